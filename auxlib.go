@@ -22,9 +22,15 @@
 package lua
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
 	"strconv"
+	"strings"
 	"unsafe"
 
 	"zombiezen.com/go/lua/internal/lua54"
@@ -50,6 +56,25 @@ func Metafield(l *State, obj int, event string) Type {
 	return tt
 }
 
+// TypeName returns the name of the type of the value at the given index
+// for use in messages.
+// If the value has a metatable with a string __name field
+// (like the metatables created by [NewMetatable]),
+// then TypeName returns that name.
+// Otherwise, TypeName returns the name of the value's basic type.
+func TypeName(l *State, idx int) string {
+	tt := Metafield(l, idx, "__name")
+	if tt == TypeString {
+		name, _ := l.ToString(-1)
+		l.Pop(1)
+		return name
+	}
+	if tt != TypeNil {
+		l.Pop(1)
+	}
+	return l.Type(idx).String()
+}
+
 // CallMeta calls a metamethod.
 //
 // If the object at index obj has a metatable and this metatable has a field event,
@@ -89,7 +114,7 @@ func ToString(l *State, idx int) (string, error) {
 			l.Pop(1)
 			return "", fmt.Errorf("lua: '__tostring' must return a string")
 		}
-		s, _ := l.ToString(idx)
+		s, _ := l.ToString(-1)
 		l.Pop(1)
 		return s, nil
 	}
@@ -114,17 +139,7 @@ func ToString(l *State, idx int) (string, error) {
 	case TypeNil:
 		return "nil", nil
 	default:
-		var kind string
-		if tt := Metafield(l, idx, "__name"); tt == TypeString {
-			kind, _ = l.ToString(-1)
-			l.Pop(1)
-		} else {
-			if tt != TypeNil {
-				l.Pop(1)
-			}
-			kind = l.Type(idx).String()
-		}
-		return fmt.Sprintf("%s: %#x", kind, l.ToPointer(idx)), nil
+		return fmt.Sprintf("%s: %#x", TypeName(l, idx), l.ToPointer(idx)), nil
 	}
 }
 
@@ -140,6 +155,17 @@ func CheckString(l *State, arg int) (string, error) {
 	return s, nil
 }
 
+// CheckNumber checks whether the function argument arg is a number
+// (or can be converted to a number)
+// and returns this number converted to a float.
+func CheckNumber(l *State, arg int) (float64, error) {
+	n, ok := l.ToNumber(arg)
+	if !ok {
+		return 0, NewTypeError(l, arg, TypeNumber.String())
+	}
+	return n, nil
+}
+
 // CheckInteger checks whether the function argument arg is an integer
 // (or can be converted to an integer)
 // and returns this integer.
@@ -154,6 +180,151 @@ func CheckInteger(l *State, arg int) (int64, error) {
 	return d, nil
 }
 
+// CheckIntRange checks whether the function argument arg is an integer
+// (or can be converted to an integer)
+// in the inclusive range [lo, hi]
+// and returns this integer.
+// The returned error mentions the range if the argument is out of bounds.
+func CheckIntRange(l *State, arg int, lo, hi int64) (int64, error) {
+	d, err := CheckInteger(l, arg)
+	if err != nil {
+		return 0, err
+	}
+	if !(lo <= d && d <= hi) {
+		return 0, NewArgError(l, arg, fmt.Sprintf("integer %d out of range [%d, %d]", d, lo, hi))
+	}
+	return d, nil
+}
+
+// CheckInt checks whether the function argument arg is an integer
+// (or can be converted to an integer)
+// that fits in an int
+// and returns this integer.
+func CheckInt(l *State, arg int) (int, error) {
+	d, err := CheckIntRange(l, arg, math.MinInt, math.MaxInt)
+	return int(d), err
+}
+
+// CheckInt32 checks whether the function argument arg is an integer
+// (or can be converted to an integer)
+// that fits in an int32
+// and returns this integer.
+func CheckInt32(l *State, arg int) (int32, error) {
+	d, err := CheckIntRange(l, arg, math.MinInt32, math.MaxInt32)
+	return int32(d), err
+}
+
+// CheckUint checks whether the function argument arg is a non-negative integer
+// (or can be converted to a non-negative integer)
+// that fits in a uint
+// and returns this integer.
+func CheckUint(l *State, arg int) (uint, error) {
+	d, err := CheckIntRange(l, arg, 0, int64(min(math.MaxUint, math.MaxInt64)))
+	return uint(d), err
+}
+
+// CheckUint32 checks whether the function argument arg is a non-negative integer
+// (or can be converted to a non-negative integer)
+// that fits in a uint32
+// and returns this integer.
+func CheckUint32(l *State, arg int) (uint32, error) {
+	d, err := CheckIntRange(l, arg, 0, math.MaxUint32)
+	return uint32(d), err
+}
+
+// CheckBoolean checks whether the function argument arg is a boolean
+// and returns its value.
+func CheckBoolean(l *State, arg int) (bool, error) {
+	if l.Type(arg) != TypeBoolean {
+		return false, NewTypeError(l, arg, TypeBoolean.String())
+	}
+	return l.ToBoolean(arg), nil
+}
+
+// CheckAny checks whether the function has an argument of any type
+// (including nil) at position arg.
+func CheckAny(l *State, arg int) error {
+	if l.Type(arg) == TypeNone {
+		return NewArgError(l, arg, "value expected")
+	}
+	return nil
+}
+
+// CheckType checks whether the function argument arg has type tp.
+func CheckType(l *State, arg int, tp Type) error {
+	if l.Type(arg) != tp {
+		return NewTypeError(l, arg, tp.String())
+	}
+	return nil
+}
+
+// CheckOption checks whether the function argument arg is a string
+// and searches for this string in list.
+// It returns the index in list where the string was found.
+// If the argument is not a string or if the string cannot be found,
+// it returns an error.
+//
+// If def is not nil, the function uses *def as a default value
+// when there is no argument arg or when this argument is nil.
+func CheckOption(l *State, arg int, def *string, list []string) (int, error) {
+	var name string
+	if def != nil && l.IsNoneOrNil(arg) {
+		name = *def
+	} else {
+		var err error
+		name, err = CheckString(l, arg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for i, opt := range list {
+		if opt == name {
+			return i, nil
+		}
+	}
+	return 0, NewArgError(l, arg, fmt.Sprintf("invalid option '%s'", name))
+}
+
+// OptString returns the result of [CheckString]
+// if the function argument arg is a string,
+// or def if the argument is absent or nil.
+func OptString(l *State, arg int, def string) (string, error) {
+	if l.IsNoneOrNil(arg) {
+		return def, nil
+	}
+	return CheckString(l, arg)
+}
+
+// OptNumber returns the result of [CheckNumber]
+// if the function argument arg is a number,
+// or def if the argument is absent or nil.
+func OptNumber(l *State, arg int, def float64) (float64, error) {
+	if l.IsNoneOrNil(arg) {
+		return def, nil
+	}
+	return CheckNumber(l, arg)
+}
+
+// OptInteger returns the result of [CheckInteger]
+// if the function argument arg is an integer,
+// or def if the argument is absent or nil.
+func OptInteger(l *State, arg int, def int64) (int64, error) {
+	if l.IsNoneOrNil(arg) {
+		return def, nil
+	}
+	return CheckInteger(l, arg)
+}
+
+// OptBoolean returns the result of [CheckBoolean]
+// if the function argument arg is a boolean,
+// or def if the argument is absent or nil.
+func OptBoolean(l *State, arg int, def bool) (bool, error) {
+	if l.IsNoneOrNil(arg) {
+		return def, nil
+	}
+	return CheckBoolean(l, arg)
+}
+
 // NewMetatable gets or creates a table in the registry
 // to be used as a metatable for userdata.
 // If the table is created, adds the pair __name = tname,
@@ -214,6 +385,72 @@ func CheckUserdata(l *State, arg int, tname string) ([]byte, error) {
 	return data, nil
 }
 
+// LoadFS loads the file with the given name from fsys as a Lua chunk
+// without running it.
+// The chunk name is "@" followed by name,
+// so error messages and tracebacks refer to the file.
+// Like the standalone interpreter,
+// LoadFS skips a leading UTF-8 byte order mark
+// and a first line that starts with "#" (like a Unix shebang line).
+// The mode argument is the same as in [State.Load].
+//
+// As with [State.Load], if there are no errors,
+// LoadFS pushes the compiled chunk as a Lua function on top of the stack.
+// Otherwise, it pushes an error message.
+func LoadFS(l *State, fsys fs.FS, name string, mode string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		l.PushString(fmt.Sprintf("cannot open %s", name))
+		return fmt.Errorf("lua: load %s: %w", name, err)
+	}
+	defer f.Close()
+	return loadSkippingComment(l, f, name, "@"+name, mode)
+}
+
+// LoadFile loads the file with the given name from the operating system
+// as a Lua chunk without running it.
+// If name is empty, then LoadFile loads from [os.Stdin]
+// and uses the chunk name "=stdin".
+// Otherwise, LoadFile behaves like [LoadFS].
+func LoadFile(l *State, name string, mode string) error {
+	if name == "" {
+		return loadSkippingComment(l, os.Stdin, "stdin", "=stdin", mode)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		l.PushString(fmt.Sprintf("cannot open %s", name))
+		return fmt.Errorf("lua: load %s: %w", name, err)
+	}
+	defer f.Close()
+	return loadSkippingComment(l, f, name, "@"+name, mode)
+}
+
+// loadSkippingComment loads a chunk from r
+// after skipping a UTF-8 byte order mark and a first line starting with "#".
+// name is used in error messages.
+func loadSkippingComment(l *State, r io.Reader, name, chunkName, mode string) error {
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(3); string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	if c, _ := br.Peek(1); len(c) == 1 && c[0] == '#' {
+		_, err := br.ReadSlice('\n')
+		for err == bufio.ErrBufferFull {
+			_, err = br.ReadSlice('\n')
+		}
+		if err != nil && err != io.EOF {
+			l.PushString(fmt.Sprintf("cannot read %s", name))
+			return fmt.Errorf("lua: load %s: %w", name, err)
+		}
+		// Binary chunks start with an escape character.
+		if c, _ := br.Peek(1); len(c) == 0 || c[0] != '\x1b' {
+			// Add a newline to keep line numbers correct.
+			return l.Load(io.MultiReader(strings.NewReader("\n"), br), chunkName, mode)
+		}
+	}
+	return l.Load(br, chunkName, mode)
+}
+
 // Where returns a string identifying the current position of the control
 // at the given level in the call stack.
 // Typically this string has the following format (including a trailing space):
@@ -226,12 +463,153 @@ func CheckUserdata(l *State, arg int, tname string) ([]byte, error) {
 // This function is used to build a prefix for error messages.
 func Where(l *State, level int) string {
 	ar := l.Stack(level).Info("Sl")
-	if ar.CurrentLine <= 0 {
+	if ar == nil || ar.CurrentLine <= 0 {
 		return ""
 	}
 	return fmt.Sprintf("%s:%d: ", ar.ShortSource, ar.CurrentLine)
 }
 
+// Number of levels shown at the start and end of a long traceback.
+const (
+	tracebackLevels1 = 10
+	tracebackLevels2 = 11
+)
+
+// Traceback creates and pushes a traceback of the stack l1 onto the stack of l.
+// If msg is not empty, it is appended at the beginning of the traceback.
+// The level parameter tells at which level to start the traceback.
+func Traceback(l, l1 *State, msg string, level int) {
+	sb := new(strings.Builder)
+	if msg != "" {
+		sb.WriteString(msg)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("stack traceback:")
+	last := lastLevel(l1)
+	limit2show := -1
+	if last-level > tracebackLevels1+tracebackLevels2 {
+		limit2show = tracebackLevels1
+	}
+	for {
+		ar := l1.Stack(level)
+		if ar == nil {
+			break
+		}
+		level++
+		if limit2show == 0 {
+			// Too many levels.
+			n := last - level - tracebackLevels2 + 1
+			fmt.Fprintf(sb, "\n\t...\t(skipping %d levels)", n)
+			level += n
+			limit2show--
+			continue
+		}
+		limit2show--
+		db := ar.Info("Slnt")
+		if db.CurrentLine <= 0 {
+			fmt.Fprintf(sb, "\n\t%s: in ", db.ShortSource)
+		} else {
+			fmt.Fprintf(sb, "\n\t%s:%d: in ", db.ShortSource, db.CurrentLine)
+		}
+		sb.WriteString(funcName(l1, ar, db))
+		if db.IsTailCall {
+			sb.WriteString("\n\t(...tail calls...)")
+		}
+	}
+	l.PushString(sb.String())
+}
+
+// lastLevel returns the deepest valid level in l's stack.
+func lastLevel(l *State) int {
+	// Find an upper bound.
+	li, le := 1, 1
+	for l.Stack(le) != nil {
+		li = le
+		le *= 2
+	}
+	// Do a binary search.
+	for li < le {
+		m := (li + le) / 2
+		if l.Stack(m) != nil {
+			li = m + 1
+		} else {
+			le = m
+		}
+	}
+	return le - 1
+}
+
+// funcName returns a description of the function
+// for the activation record ar in l's stack,
+// as used in a traceback.
+// db must have been filled in with at least "Sn".
+func funcName(l *State, ar *ActivationRecord, db *Debug) string {
+	if name := globalFuncName(l, ar); name != "" {
+		return fmt.Sprintf("function '%s'", name)
+	}
+	switch {
+	case db.NameWhat != "":
+		return fmt.Sprintf("%s '%s'", db.NameWhat, db.Name)
+	case db.What == "main":
+		return "main chunk"
+	case db.What != "C":
+		return fmt.Sprintf("function <%s:%d>", db.ShortSource, db.LineDefined)
+	default:
+		return "?"
+	}
+}
+
+// globalFuncName searches the loaded modules table
+// for the function of the activation record ar in l's stack,
+// returning its name in the form "module.name"
+// (or just "name" for functions in the global table).
+// It returns the empty string if the function was not found.
+func globalFuncName(l *State, ar *ActivationRecord) string {
+	if !l.CheckStack(5) {
+		return ""
+	}
+	top := l.Top()
+	defer l.SetTop(top)
+	ar.Info("f") // push function
+	fn := l.Top()
+	if l.RawField(RegistryIndex, LoadedTable) != TypeTable {
+		return ""
+	}
+	loaded := l.Top()
+	l.PushNil()
+	for l.Next(loaded) {
+		if l.Type(-2) == TypeString && l.Type(-1) == TypeTable {
+			l.PushNil()
+			for l.Next(-2) {
+				if l.Type(-2) == TypeString && l.RawEqual(-1, fn) {
+					modName, _ := l.ToString(-4)
+					name, _ := l.ToString(-2)
+					if modName == GName {
+						return name
+					}
+					return modName + "." + name
+				}
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+	}
+	return ""
+}
+
+// Gsub creates a copy of the string s,
+// replacing any occurrence of the string pattern with the string replacement.
+// (Unlike string.gsub, pattern is a literal string, not a Lua pattern.)
+// If pattern is empty, the copy is identical to s.
+// Gsub pushes the resulting string on the stack and returns it.
+func Gsub(l *State, s, pattern, replacement string) string {
+	if pattern != "" {
+		s = strings.ReplaceAll(s, pattern, replacement)
+	}
+	l.PushString(s)
+	return s
+}
+
 // Len returns the "length" of the value at the given index as an integer.
 // It is similar to
 func Len(l *State, idx int) (int64, error) {
@@ -350,37 +728,45 @@ func Require(l *State, modName string, global bool, openf Function) error {
 // NewArgError returns a new error reporting a problem with argument arg
 // of the Go function that called it,
 // using a standard message that includes msg as a comment.
+// If returned from a [Function], the error is raised as a string
+// even if [CaptureGoError] is set.
 func NewArgError(l *State, arg int, msg string) error {
 	ar := l.Stack(0).Info("n")
 	if ar == nil {
 		// No stack frame.
-		return fmt.Errorf("%sbad argument #%d (%s)", Where(l, 1), arg, msg)
+		return luaErrorf("%sbad argument #%d (%s)", Where(l, 1), arg, msg)
 	}
 	if ar.NameWhat == "method" {
 		arg-- // do not count 'self'
 		if arg == 0 {
 			// Error is in the self argument itself.
-			return fmt.Errorf("%scalling '%s' on bad self (%s)", Where(l, 1), ar.Name, msg)
+			return luaErrorf("%scalling '%s' on bad self (%s)", Where(l, 1), ar.Name, msg)
 		}
 	}
 	if ar.Name == "" {
-		// TODO(someday): Find global function.
-		ar.Name = "?"
+		ar.Name = globalFuncName(l, l.Stack(0))
+		if ar.Name == "" {
+			ar.Name = "?"
+		}
 	}
-	return fmt.Errorf("%sbad argument #%d to '%s' (%s)", Where(l, 1), arg, ar.Name, msg)
+	return luaErrorf("%sbad argument #%d to '%s' (%s)", Where(l, 1), arg, ar.Name, msg)
+}
+
+// luaErrorf formats an error that a [Function] raises in Lua as a plain string,
+// like the errors raised by Lua's C libraries,
+// even if [CaptureGoError] is set.
+// As with [fmt.Errorf], the %w verb wraps an error.
+func luaErrorf(format string, args ...any) error {
+	return lua54.MessageError{Err: fmt.Errorf(format, args...)}
 }
 
 // NewTypeError returns a new type error for the argument arg
 // of the Go function that called it, using a standard message;
 // tname is a "name" for the expected type.
 func NewTypeError(l *State, arg int, tname string) error {
-	var typeArg string
-	if Metafield(l, arg, "__name") == TypeString {
-		typeArg, _ = l.ToString(-1)
-	} else if tp := l.Type(arg); tp == TypeLightUserdata {
+	typeArg := TypeName(l, arg)
+	if l.Type(arg) == TypeLightUserdata {
 		typeArg = "light userdata"
-	} else {
-		typeArg = tp.String()
 	}
 	return NewArgError(l, arg, fmt.Sprintf("%s expected, got %s", tname, typeArg))
 }
@@ -21,7 +21,16 @@
 
 package lua
 
-import "testing"
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
 
 func TestLen(t *testing.T) {
 	state := new(State)
@@ -75,3 +84,385 @@ func TestWhere(t *testing.T) {
 		t.Errorf("result = %q; want %q", got, want)
 	}
 }
+
+func TestGsub(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	tests := []struct {
+		s, pattern, replacement string
+		want                    string
+	}{
+		{"./?.lua;./?/init.lua", "?", "foo/bar", "./foo/bar.lua;./foo/bar/init.lua"},
+		{"a.b.c", ".", "/", "a/b/c"},
+		{"%d", "%", "%%", "%%d"},
+		{"abc", "", "x", "abc"},
+	}
+	for _, test := range tests {
+		got := Gsub(state, test.s, test.pattern, test.replacement)
+		if got != test.want {
+			t.Errorf("Gsub(state, %q, %q, %q) = %q; want %q",
+				test.s, test.pattern, test.replacement, got, test.want)
+		}
+		if pushed, _ := state.ToString(-1); pushed != test.want {
+			t.Errorf("Gsub(state, %q, %q, %q) pushed %q; want %q",
+				test.s, test.pattern, test.replacement, pushed, test.want)
+		}
+		state.Pop(1)
+	}
+}
+
+func TestLoadFS(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		"scripts/hello.lua": {Data: []byte("#!/usr/bin/env lua\nreturn 'hello'\n")},
+		"scripts/bom.lua":   {Data: []byte("\xef\xbb\xbfreturn 'bom'\n")},
+		"scripts/error.lua": {Data: []byte("#!/usr/bin/env lua\n\nerror('bork')\n")},
+	}
+	for name, want := range map[string]string{"scripts/hello.lua": "hello", "scripts/bom.lua": "bom"} {
+		if err := LoadFS(state, fsys, name, "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := state.ToString(-1); got != want {
+			t.Errorf("%s returned %q; want %q", name, got, want)
+		}
+		state.Pop(1)
+	}
+
+	if err := LoadFS(state, fsys, "scripts/error.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err == nil {
+		t.Error("error.lua did not raise an error")
+	} else if got, want := err.Error(), "scripts/error.lua:3: bork"; !strings.Contains(got, want) {
+		t.Errorf("error.lua error = %q; want to contain %q", got, want)
+	}
+	state.SetTop(0)
+
+	if err := LoadFS(state, fsys, "nonexistent.lua", "t"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadFS(state, fsys, \"nonexistent.lua\", \"t\") = %v; want %v", err, fs.ErrNotExist)
+	}
+	if got, want := state.Top(), 1; got != want {
+		t.Errorf("after failed LoadFS, state.Top() = %d; want %d", got, want)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	name := filepath.Join(t.TempDir(), "script.lua")
+	if err := os.WriteFile(name, []byte("#!/usr/bin/env lua\nreturn debug and 1 or 2\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadFile(state, name, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToInteger(-1); got != 2 {
+		t.Errorf("script returned %d; want 2", got)
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	state.PushInteger(42)
+	if got, want := TypeName(state, -1), "number"; got != want {
+		t.Errorf("TypeName(state, -1) for 42 = %q; want %q", got, want)
+	}
+	state.NewUserdataUV(0, 0)
+	if got, want := TypeName(state, -1), "userdata"; got != want {
+		t.Errorf("TypeName(state, -1) for plain userdata = %q; want %q", got, want)
+	}
+	NewMetatable(state, "widget")
+	state.SetMetatable(-2)
+	if got, want := TypeName(state, -1), "widget"; got != want {
+		t.Errorf("TypeName(state, -1) for widget = %q; want %q", got, want)
+	}
+	if got, want := state.Top(), 2; got != want {
+		t.Errorf("state.Top() = %d; want %d", got, want)
+	}
+}
+
+func TestTraceback(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	state.PushClosure(0, func(l *State) (int, error) {
+		Traceback(l, l, "hello", 1)
+		return 1, nil
+	})
+	if err := state.SetGlobal("trace", 0); err != nil {
+		t.Fatal(err)
+	}
+	const luaCode = "local function f()\n" +
+		"  local s = trace()\n" +
+		"  return s\n" +
+		"end\n" +
+		"return (f())\n"
+	if err := state.LoadString(luaCode, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := state.ToString(-1)
+	const want = "hello\n" +
+		"stack traceback:\n" +
+		"\t(load):2: in local 'f'\n" +
+		"\t(load):5: in main chunk"
+	if got != want {
+		t.Errorf("traceback = %q; want %q", got, want)
+	}
+}
+
+func TestCheckIntRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     int64
+		check   func(l *State) error
+		wantErr string
+	}{
+		{
+			name: "Int32InRange",
+			arg:  math.MaxInt32,
+			check: func(l *State) error {
+				_, err := CheckInt32(l, 1)
+				return err
+			},
+		},
+		{
+			name: "Int32Overflow",
+			arg:  math.MaxInt32 + 1,
+			check: func(l *State) error {
+				_, err := CheckInt32(l, 1)
+				return err
+			},
+			wantErr: "integer 2147483648 out of range [-2147483648, 2147483647]",
+		},
+		{
+			name: "Uint32Negative",
+			arg:  -1,
+			check: func(l *State) error {
+				_, err := CheckUint32(l, 1)
+				return err
+			},
+			wantErr: "integer -1 out of range [0, 4294967295]",
+		},
+		{
+			name: "UintNegative",
+			arg:  -1,
+			check: func(l *State) error {
+				_, err := CheckUint(l, 1)
+				return err
+			},
+			wantErr: "out of range",
+		},
+		{
+			name: "CustomRange",
+			arg:  11,
+			check: func(l *State) error {
+				_, err := CheckIntRange(l, 1, 1, 10)
+				return err
+			},
+			wantErr: "integer 11 out of range [1, 10]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := new(State)
+			defer func() {
+				if err := state.Close(); err != nil {
+					t.Error("Close:", err)
+				}
+			}()
+
+			state.PushClosure(0, func(l *State) (int, error) {
+				return 0, test.check(l)
+			})
+			state.PushInteger(test.arg)
+			err := state.Call(1, 0, 0)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Error("Call:", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("Call did not return an error; want %q", test.wantErr)
+			} else if got := err.Error(); !strings.Contains(got, test.wantErr) {
+				t.Errorf("Call error = %q; want to contain %q", got, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		check   func(l *State) (any, error)
+		want    any
+		wantErr string
+	}{
+		{
+			name:   "NumberOK",
+			source: "return f('2.5')",
+			check:  func(l *State) (any, error) { return CheckNumber(l, 1) },
+			want:   2.5,
+		},
+		{
+			name:    "NumberWrongType",
+			source:  "return f({})",
+			check:   func(l *State) (any, error) { return CheckNumber(l, 1) },
+			wantErr: "bad argument #1 to 'f' (number expected, got table)",
+		},
+		{
+			name:   "BooleanOK",
+			source: "return f(true)",
+			check:  func(l *State) (any, error) { return CheckBoolean(l, 1) },
+			want:   true,
+		},
+		{
+			name:    "BooleanWrongType",
+			source:  "return f(1)",
+			check:   func(l *State) (any, error) { return CheckBoolean(l, 1) },
+			wantErr: "bad argument #1 to 'f' (boolean expected, got number)",
+		},
+		{
+			name:   "AnyNil",
+			source: "return f(nil)",
+			check:  func(l *State) (any, error) { return nil, CheckAny(l, 1) },
+		},
+		{
+			name:    "AnyMissing",
+			source:  "return f()",
+			check:   func(l *State) (any, error) { return nil, CheckAny(l, 1) },
+			wantErr: "bad argument #1 to 'f' (value expected)",
+		},
+		{
+			name:    "TypeMismatch",
+			source:  "return f('x')",
+			check:   func(l *State) (any, error) { return nil, CheckType(l, 1, TypeTable) },
+			wantErr: "bad argument #1 to 'f' (table expected, got string)",
+		},
+		{
+			name:   "OptionDefault",
+			source: "return f()",
+			check: func(l *State) (any, error) {
+				def := "b"
+				return CheckOption(l, 1, &def, []string{"a", "b"})
+			},
+			want: 1,
+		},
+		{
+			name:   "OptionInvalid",
+			source: "return f('c')",
+			check: func(l *State) (any, error) {
+				return CheckOption(l, 1, nil, []string{"a", "b"})
+			},
+			wantErr: "bad argument #1 to 'f' (invalid option 'c')",
+		},
+		{
+			name:   "OptStringDefault",
+			source: "return f(nil)",
+			check:  func(l *State) (any, error) { return OptString(l, 1, "def") },
+			want:   "def",
+		},
+		{
+			name:   "OptNumberValue",
+			source: "return f(2.5)",
+			check:  func(l *State) (any, error) { return OptNumber(l, 1, 1) },
+			want:   2.5,
+		},
+		{
+			name:   "OptIntegerDefault",
+			source: "return f()",
+			check:  func(l *State) (any, error) { return OptInteger(l, 1, 7) },
+			want:   int64(7),
+		},
+		{
+			name:    "OptIntegerWrongType",
+			source:  "return f({})",
+			check:   func(l *State) (any, error) { return OptInteger(l, 1, 7) },
+			wantErr: "bad argument #1 to 'f' (number expected, got table)",
+		},
+		{
+			name:   "OptBooleanDefault",
+			source: "return f()",
+			check:  func(l *State) (any, error) { return OptBoolean(l, 1, true) },
+			want:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := new(State)
+			defer func() {
+				if err := state.Close(); err != nil {
+					t.Error("Close:", err)
+				}
+			}()
+
+			var got any
+			state.PushClosure(0, func(l *State) (int, error) {
+				var err error
+				got, err = test.check(l)
+				return 0, err
+			})
+			if err := state.SetGlobal("f", 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := state.LoadString(test.source, "=(load)", "t"); err != nil {
+				t.Fatal(err)
+			}
+			err := state.Call(0, 0, 0)
+			if test.wantErr != "" {
+				if err == nil {
+					t.Errorf("Call did not return an error; want %q", test.wantErr)
+				} else if got := err.Error(); !strings.Contains(got, test.wantErr) {
+					t.Errorf("Call error = %q; want to contain %q", got, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Call:", err)
+			}
+			if got != test.want {
+				t.Errorf("result = %#v; want %#v", got, test.want)
+			}
+		})
+	}
+}
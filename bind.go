@@ -0,0 +1,403 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// PushStruct pushes a userdata onto the stack
+// that is bound to the struct that ptr points to.
+// ptr must be a non-nil pointer to a struct.
+// The userdata keeps ptr alive until it is garbage collected.
+//
+// Indexing the userdata reads the struct's exported fields
+// and assigning to an index sets them.
+// Fields are named and excluded the same way as in [Unmarshal],
+// and a field whose "lua" tag has the "readonly" option
+// (like `lua:"name,readonly"`) cannot be assigned from Lua.
+// Field values are converted as in [PushAny],
+// except that struct fields and non-nil pointer-to-struct fields
+// are themselves pushed as bound userdata,
+// so nested fields can be modified in place (e.g. cfg.Server.Port = 8080).
+// Assigned values are converted as in [Unmarshal].
+//
+// Exported methods of the pointer type are available as functions
+// intended to be called with method syntax (obj:Method(...)).
+// Method arguments and results are converted as described in [Wrap].
+// Fields take precedence over methods with the same name.
+//
+// Two userdata bound to the same pointer compare equal,
+// and tostring uses the String method if the pointer type has one.
+func PushStruct(l *State, ptr any) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Pointer || v.Type().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("lua: push struct: %T is not a pointer to a struct", ptr)
+	}
+	if v.IsNil() {
+		return fmt.Errorf("lua: push struct: nil %T", ptr)
+	}
+	if err := pushBoundStruct(l, v); err != nil {
+		return fmt.Errorf("lua: push struct: %v", err)
+	}
+	return nil
+}
+
+// TestStruct returns the pointer bound to the userdata at the given index
+// by [PushStruct].
+// TestStruct returns nil if the value is not a userdata
+// bound to a *T.
+func TestStruct[T any](l *State, idx int) *T {
+	t := reflect.TypeOf((*T)(nil))
+	if t.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	v := testBoundStruct(l, idx, bindingFor(t))
+	if !v.IsValid() {
+		return nil
+	}
+	p, _ := v.Interface().(*T)
+	return p
+}
+
+// CheckStruct returns the pointer bound to the given function argument
+// by [PushStruct].
+// CheckStruct returns an error if the argument is not a userdata
+// bound to a *T.
+func CheckStruct[T any](l *State, arg int) (*T, error) {
+	p := TestStruct[T](l, arg)
+	if p == nil {
+		return nil, NewTypeError(l, arg, reflect.TypeOf((*T)(nil)).String())
+	}
+	return p, nil
+}
+
+// Wrap returns a [Function] that calls the Go function fn
+// with its Lua arguments converted to fn's parameter types.
+// Wrap panics if fn is not a function.
+//
+// Arguments are converted as in [Unmarshal],
+// with missing arguments treated as nil.
+// Userdata created by [PushStruct] are also accepted
+// for struct parameters (which receive a copy)
+// and pointer-to-struct parameters.
+// A *State parameter receives the calling state
+// without consuming an argument.
+// If fn is variadic, the remaining arguments are converted
+// to the variadic parameter's element type.
+// Extra arguments are ignored.
+// If an argument cannot be converted,
+// the Function returns an error naming the bad argument.
+//
+// If fn's last result is an error, it is not pushed:
+// a non-nil error is returned from the Function instead
+// (raising a Lua error).
+// Non-nil pointers to structs are pushed with [PushStruct],
+// and the other results are converted as in [PushAny].
+func Wrap(fn any) Function {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		panic(fmt.Errorf("lua: wrap: %T is not a function", fn))
+	}
+	if v.IsNil() {
+		panic(fmt.Errorf("lua: wrap: nil %T", fn))
+	}
+	return func(l *State) (int, error) {
+		return callReflect(l, v, nil, 1)
+	}
+}
+
+// structBinding holds the information needed
+// to expose a pointer-to-struct type to Lua.
+type structBinding struct {
+	typ     reflect.Type // pointer to struct
+	tname   string
+	fields  map[string]structField
+	methods map[string]reflect.Method
+}
+
+// structBindings is a cache of *structBinding values keyed by reflect.Type.
+var structBindings sync.Map
+
+// bindingFor returns the binding for the pointer-to-struct type t.
+func bindingFor(t reflect.Type) *structBinding {
+	if b, ok := structBindings.Load(t); ok {
+		return b.(*structBinding)
+	}
+	b := &structBinding{
+		typ:     t,
+		tname:   fmt.Sprintf("*zombiezen.com/go/lua.struct(%v)", t),
+		fields:  make(map[string]structField),
+		methods: make(map[string]reflect.Method),
+	}
+	for _, f := range structFields(t.Elem()) {
+		b.fields[f.name] = f
+	}
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if _, isField := b.fields[m.Name]; !isField {
+			b.methods[m.Name] = m
+		}
+	}
+	actual, _ := structBindings.LoadOrStore(t, b)
+	return actual.(*structBinding)
+}
+
+// pushBoundStruct pushes a userdata bound to the non-nil pointer-to-struct v.
+func pushBoundStruct(l *State, v reflect.Value) error {
+	b := bindingFor(v.Type())
+	if err := b.createMetatable(l); err != nil {
+		return err
+	}
+	return NewUserdata(l, v, b.tname)
+}
+
+// testBoundStruct returns the pointer bound to the userdata at the given index
+// or the zero Value if the value is not bound to b's type.
+func testBoundStruct(l *State, idx int, b *structBinding) reflect.Value {
+	p := TestTypedUserdata[reflect.Value](l, idx, b.tname)
+	if p == nil || p.Type() != b.typ {
+		return reflect.Value{}
+	}
+	return *p
+}
+
+func (b *structBinding) createMetatable(l *State) error {
+	if !NewMetatable(l, b.tname) {
+		l.Pop(1)
+		return nil
+	}
+	err := SetFuncs(l, 0, map[string]Function{
+		"__index":     b.index,
+		"__newindex":  b.newIndex,
+		"__eq":        b.eq,
+		"__tostring":  b.tostring,
+		"__metatable": nil, // prevent access to metatable
+	})
+	if err != nil {
+		l.Pop(1)
+		return err
+	}
+	// Use the Go type name in error messages.
+	l.PushString(b.typ.String())
+	l.RawSetField(-2, "__name")
+	l.Pop(1)
+	return nil
+}
+
+func (b *structBinding) check(l *State) (reflect.Value, error) {
+	v := testBoundStruct(l, 1, b)
+	if !v.IsValid() {
+		return reflect.Value{}, NewTypeError(l, 1, b.typ.String())
+	}
+	return v, nil
+}
+
+func (b *structBinding) index(l *State) (int, error) {
+	v, err := b.check(l)
+	if err != nil {
+		return 0, err
+	}
+	if l.Type(2) != TypeString {
+		l.PushNil()
+		return 1, nil
+	}
+	key, _ := l.ToString(2)
+	if f, ok := b.fields[key]; ok {
+		fv, err := v.Elem().FieldByIndexErr(f.index)
+		if err != nil {
+			return 0, fmt.Errorf("%sfield '%s' of %v: %v", Where(l, 1), key, b.typ, err)
+		}
+		if err := pushReflectValue(l, fv); err != nil {
+			return 0, fmt.Errorf("%s%v", Where(l, 1), prependPath(err, fieldSegment(key)))
+		}
+		return 1, nil
+	}
+	if m, ok := b.methods[key]; ok {
+		l.PushClosure(0, b.method(m))
+		return 1, nil
+	}
+	l.PushNil()
+	return 1, nil
+}
+
+func (b *structBinding) newIndex(l *State) (int, error) {
+	v, err := b.check(l)
+	if err != nil {
+		return 0, err
+	}
+	if l.Type(2) != TypeString {
+		return 0, fmt.Errorf("%sinvalid %v key for %v", Where(l, 1), l.Type(2), b.typ)
+	}
+	key, _ := l.ToString(2)
+	f, ok := b.fields[key]
+	if !ok {
+		return 0, fmt.Errorf("%sno field '%s' in %v", Where(l, 1), key, b.typ)
+	}
+	if f.readOnly {
+		return 0, fmt.Errorf("%sfield '%s' of %v is read-only", Where(l, 1), key, b.typ)
+	}
+	fv, err := v.Elem().FieldByIndexErr(f.index)
+	if err != nil {
+		return 0, fmt.Errorf("%sfield '%s' of %v: %v", Where(l, 1), key, b.typ, err)
+	}
+	newValue, err := toReflectValue(l, 3, fv.Type())
+	if err != nil {
+		return 0, fmt.Errorf("%sset %v: %v", Where(l, 1), b.typ, prependPath(err, fieldSegment(key)))
+	}
+	fv.Set(newValue)
+	return 0, nil
+}
+
+func (b *structBinding) eq(l *State) (int, error) {
+	v1 := testBoundStruct(l, 1, b)
+	v2 := testBoundStruct(l, 2, b)
+	l.PushBoolean(v1.IsValid() && v2.IsValid() && v1.Pointer() == v2.Pointer())
+	return 1, nil
+}
+
+func (b *structBinding) tostring(l *State) (int, error) {
+	v, err := b.check(l)
+	if err != nil {
+		return 0, err
+	}
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		l.PushString(s.String())
+	} else {
+		l.PushString(fmt.Sprintf("%v: %#x", b.typ, v.Pointer()))
+	}
+	return 1, nil
+}
+
+func (b *structBinding) method(m reflect.Method) Function {
+	return func(l *State) (int, error) {
+		v := testBoundStruct(l, 1, b)
+		if !v.IsValid() {
+			return 0, NewTypeError(l, 1, b.typ.String())
+		}
+		return callReflect(l, m.Func, []reflect.Value{v}, 2)
+	}
+}
+
+// pushReflectValue pushes v onto the stack,
+// binding structs and non-nil pointers to structs with [PushStruct]
+// and converting other values as in [PushAny].
+func pushReflectValue(l *State, v reflect.Value) error {
+	switch {
+	case v.Kind() == reflect.Struct && v.CanAddr():
+		return pushBoundStruct(l, v.Addr())
+	case v.Kind() == reflect.Pointer && v.Type().Elem().Kind() == reflect.Struct && !v.IsNil():
+		return pushBoundStruct(l, v)
+	default:
+		return pushValue(l, v, 0)
+	}
+}
+
+// toReflectValue converts the Lua value at the given index
+// to a new value of type t.
+// Userdata bound with [PushStruct] are accepted for structs
+// (which are copied) and pointers to structs.
+// Other values are converted as in [Unmarshal].
+func toReflectValue(l *State, idx int, t reflect.Type) (reflect.Value, error) {
+	switch {
+	case t.Kind() == reflect.Struct:
+		if p := testBoundStruct(l, idx, bindingFor(reflect.PointerTo(t))); p.IsValid() {
+			return p.Elem(), nil
+		}
+	case t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct:
+		if p := testBoundStruct(l, idx, bindingFor(t)); p.IsValid() {
+			return p, nil
+		}
+	}
+	if l.IsNone(idx) {
+		// Convert missing arguments like nil.
+		l.PushNil()
+		defer l.Pop(1)
+		idx = -1
+	}
+	v := reflect.New(t).Elem()
+	if err := unmarshalValue(l, l.AbsIndex(idx), v, 0); err != nil {
+		return reflect.Value{}, err
+	}
+	return v, nil
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	stateType = reflect.TypeOf((*State)(nil))
+)
+
+// callReflect calls the Go function fn
+// with the leading arguments followed by the function arguments on the stack,
+// starting at firstArg.
+// It pushes fn's results onto the stack and returns the number of results.
+// See [Wrap] for details on conversions.
+func callReflect(l *State, fn reflect.Value, leading []reflect.Value, firstArg int) (int, error) {
+	ft := fn.Type()
+	args := make([]reflect.Value, 0, ft.NumIn())
+	args = append(args, leading...)
+	arg := firstArg
+	for i := len(leading); i < ft.NumIn(); i++ {
+		t := ft.In(i)
+		if t == stateType {
+			args = append(args, reflect.ValueOf(l))
+			continue
+		}
+		if ft.IsVariadic() && i == ft.NumIn()-1 {
+			for ; arg <= l.Top(); arg++ {
+				v, err := toReflectValue(l, arg, t.Elem())
+				if err != nil {
+					return 0, NewArgError(l, arg, err.Error())
+				}
+				args = append(args, v)
+			}
+			break
+		}
+		v, err := toReflectValue(l, arg, t)
+		if err != nil {
+			return 0, NewArgError(l, arg, err.Error())
+		}
+		args = append(args, v)
+		arg++
+	}
+
+	results := fn.Call(args)
+	if n := len(results); n > 0 && ft.Out(n-1) == errorType {
+		if err, _ := results[n-1].Interface().(error); err != nil {
+			return 0, err
+		}
+		results = results[:n-1]
+	}
+	if !l.CheckStack(len(results)) {
+		return 0, errors.New("stack overflow (too many results)")
+	}
+	for i, r := range results {
+		if err := pushReflectValue(l, r); err != nil {
+			l.Pop(i)
+			return 0, fmt.Errorf("%sresult #%d: %v", Where(l, 1), i+1, err)
+		}
+	}
+	return len(results), nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type bindTestServer struct {
+	Host string
+	Port int `lua:"port"`
+}
+
+type bindTestConfig struct {
+	Name    string
+	Retries int      `lua:"retries"`
+	Version string   `lua:"version,readonly"`
+	Tags    []string `lua:"tags"`
+	Secret  string   `lua:"-"`
+	Server  bindTestServer
+	Backup  *bindTestServer
+	hidden  int
+}
+
+func (c *bindTestConfig) Greet(greeting string, times int) string {
+	return strings.Repeat(greeting+", "+c.Name+"!", times)
+}
+
+func (c *bindTestConfig) AddTags(tags ...string) int {
+	c.Tags = append(c.Tags, tags...)
+	return len(c.Tags)
+}
+
+func (c *bindTestConfig) Validate() error {
+	if c.Retries < 0 {
+		return errors.New("retries must be non-negative")
+	}
+	return nil
+}
+
+func (c *bindTestConfig) Primary() *bindTestServer {
+	return &c.Server
+}
+
+func (s *bindTestServer) String() string {
+	return fmt.Sprintf("%s:%d", s.Host, s.Port)
+}
+
+func TestPushStruct(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+
+	cfg := &bindTestConfig{
+		Name:    "example",
+		Retries: 3,
+		Version: "1.0",
+		Secret:  "xyzzy",
+		Server:  bindTestServer{Host: "localhost", Port: 80},
+		hidden:  42,
+	}
+	if err := PushStruct(state, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := TestStruct[bindTestConfig](state, -1); got != cfg {
+		t.Errorf("TestStruct[bindTestConfig](state, -1) = %p; want %p", got, cfg)
+	}
+	if got := TestStruct[bindTestServer](state, -1); got != nil {
+		t.Errorf("TestStruct[bindTestServer](state, -1) = %p; want <nil>", got)
+	}
+	if err := state.SetGlobal("cfg", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source  string
+		wantErr string
+	}{
+		{source: `assert(cfg.Name == "example")`},
+		{source: `assert(cfg.retries == 3)`},
+		{source: `assert(cfg.Retries == nil)`},
+		{source: `assert(cfg.version == "1.0")`},
+		{source: `assert(cfg.Secret == nil)`},
+		{source: `assert(cfg.hidden == nil)`},
+		{source: `assert(cfg.Backup == nil)`},
+		{source: `assert(cfg.Server.Host == "localhost")`},
+		{source: `cfg.Name = "renamed"`},
+		{source: `cfg.retries = 5`},
+		{source: `cfg.Server.port = 8080`},
+		{source: `cfg.tags = {"a", "b"}`},
+		{source: `assert(cfg:AddTags("c", "d") == 4)`},
+		{source: `assert(cfg:Greet("Hi", 2) == "Hi, renamed!Hi, renamed!")`},
+		{source: `assert(cfg.Server == cfg:Primary())`},
+		{source: `assert(tostring(cfg.Server) == "localhost:8080")`},
+		{source: `assert(cfg:Validate() == nil)`},
+		{
+			source:  `cfg.version = "2.0"`,
+			wantErr: "read-only",
+		},
+		{
+			source:  `cfg.Missing = 1`,
+			wantErr: "no field 'Missing'",
+		},
+		{
+			source:  `cfg.retries = "many"`,
+			wantErr: "retries: cannot unmarshal string into int",
+		},
+		{
+			source:  `cfg:Greet("Hi")`,
+			wantErr: "bad argument #2 to 'Greet'",
+		},
+		{
+			source:  `cfg.Greet(cfg.Server, "Hi", 1)`,
+			wantErr: "bad argument #1",
+		},
+		{
+			source:  `cfg.retries = -1; cfg:Validate()`,
+			wantErr: "retries must be non-negative",
+		},
+		{source: `cfg.Backup = cfg.Server; cfg.Backup.Host = "backup"`},
+	}
+	for _, test := range tests {
+		if err := state.LoadString(test.source, "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		err := state.Call(0, 0, 0)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", test.source, err)
+		case test.wantErr != "" && err == nil:
+			t.Errorf("%s did not raise an error", test.source)
+		case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+			t.Errorf("%s: %v; want error containing %q", test.source, err, test.wantErr)
+		}
+	}
+
+	if cfg.Name != "renamed" {
+		t.Errorf("cfg.Name = %q; want \"renamed\"", cfg.Name)
+	}
+	if cfg.Retries != -1 {
+		t.Errorf("cfg.Retries = %d; want -1", cfg.Retries)
+	}
+	if cfg.Version != "1.0" {
+		t.Errorf("cfg.Version = %q; want \"1.0\"", cfg.Version)
+	}
+	if got, want := strings.Join(cfg.Tags, ","), "a,b,c,d"; got != want {
+		t.Errorf("cfg.Tags = %q; want %q", got, want)
+	}
+	if cfg.Server.Port != 8080 {
+		t.Errorf("cfg.Server.Port = %d; want 8080", cfg.Server.Port)
+	}
+	if cfg.Backup != &cfg.Server {
+		t.Errorf("cfg.Backup = %p; want %p", cfg.Backup, &cfg.Server)
+	}
+
+	if err := PushStruct(state, bindTestConfig{}); err == nil {
+		t.Error("PushStruct(state, bindTestConfig{}) did not return an error")
+	}
+	if err := PushStruct(state, (*bindTestConfig)(nil)); err == nil {
+		t.Error("PushStruct(state, (*bindTestConfig)(nil)) did not return an error")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+
+	funcs := map[string]any{
+		"add": func(a, b int64) int64 { return a + b },
+		"join": func(sep string, parts ...string) string {
+			return strings.Join(parts, sep)
+		},
+		"keys": func(m map[string]int) []string {
+			var keys []string
+			for k := range m {
+				keys = append(keys, k)
+			}
+			return keys
+		},
+		"describe": func(x any, flag bool, f float64) string {
+			return fmt.Sprintf("%v %t %g", x, flag, f)
+		},
+		"divide": func(a, b float64) (float64, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		},
+		"optional": func(p *string) string {
+			if p == nil {
+				return "none"
+			}
+			return *p
+		},
+		"top": func(l *State, x int) int { return l.Top()*100 + x },
+		"newServer": func(host string, port int) *bindTestServer {
+			return &bindTestServer{Host: host, Port: port}
+		},
+		"serverPort": func(s bindTestServer) int { return s.Port },
+		"nothing":    func() {},
+	}
+	for name, fn := range funcs {
+		state.PushClosure(0, Wrap(fn))
+		if err := state.SetGlobal(name, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		source  string
+		wantErr string
+	}{
+		{source: `assert(add(2, 3) == 5)`},
+		{source: `assert(add(2, 3, 4) == 5)`},
+		{source: `assert(join(",", "a", "b", "c") == "a,b,c")`},
+		{source: `assert(join("-") == "")`},
+		{source: `assert(keys({x = 1})[1] == "x")`},
+		{source: `assert(describe("s", true, 1.5) == "s true 1.5")`},
+		{source: `assert(divide(1, 4) == 0.25)`},
+		{source: `assert(optional() == "none")`},
+		{source: `assert(optional("x") == "x")`},
+		{source: `assert(top(7) == 107)`},
+		{source: `local s = newServer("example.com", 443); s.port = 8443; assert(serverPort(s) == 8443)`},
+		{source: `assert(serverPort({Host = "h", port = 1}) == 1)`},
+		{source: `assert(select("#", nothing()) == 0)`},
+		{
+			source:  `add(1)`,
+			wantErr: "bad argument #2 to 'add' (cannot unmarshal nil into int64)",
+		},
+		{
+			source:  `add(1.5, 2)`,
+			wantErr: "bad argument #1 to 'add'",
+		},
+		{
+			source:  `join(",", "a", {})`,
+			wantErr: "bad argument #3 to 'join'",
+		},
+		{
+			source:  `divide(1, 0)`,
+			wantErr: "division by zero",
+		},
+	}
+	for _, test := range tests {
+		if err := state.LoadString(test.source, "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		err := state.Call(0, 0, 0)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", test.source, err)
+		case test.wantErr != "" && err == nil:
+			t.Errorf("%s did not raise an error", test.source)
+		case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+			t.Errorf("%s: %v; want error containing %q", test.source, err, test.wantErr)
+		}
+	}
+}
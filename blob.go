@@ -0,0 +1,244 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/cgo"
+	"unsafe"
+)
+
+const blobMetatableName = "*zombiezen.com/go/lua.blob"
+
+// PushBlob pushes a Lua blob object onto the stack
+// that references b without copying it.
+// Blobs are intended for large payloads (like file contents or request bodies)
+// that would be expensive to materialize as Lua strings.
+// The caller must not modify b after calling PushBlob.
+//
+// Blob objects support the # operator and the following methods:
+//
+//   - blob:len() returns the length of the blob in bytes.
+//   - blob:sub(i [, j]) returns a new blob that shares memory with the original.
+//     i and j follow the same conventions as string.sub.
+//   - blob:string([i [, j]]) copies the blob (or a range of it) into a Lua string.
+//   - blob:reader() returns a read-only file object
+//     that reads from and seeks within the blob.
+func PushBlob(l *State, b []byte) error {
+	if err := createBlobMetatable(l); err != nil {
+		return fmt.Errorf("lua: push blob: %v", err)
+	}
+	pushBlob(l, b)
+	return nil
+}
+
+// ToBlob returns the bytes referenced by the blob object at the given index
+// or nil if the value is not a blob object.
+// The returned slice must not be modified.
+func ToBlob(l *State, idx int) []byte {
+	b := testBlob(l, idx)
+	if b == nil {
+		return nil
+	}
+	return b.data
+}
+
+type blob struct {
+	data []byte
+}
+
+func pushBlob(l *State, b []byte) {
+	l.NewUserdataUV(int(unsafe.Sizeof(uintptr(0))), 1)
+	SetMetatable(l, blobMetatableName)
+	setUintptr(l, -1, uintptr(l.state.NewHandle(&blob{data: b})))
+}
+
+func createBlobMetatable(l *State) error {
+	if !NewMetatable(l, blobMetatableName) {
+		l.Pop(1)
+		return nil
+	}
+	err := SetFuncs(l, 0, map[string]Function{
+		"__index":     nil,
+		"__gc":        blobGC,
+		"__len":       blobLen,
+		"__tostring":  blobToString,
+		"__metatable": nil, // prevent access to metatable
+	})
+	if err != nil {
+		l.Pop(1)
+		return err
+	}
+
+	err = NewLib(l, map[string]Function{
+		"len":    blobLen,
+		"reader": blobReader,
+		"string": blobString,
+		"sub":    blobSub,
+	})
+	if err != nil {
+		l.Pop(1)
+		return err
+	}
+	l.RawSetField(-2, "__index") // metatable.__index = method table
+
+	l.Pop(1)
+	return nil
+}
+
+func toBlob(l *State) (*blob, error) {
+	const idx = 1
+	if _, err := CheckUserdata(l, idx, blobMetatableName); err != nil {
+		return nil, err
+	}
+	b := testBlob(l, idx)
+	if b == nil {
+		return nil, NewArgError(l, idx, "could not extract blob")
+	}
+	return b, nil
+}
+
+func testBlob(l *State, idx int) *blob {
+	handle := cgo.Handle(unmarshalUintptr(TestUserdata(l, idx, blobMetatableName)))
+	if handle == 0 {
+		return nil
+	}
+	b, _ := handle.Value().(*blob)
+	return b
+}
+
+func blobGC(l *State) (int, error) {
+	if _, err := CheckUserdata(l, 1, blobMetatableName); err != nil {
+		return 0, err
+	}
+	if handle := cgo.Handle(unmarshalUintptr(TestUserdata(l, 1, blobMetatableName))); handle != 0 {
+		l.state.DeleteHandle(handle)
+		setUintptr(l, 1, 0)
+	}
+	return 0, nil
+}
+
+func blobLen(l *State) (int, error) {
+	b, err := toBlob(l)
+	if err != nil {
+		return 0, err
+	}
+	l.PushInteger(int64(len(b.data)))
+	return 1, nil
+}
+
+func blobToString(l *State) (int, error) {
+	b, err := toBlob(l)
+	if err != nil {
+		return 0, err
+	}
+	l.PushString(fmt.Sprintf("blob (%d bytes)", len(b.data)))
+	return 1, nil
+}
+
+func blobSub(l *State) (int, error) {
+	b, err := toBlob(l)
+	if err != nil {
+		return 0, err
+	}
+	start, end, err := blobRange(l, b, 2)
+	if err != nil {
+		return 0, err
+	}
+	pushBlob(l, b.data[start:end:end])
+	return 1, nil
+}
+
+func blobString(l *State) (int, error) {
+	b, err := toBlob(l)
+	if err != nil {
+		return 0, err
+	}
+	start, end, err := blobRange(l, b, 2)
+	if err != nil {
+		return 0, err
+	}
+	l.PushString(string(b.data[start:end]))
+	return 1, nil
+}
+
+func blobReader(l *State) (int, error) {
+	b, err := toBlob(l)
+	if err != nil {
+		return 0, err
+	}
+	if err := PushReader(l, blobReadCloser{bytes.NewReader(b.data)}); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// blobReadCloser is a [*bytes.Reader] with a no-op Close method.
+// Unlike [io.NopCloser], it preserves the reader's Seek and ReadByte methods.
+type blobReadCloser struct {
+	*bytes.Reader
+}
+
+func (blobReadCloser) Close() error {
+	return nil
+}
+
+// blobRange converts the optional arguments i and j at the given indices
+// to a byte range in b using the same rules as string.sub.
+func blobRange(l *State, b *blob, arg int) (start, end int, err error) {
+	n := int64(len(b.data))
+	i := int64(1)
+	if !l.IsNoneOrNil(arg) {
+		i, err = CheckInteger(l, arg)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	j := int64(-1)
+	if !l.IsNoneOrNil(arg + 1) {
+		j, err = CheckInteger(l, arg+1)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	switch {
+	case i < -n:
+		i = 1
+	case i < 0:
+		i = n + i + 1
+	case i == 0:
+		i = 1
+	}
+	switch {
+	case j < -n:
+		j = 0
+	case j < 0:
+		j = n + j + 1
+	case j > n:
+		j = n
+	}
+	if i > j {
+		return 0, 0, nil
+	}
+	return int(i - 1), int(j), nil
+}
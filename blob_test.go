@@ -0,0 +1,133 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlob(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	out := new(strings.Builder)
+	if err := Require(state, GName, true, NewOpenBase(out, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("Hello, World!")
+	if err := PushBlob(state, data); err != nil {
+		t.Fatal(err)
+	}
+	if got := ToBlob(state, -1); string(got) != string(data) {
+		t.Errorf("ToBlob(...) = %q; want %q", got, data)
+	}
+	if err := state.SetGlobal("b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = `assert(#b == 13)` + "\n" +
+		`assert(b:len() == 13)` + "\n" +
+		`assert(b:string() == "Hello, World!")` + "\n" +
+		`assert(b:string(-6) == "World!")` + "\n" +
+		`local sub = b:sub(1, 5)` + "\n" +
+		`assert(#sub == 5)` + "\n" +
+		`assert(sub:string() == "Hello")` + "\n" +
+		`assert(b:sub(5, 2):string() == "")` + "\n" +
+		`assert(b:sub(100):len() == 0)` + "\n" +
+		`local r = b:reader()` + "\n" +
+		`assert(r:read(5) == "Hello")` + "\n" +
+		`assert(r:seek("cur") == 5)` + "\n" +
+		`assert(r:read("a") == ", World!")` + "\n" +
+		`assert(tostring(b) == "blob (13 bytes)")` + "\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	err := state.Call(0, 0, 0)
+	if out.Len() > 0 {
+		t.Log(out.String())
+	}
+	if err != nil {
+		t.Error(err)
+	}
+
+	state.PushString("Hello")
+	if got := ToBlob(state, -1); got != nil {
+		t.Errorf("ToBlob(string) = %q; want nil", got)
+	}
+}
+
+func TestBlobRangeLimits(t *testing.T) {
+	tests := []struct {
+		i, j string
+		want string
+	}{
+		{"math.mininteger", "nil", "Hello, World!"},
+		{"1", "math.mininteger", ""},
+		{"math.mininteger", "math.maxinteger", "Hello, World!"},
+		{"math.maxinteger", "nil", ""},
+		{"math.maxinteger", "math.maxinteger", ""},
+		{"math.mininteger", "math.mininteger", ""},
+		{"-5", "math.maxinteger", "orld!"},
+	}
+
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, MathLibraryName, true, NewOpenMath(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushBlob(state, []byte("Hello, World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetGlobal("b", 0); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	for _, test := range tests {
+		source := "return b:sub(" + test.i + ", " + test.j + "):string(), " +
+			"b:string(" + test.i + ", " + test.j + ")"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 2, 0); err != nil {
+			t.Errorf("b:sub(%s, %s): %v", test.i, test.j, err)
+			state.Pop(1)
+			continue
+		}
+		if got, _ := state.ToString(-2); got != test.want {
+			t.Errorf("b:sub(%s, %s):string() = %q; want %q", test.i, test.j, got, test.want)
+		}
+		if got, _ := state.ToString(-1); got != test.want {
+			t.Errorf("b:string(%s, %s) = %q; want %q", test.i, test.j, got, test.want)
+		}
+		state.Pop(2)
+	}
+}
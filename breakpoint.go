@@ -0,0 +1,252 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+const (
+	// breakpointsRegistryKey is the registry key of the userdata
+	// that holds a state's *breakpoints.
+	breakpointsRegistryKey = "zombiezen.com/go/lua.breakpoints"
+	// breakpointsMetatableName is the registry name
+	// of the breakpoints userdata's metatable.
+	breakpointsMetatableName = "*zombiezen.com/go/lua.breakpoints"
+)
+
+// A BreakpointFunc is called when execution stops:
+// when it reaches a breakpoint set with [State.SetBreakpoint],
+// when a step requested with [State.Step] completes,
+// or when it reaches the line given to [State.RunToLine].
+// The BreakpointFunc can call [State.Step] or [State.RunToLine]
+// to choose where execution stops next.
+// ar is the activation record of the function at the breakpoint,
+// which can be inspected with [ActivationRecord.Info].
+// If the BreakpointFunc returns an error,
+// the error is raised in the function at the breakpoint.
+type BreakpointFunc func(l *State, ar *ActivationRecord) error
+
+// StepMode is the kind of step requested with [State.Step].
+type StepMode int
+
+// Step modes.
+const (
+	// StepContinue runs until the next breakpoint.
+	StepContinue StepMode = iota
+	// StepIn stops at the next line that runs, in any function.
+	StepIn
+	// StepOver stops at the next line that runs
+	// in the current function or one of its callers.
+	StepOver
+	// StepOut stops at the next line that runs
+	// after the current function returns.
+	StepOut
+)
+
+// breakpoints is the set of breakpoints of a state
+// along with its stepping state.
+type breakpoints struct {
+	handler BreakpointFunc
+	// lines maps line numbers to the sources that have a breakpoint on that line.
+	lines map[int]map[string]struct{}
+	// id is the breakpoints' line hook, added with [State.AddHook].
+	// The hook only requests line events
+	// while breakpoints or steps are pending.
+	id HookID
+
+	// step is the kind of step in progress.
+	// stepDepth is the stack depth at which the step started.
+	step      StepMode
+	stepDepth int
+	// runTo is the location given to RunToLine.
+	// runToLine is zero if there is no such location.
+	runToSource string
+	runToLine   int
+}
+
+// SetBreakpointHandler sets the function that is called
+// when execution reaches a breakpoint.
+// A nil handler ignores breakpoints.
+func (l *State) SetBreakpointHandler(f BreakpointFunc) {
+	b := l.breakpoints(true)
+	b.handler = f
+}
+
+// SetBreakpoint sets a breakpoint on the given line of the given source,
+// so that the function set by [State.SetBreakpointHandler] is called
+// before the line runs.
+// source is the chunk name that the code was loaded with
+// (for example, "@script.lua" for a file loaded with [LoadFile]).
+// The leading "@" or "=" may be omitted.
+//
+// Breakpoints are implemented with a line hook (see [State.AddHook])
+// that is active while any breakpoints are set.
+// Breakpoints only apply to coroutines
+// created after the first breakpoint was set.
+func (l *State) SetBreakpoint(source string, line int) {
+	b := l.breakpoints(true)
+	sources := b.lines[line]
+	if sources == nil {
+		sources = make(map[string]struct{})
+		b.lines[line] = sources
+	}
+	sources[trimSourcePrefix(source)] = struct{}{}
+	b.update(l)
+}
+
+// ClearBreakpoint removes a breakpoint set with [State.SetBreakpoint].
+// Once no breakpoints remain,
+// the line hook is turned off.
+func (l *State) ClearBreakpoint(source string, line int) {
+	b := l.breakpoints(false)
+	if b == nil {
+		return
+	}
+	sources := b.lines[line]
+	if sources == nil {
+		return
+	}
+	delete(sources, trimSourcePrefix(source))
+	if len(sources) == 0 {
+		delete(b.lines, line)
+	}
+	b.update(l)
+}
+
+// Step requests that execution stop after a step of the given kind
+// and call the function set by [State.SetBreakpointHandler].
+// Step is typically called from that function
+// to continue stepping after a stop,
+// but it can also be called before running code
+// (for example, Step(StepIn) stops at the first line that runs).
+// The step is measured from the function running when Step is called.
+// Breakpoints still stop execution during a step.
+// Like breakpoints, steps use a line hook.
+func (l *State) Step(mode StepMode) {
+	b := l.breakpoints(true)
+	b.step = mode
+	b.stepDepth = stackDepth(l)
+	b.update(l)
+}
+
+// RunToLine requests that execution stop once it reaches
+// the given line of the given source
+// and call the function set by [State.SetBreakpointHandler].
+// RunToLine acts like a breakpoint that is cleared once it is reached
+// and replaces any previous call to RunToLine.
+// The source is interpreted the same as in [State.SetBreakpoint].
+func (l *State) RunToLine(source string, line int) {
+	b := l.breakpoints(true)
+	b.runToSource = trimSourcePrefix(source)
+	b.runToLine = line
+	b.update(l)
+}
+
+// update turns the line hook on or off
+// depending on whether any breakpoints or steps are pending.
+func (b *breakpoints) update(l *State) {
+	var mask HookMask
+	if len(b.lines) > 0 || b.step != StepContinue || b.runToLine != 0 {
+		mask = MaskLine
+	}
+	l.UpdateHook(b.id, mask, 0)
+}
+
+// shouldStop reports whether execution should stop
+// on the line reported by a line hook event.
+// If so, it resets any step or RunToLine request.
+func (b *breakpoints) shouldStop(l *State, ar *ActivationRecord) bool {
+	stop := false
+	switch b.step {
+	case StepIn:
+		stop = true
+	case StepOver:
+		stop = stackDepth(l) <= b.stepDepth
+	case StepOut:
+		stop = stackDepth(l) < b.stepDepth
+	}
+	line := ar.Info("l").CurrentLine
+	sources := b.lines[line]
+	if !stop && len(sources) == 0 && line != b.runToLine {
+		return false
+	}
+	if !stop {
+		source := trimSourcePrefix(ar.Info("S").Source)
+		_, stop = sources[source]
+		if line == b.runToLine && source == b.runToSource {
+			stop = true
+		}
+	}
+	if stop {
+		b.step = StepContinue
+		b.runToSource = ""
+		b.runToLine = 0
+	}
+	return stop
+}
+
+// stackDepth returns the number of active functions on the call stack.
+func stackDepth(l *State) int {
+	n := 0
+	for l.Stack(n) != nil {
+		n++
+	}
+	return n
+}
+
+// breakpoints returns the state's breakpoints.
+// If create is true and the state does not have any,
+// breakpoints creates an empty set.
+func (l *State) breakpoints(create bool) *breakpoints {
+	if !l.CheckStack(1) {
+		panic("stack overflow")
+	}
+	l.RawField(RegistryIndex, breakpointsRegistryKey)
+	p := TestTypedUserdata[*breakpoints](l, -1, breakpointsMetatableName)
+	l.Pop(1)
+	if p != nil {
+		return *p
+	}
+	if !create {
+		return nil
+	}
+	b := &breakpoints{lines: make(map[int]map[string]struct{})}
+	b.id = l.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		if !b.shouldStop(l, ar) {
+			return nil
+		}
+		var err error
+		if b.handler != nil {
+			err = b.handler(l, ar)
+		}
+		b.update(l)
+		return err
+	}, 0, 0)
+	NewUserdata(l, b, breakpointsMetatableName)
+	l.RawSetField(RegistryIndex, breakpointsRegistryKey)
+	return b
+}
+
+// trimSourcePrefix removes the "@" or "=" that starts a chunk name.
+func trimSourcePrefix(source string) string {
+	if len(source) > 0 && (source[0] == '@' || source[0] == '=') {
+		return source[1:]
+	}
+	return source
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestBreakpoint(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "local x = 1\n" +
+		"for i = 1, 3 do\n" +
+		"  x = x + i\n" +
+		"end\n" +
+		"return x\n"
+	var hits []int
+	state.SetBreakpointHandler(func(l *State, ar *ActivationRecord) error {
+		info := ar.Info("Sl")
+		if info.Source != "@bp.lua" {
+			t.Errorf("breakpoint hit in %q; want \"@bp.lua\"", info.Source)
+		}
+		hits = append(hits, info.CurrentLine)
+		return nil
+	})
+	state.SetBreakpoint("bp.lua", 3)
+	state.SetBreakpoint("bp.lua", 5)
+	state.SetBreakpoint("other.lua", 1)
+
+	run := func() error {
+		if err := state.LoadString(source, "@bp.lua", "t"); err != nil {
+			return err
+		}
+		if err := state.Call(0, 0, 0); err != nil {
+			return err
+		}
+		return nil
+	}
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 3, 3, 5}; !slices.Equal(hits, want) {
+		t.Errorf("breakpoints hit on lines %v; want %v", hits, want)
+	}
+
+	hits = nil
+	state.ClearBreakpoint("@bp.lua", 3)
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{5}; !slices.Equal(hits, want) {
+		t.Errorf("after clearing line 3, breakpoints hit on lines %v; want %v", hits, want)
+	}
+
+	// Errors from the handler are raised in the running function.
+	errStop := errors.New("stop")
+	state.SetBreakpointHandler(func(l *State, ar *ActivationRecord) error {
+		return errStop
+	})
+	if err := run(); !errors.Is(err, errStop) {
+		t.Errorf("run with failing handler = %v; want %v", err, errStop)
+	}
+
+	state.ClearBreakpoint("bp.lua", 5)
+	state.ClearBreakpoint("other.lua", 1)
+	if hook, _, _ := state.Hook(); hook != nil {
+		t.Error("hook still set after clearing all breakpoints")
+	}
+}
+
+func TestStep(t *testing.T) {
+	const source = "local function f(a)\n" +
+		"  local b = a + 1\n" +
+		"  return b\n" +
+		"end\n" +
+		"local x = f(1)\n" +
+		"local y = f(x)\n" +
+		"return y\n"
+
+	tests := []struct {
+		name       string
+		breakpoint int
+		first      StepMode
+		next       StepMode
+		want       []int
+	}{
+		{
+			name:  "StepIn",
+			first: StepIn,
+			next:  StepIn,
+			want:  []int{4, 5, 2, 3, 6, 2, 3, 7},
+		},
+		{
+			name:  "StepOver",
+			first: StepIn,
+			next:  StepOver,
+			want:  []int{4, 5, 6, 7},
+		},
+		{
+			name:       "StepOut",
+			breakpoint: 2,
+			next:       StepOut,
+			want:       []int{2, 6, 2, 7},
+		},
+		{
+			name:       "Continue",
+			breakpoint: 3,
+			first:      StepContinue,
+			next:       StepContinue,
+			want:       []int{3, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := new(State)
+			defer func() {
+				if err := state.Close(); err != nil {
+					t.Error("Close:", err)
+				}
+			}()
+
+			var stops []int
+			state.SetBreakpointHandler(func(l *State, ar *ActivationRecord) error {
+				stops = append(stops, ar.Info("l").CurrentLine)
+				l.Step(test.next)
+				return nil
+			})
+			if test.breakpoint != 0 {
+				state.SetBreakpoint("step.lua", test.breakpoint)
+			}
+			state.Step(test.first)
+			if err := state.LoadString(source, "@step.lua", "t"); err != nil {
+				t.Fatal(err)
+			}
+			if err := state.Call(0, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(stops, test.want) {
+				t.Errorf("stopped on lines %v; want %v", stops, test.want)
+			}
+		})
+	}
+}
+
+func TestRunToLine(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	var stops []int
+	state.SetBreakpointHandler(func(l *State, ar *ActivationRecord) error {
+		line := ar.Info("l").CurrentLine
+		stops = append(stops, line)
+		if line == 2 {
+			l.RunToLine("step.lua", 4)
+		}
+		return nil
+	})
+	state.RunToLine("step.lua", 2)
+	const source = "local x = 1\n" +
+		"x = x + 1\n" +
+		"x = x + 1\n" +
+		"x = x + 1\n" +
+		"for i = 1, 3 do x = x + i end\n" +
+		"x = x + 1\n" +
+		"x = x + 1\n" +
+		"return x\n"
+	if err := state.LoadString(source, "@step.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 4}; !slices.Equal(stops, want) {
+		t.Errorf("stopped on lines %v; want %v", stops, want)
+	}
+	if hook, _, _ := state.Hook(); hook != nil {
+		t.Error("hook still installed after run to line completed")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Buffer accumulates pieces of a Lua string
+// and then pushes the result onto the stack as a single string,
+// similar to luaL_Buffer in the C API.
+// Unlike luaL_Buffer, a Buffer does not use any stack space
+// while it accumulates the string.
+// The zero value is an empty buffer ready to use.
+// A Buffer must not be copied after first use.
+type Buffer struct {
+	sb strings.Builder
+}
+
+// Len returns the number of bytes accumulated in the buffer.
+func (b *Buffer) Len() int {
+	return b.sb.Len()
+}
+
+// Reset discards the contents of the buffer.
+func (b *Buffer) Reset() {
+	b.sb.Reset()
+}
+
+// Write appends p to the buffer.
+// It always returns len(p), nil.
+func (b *Buffer) Write(p []byte) (int, error) {
+	return b.sb.Write(p)
+}
+
+// WriteString appends s to the buffer.
+// It always returns len(s), nil.
+func (b *Buffer) WriteString(s string) (int, error) {
+	return b.sb.WriteString(s)
+}
+
+// WriteByte appends c to the buffer.
+// It always returns nil.
+func (b *Buffer) WriteByte(c byte) error {
+	return b.sb.WriteByte(c)
+}
+
+// AddValue pops the value on the top of the stack of l
+// and appends it to the buffer.
+// The value must be a string or a number,
+// which is converted as by [State.ToString].
+// Otherwise, AddValue returns an error and leaves the value on the stack.
+func (b *Buffer) AddValue(l *State) error {
+	s, ok := l.ToString(-1)
+	if !ok {
+		return fmt.Errorf("lua: buffer: cannot add %v value", l.Type(-1))
+	}
+	b.sb.WriteString(s)
+	l.Pop(1)
+	return nil
+}
+
+// String returns the accumulated string.
+func (b *Buffer) String() string {
+	return b.sb.String()
+}
+
+// Push pushes the accumulated string onto the stack of l
+// and resets the buffer.
+func (b *Buffer) Push(l *State) {
+	l.PushString(b.sb.String())
+	b.sb.Reset()
+}
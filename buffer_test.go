@@ -0,0 +1,70 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import "testing"
+
+func TestBuffer(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	var b Buffer
+	b.WriteString("x = ")
+	state.PushInteger(42)
+	if err := b.AddValue(state); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteByte(',')
+	b.Write([]byte(" y = "))
+	state.PushNumber(1.5)
+	if err := b.AddValue(state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state.Top(), 0; got != want {
+		t.Errorf("after AddValue, state.Top() = %d; want %d", got, want)
+	}
+
+	state.CreateTable(0, 0)
+	if err := b.AddValue(state); err == nil {
+		t.Error("AddValue(table) did not return an error")
+	}
+	if got, want := state.Top(), 1; got != want {
+		t.Errorf("after failed AddValue, state.Top() = %d; want %d", got, want)
+	}
+	state.Pop(1)
+
+	b.Push(state)
+	if got, want := state.Top(), 1; got != want {
+		t.Errorf("after Push, state.Top() = %d; want %d", got, want)
+	}
+	const want = "x = 42, y = 1.5"
+	if got, _ := state.ToString(-1); got != want {
+		t.Errorf("pushed string = %q; want %q", got, want)
+	}
+	if got := b.Len(); got != 0 {
+		t.Errorf("after Push, b.Len() = %d; want 0", got)
+	}
+}
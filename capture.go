@@ -0,0 +1,176 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultTruncationMarker is the marker that an [OutputBuffer]
+// appends when its TruncationMarker field is empty.
+const DefaultTruncationMarker = "\n[output truncated]\n"
+
+// OutputBuffer is an [io.Writer] that stores up to a fixed number of bytes.
+// It is intended to capture script output for returning to users
+// without risking unbounded memory growth.
+// Once the limit is reached, OutputBuffer appends a truncation marker
+// and discards any further data.
+// Writes never fail, so scripts are not affected by truncation.
+//
+// To capture the output of print, io.write, io.stdout, and io.stderr,
+// call [CaptureOutput] after opening the libraries,
+// or pass the same OutputBuffer to [NewOpenBase]
+// and as the [IOLibrary] Stdout and Stderr fields.
+// Call [OutputBuffer.Reset] between calls to capture output per call.
+//
+// An OutputBuffer is safe to use from multiple goroutines.
+type OutputBuffer struct {
+	// Limit is the maximum number of bytes of output to store,
+	// not counting the truncation marker.
+	// If Limit is zero or negative, all output is discarded.
+	Limit int
+	// TruncationMarker is the text appended after the output
+	// when it exceeds the limit.
+	// If empty, DefaultTruncationMarker is used.
+	TruncationMarker string
+
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+// NewOutputBuffer returns a new [OutputBuffer] that stores up to limit bytes.
+func NewOutputBuffer(limit int) *OutputBuffer {
+	return &OutputBuffer{Limit: limit}
+}
+
+// Write appends p to the buffer, truncating it if it exceeds the limit.
+// It always returns len(p), nil.
+func (b *OutputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return len(p), nil
+	}
+	n := min(len(p), max(b.Limit-len(b.buf), 0))
+	b.buf = append(b.buf, p[:n]...)
+	if n < len(p) {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// WriteString appends s to the buffer, truncating it if it exceeds the limit.
+// It always returns len(s), nil.
+func (b *OutputBuffer) WriteString(s string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return len(s), nil
+	}
+	n := min(len(s), max(b.Limit-len(b.buf), 0))
+	b.buf = append(b.buf, s[:n]...)
+	if n < len(s) {
+		b.truncated = true
+	}
+	return len(s), nil
+}
+
+// String returns the captured output,
+// followed by the truncation marker if the output was truncated.
+func (b *OutputBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.truncated {
+		return string(b.buf)
+	}
+	marker := b.TruncationMarker
+	if marker == "" {
+		marker = DefaultTruncationMarker
+	}
+	return string(b.buf) + marker
+}
+
+// Len returns the number of bytes of output stored,
+// not counting the truncation marker.
+func (b *OutputBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buf)
+}
+
+// Truncated reports whether any output has been discarded
+// since the buffer was created or last reset.
+func (b *OutputBuffer) Truncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.truncated
+}
+
+// Reset discards the buffer's contents, retaining its limit.
+func (b *OutputBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = b.buf[:0]
+	b.truncated = false
+}
+
+// CaptureOutput redirects the output of print, io.write, io.stdout, and io.stderr
+// in a state whose libraries have already been opened to b.
+// Existing references to io.stdout and io.stderr,
+// including the default output file set by io.output,
+// write to b from then on.
+// Libraries that are not loaded are skipped.
+// CaptureOutput replaces the global print function,
+// so references to print saved before the call are not affected.
+func CaptureOutput(l *State, b *OutputBuffer) error {
+	if !l.CheckStack(3) {
+		return errors.New("lua: capture output: stack overflow")
+	}
+	if l.RawField(RegistryIndex, LoadedTable) != TypeTable {
+		l.Pop(1)
+		return errors.New("lua: capture output: no libraries loaded")
+	}
+
+	if l.RawField(-1, GName) == TypeTable {
+		l.PushClosure(0, newPrint(b))
+		l.RawSetField(-2, "print")
+	}
+	l.Pop(1)
+
+	if l.RawField(-1, IOLibraryName) == TypeTable {
+		for _, name := range []string{"stdout", "stderr"} {
+			l.RawField(-1, name)
+			if s := testStream(l, -1); s != nil && s.w != nil {
+				if s.wbuf != nil {
+					s.wbuf.Flush()
+					s.wbuf.Reset(b)
+				}
+				s.w = b
+			}
+			l.Pop(1)
+		}
+	}
+	l.Pop(2)
+	return nil
+}
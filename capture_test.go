@@ -0,0 +1,121 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	buf := NewOutputBuffer(16)
+	lib := new(IOLibrary)
+	lib.Stdout = buf
+	lib.Stderr = buf
+
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(buf, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, IOLibraryName, true, lib.OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(2)
+
+	run := func(t *testing.T, source string) {
+		t.Helper()
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(t, `print("Hello") io.write("!")`)
+	if got, want := buf.String(), "Hello\n!"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+	if buf.Truncated() {
+		t.Error("buf.Truncated() = true before limit reached")
+	}
+
+	run(t, `io.stderr:write("0123456789abcdef") print("more")`)
+	if got, want := buf.String(), "Hello\n!012345678"+DefaultTruncationMarker; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+	if got, want := buf.Len(), 16; got != want {
+		t.Errorf("buf.Len() = %d; want %d", got, want)
+	}
+	if !buf.Truncated() {
+		t.Error("buf.Truncated() = false after limit reached")
+	}
+
+	buf.Reset()
+	buf.TruncationMarker = "..."
+	run(t, `print("0123456789abcdefghij")`)
+	if got, want := buf.String(), "0123456789abcdef..."; got != want {
+		t.Errorf("after Reset, output = %q; want %q", got, want)
+	}
+}
+
+func TestCaptureOutput(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	buf := NewOutputBuffer(32)
+	if err := CaptureOutput(state, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T, source string) {
+		t.Helper()
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(t, `print("a", 1) io.write("b") io.stderr:write("c") io.output():write("d")`)
+	if got, want := buf.String(), "a\t1\nbcd"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	run(t, `for i = 1, 100 do io.write("x") end`)
+	if got, want := buf.String(), strings.Repeat("x", 32)+DefaultTruncationMarker; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// ChannelLibraryName is the conventional module name for the [ChannelLibrary].
+const ChannelLibraryName = "channel"
+
+const (
+	channelMetatableName = "*zombiezen.com/go/lua.channel"
+	// channelYieldKey is the registry key of a boolean
+	// that is true if channel operations should yield instead of blocking.
+	channelYieldKey = "zombiezen.com/go/lua.channelYield"
+)
+
+var channelMetatable = NewMetatableFor[chan any](channelMetatableName).
+	Method("send", channelSend).
+	Method("receive", channelReceive).
+	Method("close", channelClose)
+
+// PushChannel pushes a Lua channel object onto the stack
+// that sends and receives on ch.
+// Channel objects have the following methods:
+//
+//   - ch:send(v [, timeout]) sends v on the channel
+//     and returns true.
+//     If timeout (in seconds) is given and elapses first,
+//     send returns false and "timeout".
+//     Sending on a closed channel raises an error.
+//   - ch:receive([timeout]) receives a value from the channel
+//     and returns it and true.
+//     If the channel is closed, receive returns nil and false.
+//     If timeout (in seconds) is given and elapses first,
+//     receive returns nil, false, and "timeout".
+//   - ch:close() closes the channel.
+//
+// Values are converted with [Marshal] when sent
+// and with [Push] when received,
+// so channels can be shared by independent States
+// and with Go code.
+func PushChannel(l *State, ch chan any) error {
+	if ch == nil {
+		return errors.New("lua: push channel: nil channel")
+	}
+	if err := channelMetatable.New(l, ch); err != nil {
+		return fmt.Errorf("lua: push channel: %v", err)
+	}
+	return nil
+}
+
+// ToChannel returns the Go channel of the Lua channel object
+// at the given index
+// or nil if the value is not a channel object.
+func ToChannel(l *State, idx int) chan any {
+	p := channelMetatable.Test(l, idx)
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// ChannelLibrary is a library for communicating over Go channels.
+// It provides the following functions:
+//
+//   - channel.new([size]) returns a new channel object
+//     (see [PushChannel]) with the given buffer size.
+//   - channel.select(cases [, timeout]) waits until one of the cases can proceed
+//     and returns its index.
+//     Each case is either a table {"receive", ch},
+//     in which case select also returns the received value
+//     and whether the receive succeeded (as in ch:receive),
+//     or a table {"send", ch, v}.
+//     If timeout (in seconds) is given and elapses first,
+//     select returns nil.
+type ChannelLibrary struct {
+	// If YieldWhenBlocked is true,
+	// then channel operations without a timeout
+	// that are called in a coroutine that can yield (see [State.IsYieldable])
+	// yield the channel objects they are waiting on instead of blocking.
+	// When the coroutine is resumed (with no values),
+	// the operation is tried again.
+	// This allows Go code that drives coroutines with [State.Resume]
+	// to run other coroutines while one is waiting.
+	// Coroutines driven by coroutine.resume see these yields too,
+	// so YieldWhenBlocked should not be used with such scripts.
+	YieldWhenBlocked bool
+}
+
+// OpenLibrary loads the channel library.
+// This method is intended to be used as an argument to [Require].
+func (lib *ChannelLibrary) OpenLibrary(l *State) (int, error) {
+	if err := channelMetatable.Push(l); err != nil {
+		return 0, err
+	}
+	l.Pop(1)
+	l.PushBoolean(lib.YieldWhenBlocked)
+	l.RawSetField(RegistryIndex, channelYieldKey)
+
+	err := NewLib(l, map[string]Function{
+		"new":    channelNew,
+		"select": channelSelect,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func channelNew(l *State) (int, error) {
+	size, err := OptInteger(l, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 || size > math.MaxInt32 {
+		return 0, NewArgError(l, 1, "invalid size")
+	}
+	if err := PushChannel(l, make(chan any, size)); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func channelSend(l *State, ch *chan any) (int, error) {
+	v, err := Marshal(l, 2)
+	if err != nil {
+		return 0, NewArgError(l, 2, err.Error())
+	}
+	cases := []reflect.SelectCase{{
+		Dir:  reflect.SelectSend,
+		Chan: reflect.ValueOf(*ch),
+		Send: reflect.ValueOf(&v).Elem(),
+	}}
+	chosen, _, _, err := runSelect(l, cases, 3)
+	if err != nil {
+		return 0, err
+	}
+	switch chosen {
+	case selectTimeout:
+		l.PushBoolean(false)
+		l.PushString("timeout")
+		return 2, nil
+	case selectWouldBlock:
+		l.PushValue(1)
+		return l.Yield(1)
+	default:
+		l.PushBoolean(true)
+		return 1, nil
+	}
+}
+
+func channelReceive(l *State, ch *chan any) (int, error) {
+	cases := []reflect.SelectCase{{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(*ch),
+	}}
+	chosen, recv, recvOK, err := runSelect(l, cases, 2)
+	if err != nil {
+		return 0, err
+	}
+	switch chosen {
+	case selectTimeout:
+		l.PushNil()
+		l.PushBoolean(false)
+		l.PushString("timeout")
+		return 3, nil
+	case selectWouldBlock:
+		l.PushValue(1)
+		return l.Yield(1)
+	default:
+		if err := pushReceived(l, recv, recvOK); err != nil {
+			return 0, err
+		}
+		return 2, nil
+	}
+}
+
+func channelClose(l *State, ch *chan any) (_ int, err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("%sclose of closed channel", Where(l, 1))
+		}
+	}()
+	close(*ch)
+	return 0, nil
+}
+
+func channelSelect(l *State) (int, error) {
+	if err := CheckType(l, 1, TypeTable); err != nil {
+		return 0, err
+	}
+	n := l.RawLen(1)
+	if n == 0 {
+		return 0, NewArgError(l, 1, "no cases")
+	}
+	if !l.CheckStack(3) {
+		return 0, errors.New("stack overflow")
+	}
+	cases := make([]reflect.SelectCase, 0, int(min(n, 1<<10)))
+	for i := int64(1); i <= int64(n); i++ {
+		if l.RawIndex(1, i) != TypeTable {
+			l.Pop(1)
+			return 0, NewArgError(l, 1, fmt.Sprintf("case #%d is not a table", i))
+		}
+		l.RawIndex(-1, 1)
+		op, _ := l.ToString(-1)
+		l.RawIndex(-2, 2)
+		ch := channelMetatable.Test(l, -1)
+		l.Pop(2)
+		if ch == nil {
+			l.Pop(1)
+			return 0, NewArgError(l, 1, fmt.Sprintf("case #%d does not have a channel", i))
+		}
+		switch op {
+		case "receive":
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(*ch),
+			})
+		case "send":
+			l.RawIndex(-1, 3)
+			v, err := Marshal(l, -1)
+			l.Pop(1)
+			if err != nil {
+				l.Pop(1)
+				return 0, NewArgError(l, 1, fmt.Sprintf("case #%d: %v", i, err))
+			}
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectSend,
+				Chan: reflect.ValueOf(*ch),
+				Send: reflect.ValueOf(&v).Elem(),
+			})
+		default:
+			l.Pop(1)
+			return 0, NewArgError(l, 1, fmt.Sprintf("case #%d has invalid operation %q", i, op))
+		}
+		l.Pop(1)
+	}
+
+	chosen, recv, recvOK, err := runSelect(l, cases, 2)
+	if err != nil {
+		return 0, err
+	}
+	switch chosen {
+	case selectTimeout:
+		l.PushNil()
+		return 1, nil
+	case selectWouldBlock:
+		if !l.CheckStack(len(cases)) {
+			return 0, errors.New("stack overflow")
+		}
+		for i := range cases {
+			l.RawIndex(1, int64(i+1))
+			l.RawIndex(-1, 2)
+			l.Remove(-2)
+		}
+		return l.Yield(len(cases))
+	}
+	l.PushInteger(int64(chosen) + 1)
+	if cases[chosen].Dir != reflect.SelectRecv {
+		return 1, nil
+	}
+	if err := pushReceived(l, recv, recvOK); err != nil {
+		return 0, err
+	}
+	return 3, nil
+}
+
+// Special results of [runSelect].
+const (
+	selectTimeout    = -1
+	selectWouldBlock = -2
+)
+
+// runSelect runs a select statement over the given cases.
+// If the function argument timeoutArg is not nil,
+// runSelect waits at most that many seconds for a case to proceed
+// before returning selectTimeout.
+// Otherwise, if channel operations should yield and l can yield,
+// runSelect returns selectWouldBlock instead of blocking.
+// While blocked, runSelect returns the error of any interruption
+// of the running call (for example, from [State.CallContext]).
+func runSelect(l *State, cases []reflect.SelectCase, timeoutArg int) (chosen int, recv reflect.Value, recvOK bool, err error) {
+	var timeout time.Duration
+	hasTimeout := !l.IsNoneOrNil(timeoutArg)
+	if hasTimeout {
+		secs, err := CheckNumber(l, timeoutArg)
+		if err != nil {
+			return 0, reflect.Value{}, false, err
+		}
+		switch {
+		case secs >= math.MaxInt64/float64(time.Second):
+			timeout = math.MaxInt64
+		case secs > 0:
+			timeout = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("%ssend on closed channel", Where(l, 1))
+		}
+	}()
+	n := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	chosen, recv, recvOK = reflect.Select(cases)
+	if chosen < n {
+		return chosen, recv, recvOK, nil
+	}
+	cases = cases[:n]
+	switch {
+	case hasTimeout && timeout <= 0:
+		return selectTimeout, reflect.Value{}, false, nil
+	case hasTimeout:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(timer.C),
+		})
+	case l.IsYieldable() && channelShouldYield(l):
+		return selectWouldBlock, reflect.Value{}, false, nil
+	}
+	nWait := len(cases)
+	sources := l.interruptSources()
+	for _, src := range sources {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(src.done),
+		})
+	}
+	for {
+		chosen, recv, recvOK = reflect.Select(cases)
+		switch {
+		case chosen < n:
+			return chosen, recv, recvOK, nil
+		case chosen < nWait:
+			return selectTimeout, reflect.Value{}, false, nil
+		}
+		if err := sources[chosen-nWait].check(l); err != nil {
+			return 0, reflect.Value{}, false, err
+		}
+		// The source does not interrupt the state after all.
+		// Stop waiting on it.
+		cases[chosen].Chan = reflect.Value{}
+	}
+}
+
+// channelShouldYield reports whether the [ChannelLibrary]
+// was loaded with YieldWhenBlocked set.
+func channelShouldYield(l *State) bool {
+	if !l.CheckStack(1) {
+		return false
+	}
+	l.RawField(RegistryIndex, channelYieldKey)
+	yield := l.ToBoolean(-1)
+	l.Pop(1)
+	return yield
+}
+
+// pushReceived pushes the results of receiving recv from a channel.
+func pushReceived(l *State, recv reflect.Value, recvOK bool) error {
+	if !recvOK {
+		l.PushNil()
+		l.PushBoolean(false)
+		return nil
+	}
+	if err := Push(l, recv.Interface()); err != nil {
+		return fmt.Errorf("%s%v", Where(l, 1), err)
+	}
+	l.PushBoolean(true)
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChannelLibrary(t *testing.T) {
+	newState := func(t *testing.T, lib *ChannelLibrary) *State {
+		t.Helper()
+		l := new(State)
+		t.Cleanup(func() {
+			if err := l.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		})
+		if err := OpenLibraries(l); err != nil {
+			t.Fatal(err)
+		}
+		if err := Require(l, ChannelLibraryName, true, lib.OpenLibrary); err != nil {
+			t.Fatal(err)
+		}
+		l.SetTop(0)
+		return l
+	}
+	run := func(t *testing.T, l *State, source string) {
+		t.Helper()
+		if err := l.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Call(0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("SendReceive", func(t *testing.T) {
+		l := newState(t, new(ChannelLibrary))
+		run(t, l, `local ch = channel.new(2)`+"\n"+
+			`assert(ch:send({1, 2, 3}) == true)`+"\n"+
+			`assert(ch:send("hi") == true)`+"\n"+
+			`local ok, msg = ch:send("full", 0)`+"\n"+
+			`assert(ok == false and msg == "timeout")`+"\n"+
+			`local v, ok = ch:receive()`+"\n"+
+			`assert(ok and #v == 3 and v[3] == 3)`+"\n"+
+			`assert(ch:receive() == "hi")`+"\n"+
+			`local v, ok, msg = ch:receive(0.01)`+"\n"+
+			`assert(v == nil and ok == false and msg == "timeout")`+"\n"+
+			`ch:close()`+"\n"+
+			`local v, ok, msg = ch:receive()`+"\n"+
+			`assert(v == nil and ok == false and msg == nil)`+"\n"+
+			`assert(not pcall(ch.send, ch, 1))`+"\n"+
+			`assert(not pcall(ch.close, ch))`)
+	})
+
+	t.Run("Go", func(t *testing.T) {
+		l := newState(t, new(ChannelLibrary))
+		in := make(chan any)
+		out := make(chan any, 1)
+		if err := PushChannel(l, in); err != nil {
+			t.Fatal(err)
+		}
+		if ToChannel(l, -1) != in {
+			t.Error("ToChannel(l, -1) did not return the pushed channel")
+		}
+		if err := l.SetGlobal("input", 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := PushChannel(l, out); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.SetGlobal("output", 0); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			in <- "hello"
+			close(in)
+		}()
+		run(t, l, `local s = ""`+"\n"+
+			`while true do`+"\n"+
+			`  local v, ok = input:receive()`+"\n"+
+			`  if not ok then break end`+"\n"+
+			`  s = s .. v`+"\n"+
+			`end`+"\n"+
+			`output:send(s .. ", world")`)
+		if got, want := <-out, "hello, world"; got != want {
+			t.Errorf("received %#v; want %#v", got, want)
+		}
+	})
+
+	t.Run("Select", func(t *testing.T) {
+		l := newState(t, new(ChannelLibrary))
+		run(t, l, `local a, b = channel.new(1), channel.new(1)`+"\n"+
+			`assert(channel.select({{"receive", a}, {"receive", b}}, 0) == nil)`+"\n"+
+			`b:send(42)`+"\n"+
+			`local i, v, ok = channel.select({{"receive", a}, {"receive", b}})`+"\n"+
+			`assert(i == 2 and v == 42 and ok == true)`+"\n"+
+			`assert(channel.select({{"receive", a}, {"send", b, "x"}}) == 2)`+"\n"+
+			`assert(b:receive() == "x")`+"\n"+
+			`assert(not pcall(channel.select, {{"peek", a}}))`)
+	})
+
+	t.Run("Yield", func(t *testing.T) {
+		l := newState(t, &ChannelLibrary{YieldWhenBlocked: true})
+		ch := make(chan any, 1)
+		if err := PushChannel(l, ch); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.SetGlobal("ch", 0); err != nil {
+			t.Fatal(err)
+		}
+		thread := l.NewThread()
+		const source = `local v, ok = ch:receive()` + "\n" +
+			`return v .. "!"`
+		if err := thread.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		nResults, yielded, err := thread.Resume(l, 0)
+		if err != nil || !yielded || nResults != 1 {
+			t.Fatalf("first Resume(...) = %d, %t, %v; want 1, true, <nil>", nResults, yielded, err)
+		}
+		if ToChannel(thread, -1) != ch {
+			t.Errorf("coroutine yielded %v; want channel", thread.Type(-1))
+		}
+		thread.Pop(1)
+
+		ch <- "hi"
+		nResults, yielded, err = thread.Resume(l, 0)
+		if err != nil || yielded || nResults != 1 {
+			t.Fatalf("second Resume(...) = %d, %t, %v; want 1, false, <nil>", nResults, yielded, err)
+		}
+		if got, _ := thread.ToString(-1); got != "hi!" {
+			t.Errorf("coroutine returned %q; want \"hi!\"", got)
+		}
+	})
+
+	t.Run("BadSend", func(t *testing.T) {
+		l := newState(t, new(ChannelLibrary))
+		err := l.LoadString(`channel.new(1):send(io.stdout)`, "=(load)", "t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Call(0, 0, 0); err == nil || !strings.Contains(err.Error(), "bad argument #1 to 'send'") {
+			t.Errorf("sending a file = %v; want bad argument error", err)
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		l := newState(t, new(ChannelLibrary))
+		err := l.LoadString(`channel.new(0):receive()`, "=(load)", "t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.CallTimeout(10*time.Millisecond, 0, 0, 0); !errors.Is(err, ErrTimeout) {
+			t.Errorf("CallTimeout(...) = %v; want %v", err, ErrTimeout)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		l := newState(t, new(ChannelLibrary))
+		err := l.LoadString(`channel.select({{"receive", channel.new(0)}})`, "=(load)", "t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := l.CallContext(ctx, 0, 0, 0); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CallContext(...) = %v; want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zombiezen.com/go/lua"
+)
+
+// runCheck loads each of the named files as text chunks without running them
+// and reports any syntax errors to stderr as "file:line:col: message".
+// runCheck returns an error if any of the files could not be loaded.
+func runCheck(programName string, args []string) error {
+	fset := flag.NewFlagSet(programName+" check", flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s check file.lua [...]\n", programName)
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return errors.New("check: no input files given")
+	}
+
+	l := new(lua.State)
+	defer l.Close()
+	failed := 0
+	for _, name := range fset.Args() {
+		if msg := checkFile(l, name); msg != "" {
+			fmt.Fprintln(os.Stderr, msg)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("check: %d of %d files have errors", failed, fset.NArg())
+	}
+	return nil
+}
+
+// syntaxErrorPattern matches a Lua syntax error message
+// of the form "chunk:line: message".
+var syntaxErrorPattern = regexp.MustCompile(`^(?s)(.*?):([0-9]+): (.*)$`)
+
+// nearPattern matches the token that a Lua syntax error occurred near.
+var nearPattern = regexp.MustCompile(`near (?:'(.*)'|<eof>)$`)
+
+// checkFile loads the named file as a text chunk
+// and returns a description of the error, if any.
+func checkFile(l *lua.State, name string) string {
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return err.Error()
+	}
+	err = lua.LoadFile(l, name, "t")
+	msg, _ := l.ToString(-1)
+	l.Pop(1)
+	if err == nil {
+		return ""
+	}
+	m := syntaxErrorPattern.FindStringSubmatch(msg)
+	if m == nil {
+		return name + ": " + msg
+	}
+	line, err := strconv.Atoi(m[2])
+	if err != nil {
+		return name + ": " + msg
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", name, line, errorColumn(src, line, m[3]), m[3])
+}
+
+// errorColumn returns the 1-based byte column of the token
+// that the syntax error message refers to on the given line of src,
+// or 1 if the token cannot be found.
+// Lua does not report columns, so this is a best guess:
+// if the token appears more than once on the line,
+// errorColumn uses the first occurrence.
+func errorColumn(src []byte, line int, msg string) int {
+	lines := bytes.Split(src, []byte("\n"))
+	if line < 1 || line > len(lines) {
+		return 1
+	}
+	text := strings.TrimSuffix(string(lines[line-1]), "\r")
+	m := nearPattern.FindStringSubmatch(msg)
+	switch {
+	case m == nil:
+		return 1
+	case m[0] == "near <eof>":
+		return len(text) + 1
+	}
+	if i := strings.Index(text, m[1]); i >= 0 {
+		return i + 1
+	}
+	return 1
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"zombiezen.com/go/lua"
+)
+
+// runCompile precompiles Lua source files into binary chunks,
+// like the stock luac program.
+// With a single input file, the chunk is written to the -o file.
+// With multiple input files, each chunk is written
+// next to its source file with a ".luac" extension.
+func runCompile(programName string, args []string) error {
+	fset := flag.NewFlagSet(programName+" compile", flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s compile [-l] [-p] [-s] [-o file] file.lua [...]\n", programName)
+		fset.PrintDefaults()
+	}
+	output := fset.String("o", "", "output to `file` (default \"luac.out\"; only valid with one input)")
+	list := fset.Bool("l", false, "list chunk metadata")
+	parseOnly := fset.Bool("p", false, "parse only; do not write any output files")
+	strip := fset.Bool("s", false, "strip debug information")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return errors.New("compile: no input files given")
+	}
+	if *output != "" && fset.NArg() > 1 {
+		return errors.New("compile: -o cannot be used with multiple input files")
+	}
+
+	l := new(lua.State)
+	defer l.Close()
+	for _, name := range fset.Args() {
+		outName := *output
+		switch {
+		case *parseOnly:
+			outName = ""
+		case fset.NArg() > 1:
+			outName = strings.TrimSuffix(name, ".lua") + ".luac"
+		case outName == "":
+			outName = "luac.out"
+		}
+		if err := compileFile(l, name, outName, *strip, *list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileFile compiles the named source file ("-" for stdin)
+// and writes the binary chunk to outName, if it is not empty.
+// If list is true, compileFile prints the chunk's metadata to stdout.
+func compileFile(l *lua.State, name, outName string, strip, list bool) error {
+	loadName := name
+	if name == "-" {
+		loadName = ""
+	}
+	if err := lua.LoadFile(l, loadName, "t"); err != nil {
+		l.Pop(1)
+		return err
+	}
+	defer l.Pop(1)
+
+	chunk := new(bytes.Buffer)
+	if _, err := l.Dump(chunk, strip); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if list {
+		l.PushValue(-1)
+		info := l.Info(">SuL")
+		activeLines := 0
+		l.PushNil()
+		for l.Next(-2) {
+			activeLines++
+			l.Pop(1)
+		}
+		l.Pop(1)
+		params := fmt.Sprint(info.NumParams)
+		if info.IsVararg {
+			params += "+"
+		}
+		fmt.Printf("main <%s:%d,%d> (%d bytes, %d lines with code, %d upvalues, %s params)\n",
+			info.ShortSource, info.LineDefined, info.LastLineDefined,
+			chunk.Len(), activeLines, info.NumUpvalues, params)
+	}
+	if outName == "" {
+		return nil
+	}
+	if err := os.WriteFile(outName, chunk.Bytes(), 0o666); err != nil {
+		return err
+	}
+	return nil
+}
@@ -24,16 +24,23 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"zombiezen.com/go/lua"
+	"zombiezen.com/go/lua/luaprofile"
 )
 
 func main() {
@@ -42,7 +49,7 @@ func main() {
 		programName = filepath.Base(os.Args[0])
 	}
 	err := run(programName)
-	if err != nil {
+	if err != nil && !errors.Is(err, errTestsFailed) {
 		fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
 	}
 	if err != nil {
@@ -51,9 +58,29 @@ func main() {
 }
 
 func run(programName string) error {
+	// A script with the same name as a subcommand
+	// takes precedence over the subcommand.
+	if len(os.Args) > 1 && !fileExists(os.Args[1]) {
+		switch os.Args[1] {
+		case "deps":
+			return runDeps(programName, os.Args[2:])
+		case "compile":
+			return runCompile(programName, os.Args[2:])
+		case "check":
+			return runCheck(programName, os.Args[2:])
+		case "test":
+			return runTests(programName, os.Args[2:])
+		}
+	}
+
 	var exprArgs []exprArg
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [options] [script [args]]\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s [options] -n|-p stat [file ...]\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s deps [-path templates] script\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s compile [-l] [-p] [-s] [-o file] file.lua [...]\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s check file.lua [...]\n", programName)
+		fmt.Fprintf(os.Stderr, "       %s test [-v] [-run regexp] [dir]\n", programName)
 		flag.PrintDefaults()
 	}
 	flag.Var(exprArgFlag{'e', &exprArgs}, "e", "execute string '`stat`'")
@@ -61,13 +88,41 @@ func run(programName string) error {
 	interactive := flag.Bool("i", false, "enter interactive mode after executing 'script'")
 	showVersion := flag.Bool("v", false, "show version information")
 	noEnv := flag.Bool("E", false, "ignore environment variables")
+	warnings := flag.Bool("W", false, "turn warnings on")
+	profile := flag.String("profile", "", "write a pprof profile of the Lua code to `file`")
+	memProfile := flag.String("memprofile", "", "write a pprof profile of the Lua code's allocations to `file`")
+	flag.Var(&limits.memory, "memlimit", "limit the memory used by Lua to `size` bytes (with an optional K, M, or G suffix)")
+	flag.DurationVar(&limits.timeout, "timeout", 0, "stop running Lua code after `duration`")
+	var filter filterOptions
+	flag.StringVar(&filter.code, "n", "", "execute '`stat`' for each input line with the global 'line' set")
+	flag.StringVar(&filter.code, "p", "", "like -n, but print 'line' after executing '`stat`'")
+	flag.StringVar(&filter.begin, "begin", "", "with -n or -p, execute '`stat`' before reading input")
+	flag.StringVar(&filter.end, "end", "", "with -n or -p, execute '`stat`' after reading all input")
+	subprocess := flag.Bool(lua.SubprocessFlag[1:], false, "run a chunk from stdin in a sandbox and write its results to stdout (used by lua.Subprocess)")
+	subprocessUnsafe := flag.Bool("subprocess-unsafe", false, "with -subprocess, open all standard libraries instead of the sandbox")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			filter.print = true
+		}
+	})
+
+	if *subprocess {
+		return runSubprocess(*subprocessUnsafe)
+	}
 
 	if *showVersion || *interactive {
 		fmt.Println(lua.Copyright)
 	}
 
+	if limits.timeout > 0 {
+		limits.deadline = time.Now().Add(limits.timeout)
+	}
 	l := new(lua.State)
+	if limits.memory > 0 {
+		l = lua.NewStateWithLimit(int64(limits.memory))
+	}
+	l.SetWarnHandler((&warnHandler{on: *warnings}).warn)
 	if *noEnv {
 		l.PushBoolean(true)
 		l.RawSetField(lua.RegistryIndex, "LUA_NOENV")
@@ -75,11 +130,30 @@ func run(programName string) error {
 	if err := lua.OpenLibraries(l); err != nil {
 		return err
 	}
+	if *profile != "" {
+		p := luaprofile.Start(l, nil)
+		defer func() {
+			p.Stop()
+			if err := writeProfile(*profile, p); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+			}
+		}()
+	}
+	if *memProfile != "" {
+		p := luaprofile.StartAlloc(l, nil)
+		defer func() {
+			p.Stop()
+			if err := writeProfile(*memProfile, p); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", programName, err)
+			}
+		}()
+	}
 
 	var script int
 	if len(os.Args) == 0 {
 		script = -1
-	} else if flag.NArg() == 0 {
+	} else if flag.NArg() == 0 || filter.code != "" {
+		// In filter mode, the remaining arguments are input files.
 		script = 0
 	} else {
 		script = len(os.Args) - flag.NArg()
@@ -107,6 +181,9 @@ func run(programName string) error {
 			panic("unreachable")
 		}
 	}
+	if filter.code != "" {
+		return runFilter(l, &filter, flag.Args())
+	}
 	if flag.NArg() > 0 {
 		if err := handleScript(l, flag.Args()); err != nil {
 			return err
@@ -131,6 +208,209 @@ func run(programName string) error {
 	return nil
 }
 
+// warnHandler writes warnings to stderr
+// the same way as the reference interpreter.
+// Warnings can be turned on and off with the "@on" and "@off" control messages.
+type warnHandler struct {
+	on        bool
+	continued bool
+}
+
+func (h *warnHandler) warn(msg string, toBeContinued bool) {
+	if !h.continued && !toBeContinued && strings.HasPrefix(msg, "@") {
+		switch msg {
+		case "@on":
+			h.on = true
+		case "@off":
+			h.on = false
+		}
+		return
+	}
+	if h.on {
+		if !h.continued {
+			os.Stderr.WriteString("Lua warning: ")
+		}
+		os.Stderr.WriteString(msg)
+		if !toBeContinued {
+			os.Stderr.WriteString("\n")
+		}
+	}
+	h.continued = toBeContinued
+}
+
+// filterOptions holds the flags for running the interpreter as a line filter.
+type filterOptions struct {
+	code  string
+	print bool
+	begin string
+	end   string
+}
+
+// runFilter runs opts.code for each line in the named files
+// (or stdin if there are none),
+// like awk or perl -n/-p.
+// The global 'line' holds the current line without its line ending
+// and the global 'NR' holds the current line number.
+func runFilter(l *lua.State, opts *filterOptions, files []string) error {
+	if opts.begin != "" {
+		if err := doString(l, opts.begin, "=(begin)"); err != nil {
+			return err
+		}
+	}
+	if err := l.LoadString(opts.code, "=(command line)", "t"); err != nil {
+		l.Pop(1)
+		return err
+	}
+	code := l.AbsIndex(-1)
+
+	nr := int64(0)
+	processLine := func(line string) error {
+		nr++
+		l.PushString(line)
+		if err := l.SetGlobal("line", 0); err != nil {
+			return err
+		}
+		l.PushInteger(nr)
+		if err := l.SetGlobal("NR", 0); err != nil {
+			return err
+		}
+		l.PushValue(code)
+		if err := doCall(l, 0, 0); err != nil {
+			return err
+		}
+		if !opts.print {
+			return nil
+		}
+		if _, err := l.Global("line", 0); err != nil {
+			return err
+		}
+		s, err := lua.ToString(l, -1)
+		l.Pop(1)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, s)
+		return err
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if err := filterFile(name, processLine); err != nil {
+			return err
+		}
+	}
+	l.Remove(code)
+
+	if opts.end != "" {
+		if err := doString(l, opts.end, "=(end)"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterFile calls f for each line in the named file,
+// with "-" meaning stdin.
+func filterFile(name string, f func(line string) error) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<30)
+	for s.Scan() {
+		if err := f(s.Text()); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// runDeps prints the modules that a script requires,
+// as found by [lua.Dependencies] relative to the working directory.
+// A script named "deps" can be run as "./deps".
+func runDeps(programName string, args []string) error {
+	fset := flag.NewFlagSet(programName+" deps", flag.ContinueOnError)
+	searchPath := fset.String("path", lua.DefaultFSPath, "';'-separated module search `templates`")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("deps takes exactly one script")
+	}
+	entry := filepath.ToSlash(filepath.Clean(fset.Arg(0)))
+	if !fs.ValidPath(entry) {
+		return fmt.Errorf("%s: script must be inside the working directory", fset.Arg(0))
+	}
+	g, err := lua.Dependencies(os.DirFS("."), entry, *searchPath)
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(g.Files))
+	for file := range g.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		for _, mod := range g.Files[file] {
+			found, ok := g.Modules[mod]
+			if !ok {
+				found = "(missing)"
+			}
+			fmt.Printf("%s: %s %s\n", file, mod, found)
+		}
+	}
+	return nil
+}
+
+// runSubprocess serves a single lua.Subprocess request.
+// The chunk runs in a sandbox unless unsafe is true.
+// Output from the chunk is sent to stderr
+// so that stdout only contains the response.
+func runSubprocess(unsafe bool) error {
+	l := new(lua.State)
+	defer l.Close()
+	if !unsafe {
+		if err := lua.OpenSandbox(l, &lua.SandboxOptions{Output: os.Stderr}); err != nil {
+			return err
+		}
+		return lua.ServeSubprocess(l, os.Stdin, os.Stdout)
+	}
+	ioLib := lua.NewIOLibrary()
+	ioLib.Stdout = os.Stderr
+	libs := []struct {
+		name  string
+		openf lua.Function
+	}{
+		{lua.GName, lua.NewOpenBase(os.Stderr, nil)},
+		{lua.CoroutineLibraryName, lua.OpenCoroutine},
+		{lua.TableLibraryName, lua.OpenTable},
+		{lua.IOLibraryName, ioLib.OpenLibrary},
+		{lua.OSLibraryName, lua.NewOSLibrary().OpenLibrary},
+		{lua.StringLibraryName, lua.OpenString},
+		{lua.UTF8LibraryName, lua.OpenUTF8},
+		{lua.MathLibraryName, lua.NewOpenMath(nil)},
+	}
+	for _, lib := range libs {
+		if err := lua.Require(l, lib.name, true, lib.openf); err != nil {
+			return err
+		}
+		l.Pop(1)
+	}
+	return lua.ServeSubprocess(l, os.Stdin, os.Stdout)
+}
+
 func doREPL(l *lua.State) error {
 	s := bufio.NewScanner(os.Stdin)
 	for {
@@ -188,22 +468,11 @@ func handleInit(l *lua.State) error {
 }
 
 func handleScript(l *lua.State, args []string) error {
-	var r io.ReadCloser
 	name := args[0]
 	if name == "-" {
-		r = io.NopCloser(os.Stdin)
-		name = "=stdin"
-	} else {
-		var err error
-		r, err = os.Open(name)
-		if err != nil {
-			return err
-		}
-		name = "@" + name
+		name = ""
 	}
-	err := l.Load(r, name, "bt")
-	r.Close()
-	if err != nil {
+	if err := lua.LoadFile(l, name, "bt"); err != nil {
 		return err
 	}
 
@@ -262,13 +531,7 @@ func doString(l *lua.State, s string, chunkName string) error {
 }
 
 func doFile(l *lua.State, name string) error {
-	f, err := os.Open(name)
-	if err != nil {
-		return err
-	}
-	err = l.Load(f, "@"+name, "bt")
-	f.Close()
-	if err != nil {
+	if err := lua.LoadFile(l, name, "bt"); err != nil {
 		l.Pop(1)
 		return err
 	}
@@ -279,15 +542,137 @@ func doCall(l *lua.State, nArgs, nResults int) error {
 	base := l.Top() - nArgs
 	l.PushClosure(0, msgHandler)
 	l.Insert(base)
-	// TODO(someday): Catch signals.
-	err := l.Call(nArgs, nResults, base)
+	ctx, stop := interruptOnSignal(limits.deadline)
+	err := l.CallContext(ctx, nArgs, nResults, base)
+	stop()
 	if err != nil {
 		l.Pop(1)
+		if limits.memory > 0 && lua.IsOutOfMemory(err) {
+			err = fmt.Errorf("%w (memory limit of %v exceeded)", err, limits.memory)
+		}
 	}
 	l.Remove(base)
 	return err
 }
 
+// runLimits holds the resource limits given on the command line.
+type runLimits struct {
+	memory   byteSize
+	timeout  time.Duration
+	deadline time.Time
+}
+
+// limits is the set of resource limits for the process.
+// It is set by the command-line flags.
+var limits runLimits
+
+// byteSize is a [flag.Value] for a number of bytes
+// with an optional K, M, or G suffix (powers of 1024).
+type byteSize int64
+
+func (b byteSize) String() string {
+	switch {
+	case b != 0 && b%(1<<30) == 0:
+		return fmt.Sprintf("%dG", b>>30)
+	case b != 0 && b%(1<<20) == 0:
+		return fmt.Sprintf("%dM", b>>20)
+	case b != 0 && b%(1<<10) == 0:
+		return fmt.Sprintf("%dK", b>>10)
+	default:
+		return strconv.FormatInt(int64(b), 10)
+	}
+}
+
+func (b *byteSize) Set(s string) error {
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	digits := s
+	if shift != 0 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n << shift)
+	return nil
+}
+
+// errInterrupted is the error raised in a running chunk
+// when the user presses Ctrl-C.
+var errInterrupted = errors.New("interrupted!")
+
+// interruptContext is a [context.Context]
+// that is done once the process receives an interrupt signal
+// or its deadline passes.
+type interruptContext struct {
+	deadline time.Time
+	done     chan struct{}
+	// err is set before done is closed.
+	err error
+}
+
+// interruptOnSignal returns a context that is done
+// once the process receives an interrupt signal
+// or once the deadline passes (if it is not zero).
+// Until stop is called, interrupt signals do not terminate the process.
+func interruptOnSignal(deadline time.Time) (ctx context.Context, stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	ictx := &interruptContext{
+		deadline: deadline,
+		done:     make(chan struct{}),
+	}
+	var timer *time.Timer
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer = time.NewTimer(time.Until(deadline))
+		expired = timer.C
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-c:
+			ictx.err = errInterrupted
+			close(ictx.done)
+		case <-expired:
+			ictx.err = fmt.Errorf("timeout of %v exceeded", limits.timeout)
+			close(ictx.done)
+		case <-stopped:
+		}
+	}()
+	return ictx, func() {
+		signal.Stop(c)
+		if timer != nil {
+			timer.Stop()
+		}
+		close(stopped)
+	}
+}
+
+func (ctx *interruptContext) Deadline() (time.Time, bool) {
+	return ctx.deadline, !ctx.deadline.IsZero()
+}
+
+func (ctx *interruptContext) Done() <-chan struct{} { return ctx.done }
+func (ctx *interruptContext) Value(key any) any     { return nil }
+
+func (ctx *interruptContext) Err() error {
+	select {
+	case <-ctx.done:
+		return ctx.err
+	default:
+		return nil
+	}
+}
+
 func msgHandler(l *lua.State) (int, error) {
 	msg, ok := l.ToString(1)
 	if !ok {
@@ -297,8 +682,7 @@ func msgHandler(l *lua.State) (int, error) {
 		}
 		msg = fmt.Sprintf("(error object is a %v value)", l.Type(1))
 	}
-	// TODO(soon): Append a standard traceback.
-	l.PushString(msg)
+	lua.Traceback(l, l, msg, 1)
 	return 1, nil
 }
 
@@ -458,3 +842,25 @@ func (f exprArgFlag) Set(s string) error {
 func (f exprArgFlag) Get() any {
 	return *f.slice
 }
+
+// writeProfile writes the profile to the named file.
+func writeProfile(name string, p interface{ Write(io.Writer) error }) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = p.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write profile: %v", err)
+	}
+	return nil
+}
+
+// fileExists reports whether a file with the given name exists.
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
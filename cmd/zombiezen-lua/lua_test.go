@@ -0,0 +1,414 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/lua"
+)
+
+// mainEnv is the environment variable that makes the test binary
+// run the interpreter's main function instead of the tests.
+const mainEnv = "ZOMBIEZEN_LUA_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// cliCommand returns a command that runs the interpreter
+// with the given arguments in the testdata directory.
+func cliCommand(t *testing.T, env []string, args ...string) *exec.Cmd {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip("Cannot find test executable:", err)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = "testdata"
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LUA_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, mainEnv+"=1")
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
+func TestCLI(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		env   []string
+		stdin string
+		// wantStdout and wantStderr are substrings
+		// of the expected standard output and standard error.
+		// If empty, the output must be empty.
+		wantStdout string
+		wantStderr string
+		wantFail   bool
+	}{
+		{
+			name:       "Script",
+			args:       []string{"hello.lua", "a", "b"},
+			wantStdout: "hello\ta\tb\n",
+		},
+		{
+			name:       "ScriptFromStdin",
+			args:       []string{"-", "x"},
+			stdin:      `print("stdin", ...)`,
+			wantStdout: "stdin\tx\n",
+		},
+		{
+			name:       "Expression",
+			args:       []string{"-e", "print(1 + 1)"},
+			wantStdout: "2\n",
+		},
+		{
+			name:       "Library",
+			args:       []string{"-l", "g=greet", "-e", "print(g.hello())"},
+			env:        []string{"LUA_PATH=lib/?.lua"},
+			wantStdout: "hi from greet\n",
+		},
+		{
+			name:       "DefaultPathExpansion",
+			args:       []string{"-e", `print(package.path:sub(1, 10), package.path:find(";;", 1, true))`},
+			env:        []string{"LUA_PATH=lib/?.lua;;"},
+			wantStdout: "lib/?.lua;\tnil\n",
+		},
+		{
+			name:       "NoEnv",
+			args:       []string{"-E", "-e", `print(package.path:sub(1, 9) == "lib/?.lua")`},
+			env:        []string{"LUA_PATH=lib/?.lua;;", "LUA_INIT=error('init')"},
+			wantStdout: "false\n",
+		},
+		{
+			name:       "Init",
+			args:       []string{"-e", "print(x)"},
+			env:        []string{"LUA_INIT=x = 42"},
+			wantStdout: "42\n",
+		},
+		{
+			name:       "FilterN",
+			args:       []string{"-n", "if NR == 2 then print(line) end", "lines.txt"},
+			wantStdout: "b\n",
+		},
+		{
+			name:       "FilterP",
+			args:       []string{"-p", "line = NR .. ':' .. line"},
+			stdin:      "x\ny\n",
+			wantStdout: "1:x\n2:y\n",
+		},
+		{
+			name: "FilterBeginEnd",
+			args: []string{
+				"-begin", "n = 0",
+				"-n", "n = n + #line",
+				"-end", "print(n)",
+				"lines.txt", "lines.txt",
+			},
+			wantStdout: "6\n",
+		},
+		{
+			name:       "FilterError",
+			args:       []string{"-n", "error('bad line ' .. NR)", "lines.txt"},
+			wantStderr: "bad line 1",
+			wantFail:   true,
+		},
+		{
+			name: "WarningsOff",
+			args: []string{"-e", `warn("hi")`},
+		},
+		{
+			name:       "WarningsOn",
+			args:       []string{"-W", "-e", `warn("hi")`},
+			wantStderr: "Lua warning: hi\n",
+		},
+		{
+			name:       "WarningsControl",
+			args:       []string{"-e", `warn("@on"); warn("a", "b")`},
+			wantStderr: "Lua warning: ab\n",
+		},
+		{
+			name:       "Traceback",
+			args:       []string{"-"},
+			stdin:      "local function f() error('boom') end\nf()",
+			wantStderr: "boom\nstack traceback:\n",
+			wantFail:   true,
+		},
+		{
+			name:       "MemoryLimit",
+			args:       []string{"-memlimit", "1M", "alloc.lua"},
+			wantStderr: "memory limit of 1M exceeded",
+			wantFail:   true,
+		},
+		{
+			name:       "MemoryLimitNotReached",
+			args:       []string{"-memlimit", "64M", "hello.lua"},
+			wantStdout: "hello\n",
+		},
+		{
+			name:       "InvalidMemoryLimit",
+			args:       []string{"-memlimit", "12X", "hello.lua"},
+			wantStderr: `invalid size "12X"`,
+			wantFail:   true,
+		},
+		{
+			name:       "Timeout",
+			args:       []string{"-timeout", "100ms", "loop.lua"},
+			wantStderr: "timeout of 100ms exceeded",
+			wantFail:   true,
+		},
+		{
+			name: "Check",
+			args: []string{"check", "hello.lua"},
+		},
+		{
+			name:       "CheckSyntaxError",
+			args:       []string{"check", "hello.lua", "syntax.lua"},
+			wantStderr: "syntax.lua:1:9: unexpected symbol near '='\n",
+			wantFail:   true,
+		},
+		{
+			name:       "CompileList",
+			args:       []string{"compile", "-p", "-l", "hello.lua"},
+			wantStdout: "main <hello.lua:0,0> (",
+		},
+		{
+			name:       "CompileSyntaxError",
+			args:       []string{"compile", "-p", "syntax.lua"},
+			wantStderr: "unexpected symbol near '='",
+			wantFail:   true,
+		},
+		{
+			name:       "CompileOutputWithMultipleFiles",
+			args:       []string{"compile", "-o", "x.luac", "hello.lua", "loop.lua"},
+			wantStderr: "-o cannot be used with multiple input files",
+			wantFail:   true,
+		},
+		{
+			name:       "Deps",
+			args:       []string{"deps", "-path", "lib/?.lua", "deps.lua"},
+			wantStdout: "deps.lua: greet lib/greet.lua\n",
+		},
+		{
+			name:       "TestPass",
+			args:       []string{"test", "tests/pass"},
+			wantStdout: "PASS\n",
+		},
+		{
+			name:       "TestVerboseRun",
+			args:       []string{"test", "-v", "-run", "Concat", "tests/pass"},
+			wantStdout: "=== RUN   tests/pass/math_test.lua/testConcat\n--- PASS: tests/pass/math_test.lua/testConcat",
+		},
+		{
+			name:       "TestFail",
+			args:       []string{"test", "tests/fail"},
+			wantStdout: "--- FAIL: tests/fail/fail_test.lua/testWrong",
+			wantFail:   true,
+		},
+		{
+			name:       "TestInvalidRun",
+			args:       []string{"test", "-run", "(", "tests/pass"},
+			wantStderr: "test: -run:",
+			wantFail:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := cliCommand(t, test.env, test.args...)
+			cmd.Stdin = strings.NewReader(test.stdin)
+			stdout := new(strings.Builder)
+			stderr := new(strings.Builder)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			err := cmd.Run()
+			if exitErr := (*exec.ExitError)(nil); err != nil && !errors.As(err, &exitErr) {
+				t.Fatal(err)
+			}
+			if failed := err != nil; failed != test.wantFail {
+				t.Errorf("failed = %t; want %t (stderr: %s)", failed, test.wantFail, stderr)
+			}
+			if test.wantStdout == "" && stdout.Len() > 0 {
+				t.Errorf("stdout:\n%s\nwant empty", stdout)
+			} else if !strings.Contains(stdout.String(), test.wantStdout) {
+				t.Errorf("stdout:\n%s\nwant to contain:\n%s", stdout, test.wantStdout)
+			}
+			if test.wantStderr == "" && stderr.Len() > 0 {
+				t.Errorf("stderr:\n%s\nwant empty", stderr)
+			} else if !strings.Contains(stderr.String(), test.wantStderr) {
+				t.Errorf("stderr:\n%s\nwant to contain:\n%s", stderr, test.wantStderr)
+			}
+		})
+	}
+}
+
+func TestSubcommandNameCollision(t *testing.T) {
+	cmd := cliCommand(t, nil, "test", "x")
+	cmd.Dir = filepath.Join("testdata", "collide")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if got, want := string(output), "script named test\tx\n"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hello.luac")
+	cmd := cliCommand(t, nil, "compile", "-s", "-o", out, "hello.lua")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("compile: %v\n%s", err, output)
+	}
+	chunk, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(chunk, []byte("\x1bLua")) {
+		t.Errorf("%s does not start with the binary chunk signature", out)
+	}
+
+	cmd = cliCommand(t, nil, out, "x")
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(output), "hello\tx\n"; got != want {
+		t.Errorf("running compiled chunk printed %q; want %q", got, want)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	dir := t.TempDir()
+	cpuProfile := filepath.Join(dir, "cpu.pprof")
+	memProfile := filepath.Join(dir, "mem.pprof")
+	cmd := cliCommand(t, nil, "-profile", cpuProfile, "-memprofile", memProfile, "hello.lua")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	for _, name := range []string{cpuProfile, memProfile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Error(err)
+		} else if info.Size() == 0 {
+			t.Errorf("%s is empty", name)
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Cannot send interrupt signals on Windows")
+	}
+	cmd := cliCommand(t, nil, "ready.lua")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := new(strings.Builder)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		cmd.Process.Kill()
+	}()
+
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("first line = %q, %v; want \"ready\\n\"", line, err)
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		t.Fatal("interpreter did not stop after interrupt")
+	}
+	if err == nil {
+		t.Error("interpreter exited successfully after interrupt")
+	}
+	if !strings.Contains(stderr.String(), "interrupted!") {
+		t.Errorf("stderr:\n%s\nwant to contain \"interrupted!\"", stderr)
+	}
+}
+
+func TestSubprocess(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip("Cannot find test executable:", err)
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		wantIO bool
+	}{
+		{name: "Sandbox", wantIO: false},
+		{name: "Unsafe", args: []string{"-subprocess-unsafe"}, wantIO: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := new(lua.State)
+			defer func() {
+				if err := state.Close(); err != nil {
+					t.Error("Close:", err)
+				}
+			}()
+			sp := &lua.Subprocess{
+				Path: exe,
+				Args: test.args,
+				Env:  append(os.Environ(), mainEnv+"=1"),
+			}
+			n, err := sp.Run(context.Background(), state, strings.NewReader("return io ~= nil, string.upper('x')"), "=(subprocess)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Fatalf("Run(...) = %d; want 2", n)
+			}
+			if got := state.ToBoolean(1); got != test.wantIO {
+				t.Errorf("io ~= nil = %t; want %t", got, test.wantIO)
+			}
+			if got, _ := state.ToString(2); got != "X" {
+				t.Errorf("string.upper('x') = %q; want \"X\"", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+local greet = {}
+
+function greet.hello()
+  return "hi from greet"
+end
+
+return greet
@@ -0,0 +1 @@
+while true do end
@@ -0,0 +1,3 @@
+print("ready")
+io.stdout:flush()
+while true do end
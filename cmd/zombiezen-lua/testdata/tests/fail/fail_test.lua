@@ -0,0 +1,8 @@
+local testing = require("testing")
+
+function testOK()
+end
+
+function testWrong()
+  testing.equal(1, 2, "one")
+end
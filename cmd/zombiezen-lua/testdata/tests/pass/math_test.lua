@@ -0,0 +1,9 @@
+local testing = require("testing")
+
+function testAdd()
+  testing.equal(1 + 1, 2)
+end
+
+function testConcat()
+  testing.equal("a" .. "b", "ab")
+end
@@ -0,0 +1,381 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/lua"
+)
+
+// errTestsFailed is returned by runTests when a test fails.
+// The failures have already been reported.
+var errTestsFailed = errors.New("tests failed")
+
+// testingModuleName is the name of the assertion module
+// that test files can require.
+const testingModuleName = "testing"
+
+// testingModuleSource is the source of the assertion module.
+const testingModuleSource = `
+local testing = {}
+
+local function show(v)
+  if type(v) == "string" then
+    return string.format("%q", v)
+  end
+  return tostring(v)
+end
+
+local function prefix(msg)
+  if msg then
+    return tostring(msg) .. ": "
+  end
+  return ""
+end
+
+local function deepequal(a, b, seen)
+  if a == b then return true end
+  if type(a) ~= "table" or type(b) ~= "table" then return false end
+  seen = seen or {}
+  if seen[a] == b then return true end
+  seen[a] = b
+  for k, v in pairs(a) do
+    if not deepequal(v, b[k], seen) then return false end
+  end
+  for k in pairs(b) do
+    if a[k] == nil then return false end
+  end
+  return true
+end
+
+-- equal fails the test if got ~= want.
+function testing.equal(got, want, msg)
+  if got ~= want then
+    error(prefix(msg) .. "got " .. show(got) .. "; want " .. show(want), 2)
+  end
+end
+
+-- deepequal fails the test if got and want are not equal
+-- or tables with deeply equal contents.
+function testing.deepequal(got, want, msg)
+  if not deepequal(got, want) then
+    error(prefix(msg) .. "got " .. show(got) .. "; want a value deeply equal to " .. show(want), 2)
+  end
+end
+
+-- truthy fails the test if v is false or nil.
+function testing.truthy(v, msg)
+  if not v then
+    error(prefix(msg) .. "got " .. show(v) .. "; want a true value", 2)
+  end
+end
+
+-- raises fails the test if f does not raise an error
+-- or if the error message does not match the given Lua pattern.
+function testing.raises(f, pattern, msg)
+  local ok, err = pcall(f)
+  if ok then
+    error(prefix(msg) .. "function did not raise an error", 2)
+  end
+  if pattern and not string.find(tostring(err), pattern) then
+    error(prefix(msg) .. "error " .. show(tostring(err)) .. " does not match " .. show(pattern), 2)
+  end
+end
+
+-- fail fails the test with the given message.
+function testing.fail(msg)
+  error(msg or "test failed", 2)
+end
+
+return testing
+`
+
+// runTests runs the tests in the *_test.lua files in a directory tree
+// and prints the results in the same format as "go test".
+// Each global function in a test file whose name starts with "test" is a test.
+// Each test runs in a new state
+// in which the test file has been run from the beginning,
+// so tests cannot affect each other.
+// With -cover, runTests also reports the fraction of lines that the tests ran.
+func runTests(programName string, args []string) error {
+	fset := flag.NewFlagSet(programName+" test", flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "usage: %s test [-v] [-run regexp] [-cover] [-coverprofile file] [-coverhtml file] [dir]\n", programName)
+		fset.PrintDefaults()
+	}
+	verbose := fset.Bool("v", false, "print the name of each test as it runs and tracebacks of failures")
+	runPattern := fset.String("run", "", "run only the tests whose names match `regexp`")
+	cover := fset.Bool("cover", false, "report line coverage")
+	coverProfile := fset.String("coverprofile", "", "write an LCOV coverage report to `file` (implies -cover)")
+	coverHTML := fset.String("coverhtml", "", "write an HTML coverage report to `file` (implies -cover)")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() > 1 {
+		fset.Usage()
+		return errors.New("test takes at most one directory")
+	}
+	dir := "."
+	if fset.NArg() == 1 {
+		dir = fset.Arg(0)
+	}
+	var run *regexp.Regexp
+	if *runPattern != "" {
+		var err error
+		run, err = regexp.Compile(*runPattern)
+		if err != nil {
+			return fmt.Errorf("test: -run: %v", err)
+		}
+	}
+
+	var coverage *lua.Coverage
+	if *cover || *coverProfile != "" || *coverHTML != "" {
+		coverage = new(lua.Coverage)
+	}
+
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), "_test.lua") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("test: %v", err)
+	}
+
+	start := time.Now()
+	passed, failed := 0, 0
+	for _, file := range files {
+		names, err := findTests(file)
+		if err != nil {
+			fmt.Printf("--- FAIL: %s\n    %s\n", file, indentOutput(err.Error()))
+			failed++
+			continue
+		}
+		for _, name := range names {
+			if run != nil && !run.MatchString(name) {
+				continue
+			}
+			fullName := file + "/" + name
+			if *verbose {
+				fmt.Printf("=== RUN   %s\n", fullName)
+			}
+			testStart := time.Now()
+			err := runTest(file, name, coverage)
+			elapsed := time.Since(testStart).Seconds()
+			if err != nil {
+				msg := err.Error()
+				if !*verbose {
+					// Only show the traceback in verbose mode.
+					msg, _, _ = strings.Cut(msg, "\nstack traceback:")
+				}
+				fmt.Printf("--- FAIL: %s (%.2fs)\n    %s\n", fullName, elapsed, indentOutput(msg))
+				failed++
+			} else {
+				if *verbose {
+					fmt.Printf("--- PASS: %s (%.2fs)\n", fullName, elapsed)
+				}
+				passed++
+			}
+		}
+	}
+
+	elapsed := time.Since(start).Seconds()
+	if coverage != nil {
+		if err := writeCoverage(coverage, *coverProfile, *coverHTML); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		fmt.Println("FAIL")
+		fmt.Printf("FAIL\t%s\t%.3fs\t(%d passed, %d failed)\n", dir, elapsed, passed, failed)
+		return errTestsFailed
+	}
+	fmt.Println("PASS")
+	fmt.Printf("ok  \t%s\t%.3fs\t(%d passed)\n", dir, elapsed, passed)
+	return nil
+}
+
+// newTestState returns a new state for running the given test file
+// with the file loaded and run.
+// If coverage is not nil, the lines that run in the state are recorded in it.
+func newTestState(file string, coverage *lua.Coverage) (*lua.State, error) {
+	l := new(lua.State)
+	if coverage != nil {
+		l.SetCoverage(coverage)
+	}
+	if err := lua.OpenLibraries(l); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	// Let test files require modules next to them and the assertion module.
+	dir := filepath.Dir(file)
+	if _, err := l.Global(lua.PackageLibraryName, 0); err != nil {
+		l.Close()
+		return nil, err
+	}
+	l.RawField(-1, "path")
+	p, _ := l.ToString(-1)
+	l.Pop(1)
+	l.PushString(filepath.Join(dir, "?.lua") + ";" + filepath.Join(dir, "?", "init.lua") + ";" + p)
+	l.RawSetField(-2, "path")
+	l.Pop(1)
+	if _, err := lua.Subtable(l, lua.RegistryIndex, lua.PreloadTable); err != nil {
+		l.Close()
+		return nil, err
+	}
+	l.PushClosure(0, func(l *lua.State) (int, error) {
+		if err := l.LoadString(testingModuleSource, "="+testingModuleName, "t"); err != nil {
+			return 0, err
+		}
+		if err := l.Call(0, 1, 0); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+	l.RawSetField(-2, testingModuleName)
+	l.Pop(1)
+
+	if err := lua.LoadFile(l, file, "t"); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := doCall(l, 0, 0); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// findTests returns the names of the tests in the given file
+// in the order they are defined.
+func findTests(file string) ([]string, error) {
+	l, err := newTestState(file, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	type test struct {
+		name string
+		line int
+	}
+	var tests []test
+	l.RawIndex(lua.RegistryIndex, lua.RegistryIndexGlobals)
+	l.PushNil()
+	for l.Next(-2) {
+		name, isString := l.ToString(-2)
+		if isString && l.Type(-2) == lua.TypeString && strings.HasPrefix(name, "test") && l.Type(-1) == lua.TypeFunction {
+			info := l.Info(">S")
+			tests = append(tests, test{name, info.LineDefined})
+		} else {
+			l.Pop(1)
+		}
+	}
+	l.Pop(1)
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].line != tests[j].line {
+			return tests[i].line < tests[j].line
+		}
+		return tests[i].name < tests[j].name
+	})
+	names := make([]string, len(tests))
+	for i, t := range tests {
+		names[i] = t.name
+	}
+	return names, nil
+}
+
+// runTest runs the named test function from the given file in a new state.
+func runTest(file, name string, coverage *lua.Coverage) error {
+	l, err := newTestState(file, coverage)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if _, err := l.Global(name, 0); err != nil {
+		return err
+	}
+	return doCall(l, 0, 0)
+}
+
+// writeCoverage prints a summary of the coverage
+// and writes the LCOV and HTML reports if their paths are not empty.
+func writeCoverage(coverage *lua.Coverage, lcovPath, htmlPath string) error {
+	covered, total := coverage.Summary()
+	percent := 0.0
+	if total > 0 {
+		percent = float64(covered) * 100 / float64(total)
+	}
+	fmt.Printf("coverage: %.1f%% of lines\n", percent)
+	if lcovPath != "" {
+		if err := writeCoverageFile(lcovPath, coverage.WriteLCOV); err != nil {
+			return err
+		}
+	}
+	if htmlPath != "" {
+		err := writeCoverageFile(htmlPath, func(w io.Writer) error {
+			return coverage.WriteHTML(w, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCoverageFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("test: %v", err)
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("test: %v", err)
+	}
+	return nil
+}
+
+// indentOutput indents every line of s after the first
+// to line up under a test's result line.
+func indentOutput(s string) string {
+	return strings.ReplaceAll(s, "\n", "\n    ")
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// CommandMode specifies how a command started by a [CommandRunner]
+// is connected to its caller.
+type CommandMode int
+
+const (
+	// CommandExecute runs a command for os.execute.
+	// The command uses the host's standard streams
+	// and the caller only waits for it to finish.
+	CommandExecute CommandMode = iota
+	// CommandRead runs a command for io.popen(command, "r").
+	// Reading from the [Process] reads the command's standard output.
+	CommandRead
+	// CommandWrite runs a command for io.popen(command, "w").
+	// Writing to the [Process] writes to the command's standard input.
+	CommandWrite
+)
+
+// String returns the name of the mode's constant.
+func (mode CommandMode) String() string {
+	switch mode {
+	case CommandExecute:
+		return "CommandExecute"
+	case CommandRead:
+		return "CommandRead"
+	case CommandWrite:
+		return "CommandWrite"
+	default:
+		return fmt.Sprintf("CommandMode(%d)", int(mode))
+	}
+}
+
+// A CommandRunner starts operating system commands
+// on behalf of os.execute and io.popen.
+// Hosts can provide their own CommandRunner
+// (see [OSLibrary] and [IOLibrary])
+// to sandbox, log, or virtualize subprocess execution.
+// [ExecCommandRunner] is the default implementation.
+type CommandRunner interface {
+	// StartCommand starts the given shell command.
+	// The Lua libraries call StartCommand with [context.Background].
+	StartCommand(ctx context.Context, command string, mode CommandMode) (Process, error)
+}
+
+// Process is a command started by a [CommandRunner].
+type Process interface {
+	// Read reads from the command's standard output
+	// if the command was started with [CommandRead].
+	io.Reader
+	// Write writes to the command's standard input
+	// if the command was started with [CommandWrite].
+	io.Writer
+	// Wait closes any pipes to the command
+	// and waits for the command to exit.
+	// Wait returns nil if the command exited successfully.
+	// Wait may return an [*ExitError] (or an [*exec.ExitError])
+	// to report the command's exit status to Lua.
+	Wait() error
+}
+
+// ExitError is an error that reports a command's unsuccessful exit
+// as the results of os.execute.
+type ExitError struct {
+	// Signaled is true if the command was terminated by a signal.
+	Signaled bool
+	// Status is the command's exit status
+	// or the signal number if Signaled is true.
+	Status int
+}
+
+// Error returns a description of the exit status.
+func (e *ExitError) Error() string {
+	if e.Signaled {
+		return fmt.Sprintf("signal: %d", e.Status)
+	}
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// ExecCommandRunner is a [CommandRunner] that uses [os/exec]
+// to run commands in the operating system shell.
+// Commands use the host's standard streams
+// for any stream not connected to the Process.
+// If the Context passed to StartCommand is done before the command exits,
+// then the command is killed.
+type ExecCommandRunner struct{}
+
+// StartCommand starts the command in the operating system shell.
+func (ExecCommandRunner) StartCommand(ctx context.Context, command string, mode CommandMode) (Process, error) {
+	c := osCommand(command)
+	p := &execProcess{cmd: c}
+	var err error
+	switch mode {
+	case CommandExecute:
+		c.Stdin = os.Stdin
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+	case CommandRead:
+		c.Stdin = os.Stdin
+		c.Stderr = os.Stderr
+		p.r, err = c.StdoutPipe()
+	case CommandWrite:
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		p.w, err = c.StdinPipe()
+	default:
+		return nil, fmt.Errorf("start %q: invalid mode %v", command, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	p.stop = context.AfterFunc(ctx, func() {
+		c.Process.Kill()
+	})
+	return p, nil
+}
+
+type execProcess struct {
+	cmd  *exec.Cmd
+	r    io.ReadCloser
+	w    io.WriteCloser
+	stop func() bool
+}
+
+func (p *execProcess) Read(b []byte) (int, error) {
+	if p.r == nil {
+		return 0, errors.New("process not opened for reading")
+	}
+	return p.r.Read(b)
+}
+
+func (p *execProcess) Write(b []byte) (int, error) {
+	if p.w == nil {
+		return 0, errors.New("process not opened for writing")
+	}
+	return p.w.Write(b)
+}
+
+func (p *execProcess) Wait() error {
+	var err1 error
+	if p.r != nil {
+		err1 = p.r.Close()
+	}
+	if p.w != nil {
+		err1 = p.w.Close()
+	}
+	err2 := p.cmd.Wait()
+	p.stop()
+	if err2 != nil {
+		return err2
+	}
+	return err1
+}
+
+// executeCommand runs a command with r for os.execute
+// and returns os.execute's results.
+func executeCommand(r CommandRunner, command string) (ok bool, result string, status int) {
+	p, err := r.StartCommand(context.Background(), command, CommandExecute)
+	if err == nil {
+		err = p.Wait()
+	}
+	if err != nil {
+		result, status = commandStatus(err)
+		return false, result, status
+	}
+	return true, "exit", 0
+}
+
+// commandStatus converts an error from running a command
+// to os.execute's results.
+func commandStatus(err error) (result string, status int) {
+	var e *ExitError
+	if !errors.As(err, &e) {
+		return execError(err)
+	}
+	if e.Signaled {
+		return "signal", e.Status
+	}
+	return "exit", e.Status
+}
+
+// processReader adapts a [Process] started with [CommandRead]
+// to an [io.ReadCloser] for io.popen.
+type processReader struct {
+	p Process
+}
+
+func (pr processReader) Read(b []byte) (int, error) { return pr.p.Read(b) }
+func (pr processReader) Close() error               { return pr.p.Wait() }
+
+// processWriter adapts a [Process] started with [CommandWrite]
+// to an [io.WriteCloser] for io.popen.
+type processWriter struct {
+	p Process
+}
+
+func (pw processWriter) Write(b []byte) (int, error) { return pw.p.Write(b) }
+func (pw processWriter) Close() error                { return pw.p.Wait() }
@@ -0,0 +1,123 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type fakeRunner struct {
+	log     []string
+	written strings.Builder
+}
+
+func (r *fakeRunner) StartCommand(ctx context.Context, command string, mode CommandMode) (Process, error) {
+	r.log = append(r.log, mode.String()+" "+command)
+	p := &fakeProcess{runner: r}
+	switch command {
+	case "greet":
+		p.Reader = strings.NewReader("hello\n")
+	case "fail":
+		p.err = &ExitError{Status: 3}
+	case "kill":
+		p.err = &ExitError{Signaled: true, Status: 9}
+	}
+	return p, nil
+}
+
+type fakeProcess struct {
+	*strings.Reader
+	runner *fakeRunner
+	err    error
+}
+
+func (p *fakeProcess) Write(b []byte) (int, error) {
+	return p.runner.written.Write(b)
+}
+
+func (p *fakeProcess) Wait() error {
+	return p.err
+}
+
+func TestCommandRunner(t *testing.T) {
+	runner := new(fakeRunner)
+	osLib := &OSLibrary{Commands: runner}
+	ioLib := &IOLibrary{Commands: runner}
+
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, OSLibraryName, true, osLib.OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, IOLibraryName, true, ioLib.OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = `local results = {}
+local function add(...) for i = 1, select("#", ...) do results[#results + 1] = tostring((select(i, ...))) end end
+add(os.execute("true"))
+add(os.execute("fail"))
+add(os.execute("kill"))
+local f = io.popen("greet")
+add(f:read("l"))
+f:close()
+f = io.popen("sink", "w")
+f:write("abc")
+f:close()
+return table.concat(results, ",")`
+	if err := Require(state, TableLibraryName, true, OpenTable); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := state.ToString(-1)
+	if want := "true,exit,0,nil,exit,3,nil,signal,9,hello"; got != want {
+		t.Errorf("results = %q; want %q", got, want)
+	}
+	if got, want := runner.written.String(), "abc"; got != want {
+		t.Errorf("written = %q; want %q", got, want)
+	}
+	wantLog := []string{
+		"CommandExecute true",
+		"CommandExecute fail",
+		"CommandExecute kill",
+		"CommandRead greet",
+		"CommandWrite sink",
+	}
+	if strings.Join(runner.log, "\n") != strings.Join(wantLog, "\n") {
+		t.Errorf("commands started:\n%s\nwant:\n%s", strings.Join(runner.log, "\n"), strings.Join(wantLog, "\n"))
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"math"
+)
+
+// Compat53Options is the set of Lua 5.3 compatibility features
+// that [OpenCompat53] can enable.
+// These help existing Lua 5.3 scripts run on Lua 5.4
+// while they are migrated.
+//
+// Differences in the core language
+// (like the semantics of integer for-loops or string coercions)
+// cannot be changed at run time and are not covered.
+type Compat53Options struct {
+	// MathFunctions adds the deprecated math functions
+	// math.pow, math.cosh, math.sinh, math.tanh,
+	// math.frexp, math.ldexp, and math.log10.
+	MathFunctions bool
+	// Unpack adds a global unpack function
+	// that is an alias for table.unpack.
+	Unpack bool
+	// Warn causes each compatibility function
+	// to emit a warning (see [State.SetWarnHandler])
+	// the first time it is called,
+	// so that scripts still using them can be found.
+	Warn bool
+}
+
+// OpenCompat53 adds the Lua 5.3 compatibility features selected by opts
+// to the global environment.
+// It should be called after the standard libraries are opened;
+// features whose library is not loaded are skipped.
+func OpenCompat53(l *State, opts *Compat53Options) error {
+	if opts == nil {
+		return nil
+	}
+	if !l.CheckStack(3) {
+		return fmt.Errorf("lua: open 5.3 compatibility: stack overflow")
+	}
+	c := &compat53{warn: opts.Warn, warned: make(map[string]bool)}
+	if opts.MathFunctions {
+		if tp, err := l.Global(MathLibraryName, 0); err != nil {
+			l.Pop(1)
+			return fmt.Errorf("lua: open 5.3 compatibility: %w", err)
+		} else if tp == TypeTable {
+			funcs := map[string]Function{
+				"cosh":  mathFunc1(math.Cosh),
+				"sinh":  mathFunc1(math.Sinh),
+				"tanh":  mathFunc1(math.Tanh),
+				"log10": mathFunc1(math.Log10),
+				"pow":   mathPow,
+				"frexp": mathFrexp,
+				"ldexp": mathLdexp,
+			}
+			for name, f := range funcs {
+				l.PushClosure(0, c.wrap("math."+name, f))
+				l.RawSetField(-2, name)
+			}
+		}
+		l.Pop(1)
+	}
+	if opts.Unpack {
+		if tp, err := l.Global(TableLibraryName, 0); err != nil {
+			l.Pop(1)
+			return fmt.Errorf("lua: open 5.3 compatibility: %w", err)
+		} else if tp == TypeTable {
+			l.RawField(-1, "unpack")
+			l.PushClosure(1, c.wrap("unpack", func(l *State) (int, error) {
+				l.PushValue(UpvalueIndex(1))
+				l.Insert(1)
+				if err := l.Call(l.Top()-1, MultipleReturns, 0); err != nil {
+					return 0, err
+				}
+				return l.Top(), nil
+			}))
+			if err := l.SetGlobal("unpack", 0); err != nil {
+				l.Pop(2)
+				return fmt.Errorf("lua: open 5.3 compatibility: %w", err)
+			}
+		}
+		l.Pop(1)
+	}
+	return nil
+}
+
+type compat53 struct {
+	warn   bool
+	warned map[string]bool
+}
+
+// wrap returns a function that calls f,
+// first issuing a deprecation warning if enabled.
+func (c *compat53) wrap(name string, f Function) Function {
+	if !c.warn {
+		return f
+	}
+	return func(l *State) (int, error) {
+		if !c.warned[name] {
+			c.warned[name] = true
+			l.Warning(name+" is deprecated in Lua 5.4", false)
+		}
+		return f(l)
+	}
+}
+
+func mathFunc1(f func(float64) float64) Function {
+	return func(l *State) (int, error) {
+		x, err := CheckNumber(l, 1)
+		if err != nil {
+			return 0, err
+		}
+		l.PushNumber(f(x))
+		return 1, nil
+	}
+}
+
+func mathPow(l *State) (int, error) {
+	x, err := CheckNumber(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	y, err := CheckNumber(l, 2)
+	if err != nil {
+		return 0, err
+	}
+	l.PushNumber(math.Pow(x, y))
+	return 1, nil
+}
+
+func mathFrexp(l *State) (int, error) {
+	x, err := CheckNumber(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	frac, exp := math.Frexp(x)
+	l.PushNumber(frac)
+	l.PushInteger(int64(exp))
+	return 2, nil
+}
+
+func mathLdexp(l *State) (int, error) {
+	frac, err := CheckNumber(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	exp, err := CheckInt(l, 2)
+	if err != nil {
+		return 0, err
+	}
+	l.PushNumber(math.Ldexp(frac, exp))
+	return 1, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpenCompat53(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	state.SetWarnHandler(func(msg string, toBeContinued bool) {
+		warnings = append(warnings, msg)
+	})
+	err := OpenCompat53(state, &Compat53Options{
+		MathFunctions: true,
+		Unpack:        true,
+		Warn:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Top(); got != 0 {
+		t.Errorf("after OpenCompat53, state.Top() = %d; want 0", got)
+	}
+
+	const source = `assert(math.pow(2, 10) == 1024.0)` + "\n" +
+		`assert(math.pow(3, 2) == 9.0)` + "\n" +
+		`local m, e = math.frexp(8)` + "\n" +
+		`assert(m == 0.5 and e == 4)` + "\n" +
+		`assert(math.ldexp(0.5, 4) == 8.0)` + "\n" +
+		`assert(math.log10(1000) == 3.0)` + "\n" +
+		`assert(math.cosh(0) == 1.0)` + "\n" +
+		`local a, b, c = unpack({1, 2, 3})` + "\n" +
+		`assert(a == 1 and b == 2 and c == 3)` + "\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"math.pow is deprecated in Lua 5.4",
+		"math.frexp is deprecated in Lua 5.4",
+		"math.ldexp is deprecated in Lua 5.4",
+		"math.log10 is deprecated in Lua 5.4",
+		"math.cosh is deprecated in Lua 5.4",
+		"unpack is deprecated in Lua 5.4",
+	}
+	if got := strings.Join(warnings, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("warnings:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+)
+
+// contextInterruptCount is the number of instructions
+// between checks of a context in [State.CallContext]
+// or a deadline in [State.CallTimeout].
+const contextInterruptCount = 1000
+
+// CallContext calls a function like [State.Call],
+// but interrupts the function with an error once ctx is done.
+// While the function runs, CallContext adds a hook (see [State.AddHook])
+// that polls ctx every 1000 instructions.
+// The hook is removed before CallContext returns.
+//
+// If ctx is done before or during the call,
+// the returned error wraps ctx.Err(),
+// so it can be detected with [errors.Is].
+// Go functions called by Lua are not interrupted,
+// so long-running Go functions should check ctx themselves,
+// except that blocked channel operations (see [PushChannel])
+// return once ctx is done.
+// If Lua code catches the error with pcall,
+// the error is raised again after every instruction.
+func (l *State) CallContext(ctx context.Context, nArgs, nResults, msgHandler int) error {
+	done := ctx.Done()
+	if done == nil {
+		return l.Call(nArgs, nResults, msgHandler)
+	}
+	if err := ctx.Err(); err != nil {
+		l.Pop(nArgs + 1)
+		l.PushString(err.Error())
+		return &interruptError{msg: err.Error(), cause: err}
+	}
+
+	cause, err := l.callInterruptible(nArgs, nResults, msgHandler, done, func(l *State) error {
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+			return nil
+		}
+	})
+	if cause != nil {
+		return &interruptError{msg: err.Error(), err: err, cause: cause}
+	}
+	return err
+}
+
+// callInterruptible calls a function like [State.Call]
+// while calling check from a count hook every 1000 instructions
+// and whenever done is closed while a channel operation is blocked.
+// If check returns an error, the error is raised in the running function
+// and callInterruptible returns the first such error as cause
+// along with the error returned by [State.Call].
+func (l *State) callInterruptible(nArgs, nResults, msgHandler int, done <-chan struct{}, check func(l *State) error) (cause, err error) {
+	var id HookID
+	interrupt := func(l *State) error {
+		err := check(l)
+		if err != nil && cause == nil {
+			cause = err
+			// Raise the error after every instruction from now on
+			// so that pcall cannot be used to keep running.
+			l.UpdateHook(id, MaskCount, 1)
+		}
+		return err
+	}
+	id = l.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		return interrupt(l)
+	}, MaskCount, contextInterruptCount)
+	defer l.RemoveHook(id)
+	removeInterrupt := l.addInterrupt(done, interrupt)
+	defer removeInterrupt()
+	err = l.Call(nArgs, nResults, msgHandler)
+	if err == nil {
+		// The error was caught inside the call.
+		cause = nil
+	}
+	return cause, err
+}
+
+const (
+	// interruptsRegistryKey is the registry key of the userdata
+	// that holds a state's *interrupts.
+	interruptsRegistryKey = "zombiezen.com/go/lua.interrupts"
+	// interruptsMetatableName is the registry name of the interrupts userdata's metatable.
+	interruptsMetatableName = "*zombiezen.com/go/lua.interrupts"
+)
+
+// interrupts is the set of conditions that interrupt
+// blocking operations in a state, like channel sends and receives.
+// The count hooks that interrupt running Lua code
+// cannot run while a Go function blocks,
+// so blocking functions wait on the sources' channels too.
+type interrupts struct {
+	sources []*interruptSource
+}
+
+// interruptSource is a condition that interrupts a state.
+type interruptSource struct {
+	// done is closed once the condition may hold.
+	done <-chan struct{}
+	// check returns the error to raise in the interrupted function
+	// or nil if the state should keep running.
+	check func(l *State) error
+}
+
+// addInterrupt arranges for blocking operations in l
+// to call check once done is closed.
+// The returned function removes the source.
+func (l *State) addInterrupt(done <-chan struct{}, check func(l *State) error) (remove func()) {
+	if done == nil {
+		return func() {}
+	}
+	if !l.CheckStack(2) {
+		panic("stack overflow")
+	}
+	var in *interrupts
+	l.RawField(RegistryIndex, interruptsRegistryKey)
+	if p := TestTypedUserdata[*interrupts](l, -1, interruptsMetatableName); p != nil {
+		in = *p
+		l.Pop(1)
+	} else {
+		l.Pop(1)
+		in = new(interrupts)
+		NewUserdata(l, in, interruptsMetatableName)
+		l.RawSetField(RegistryIndex, interruptsRegistryKey)
+	}
+	src := &interruptSource{done: done, check: check}
+	in.sources = append(in.sources, src)
+	return func() {
+		for i, s := range in.sources {
+			if s == src {
+				in.sources = append(in.sources[:i:i], in.sources[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// interruptSources returns the state's current interrupt sources.
+func (l *State) interruptSources() []*interruptSource {
+	if !l.CheckStack(1) {
+		return nil
+	}
+	l.RawField(RegistryIndex, interruptsRegistryKey)
+	p := TestTypedUserdata[*interrupts](l, -1, interruptsMetatableName)
+	l.Pop(1)
+	if p == nil {
+		return nil
+	}
+	return (*p).sources
+}
+
+// interruptError is the error returned from a call
+// that was interrupted by a Go condition like a done context.
+type interruptError struct {
+	msg string
+	// err is the error returned by [State.Call], if any.
+	err error
+	// cause is the condition that interrupted the call.
+	cause error
+}
+
+func (e *interruptError) Error() string {
+	return e.msg
+}
+
+func (e *interruptError) Unwrap() []error {
+	if e.err == nil {
+		return []error{e.cause}
+	}
+	return []error{e.err, e.cause}
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCallContext(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	t.Run("Interrupt", func(t *testing.T) {
+		defer state.SetTop(0)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := state.LoadString(`while true do end`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		err := state.CallContext(ctx, 0, 0, 0)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CallContext(...) = %v; want %v", err, context.DeadlineExceeded)
+		}
+		if got := state.Top(); got != 1 {
+			t.Errorf("state.Top() = %d; want 1 (error object)", got)
+		}
+		if f, mask, _ := state.Hook(); f != nil || mask != 0 {
+			t.Errorf("hook not removed after CallContext (mask = %v)", mask)
+		}
+	})
+
+	t.Run("ExistingCoroutine", func(t *testing.T) {
+		defer state.SetTop(0)
+		// Create the coroutine before CallContext adds its hook.
+		thread := state.NewThread()
+		if err := thread.LoadString(`while true do end`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		state.PushClosure(0, func(l *State) (int, error) {
+			_, _, err := thread.Resume(l, 0)
+			return 0, err
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := state.CallContext(ctx, 0, 0, 0)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CallContext(...) = %v; want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("AlreadyDone", func(t *testing.T) {
+		defer state.SetTop(0)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		state.PushInteger(1)
+		ran := false
+		state.PushClosure(0, func(l *State) (int, error) {
+			ran = true
+			return 0, nil
+		})
+		state.PushInteger(2)
+		err := state.CallContext(ctx, 1, 0, 0)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("CallContext(...) = %v; want %v", err, context.Canceled)
+		}
+		if ran {
+			t.Error("function ran with a done context")
+		}
+		if got := state.Top(); got != 2 {
+			t.Errorf("state.Top() = %d; want 2", got)
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		defer state.SetTop(0)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if err := state.LoadString(`local n = 0; for i = 1, 10000 do n = n + i end; return n`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.CallContext(ctx, 0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := state.ToInteger(-1); got != 50005000 {
+			t.Errorf("result = %d; want 50005000", got)
+		}
+	})
+
+	t.Run("PreviousHook", func(t *testing.T) {
+		defer state.SetTop(0)
+		lines := 0
+		prev := func(l *State, event HookEvent, ar *ActivationRecord) error {
+			if event == HookEventLine {
+				lines++
+			}
+			return nil
+		}
+		state.SetHook(prev, MaskLine, 0)
+		defer state.SetHook(nil, 0, 0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if err := state.LoadString("local x = 1\nx = x + 1\nreturn x", "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.CallContext(ctx, 0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if lines != 3 {
+			t.Errorf("previous hook saw %d line events; want 3", lines)
+		}
+		if _, mask, _ := state.Hook(); mask != MaskLine {
+			t.Errorf("hook mask after CallContext = %v; want %v", mask, MaskLine)
+		}
+	})
+}
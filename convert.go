@@ -0,0 +1,909 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxConvertDepth is the maximum nesting of tables
+// that the Go value conversion functions will follow.
+const maxConvertDepth = 200
+
+// Marshaler is the interface implemented by types
+// that can push themselves onto a Lua stack.
+// PushLua must push exactly one value onto the stack
+// or return an error.
+// [PushAny], [MarshalOptions.Push], and the other conversion functions
+// call PushLua instead of converting the value themselves.
+type Marshaler interface {
+	PushLua(l *State) error
+}
+
+// Unmarshaler is the interface implemented by types
+// that can set themselves from a Lua value.
+// FromLua must not modify the stack.
+// idx is an absolute stack index.
+// [Unmarshal], [CallInto], and the other conversion functions
+// call FromLua instead of converting the value themselves.
+type Unmarshaler interface {
+	FromLua(l *State, idx int) error
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// pushMarshaler calls m.PushLua,
+// checking that it pushes exactly one value.
+func pushMarshaler(l *State, m Marshaler) error {
+	top := l.Top()
+	if err := m.PushLua(l); err != nil {
+		l.SetTop(top)
+		return err
+	}
+	if n := l.Top() - top; n != 1 {
+		l.SetTop(top)
+		return fmt.Errorf("%T.PushLua pushed %d values", m, n)
+	}
+	return nil
+}
+
+// asMarshaler returns v as a [Marshaler] if v or a pointer to v implements it.
+// asMarshaler returns false for nil pointers and interfaces
+// so that they can be converted to nil.
+func asMarshaler(v reflect.Value) (Marshaler, bool) {
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, false
+	}
+	if v.Type().Implements(marshalerType) && v.CanInterface() {
+		return v.Interface().(Marshaler), true
+	}
+	if v.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(v.Type()).Implements(marshalerType) {
+		return v.Addr().Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+// asUnmarshaler returns a pointer to v as an [Unmarshaler]
+// if the pointer implements it.
+func asUnmarshaler(v reflect.Value) (Unmarshaler, bool) {
+	if v.Kind() == reflect.Pointer || !v.CanAddr() || !reflect.PointerTo(v.Type()).Implements(unmarshalerType) {
+		return nil, false
+	}
+	return v.Addr().Interface().(Unmarshaler), true
+}
+
+// Kinds of [ConversionError].
+// ConversionError values match their kind with [errors.Is].
+var (
+	// ErrTypeMismatch indicates that a Lua value's type
+	// is not compatible with the Go type it is being converted to.
+	ErrTypeMismatch = errors.New("lua: type mismatch")
+	// ErrOverflow indicates that a number cannot be represented
+	// in the destination type.
+	ErrOverflow = errors.New("lua: number out of range")
+	// ErrNestedTooDeeply indicates that a value has more than 200 levels of nesting
+	// or more than the limit given by [MapOptions.MaxDepth].
+	ErrNestedTooDeeply = errors.New("lua: value nested too deeply")
+	// ErrCycle indicates that a table, slice, or map contains itself.
+	ErrCycle = errors.New("lua: value contains a cycle")
+	// ErrUnsupportedType indicates that a Go value or type
+	// has no Lua representation.
+	ErrUnsupportedType = errors.New("lua: unsupported type")
+)
+
+// ConversionError is the error returned by [PushAny], [Unmarshal], [CallInto],
+// and the other conversion functions
+// when a value cannot be converted.
+type ConversionError struct {
+	// Path is the location of the offending value
+	// relative to the value being converted,
+	// like "options.retries[3]".
+	// Path is empty if the offending value is the value being converted.
+	Path string
+	// GoType is the Go type involved in the conversion, if known.
+	GoType reflect.Type
+	// LuaType is the type of the Lua value being converted
+	// or [TypeNone] when converting a Go value to Lua.
+	LuaType Type
+	// Kind is one of [ErrTypeMismatch], [ErrOverflow],
+	// [ErrNestedTooDeeply], [ErrCycle], or [ErrUnsupportedType].
+	Kind error
+
+	msg string
+}
+
+// Error returns the error's message prefixed by its path.
+func (e *ConversionError) Error() string {
+	if e.Path == "" {
+		return e.msg
+	}
+	return e.Path + ": " + e.msg
+}
+
+// Unwrap returns e.Kind.
+func (e *ConversionError) Unwrap() error {
+	return e.Kind
+}
+
+// prependPath adds seg to the beginning of the path of a [*ConversionError].
+// Other errors are returned unchanged.
+func prependPath(err error, seg string) error {
+	e, ok := err.(*ConversionError)
+	if !ok {
+		return err
+	}
+	if e.Path == "" || strings.HasPrefix(e.Path, "[") {
+		e.Path = seg + e.Path
+	} else {
+		e.Path = seg + "." + e.Path
+	}
+	return e
+}
+
+// fieldSegment returns the path segment for the table field with the given name.
+func fieldSegment(name string) string {
+	if !isIdentifier(name) {
+		return "[" + strconv.Quote(name) + "]"
+	}
+	return name
+}
+
+// indexSegment returns the path segment for the i'th element of a sequence.
+func indexSegment(i int64) string {
+	return "[" + strconv.FormatInt(i, 10) + "]"
+}
+
+// goKeySegment returns the path segment for a Go map key.
+func goKeySegment(k reflect.Value) string {
+	switch k.Kind() {
+	case reflect.String:
+		return fieldSegment(k.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return indexSegment(k.Int())
+	default:
+		return fmt.Sprintf("[%v]", k)
+	}
+}
+
+// luaKeySegment returns the path segment for the Lua table key at the given index.
+func luaKeySegment(l *State, idx int) string {
+	switch l.Type(idx) {
+	case TypeString:
+		s, _ := l.ToString(idx)
+		return fieldSegment(s)
+	case TypeNumber:
+		if i, ok := l.ToInteger(idx); ok {
+			return indexSegment(i)
+		}
+		f, _ := l.ToNumber(idx)
+		return "[" + strconv.FormatFloat(f, 'g', -1, 64) + "]"
+	default:
+		return "[" + l.Type(idx).String() + "]"
+	}
+}
+
+// isIdentifier reports whether s is a valid Lua name.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func tooDeepError(goType reflect.Type, luaType Type) error {
+	return &ConversionError{
+		GoType:  goType,
+		LuaType: luaType,
+		Kind:    ErrNestedTooDeeply,
+		msg:     "value nested too deeply",
+	}
+}
+
+// PushAny converts a Go value to a Lua value and pushes it onto the stack.
+// Values are converted as follows:
+//
+//   - nil and nil pointers, maps, and slices become nil.
+//   - bool becomes a boolean.
+//   - Signed and unsigned integer types become integers.
+//     Unsigned values larger than [math.MaxInt64] are an error.
+//   - float32 and float64 become floats.
+//   - string and []byte become strings.
+//   - [Function] becomes a Go closure with no upvalues.
+//   - Slices and arrays become sequences.
+//   - Maps become tables with their keys and values converted.
+//     Keys that convert to nil or NaN are an error.
+//   - Structs become tables keyed by field name
+//     (see [Unmarshal] for how fields are named).
+//   - Pointers and interfaces are converted by their underlying value.
+//
+// Values that implement [Marshaler] are pushed by calling their PushLua method.
+// Other types are an error.
+// If a value cannot be converted, PushAny returns a [*ConversionError].
+// If PushAny returns an error, then nothing is pushed onto the stack.
+func PushAny(l *State, v any) error {
+	if err := pushValue(l, reflect.ValueOf(v), 0); err != nil {
+		return fmt.Errorf("lua: push: %w", err)
+	}
+	return nil
+}
+
+var functionType = reflect.TypeOf(Function(nil))
+
+func pushValue(l *State, v reflect.Value, depth int) error {
+	if !l.CheckStack(3) {
+		return errors.New("stack overflow")
+	}
+	if !v.IsValid() {
+		l.PushNil()
+		return nil
+	}
+	if m, ok := asMarshaler(v); ok {
+		return pushMarshaler(l, m)
+	}
+	if v.Type() == functionType {
+		f := v.Interface().(Function)
+		if f == nil {
+			l.PushNil()
+		} else {
+			l.PushClosure(0, f)
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		l.PushBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.PushInteger(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return &ConversionError{
+				GoType:  v.Type(),
+				LuaType: TypeNone,
+				Kind:    ErrOverflow,
+				msg:     fmt.Sprintf("%d overflows a Lua integer", u),
+			}
+		}
+		l.PushInteger(int64(u))
+	case reflect.Float32, reflect.Float64:
+		l.PushNumber(v.Float())
+	case reflect.String:
+		l.PushString(v.String())
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		return pushValue(l, v.Elem(), depth)
+	case reflect.Slice:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			l.PushString(string(v.Bytes()))
+			return nil
+		}
+		return pushSequence(l, v, depth)
+	case reflect.Array:
+		return pushSequence(l, v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		if depth >= maxConvertDepth {
+			return tooDeepError(v.Type(), TypeNone)
+		}
+		l.CreateTable(0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			seg := goKeySegment(iter.Key())
+			if err := pushValue(l, iter.Key(), depth+1); err != nil {
+				l.Pop(1)
+				return prependPath(err, seg)
+			}
+			if bad := badTableKey(l, -1); bad != "" {
+				l.Pop(2)
+				return &ConversionError{
+					GoType:  v.Type(),
+					LuaType: TypeNone,
+					Kind:    ErrUnsupportedType,
+					msg:     "map has " + bad + " key",
+				}
+			}
+			if err := pushValue(l, iter.Value(), depth+1); err != nil {
+				l.Pop(2)
+				return prependPath(err, seg)
+			}
+			l.RawSet(-3)
+		}
+	case reflect.Struct:
+		if depth >= maxConvertDepth {
+			return tooDeepError(v.Type(), TypeNone)
+		}
+		fields := structFields(v.Type())
+		l.CreateTable(0, len(fields))
+		for _, f := range fields {
+			if err := pushValue(l, v.FieldByIndex(f.index), depth+1); err != nil {
+				l.Pop(1)
+				return prependPath(err, fieldSegment(f.name))
+			}
+			l.RawSetField(-2, f.name)
+		}
+	default:
+		return &ConversionError{
+			GoType:  v.Type(),
+			LuaType: TypeNone,
+			Kind:    ErrUnsupportedType,
+			msg:     fmt.Sprintf("cannot convert %v to a Lua value", v.Type()),
+		}
+	}
+	return nil
+}
+
+// badTableKey reports why the value at the given index
+// cannot be used as a table key
+// or returns the empty string if it can.
+// [State.RawSet] raises an unprotected error for such keys,
+// so keys that did not come from an existing table must be checked first.
+func badTableKey(l *State, idx int) string {
+	switch l.Type(idx) {
+	case TypeNil, TypeNone:
+		return "nil"
+	case TypeNumber:
+		if n, _ := l.ToNumber(idx); math.IsNaN(n) {
+			return "NaN"
+		}
+	}
+	return ""
+}
+
+func pushSequence(l *State, v reflect.Value, depth int) error {
+	if depth >= maxConvertDepth {
+		return tooDeepError(v.Type(), TypeNone)
+	}
+	n := v.Len()
+	l.CreateTable(n, 0)
+	for i := 0; i < n; i++ {
+		if err := pushValue(l, v.Index(i), depth+1); err != nil {
+			l.Pop(1)
+			return prependPath(err, indexSegment(int64(i)+1))
+		}
+		l.RawSetIndex(-2, int64(i)+1)
+	}
+	return nil
+}
+
+// Unmarshal converts the Lua value at the given index
+// and stores the result in the value pointed to by v.
+// Unmarshal checks the Lua value's type against the Go type
+// and does not perform Lua's string/number coercions:
+//
+//   - bool requires a boolean.
+//   - Integer types require an integer
+//     or a float with an exact integer representation
+//     that fits in the Go type.
+//   - float32 and float64 require a number.
+//   - string and []byte require a string.
+//   - Slices require a sequence.
+//     Arrays require a sequence no longer than the array.
+//   - Maps require a table.
+//     Each key and value is converted to the map's key and element type.
+//   - Structs require a table.
+//     Each exported field is read from the table
+//     using the name given in the field's "lua" tag
+//     or the field's name if there is no tag.
+//     Fields with a tag of "-" are ignored.
+//   - Pointers store nil for a nil Lua value.
+//     Otherwise, they point to a newly allocated value of the element type.
+//   - Empty interfaces store nil, bool, int64, float64, string,
+//     or map[any]any for tables.
+//
+// Tables are read without invoking metamethods.
+// If a pointer to the destination implements [Unmarshaler],
+// Unmarshal calls its FromLua method instead,
+// including when the Lua value is nil.
+//
+// If a value cannot be converted, Unmarshal returns a [*ConversionError].
+func Unmarshal(l *State, idx int, v any) error {
+	if err := unmarshal(l, idx, v); err != nil {
+		return fmt.Errorf("lua: unmarshal: %w", err)
+	}
+	return nil
+}
+
+func unmarshal(l *State, idx int, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("non-pointer %T", v)
+	}
+	return unmarshalValue(l, l.AbsIndex(idx), rv.Elem(), 0)
+}
+
+func unmarshalValue(l *State, idx int, v reflect.Value, depth int) error {
+	tp := l.Type(idx)
+	newError := func(kind error, format string, args ...any) error {
+		return &ConversionError{
+			GoType:  v.Type(),
+			LuaType: tp,
+			Kind:    kind,
+			msg:     fmt.Sprintf(format, args...),
+		}
+	}
+	typeError := func() error {
+		return newError(ErrTypeMismatch, "cannot unmarshal %v into %v", tp, v.Type())
+	}
+	if u, ok := asUnmarshaler(v); ok {
+		return u.FromLua(l, idx)
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError()
+		}
+		x, err := toAny(l, idx, depth)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+	case reflect.Pointer:
+		if tp == TypeNil {
+			v.SetZero()
+			return nil
+		}
+		p := reflect.New(v.Type().Elem())
+		if err := unmarshalValue(l, idx, p.Elem(), depth); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Bool:
+		if tp != TypeBoolean {
+			return typeError()
+		}
+		v.SetBool(l.ToBoolean(idx))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if tp != TypeNumber {
+			return typeError()
+		}
+		i, ok := l.ToInteger(idx)
+		if !ok {
+			f, _ := l.ToNumber(idx)
+			return newError(ErrOverflow, "%v has no exact integer representation for %v", f, v.Type())
+		}
+		if v.OverflowInt(i) {
+			return newError(ErrOverflow, "%d overflows %v", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if tp != TypeNumber {
+			return typeError()
+		}
+		i, ok := l.ToInteger(idx)
+		if !ok {
+			f, _ := l.ToNumber(idx)
+			return newError(ErrOverflow, "%v has no exact integer representation for %v", f, v.Type())
+		}
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return newError(ErrOverflow, "%d overflows %v", i, v.Type())
+		}
+		v.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		if tp != TypeNumber {
+			return typeError()
+		}
+		f, _ := l.ToNumber(idx)
+		v.SetFloat(f)
+	case reflect.String:
+		if tp != TypeString {
+			return typeError()
+		}
+		s, _ := l.ToString(idx)
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && tp == TypeString {
+			s, _ := l.ToString(idx)
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		if tp != TypeTable {
+			return typeError()
+		}
+		n := int(l.RawLen(idx))
+		s := reflect.MakeSlice(v.Type(), n, n)
+		if err := unmarshalSequence(l, idx, s, depth); err != nil {
+			return err
+		}
+		v.Set(s)
+	case reflect.Array:
+		if tp != TypeTable {
+			return typeError()
+		}
+		if n := l.RawLen(idx); n > uint64(v.Len()) {
+			return newError(ErrOverflow, "sequence of length %d does not fit in %v", n, v.Type())
+		}
+		v.SetZero()
+		return unmarshalSequence(l, idx, v, depth)
+	case reflect.Map:
+		if tp != TypeTable {
+			return typeError()
+		}
+		if depth >= maxConvertDepth {
+			return tooDeepError(v.Type(), tp)
+		}
+		if !l.CheckStack(3) {
+			return errors.New("stack overflow")
+		}
+		m := reflect.MakeMap(v.Type())
+		l.PushNil()
+		for l.Next(idx) {
+			seg := luaKeySegment(l, -2)
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := unmarshalValue(l, l.AbsIndex(-2), key, depth+1); err != nil {
+				l.Pop(2)
+				return prependPath(err, seg)
+			}
+			if !key.Comparable() {
+				err := prependPath(newError(ErrUnsupportedType, "cannot use %v as map key", l.Type(-2)), seg)
+				l.Pop(2)
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := unmarshalValue(l, l.AbsIndex(-1), elem, depth+1); err != nil {
+				l.Pop(2)
+				return prependPath(err, seg)
+			}
+			m.SetMapIndex(key, elem)
+			l.Pop(1)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		if tp != TypeTable {
+			return typeError()
+		}
+		if depth >= maxConvertDepth {
+			return tooDeepError(v.Type(), tp)
+		}
+		if !l.CheckStack(1) {
+			return errors.New("stack overflow")
+		}
+		for _, f := range structFields(v.Type()) {
+			l.PushString(f.name)
+			l.RawGet(idx)
+			err := unmarshalValue(l, l.AbsIndex(-1), v.FieldByIndex(f.index), depth+1)
+			l.Pop(1)
+			if err != nil {
+				return prependPath(err, fieldSegment(f.name))
+			}
+		}
+	default:
+		return newError(ErrUnsupportedType, "cannot unmarshal into %v", v.Type())
+	}
+	return nil
+}
+
+func unmarshalSequence(l *State, idx int, v reflect.Value, depth int) error {
+	if depth >= maxConvertDepth {
+		return tooDeepError(v.Type(), TypeTable)
+	}
+	if !l.CheckStack(1) {
+		return errors.New("stack overflow")
+	}
+	n := int(l.RawLen(idx))
+	for i := 0; i < n; i++ {
+		l.RawIndex(idx, int64(i)+1)
+		err := unmarshalValue(l, l.AbsIndex(-1), v.Index(i), depth+1)
+		l.Pop(1)
+		if err != nil {
+			return prependPath(err, indexSegment(int64(i)+1))
+		}
+	}
+	return nil
+}
+
+// toAny converts the Lua value at the given index
+// to a Go value as described for empty interfaces in [Unmarshal].
+func toAny(l *State, idx int, depth int) (any, error) {
+	switch tp := l.Type(idx); tp {
+	case TypeNil:
+		return nil, nil
+	case TypeBoolean:
+		return l.ToBoolean(idx), nil
+	case TypeNumber:
+		if l.IsInteger(idx) {
+			i, _ := l.ToInteger(idx)
+			return i, nil
+		}
+		f, _ := l.ToNumber(idx)
+		return f, nil
+	case TypeString:
+		s, _ := l.ToString(idx)
+		return s, nil
+	case TypeTable:
+		m := make(map[any]any)
+		if err := unmarshalValue(l, idx, reflect.ValueOf(&m).Elem(), depth); err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		return nil, &ConversionError{
+			LuaType: tp,
+			Kind:    ErrUnsupportedType,
+			msg:     fmt.Sprintf("cannot unmarshal %v into Go value", tp),
+		}
+	}
+}
+
+// structField describes an exported field of a struct
+// for the purpose of Lua conversion.
+type structField struct {
+	name  string
+	index []int
+	// readOnly is true if the field's tag has the "readonly" option.
+	// It only applies to structs bound with [PushStruct].
+	readOnly bool
+}
+
+// structFields returns the fields of the struct type t
+// that are converted to and from Lua tables.
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		field := structField{name: f.Name, index: f.Index}
+		if tag, ok := f.Tag.Lookup("lua"); ok {
+			if tag == "-" {
+				continue
+			}
+			tagName, opts, _ := strings.Cut(tag, ",")
+			if tagName != "" {
+				field.name = tagName
+			}
+			for opts != "" {
+				var opt string
+				opt, opts, _ = strings.Cut(opts, ",")
+				if opt == "readonly" {
+					field.readOnly = true
+				}
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// CallInto calls the function at the given index
+// with args converted by [PushAny]
+// and stores its results into the values pointed to by results
+// using [Unmarshal].
+// The function is called with len(results) results,
+// so extra results are discarded and missing results are nil.
+// The function at idx is not removed from the stack
+// and CallInto leaves the stack as it found it,
+// even if an error occurs.
+func CallInto(l *State, idx int, args []any, results ...any) error {
+	idx = l.AbsIndex(idx)
+	base := l.Top()
+	defer l.SetTop(base)
+
+	if !l.CheckStack(1 + len(args)) {
+		return errors.New("lua: call: stack overflow")
+	}
+	l.PushValue(idx)
+	for i, arg := range args {
+		if err := pushValue(l, reflect.ValueOf(arg), 0); err != nil {
+			return fmt.Errorf("lua: call: argument #%d: %w", i+1, err)
+		}
+	}
+	if err := l.Call(len(args), len(results), 0); err != nil {
+		return fmt.Errorf("lua: call: %w", err)
+	}
+	for i, r := range results {
+		if err := unmarshal(l, base+1+i, r); err != nil {
+			return fmt.Errorf("lua: call: result #%d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// PushSlice pushes a new sequence table onto the stack
+// with the elements of s converted as in [PushAny].
+// Unlike [PushAny], PushSlice pushes an empty table for a nil slice
+// and converts a []byte to a sequence of integers rather than a string.
+// If PushSlice returns an error, then nothing is pushed onto the stack.
+func PushSlice[T any](l *State, s []T) error {
+	if err := pushSequence(l, reflect.ValueOf(s), 0); err != nil {
+		return fmt.Errorf("lua: push: %w", err)
+	}
+	return nil
+}
+
+// ToSlice converts the sequence table at the given index to a slice,
+// converting each element as in [Unmarshal].
+// ToSlice reads elements 1 through the table's raw length,
+// so the returned slice's length is that of the table's border.
+// It returns an error if the value is not a table.
+func ToSlice[T any](l *State, idx int) ([]T, error) {
+	idx = l.AbsIndex(idx)
+	if tp := l.Type(idx); tp != TypeTable {
+		return nil, fmt.Errorf("lua: unmarshal: %w", &ConversionError{
+			GoType:  reflect.TypeOf([]T(nil)),
+			LuaType: tp,
+			Kind:    ErrTypeMismatch,
+			msg:     fmt.Sprintf("cannot unmarshal %v into %v", tp, reflect.TypeOf([]T(nil))),
+		})
+	}
+	s := make([]T, int(l.RawLen(idx)))
+	if err := unmarshalSequence(l, idx, reflect.ValueOf(s), 0); err != nil {
+		return nil, fmt.Errorf("lua: unmarshal: %w", err)
+	}
+	return s, nil
+}
+
+// MapOptions is the set of optional parameters
+// for [PushMap], [ToMap], and [ToMapOf].
+// A nil *MapOptions is treated the same as the zero value.
+type MapOptions struct {
+	// MaxDepth is the maximum number of levels of nested tables to convert,
+	// counting the outermost table as one level.
+	// If MaxDepth is zero or negative, then 200 is used.
+	MaxDepth int
+}
+
+// startDepth returns the depth to begin a conversion at
+// so that the conversion functions' check against maxConvertDepth
+// enforces opts.MaxDepth.
+func (opts *MapOptions) startDepth() int {
+	if opts == nil || opts.MaxDepth <= 0 {
+		return 0
+	}
+	return maxConvertDepth - opts.MaxDepth
+}
+
+// PushMap pushes a new table onto the stack
+// with the keys and values of m converted as in [PushAny].
+// Numeric keys become integer or float keys, not strings.
+// Unlike [PushAny], PushMap pushes an empty table for a nil map.
+// Go values that refer to themselves
+// fail with [ErrNestedTooDeeply] once they exceed the depth limit.
+// If PushMap returns an error, then nothing is pushed onto the stack.
+func PushMap[K comparable, V any](l *State, m map[K]V, opts *MapOptions) error {
+	if m == nil {
+		l.CreateTable(0, 0)
+		return nil
+	}
+	if err := pushValue(l, reflect.ValueOf(m), opts.startDepth()); err != nil {
+		return fmt.Errorf("lua: push: %w", err)
+	}
+	return nil
+}
+
+var stringMapType = reflect.TypeOf(map[string]any(nil))
+
+// ToMap converts the table at the given index to a map[string]any.
+// String keys are used as-is and numeric keys are formatted in decimal,
+// so a sequence becomes a map with keys "1", "2", and so on.
+// A table that has both a number key and the equivalent string key
+// (like [1] and ["1"]) is an error, since the keys would collide.
+// Other keys are an error.
+// Nested tables are converted to map[string]any in the same way,
+// and other values are converted like empty interfaces in [Unmarshal].
+// A table that contains itself, directly or indirectly,
+// is an error that matches [ErrCycle].
+// Tables are read without invoking metamethods.
+func ToMap(l *State, idx int, opts *MapOptions) (map[string]any, error) {
+	idx = l.AbsIndex(idx)
+	if tp := l.Type(idx); tp != TypeTable {
+		return nil, fmt.Errorf("lua: unmarshal: %w", &ConversionError{
+			GoType:  stringMapType,
+			LuaType: tp,
+			Kind:    ErrTypeMismatch,
+			msg:     fmt.Sprintf("cannot unmarshal %v into %v", tp, stringMapType),
+		})
+	}
+	m, err := toStringMap(l, idx, opts.startDepth(), make(map[uintptr]struct{}))
+	if err != nil {
+		return nil, fmt.Errorf("lua: unmarshal: %w", err)
+	}
+	return m, nil
+}
+
+// toStringMap converts the table at the absolute index idx
+// as described in [ToMap].
+// visiting holds the addresses of the tables being converted
+// by the callers of toStringMap.
+func toStringMap(l *State, idx int, depth int, visiting map[uintptr]struct{}) (map[string]any, error) {
+	if depth >= maxConvertDepth {
+		return nil, tooDeepError(stringMapType, TypeTable)
+	}
+	ptr := l.ToPointer(idx)
+	if _, cyclic := visiting[ptr]; cyclic {
+		return nil, &ConversionError{
+			GoType:  stringMapType,
+			LuaType: TypeTable,
+			Kind:    ErrCycle,
+			msg:     "table contains itself",
+		}
+	}
+	visiting[ptr] = struct{}{}
+	defer delete(visiting, ptr)
+
+	if !l.CheckStack(3) {
+		return nil, errors.New("stack overflow")
+	}
+	m := make(map[string]any)
+	l.PushNil()
+	for l.Next(idx) {
+		seg := luaKeySegment(l, -2)
+		key, err := stringMapKey(l, -2, m)
+		if err != nil {
+			l.Pop(2)
+			return nil, prependPath(err, seg)
+		}
+		var v any
+		if l.IsTable(-1) {
+			v, err = toStringMap(l, l.AbsIndex(-1), depth+1, visiting)
+		} else {
+			v, err = toAny(l, l.AbsIndex(-1), depth+1)
+		}
+		if err != nil {
+			l.Pop(2)
+			return nil, prependPath(err, seg)
+		}
+		m[key] = v
+		l.Pop(1)
+	}
+	return m, nil
+}
+
+// ToMapOf converts the table at the given index to a map[K]V,
+// converting each key and value as in [Unmarshal].
+// Unlike [ToMap], ToMapOf does not detect cycles:
+// a table that contains itself fails with [ErrNestedTooDeeply]
+// once it exceeds the depth limit.
+func ToMapOf[K comparable, V any](l *State, idx int, opts *MapOptions) (map[K]V, error) {
+	var m map[K]V
+	if err := unmarshalValue(l, l.AbsIndex(idx), reflect.ValueOf(&m).Elem(), opts.startDepth()); err != nil {
+		return nil, fmt.Errorf("lua: unmarshal: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,550 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPushAnyUnmarshal(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	type options struct {
+		Name    string `lua:"name"`
+		Retries []int  `lua:"retries"`
+		Timeout *float64
+		Ignored string `lua:"-"`
+	}
+	timeout := 1.5
+	want := options{
+		Name:    "x",
+		Retries: []int{1, 2, 3},
+		Timeout: &timeout,
+	}
+	if err := PushAny(state, want); err != nil {
+		t.Fatal(err)
+	}
+	var got options
+	if err := Unmarshal(state, -1, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v; want %+v", got, want)
+	}
+
+	var x any
+	if err := Unmarshal(state, -1, &x); err != nil {
+		t.Fatal(err)
+	}
+	wantAny := map[any]any{
+		"name":    "x",
+		"retries": map[any]any{int64(1): int64(1), int64(2): int64(2), int64(3): int64(3)},
+		"Timeout": 1.5,
+	}
+	if !reflect.DeepEqual(x, wantAny) {
+		t.Errorf("Unmarshal into any = %#v; want %#v", x, wantAny)
+	}
+	state.Pop(1)
+
+	state.PushString("abc")
+	var n int
+	if err := Unmarshal(state, -1, &n); err == nil {
+		t.Error("Unmarshal string into int did not return an error")
+	}
+	state.PushNumber(1.5)
+	if err := Unmarshal(state, -1, &n); err == nil {
+		t.Error("Unmarshal 1.5 into int did not return an error")
+	}
+	state.PushInteger(300)
+	var b uint8
+	if err := Unmarshal(state, -1, &b); err == nil {
+		t.Error("Unmarshal 300 into uint8 did not return an error")
+	}
+}
+
+func TestCallInto(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "return function(a, t) return a * 2, t.name, 'extra' end"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var doubled int
+	var name string
+	args := []any{21, map[string]string{"name": "lua"}}
+	if err := CallInto(state, 1, args, &doubled, &name); err != nil {
+		t.Fatal(err)
+	}
+	if doubled != 42 || name != "lua" {
+		t.Errorf("results = %d, %q; want 42, \"lua\"", doubled, name)
+	}
+	if got := state.Top(); got != 1 {
+		t.Errorf("state.Top() = %d; want 1", got)
+	}
+
+	var notNumber int
+	err := CallInto(state, 1, args, &doubled, &notNumber)
+	if err == nil || !strings.Contains(err.Error(), "result #2") {
+		t.Errorf("CallInto with mismatched result = %v; want error mentioning result #2", err)
+	}
+	if got := state.Top(); got != 1 {
+		t.Errorf("after error, state.Top() = %d; want 1", got)
+	}
+}
+
+func TestConversionError(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	type options struct {
+		Retries []int `lua:"retries"`
+	}
+	type config struct {
+		Options options `lua:"options"`
+	}
+
+	t.Run("Unmarshal", func(t *testing.T) {
+		const source = "return {options = {retries = {1, 2, 'three'}}}"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer state.Pop(1)
+
+		var c config
+		err := Unmarshal(state, -1, &c)
+		var convErr *ConversionError
+		if !errors.As(err, &convErr) {
+			t.Fatalf("Unmarshal(...) = %v; want *ConversionError", err)
+		}
+		if got, want := convErr.Path, "options.retries[3]"; got != want {
+			t.Errorf("Path = %q; want %q", got, want)
+		}
+		if got, want := convErr.GoType, reflect.TypeOf(0); got != want {
+			t.Errorf("GoType = %v; want %v", got, want)
+		}
+		if got, want := convErr.LuaType, TypeString; got != want {
+			t.Errorf("LuaType = %v; want %v", got, want)
+		}
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("errors.Is(%v, ErrTypeMismatch) = false; want true", err)
+		}
+	})
+
+	t.Run("MapKey", func(t *testing.T) {
+		const source = "return {['not a name'] = {x = 1.5}}"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer state.Pop(1)
+
+		var m map[string]map[string]int
+		err := Unmarshal(state, -1, &m)
+		var convErr *ConversionError
+		if !errors.As(err, &convErr) {
+			t.Fatalf("Unmarshal(...) = %v; want *ConversionError", err)
+		}
+		if got, want := convErr.Path, `["not a name"].x`; got != want {
+			t.Errorf("Path = %q; want %q", got, want)
+		}
+		if !errors.Is(err, ErrOverflow) {
+			t.Errorf("errors.Is(%v, ErrOverflow) = false; want true", err)
+		}
+	})
+
+	t.Run("PushAny", func(t *testing.T) {
+		v := map[string]any{"ids": []any{1, uint64(math.MaxUint64)}}
+		err := PushAny(state, v)
+		var convErr *ConversionError
+		if !errors.As(err, &convErr) {
+			t.Fatalf("PushAny(...) = %v; want *ConversionError", err)
+		}
+		if got, want := convErr.Path, "ids[2]"; got != want {
+			t.Errorf("Path = %q; want %q", got, want)
+		}
+		if !errors.Is(err, ErrOverflow) {
+			t.Errorf("errors.Is(%v, ErrOverflow) = false; want true", err)
+		}
+		if got := state.Top(); got != 0 {
+			t.Errorf("state.Top() = %d; want 0", got)
+		}
+	})
+
+	t.Run("PushAnyBadKey", func(t *testing.T) {
+		tests := []struct {
+			name string
+			v    any
+		}{
+			{"NaNFloat", map[float64]int{math.NaN(): 1}},
+			{"NaNInterface", map[any]any{math.NaN(): 1}},
+			{"NilInterface", map[any]any{nil: 1}},
+			{"NilPointer", map[any]any{(*int)(nil): 1}},
+		}
+		for _, test := range tests {
+			err := PushAny(state, test.v)
+			if !errors.Is(err, ErrUnsupportedType) {
+				t.Errorf("%s: PushAny(%v) = %v; want %v", test.name, test.v, err, ErrUnsupportedType)
+			}
+			if got := state.Top(); got != 0 {
+				t.Errorf("%s: state.Top() = %d; want 0", test.name, got)
+				state.SetTop(0)
+			}
+		}
+	})
+}
+
+func TestPushSliceToSlice(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	want := [][]string{{"a", "b"}, {}, {"c"}}
+	if err := PushSlice(state, want); err != nil {
+		t.Fatal(err)
+	}
+	if got := state.RawLen(-1); got != 3 {
+		t.Errorf("#t = %d; want 3", got)
+	}
+	got, err := ToSlice[[]string](state, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ToSlice(...) = %q; want %q", got, want)
+	}
+	state.Pop(1)
+
+	if err := PushSlice[int](state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !state.IsTable(-1) || state.RawLen(-1) != 0 {
+		t.Errorf("PushSlice(nil) pushed %v of length %d; want empty table", state.Type(-1), state.RawLen(-1))
+	}
+	state.Pop(1)
+
+	if err := PushSlice(state, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ToSlice[byte](state, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytes) != "hi" {
+		t.Errorf("ToSlice[byte](...) = %q; want \"hi\"", bytes)
+	}
+	state.Pop(1)
+
+	if err := PushSlice(state, []any{1, math.Inf(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ToSlice[int](state, -1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("ToSlice[int]({1, math.huge}) error = %v; want %v", err, ErrOverflow)
+	} else if e := new(ConversionError); !errors.As(err, &e) || e.Path != "[2]" {
+		t.Errorf("ToSlice[int]({1, math.huge}) error = %v; want path [2]", err)
+	}
+	state.Pop(1)
+
+	state.PushString("abc")
+	if _, err := ToSlice[byte](state, -1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("ToSlice[byte](\"abc\") error = %v; want %v", err, ErrTypeMismatch)
+	}
+	if got := state.Top(); got != 1 {
+		t.Errorf("state.Top() = %d; want 1", got)
+	}
+
+	if err := PushSlice(state, []any{func() {}}); err == nil {
+		t.Error("PushSlice with function element did not return an error")
+	}
+	if got := state.Top(); got != 1 {
+		t.Errorf("after failed PushSlice, state.Top() = %d; want 1", got)
+	}
+}
+
+func TestPushMapToMap(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	if err := PushMap(state, map[string]any{
+		"name":  "x",
+		"count": 3,
+		"tags":  []string{"a", "b"},
+		"inner": map[int]bool{1: true, 10: false},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	state.RawField(-1, "inner")
+	if tp := state.RawIndex(-1, 10); tp != TypeBoolean {
+		t.Errorf("inner[10] type = %v; want %v", tp, TypeBoolean)
+	}
+	state.Pop(2)
+
+	got, err := ToMap(state, -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"name":  "x",
+		"count": int64(3),
+		"tags":  map[string]any{"1": "a", "2": "b"},
+		"inner": map[string]any{"1": true, "10": false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ToMap(...) = %#v; want %#v", got, want)
+	}
+
+	typed, err := ToMapOf[int, bool](state, -1, nil)
+	if err == nil {
+		t.Errorf("ToMapOf[int, bool](...) = %v, <nil>; want error", typed)
+	}
+	state.Pop(1)
+
+	if err := PushMap(state, map[float64]int{1.5: 1, 2: 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	typedFloat, err := ToMapOf[float64, int](state, -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[float64]int{1.5: 1, 2: 2}; !reflect.DeepEqual(typedFloat, want) {
+		t.Errorf("ToMapOf[float64, int](...) = %v; want %v", typedFloat, want)
+	}
+	gotFloat, err := ToMap(state, -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]any{"1.5": int64(1), "2": int64(2)}; !reflect.DeepEqual(gotFloat, want) {
+		t.Errorf("ToMap(...) = %v; want %v", gotFloat, want)
+	}
+	state.Pop(1)
+
+	if err := PushMap[string, int](state, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !state.IsTable(-1) {
+		t.Errorf("PushMap(nil) pushed %v; want table", state.Type(-1))
+	}
+	state.Pop(1)
+
+	t.Run("Cycle", func(t *testing.T) {
+		if err := state.LoadString(`local t = {a = {}}; t.a.b = t; return t`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer state.SetTop(0)
+		_, err := ToMap(state, -1, nil)
+		if !errors.Is(err, ErrCycle) {
+			t.Errorf("ToMap(...) error = %v; want %v", err, ErrCycle)
+		} else if e := new(ConversionError); !errors.As(err, &e) || e.Path != "a.b" {
+			t.Errorf("ToMap(...) error = %v; want path a.b", err)
+		}
+		if _, err := ToMapOf[string, any](state, -1, &MapOptions{MaxDepth: 10}); !errors.Is(err, ErrNestedTooDeeply) {
+			t.Errorf("ToMapOf[string, any](...) error = %v; want %v", err, ErrNestedTooDeeply)
+		}
+		if got := state.Top(); got != 1 {
+			t.Errorf("state.Top() = %d; want 1", got)
+		}
+
+		// Shared tables that do not form a cycle are fine.
+		if err := state.LoadString(`local s = {1}; return {x = s, y = s}`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ToMap(state, -1, nil); err != nil {
+			t.Error("ToMap with shared table:", err)
+		}
+	})
+
+	t.Run("MaxDepth", func(t *testing.T) {
+		defer state.SetTop(0)
+		nested := map[string]any{"a": map[string]any{"b": map[string]any{}}}
+		opts := &MapOptions{MaxDepth: 2}
+		if err := PushMap(state, nested, opts); !errors.Is(err, ErrNestedTooDeeply) {
+			t.Errorf("PushMap(..., MaxDepth: 2) error = %v; want %v", err, ErrNestedTooDeeply)
+		}
+		if got := state.Top(); got != 0 {
+			t.Errorf("after failed PushMap, state.Top() = %d; want 0", got)
+		}
+		if err := PushMap(state, nested, &MapOptions{MaxDepth: 3}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ToMap(state, -1, opts); !errors.Is(err, ErrNestedTooDeeply) {
+			t.Errorf("ToMap(..., MaxDepth: 2) error = %v; want %v", err, ErrNestedTooDeeply)
+		}
+		if _, err := ToMap(state, -1, &MapOptions{MaxDepth: 3}); err != nil {
+			t.Error("ToMap(..., MaxDepth: 3):", err)
+		}
+
+		cyclic := map[string]any{}
+		cyclic["self"] = cyclic
+		if err := PushMap(state, cyclic, nil); !errors.Is(err, ErrNestedTooDeeply) {
+			t.Errorf("PushMap(cyclic) error = %v; want %v", err, ErrNestedTooDeeply)
+		}
+	})
+
+	t.Run("BadKey", func(t *testing.T) {
+		defer state.SetTop(0)
+		if err := state.LoadString(`return {[true] = 1}`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ToMap(state, -1, nil); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("ToMap({[true] = 1}) error = %v; want %v", err, ErrUnsupportedType)
+		}
+		state.PushString("x")
+		if _, err := ToMap(state, -1, nil); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("ToMap(\"x\") error = %v; want %v", err, ErrTypeMismatch)
+		}
+		state.SetTop(0)
+
+		if err := state.LoadString(`return {[1] = "num", ["1"] = "str"}`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ToMap(state, -1, nil); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("ToMap({[1] = \"num\", [\"1\"] = \"str\"}) = %v, %v; want error %v", got, err, ErrUnsupportedType)
+		}
+		if got := state.Top(); got != 1 {
+			t.Errorf("after failed ToMap, state.Top() = %d; want 1", got)
+		}
+		state.SetTop(0)
+
+		if err := PushMap(state, map[float64]int{math.NaN(): 1}, nil); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("PushMap(map[float64]int{NaN: 1}) error = %v; want %v", err, ErrUnsupportedType)
+		}
+		if got := state.Top(); got != 0 {
+			t.Errorf("after failed PushMap, state.Top() = %d; want 0", got)
+		}
+	})
+}
+
+// testPoint is represented in Lua as a string "x,y".
+type testPoint struct {
+	X, Y int64
+}
+
+func (p testPoint) PushLua(l *State) error {
+	l.PushString(fmt.Sprintf("%d,%d", p.X, p.Y))
+	return nil
+}
+
+func (p *testPoint) FromLua(l *State, idx int) error {
+	s, _ := l.ToString(idx)
+	if _, err := fmt.Sscanf(s, "%d,%d", &p.X, &p.Y); err != nil {
+		return fmt.Errorf("parse point: %v", err)
+	}
+	return nil
+}
+
+func TestMarshalerUnmarshaler(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	type shape struct {
+		Origin testPoint
+		Points []*testPoint
+	}
+	want := shape{
+		Origin: testPoint{1, 2},
+		Points: []*testPoint{{3, 4}, {5, 6}},
+	}
+	if err := PushAny(state, want); err != nil {
+		t.Fatal(err)
+	}
+	if tp, _ := state.Field(-1, "Origin", 0); tp != TypeString {
+		t.Errorf("type(Origin) = %v; want %v", tp, TypeString)
+	} else if got, _ := state.ToString(-1); got != "1,2" {
+		t.Errorf("Origin = %q; want \"1,2\"", got)
+	}
+	state.Pop(1)
+	var got shape
+	if err := Unmarshal(state, -1, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal(PushAny(%+v)) = %+v", want, got)
+	}
+	state.SetTop(0)
+
+	if err := Push(state, []any{testPoint{7, 8}}); err != nil {
+		t.Fatal(err)
+	}
+	state.RawIndex(-1, 1)
+	if got, _ := state.ToString(-1); got != "7,8" {
+		t.Errorf("Push([]any{testPoint{7, 8}})[1] = %q; want \"7,8\"", got)
+	}
+	state.SetTop(0)
+
+	state.PushBoolean(true)
+	var p testPoint
+	if err := Unmarshal(state, -1, &p); err == nil {
+		t.Error("Unmarshal(true, &p) did not return an error")
+	} else if !strings.Contains(err.Error(), "parse point") {
+		t.Errorf("Unmarshal(true, &p) = %v; want FromLua error", err)
+	}
+}
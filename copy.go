@@ -0,0 +1,257 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// FunctionPolicy is an enumeration of the ways
+// that Lua functions may be copied between states.
+type FunctionPolicy int
+
+// Function policies.
+const (
+	// FunctionError causes copying a function to fail.
+	FunctionError FunctionPolicy = iota
+	// FunctionDump copies Lua functions by dumping them
+	// and loading the result in the destination state.
+	// Upvalues named _ENV are set to the destination's global environment
+	// and all other upvalues are set to nil.
+	FunctionDump
+	// FunctionDumpUpvalues is like FunctionDump,
+	// but upvalues with names allowed by [CopyOptions.AllowUpvalue]
+	// are copied to the new function.
+	// Copying fails if the function has any other non-nil upvalues
+	// (besides _ENV).
+	FunctionDumpUpvalues
+)
+
+// CopyOptions is the set of parameters for copying values between states.
+// A nil *CopyOptions is treated the same as the zero value.
+type CopyOptions struct {
+	// Functions determines how Lua functions are copied.
+	// Go functions can never be copied.
+	Functions FunctionPolicy
+	// AllowUpvalue reports whether the upvalue with the given name
+	// may be copied under the [FunctionDumpUpvalues] policy.
+	// If AllowUpvalue is nil, no upvalues are allowed.
+	AllowUpvalue func(name string) bool
+}
+
+// Copy pushes a copy of the value at index idx in src onto dst's stack.
+// Nil, booleans, numbers, and strings are copied directly.
+// Tables are copied deeply, preserving cycles and shared references,
+// but not metatables.
+// Functions are copied according to opts.Functions.
+// Copy returns an error for values that cannot be copied
+// (such as userdata and threads)
+// and does not push any value onto dst in that case.
+func (opts *CopyOptions) Copy(dst, src *State, idx int) error {
+	c := &copier{dst: dst, src: src}
+	if opts != nil {
+		c.opts = *opts
+	}
+	return c.copyValue(idx)
+}
+
+// copier copies values from one State to another.
+type copier struct {
+	dst  *State
+	src  *State
+	opts CopyOptions
+
+	// seenIndex is the absolute index on dst's stack
+	// of a table that maps integers to tables that have already been copied,
+	// or zero if no table has been created.
+	seenIndex int
+	// seen maps the addresses of tables and functions in src
+	// to their keys in the table at seenIndex.
+	seen map[uintptr]int64
+}
+
+// CopyValue pushes a deep copy of the value at index idx in src onto dst's stack
+// so that it can be used in an independent State.
+// It is the same as calling [CopyOptions.Copy]
+// with Functions set to [FunctionDump].
+func CopyValue(dst, src *State, idx int) error {
+	opts := &CopyOptions{Functions: FunctionDump}
+	return opts.Copy(dst, src, idx)
+}
+
+func (c *copier) copyValue(idx int) error {
+	if !c.dst.CheckStack(2) {
+		return fmt.Errorf("lua: copy value: stack overflow")
+	}
+	err := c.push(c.src.AbsIndex(idx))
+	if c.seenIndex != 0 {
+		if err == nil {
+			c.dst.Remove(c.seenIndex)
+		} else {
+			c.dst.SetTop(c.seenIndex - 1)
+		}
+		c.seenIndex = 0
+		c.seen = nil
+	}
+	if err != nil {
+		return fmt.Errorf("lua: copy value: %w", err)
+	}
+	return nil
+}
+
+// push pushes a copy of the value at the absolute index idx in c.src onto c.dst.
+func (c *copier) push(idx int) error {
+	switch tp := c.src.Type(idx); tp {
+	case TypeNil, TypeNone:
+		c.dst.PushNil()
+	case TypeBoolean:
+		c.dst.PushBoolean(c.src.ToBoolean(idx))
+	case TypeNumber:
+		if c.src.IsInteger(idx) {
+			n, _ := c.src.ToInteger(idx)
+			c.dst.PushInteger(n)
+		} else {
+			n, _ := c.src.ToNumber(idx)
+			c.dst.PushNumber(n)
+		}
+	case TypeString:
+		s, _ := c.src.ToString(idx)
+		c.dst.PushString(s)
+	case TypeTable:
+		return c.pushTable(idx)
+	case TypeFunction:
+		return c.pushFunction(idx)
+	default:
+		return fmt.Errorf("cannot copy a %v", tp)
+	}
+	return nil
+}
+
+// pushSeen pushes the copy of the value at the absolute index idx in c.src
+// if it has already been copied.
+func (c *copier) pushSeen(idx int) bool {
+	if c.seenIndex == 0 {
+		c.dst.CreateTable(0, 0)
+		c.seenIndex = c.dst.Top()
+		c.seen = make(map[uintptr]int64)
+	}
+	key, ok := c.seen[c.src.ToPointer(idx)]
+	if !ok {
+		return false
+	}
+	c.dst.RawIndex(c.seenIndex, key)
+	return true
+}
+
+// markSeen records the value on the top of c.dst's stack
+// as the copy of the value at the absolute index idx in c.src.
+func (c *copier) markSeen(idx int) {
+	key := int64(len(c.seen) + 1)
+	c.seen[c.src.ToPointer(idx)] = key
+	c.dst.PushValue(-1)
+	c.dst.RawSetIndex(c.seenIndex, key)
+}
+
+func (c *copier) pushTable(idx int) error {
+	if c.pushSeen(idx) {
+		return nil
+	}
+
+	if !c.src.CheckStack(3) || !c.dst.CheckStack(4) {
+		return fmt.Errorf("stack overflow (table nested too deeply)")
+	}
+	nArr := c.src.RawLen(idx)
+	c.dst.CreateTable(int(min(nArr, 1<<20)), 0)
+	c.markSeen(idx)
+
+	c.src.PushNil()
+	for c.src.Next(idx) {
+		if err := c.push(c.src.AbsIndex(-2)); err != nil {
+			c.src.Pop(2)
+			c.dst.Pop(1)
+			return err
+		}
+		if err := c.push(c.src.AbsIndex(-1)); err != nil {
+			c.src.Pop(2)
+			c.dst.Pop(2)
+			return err
+		}
+		c.dst.RawSet(-3)
+		c.src.Pop(1)
+	}
+	return nil
+}
+
+func (c *copier) pushFunction(idx int) error {
+	if c.src.IsNativeFunction(idx) {
+		return fmt.Errorf("cannot copy a native function")
+	}
+	if c.opts.Functions == FunctionError {
+		return fmt.Errorf("cannot copy a function")
+	}
+	if c.pushSeen(idx) {
+		return nil
+	}
+	if !c.src.CheckStack(2) || !c.dst.CheckStack(3) {
+		return fmt.Errorf("stack overflow (function nested too deeply)")
+	}
+
+	c.src.PushValue(idx)
+	chunk := new(bytes.Buffer)
+	_, err := c.src.Dump(chunk, false)
+	c.src.Pop(1)
+	if err != nil {
+		return err
+	}
+	if err := c.dst.Load(chunk, "=(copy)", "b"); err != nil {
+		c.dst.Pop(1)
+		return err
+	}
+	c.markSeen(idx)
+
+	for i := 1; ; i++ {
+		name, ok := c.src.state.Upvalue(idx, i)
+		if !ok {
+			break
+		}
+		switch {
+		case name == "_ENV":
+			c.dst.RawIndex(RegistryIndex, RegistryIndexGlobals)
+		case c.opts.Functions == FunctionDumpUpvalues && c.opts.AllowUpvalue != nil && c.opts.AllowUpvalue(name):
+			if err := c.push(c.src.AbsIndex(-1)); err != nil {
+				c.src.Pop(1)
+				c.dst.Pop(1)
+				return fmt.Errorf("upvalue %s: %w", name, err)
+			}
+		case c.opts.Functions == FunctionDumpUpvalues && !c.src.IsNil(-1):
+			c.src.Pop(1)
+			c.dst.Pop(1)
+			return fmt.Errorf("function captures upvalue %s", name)
+		default:
+			c.dst.PushNil()
+		}
+		c.src.Pop(1)
+		c.dst.state.SetUpvalue(-2, i)
+	}
+	return nil
+}
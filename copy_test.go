@@ -0,0 +1,218 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import "testing"
+
+func TestCopyValue(t *testing.T) {
+	src := new(State)
+	defer func() {
+		if err := src.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	dst := new(State)
+	defer func() {
+		if err := dst.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = `local t = {1, 2.5, "three", nested = {true}}` + "\n" +
+		`t.self = t` + "\n" +
+		`return t`
+	if err := src.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopyValue(dst, src, -1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dst.Top(), 1; got != want {
+		t.Fatalf("dst.Top() = %d; want %d", got, want)
+	}
+	if got, ok := dst.RawIndex(1, 1), dst.IsInteger(-1); got != TypeNumber || !ok {
+		t.Errorf("t[1] is %v (integer = %t); want integer", got, ok)
+	}
+	if got, want := dst.RawIndex(1, 2), TypeNumber; got != want || dst.IsInteger(-1) {
+		t.Errorf("t[2] is %v (integer = %t); want float", got, dst.IsInteger(-1))
+	}
+	if got, _ := dst.ToNumber(-1); got != 2.5 {
+		t.Errorf("t[2] = %g; want 2.5", got)
+	}
+	dst.Pop(2)
+	dst.RawIndex(1, 3)
+	if got, _ := dst.ToString(-1); got != "three" {
+		t.Errorf("t[3] = %q; want \"three\"", got)
+	}
+	dst.Pop(1)
+	dst.RawField(1, "nested")
+	if got := dst.RawIndex(-1, 1); got != TypeBoolean || !dst.ToBoolean(-1) {
+		t.Errorf("t.nested[1] = %v; want true", got)
+	}
+	dst.Pop(2)
+	dst.RawField(1, "self")
+	if !dst.RawEqual(1, -1) {
+		t.Error("t.self ~= t")
+	}
+	dst.Pop(1)
+
+	if err := src.LoadString("return 2 * ...", "=(fn)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyValue(dst, src, -1); err != nil {
+		t.Fatal(err)
+	}
+	dst.PushInteger(21)
+	if err := dst.Call(1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := dst.ToInteger(-1); got != 42 {
+		t.Errorf("copied function returned %d; want 42", got)
+	}
+	dst.Pop(1)
+
+	src.PushClosure(0, func(l *State) (int, error) { return 0, nil })
+	if err := CopyValue(dst, src, -1); err == nil {
+		t.Error("copying native function did not return an error")
+	}
+	if got, want := dst.Top(), 1; got != want {
+		t.Errorf("after failed copy, dst.Top() = %d; want %d", got, want)
+	}
+}
+
+func TestCopyOptions(t *testing.T) {
+	newState := func(t *testing.T) *State {
+		t.Helper()
+		l := new(State)
+		t.Cleanup(func() {
+			if err := l.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		})
+		return l
+	}
+	const source = `local x = 10` + "\n" +
+		`local y = 5` + "\n" +
+		`return function(n) return (x or 0) + (y or 0) + n + (bonus or 0) end`
+
+	tests := []struct {
+		name    string
+		opts    *CopyOptions
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:    "Error",
+			opts:    nil,
+			wantErr: true,
+		},
+		{
+			name: "Dump",
+			opts: &CopyOptions{Functions: FunctionDump},
+			want: 1 + 100,
+		},
+		{
+			name: "DumpUpvaluesAllowed",
+			opts: &CopyOptions{
+				Functions:    FunctionDumpUpvalues,
+				AllowUpvalue: func(name string) bool { return name == "x" || name == "y" },
+			},
+			want: 10 + 5 + 1 + 100,
+		},
+		{
+			name: "DumpUpvaluesRejected",
+			opts: &CopyOptions{
+				Functions:    FunctionDumpUpvalues,
+				AllowUpvalue: func(name string) bool { return name == "x" },
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := newState(t)
+			dst := newState(t)
+			if err := src.LoadString(source, "=(load)", "t"); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.Call(0, 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			dst.PushInteger(100)
+			if err := dst.SetGlobal("bonus", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			err := test.opts.Copy(dst, src, -1)
+			if err != nil {
+				if !test.wantErr {
+					t.Fatal("Copy:", err)
+				}
+				if got := dst.Top(); got != 0 {
+					t.Errorf("after failed copy, dst.Top() = %d; want 0", got)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatal("Copy did not return an error")
+			}
+			dst.PushInteger(1)
+			if err := dst.Call(1, 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := dst.ToInteger(-1); got != test.want {
+				t.Errorf("f(1) = %d; want %d", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Recursive", func(t *testing.T) {
+		src := newState(t)
+		dst := newState(t)
+		const source = `local function fact(n) if n <= 1 then return 1 end return n * fact(n - 1) end` + "\n" +
+			`return fact`
+		if err := src.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		opts := &CopyOptions{
+			Functions:    FunctionDumpUpvalues,
+			AllowUpvalue: func(name string) bool { return name == "fact" },
+		}
+		if err := opts.Copy(dst, src, -1); err != nil {
+			t.Fatal("Copy:", err)
+		}
+		dst.PushInteger(5)
+		if err := dst.Call(1, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := dst.ToInteger(-1); got != 120 {
+			t.Errorf("fact(5) = %d; want 120", got)
+		}
+	})
+}
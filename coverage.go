@@ -0,0 +1,359 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// coverageRegistryKey is the registry key of the userdata
+	// that holds a state's *coverageHook.
+	coverageRegistryKey = "zombiezen.com/go/lua.coverage"
+	// coverageMetatableName is the registry name
+	// of the coverage userdata's metatable.
+	coverageMetatableName = "*zombiezen.com/go/lua.coverageHook"
+)
+
+// Coverage is a record of the lines of Lua code that have run.
+// Coverage is collected with [State.SetCoverage]
+// and only includes chunks loaded from files
+// (that is, chunks whose names start with "@").
+// The zero value is an empty record.
+//
+// A line is considered executable once the function containing it has been called,
+// so the lines of functions that never run are not counted.
+// Coverage must not be used from multiple goroutines concurrently.
+type Coverage struct {
+	files map[string]*fileCoverage
+}
+
+type fileCoverage struct {
+	// hits maps lines to the number of times they ran.
+	hits map[int]int64
+	// lines is the set of lines that have code.
+	lines map[int]struct{}
+	// funcs is the set of functions (identified by their line ranges)
+	// whose lines have been added to lines.
+	funcs map[[2]int]struct{}
+}
+
+// LineCoverage is the number of times a line ran.
+type LineCoverage struct {
+	Line  int
+	Count int64
+}
+
+func (c *Coverage) file(name string) *fileCoverage {
+	if c.files == nil {
+		c.files = make(map[string]*fileCoverage)
+	}
+	f := c.files[name]
+	if f == nil {
+		f = &fileCoverage{
+			hits:  make(map[int]int64),
+			lines: make(map[int]struct{}),
+			funcs: make(map[[2]int]struct{}),
+		}
+		c.files[name] = f
+	}
+	return f
+}
+
+// Files returns the sorted names of the files in the record.
+// The names do not include the leading "@" of their chunk names.
+func (c *Coverage) Files() []string {
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lines returns the executable lines of the given file in ascending order,
+// including lines that have not run.
+func (c *Coverage) Lines(file string) []LineCoverage {
+	f := c.files[file]
+	if f == nil {
+		return nil
+	}
+	lines := make([]LineCoverage, 0, len(f.lines))
+	for line := range f.lines {
+		lines = append(lines, LineCoverage{Line: line, Count: f.hits[line]})
+	}
+	slices.SortFunc(lines, func(a, b LineCoverage) int {
+		return a.Line - b.Line
+	})
+	return lines
+}
+
+// Summary returns the number of executable lines that have run
+// and the total number of executable lines in the record.
+func (c *Coverage) Summary() (covered, total int) {
+	for _, f := range c.files {
+		covered += len(f.hits)
+		total += len(f.lines)
+	}
+	return covered, total
+}
+
+// Merge adds the counts in other to c.
+func (c *Coverage) Merge(other *Coverage) {
+	for name, of := range other.files {
+		f := c.file(name)
+		for line, n := range of.hits {
+			f.hits[line] += n
+		}
+		for line := range of.lines {
+			f.lines[line] = struct{}{}
+		}
+		for fn := range of.funcs {
+			f.funcs[fn] = struct{}{}
+		}
+	}
+}
+
+func (c *Coverage) hit(file string, line int) {
+	f := c.file(file)
+	f.hits[line]++
+	f.lines[line] = struct{}{}
+}
+
+// WriteLCOV writes the record to w in the LCOV tracefile format
+// used by genhtml and many code coverage services.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, name := range c.Files() {
+		lines := c.Lines(name)
+		hit := 0
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", name)
+		for _, lc := range lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", lc.Line, lc.Count)
+			if lc.Count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("lua: write lcov: %v", err)
+	}
+	return nil
+}
+
+// WriteHTML writes an HTML page to w
+// that shows the source of each file in the record
+// with its lines colored by whether they ran.
+// readFile is used to read the source of each file.
+// If readFile is nil, then [os.ReadFile] is used.
+// Files that cannot be read are listed without their source.
+func (c *Coverage) WriteHTML(w io.Writer, readFile func(name string) ([]byte, error)) error {
+	if readFile == nil {
+		readFile = os.ReadFile
+	}
+	type htmlLine struct {
+		Number int
+		Text   string
+		Class  string
+		Count  int64
+	}
+	type htmlFile struct {
+		Name    string
+		Percent string
+		Lines   []htmlLine
+		Err     string
+	}
+	var data struct {
+		Percent string
+		Files   []htmlFile
+	}
+	covered, total := c.Summary()
+	data.Percent = coveragePercent(covered, total)
+	for _, name := range c.Files() {
+		f := c.files[name]
+		hf := htmlFile{
+			Name:    name,
+			Percent: coveragePercent(len(f.hits), len(f.lines)),
+		}
+		src, err := readFile(name)
+		if err != nil {
+			hf.Err = err.Error()
+		} else {
+			for i, text := range strings.Split(strings.TrimSuffix(string(src), "\n"), "\n") {
+				hl := htmlLine{Number: i + 1, Text: text}
+				if _, ok := f.lines[hl.Number]; ok {
+					hl.Count = f.hits[hl.Number]
+					hl.Class = "miss"
+					if hl.Count > 0 {
+						hl.Class = "hit"
+					}
+				}
+				hf.Lines = append(hf.Lines, hl)
+			}
+		}
+		data.Files = append(data.Files, hf)
+	}
+	buf := new(bytes.Buffer)
+	if err := coverageHTMLTemplate.Execute(buf, data); err != nil {
+		return fmt.Errorf("lua: write coverage html: %v", err)
+	}
+	if _, err := buf.WriteTo(w); err != nil {
+		return fmt.Errorf("lua: write coverage html: %v", err)
+	}
+	return nil
+}
+
+func coveragePercent(covered, total int) string {
+	if total == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(covered)*100/float64(total))
+}
+
+var coverageHTMLTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Lua coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { margin: 0; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 0.5em; white-space: pre; }
+td.num, td.count { color: #888; text-align: right; }
+tr.hit td.src { background: #dfd; }
+tr.miss td.src { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Lua coverage: {{ .Percent }} of lines</h1>
+<ul>
+{{- range .Files }}
+<li><a href="#{{ .Name }}">{{ .Name }}</a> ({{ .Percent }})</li>
+{{- end }}
+</ul>
+{{- range .Files }}
+<h2 id="{{ .Name }}">{{ .Name }} ({{ .Percent }})</h2>
+{{- if .Err }}
+<p>{{ .Err }}</p>
+{{- else }}
+<table>
+{{- range .Lines }}
+<tr{{ if .Class }} class="{{ .Class }}"{{ end }}><td class="num">{{ .Number }}</td><td class="count">{{ if .Class }}{{ .Count }}{{ end }}</td><td class="src">{{ .Text }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- end }}
+</body>
+</html>
+`))
+
+// coverageHook holds the state of a coverage hook.
+type coverageHook struct {
+	c  *Coverage
+	id HookID
+}
+
+// SetCoverage starts recording the lines of Lua code that run into c.
+// If c is nil, SetCoverage stops recording.
+// Calling SetCoverage again replaces the previous record,
+// which keeps any lines recorded so far.
+//
+// Coverage is recorded with call and line hooks (see [State.AddHook]).
+// Lines run in coroutines are only recorded
+// if the coroutine was created after SetCoverage was called.
+func (l *State) SetCoverage(c *Coverage) {
+	if !l.CheckStack(1) {
+		panic("stack overflow")
+	}
+	l.RawField(RegistryIndex, coverageRegistryKey)
+	p := TestTypedUserdata[*coverageHook](l, -1, coverageMetatableName)
+	l.Pop(1)
+	if p != nil {
+		if c != nil {
+			(*p).c = c
+			return
+		}
+		l.RemoveHook((*p).id)
+		l.PushNil()
+		l.RawSetField(RegistryIndex, coverageRegistryKey)
+		return
+	}
+	if c == nil {
+		return
+	}
+
+	h := &coverageHook{c: c}
+	h.id = l.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		switch event {
+		case HookEventCall, HookEventTailCall:
+			h.recordFunction(l, ar)
+		case HookEventLine:
+			info := ar.Info("Sl")
+			if name, ok := strings.CutPrefix(info.Source, "@"); ok && info.CurrentLine > 0 {
+				h.c.hit(name, info.CurrentLine)
+			}
+		}
+		return nil
+	}, MaskCall|MaskLine, 0)
+	NewUserdata(l, h, coverageMetatableName)
+	l.RawSetField(RegistryIndex, coverageRegistryKey)
+}
+
+// recordFunction adds the executable lines of the called function
+// to the record the first time the function is called.
+func (h *coverageHook) recordFunction(l *State, ar *ActivationRecord) {
+	info := ar.Info("S")
+	name, ok := strings.CutPrefix(info.Source, "@")
+	if !ok || info.What == "C" {
+		return
+	}
+	f := h.c.file(name)
+	key := [2]int{info.LineDefined, info.LastLineDefined}
+	if _, seen := f.funcs[key]; seen {
+		return
+	}
+	f.funcs[key] = struct{}{}
+	if !l.CheckStack(3) {
+		return
+	}
+	ar.Info("L")
+	if l.IsTable(-1) {
+		l.PushNil()
+		for l.Next(-2) {
+			if line, ok := l.ToInteger(-2); ok {
+				f.lines[int(line)] = struct{}{}
+			}
+			l.Pop(1)
+		}
+	}
+	l.Pop(1)
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "local function used(x)\n" +
+		"  if x > 0 then\n" +
+		"    return x\n" +
+		"  end\n" +
+		"  return -x\n" +
+		"end\n" +
+		"local function unused()\n" +
+		"  return 1\n" +
+		"end\n" +
+		"return used(5)\n"
+	c := new(Coverage)
+	state.SetCoverage(c)
+	if err := state.LoadString(source, "@cov.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	state.SetCoverage(nil)
+	if hook, _, _ := state.Hook(); hook != nil {
+		t.Error("hook still installed after SetCoverage(nil)")
+	}
+
+	if got, want := c.Files(), []string{"cov.lua"}; !slices.Equal(got, want) {
+		t.Errorf("c.Files() = %q; want %q", got, want)
+	}
+	counts := make(map[int]int64)
+	for _, lc := range c.Lines("cov.lua") {
+		counts[lc.Line] = lc.Count
+	}
+	for _, line := range []int{2, 3, 10} {
+		if counts[line] != 1 {
+			t.Errorf("line %d count = %d; want 1", line, counts[line])
+		}
+	}
+	if n, ok := counts[5]; !ok || n != 0 {
+		t.Errorf("line 5 count = %d, %t; want 0, true", n, ok)
+	}
+	if _, ok := counts[8]; ok {
+		t.Error("line 8 (in a function that never ran) reported as executable")
+	}
+	covered, total := c.Summary()
+	if covered == 0 || covered >= total || total != len(counts) {
+		t.Errorf("c.Summary() = %d, %d; want 0 < covered < total = %d", covered, total, len(counts))
+	}
+
+	merged := new(Coverage)
+	merged.Merge(c)
+	merged.Merge(c)
+	if got := merged.Lines("cov.lua"); len(got) != total || got[1].Count != 2*counts[got[1].Line] {
+		t.Errorf("after merging twice, lines = %v", got)
+	}
+
+	lcov := new(bytes.Buffer)
+	if err := c.WriteLCOV(lcov); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SF:cov.lua\n", "DA:3,1\n", "DA:5,0\n", "end_of_record\n"} {
+		if !strings.Contains(lcov.String(), want) {
+			t.Errorf("LCOV output does not contain %q:\n%s", want, lcov)
+		}
+	}
+
+	page := new(bytes.Buffer)
+	err := c.WriteHTML(page, func(name string) ([]byte, error) {
+		if name != "cov.lua" {
+			return nil, errors.New("not found")
+		}
+		return []byte(source), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`class="hit"`, `class="miss"`, "return -x"} {
+		if !strings.Contains(page.String(), want) {
+			t.Errorf("HTML output does not contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultFSPath is the default list of templates
+// that [Dependencies] uses to search for modules.
+// It has the same format as package.path,
+// but the templates are slash-separated paths in an [fs.FS].
+const DefaultFSPath = "?.lua;?/init.lua"
+
+// DependencyGraph describes the modules that a Lua program requires.
+type DependencyGraph struct {
+	// Entry is the name of the file the program starts from.
+	Entry string
+	// Files maps the name of each file in the program
+	// (including Entry)
+	// to the names of the modules that it requires
+	// in order of first appearance.
+	Files map[string][]string
+	// Modules maps the name of each module that was found
+	// to the name of the file that provides it.
+	Modules map[string]string
+	// Missing is the sorted list of names of modules
+	// that could not be found.
+	// This includes modules provided by the host program,
+	// like the standard libraries.
+	Missing []string
+}
+
+// Dependents returns the sorted names of the files
+// that directly or indirectly require the given file.
+// This is the set of files that are affected if the given file changes.
+func (g *DependencyGraph) Dependents(name string) []string {
+	reverse := make(map[string][]string)
+	for file, mods := range g.Files {
+		for _, mod := range mods {
+			if dep, ok := g.Modules[mod]; ok {
+				reverse[dep] = append(reverse[dep], file)
+			}
+		}
+	}
+	seen := make(map[string]struct{})
+	queue := []string{name}
+	for len(queue) > 0 {
+		curr := queue[0]
+		queue = queue[1:]
+		for _, file := range reverse[curr] {
+			if _, ok := seen[file]; !ok && file != name {
+				seen[file] = struct{}{}
+				queue = append(queue, file)
+			}
+		}
+	}
+	result := make([]string, 0, len(seen))
+	for file := range seen {
+		result = append(result, file)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Dependencies reads the Lua source file named entry from fsys
+// and statically resolves its calls to require
+// (as well as the calls in the modules it requires, transitively).
+// Only calls whose argument is a single string literal are followed,
+// like require "foo" or require("foo.bar").
+// Module names are resolved by replacing each "." in the name with "/"
+// and trying each ";"-separated template in searchPath
+// with "?" replaced by the result.
+// If searchPath is empty, [DefaultFSPath] is used.
+//
+// Dependencies does not run any code,
+// so it cannot see modules required with computed names
+// or modules that are found by custom searchers.
+func Dependencies(fsys fs.FS, entry, searchPath string) (*DependencyGraph, error) {
+	if searchPath == "" {
+		searchPath = DefaultFSPath
+	}
+	g := &DependencyGraph{
+		Entry:   entry,
+		Files:   make(map[string][]string),
+		Modules: make(map[string]string),
+	}
+	missing := make(map[string]struct{})
+	queue := []string{entry}
+	for len(queue) > 0 {
+		file := queue[0]
+		queue = queue[1:]
+		src, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("lua: dependencies: %w", err)
+		}
+		mods := requiredModules(src)
+		g.Files[file] = mods
+		for _, mod := range mods {
+			if _, done := g.Modules[mod]; done {
+				continue
+			}
+			if _, done := missing[mod]; done {
+				continue
+			}
+			found, ok := searchFS(fsys, mod, searchPath)
+			if !ok {
+				missing[mod] = struct{}{}
+				continue
+			}
+			g.Modules[mod] = found
+			if _, done := g.Files[found]; !done {
+				g.Files[found] = nil
+				queue = append(queue, found)
+			}
+		}
+	}
+	for mod := range missing {
+		g.Missing = append(g.Missing, mod)
+	}
+	sort.Strings(g.Missing)
+	return g, nil
+}
+
+// searchFS returns the name of the first file in fsys
+// that matches one of the templates in searchPath for the module name.
+func searchFS(fsys fs.FS, name, searchPath string) (string, bool) {
+	name = strings.ReplaceAll(name, ".", "/")
+	for _, template := range strings.Split(searchPath, ";") {
+		if template == "" {
+			continue
+		}
+		file := path.Clean(strings.ReplaceAll(template, "?", name))
+		if !fs.ValidPath(file) {
+			continue
+		}
+		if info, err := fs.Stat(fsys, file); err == nil && info.Mode().IsRegular() {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// requiredModules returns the names of the modules that the Lua source src
+// requires with a string literal argument,
+// in order of first appearance.
+func requiredModules(src []byte) []string {
+	tokens := tokenizeLua(src)
+	var mods []string
+	seen := make(map[string]struct{})
+	for i, tok := range tokens {
+		if tok.kind != luaTokenName || tok.text != "require" {
+			continue
+		}
+		if i > 0 {
+			if prev := tokens[i-1]; prev.text == "." || prev.text == ":" || prev.text == "function" {
+				continue
+			}
+		}
+		var arg luaToken
+		switch {
+		case i+1 < len(tokens) && tokens[i+1].kind == luaTokenString:
+			arg = tokens[i+1]
+		case i+3 < len(tokens) && tokens[i+1].text == "(" &&
+			tokens[i+2].kind == luaTokenString && tokens[i+3].text == ")":
+			arg = tokens[i+2]
+		default:
+			continue
+		}
+		if _, dup := seen[arg.text]; !dup {
+			seen[arg.text] = struct{}{}
+			mods = append(mods, arg.text)
+		}
+	}
+	return mods
+}
+
+type luaTokenKind int
+
+const (
+	luaTokenName luaTokenKind = 1 + iota
+	luaTokenString
+	luaTokenOther
+)
+
+type luaToken struct {
+	kind luaTokenKind
+	// text is the identifier for names,
+	// the decoded value for strings,
+	// and the source text for other tokens.
+	text string
+}
+
+// tokenizeLua splits Lua source into tokens, discarding comments.
+// It is only precise enough to find require calls:
+// numbers and operators may be split differently than Lua would,
+// and strings with escape sequences that tokenizeLua does not understand
+// are reported as other tokens.
+func tokenizeLua(src []byte) []luaToken {
+	var tokens []luaToken
+	i := 0
+	if len(src) > 0 && src[0] == '#' {
+		// Skip shebang line.
+		for i < len(src) && src[i] != '\n' {
+			i++
+		}
+	}
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case c == '-' && i+1 < len(src) && src[i+1] == '-':
+			i += 2
+			if _, end, ok := longBracket(src, i); ok {
+				i = end
+			} else {
+				for i < len(src) && src[i] != '\n' {
+					i++
+				}
+			}
+		case c == '[':
+			if s, end, ok := longBracket(src, i); ok {
+				tokens = append(tokens, luaToken{kind: luaTokenString, text: s})
+				i = end
+			} else {
+				tokens = append(tokens, luaToken{kind: luaTokenOther, text: "["})
+				i++
+			}
+		case c == '"' || c == '\'':
+			s, end, ok := shortString(src, i)
+			if ok {
+				tokens = append(tokens, luaToken{kind: luaTokenString, text: s})
+			} else {
+				tokens = append(tokens, luaToken{kind: luaTokenOther, text: string(src[i:end])})
+			}
+			i = end
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+			start := i
+			for i < len(src) && isNameByte(src[i]) {
+				i++
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenName, text: string(src[start:i])})
+		case '0' <= c && c <= '9':
+			start := i
+			for i < len(src) && (isNameByte(src[i]) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenOther, text: string(src[start:i])})
+		case c == '.' || c == ':':
+			start := i
+			for i < len(src) && src[i] == c {
+				i++
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenOther, text: string(src[start:i])})
+		default:
+			tokens = append(tokens, luaToken{kind: luaTokenOther, text: string(c)})
+			i++
+		}
+	}
+	return tokens
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// longBracket parses a long bracket string (like [[...]] or [==[...]==])
+// starting at src[start].
+// It returns the bracket's contents and the index just past the closing bracket.
+// If the long bracket is not terminated, then it consumes the rest of src.
+func longBracket(src []byte, start int) (s string, end int, ok bool) {
+	if start >= len(src) || src[start] != '[' {
+		return "", start, false
+	}
+	i := start + 1
+	level := 0
+	for i < len(src) && src[i] == '=' {
+		level++
+		i++
+	}
+	if i >= len(src) || src[i] != '[' {
+		return "", start, false
+	}
+	i++
+	// A newline immediately following the opening bracket is skipped.
+	if i < len(src) && src[i] == '\r' {
+		i++
+	}
+	if i < len(src) && src[i] == '\n' {
+		i++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	n := strings.Index(string(src[i:]), closing)
+	if n < 0 {
+		return string(src[i:]), len(src), true
+	}
+	return string(src[i : i+n]), i + n + len(closing), true
+}
+
+// shortString parses a quoted string starting at src[start].
+// It returns the decoded string and the index just past the closing quote.
+// ok is false if the string contains an escape sequence
+// that shortString does not decode or the string is not terminated.
+func shortString(src []byte, start int) (s string, end int, ok bool) {
+	quote := src[start]
+	var sb strings.Builder
+	ok = true
+	i := start + 1
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == quote:
+			return sb.String(), i + 1, ok
+		case c == '\n':
+			return "", i, false
+		case c == '\\' && i+1 < len(src):
+			i++
+			switch e := src[i]; e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case '\\', '"', '\'':
+				sb.WriteByte(e)
+			default:
+				ok = false
+			}
+			i++
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return "", i, false
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDependencies(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.lua": {Data: []byte("#!/usr/bin/env lua\n" +
+			"local a = require 'a'\n" +
+			"local b = require(\"pkg.b\")\n" +
+			"-- require 'commented'\n" +
+			"--[[ require 'block' ]]\n" +
+			"local s = [[require 'inside string']]\n" +
+			"local dyn = require(prefix .. 'x')\n" +
+			"obj:require 'method'\n" +
+			"require 'string'\n")},
+		"a.lua":          {Data: []byte("return require [[pkg.b]]\n")},
+		"pkg/b/init.lua": {Data: []byte("local c = require('c') return {}\n")},
+	}
+	got, err := Dependencies(fsys, "main.lua", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DependencyGraph{
+		Entry: "main.lua",
+		Files: map[string][]string{
+			"main.lua":       {"a", "pkg.b", "string"},
+			"a.lua":          {"pkg.b"},
+			"pkg/b/init.lua": {"c"},
+		},
+		Modules: map[string]string{
+			"a":     "a.lua",
+			"pkg.b": "pkg/b/init.lua",
+		},
+		Missing: []string{"c", "string"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Dependencies(...) = %+v; want %+v", got, want)
+	}
+
+	if got, want := got.Dependents("pkg/b/init.lua"), []string{"a.lua", "main.lua"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Dependents(\"pkg/b/init.lua\") = %q; want %q", got, want)
+	}
+	if got := got.Dependents("main.lua"); len(got) != 0 {
+		t.Errorf("Dependents(\"main.lua\") = %q; want []", got)
+	}
+
+	if _, err := Dependencies(fsys, "nonexistent.lua", ""); err == nil {
+		t.Error("Dependencies(fsys, \"nonexistent.lua\", \"\") did not return an error")
+	}
+}
@@ -0,0 +1,473 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Tags used in the value encoding.
+const (
+	encodeTagNil      byte = 0
+	encodeTagFalse    byte = 1
+	encodeTagTrue     byte = 2
+	encodeTagInteger  byte = 3
+	encodeTagFloat    byte = 4
+	encodeTagString   byte = 5
+	encodeTagTable    byte = 6
+	encodeTagTableEnd byte = 7
+	encodeTagTableRef byte = 8
+	encodeTagFunction byte = 9
+)
+
+// encodeMagic is the header written by [Encode].
+// The last byte is the format version.
+const encodeMagic = "\x1bLuaZ\x01"
+
+// EncodeOptions is the set of parameters for [EncodeOptions.Encode].
+// A nil *EncodeOptions is treated the same as the zero value.
+type EncodeOptions struct {
+	// If Functions is true, then Lua functions are encoded as binary chunks.
+	// Their upvalues are not encoded: see [FunctionDump].
+	// Go functions can never be encoded.
+	Functions bool
+}
+
+// Encode writes the value at index idx in l to w
+// in a stable binary format that can be read by [Decode].
+// Nil, booleans, numbers, and strings are encoded directly.
+// Tables are encoded deeply, preserving cycles and shared references,
+// but not metatables.
+// Encode returns an error for userdata, threads,
+// and functions (unless opts.Functions is true).
+func (opts *EncodeOptions) Encode(l *State, idx int, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(encodeMagic)
+	e := &encoder{l: l, w: bw}
+	if opts != nil {
+		e.functions = opts.Functions
+	}
+	if err := e.encode(l.AbsIndex(idx)); err != nil {
+		return fmt.Errorf("lua: encode: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("lua: encode: %w", err)
+	}
+	return nil
+}
+
+// Encode writes the value at index idx in l to w
+// using the default [EncodeOptions].
+func Encode(l *State, idx int, w io.Writer) error {
+	return (*EncodeOptions)(nil).Encode(l, idx, w)
+}
+
+// DecodeOptions is the set of parameters for [DecodeOptions.Decode].
+// A nil *DecodeOptions is treated the same as the zero value.
+type DecodeOptions struct {
+	// If Functions is true, then encoded functions are loaded.
+	// Lua does not verify binary chunks,
+	// so Functions should only be set for data from a trusted source.
+	Functions bool
+}
+
+// Decode reads a value written by [Encode] from r
+// and pushes it onto l's stack.
+// Upvalues of decoded functions named _ENV are set to l's global environment.
+// If r is not a [*bufio.Reader],
+// then Decode may read past the end of the encoded value.
+// If Decode returns an error, it does not push any value.
+func (opts *DecodeOptions) Decode(l *State, r io.Reader) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	var header [len(encodeMagic)]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("lua: decode: %w", err)
+	}
+	if !strings.HasPrefix(string(header[:]), encodeMagic[:len(encodeMagic)-1]) {
+		return fmt.Errorf("lua: decode: not encoded Lua data")
+	}
+	if v := header[len(header)-1]; v != encodeMagic[len(encodeMagic)-1] {
+		return fmt.Errorf("lua: decode: unsupported format version %d", v)
+	}
+	d := &decoder{l: l, r: br}
+	if opts != nil {
+		d.functions = opts.Functions
+	}
+	if err := d.decodeValue(); err != nil {
+		return fmt.Errorf("lua: %w", err)
+	}
+	return nil
+}
+
+// Decode reads a value written by [Encode] from r
+// and pushes it onto l's stack
+// using the default [DecodeOptions].
+func Decode(l *State, r io.Reader) error {
+	return (*DecodeOptions)(nil).Decode(l, r)
+}
+
+// encoder writes Lua values in a compact binary format.
+// Each value starts with a tag byte:
+//
+//   - nil, false, and true have no further data.
+//   - An integer is followed by its zig-zag varint encoding.
+//   - A float is followed by the 8-byte little-endian IEEE 754 representation.
+//   - A string is followed by its length as a uvarint, then its bytes.
+//   - A table is followed by its key/value pairs, then a table end tag.
+//   - A function is followed by the length of its binary chunk as a uvarint,
+//     then the chunk.
+//   - A table reference is followed by a uvarint
+//     that refers to the n-th table or function (0-based) encoded so far,
+//     which preserves cycles and shared references.
+type encoder struct {
+	l         *State
+	w         *bufio.Writer
+	functions bool
+	seen      map[uintptr]uint64
+}
+
+// encodeValue writes the value at idx to w.
+func encodeValue(w *bufio.Writer, l *State, idx int) error {
+	e := &encoder{l: l, w: w}
+	return e.encode(l.AbsIndex(idx))
+}
+
+func (e *encoder) encode(idx int) error {
+	switch tp := e.l.Type(idx); tp {
+	case TypeNil, TypeNone:
+		e.w.WriteByte(encodeTagNil)
+	case TypeBoolean:
+		if e.l.ToBoolean(idx) {
+			e.w.WriteByte(encodeTagTrue)
+		} else {
+			e.w.WriteByte(encodeTagFalse)
+		}
+	case TypeNumber:
+		if e.l.IsInteger(idx) {
+			n, _ := e.l.ToInteger(idx)
+			e.w.WriteByte(encodeTagInteger)
+			e.w.Write(binary.AppendVarint(nil, n))
+		} else {
+			n, _ := e.l.ToNumber(idx)
+			e.w.WriteByte(encodeTagFloat)
+			e.w.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(n)))
+		}
+	case TypeString:
+		s, _ := e.l.ToString(idx)
+		e.w.WriteByte(encodeTagString)
+		e.w.Write(binary.AppendUvarint(nil, uint64(len(s))))
+		e.w.WriteString(s)
+	case TypeTable:
+		if err := e.encodeTable(idx); err != nil {
+			return err
+		}
+	case TypeFunction:
+		if err := e.encodeFunction(idx); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot encode a %v", tp)
+	}
+	return nil
+}
+
+func (e *encoder) encodeTable(idx int) error {
+	if e.encodeRef(idx) {
+		return nil
+	}
+	if !e.l.CheckStack(3) {
+		return fmt.Errorf("stack overflow (table nested too deeply)")
+	}
+	e.w.WriteByte(encodeTagTable)
+	e.l.PushNil()
+	for e.l.Next(idx) {
+		if err := e.encode(e.l.AbsIndex(-2)); err != nil {
+			e.l.Pop(2)
+			return err
+		}
+		if err := e.encode(e.l.AbsIndex(-1)); err != nil {
+			e.l.Pop(2)
+			return err
+		}
+		e.l.Pop(1)
+	}
+	e.w.WriteByte(encodeTagTableEnd)
+	return nil
+}
+
+func (e *encoder) encodeFunction(idx int) error {
+	if e.l.IsNativeFunction(idx) {
+		return fmt.Errorf("cannot encode a native function")
+	}
+	if !e.functions {
+		return fmt.Errorf("cannot encode a function")
+	}
+	if e.encodeRef(idx) {
+		return nil
+	}
+	if !e.l.CheckStack(1) {
+		return fmt.Errorf("stack overflow (function nested too deeply)")
+	}
+	e.l.PushValue(idx)
+	chunk := new(bytes.Buffer)
+	_, err := e.l.Dump(chunk, false)
+	e.l.Pop(1)
+	if err != nil {
+		return err
+	}
+	e.w.WriteByte(encodeTagFunction)
+	e.w.Write(binary.AppendUvarint(nil, uint64(chunk.Len())))
+	e.w.Write(chunk.Bytes())
+	return nil
+}
+
+// encodeRef writes a reference to the table or function at idx
+// if it has already been encoded.
+// Otherwise, encodeRef assigns the value the next reference
+// and returns false.
+func (e *encoder) encodeRef(idx int) bool {
+	ptr := e.l.ToPointer(idx)
+	if ref, ok := e.seen[ptr]; ok {
+		e.w.WriteByte(encodeTagTableRef)
+		e.w.Write(binary.AppendUvarint(nil, ref))
+		return true
+	}
+	if e.seen == nil {
+		e.seen = make(map[uintptr]uint64)
+	}
+	e.seen[ptr] = uint64(len(e.seen))
+	return false
+}
+
+// decoder reads values written by an [encoder]
+// and pushes them onto a State's stack.
+type decoder struct {
+	l         *State
+	r         *bufio.Reader
+	functions bool
+	// tablesIndex is the absolute stack index of a table
+	// that maps references to tables and functions, or 0 if not created yet.
+	tablesIndex int
+	nTables     int64
+}
+
+// decodeValue reads a single value from r and pushes it onto l's stack.
+// If decodeValue returns an error, it does not push any value.
+func decodeValue(l *State, r *bufio.Reader) error {
+	d := &decoder{l: l, r: r}
+	return d.decodeValue()
+}
+
+func (d *decoder) decodeValue() error {
+	l := d.l
+	if !l.CheckStack(2) {
+		return fmt.Errorf("decode: stack overflow")
+	}
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("decode: %w", err)
+	}
+	err = d.decode(tag)
+	if d.tablesIndex != 0 {
+		if err == nil {
+			l.Remove(d.tablesIndex)
+		} else {
+			l.SetTop(d.tablesIndex - 1)
+		}
+		d.tablesIndex = 0
+		d.nTables = 0
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("decode: %w", err)
+	}
+	return nil
+}
+
+var errTableEnd = errors.New("unexpected table end")
+
+// decode pushes the value that starts with the given tag.
+func (d *decoder) decode(tag byte) error {
+	switch tag {
+	case encodeTagNil:
+		d.l.PushNil()
+	case encodeTagFalse:
+		d.l.PushBoolean(false)
+	case encodeTagTrue:
+		d.l.PushBoolean(true)
+	case encodeTagInteger:
+		n, err := binary.ReadVarint(d.r)
+		if err != nil {
+			return err
+		}
+		d.l.PushInteger(n)
+	case encodeTagFloat:
+		var buf [8]byte
+		if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+			return err
+		}
+		d.l.PushNumber(math.Float64frombits(binary.LittleEndian.Uint64(buf[:])))
+	case encodeTagString:
+		n, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return err
+		}
+		sb := new(strings.Builder)
+		if m, err := io.CopyN(sb, d.r, int64(min(n, math.MaxInt64))); err != nil {
+			if err == io.EOF && uint64(m) < n {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		d.l.PushString(sb.String())
+	case encodeTagTable:
+		return d.decodeTable()
+	case encodeTagTableRef:
+		ref, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return err
+		}
+		if d.tablesIndex == 0 || ref >= uint64(d.nTables) {
+			return fmt.Errorf("invalid table reference %d", ref)
+		}
+		d.l.RawIndex(d.tablesIndex, int64(ref)+1)
+	case encodeTagFunction:
+		return d.decodeFunction()
+	case encodeTagTableEnd:
+		return errTableEnd
+	default:
+		return fmt.Errorf("unknown tag %#02x", tag)
+	}
+	return nil
+}
+
+func (d *decoder) decodeTable() error {
+	if !d.l.CheckStack(4) {
+		return fmt.Errorf("stack overflow (table nested too deeply)")
+	}
+	d.l.CreateTable(0, 0)
+	d.addRef()
+
+	for {
+		tag, err := d.r.ReadByte()
+		if err != nil {
+			d.l.Pop(1)
+			return err
+		}
+		if tag == encodeTagTableEnd {
+			return nil
+		}
+		if err := d.decode(tag); err != nil {
+			d.l.Pop(1)
+			return err
+		}
+		switch d.l.Type(-1) {
+		case TypeNil:
+			d.l.Pop(2)
+			return fmt.Errorf("table key is nil")
+		case TypeNumber:
+			if n, _ := d.l.ToNumber(-1); math.IsNaN(n) {
+				d.l.Pop(2)
+				return fmt.Errorf("table key is NaN")
+			}
+		}
+		tag, err = d.r.ReadByte()
+		if err != nil {
+			d.l.Pop(2)
+			return err
+		}
+		if err := d.decode(tag); err != nil {
+			d.l.Pop(2)
+			return err
+		}
+		d.l.RawSet(-3)
+	}
+}
+
+func (d *decoder) decodeFunction() error {
+	if !d.functions {
+		return fmt.Errorf("cannot decode a function")
+	}
+	if !d.l.CheckStack(3) {
+		return fmt.Errorf("stack overflow (function nested too deeply)")
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	chunk := new(bytes.Buffer)
+	if m, err := io.CopyN(chunk, d.r, int64(min(n, math.MaxInt64))); err != nil {
+		if err == io.EOF && uint64(m) < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := d.l.Load(chunk, "=(decode)", "b"); err != nil {
+		d.l.Pop(1)
+		return err
+	}
+	for i := 1; ; i++ {
+		name, ok := d.l.state.Upvalue(-1, i)
+		if !ok {
+			break
+		}
+		d.l.Pop(1)
+		if name == "_ENV" {
+			d.l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+		} else {
+			d.l.PushNil()
+		}
+		d.l.state.SetUpvalue(-2, i)
+	}
+	d.addRef()
+	return nil
+}
+
+// addRef assigns the next reference to the value on the top of the stack.
+func (d *decoder) addRef() {
+	if d.tablesIndex == 0 {
+		d.l.CreateTable(0, 0)
+		d.l.Insert(-2)
+		d.tablesIndex = d.l.Top() - 1
+	}
+	d.nTables++
+	d.l.PushValue(-1)
+	d.l.RawSetIndex(d.tablesIndex, d.nTables)
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	newState := func(t *testing.T) *State {
+		t.Helper()
+		l := new(State)
+		t.Cleanup(func() {
+			if err := l.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		})
+		if err := OpenLibraries(l); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	eval := func(t *testing.T, l *State, source string) {
+		t.Helper()
+		if err := l.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		src := newState(t)
+		eval(t, src, `local shared = {"x"}`+"\n"+
+			`local t = {1, 2.5, "three\0", false, a = shared, b = shared}`+"\n"+
+			`t.self = t`+"\n"+
+			`return t`)
+		buf := new(bytes.Buffer)
+		if err := Encode(src, -1, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := newState(t)
+		if err := Decode(dst, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := dst.Top(), 1; got != want {
+			t.Fatalf("dst.Top() = %d; want %d", got, want)
+		}
+		if err := dst.SetGlobal("t", 0); err != nil {
+			t.Fatal(err)
+		}
+		eval(t, dst, `return math.type(t[1]) == "integer" and t[1] == 1 and`+"\n"+
+			`math.type(t[2]) == "float" and t[2] == 2.5 and`+"\n"+
+			`t[3] == "three\0" and t[4] == false and`+"\n"+
+			`t.a == t.b and t.a[1] == "x" and t.self == t`)
+		if !dst.ToBoolean(-1) {
+			t.Error("decoded table does not match")
+		}
+	})
+
+	t.Run("Functions", func(t *testing.T) {
+		src := newState(t)
+		eval(t, src, `local function f(n) return n * factor end`+"\n"+
+			`return {f = f, g = f}`)
+		if err := Encode(src, -1, new(bytes.Buffer)); err == nil {
+			t.Error("Encode with default options did not return an error")
+		}
+		buf := new(bytes.Buffer)
+		if err := (&EncodeOptions{Functions: true}).Encode(src, -1, buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		dst := newState(t)
+		if err := Decode(dst, bytes.NewReader(data)); err == nil {
+			t.Error("Decode with default options did not return an error")
+		}
+		if got := dst.Top(); got != 0 {
+			t.Errorf("after failed Decode, dst.Top() = %d; want 0", got)
+		}
+		if err := (&DecodeOptions{Functions: true}).Decode(dst, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.SetGlobal("t", 0); err != nil {
+			t.Fatal(err)
+		}
+		eval(t, dst, `factor = 3`+"\n"+
+			`return t.f == t.g and t.f(14) == 42`)
+		if !dst.ToBoolean(-1) {
+			t.Error("decoded functions do not match")
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		src := newState(t)
+		eval(t, src, `return {"abc", {1, 2, 3}}`)
+		buf := new(bytes.Buffer)
+		if err := Encode(src, -1, buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		dst := newState(t)
+		for n := 0; n < len(data); n++ {
+			if err := Decode(dst, bytes.NewReader(data[:n])); err == nil {
+				t.Errorf("Decode(data[:%d]) did not return an error", n)
+			}
+			if got := dst.Top(); got != 0 {
+				t.Fatalf("after Decode(data[:%d]), dst.Top() = %d; want 0", n, got)
+			}
+		}
+	})
+}
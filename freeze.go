@@ -0,0 +1,237 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+
+	"zombiezen.com/go/lua/internal/lua54"
+)
+
+// FreezeGlobals replaces the state's globals table
+// with a read-only proxy,
+// so that assignments in scripts cannot add, change, or remove global variables
+// except for the names listed in allow.
+// Reading a global variable through the proxy reads the original table,
+// and assigning to an allowed name assigns to the original table.
+// Assigning to any other name raises an error.
+// The _G field of the original table is changed to refer to the proxy.
+//
+// Tables stored in globals, like the string or table libraries,
+// are replaced with read-only proxies in the same way,
+// both in the globals table and in package.loaded.
+// The string metatable's __index field is changed to the frozen string library
+// and its metatable is protected,
+// so getmetatable on a string returns false.
+// The rawset function is replaced with one that refuses to modify
+// the proxies created by FreezeGlobals.
+// Tables nested inside those tables (like package.loaded itself)
+// are not frozen,
+// and the debug library can bypass the proxies.
+//
+// Only chunks loaded after FreezeGlobals use the globals proxy:
+// functions that were loaded before still use the original table.
+// After FreezeGlobals, [State.SetGlobal] is subject to the same rules as scripts.
+// Go code that needs to modify other globals
+// can use raw accesses on the original table,
+// which is the __index field of the proxy's metatable.
+func FreezeGlobals(l *State, allow ...string) error {
+	if !l.CheckStack(14) {
+		return fmt.Errorf("lua: freeze globals: stack overflow")
+	}
+	allowed := make(map[string]struct{}, len(allow))
+	for _, name := range allow {
+		allowed[name] = struct{}{}
+	}
+
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	globals := l.Top()
+	// frozen maps each original table to its proxy.
+	l.CreateTable(0, 0)
+	frozen := l.Top()
+	// proxies is the set of proxies that rawset refuses to modify.
+	l.CreateTable(0, 0)
+	proxies := l.Top()
+	l.RawField(globals, "package")
+	pkg := l.Top()
+
+	l.PushNil()
+	for l.Next(globals) {
+		if l.Type(-2) != TypeString || l.Type(-1) != TypeTable || l.RawEqual(-1, globals) {
+			l.Pop(1)
+			continue
+		}
+		l.PushValue(-1)
+		if l.RawGet(frozen) == TypeNil {
+			l.Pop(1)
+			name, _ := l.ToString(-2)
+			pushFrozenProxy(l, -1, func(l *State) (int, error) {
+				if l.Type(2) == TypeString {
+					k, _ := l.ToString(2)
+					return 0, luaErrorf("%sattempt to assign to read-only field '%s.%s'", Where(l, 1), name, k)
+				}
+				return 0, luaErrorf("%sattempt to assign to read-only table '%s'", Where(l, 1), name)
+			})
+			l.PushValue(-1)
+			l.PushBoolean(true)
+			l.RawSet(proxies)
+			l.PushValue(-2)
+			l.PushValue(-2)
+			l.RawSet(frozen)
+		}
+		// Stack: key, table, proxy.
+		l.PushValue(-3)
+		l.Rotate(-2, 1)
+		l.RawSet(globals)
+		l.Pop(1)
+	}
+
+	pushFrozenProxy(l, globals, func(l *State) (int, error) {
+		if l.Type(2) == TypeString {
+			name, _ := l.ToString(2)
+			if _, ok := allowed[name]; ok {
+				l.SetTop(3)
+				l.RawSet(UpvalueIndex(1))
+				return 0, nil
+			}
+			return 0, luaErrorf("%sattempt to assign to read-only global '%s'", Where(l, 1), name)
+		}
+		return 0, luaErrorf("%sattempt to assign to read-only globals table", Where(l, 1))
+	})
+	l.PushValue(-1)
+	l.PushBoolean(true)
+	l.RawSet(proxies)
+	l.PushValue(globals)
+	l.PushValue(-2)
+	l.RawSet(frozen)
+	l.PushValue(-1)
+	l.RawSetField(globals, GName)
+	l.RawSetIndex(RegistryIndex, RegistryIndexGlobals)
+
+	// Replace the loaded modules too, so that require returns the proxies.
+	if l.Type(pkg) == TypeTable && l.RawField(pkg, "loaded") == TypeTable {
+		loaded := l.Top()
+		l.PushNil()
+		for l.Next(loaded) {
+			l.PushValue(-1)
+			if l.RawGet(frozen) != TypeNil {
+				// Stack: key, table, proxy.
+				l.PushValue(-3)
+				l.Rotate(-2, 1)
+				l.RawSet(loaded)
+			} else {
+				l.Pop(1)
+			}
+			l.Pop(1)
+		}
+	}
+	l.SetTop(proxies)
+
+	l.PushString("")
+	if l.Metatable(-1) {
+		l.RawField(-1, "__index")
+		if l.RawGet(frozen) != TypeNil {
+			l.RawSetField(-2, "__index")
+		} else {
+			l.Pop(1)
+		}
+		l.PushBoolean(false)
+		l.RawSetField(-2, "__metatable")
+		l.Pop(1)
+	}
+	l.Pop(1)
+
+	if l.RawField(globals, "rawset") == TypeFunction {
+		l.PushValue(proxies)
+		l.Rotate(-2, 1)
+		l.PushClosure(2, frozenRawSet)
+		l.RawSetField(globals, "rawset")
+	} else {
+		l.Pop(1)
+	}
+	l.SetTop(globals - 1)
+	return nil
+}
+
+// pushFrozenProxy pushes an empty table whose metatable
+// reads from the table at idx
+// and calls newIndex with the table as its first upvalue on assignment.
+func pushFrozenProxy(l *State, idx int, newIndex Function) {
+	idx = l.AbsIndex(idx)
+	l.CreateTable(0, 0)
+	l.CreateTable(0, 5)
+	l.PushValue(idx)
+	l.RawSetField(-2, "__index")
+	l.PushValue(idx)
+	l.PushClosure(1, newIndex)
+	l.RawSetField(-2, "__newindex")
+	l.PushValue(idx)
+	l.PushClosure(1, frozenPairs)
+	l.RawSetField(-2, "__pairs")
+	l.PushValue(idx)
+	l.PushClosure(1, frozenLen)
+	l.RawSetField(-2, "__len")
+	l.PushBoolean(false)
+	l.RawSetField(-2, "__metatable")
+	l.SetMetatable(-2)
+}
+
+// frozenPairs is the __pairs metamethod of the proxies
+// created by [FreezeGlobals].
+// It iterates over the original table in its first upvalue.
+func frozenPairs(l *State) (int, error) {
+	// The iterator is a C function because lua_next raises an error
+	// for keys that are not in the table,
+	// which must not unwind through a Go function.
+	lua54.PushNextFunction(&l.state)
+	l.PushValue(UpvalueIndex(1))
+	l.PushNil()
+	return 3, nil
+}
+
+// frozenLen is the __len metamethod of the proxies
+// created by [FreezeGlobals].
+// It returns the raw length of the original table in its first upvalue.
+func frozenLen(l *State) (int, error) {
+	l.PushInteger(int64(l.RawLen(UpvalueIndex(1))))
+	return 1, nil
+}
+
+// frozenRawSet replaces rawset after [FreezeGlobals].
+// Its first upvalue is the set of proxies it refuses to modify
+// and its second upvalue is the original rawset function.
+func frozenRawSet(l *State) (int, error) {
+	l.PushValue(1)
+	if l.RawGet(UpvalueIndex(1)) != TypeNil {
+		return 0, NewArgError(l, 1, "read-only table")
+	}
+	l.Pop(1)
+	// The original rawset raises an error for nil and NaN keys,
+	// which must not unwind through a Go function.
+	nArgs := l.Top()
+	l.PushValue(UpvalueIndex(2))
+	l.Insert(1)
+	if err := l.Call(nArgs, MultipleReturns, 0); err != nil {
+		return 0, err
+	}
+	return l.Top(), nil
+}
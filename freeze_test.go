@@ -0,0 +1,107 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFreezeGlobals(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	state.PushInteger(1)
+	if err := state.SetGlobal("x", 0); err != nil {
+		t.Fatal(err)
+	}
+	state.CreateTable(2, 0)
+	state.PushString("a")
+	state.RawSetIndex(-2, 1)
+	state.PushString("b")
+	state.RawSetIndex(-2, 2)
+	if err := state.SetGlobal("seq", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := FreezeGlobals(state, "result"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		script  string
+		want    string
+		wantErr string
+	}{
+		{script: "return tostring(x + 1)", want: "2"},
+		{script: "return type(string.format)", want: "function"},
+		{script: "return tostring(_G == _ENV)", want: "true"},
+		{script: "result = 'ok'; return result", want: "ok"},
+		{script: "x = 2", wantErr: "read-only global 'x'"},
+		{script: "y = 2", wantErr: "read-only global 'y'"},
+		{script: "_G.print = nil", wantErr: "read-only global 'print'"},
+		{script: "setmetatable(_G, nil)", wantErr: "protected metatable"},
+		{script: "local n = 0; for k in pairs(_G) do if k == 'x' then n = n + 1 end end; return tostring(n)", want: "1"},
+		{script: "local f = pairs(_G); return f({}, 'nokey')", wantErr: "invalid key to 'next'"},
+		{script: "local f = pairs(_G); return f(nil)", wantErr: "table expected"},
+		{script: "rawset(_G, 'y', 2)", wantErr: "read-only table"},
+		{script: "rawset(string, 'format', print)", wantErr: "read-only table"},
+		{script: "local t = {}; rawset(t, 'k', 'v'); return t.k", want: "v"},
+		{script: "rawset({}, nil, 1)", wantErr: "index is nil"},
+		{script: "string.format = print", wantErr: "read-only field 'string.format'"},
+		{script: "string[1] = print", wantErr: "read-only table 'string'"},
+		{script: "setmetatable(math, nil)", wantErr: "protected metatable"},
+		{script: "return string.upper('x') .. ('y'):upper()", want: "XY"},
+		{script: "return tostring(getmetatable(''))", want: "false"},
+		{script: "return tostring(require('string') == string and package.loaded._G == _G)", want: "true"},
+		{script: "require('table').insert = nil", wantErr: "read-only field 'table.insert'"},
+		{script: "return table.concat(seq, ',') .. #seq", want: "a,b2"},
+		{script: "local n = 0; for k in pairs(math) do if k == 'pi' then n = n + 1 end end; return tostring(n)", want: "1"},
+	}
+	for _, test := range tests {
+		if err := state.LoadString(test.script, "=(load)", "t"); err != nil {
+			t.Errorf("%s: %v", test.script, err)
+			continue
+		}
+		err := state.Call(0, 1, 0)
+		switch {
+		case test.wantErr != "":
+			if err == nil {
+				t.Errorf("%s did not raise an error", test.script)
+			} else if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s raised %v; want %q", test.script, err, test.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", test.script, err)
+		default:
+			if got, _ := state.ToString(-1); got != test.want {
+				t.Errorf("%s = %q; want %q", test.script, got, test.want)
+			}
+		}
+		state.SetTop(0)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Group runs a collection of Lua tasks concurrently
+// on States borrowed from a [Pool],
+// in the manner of golang.org/x/sync/errgroup.
+// The first task to fail cancels the Group's context,
+// which interrupts any Lua code still running in the other tasks.
+//
+// A Group must be created with [NewGroup].
+type Group struct {
+	pool    *Pool
+	ownPool bool
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+// NewGroup returns a new Group whose tasks use States from pool
+// and a derived context that is canceled
+// the first time a task returns an error
+// or the first time [Group.Wait] returns, whichever occurs first.
+// If pool is nil, then the Group uses its own pool
+// that is shut down when [Group.Wait] returns.
+func NewGroup(ctx context.Context, pool *Pool) (*Group, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	g := &Group{
+		pool:   pool,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if g.pool == nil {
+		g.pool = new(Pool)
+		g.ownPool = true
+	}
+	return g, ctx
+}
+
+// Go calls f in a new goroutine with a State from the Group's pool.
+// Lua code that f runs in the State is interrupted with an error
+// once the context passed to f is done.
+// The State is returned to the pool after f returns,
+// so f must not retain it.
+//
+// The first call to return a non-nil error cancels the Group's context;
+// its error will be returned by [Group.Wait].
+func (g *Group) Go(f func(ctx context.Context, l *State) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := g.run(f); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				g.cancel(err)
+			})
+		}
+	}()
+}
+
+func (g *Group) run(f func(ctx context.Context, l *State) error) error {
+	if err := g.ctx.Err(); err != nil {
+		return context.Cause(g.ctx)
+	}
+	l, err := g.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer g.pool.Put(l)
+	unbind := g.pool.bindContext(l, g.ctx)
+	defer unbind()
+	return f(g.ctx, l)
+}
+
+// GoScript runs the given Lua source in a new goroutine
+// as with [Group.Go].
+// The source's return values are converted to Go values
+// (see [GroupResult.Values]) and stored in the returned GroupResult.
+func (g *Group) GoScript(source string, chunkName string) *GroupResult {
+	result := new(GroupResult)
+	g.Go(func(ctx context.Context, l *State) error {
+		base := l.Top()
+		if err := l.LoadString(source, chunkName, "t"); err != nil {
+			return fmt.Errorf("lua: group: %w", err)
+		}
+		if err := l.Call(0, MultipleReturns, 0); err != nil {
+			return fmt.Errorf("lua: group: %s: %w", chunkName, err)
+		}
+		values := make([]any, 0, l.Top()-base)
+		for i := base + 1; i <= l.Top(); i++ {
+			v, err := toAny(l, i, 0)
+			if err != nil {
+				return fmt.Errorf("lua: group: %s: result %d: %w", chunkName, i-base, err)
+			}
+			values = append(values, v)
+		}
+		result.values = values
+		return nil
+	})
+	return result
+}
+
+// Wait blocks until all tasks started with [Group.Go] or [Group.GoScript]
+// have returned, then returns the first non-nil error (if any) from them.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel(nil)
+	if g.ownPool {
+		g.pool.Shutdown(context.Background())
+	}
+	return g.err
+}
+
+// GroupResult holds the values returned by a script
+// started with [Group.GoScript].
+type GroupResult struct {
+	values []any
+}
+
+// Values returns the values returned by the script.
+// Values must only be called after [Group.Wait] has returned;
+// it returns nil if the script did not complete successfully.
+//
+// Lua values are converted as [Unmarshal] does for an empty interface.
+// Values that cannot be converted cause the task to fail.
+func (r *GroupResult) Values() []any {
+	return r.values
+}
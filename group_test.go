@@ -0,0 +1,89 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	t.Run("Results", func(t *testing.T) {
+		pool := new(Pool)
+		defer pool.Shutdown(context.Background())
+		g, _ := NewGroup(context.Background(), pool)
+		r1 := g.GoScript("return 1 + 2, 'x'", "=(one)")
+		r2 := g.GoScript("return {a = true, [1] = 1.5}", "=(two)")
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		got1 := r1.Values()
+		if len(got1) != 2 || got1[0] != int64(3) || got1[1] != "x" {
+			t.Errorf("r1.Values() = %#v; want []any{int64(3), \"x\"}", got1)
+		}
+		got2 := r2.Values()
+		if len(got2) != 1 {
+			t.Fatalf("r2.Values() = %#v; want 1 value", got2)
+		}
+		m, ok := got2[0].(map[any]any)
+		if !ok || len(m) != 2 || m["a"] != true || m[int64(1)] != 1.5 {
+			t.Errorf("r2.Values()[0] = %#v; want map[any]any{\"a\": true, int64(1): 1.5}", got2[0])
+		}
+	})
+
+	t.Run("CancelOnError", func(t *testing.T) {
+		g, ctx := NewGroup(context.Background(), nil)
+		looping := g.GoScript("while true do end", "=(loop)")
+		g.Go(func(ctx context.Context, l *State) error {
+			return errors.New("bork")
+		})
+
+		waitDone := make(chan error)
+		go func() { waitDone <- g.Wait() }()
+		select {
+		case err := <-waitDone:
+			if err == nil || err.Error() != "bork" {
+				t.Errorf("g.Wait() = %v; want bork", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("looping script not interrupted")
+		}
+		if ctx.Err() == nil {
+			t.Error("group context not canceled")
+		}
+		if got := looping.Values(); got != nil {
+			t.Errorf("looping.Values() = %#v; want nil", got)
+		}
+	})
+
+	t.Run("ScriptError", func(t *testing.T) {
+		g, _ := NewGroup(context.Background(), nil)
+		g.GoScript("error('oops')", "=(fail)")
+		if err := g.Wait(); err == nil || !strings.Contains(err.Error(), "oops") {
+			t.Errorf("g.Wait() = %v; want error containing oops", err)
+		}
+	})
+}
@@ -0,0 +1,218 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"sort"
+)
+
+// HostLibraryName is the conventional module name for the [HostLibrary].
+const HostLibraryName = "host"
+
+// hostCapabilities is the registry key of the table
+// that holds the capabilities declared by the [HostLibrary].
+const hostCapabilities = "zombiezen.com/go/lua.hostCapabilities"
+
+// Capabilities describes the environment that a State is embedded in.
+type Capabilities struct {
+	// Libraries is the sorted list of names of loaded modules
+	// (the keys of package.loaded).
+	Libraries []string
+	// Flags is the set of host-defined feature flags
+	// declared by the [HostLibrary].
+	Flags map[string]bool
+	// Limits is the set of host-defined limits
+	// declared by the [HostLibrary].
+	Limits map[string]int64
+
+	// Quota is the number of instructions remaining
+	// in the quota set by [State.SetQuota]
+	// or -1 if the state has no quota.
+	Quota int64
+	// MemoryLimit is the state's memory limit in bytes
+	// (see [State.MemoryLimit])
+	// or zero if the state has no limit.
+	MemoryLimit int64
+	// Sandbox is true if the state's libraries were opened by [OpenSandbox].
+	Sandbox bool
+	// BinaryChunks is true if the state loads binary chunks
+	// (see [State.SetAllowBinaryChunks]).
+	BinaryChunks bool
+}
+
+// HostLibrary is a library that lets scripts discover the capabilities
+// of the environment they are embedded in.
+// It provides a single function, host.capabilities(),
+// which returns a table with the following fields:
+//
+//   - libraries: a table whose keys are the names of loaded modules
+//     and whose values are true.
+//   - flags: a copy of the Flags field.
+//     The binarychunks flag is set to the BinaryChunks field of [Capabilities],
+//     and the sandbox flag is set to true if the state was opened with [OpenSandbox].
+//   - limits: a copy of the Limits field.
+//     If the state has a quota or memory limit,
+//     the instructions and memory limits are set
+//     to the Quota and MemoryLimit fields of [Capabilities].
+//   - version: the Lua version number (e.g. 504).
+//
+// The values reported for the state take precedence
+// over flags and limits of the same name declared by the host.
+type HostLibrary struct {
+	// Flags holds host-defined feature flags,
+	// such as whether the script is running in a sandbox.
+	Flags map[string]bool
+	// Limits holds host-defined limits in effect,
+	// such as a memory or instruction budget.
+	Limits map[string]int64
+}
+
+// OpenLibrary loads the host library.
+// This method is intended to be used as an argument to [Require].
+func (lib *HostLibrary) OpenLibrary(l *State) (int, error) {
+	l.CreateTable(0, 2)
+	l.CreateTable(0, len(lib.Flags))
+	for name, value := range lib.Flags {
+		l.PushBoolean(value)
+		l.RawSetField(-2, name)
+	}
+	l.RawSetField(-2, "flags")
+	l.CreateTable(0, len(lib.Limits))
+	for name, value := range lib.Limits {
+		l.PushInteger(value)
+		l.RawSetField(-2, name)
+	}
+	l.RawSetField(-2, "limits")
+	l.RawSetField(RegistryIndex, hostCapabilities)
+
+	err := NewLib(l, map[string]Function{
+		"capabilities": hostCapabilitiesFunction,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func hostCapabilitiesFunction(l *State) (int, error) {
+	c, err := l.Capabilities()
+	if err != nil {
+		return 0, err
+	}
+	l.CreateTable(0, 4)
+	l.CreateTable(0, len(c.Libraries))
+	for _, name := range c.Libraries {
+		l.PushBoolean(true)
+		l.RawSetField(-2, name)
+	}
+	l.RawSetField(-2, "libraries")
+	l.CreateTable(0, len(c.Flags)+2)
+	for name, value := range c.Flags {
+		l.PushBoolean(value)
+		l.RawSetField(-2, name)
+	}
+	if c.Sandbox {
+		l.PushBoolean(true)
+		l.RawSetField(-2, "sandbox")
+	}
+	l.PushBoolean(c.BinaryChunks)
+	l.RawSetField(-2, "binarychunks")
+	l.RawSetField(-2, "flags")
+	l.CreateTable(0, len(c.Limits)+2)
+	for name, value := range c.Limits {
+		l.PushInteger(value)
+		l.RawSetField(-2, name)
+	}
+	if c.Quota >= 0 {
+		l.PushInteger(c.Quota)
+		l.RawSetField(-2, "instructions")
+	}
+	if c.MemoryLimit > 0 {
+		l.PushInteger(c.MemoryLimit)
+		l.RawSetField(-2, "memory")
+	}
+	l.RawSetField(-2, "limits")
+	l.PushInteger(VersionNum)
+	l.RawSetField(-2, "version")
+	return 1, nil
+}
+
+// Capabilities reports the libraries loaded into the state,
+// the limits in force on the state,
+// and the flags and limits declared by the [HostLibrary], if it is loaded.
+func (l *State) Capabilities() (*Capabilities, error) {
+	if !l.CheckStack(3) {
+		return nil, fmt.Errorf("lua: capabilities: stack overflow")
+	}
+	c := &Capabilities{
+		Flags:        make(map[string]bool),
+		Limits:       make(map[string]int64),
+		Quota:        -1,
+		MemoryLimit:  l.MemoryLimit(),
+		BinaryChunks: l.AllowBinaryChunks(),
+	}
+	if remaining, ok := l.Quota(); ok {
+		c.Quota = remaining
+	}
+	c.Sandbox = l.RawField(RegistryIndex, sandboxRegistryKey) == TypeBoolean && l.ToBoolean(-1)
+	l.Pop(1)
+	if l.RawField(RegistryIndex, LoadedTable) == TypeTable {
+		l.PushNil()
+		for l.Next(-2) {
+			if l.Type(-2) == TypeString {
+				name, _ := l.ToString(-2)
+				c.Libraries = append(c.Libraries, name)
+			}
+			l.Pop(1)
+		}
+		sort.Strings(c.Libraries)
+	}
+	l.Pop(1)
+
+	if l.RawField(RegistryIndex, hostCapabilities) == TypeTable {
+		if l.RawField(-1, "flags") == TypeTable {
+			l.PushNil()
+			for l.Next(-2) {
+				if l.Type(-2) == TypeString {
+					name, _ := l.ToString(-2)
+					c.Flags[name] = l.ToBoolean(-1)
+				}
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+		if l.RawField(-1, "limits") == TypeTable {
+			l.PushNil()
+			for l.Next(-2) {
+				if l.Type(-2) == TypeString {
+					name, _ := l.ToString(-2)
+					c.Limits[name], _ = l.ToInteger(-1)
+				}
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+	}
+	l.Pop(1)
+	return c, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestHostLibrary(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(io.Discard, nil)); err != nil {
+		t.Fatal(err)
+	}
+	lib := &HostLibrary{
+		Flags:  map[string]bool{"sandbox": true},
+		Limits: map[string]int64{"memory": 1 << 20},
+	}
+	if err := Require(state, HostLibraryName, true, lib.OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	c, err := state.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{GName, HostLibraryName}; !slices.Equal(c.Libraries, want) {
+		t.Errorf("Libraries = %q; want %q", c.Libraries, want)
+	}
+	if !c.Flags["sandbox"] {
+		t.Errorf("Flags = %v; want sandbox = true", c.Flags)
+	}
+	if got := c.Limits["memory"]; got != 1<<20 {
+		t.Errorf("Limits[memory] = %d; want %d", got, 1<<20)
+	}
+	if c.Quota != -1 || c.MemoryLimit != 0 || c.Sandbox || !c.BinaryChunks {
+		t.Errorf("Quota, MemoryLimit, Sandbox, BinaryChunks = %d, %d, %t, %t; want -1, 0, false, true",
+			c.Quota, c.MemoryLimit, c.Sandbox, c.BinaryChunks)
+	}
+
+	const source = `local c = host.capabilities()` + "\n" +
+		`assert(c.libraries.host and c.libraries._G)` + "\n" +
+		`assert(not c.libraries.os)` + "\n" +
+		`assert(c.flags.sandbox == true)` + "\n" +
+		`assert(c.limits.memory == 1048576)` + "\n" +
+		`assert(c.version == 504)` + "\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCapabilitiesLimits(t *testing.T) {
+	state := NewStateWithLimit(64 << 20)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenSandbox(state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, HostLibraryName, true, new(HostLibrary).OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+	state.SetAllowBinaryChunks(false)
+	state.SetQuota(1_000_000)
+
+	c, err := state.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Quota != 1_000_000 {
+		t.Errorf("Quota = %d; want 1000000", c.Quota)
+	}
+	if c.MemoryLimit != 64<<20 {
+		t.Errorf("MemoryLimit = %d; want %d", c.MemoryLimit, 64<<20)
+	}
+	if !c.Sandbox {
+		t.Error("Sandbox = false; want true")
+	}
+	if c.BinaryChunks {
+		t.Error("BinaryChunks = true; want false")
+	}
+
+	const source = `local c = host.capabilities()` + "\n" +
+		`assert(c.flags.sandbox == true)` + "\n" +
+		`assert(c.flags.binarychunks == false)` + "\n" +
+		`assert(c.limits.memory == 64 * 1024 * 1024)` + "\n" +
+		`assert(c.limits.instructions > 0 and c.limits.instructions <= 1000000)` + "\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Error(err)
+	}
+}
@@ -39,6 +39,8 @@ type Reader struct {
 	err  error
 	// pos is the stream position of the beginning of buf.
 	pos int64
+	// canUnread is true if the last operation was a successful ReadByte.
+	canUnread bool
 }
 
 // NewReaderSize returns a new [Reader]
@@ -123,9 +125,21 @@ func (b *Reader) ReadByte() (byte, error) {
 	}
 	c := b.buf[b.r]
 	b.r++
+	b.canUnread = true
 	return c, nil
 }
 
+// UnreadByte unreads the last byte.
+// Only the byte returned by the most recent call to ReadByte can be unread.
+func (b *Reader) UnreadByte() error {
+	if !b.canUnread || b.r <= 0 {
+		return ErrInvalidUnreadByte
+	}
+	b.r--
+	b.canUnread = false
+	return nil
+}
+
 // Read reads data into p.
 // It returns the number of bytes read into p.
 // The bytes are taken from at most one Read on the underlying Reader,
@@ -134,6 +148,7 @@ func (b *Reader) ReadByte() (byte, error) {
 // If the underlying Reader can return a non-zero count with io.EOF,
 // then this Read method can do so as well; see the [io.Reader] docs.
 func (b *Reader) Read(p []byte) (n int, err error) {
+	b.canUnread = false
 	if len(p) == 0 {
 		if b.Buffered() > 0 {
 			return 0, nil
@@ -183,6 +198,7 @@ func (b *Reader) Read(p []byte) (n int, err error) {
 // Seek sets the offset for the next Read to offset, interpreted according to whence;
 // see the [io.Seeker] docs.
 func (b *Reader) Seek(offset int64, whence int) (pos int64, err error) {
+	b.canUnread = false
 	if whence == io.SeekCurrent {
 		if 0 <= offset && offset <= int64(b.Buffered()) {
 			if b.pos < 0 {
@@ -210,6 +226,7 @@ func (b *Reader) clear(pos int64) {
 	b.r = 0
 	b.w = 0
 	b.err = nil
+	b.canUnread = false
 }
 
 // Buffered returns the number of bytes that can be read from the current buffer.
@@ -246,6 +263,12 @@ func (b *ReadWriter) ReadByte() (byte, error) {
 	return b.r.ReadByte()
 }
 
+// UnreadByte unreads the last byte.
+// Only the byte returned by the most recent call to ReadByte can be unread.
+func (b *ReadWriter) UnreadByte() error {
+	return b.r.UnreadByte()
+}
+
 // Read reads data into p.
 // It returns the number of bytes read into p.
 // The bytes are taken from at most one Read on the underlying Reader,
@@ -309,4 +332,8 @@ func (b *ReadWriter) syncWritePosition() error {
 	return nil
 }
 
+// ErrInvalidUnreadByte is returned by UnreadByte
+// if the last operation was not a successful ReadByte.
+var ErrInvalidUnreadByte = errors.New("bufseek: invalid use of UnreadByte")
+
 var errNegativeRead = errors.New("bufseek: reader returned negative count from Read")
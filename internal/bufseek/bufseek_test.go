@@ -32,14 +32,14 @@ import (
 
 var _ interface {
 	io.Reader
-	io.ByteReader
+	io.ByteScanner
 	io.Seeker
 } = (*Reader)(nil)
 
 var _ interface {
 	io.Reader
 	io.Writer
-	io.ByteReader
+	io.ByteScanner
 	io.Seeker
 } = (*ReadWriter)(nil)
 
@@ -72,6 +72,31 @@ func TestReadByte(t *testing.T) {
 	}
 }
 
+func TestUnreadByte(t *testing.T) {
+	rd := NewReaderSize(bytes.NewReader([]byte("abc")), 16)
+	if err := rd.UnreadByte(); err != ErrInvalidUnreadByte {
+		t.Errorf("UnreadByte() before reading = %v; want %v", err, ErrInvalidUnreadByte)
+	}
+	if c, err := rd.ReadByte(); c != 'a' || err != nil {
+		t.Fatalf("ReadByte() = %q, %v; want 'a', <nil>", c, err)
+	}
+	if err := rd.UnreadByte(); err != nil {
+		t.Error("UnreadByte():", err)
+	}
+	if err := rd.UnreadByte(); err != ErrInvalidUnreadByte {
+		t.Errorf("second UnreadByte() = %v; want %v", err, ErrInvalidUnreadByte)
+	}
+	if c, err := rd.ReadByte(); c != 'a' || err != nil {
+		t.Errorf("ReadByte() after UnreadByte() = %q, %v; want 'a', <nil>", c, err)
+	}
+	if pos, err := rd.Seek(0, io.SeekCurrent); pos != 1 || err != nil {
+		t.Errorf("Seek(0, io.SeekCurrent) = %d, %v; want 1, <nil>", pos, err)
+	}
+	if err := rd.UnreadByte(); err != ErrInvalidUnreadByte {
+		t.Errorf("UnreadByte() after Seek = %v; want %v", err, ErrInvalidUnreadByte)
+	}
+}
+
 func TestReadWriter(t *testing.T) {
 	dir := t.TempDir()
 	f, err := os.Create(filepath.Join(dir, "foo.txt"))
@@ -22,8 +22,10 @@
 package lua54
 
 import (
+	"fmt"
 	"io"
 	"runtime/cgo"
+	"runtime/debug"
 	"unsafe"
 )
 
@@ -89,8 +91,12 @@ func zombiezen_lua_gocb(l *C.lua_State) C.int {
 	}
 
 	results, err := pcall(f, state)
+	if y, ok := err.(*yieldRequest); ok {
+		// Handled by trampoline.
+		return C.int(-2 - y.n)
+	}
 	if err != nil {
-		C.zombiezen_lua_pushstring(l, err.Error())
+		state.data().pushGoError(l, err)
 		return -1
 	}
 	if results < 0 {
@@ -110,3 +116,84 @@ func zombiezen_lua_gcfunc(l *C.lua_State) C.int {
 	}
 	return 0
 }
+
+//export zombiezen_lua_gcgoerror
+func zombiezen_lua_gcgoerror(l *C.lua_State) C.int {
+	state := stateForCallback(l)
+	delete(state.data().goErrors, copyUint64(state, 1))
+	return 0
+}
+
+//export zombiezen_lua_warncb
+func zombiezen_lua_warncb(ud unsafe.Pointer, msg *C.char, tocont C.int) {
+	data := cgo.Handle(ud).Value().(*stateData)
+	if data.warn != nil {
+		data.warn(C.GoString(msg), tocont != 0)
+	}
+}
+
+//export zombiezen_lua_hookcb
+func zombiezen_lua_hookcb(l *C.lua_State, ar *C.lua_Debug) C.int {
+	state := stateForCallback(l)
+	defer func() {
+		// Once the hook has finished, clear the State.
+		// This prevents incorrect usage, especially with ActivationRecords.
+		*state = State{}
+	}()
+	data := state.data()
+	event := int(ar.event)
+	n := int(C.lua_gethookcount(l))
+	if mask, count := hookSettings(data.hook(l), data.addedHooks); mask != int(C.lua_gethookmask(l)) || count != n {
+		// The thread's Lua hook was installed for hooks that have since changed.
+		data.installHook(l)
+	}
+	hooks := make([]*hookEntry, 0, 1+len(data.addedHooks))
+	if entry := data.hook(l); entry.wants(event, n) {
+		hooks = append(hooks, entry)
+	}
+	for _, entry := range data.addedHooks {
+		if entry.wants(event, n) {
+			hooks = append(hooks, entry)
+		}
+	}
+	var err error
+	for _, entry := range hooks {
+		if entry.f == nil {
+			// Removed by an earlier hook.
+			continue
+		}
+		err = pcallHook(entry.f, state, event, &ActivationRecord{
+			state: state,
+			lptr:  l,
+			ar:    ar,
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		state.data().pushGoError(l, err)
+		return 1
+	}
+	return 0
+}
+
+//export zombiezen_lua_panic
+func zombiezen_lua_panic(l *C.lua_State) C.int {
+	e := &PanicError{Message: "(no error object)"}
+	if C.lua_gettop(l) > 0 {
+		switch tp := C.lua_type(l, -1); tp {
+		case C.LUA_TSTRING:
+			var size C.size_t
+			p := C.lua_tolstring(l, -1, &size)
+			e.Message = C.GoStringN(p, C.int(size))
+		default:
+			e.Message = fmt.Sprintf("(error object is a %v value)", Type(tp))
+		}
+	}
+
+	// Lua resets the thread's call stack before calling the panic function,
+	// so the Go stack is the only context available.
+	e.Stack = debug.Stack()
+	panic(e)
+}
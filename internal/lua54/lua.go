@@ -22,9 +22,13 @@
 package lua54
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/bits"
 	"runtime/cgo"
 	"strings"
 	"unsafe"
@@ -39,20 +43,89 @@ import (
 // #include "lua.h"
 // #include "lauxlib.h"
 // #include "lualib.h"
+// #include "lstate.h"
 //
 // char *zombiezen_lua_readercb(lua_State *L, void *data, size_t *size);
 // int zombiezen_lua_writercb(lua_State *L, const void *p, size_t size, void *ud);
 // int zombiezen_lua_gocb(lua_State *L);
 // int zombiezen_lua_gcfunc(lua_State *L);
+// int zombiezen_lua_gcgoerror(lua_State *L);
+// void zombiezen_lua_warncb(void *ud, char *msg, int tocont);
+// int zombiezen_lua_hookcb(lua_State *L, lua_Debug *ar);
+// int zombiezen_lua_panic(lua_State *L);
+//
+// static int trampoline(lua_State *L);
+//
+// static int trampolinek(lua_State *L, int status, lua_KContext ctx) {
+//   return trampoline(L);
+// }
 //
 // static int trampoline(lua_State *L) {
 //   int nresults = zombiezen_lua_gocb(L);
-//   if (nresults < 0) {
+//   if (nresults == -1) {
 //     lua_error(L);
 //   }
+//   if (nresults < -1) {
+//     return lua_yieldk(L, -2 - nresults, 0, trampolinek);
+//   }
 //   return nresults;
 // }
 //
+// static int isgoclosure(lua_State *L, int index) {
+//   return lua_tocfunction(L, index) == trampoline;
+// }
+//
+// static uint64_t gofuncid(lua_State *L, int index) {
+//   if (!isgoclosure(L, index) || !lua_checkstack(L, 1)) {
+//     return 0;
+//   }
+//   lua_getupvalue(L, index, 1);
+//   const uint8_t *data = lua_touserdata(L, -1);
+//   uint64_t funcID = 0;
+//   if (data != NULL && lua_rawlen(L, -1) == 8) {
+//     for (int i = 0; i < 8; i++) {
+//       funcID |= (uint64_t)data[i] << (i * 8);
+//     }
+//   }
+//   lua_pop(L, 1);
+//   return funcID;
+// }
+//
+// static int noopclose(lua_State *L) {
+//   return 0;
+// }
+//
+// static int hasclosemethod(lua_State *L, int idx) {
+//   if (luaL_getmetafield(L, idx, "__close") == LUA_TNIL) {
+//     return 0;
+//   }
+//   lua_pop(L, 1);
+//   return 1;
+// }
+//
+// static int closeslot(lua_State *L, int idx, int msgh) {
+//   if (luaL_getmetafield(L, idx, "__close") == LUA_TNIL) {
+//     lua_pushnil(L);
+//   }
+//   lua_pushvalue(L, idx);
+//   lua_pushnil(L);
+//   int ret = lua_pcall(L, 2, 0, msgh);
+//
+//   // The __close metamethod has already run,
+//   // so replace the value with one whose __close cannot fail
+//   // before letting Lua remove the slot from its list.
+//   if (luaL_newmetatable(L, "zombiezen.com/go/lua.closedSlot")) {
+//     lua_pushcfunction(L, noopclose);
+//     lua_setfield(L, -2, "__close");
+//   }
+//   lua_newuserdatauv(L, 0, 0);
+//   lua_rotate(L, -2, 1);
+//   lua_setmetatable(L, -2);
+//   lua_replace(L, idx);
+//   lua_closeslot(L, idx);
+//   return ret;
+// }
+//
 // static void pushclosure(lua_State *L, uint64_t funcID, int n) {
 //   uint8_t *data = lua_newuserdatauv(L, 8, 0);
 //   data[0] = (uint8_t)funcID;
@@ -79,6 +152,79 @@ import (
 //   lua_pushlstring(L, _GoStringPtr(s), _GoStringLen(s));
 // }
 //
+// static const char goerrorname[] = "zombiezen.com/go/lua.GoError";
+//
+// static int goerrortostring(lua_State *L) {
+//   lua_getiuservalue(L, 1, 1);
+//   return 1;
+// }
+//
+// static int goerrorconcat(lua_State *L) {
+//   luaL_tolstring(L, 1, NULL);
+//   luaL_tolstring(L, 2, NULL);
+//   lua_concat(L, 2);
+//   return 1;
+// }
+//
+// static int goerrormethod(lua_State *L) {
+//   luaL_tolstring(L, 1, NULL);
+//   lua_replace(L, 1);
+//   lua_pushvalue(L, lua_upvalueindex(1));
+//   lua_insert(L, 1);
+//   lua_call(L, lua_gettop(L) - 1, LUA_MULTRET);
+//   return lua_gettop(L);
+// }
+//
+// static int goerrorindex(lua_State *L) {
+//   lua_pushliteral(L, "");
+//   if (luaL_getmetafield(L, -1, "__index") == LUA_TNIL) {
+//     return 0;
+//   }
+//   lua_pushvalue(L, 2);
+//   if (lua_gettable(L, -2) != LUA_TFUNCTION) {
+//     return 0;
+//   }
+//   lua_pushcclosure(L, goerrormethod, 1);
+//   return 1;
+// }
+//
+// static void pushgoerror(lua_State *L, _GoString_ msg, uint64_t errID) {
+//   uint8_t *data = lua_newuserdatauv(L, 8, 1);
+//   for (int i = 0; i < 8; i++) {
+//     data[i] = (uint8_t)(errID >> (i * 8));
+//   }
+//   lua_pushlstring(L, _GoStringPtr(msg), _GoStringLen(msg));
+//   lua_setiuservalue(L, -2, 1);
+//   if (luaL_newmetatable(L, goerrorname)) {
+//     lua_pushcfunction(L, zombiezen_lua_gcgoerror);
+//     lua_setfield(L, -2, "__gc");
+//     lua_pushcfunction(L, goerrortostring);
+//     lua_setfield(L, -2, "__tostring");
+//     lua_pushcfunction(L, goerrorconcat);
+//     lua_setfield(L, -2, "__concat");
+//     lua_pushcfunction(L, goerrorindex);
+//     lua_setfield(L, -2, "__index");
+//     lua_pushboolean(L, 0);
+//     lua_setfield(L, -2, "__metatable");
+//   }
+//   lua_setmetatable(L, -2);
+// }
+//
+// static uint64_t goerrorid(lua_State *L, int idx) {
+//   if (!lua_checkstack(L, 2)) {
+//     return 0;
+//   }
+//   const uint8_t *data = luaL_testudata(L, idx, goerrorname);
+//   if (data == NULL) {
+//     return 0;
+//   }
+//   uint64_t errID = 0;
+//   for (int i = 0; i < 8; i++) {
+//     errID |= (uint64_t)data[i] << (i * 8);
+//   }
+//   return errID;
+// }
+//
 // const char *zombiezen_lua_reader(lua_State *L, void *data, size_t *size) {
 //   const char *p = zombiezen_lua_readercb(L, data, size);
 //   if (p == NULL) {
@@ -144,6 +290,14 @@ import (
 //   lua_pushlightuserdata(L, (void *)p);
 // }
 //
+// static int rawgetp(lua_State *L, int idx, uintptr_t p) {
+//   return lua_rawgetp(L, idx, (const void *)p);
+// }
+//
+// static void rawsetp(lua_State *L, int idx, uintptr_t p) {
+//   lua_rawsetp(L, idx, (const void *)p);
+// }
+//
 // static int lencb(lua_State *L) {
 //   lua_len(L, 1);
 //   return 1;
@@ -153,6 +307,20 @@ import (
 //   lua_pushcfunction(L, lencb);
 // }
 //
+// static int nextcb(lua_State *L) {
+//   luaL_checktype(L, 1, LUA_TTABLE);
+//   lua_settop(L, 2);
+//   if (lua_next(L, 1)) {
+//     return 2;
+//   }
+//   lua_pushnil(L);
+//   return 1;
+// }
+//
+// static void pushnextfunction(lua_State *L) {
+//   lua_pushcfunction(L, nextcb);
+// }
+//
 // static void *newuserdata(lua_State *L, size_t size, int nuvalue) {
 //   void *ptr = lua_newuserdatauv(L, size, nuvalue);
 //   memset(ptr, 0, size);
@@ -166,20 +334,205 @@ import (
 //   return (size_t)lua_rawlen(L, index);
 // }
 //
+// typedef struct {
+//   size_t used;
+//   size_t limit;
+//   size_t peak;
+//   uint64_t allocs;
+//   uint64_t frees;
+//   uint64_t total;
+//   uint64_t collections;
+// } memlimit;
+//
+// static void *limitedalloc(void *ud, void *ptr, size_t osize, size_t nsize) {
+//   memlimit *m = (memlimit *)ud;
+//   if (ptr == NULL) {
+//     osize = 0;
+//   }
+//   if (nsize == 0) {
+//     if (ptr != NULL) {
+//       free(ptr);
+//       m->used -= osize;
+//       m->frees++;
+//     }
+//     return NULL;
+//   }
+//   if (m->limit != 0 && nsize > osize &&
+//       (m->used > m->limit || nsize - osize > m->limit - m->used)) {
+//     return NULL;
+//   }
+//   void *newptr = realloc(ptr, nsize);
+//   if (newptr == NULL) {
+//     return NULL;
+//   }
+//   m->used = m->used - osize + nsize;
+//   if (nsize > osize) {
+//     m->total += nsize - osize;
+//   }
+//   if (m->used > m->peak) {
+//     m->peak = m->used;
+//   }
+//   if (ptr == NULL) {
+//     m->allocs++;
+//   }
+//   return newptr;
+// }
+//
+// static memlimit *getmemlimit(lua_State *L) {
+//   void *ud = NULL;
+//   lua_getallocf(L, &ud);
+//   return (memlimit *)ud;
+// }
+//
+// // gcsentinel is the finalizer of an otherwise unreferenced userdata.
+// // It counts a garbage collection cycle
+// // and creates a new sentinel for the next cycle.
+// // Once lua_close starts, the new sentinel is not finalized.
+// static int gcsentinel(lua_State *L) {
+//   getmemlimit(L)->collections++;
+//   lua_newuserdatauv(L, 0, 0);
+//   lua_getmetatable(L, 1);
+//   lua_setmetatable(L, -2);
+//   return 0;
+// }
+//
+// static char errorvalueskey;
+// static char tracebackkey;
+//
 // static lua_State *newstate(uintptr_t id) {
-//   lua_State *L = luaL_newstate();
+//   memlimit *m = calloc(1, sizeof(memlimit));
+//   if (m == NULL) {
+//     return NULL;
+//   }
+//   lua_State *L = lua_newstate(limitedalloc, m);
 //   if (L == NULL) {
+//     free(m);
 //     return NULL;
 //   }
 //   lua_setwarnf(L, NULL, NULL);
+//   lua_atpanic(L, zombiezen_lua_panic);
 //   *(uintptr_t *)(lua_getextraspace(L)) = id;
+//   lua_newtable(L);
+//   lua_rawsetp(L, LUA_REGISTRYINDEX, &errorvalueskey);
+//   lua_newuserdatauv(L, 0, 0);
+//   lua_createtable(L, 0, 1);
+//   lua_pushcfunction(L, gcsentinel);
+//   lua_setfield(L, -2, "__gc");
+//   lua_setmetatable(L, -2);
+//   lua_pop(L, 1);
 //   return L;
 // }
 //
+// static int saveerrorvaluecb(lua_State *L) {
+//   lua_pushinteger(L, luaL_ref(L, 1));
+//   return 1;
+// }
+//
+// // saveerrorvalue saves a copy of the value on the top of the stack
+// // in the error values table and returns its reference,
+// // or LUA_NOREF if the value could not be saved.
+// static int saveerrorvalue(lua_State *L) {
+//   if (!lua_checkstack(L, 3)) {
+//     return LUA_NOREF;
+//   }
+//   lua_pushcfunction(L, saveerrorvaluecb);
+//   lua_rawgetp(L, LUA_REGISTRYINDEX, &errorvalueskey);
+//   lua_pushvalue(L, -3);
+//   if (lua_pcall(L, 2, 1, 0) != LUA_OK) {
+//     lua_pop(L, 1);
+//     return LUA_NOREF;
+//   }
+//   int ref = (int)lua_tointeger(L, -1);
+//   lua_pop(L, 1);
+//   return ref;
+// }
+//
+// static void pusherrorvalue(lua_State *L, int ref) {
+//   lua_rawgetp(L, LUA_REGISTRYINDEX, &errorvalueskey);
+//   lua_rawgeti(L, -1, ref);
+//   lua_remove(L, -2);
+// }
+//
+// static void releaseerrorvalue(lua_State *L, int ref) {
+//   if (!lua_checkstack(L, 1)) {
+//     return;
+//   }
+//   lua_rawgetp(L, LUA_REGISTRYINDEX, &errorvalueskey);
+//   luaL_unref(L, -1, ref);
+//   lua_pop(L, 1);
+// }
+//
+// static int capturetraceback(lua_State *L) {
+//   luaL_traceback(L, L, NULL, 1);
+//   lua_rawsetp(L, LUA_REGISTRYINDEX, &tracebackkey);
+//   return 1;
+// }
+//
+// static void pushcapturetraceback(lua_State *L) {
+//   lua_pushnil(L);
+//   lua_rawsetp(L, LUA_REGISTRYINDEX, &tracebackkey);
+//   lua_pushcfunction(L, capturetraceback);
+// }
+//
+// static const char *gettraceback(lua_State *L, size_t *len) {
+//   const char *s = NULL;
+//   if (lua_rawgetp(L, LUA_REGISTRYINDEX, &tracebackkey) == LUA_TSTRING) {
+//     s = lua_tolstring(L, -1, len);
+//   }
+//   lua_pop(L, 1);
+//   return s;
+// }
+//
 // static uintptr_t stateid(lua_State *L) {
 //   return *(uintptr_t *)(lua_getextraspace(L));
 // }
 //
+// static void warncb(void *ud, const char *msg, int tocont) {
+//   zombiezen_lua_warncb(ud, (char *)msg, tocont);
+// }
+//
+// static void setwarnf(lua_State *L, int on) {
+//   if (on) {
+//     lua_setwarnf(L, warncb, (void *)stateid(L));
+//   } else {
+//     lua_setwarnf(L, NULL, NULL);
+//   }
+// }
+//
+// static void warning(lua_State *L, _GoString_ msg, int tocont) {
+//   lua_pushlstring(L, _GoStringPtr(msg), _GoStringLen(msg));
+//   lua_warning(L, lua_tostring(L, -1), tocont);
+//   lua_pop(L, 1);
+// }
+//
+// static void hooktrampoline(lua_State *L, lua_Debug *ar) {
+//   if (zombiezen_lua_hookcb(L, ar)) {
+//     lua_error(L);
+//   }
+// }
+//
+// static void sethook(lua_State *L, int mask, int count) {
+//   lua_sethook(L, mask != 0 ? hooktrampoline : NULL, mask, count);
+// }
+//
+// static void *nextthread(lua_State *L, void *prev) {
+//   GCObject *o = prev == NULL ? G(L)->allgc : ((lua_State *)prev)->next;
+//   while (o != NULL && o->tt != LUA_VTHREAD) {
+//     o = o->next;
+//   }
+//   return o == NULL ? NULL : gco2th(o);
+// }
+//
+// static lua_State *mainthread(lua_State *L) {
+//   if (!lua_checkstack(L, 1)) {
+//     return NULL;
+//   }
+//   lua_rawgeti(L, LUA_REGISTRYINDEX, LUA_RIDX_MAINTHREAD);
+//   lua_State *main = lua_tothread(L, -1);
+//   lua_pop(L, 1);
+//   return main;
+// }
+//
 // static int gcniladic(lua_State *L, int what) {
 //   return lua_gc(L, what);
 // }
@@ -209,6 +562,8 @@ const (
 	Release   = C.LUA_RELEASE
 	Copyright = C.LUA_COPYRIGHT
 	Authors   = C.LUA_AUTHORS
+
+	PathDefault = C.LUA_PATH_DEFAULT
 )
 
 const RegistryIndex int = C.LUA_REGISTRYINDEX
@@ -268,11 +623,161 @@ type State struct {
 	top  int
 	cap  int
 	main bool
+	// tbc is the list of absolute stack indices
+	// that have been marked as to-be-closed by ToClose
+	// in ascending order.
+	tbc []int
 }
 
 type stateData struct {
 	nextID   uint64
 	closures map[uint64]Function
+	warn     func(msg string, toBeContinued bool)
+
+	// mainThread is the address of the main thread's lua_State.
+	mainThread uintptr
+	// hooks is the set of hook functions set with SetHook
+	// keyed by lua_State address.
+	hooks map[uintptr]*hookEntry
+	// addedHooks is the list of hooks added with AddHook
+	// in the order they were added.
+	// Unlike hooks, they apply to every thread.
+	addedHooks []*hookEntry
+	nextHookID uint64
+	// syncedMask and syncedCount are a Lua hook mask and count
+	// that every thread's Lua hook is known to deliver events for.
+	// They always cover the events requested by addedHooks.
+	syncedMask  int
+	syncedCount int
+	// handles is the set of handles created by NewHandle
+	// that have not been passed to DeleteHandle.
+	handles map[cgo.Handle]struct{}
+	// lastGoError is the most recent Go error raised as a string
+	// along with the string it was raised as.
+	lastGoError     error
+	lastGoErrorText string
+	// goErrors maps the IDs of the error objects raised for Go errors
+	// with CaptureGoError to the original errors.
+	// Entries are removed when the error object is garbage collected.
+	goErrors map[uint64]error
+
+	// errorValues maps the IDs of ValueRefs that have not been released
+	// to their references in the error values table.
+	errorValues map[uint64]C.int
+	// capture is the set of ErrorCapture flags set with SetErrorCapture.
+	capture int
+
+	// forbidBinary is true if loading binary chunks has been disabled
+	// with SetAllowBinaryChunks.
+	forbidBinary bool
+}
+
+// Flags for SetErrorCapture.
+const (
+	CaptureTraceback = 1 << iota
+	CaptureValue
+	CaptureGoError
+)
+
+// pushGoError pushes the error object raised for the Go error err.
+// By default, the error object is err's message
+// and the state remembers err as the Go error for that string
+// until the next error is raised by Go or returned to Go.
+// If CaptureGoError is set, errors other than [MessageError]
+// are instead raised as a userdata
+// that converts to err's message with tostring
+// and that lets the Go code that catches it recover err.
+func (data *stateData) pushGoError(l *C.lua_State, err error) {
+	if _, isMessage := err.(MessageError); isMessage || data.capture&CaptureGoError == 0 {
+		msg := err.Error()
+		data.lastGoError = err
+		data.lastGoErrorText = msg
+		C.zombiezen_lua_pushstring(l, msg)
+		return
+	}
+	data.lastGoError = nil
+	data.lastGoErrorText = ""
+	errID := data.nextID
+	if errID == 0 {
+		panic("ID wrap-around")
+	}
+	data.nextID++
+	if data.goErrors == nil {
+		data.goErrors = make(map[uint64]error)
+	}
+	data.goErrors[errID] = err
+	C.pushgoerror(l, err.Error(), C.uint64_t(errID))
+}
+
+// MessageError is an error that a Go function raises in Lua as a plain string
+// even if CaptureGoError is set,
+// like the errors raised by Lua's C libraries.
+type MessageError struct {
+	Err error
+}
+
+// Error returns the message.
+func (e MessageError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e MessageError) Unwrap() error {
+	return e.Err
+}
+
+// goError returns the Go error for the error object at the given index
+// or nil if the value is not an error object pushed by pushGoError.
+func (l *State) goError(idx int) error {
+	errID := C.goerrorid(l.ptr, C.int(idx))
+	if errID == 0 {
+		return nil
+	}
+	return l.data().goErrors[uint64(errID)]
+}
+
+// hookEntry is a hook function
+// along with the events it was requested for.
+type hookEntry struct {
+	f    Hook
+	orig any
+	mask int
+	// count is the number of instructions between count events.
+	// pending is the number of instructions run
+	// since the hook's last count event.
+	count   int
+	pending int
+	// id is the identifier returned by AddHook
+	// or zero for hooks set with SetHook.
+	id uint64
+}
+
+// wants reports whether the hook should be called for the given event.
+// For count events, wants adds n instructions to the hook's pending count.
+func (entry *hookEntry) wants(event int, n int) bool {
+	if entry == nil || entry.f == nil {
+		return false
+	}
+	switch event {
+	case HookCall, HookTailCall:
+		return entry.mask&MaskCall != 0
+	case HookReturn:
+		return entry.mask&MaskReturn != 0
+	case HookLine:
+		return entry.mask&MaskLine != 0
+	case HookCount:
+		if entry.mask&MaskCount == 0 || entry.count <= 0 {
+			return false
+		}
+		entry.pending += n
+		if entry.pending < entry.count {
+			return false
+		}
+		entry.pending %= entry.count
+		return true
+	default:
+		return false
+	}
 }
 
 // stateForCallback returns a new State for the given *lua_State.
@@ -289,14 +794,17 @@ func stateForCallback(ptr *C.lua_State) *State {
 
 func (l *State) init() {
 	if l.ptr == nil {
-		data := cgo.NewHandle(&stateData{
+		data := &stateData{
 			nextID:   1,
 			closures: make(map[uint64]Function),
-		})
-		l.ptr = C.newstate(C.uintptr_t(data))
-		if l == nil {
+		}
+		handle := cgo.NewHandle(data)
+		l.ptr = C.newstate(C.uintptr_t(handle))
+		if l.ptr == nil {
+			handle.Delete()
 			panic("could not allocate memory for new state")
 		}
+		data.mainThread = uintptr(unsafe.Pointer(l.ptr))
 		l.top = 0
 		l.cap = C.LUA_MINSTACK
 		l.main = true
@@ -308,14 +816,443 @@ func (l *State) Close() error {
 		if !l.main {
 			return errors.New("lua: cannot close non-main thread")
 		}
-		data := cgo.Handle(C.stateid(l.ptr))
+		handle := cgo.Handle(C.stateid(l.ptr))
+		m := C.getmemlimit(l.ptr)
 		C.lua_close(l.ptr)
-		data.Delete()
+		C.free(unsafe.Pointer(m))
+		data := handle.Value().(*stateData)
+		handle.Delete()
 		*l = State{}
+
+		// lua_close runs all pending finalizers,
+		// so anything left over was never released.
+		leaked := len(data.closures) + len(data.handles)
+		for h := range data.handles {
+			h.Delete()
+		}
+		if leaked > 0 {
+			return fmt.Errorf("lua: %d Go values leaked by state", leaked)
+		}
 	}
 	return nil
 }
 
+// SetMemoryLimit sets the maximum number of bytes
+// that the state may have allocated at once.
+// Zero means no limit.
+func (l *State) SetMemoryLimit(limit uint64) {
+	l.init()
+	C.getmemlimit(l.ptr).limit = C.size_t(min(limit, uint64(^C.size_t(0))))
+}
+
+// MemoryLimit returns the limit set with SetMemoryLimit
+// or zero if the state has no limit.
+func (l *State) MemoryLimit() uint64 {
+	if l.ptr == nil {
+		return 0
+	}
+	return uint64(C.getmemlimit(l.ptr).limit)
+}
+
+// MemoryStats is a snapshot of a state's memory allocator counters.
+type MemoryStats struct {
+	// InUse is the number of bytes currently allocated by the state.
+	InUse uint64
+	// Peak is the largest value InUse has had.
+	Peak uint64
+	// Allocs is the cumulative number of memory blocks allocated.
+	Allocs uint64
+	// Frees is the cumulative number of memory blocks freed.
+	Frees uint64
+	// TotalAlloc is the cumulative number of bytes allocated.
+	// Growing a block counts the added bytes.
+	TotalAlloc uint64
+	// Collections is the number of garbage collection cycles
+	// that have completed.
+	Collections uint64
+}
+
+func (l *State) MemoryStats() MemoryStats {
+	if l.ptr == nil {
+		return MemoryStats{}
+	}
+	m := C.getmemlimit(l.ptr)
+	return MemoryStats{
+		InUse:       uint64(m.used),
+		Peak:        uint64(m.peak),
+		Allocs:      uint64(m.allocs),
+		Frees:       uint64(m.frees),
+		TotalAlloc:  uint64(m.total),
+		Collections: uint64(m.collections),
+	}
+}
+
+// NewHandle returns a new [cgo.Handle] for v
+// that is tracked by the state until it is passed to [State.DeleteHandle].
+func (l *State) NewHandle(v any) cgo.Handle {
+	l.init()
+	data := l.data()
+	h := cgo.NewHandle(v)
+	if data.handles == nil {
+		data.handles = make(map[cgo.Handle]struct{})
+	}
+	data.handles[h] = struct{}{}
+	return h
+}
+
+// DeleteHandle deletes a handle returned by [State.NewHandle].
+func (l *State) DeleteHandle(h cgo.Handle) {
+	delete(l.data().handles, h)
+	h.Delete()
+}
+
+// HandleCount returns the number of Go closures and handles
+// that are currently held by the state.
+func (l *State) HandleCount() int {
+	if l.ptr == nil {
+		return 0
+	}
+	data := l.data()
+	return len(data.closures) + len(data.handles)
+}
+
+// Thread status codes.
+const (
+	StatusOK           = C.LUA_OK
+	StatusYield        = C.LUA_YIELD
+	StatusRuntimeError = C.LUA_ERRRUN
+	StatusSyntaxError  = C.LUA_ERRSYNTAX
+	StatusMemoryError  = C.LUA_ERRMEM
+	StatusHandlerError = C.LUA_ERRERR
+)
+
+func (l *State) NewThread() *State {
+	l.init()
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	ptr := C.lua_newthread(l.ptr)
+	l.top++
+	return &State{
+		ptr: ptr,
+		cap: C.LUA_MINSTACK,
+	}
+}
+
+func (l *State) PushThread() bool {
+	l.init()
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	isMain := C.lua_pushthread(l.ptr) != 0
+	l.top++
+	return isMain
+}
+
+func (l *State) ToThread(idx int) *State {
+	if l.ptr == nil {
+		return nil
+	}
+	l.checkAcceptableIndex(idx)
+	ptr := C.lua_tothread(l.ptr, C.int(idx))
+	if ptr == nil {
+		return nil
+	}
+	if ptr == l.ptr {
+		return l
+	}
+	t := &State{
+		ptr: ptr,
+		top: int(C.lua_gettop(ptr)),
+	}
+	t.cap = t.top
+	if C.lua_checkstack(ptr, C.LUA_MINSTACK) != 0 {
+		t.cap += C.LUA_MINSTACK
+	}
+	return t
+}
+
+func (l *State) Status() int {
+	if l.ptr == nil {
+		return StatusOK
+	}
+	return int(C.lua_status(l.ptr))
+}
+
+func (l *State) Resume(from *State, nArgs int) (nResults int, yielded bool, err error) {
+	if nArgs < 0 {
+		panic("negative arguments")
+	}
+	// lua_resume reports invalid resumes (like resuming a dead coroutine)
+	// as errors, so only the stack needs checking.
+	l.checkElems(nArgs)
+	var fromPtr *C.lua_State
+	if from != nil {
+		fromPtr = from.ptr
+	}
+	var nres C.int
+	ret := C.lua_resume(l.ptr, fromPtr, C.int(nArgs), &nres)
+	l.top = int(C.lua_gettop(l.ptr))
+	l.cap = max(l.cap, l.top)
+	l.tbc = nil
+	switch ret {
+	case C.LUA_OK:
+		return int(nres), false, nil
+	case C.LUA_YIELD:
+		return int(nres), true, nil
+	default:
+		return 0, false, l.newError(ret)
+	}
+}
+
+func (l *State) ResetThread() error {
+	if l.ptr == nil {
+		return nil
+	}
+	if uintptr(unsafe.Pointer(l.ptr)) == l.data().mainThread {
+		panic("cannot reset main thread")
+	}
+	ret := C.lua_closethread(l.ptr, nil)
+	l.top = int(C.lua_gettop(l.ptr))
+	l.cap = max(l.cap, l.top)
+	l.tbc = nil
+	if ret != C.LUA_OK {
+		return l.newError(ret)
+	}
+	return nil
+}
+
+func (l *State) Version() float64 {
+	l.init()
+	return float64(C.lua_version(l.ptr))
+}
+
+func (l *State) SetWarnHandler(f func(msg string, toBeContinued bool)) {
+	l.init()
+	l.data().warn = f
+	on := C.int(0)
+	if f != nil {
+		on = 1
+	}
+	C.setwarnf(l.ptr, on)
+}
+
+func (l *State) Warning(msg string, toBeContinued bool) {
+	l.init()
+	if !l.CheckStack(1) {
+		panic("stack overflow")
+	}
+	tocont := C.int(0)
+	if toBeContinued {
+		tocont = 1
+	}
+	C.warning(l.ptr, msg, tocont)
+}
+
+const (
+	HookCall     int = C.LUA_HOOKCALL
+	HookReturn   int = C.LUA_HOOKRET
+	HookLine     int = C.LUA_HOOKLINE
+	HookCount    int = C.LUA_HOOKCOUNT
+	HookTailCall int = C.LUA_HOOKTAILCALL
+)
+
+const (
+	MaskCall   int = C.LUA_MASKCALL
+	MaskReturn int = C.LUA_MASKRET
+	MaskLine   int = C.LUA_MASKLINE
+	MaskCount  int = C.LUA_MASKCOUNT
+)
+
+// Hook is a function that is called by the Lua interpreter
+// on the events selected by [State.SetHook].
+type Hook = func(l *State, event int, ar *ActivationRecord) error
+
+// SetHook sets the debugging hook function for the thread.
+// orig is an arbitrary value that is returned from [State.Hook]
+// to identify the hook.
+// SetHook does not affect hooks added with [State.AddHook].
+func (l *State) SetHook(f Hook, orig any, mask int, count int) {
+	l.init()
+	data := l.data()
+	key := uintptr(unsafe.Pointer(l.ptr))
+	switch {
+	case f != nil && mask != 0:
+		if data.hooks == nil {
+			data.hooks = make(map[uintptr]*hookEntry)
+		}
+		data.hooks[key] = &hookEntry{f: f, orig: orig, mask: mask, count: count}
+	case key == data.mainThread:
+		delete(data.hooks, key)
+	default:
+		// Record that the thread no longer uses the main thread's hook.
+		if data.hooks == nil {
+			data.hooks = make(map[uintptr]*hookEntry)
+		}
+		data.hooks[key] = new(hookEntry)
+	}
+	if key == data.mainThread {
+		// Threads without their own hook use the main thread's hook.
+		l.installAllHooks()
+	} else {
+		data.installHook(l.ptr)
+	}
+}
+
+// Hook returns the orig value passed to [State.SetHook]
+// along with its hook mask and count.
+func (l *State) Hook() (orig any, mask int, count int) {
+	if l.ptr == nil {
+		return nil, 0, 0
+	}
+	entry := l.data().hook(l.ptr)
+	if entry == nil || entry.f == nil {
+		return nil, 0, 0
+	}
+	return entry.orig, entry.mask, entry.count
+}
+
+// AddHook adds a hook function that is called for the events in mask
+// in addition to the hook set by [State.SetHook]
+// and the other hooks added with AddHook.
+// AddHook returns an identifier for the hook
+// that can be passed to [State.UpdateHook] and [State.RemoveHook].
+func (l *State) AddHook(f Hook, mask int, count int) uint64 {
+	if f == nil {
+		panic("nil Hook")
+	}
+	l.init()
+	data := l.data()
+	data.nextHookID++
+	id := data.nextHookID
+	data.addedHooks = append(data.addedHooks, &hookEntry{
+		f:     f,
+		mask:  mask,
+		count: count,
+		id:    id,
+	})
+	l.updateAddedHooks()
+	return id
+}
+
+// UpdateHook changes the events that a hook added with [State.AddHook] is called for.
+// UpdateHook does nothing if the hook has been removed.
+func (l *State) UpdateHook(id uint64, mask int, count int) {
+	l.init()
+	for _, entry := range l.data().addedHooks {
+		if entry.id == id {
+			entry.mask = mask
+			if entry.count != count {
+				entry.count = count
+				entry.pending = 0
+			}
+			l.updateAddedHooks()
+			return
+		}
+	}
+}
+
+// RemoveHook removes a hook added with [State.AddHook].
+// RemoveHook does nothing if the hook has already been removed.
+func (l *State) RemoveHook(id uint64) {
+	l.init()
+	data := l.data()
+	for i, entry := range data.addedHooks {
+		if entry.id == id {
+			// Prevent a call in progress from calling the hook.
+			entry.f = nil
+			data.addedHooks = append(data.addedHooks[:i:i], data.addedHooks[i+1:]...)
+			l.updateAddedHooks()
+			return
+		}
+	}
+}
+
+// updateAddedHooks installs the Lua hook on every thread
+// if the threads do not already deliver the events requested by the added hooks.
+// Threads whose Lua hook delivers more events than needed
+// are updated by the hook callback the next time it is called for them.
+func (l *State) updateAddedHooks() {
+	data := l.data()
+	mask, count := hookSettings(nil, data.addedHooks)
+	if !hookCovers(data.syncedMask, data.syncedCount, mask, count) {
+		l.installAllHooks()
+	}
+}
+
+// installAllHooks sets the Lua hook of every thread in the state
+// to deliver the events requested by the thread's hook and the added hooks.
+// Threads created afterward inherit the Lua hook of their creator.
+func (l *State) installAllHooks() {
+	data := l.data()
+	for t := C.nextthread(l.ptr, nil); t != nil; t = C.nextthread(l.ptr, t) {
+		data.setHook((*C.lua_State)(t))
+	}
+	if main := C.mainthread(l.ptr); main != nil {
+		data.setHook(main)
+	}
+	data.syncedMask, data.syncedCount = hookSettings(nil, data.addedHooks)
+}
+
+// installHook sets the Lua hook of the given thread
+// to deliver the events requested by the thread's hook and the added hooks.
+func (data *stateData) installHook(ptr *C.lua_State) {
+	data.setHook(ptr)
+	// The thread may now deliver fewer events than before,
+	// but it still delivers the events requested by the added hooks.
+	data.syncedMask, data.syncedCount = hookSettings(nil, data.addedHooks)
+}
+
+func (data *stateData) setHook(ptr *C.lua_State) {
+	mask, count := hookSettings(data.hook(ptr), data.addedHooks)
+	C.sethook(ptr, C.int(mask), C.int(count))
+}
+
+// hookSettings returns the Lua hook mask and count
+// that deliver the events requested by entry and added.
+func hookSettings(entry *hookEntry, added []*hookEntry) (mask, count int) {
+	addMask := func(entry *hookEntry) {
+		if entry == nil || entry.f == nil {
+			return
+		}
+		m := entry.mask
+		if m&MaskCount != 0 {
+			if entry.count > 0 && (count == 0 || entry.count < count) {
+				count = entry.count
+			}
+			if entry.count <= 0 {
+				m &^= MaskCount
+			}
+		}
+		mask |= m
+	}
+	addMask(entry)
+	for _, entry := range added {
+		addMask(entry)
+	}
+	return mask, count
+}
+
+// hookCovers reports whether a Lua hook with the mask and count haveMask and haveCount
+// delivers the events needed by a Lua hook with the given mask and count.
+func hookCovers(haveMask, haveCount, mask, count int) bool {
+	if mask&^haveMask != 0 {
+		return false
+	}
+	return mask&MaskCount == 0 || haveCount <= count
+}
+
+// hook returns the hook set with SetHook for the given thread.
+// Threads created by Lua inherit their hook from the creating thread,
+// so if the thread does not have its own hook entry,
+// hook returns the main thread's hook.
+func (data *stateData) hook(ptr *C.lua_State) *hookEntry {
+	if entry, ok := data.hooks[uintptr(unsafe.Pointer(ptr))]; ok {
+		return entry
+	}
+	return data.hooks[data.mainThread]
+}
+
 // data returns the interpreter-wide data.
 func (l *State) data() *stateData {
 	return cgo.Handle(C.stateid(l.ptr)).Value().(*stateData)
@@ -326,7 +1263,7 @@ func (l *State) AbsIndex(idx int) int {
 	case isPseudo(idx):
 		return idx
 	case idx == 0 || idx < -l.top || idx > l.cap:
-		panic("unacceptable index")
+		panic(&IndexError{Index: idx, Reason: "unacceptable index"})
 	case idx < 0:
 		return l.top + idx + 1
 	default:
@@ -352,6 +1289,44 @@ func (l *State) isAcceptableIndex(idx int) bool {
 	return l.isValidIndex(idx) || l.top <= idx && idx <= l.cap
 }
 
+// IndexError is the panic value used when a State method
+// is given an invalid or unacceptable stack index.
+type IndexError struct {
+	// Index is the index that was passed to the method.
+	Index int
+	// Reason describes why the index was rejected.
+	Reason string
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("lua: %s %d", e.Reason, e.Index)
+}
+
+// CheckAcceptableIndex returns an *IndexError
+// if idx is not an acceptable index.
+func (l *State) CheckAcceptableIndex(idx int) error {
+	if !l.isAcceptableIndex(idx) {
+		return &IndexError{Index: idx, Reason: "unacceptable index"}
+	}
+	return nil
+}
+
+// checkAcceptableIndex panics with an *IndexError
+// if idx is not an acceptable index.
+func (l *State) checkAcceptableIndex(idx int) {
+	if err := l.CheckAcceptableIndex(idx); err != nil {
+		panic(err)
+	}
+}
+
+// checkStackIndex panics with an *IndexError
+// if idx is not a valid index to an actual stack position.
+func (l *State) checkStackIndex(idx int) {
+	if !l.isValidIndex(idx) || isPseudo(idx) {
+		panic(&IndexError{Index: idx, Reason: "invalid stack index"})
+	}
+}
+
 func (l *State) checkElems(n int) {
 	if l.top < n {
 		panic("not enough elements in the stack")
@@ -379,14 +1354,16 @@ func (l *State) Top() int {
 
 func (l *State) SetTop(idx int) {
 	// lua_settop can raise errors, which will be undefined behavior,
-	// but only if we mark stack slots as to-be-closed.
+	// but only if it removes stack slots marked as to-be-closed.
 	// We have a simple solution: don't let the user do that.
+	// To-be-closed slots must be closed with CloseSlot.
 
 	switch {
 	case isPseudo(idx):
 		panic("pseudo-index invalid for top")
 	case idx == 0:
 		if l.ptr != nil {
+			l.checkTBCAbove(0)
 			C.lua_settop(l.ptr, 0)
 			l.top = 0
 		}
@@ -400,6 +1377,7 @@ func (l *State) SetTop(idx int) {
 		panic("stack overflow")
 	}
 	l.init()
+	l.checkTBCAbove(idx)
 
 	C.lua_settop(l.ptr, C.int(idx))
 	l.top = idx
@@ -409,8 +1387,63 @@ func (l *State) Pop(n int) {
 	l.SetTop(-n - 1)
 }
 
+// checkTBCAbove panics if any to-be-closed slots are above the given top.
+func (l *State) checkTBCAbove(top int) {
+	if len(l.tbc) > 0 && l.tbc[len(l.tbc)-1] > top {
+		panic("removing to-be-closed slot without closing it")
+	}
+}
+
+func (l *State) ToClose(idx int) {
+	l.init()
+	l.checkStackIndex(idx)
+	idx = l.AbsIndex(idx)
+	if len(l.tbc) > 0 && idx <= l.tbc[len(l.tbc)-1] {
+		panic("to-be-closed slot below or equal to a marked one")
+	}
+	if C.lua_toboolean(l.ptr, C.int(idx)) != 0 {
+		if !l.CheckStack(1) {
+			panic("stack overflow")
+		}
+		if C.hasclosemethod(l.ptr, C.int(idx)) == 0 {
+			panic("to-be-closed value missing a __close metamethod")
+		}
+	}
+	C.lua_toclose(l.ptr, C.int(idx))
+	l.tbc = append(l.tbc, idx)
+}
+
+func (l *State) CloseSlot(idx int, msgHandler int) error {
+	l.init()
+	l.checkStackIndex(idx)
+	idx = l.AbsIndex(idx)
+	if len(l.tbc) == 0 || l.tbc[len(l.tbc)-1] != idx {
+		panic("slot is not the most recently marked to-be-closed slot")
+	}
+	if !l.CheckStack(4) {
+		panic("stack overflow")
+	}
+	msgHandler = l.checkMessageHandler(msgHandler)
+	l.tbc = l.tbc[:len(l.tbc)-1]
+
+	if C.lua_toboolean(l.ptr, C.int(idx)) == 0 {
+		// Lua does not track false values, so there's nothing to call.
+		C.lua_pushnil(l.ptr)
+		C.lua_copy(l.ptr, -1, C.int(idx))
+		C.lua_settop(l.ptr, -2)
+		return nil
+	}
+	ret := C.closeslot(l.ptr, C.int(idx), C.int(msgHandler))
+	if ret != C.LUA_OK {
+		l.top++
+		return fmt.Errorf("lua: close slot: %w", l.newError(ret))
+	}
+	return nil
+}
+
 func (l *State) PushValue(idx int) {
 	l.init()
+	l.checkAcceptableIndex(idx)
 	if l.top >= l.cap {
 		panic("stack overflow")
 	}
@@ -420,9 +1453,7 @@ func (l *State) PushValue(idx int) {
 
 func (l *State) Rotate(idx, n int) {
 	l.init()
-	if !l.isValidIndex(idx) || isPseudo(idx) {
-		panic("invalid index")
-	}
+	l.checkStackIndex(idx)
 	idx = l.AbsIndex(idx)
 	absN := n
 	if n < 0 {
@@ -445,9 +1476,8 @@ func (l *State) Insert(idx int) {
 
 func (l *State) Copy(fromIdx, toIdx int) {
 	l.init()
-	if !l.isAcceptableIndex(fromIdx) || !l.isAcceptableIndex(toIdx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(fromIdx)
+	l.checkAcceptableIndex(toIdx)
 	C.lua_copy(l.ptr, C.int(fromIdx), C.int(toIdx))
 }
 
@@ -472,9 +1502,7 @@ func (l *State) IsNumber(idx int) bool {
 	if l.ptr == nil {
 		return false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return C.lua_isnumber(l.ptr, C.int(idx)) != 0
 }
 
@@ -482,9 +1510,7 @@ func (l *State) IsString(idx int) bool {
 	if l.ptr == nil {
 		return false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return C.lua_isstring(l.ptr, C.int(idx)) != 0
 }
 
@@ -492,9 +1518,7 @@ func (l *State) IsNativeFunction(idx int) bool {
 	if l.ptr == nil {
 		return false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return C.lua_iscfunction(l.ptr, C.int(idx)) != 0
 }
 
@@ -502,9 +1526,7 @@ func (l *State) IsInteger(idx int) bool {
 	if l.ptr == nil {
 		return false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return C.lua_isinteger(l.ptr, C.int(idx)) != 0
 }
 
@@ -512,9 +1534,7 @@ func (l *State) IsUserdata(idx int) bool {
 	if l.ptr == nil {
 		return false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return C.lua_isuserdata(l.ptr, C.int(idx)) != 0
 }
 
@@ -522,9 +1542,7 @@ func (l *State) Type(idx int) Type {
 	if l.ptr == nil {
 		return TypeNone
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return Type(C.lua_type(l.ptr, C.int(idx)))
 }
 
@@ -544,9 +1562,7 @@ func (l *State) ToNumber(idx int) (n float64, ok bool) {
 	if l.ptr == nil {
 		return 0, false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	var isNum C.int
 	n = float64(C.lua_tonumberx(l.ptr, C.int(idx), &isNum))
 	return n, isNum != 0
@@ -556,9 +1572,7 @@ func (l *State) ToInteger(idx int) (n int64, ok bool) {
 	if l.ptr == nil {
 		return 0, false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	var isNum C.int
 	n = int64(C.lua_tointegerx(l.ptr, C.int(idx), &isNum))
 	return n, isNum != 0
@@ -568,9 +1582,7 @@ func (l *State) ToBoolean(idx int) bool {
 	if l.ptr == nil {
 		return false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return C.lua_toboolean(l.ptr, C.int(idx)) != 0
 }
 
@@ -578,9 +1590,7 @@ func (l *State) ToString(idx int) (s string, ok bool) {
 	if l.ptr == nil {
 		return "", false
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	var len C.size_t
 	ptr := C.lua_tolstring(l.ptr, C.int(idx), &len)
 	if ptr == nil {
@@ -593,9 +1603,7 @@ func (l *State) RawLen(idx int) uint64 {
 	if l.ptr == nil {
 		return 0
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return uint64(C.lua_rawlen(l.ptr, C.int(idx)))
 }
 
@@ -603,9 +1611,7 @@ func (l *State) CopyUserdata(dst []byte, idx, start int) int {
 	if l.ptr == nil {
 		return 0
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return l.copyUserdata(dst, idx, start)
 }
 
@@ -625,9 +1631,7 @@ func (l *State) ToPointer(idx int) uintptr {
 	if l.ptr == nil {
 		return 0
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return uintptr(C.lua_topointer(l.ptr, C.int(idx)))
 }
 
@@ -635,9 +1639,8 @@ func (l *State) RawEqual(idx1, idx2 int) bool {
 	if l.ptr == nil {
 		return false
 	}
-	if !l.isAcceptableIndex(idx1) || !l.isAcceptableIndex(idx2) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx1)
+	l.checkAcceptableIndex(idx2)
 	return C.lua_rawequal(l.ptr, C.int(idx1), C.int(idx2)) != 0
 }
 
@@ -677,6 +1680,23 @@ func (l *State) PushString(s string) {
 	l.top++
 }
 
+func (l *State) StringToNumber(s string) bool {
+	l.init()
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		return false
+	}
+	cs := C.CString(s)
+	defer C.free(unsafe.Pointer(cs))
+	if C.lua_stringtonumber(l.ptr, cs) == 0 {
+		return false
+	}
+	l.top++
+	return true
+}
+
 func (l *State) PushBoolean(b bool) {
 	l.init()
 	if l.top >= l.cap {
@@ -699,12 +1719,78 @@ func (l *State) PushLightUserdata(p uintptr) {
 	l.top++
 }
 
-type Function = func(*State) (int, error)
-
-func pcall(f Function, l *State) (nResults int, err error) {
+type Function = func(*State) (int, error)
+
+// yieldRequest is the error returned by [State.Yield].
+type yieldRequest struct {
+	n int
+}
+
+func (y *yieldRequest) Error() string {
+	return "coroutine yield"
+}
+
+// Yield returns the values a [Function] should return
+// to yield nResults values from the top of the stack.
+func (l *State) Yield(nResults int) (int, error) {
+	if nResults < 0 {
+		panic("negative results")
+	}
+	l.checkElems(nResults)
+	return 0, &yieldRequest{nResults}
+}
+
+// SetAllowBinaryChunks sets whether Load, LoadString, and LoadBytecode
+// accept binary chunks in this state and all of its threads.
+func (l *State) SetAllowBinaryChunks(allow bool) {
+	l.init()
+	l.data().forbidBinary = !allow
+}
+
+func (l *State) AllowBinaryChunks() bool {
+	return l.ptr == nil || !l.data().forbidBinary
+}
+
+// restrictMode removes "b" from the load mode
+// if binary chunks are not allowed.
+func (l *State) restrictMode(mode string) (string, error) {
+	if !l.data().forbidBinary {
+		return mode, nil
+	}
+	switch mode {
+	case "bt":
+		return "t", nil
+	case "b":
+		return "", errors.New("binary chunks are not allowed")
+	default:
+		return mode, nil
+	}
+}
+
+func (l *State) IsYieldable() bool {
+	return l.ptr != nil && C.lua_isyieldable(l.ptr) != 0
+}
+
+func pcall(f Function, l *State) (nResults int, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			nResults = 0
+			switch v := v.(type) {
+			case error:
+				err = v
+			case string:
+				err = errors.New(v)
+			default:
+				err = fmt.Errorf("%v", v)
+			}
+		}
+	}()
+	return f(l)
+}
+
+func pcallHook(f Hook, l *State, event int, ar *ActivationRecord) (err error) {
 	defer func() {
 		if v := recover(); v != nil {
-			nResults = 0
 			switch v := v.(type) {
 			case error:
 				err = v
@@ -715,7 +1801,7 @@ func pcall(f Function, l *State) (nResults int, err error) {
 			}
 		}
 	}()
-	return f(l)
+	return f(l, event, ar)
 }
 
 func (l *State) PushClosure(n int, f Function) {
@@ -743,6 +1829,106 @@ func (l *State) PushClosure(n int, f Function) {
 	l.top -= n - 1
 }
 
+// ToGoFunction returns the Function pushed by [State.PushClosure]
+// for the value at the given index.
+// If the value is not a Go closure, ToGoFunction returns nil.
+func (l *State) ToGoFunction(idx int) Function {
+	if l.ptr == nil {
+		return nil
+	}
+	l.checkAcceptableIndex(idx)
+	funcID := uint64(C.gofuncid(l.ptr, C.int(idx)))
+	if funcID == 0 {
+		return nil
+	}
+	return l.data().closures[funcID]
+}
+
+// upvalueN converts a user-provided upvalue number
+// to the number used by the Lua C API.
+// For Go closures, the first upvalue is hidden.
+func (l *State) upvalueN(funcIndex int, n int) C.int {
+	if C.isgoclosure(l.ptr, C.int(funcIndex)) != 0 {
+		n++
+	}
+	return C.int(n)
+}
+
+// Upvalue pushes the n-th upvalue of the closure at funcIndex
+// and returns its name.
+// The hidden upvalue of Go closures is not accessible.
+func (l *State) Upvalue(funcIndex int, n int) (name string, ok bool) {
+	l.init()
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	l.checkAcceptableIndex(funcIndex)
+	if n < 1 {
+		return "", false
+	}
+	cname := C.lua_getupvalue(l.ptr, C.int(funcIndex), l.upvalueN(funcIndex, n))
+	if cname == nil {
+		return "", false
+	}
+	l.top++
+	return C.GoString(cname), true
+}
+
+// SetUpvalue pops a value from the stack,
+// assigns it to the n-th upvalue of the closure at funcIndex,
+// and returns the upvalue's name.
+func (l *State) SetUpvalue(funcIndex int, n int) (name string, ok bool) {
+	l.checkElems(1)
+	l.checkAcceptableIndex(funcIndex)
+	if n < 1 {
+		l.Pop(1)
+		return "", false
+	}
+	cname := C.lua_setupvalue(l.ptr, C.int(funcIndex), l.upvalueN(funcIndex, n))
+	if cname == nil {
+		l.Pop(1)
+		return "", false
+	}
+	l.top--
+	return C.GoString(cname), true
+}
+
+// UpvalueID returns a unique identifier for the n-th upvalue
+// of the closure at funcIndex
+// or zero if the closure does not have such an upvalue.
+func (l *State) UpvalueID(funcIndex int, n int) uintptr {
+	if l.ptr == nil {
+		return 0
+	}
+	l.checkAcceptableIndex(funcIndex)
+	if !l.IsFunction(funcIndex) {
+		panic("function expected")
+	}
+	if n < 1 {
+		return 0
+	}
+	return uintptr(C.lua_upvalueid(l.ptr, C.int(funcIndex), l.upvalueN(funcIndex, n)))
+}
+
+// UpvalueJoin makes the n1-th upvalue of the Lua closure at funcIndex1
+// refer to the n2-th upvalue of the Lua closure at funcIndex2.
+func (l *State) UpvalueJoin(funcIndex1, n1, funcIndex2, n2 int) {
+	l.init()
+	l.checkLuaUpvalue(funcIndex1, n1)
+	l.checkLuaUpvalue(funcIndex2, n2)
+	C.lua_upvaluejoin(l.ptr, C.int(funcIndex1), C.int(n1), C.int(funcIndex2), C.int(n2))
+}
+
+func (l *State) checkLuaUpvalue(funcIndex int, n int) {
+	l.checkAcceptableIndex(funcIndex)
+	if !l.IsFunction(funcIndex) || l.IsNativeFunction(funcIndex) {
+		panic("Lua function expected")
+	}
+	if n < 1 || C.lua_upvalueid(l.ptr, C.int(funcIndex), C.int(n)) == nil {
+		panic("invalid upvalue index")
+	}
+}
+
 func (l *State) Global(name string, msgHandler int) (Type, error) {
 	l.init()
 	msgHandler = l.checkMessageHandler(msgHandler)
@@ -757,9 +1943,7 @@ func (l *State) Table(idx, msgHandler int) (Type, error) {
 	if !l.CheckStack(2) { // gettable needs 2 additional stack slots
 		panic("stack overflow")
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	msgHandler = l.checkMessageHandler(msgHandler)
 	var tp C.int
 	ret := C.gettable(l.ptr, C.int(idx), C.int(msgHandler), &tp)
@@ -785,11 +1969,25 @@ func (l *State) Field(idx int, k string, msgHandler int) (Type, error) {
 	return Type(tp), nil
 }
 
+func (l *State) Index(idx int, n int64, msgHandler int) (Type, error) {
+	l.init()
+	if !l.CheckStack(3) { // gettable needs 2 additional stack slots
+		panic("stack overflow")
+	}
+	idx = l.AbsIndex(idx)
+	msgHandler = l.checkMessageHandler(msgHandler)
+	l.PushInteger(n)
+	var tp C.int
+	ret := C.gettable(l.ptr, C.int(idx), C.int(msgHandler), &tp)
+	if ret != C.LUA_OK {
+		return TypeNil, fmt.Errorf("lua: get index %d: %w", n, l.newError(ret))
+	}
+	return Type(tp), nil
+}
+
 func (l *State) RawGet(idx int) Type {
 	l.checkElems(1)
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	tp := Type(C.lua_rawget(l.ptr, C.int(idx)))
 	return tp
 }
@@ -799,9 +1997,7 @@ func (l *State) RawIndex(idx int, n int64) Type {
 	if l.top >= l.cap {
 		panic("stack overflow")
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	tp := Type(C.lua_rawgeti(l.ptr, C.int(idx), C.lua_Integer(n)))
 	l.top++
 	return tp
@@ -813,6 +2009,17 @@ func (l *State) RawField(idx int, k string) Type {
 	return l.RawGet(idx)
 }
 
+func (l *State) RawGetP(idx int, p uintptr) Type {
+	l.init()
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	l.checkAcceptableIndex(idx)
+	tp := Type(C.rawgetp(l.ptr, C.int(idx), C.uintptr_t(p)))
+	l.top++
+	return tp
+}
+
 func (l *State) CreateTable(nArr, nRec int) {
 	l.init()
 	if l.top >= l.cap {
@@ -835,9 +2042,7 @@ func (l *State) NewUserdataUV(size, nUValue int) {
 }
 
 func (l *State) SetUserdata(idx int, start int, src []byte) {
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	l.setUserdata(idx, start, src)
 }
 
@@ -862,9 +2067,7 @@ func (l *State) Metatable(idx int) bool {
 	if l.top >= l.cap {
 		panic("stack overflow")
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	return l.metatable(idx)
 }
 
@@ -881,9 +2084,7 @@ func (l *State) UserValue(idx int, n int) Type {
 	if l.top >= l.cap {
 		panic("stack overflow")
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	tp := TypeNone
 	if n < 1 {
 		C.lua_pushnil(l.ptr)
@@ -911,8 +2112,9 @@ func (l *State) SetTable(idx, msgHandler int) error {
 	if !l.CheckStack(2) { // settable needs 2 additional stack slots
 		panic("stack overflow")
 	}
-	if !l.isAcceptableIndex(idx) || msgHandler != 0 && !l.isAcceptableIndex(msgHandler) {
-		panic("unacceptable index")
+	l.checkAcceptableIndex(idx)
+	if msgHandler != 0 {
+		l.checkAcceptableIndex(msgHandler)
 	}
 	ret := C.settable(l.ptr, C.int(idx), C.int(msgHandler))
 	if ret != C.LUA_OK {
@@ -945,24 +2147,49 @@ func (l *State) SetField(idx int, k string, msgHandler int) error {
 	return nil
 }
 
+func (l *State) SetIndex(idx int, n int64, msgHandler int) error {
+	l.checkElems(1)
+	if !l.CheckStack(3) { // settable needs 2 additional stack slots
+		panic("stack overflow")
+	}
+
+	idx = l.AbsIndex(idx)
+	if msgHandler != 0 {
+		msgHandler = l.AbsIndex(msgHandler)
+	}
+
+	l.PushInteger(n)
+	l.Rotate(-2, 1)
+	ret := C.settable(l.ptr, C.int(idx), C.int(msgHandler))
+	if ret != C.LUA_OK {
+		l.top--
+		return fmt.Errorf("lua: set index %d: %w", n, l.newError(ret))
+	}
+	l.top -= 2
+	return nil
+}
+
 func (l *State) RawSet(idx int) {
 	l.checkElems(2)
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	C.lua_rawset(l.ptr, C.int(idx))
 	l.top -= 2
 }
 
 func (l *State) RawSetIndex(idx int, n int64) {
 	l.checkElems(1)
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	C.lua_rawseti(l.ptr, C.int(idx), C.lua_Integer(n))
 	l.top--
 }
 
+func (l *State) RawSetP(idx int, p uintptr) {
+	l.checkElems(1)
+	l.checkAcceptableIndex(idx)
+	C.rawsetp(l.ptr, C.int(idx), C.uintptr_t(p))
+	l.top--
+}
+
 func (l *State) RawSetField(idx int, k string) {
 	idx = l.AbsIndex(idx)
 	l.PushString(k)
@@ -972,9 +2199,7 @@ func (l *State) RawSetField(idx int, k string) {
 
 func (l *State) SetMetatable(objIndex int) {
 	l.checkElems(1)
-	if !l.isAcceptableIndex(objIndex) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(objIndex)
 	C.lua_setmetatable(l.ptr, C.int(objIndex))
 	l.top--
 }
@@ -984,9 +2209,7 @@ func (l *State) SetUserValue(idx int, n int) bool {
 	if l.top >= l.cap {
 		panic("stack overflow")
 	}
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	if n < 1 {
 		l.Pop(1)
 		return false
@@ -1014,10 +2237,31 @@ func (l *State) Call(nArgs, nResults, msgHandler int) error {
 	}
 	msgHandler = l.checkMessageHandler(msgHandler)
 
+	// Without a message handler,
+	// use one that captures a traceback for Error.Traceback if requested.
+	captureTraceback := msgHandler == 0 &&
+		l.data().capture&CaptureTraceback != 0 &&
+		C.lua_checkstack(l.ptr, 2) != 0
+	if captureTraceback {
+		C.pushcapturetraceback(l.ptr)
+		msgHandler = l.top - toPop + 1
+		C.lua_rotate(l.ptr, C.int(msgHandler), 1)
+	}
 	ret := C.lua_pcallk(l.ptr, C.int(nArgs), C.int(nResults), C.int(msgHandler), 0, nil)
+	if captureTraceback {
+		C.lua_rotate(l.ptr, C.int(msgHandler), -1)
+		C.lua_settop(l.ptr, -2)
+	}
 	if ret != C.LUA_OK {
 		l.top -= toPop - 1
-		return l.newError(ret)
+		err := l.newError(ret)
+		if captureTraceback {
+			var n C.size_t
+			if s := C.gettraceback(l.ptr, &n); s != nil {
+				err.(*Error).Traceback = C.GoStringN(s, C.int(n))
+			}
+		}
+		return err
 	}
 	if newTop >= 0 {
 		l.top = newTop
@@ -1036,6 +2280,11 @@ func (l *State) Load(r io.Reader, chunkName string, mode string) error {
 		panic("stack overflow")
 	}
 
+	mode, err := l.restrictMode(mode)
+	if err != nil {
+		l.PushString(err.Error())
+		return fmt.Errorf("lua: load %s: %v", formatChunkName(chunkName), err)
+	}
 	modeC, err := loadMode(mode)
 	if err != nil {
 		l.PushString(err.Error())
@@ -1064,6 +2313,11 @@ func (l *State) LoadString(s string, chunkName string, mode string) error {
 		panic("stack overflow")
 	}
 
+	mode, err := l.restrictMode(mode)
+	if err != nil {
+		l.PushString(err.Error())
+		return fmt.Errorf("lua: load %s: %v", formatChunkName(chunkName), err)
+	}
 	modeC, err := loadMode(mode)
 	if err != nil {
 		l.PushString(err.Error())
@@ -1081,6 +2335,91 @@ func (l *State) LoadString(s string, chunkName string, mode string) error {
 	return nil
 }
 
+// LoadBytecode loads a precompiled chunk from memory without running it.
+// The chunk's header is checked for compatibility
+// before the chunk is passed to lua_load.
+func (l *State) LoadBytecode(b []byte, chunkName string) error {
+	l.init()
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	if _, err := l.restrictMode("b"); err != nil {
+		l.PushString(err.Error())
+		return fmt.Errorf("lua: load %s: %v", formatChunkName(chunkName), err)
+	}
+	if err := checkBinaryHeader(b); err != nil {
+		l.PushString(err.Error())
+		return fmt.Errorf("lua: load %s: %v", formatChunkName(chunkName), err)
+	}
+
+	chunkNameC := C.CString(chunkName)
+	defer C.free(unsafe.Pointer(chunkNameC))
+	modeC, _ := loadMode("b")
+	ret := C.loadstring(l.ptr, unsafe.String(unsafe.SliceData(b), len(b)), chunkNameC, modeC)
+	l.top++
+	if ret != C.LUA_OK {
+		return fmt.Errorf("lua: load %s: %w", formatChunkName(chunkName), l.newError(ret))
+	}
+	return nil
+}
+
+// Binary chunk header fields, as defined in lundump.h.
+const (
+	luacVersion         = C.LUA_VERSION_NUM/100*16 + C.LUA_VERSION_NUM%100
+	luacFormat          = 0
+	luacData            = "\x19\x93\r\n\x1a\n"
+	luacInt             = 0x5678
+	luacNum             = 370.5
+	luacInstructionSize = 4
+)
+
+// checkBinaryHeader verifies that b starts with a binary chunk header
+// that is compatible with this build of Lua.
+func checkBinaryHeader(b []byte) error {
+	if !bytes.HasPrefix(b, []byte(C.LUA_SIGNATURE)) {
+		return errors.New("not a binary chunk")
+	}
+	b = b[len(C.LUA_SIGNATURE):]
+	const headerSize = 1 + 1 + len(luacData) + 3 + C.sizeof_lua_Integer + C.sizeof_lua_Number
+	if len(b) < headerSize {
+		return errors.New("truncated binary chunk header")
+	}
+	if b[0] != luacVersion {
+		return fmt.Errorf("version mismatch (chunk is %d.%d, want %d.%d)",
+			b[0]>>4, b[0]&0xf, luacVersion>>4, luacVersion&0xf)
+	}
+	if b[1] != luacFormat {
+		return errors.New("format mismatch")
+	}
+	b = b[2:]
+	if string(b[:len(luacData)]) != luacData {
+		return errors.New("corrupted chunk")
+	}
+	b = b[len(luacData):]
+	if b[0] != luacInstructionSize {
+		return fmt.Errorf("instruction size mismatch (chunk has %d, want %d)", b[0], luacInstructionSize)
+	}
+	if b[1] != C.sizeof_lua_Integer {
+		return fmt.Errorf("lua_Integer size mismatch (chunk has %d, want %d)", b[1], C.sizeof_lua_Integer)
+	}
+	if b[2] != C.sizeof_lua_Number {
+		return fmt.Errorf("lua_Number size mismatch (chunk has %d, want %d)", b[2], C.sizeof_lua_Number)
+	}
+	b = b[3:]
+	// This package always builds Lua with 64-bit integers and floats.
+	if binary.NativeEndian.Uint64(b) != luacInt {
+		if binary.NativeEndian.Uint64(b) == bits.ReverseBytes64(luacInt) {
+			return errors.New("integer format mismatch (wrong endianness)")
+		}
+		return errors.New("integer format mismatch")
+	}
+	b = b[C.sizeof_lua_Integer:]
+	if math.Float64frombits(binary.NativeEndian.Uint64(b)) != luacNum {
+		return errors.New("float format mismatch")
+	}
+	return nil
+}
+
 func formatChunkName(chunkName string) string {
 	if len(chunkName) == 0 || (chunkName[0] != '@' && chunkName[0] != '=') {
 		return "(string)"
@@ -1166,9 +2505,7 @@ func (l *State) GCGenerational(minorMul, majorMul int) {
 
 func (l *State) Next(idx int) bool {
 	l.checkElems(1)
-	if !l.isAcceptableIndex(idx) {
-		panic("unacceptable index")
-	}
+	l.checkAcceptableIndex(idx)
 	ok := C.lua_next(l.ptr, C.int(idx)) != 0
 	if ok {
 		l.top++
@@ -1310,6 +2647,36 @@ func (ar *ActivationRecord) Info(what string) *Debug {
 	return ar.state.getinfo(cwhat, ar.ar)
 }
 
+func (ar *ActivationRecord) Local(n int) (name string, ok bool) {
+	if !ar.isValid() {
+		return "", false
+	}
+	l := ar.state
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	cname := C.lua_getlocal(l.ptr, ar.ar, C.int(n))
+	if cname == nil {
+		return "", false
+	}
+	l.top++
+	return C.GoString(cname), true
+}
+
+func (ar *ActivationRecord) SetLocal(n int) (name string, ok bool) {
+	if !ar.isValid() {
+		return "", false
+	}
+	l := ar.state
+	l.checkElems(1)
+	cname := C.lua_setlocal(l.ptr, ar.ar, C.int(n))
+	l.top--
+	if cname == nil {
+		return "", false
+	}
+	return C.GoString(cname), true
+}
+
 const (
 	GName = C.LUA_GNAME
 
@@ -1396,6 +2763,18 @@ func PushOpenPackage(l *State) {
 	l.top++
 }
 
+// PushNextFunction pushes a C function that behaves like the standard next function.
+// Unlike [State.Next], it raises a Lua error for invalid keys,
+// so it is safe to use with keys that Lua code controls.
+func PushNextFunction(l *State) {
+	l.init()
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	C.pushnextfunction(l.ptr)
+	l.top++
+}
+
 const readerBufferSize = 4096
 
 type reader struct {
@@ -1468,22 +2847,196 @@ func UpvalueIndex(i int) int {
 	return C.LUA_REGISTRYINDEX - (i + 1)
 }
 
-type luaError struct {
-	code C.int
-	msg  string
-}
-
+// PanicError is the value passed to panic
+// when an error occurs outside of any protected call.
+// The Lua state is in an undefined state after such an error
+// and should not be used except to close it.
+type PanicError struct {
+	// Message is the error message.
+	Message string
+	// Stack is a formatted stack trace of the goroutine
+	// that caused the error, as returned by [runtime/debug.Stack].
+	// Lua unwinds its own call stack before reporting the error,
+	// so a Lua traceback is not available.
+	Stack []byte
+}
+
+// Error returns the error message.
+func (e *PanicError) Error() string {
+	return "lua: unprotected error: " + e.Message
+}
+
+// ThreadStatus is the status of a thread.
+type ThreadStatus int
+
+// String returns a description of the status.
+func (status ThreadStatus) String() string {
+	switch status {
+	case StatusOK:
+		return "ok"
+	case StatusYield:
+		return "yield"
+	case StatusRuntimeError:
+		return "runtime error"
+	case StatusSyntaxError:
+		return "syntax error"
+	case StatusMemoryError:
+		return "memory error"
+	case StatusHandlerError:
+		return "error in error handling"
+	default:
+		return fmt.Sprintf("lua.ThreadStatus(%d)", int(status))
+	}
+}
+
+type Error struct {
+	// Code is the status code of the error,
+	// such as StatusRuntimeError or StatusSyntaxError.
+	Code ThreadStatus
+	// Message is the error object converted to a string,
+	// the message of the Go error that the error object refers to,
+	// or the empty string if the error object is neither.
+	Message string
+	// Traceback is a traceback of the Lua stack where the error was raised.
+	// It is only captured by Call when no message handler is given
+	// and SetErrorCapture was called with CaptureTraceback,
+	// and is empty otherwise.
+	Traceback string
+	// Value refers to the error object,
+	// which can be pushed again (for example, to rethrow it)
+	// with PushValueRef.
+	// It is only set when SetErrorCapture was called with CaptureValue,
+	// and the caller must release it with ReleaseValueRef.
+	Value ValueRef
+
+	// goErr is the error returned by a Go function
+	// that raised the Lua error, if known.
+	goErr error
+}
+
+// newError returns a new *Error for the error object on the top of the stack.
 func (l *State) newError(code C.int) error {
-	e := &luaError{code: code}
-	e.msg, _ = l.ToString(-1)
+	e := &Error{Code: ThreadStatus(code)}
+	data := l.data()
+	if data.capture&CaptureValue != 0 {
+		e.Value = l.saveErrorValue()
+	}
+	if goErr := l.goError(-1); goErr != nil {
+		e.Message = goErr.Error()
+		e.goErr = goErr
+	} else {
+		isString := l.Type(-1) == TypeString
+		e.Message, _ = l.ToString(-1)
+		if isString && data.lastGoError != nil && e.Message == data.lastGoErrorText {
+			// The error object is the string raised for the last Go error.
+			e.goErr = data.lastGoError
+		}
+	}
+	// Forget the last Go error once any error reaches Go
+	// so that it cannot be matched by a later, unrelated error.
+	data.lastGoError = nil
+	data.lastGoErrorText = ""
 	return e
 }
 
-func (e *luaError) Error() string {
-	if e.msg != "" {
-		return e.msg
+// saveErrorValue saves the value on the top of the stack
+// in the error values table.
+func (l *State) saveErrorValue() ValueRef {
+	ref := C.saveerrorvalue(l.ptr)
+	if ref == C.LUA_NOREF {
+		return ValueRef{}
+	}
+	data := l.data()
+	id := data.nextID
+	if id == 0 {
+		panic("ID wrap-around")
+	}
+	data.nextID++
+	if data.errorValues == nil {
+		data.errorValues = make(map[uint64]C.int)
+	}
+	data.errorValues[id] = ref
+	return ValueRef{data: data, id: id}
+}
+
+// SetErrorCapture sets the information that errors returned by Call
+// and other protected operations record about their error objects.
+// capture is a bitwise OR of the Capture constants.
+func (l *State) SetErrorCapture(capture int) {
+	l.init()
+	l.data().capture = capture
+}
+
+// ErrorCapture returns the flags passed to SetErrorCapture.
+func (l *State) ErrorCapture() int {
+	if l.ptr == nil {
+		return 0
+	}
+	return l.data().capture
+}
+
+// ValueRef is a reference to a Lua error object.
+// The error object is kept until the reference is released with ReleaseValueRef.
+// The zero value does not refer to any value.
+type ValueRef struct {
+	data *stateData
+	id   uint64
+}
+
+// PushValueRef pushes the value referred to by ref onto the stack.
+// If ref has been released
+// or ref was created by a different state,
+// then PushValueRef returns false and does not push anything.
+func (l *State) PushValueRef(ref ValueRef) bool {
+	if ref.data == nil || l.ptr == nil {
+		return false
+	}
+	data := l.data()
+	if ref.data != data {
+		return false
+	}
+	luaRef, ok := data.errorValues[ref.id]
+	if !ok {
+		return false
+	}
+	if l.top >= l.cap {
+		panic("stack overflow")
+	}
+	C.pusherrorvalue(l.ptr, luaRef)
+	l.top++
+	return true
+}
+
+// ReleaseValueRef releases the error object that ref refers to.
+// ReleaseValueRef does nothing if ref has already been released
+// or was created by a different state.
+func (l *State) ReleaseValueRef(ref ValueRef) {
+	if ref.data == nil || l.ptr == nil {
+		return
+	}
+	data := l.data()
+	if ref.data != data {
+		return
+	}
+	luaRef, ok := data.errorValues[ref.id]
+	if !ok {
+		return
+	}
+	delete(data.errorValues, ref.id)
+	C.releaseerrorvalue(l.ptr, luaRef)
+}
+
+// Unwrap returns the error returned by the Go function
+// that raised the Lua error or nil if the error was not raised by Go.
+func (e *Error) Unwrap() error {
+	return e.goErr
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
 	}
-	switch e.code {
+	switch C.int(e.Code) {
 	case C.LUA_ERRRUN:
 		return "runtime error"
 	case C.LUA_ERRMEM:
@@ -1511,9 +3064,9 @@ func AsError(err error) (code int, ok bool) {
 	if err == nil {
 		return C.LUA_OK, true
 	}
-	var e *luaError
+	var e *Error
 	if !errors.As(err, &e) {
 		return 0, false
 	}
-	return int(e.code), true
+	return int(e.Code), true
 }
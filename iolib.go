@@ -23,14 +23,17 @@ package lua
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const (
@@ -50,6 +53,14 @@ type IOLibrary struct {
 	// Stderr is the writer for io.stderr.
 	// If nil, io.stderr will discard any data written to it.
 	Stderr io.Writer
+	// WriteTimeout is the maximum amount of time
+	// that a single write to io.stdout or io.stderr may block.
+	// It only takes effect if WriteTimeout is positive
+	// and the writer has a SetWriteDeadline method
+	// (like *os.File or net.Conn).
+	// Writes that fail, including those that time out,
+	// return the usual fail, error message, and error code triple to scripts.
+	WriteTimeout time.Duration
 
 	// Open opens a file with the given name and [mode].
 	// The returned file should implement io.Reader and/or io.Writer,
@@ -58,6 +69,13 @@ type IOLibrary struct {
 	// [mode]: https://www.lua.org/manual/5.4/manual.html#pdf-io.open
 	Open func(name, mode string) (io.Closer, error)
 
+	// FS is the file system that io.open, io.lines, io.input, and io.output
+	// resolve file names against.
+	// If FS is not nil, it is used instead of Open.
+	// Files can only be opened for reading
+	// unless FS implements [OpenFileFS].
+	FS fs.FS
+
 	// CreateTemp returns a handle for a temporary file opened in update mode.
 	// The returned file should clean up the file on Close.
 	CreateTemp func() (ReadWriteSeekCloser, error)
@@ -71,6 +89,11 @@ type IOLibrary struct {
 	// and returns a handle for writing to its standard input.
 	// If nil, io.popen(command, "w") will return an error.
 	OpenProcessWriter func(command string) (io.WriteCloser, error)
+
+	// Commands starts subprocesses for io.popen.
+	// If Commands is not nil,
+	// it is used instead of OpenProcessReader and OpenProcessWriter.
+	Commands CommandRunner
 }
 
 // NewIOLibrary returns an OSLibrary that uses the native operating system.
@@ -86,30 +109,71 @@ func NewIOLibrary() *IOLibrary {
 	}
 }
 
+// OpenFileFS is the interface implemented by a file system
+// that can open files for writing.
+// [IOLibrary] uses OpenFile for any [mode] other than "r"
+// when its FS field implements OpenFileFS.
+// The flag and perm arguments have the same meaning as in [os.OpenFile],
+// and the returned file should implement [io.Writer]
+// if the flag permits writing.
+//
+// [mode]: https://www.lua.org/manual/5.4/manual.html#pdf-io.open
+type OpenFileFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
 func ioOpen(name, mode string) (io.Closer, error) {
-	var flag int
-	mode = strings.TrimSuffix(mode, "b")
-	switch mode {
+	flag, err := openFlag(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, flag, 0o666)
+}
+
+// openFS opens a file from fsys for io.open.
+func openFS(fsys fs.FS, name, mode string) (io.Closer, error) {
+	flag, err := openFlag(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	name = path.Clean(name)
+	if flag == os.O_RDONLY {
+		return fsys.Open(name)
+	}
+	wfs, ok := fsys.(OpenFileFS)
+	if !ok {
+		return nil, &fs.PathError{
+			Op:   "open",
+			Path: name,
+			Err:  fmt.Errorf("mode %q: %w", mode, errors.ErrUnsupported),
+		}
+	}
+	return wfs.OpenFile(name, flag, 0o666)
+}
+
+// openFlag returns the [os.OpenFile] flag for an io.open mode.
+func openFlag(name, mode string) (int, error) {
+	switch strings.TrimSuffix(mode, "b") {
 	case "r":
-		flag = os.O_RDONLY
+		return os.O_RDONLY, nil
 	case "w":
-		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC, nil
 	case "a":
-		flag = os.O_WRONLY | os.O_APPEND | os.O_CREATE
+		return os.O_WRONLY | os.O_APPEND | os.O_CREATE, nil
 	case "r+":
-		flag = os.O_RDWR | os.O_CREATE
+		return os.O_RDWR | os.O_CREATE, nil
 	case "w+":
-		flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		return os.O_RDWR | os.O_CREATE | os.O_TRUNC, nil
 	case "a+":
-		flag = os.O_RDWR | os.O_APPEND | os.O_CREATE
+		return os.O_RDWR | os.O_APPEND | os.O_CREATE, nil
 	default:
-		return nil, &os.PathError{
+		return 0, &os.PathError{
 			Op:   "open",
 			Path: name,
-			Err:  fmt.Errorf("invalid mode %q", mode),
+			Err:  fmt.Errorf("invalid mode %q", strings.TrimSuffix(mode, "b")),
 		}
 	}
-	return os.OpenFile(name, flag, 0o666)
 }
 
 func ioCreateTemp() (ReadWriteSeekCloser, error) {
@@ -135,31 +199,19 @@ func ioCreateTemp() (ReadWriteSeekCloser, error) {
 }
 
 func popenRead(command string) (io.ReadCloser, error) {
-	c := osCommand(command)
-	c.Stdin = os.Stdin
-	c.Stderr = os.Stderr
-	stdout, err := c.StdoutPipe()
+	p, err := ExecCommandRunner{}.StartCommand(context.Background(), command, CommandRead)
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Start(); err != nil {
-		return nil, err
-	}
-	return &popenReader{stdout, c}, nil
+	return processReader{p}, nil
 }
 
 func popenWrite(command string) (io.WriteCloser, error) {
-	c := osCommand(command)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	stdin, err := c.StdinPipe()
+	p, err := ExecCommandRunner{}.StartCommand(context.Background(), command, CommandWrite)
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Start(); err != nil {
-		return nil, err
-	}
-	return &popenWriter{stdin, c}, nil
+	return processWriter{p}, nil
 }
 
 // OpenLibrary loads the standard io library.
@@ -196,14 +248,14 @@ func (lib *IOLibrary) OpenLibrary(l *State) (int, error) {
 	}
 	l.RawSetField(-2, "stdin")
 
-	pushStream(l, &stream{w: stdoutWriter{&lib.Stdout}, c: noClose{}})
+	pushStream(l, &stream{w: stdoutWriter{&lib.Stdout, &lib.WriteTimeout}, c: noClose{}})
 	l.PushValue(-1)
 	if err := l.SetField(RegistryIndex, ioOutput, 0); err != nil {
 		return 0, err
 	}
 	l.RawSetField(-2, "stdout")
 
-	pushStream(l, &stream{w: stdoutWriter{&lib.Stderr}, c: noClose{}})
+	pushStream(l, &stream{w: stdoutWriter{&lib.Stderr, &lib.WriteTimeout}, c: noClose{}})
 	l.RawSetField(-2, "stderr")
 
 	return 1, nil
@@ -266,10 +318,16 @@ func (lib *IOLibrary) open(l *State) (int, error) {
 }
 
 func (lib *IOLibrary) doOpen(filename, mode string) (*stream, error) {
-	if lib.Open == nil {
+	var f io.Closer
+	var err error
+	switch {
+	case lib.FS != nil:
+		f, err = openFS(lib.FS, filename, mode)
+	case lib.Open != nil:
+		f, err = lib.Open(filename, mode)
+	default:
 		return nil, errors.ErrUnsupported
 	}
-	f, err := lib.Open(filename, mode)
 	if err != nil {
 		return nil, err
 	}
@@ -312,7 +370,7 @@ func (lib *IOLibrary) filefunc(l *State, f, mode string) (int, error) {
 			}
 			pushStream(l, s)
 		} else {
-			if _, err := toStream(l); err != nil {
+			if _, err := toOpenStream(l); err != nil {
 				return 0, err
 			}
 			l.PushValue(1)
@@ -342,6 +400,14 @@ func (lib *IOLibrary) popen(l *State) (int, error) {
 	}
 	switch mode {
 	case "r":
+		if lib.Commands != nil {
+			p, err := lib.Commands.StartCommand(context.Background(), command, CommandRead)
+			if err != nil {
+				return pushFileResult(l, err), nil
+			}
+			pushStream(l, newStream(processReader{p}, true, false, false))
+			return 1, nil
+		}
 		if lib.OpenProcessReader == nil {
 			err := fmt.Errorf("popen %s: %w", command, errors.ErrUnsupported)
 			return pushFileResult(l, err), nil
@@ -353,6 +419,14 @@ func (lib *IOLibrary) popen(l *State) (int, error) {
 		pushStream(l, newStream(r, true, false, false))
 		return 1, nil
 	case "w":
+		if lib.Commands != nil {
+			p, err := lib.Commands.StartCommand(context.Background(), command, CommandWrite)
+			if err != nil {
+				return pushFileResult(l, err), nil
+			}
+			pushStream(l, newStream(processWriter{p}, false, true, false))
+			return 1, nil
+		}
 		if lib.OpenProcessWriter == nil {
 			err := fmt.Errorf("popen %s: %w", command, errors.ErrUnsupported)
 			return pushFileResult(l, err), nil
@@ -456,17 +530,36 @@ func (in stdinReader) ReadByte() (byte, error) {
 	return (*in.r).ReadByte()
 }
 
+func (in stdinReader) UnreadByte() error {
+	if s, ok := (*in.r).(io.ByteScanner); ok {
+		return s.UnreadByte()
+	}
+	return errUnreadUnsupported
+}
+
 type stdoutWriter struct {
-	w *io.Writer
+	w       *io.Writer
+	timeout *time.Duration
 }
 
 func (out stdoutWriter) Write(p []byte) (int, error) {
 	if *out.w == nil {
 		return len(p), nil
 	}
+	if d, ok := (*out.w).(writeDeadliner); ok && *out.timeout > 0 {
+		if err := d.SetWriteDeadline(time.Now().Add(*out.timeout)); err == nil {
+			defer d.SetWriteDeadline(time.Time{})
+		}
+	}
 	return (*out.w).Write(p)
 }
 
+// writeDeadliner is implemented by writers that support write deadlines,
+// like *os.File and net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
 type noClose struct{}
 
 func (noClose) Close() error {
@@ -498,39 +591,3 @@ func (f *removeOnCloseFile) Close() error {
 	}
 	return err2
 }
-
-type popenReader struct {
-	pipe io.ReadCloser
-	cmd  *exec.Cmd
-}
-
-func (p *popenReader) Read(b []byte) (int, error) {
-	return p.pipe.Read(b)
-}
-
-func (p *popenReader) Close() error {
-	err1 := p.pipe.Close()
-	err2 := p.cmd.Wait()
-	if err2 != nil {
-		return err2
-	}
-	return err1
-}
-
-type popenWriter struct {
-	pipe io.WriteCloser
-	cmd  *exec.Cmd
-}
-
-func (p *popenWriter) Write(b []byte) (int, error) {
-	return p.pipe.Write(b)
-}
-
-func (p *popenWriter) Close() error {
-	err1 := p.pipe.Close()
-	err2 := p.cmd.Wait()
-	if err2 != nil {
-		return err2
-	}
-	return err1
-}
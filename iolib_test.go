@@ -23,11 +23,14 @@ package lua
 
 import (
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestIOLibrary(t *testing.T) {
@@ -71,6 +74,9 @@ func TestIOLibrary(t *testing.T) {
 		if err := Require(state, IOLibraryName, true, lib.OpenLibrary); err != nil {
 			t.Error(err)
 		}
+		if err := Require(state, MathLibraryName, true, NewOpenMath(nil)); err != nil {
+			t.Error(err)
+		}
 
 		f, err := os.Open(filepath.Join("testdata", "iolib.lua"))
 		if err != nil {
@@ -140,4 +146,143 @@ func TestIOLibrary(t *testing.T) {
 			t.Error(err)
 		}
 	})
+	t.Run("WriteTimeout", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Pipes do not support deadlines on Windows")
+		}
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pr.Close()
+		defer pw.Close()
+
+		lib := new(IOLibrary)
+		lib.Stdout = pw
+		lib.WriteTimeout = 10 * time.Millisecond
+
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+		if err := Require(state, IOLibraryName, true, lib.OpenLibrary); err != nil {
+			t.Fatal(err)
+		}
+		if err := Require(state, StringLibraryName, true, OpenString); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing reads from the pipe, so writes will block once its buffer is full.
+		const source = `local chunk = string.rep("x", 4096)` + "\n" +
+			`for i = 1, 1024 do` + "\n" +
+			`  local ok, msg = io.write(chunk)` + "\n" +
+			`  if not ok then return msg end` + "\n" +
+			`end` + "\n" +
+			`return nil`
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		msg, ok := state.ToString(-1)
+		if !ok {
+			t.Fatal("io.write never failed")
+		}
+		if !strings.Contains(msg, os.ErrDeadlineExceeded.Error()) {
+			t.Errorf("io.write error = %q; want to contain %q", msg, os.ErrDeadlineExceeded.Error())
+		}
+	})
+	t.Run("FS", func(t *testing.T) {
+		lib := &IOLibrary{
+			FS: fstest.MapFS{
+				"data/hello.txt": {Data: []byte("Hello, World!\nsecond line\n")},
+			},
+		}
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+		if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if err := Require(state, IOLibraryName, true, lib.OpenLibrary); err != nil {
+			t.Fatal(err)
+		}
+
+		const source = "local f = assert(io.open('data/hello.txt'))\n" +
+			"assert(f:read('l') == 'Hello, World!')\n" +
+			"assert(f:seek('set', 7) == 7)\n" +
+			"assert(f:read('a') == 'World!\\nsecond line\\n')\n" +
+			"assert(f:close())\n" +
+			"local n = 0\n" +
+			"for line in io.lines('./data/hello.txt') do n = n + 1 end\n" +
+			"assert(n == 2)\n" +
+			"assert(io.open('data/missing.txt') == nil)\n" +
+			"local f, msg = io.open('data/new.txt', 'w')\n" +
+			"assert(f == nil, 'opened read-only file system for writing')\n" +
+			"assert(type(msg) == 'string')\n"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 0, 0); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("OpenFileFS", func(t *testing.T) {
+		dir := t.TempDir()
+		lib := &IOLibrary{FS: openFileDirFS(dir)}
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+		if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if err := Require(state, IOLibraryName, true, lib.OpenLibrary); err != nil {
+			t.Fatal(err)
+		}
+
+		const source = "local f = assert(io.open('new.txt', 'w'))\n" +
+			"assert(f:write('abc'))\n" +
+			"assert(f:close())\n" +
+			"f = assert(io.open('new.txt', 'a+'))\n" +
+			"assert(f:write('def'))\n" +
+			"assert(f:seek('set'))\n" +
+			"assert(f:read('a') == 'abcdef')\n" +
+			"assert(f:close())\n"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 0, 0); err != nil {
+			t.Error(err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "new.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "abcdef" {
+			t.Errorf("new.txt = %q; want \"abcdef\"", got)
+		}
+	})
+}
+
+// openFileDirFS is an [OpenFileFS] for a directory on the local file system.
+type openFileDirFS string
+
+func (dir openFileDirFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(dir)).Open(name)
+}
+
+func (dir openFileDirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.OpenFile(filepath.Join(string(dir), filepath.FromSlash(name)), flag, perm)
 }
@@ -39,7 +39,9 @@ usually with Go-specific niceties.
 package lua
 
 import (
+	"fmt"
 	"io"
+	"math"
 	"unsafe"
 
 	"zombiezen.com/go/lua/internal/lua54"
@@ -47,7 +49,11 @@ import (
 
 // Version number.
 const (
-	VersionNum        = lua54.VersionNum
+	// VersionNum is the version number returned by [State.Version]
+	// for the version of Lua this package was built with.
+	VersionNum = lua54.VersionNum
+	// VersionReleaseNum is the version number including the release number
+	// (e.g. 50406 for Lua 5.4.6).
 	VersionReleaseNum = lua54.VersionReleaseNum
 )
 
@@ -60,7 +66,7 @@ const (
 	// Copyright is the full version string with a copyright notice.
 	Copyright = lua54.Copyright
 	// Authors is a string listing the authors of Lua.
-	Authors = lua54.Copyright
+	Authors = lua54.Authors
 
 	VersionMajor   = lua54.VersionMajor
 	VersionMinor   = lua54.VersionMinor
@@ -122,6 +128,111 @@ func (tp Type) String() string {
 	return lua54.Type(tp).String()
 }
 
+// NumberKind is an enumeration of the subtypes of Lua numbers.
+// Lua 5.4 distinguishes between integers and floats:
+// they compare equal when they represent the same mathematical value,
+// but they are [distinct representations].
+//
+// [distinct representations]: https://www.lua.org/manual/5.4/manual.html#2.1
+type NumberKind int
+
+// Number kinds.
+const (
+	// NumberKindNone is returned by [State.NumberKind] for a non-number value.
+	NumberKindNone NumberKind = iota
+	// NumberKindInteger is a 64-bit signed integer.
+	NumberKindInteger
+	// NumberKindFloat is a double-precision floating point number.
+	NumberKindFloat
+)
+
+// String returns the name of the number subtype
+// as returned by Lua's [math.type] function,
+// or "no number" for [NumberKindNone].
+//
+// [math.type]: https://www.lua.org/manual/5.4/manual.html#pdf-math.type
+func (kind NumberKind) String() string {
+	switch kind {
+	case NumberKindNone:
+		return "no number"
+	case NumberKindInteger:
+		return "integer"
+	case NumberKindFloat:
+		return "float"
+	default:
+		return fmt.Sprintf("lua.NumberKind(%d)", int(kind))
+	}
+}
+
+// PanicError is the value passed to panic
+// when an error occurs outside of any protected call
+// (which would otherwise cause Lua to abort the process).
+// The State is in an undefined state after such an error
+// and should only be closed.
+type PanicError = lua54.PanicError
+
+// Error is the error returned by [State] methods like [State.Call]
+// when Lua raises an error.
+// Its Error method returns the error object's message
+// (without the traceback).
+// If the error was raised by a [Function] returning a Go error,
+// then Unwrap returns that error
+// (see [Function] for when the Go error is known).
+type Error = lua54.Error
+
+// ValueRef is a reference to a Lua error object held by a [State].
+// See [State.PushValueRef] and [State.ReleaseValueRef].
+type ValueRef = lua54.ValueRef
+
+// ErrorCapture is a set of flags for [State.SetErrorCapture].
+type ErrorCapture int
+
+// Error capture flags.
+const (
+	// CaptureTraceback records a traceback in [Error.Traceback]
+	// for errors from [State.Call] without a message handler.
+	CaptureTraceback ErrorCapture = lua54.CaptureTraceback
+	// CaptureValue saves the error object in [Error.Value].
+	CaptureValue ErrorCapture = lua54.CaptureValue
+	// CaptureGoError raises the errors returned by a [Function]
+	// as userdata that refer to the Go error
+	// instead of as strings,
+	// so that [Error.Unwrap] can return the Go error
+	// even after Lua code caught the error object and raised it again.
+	// The userdata converts to the error's message
+	// with tostring, concatenation, and string methods (like err:find(...)),
+	// but Lua code that checks for a string error object will not see one.
+	CaptureGoError ErrorCapture = lua54.CaptureGoError
+)
+
+// MemoryStats is a snapshot of a state's memory allocator counters,
+// as returned by [State.MemoryStats].
+type MemoryStats = lua54.MemoryStats
+
+// ThreadStatus is the status of a thread.
+type ThreadStatus = lua54.ThreadStatus
+
+// Thread statuses.
+const (
+	// StatusOK is the status of a thread that is running,
+	// has not started, or has finished normally.
+	StatusOK ThreadStatus = lua54.StatusOK
+	// StatusYield is the status of a suspended coroutine.
+	StatusYield ThreadStatus = lua54.StatusYield
+	// StatusRuntimeError is the status of a coroutine
+	// that stopped because of a runtime error.
+	StatusRuntimeError ThreadStatus = lua54.StatusRuntimeError
+	// StatusSyntaxError is the status of a coroutine
+	// that stopped because of a syntax error.
+	StatusSyntaxError ThreadStatus = lua54.StatusSyntaxError
+	// StatusMemoryError is the status of a coroutine
+	// that stopped because of a memory allocation error.
+	StatusMemoryError ThreadStatus = lua54.StatusMemoryError
+	// StatusHandlerError is the status of a coroutine
+	// that stopped because of an error while running a message handler.
+	StatusHandlerError ThreadStatus = lua54.StatusHandlerError
+)
+
 // State represents a Lua execution thread.
 // The zero value is a state with a single main thread,
 // an empty stack, and an empty environment.
@@ -129,7 +240,10 @@ func (tp Type) String() string {
 // Methods that take in stack indices have a notion of
 // [valid and acceptable indices].
 // If a method receives a stack index that is not within range,
-// it will panic.
+// it will panic with an [*IndexError].
+// Programs that compute indices from dynamic sources
+// can validate them with [State.CheckIndex]
+// or use [CatchIndexErrors] to turn such panics into errors.
 // Methods may also panic if there is insufficient stack space.
 // Use [State.CheckStack]
 // to ensure that the State has sufficient stack space before making calls,
@@ -141,12 +255,221 @@ type State struct {
 	state lua54.State
 }
 
+// NewStateWithLimit returns a new state
+// that fails memory allocations that would make it use more than the given number of bytes.
+// Allocations that fail inside a protected call (like [State.Call])
+// raise a memory error, which can be detected with [IsOutOfMemory].
+// Methods called outside a protected call panic if they run out of memory,
+// so Go code should only push small values onto a state near its limit.
+// If bytes is zero or negative, the state has no limit,
+// like the zero value of State.
+// The limit does not apply to a new environment created after [State.Close].
+func NewStateWithLimit(bytes int64) *State {
+	l := new(State)
+	l.state.SetMemoryLimit(uint64(max(bytes, 0)))
+	return l
+}
+
+// MemoryLimit returns the number of bytes that the state may use,
+// as set by [NewStateWithLimit],
+// or zero if the state has no limit.
+func (l *State) MemoryLimit() int64 {
+	return int64(min(l.state.MemoryLimit(), math.MaxInt64))
+}
+
+// IndexError is the value that [State] methods panic with
+// when given an invalid or unacceptable stack index.
+type IndexError = lua54.IndexError
+
+// CheckIndex returns an [*IndexError]
+// if idx is not an acceptable index for l.
+func (l *State) CheckIndex(idx int) error {
+	return l.state.CheckAcceptableIndex(idx)
+}
+
+// CatchIndexErrors calls f and returns its error.
+// If f panics with an [*IndexError],
+// CatchIndexErrors recovers and returns the IndexError instead.
+// State methods check their indices before modifying the stack,
+// so the State remains usable after such a panic.
+// Other panics are propagated.
+func CatchIndexErrors(f func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			e, ok := v.(*IndexError)
+			if !ok {
+				panic(v)
+			}
+			err = e
+		}
+	}()
+	return f()
+}
+
 // Close releases all resources associated with the state.
 // Making further calls to the State will create a new execution environment.
+// If any Go values referenced by the state were not released
+// by their finalizers during Close,
+// Close releases them and returns an error reporting the leak.
 func (l *State) Close() error {
 	return l.state.Close()
 }
 
+// HandleCount returns the number of Go values
+// (like functions pushed with [State.PushClosure])
+// that are currently referenced by the state,
+// including the methods of any metatables the state has registered.
+// Each such value is released when Lua garbage-collects the object that holds it.
+// HandleCount is intended for tests to detect leaks
+// by comparing counts before and after an operation.
+func (l *State) HandleCount() int {
+	return l.state.HandleCount()
+}
+
+// Version returns the version number of the Lua core
+// that is running the state.
+// This is equal to [VersionNum] for a state created by this package.
+func (l *State) Version() float64 {
+	return l.state.Version()
+}
+
+// NewThread creates a new thread, pushes it on the stack,
+// and returns a [*State] that represents this new thread.
+// The new thread shares with the original thread its global environment
+// but has an independent execution stack.
+// Threads are subject to garbage collection like any Lua object,
+// so the returned State is only valid while the thread is referenced
+// (for example, by remaining on the stack or in the registry).
+// Calling Close on a thread returns an error.
+func (l *State) NewThread() *State {
+	return (*State)(unsafe.Pointer(l.state.NewThread()))
+}
+
+// PushThread pushes the thread represented by l onto its own stack
+// and reports whether this thread is the main thread of its state.
+func (l *State) PushThread() bool {
+	return l.state.PushThread()
+}
+
+// ToThread converts the value at the given index to a Lua thread
+// (represented as a [*State]).
+// This value must be a thread; otherwise, ToThread returns nil.
+// As with [State.NewThread],
+// the returned State is only valid while the thread is referenced.
+// ToThread may return a different *State for each call,
+// even for the same thread.
+func (l *State) ToThread(idx int) *State {
+	return (*State)(unsafe.Pointer(l.state.ToThread(idx)))
+}
+
+// Status returns the status of the thread l.
+// The status can be [StatusOK] for a normal thread,
+// an error status if the thread finished the execution of [State.Resume] with an error,
+// or [StatusYield] if the thread is suspended.
+// You can call functions only in threads with status StatusOK.
+// You can resume threads with status StatusOK (to start a new coroutine)
+// or StatusYield (to resume a coroutine).
+func (l *State) Status() ThreadStatus {
+	return ThreadStatus(l.state.Status())
+}
+
+// Resume starts and resumes a coroutine in the thread l.
+//
+// To start a coroutine,
+// you push the main function plus any arguments onto the empty stack of the thread,
+// then you call Resume, with nArgs being the number of arguments.
+// This call returns when the coroutine suspends or finishes its execution.
+// When it returns, nResults is the number of values
+// on the top of the stack that were passed to coroutine.yield or returned by the body function,
+// and yielded reports whether the coroutine yielded.
+// In case of errors, the error object is on the top of the stack.
+//
+// To resume a coroutine,
+// you remove the nResults yielded values from its stack,
+// push the values to be passed as results from yield,
+// and then call Resume.
+//
+// The from parameter represents the coroutine that is resuming l.
+// If there is no such coroutine, this parameter can be nil.
+func (l *State) Resume(from *State, nArgs int) (nResults int, yielded bool, err error) {
+	var fromState *lua54.State
+	if from != nil {
+		fromState = &from.state
+	}
+	return l.state.Resume(fromState, nArgs)
+}
+
+// PushValueRef pushes the value that ref refers to onto the stack,
+// such as the error object of an [*Error],
+// so that it can be inspected or raised again.
+// PushValueRef returns false without pushing anything
+// if ref has been released with [State.ReleaseValueRef]
+// or if ref is not from l's state.
+func (l *State) PushValueRef(ref ValueRef) bool {
+	return l.state.PushValueRef(ref)
+}
+
+// ReleaseValueRef releases the error object that ref refers to
+// so that it can be garbage collected.
+// Every non-zero [Error.Value] should be released once it is no longer needed.
+// ReleaseValueRef does nothing if ref has already been released
+// or if ref is not from l's state.
+func (l *State) ReleaseValueRef(ref ValueRef) {
+	l.state.ReleaseValueRef(ref)
+}
+
+// SetErrorCapture sets what the [*Error] values
+// returned by l's state record about Lua errors.
+// By default, errors record neither a traceback nor the error object.
+// The setting is shared by all threads of the state.
+func (l *State) SetErrorCapture(capture ErrorCapture) {
+	l.state.SetErrorCapture(int(capture))
+}
+
+// ErrorCapture returns the flags set with [State.SetErrorCapture].
+func (l *State) ErrorCapture() ErrorCapture {
+	return ErrorCapture(l.state.ErrorCapture())
+}
+
+// IsYieldable reports whether the running coroutine can yield.
+// A coroutine cannot yield from the main thread
+// or from inside a function called with [State.Call] or [State.PCall].
+func (l *State) IsYieldable() bool {
+	return l.state.IsYieldable()
+}
+
+// Yield returns values that, when returned from a [Function],
+// yield the running coroutine with the nResults values on the top of the stack
+// as the results of [State.Resume] (or coroutine.resume).
+// Yield must only be called as the return statement of a Function:
+//
+//	return l.Yield(nResults)
+//
+// When the coroutine is resumed,
+// the Function is called again with the same stack,
+// except that the yielded values are replaced
+// by the values passed to Resume.
+// As such, a Function that yields no values and is resumed with no values
+// is called again with its original arguments.
+//
+// If the coroutine cannot yield (see [State.IsYieldable]),
+// then returning the result of Yield raises an error.
+func (l *State) Yield(nResults int) (int, error) {
+	return l.state.Yield(nResults)
+}
+
+// ResetThread resets the thread l,
+// cleaning its call stack and closing all pending to-be-closed variables.
+// After ResetThread, the thread has status [StatusOK] and an empty stack,
+// so it can be reused to run another coroutine.
+// ResetThread returns an error if the thread had stopped with an error
+// or if an error occurred while closing a variable.
+// In case of error, the error object is left on the top of the stack.
+// ResetThread panics if l is the main thread.
+func (l *State) ResetThread() error {
+	return l.state.ResetThread()
+}
+
 // AbsIndex converts the acceptable index idx
 // into an equivalent absolute index
 // (that is, one that does not depend on the stack size).
@@ -167,15 +490,54 @@ func (l *State) Top() int {
 // If the new top is greater than the old one,
 // then the new elements are filled with nil.
 // If idx is 0, then all stack elements are removed.
+// SetTop panics if it would remove a slot marked by [State.ToClose]
+// that has not been closed with [State.CloseSlot].
 func (l *State) SetTop(idx int) {
 	l.state.SetTop(idx)
 }
 
 // Pop pops n elements from the stack.
+// Like [State.SetTop], Pop panics if it would remove an unclosed to-be-closed slot.
 func (l *State) Pop(n int) {
 	l.state.Pop(n)
 }
 
+// ToClose marks the given index in the stack as a [to-be-closed slot].
+// Like a to-be-closed variable in Lua,
+// the value at that slot in the stack will be closed
+// when it goes out of scope.
+// Here, in the context of a Go function,
+// to go out of scope means that the running function returns to Lua,
+// or there is an error.
+// Outside of a Go function, the slot must be closed explicitly
+// with [State.CloseSlot] before it can be removed from the stack.
+// The value must have a __close metamethod or be a false value (nil or false);
+// ToClose panics otherwise.
+// ToClose also panics if idx is not above every other to-be-closed slot.
+//
+// A slot marked as to-be-closed should not be modified or removed
+// by any other function besides [State.CloseSlot].
+//
+// [to-be-closed slot]: https://www.lua.org/manual/5.4/manual.html#3.3.8
+func (l *State) ToClose(idx int) {
+	l.state.ToClose(idx)
+}
+
+// CloseSlot closes the to-be-closed slot at the given index
+// and sets its value to nil.
+// The index must be the last index previously marked to be closed
+// (see [State.ToClose]) that is still active (that is, not closed yet);
+// CloseSlot panics otherwise.
+//
+// If the value's __close metamethod raises an error,
+// CloseSlot catches it, pushes a single value on the stack (the error object),
+// and returns an error.
+// The slot is closed and set to nil in either case.
+// msgHandler has the same meaning as in [State.Call].
+func (l *State) CloseSlot(idx int, msgHandler int) error {
+	return l.state.CloseSlot(idx, msgHandler)
+}
+
 // PushValue pushes a copy of the element at the given index onto the stack.
 func (l *State) PushValue(idx int) {
 	l.state.PushValue(idx)
@@ -256,6 +618,21 @@ func (l *State) IsInteger(idx int) bool {
 	return l.state.IsInteger(idx)
 }
 
+// NumberKind reports whether the value at the given index
+// is an integer or a float.
+// Unlike [State.IsNumber], strings are never considered numbers,
+// so NumberKind returns [NumberKindNone] for any value that is not of [TypeNumber].
+func (l *State) NumberKind(idx int) NumberKind {
+	switch {
+	case l.Type(idx) != TypeNumber:
+		return NumberKindNone
+	case l.IsInteger(idx):
+		return NumberKindInteger
+	default:
+		return NumberKindFloat
+	}
+}
+
 // IsUserdata reports if the value at the given index is a userdata (either full or light).
 func (l *State) IsUserdata(idx int) bool {
 	return l.state.IsUserdata(idx)
@@ -391,6 +768,17 @@ func (l *State) PushString(s string) {
 	l.state.PushString(s)
 }
 
+// StringToNumber converts s to a number
+// following the [conversion rules] of Lua
+// and pushes that number onto the stack.
+// If s is not a valid numeral,
+// StringToNumber returns false and does not push anything.
+//
+// [conversion rules]: https://www.lua.org/manual/5.4/manual.html#3.4.3
+func (l *State) StringToNumber(s string) bool {
+	return l.state.StringToNumber(s)
+}
+
 // PushBoolean pushes a boolean onto the stack.
 func (l *State) PushBoolean(b bool) {
 	l.state.PushBoolean(b)
@@ -420,6 +808,13 @@ func (l *State) PushLightUserdata(p uintptr) {
 // Like a Lua function, a Go function called by Lua can also return many results.
 // To raise an error, return a Go error
 // and the string result of its Error() method will be used as the error object.
+// When that string is returned to Go by a method like [State.Call],
+// [errors.Is] and [errors.As] can find the original error.
+// The State only remembers the most recent such error,
+// so an error that Lua code catches and raises again
+// (for example, with position information added by Lua's error function)
+// is only a string.
+// [CaptureGoError] raises errors as userdata that keep the Go error instead.
 type Function func(*State) (int, error)
 
 // PushClosure pushes a Go closure onto the stack.
@@ -444,6 +839,20 @@ func (l *State) PushClosure(n int, f Function) {
 	l.state.PushClosure(n, g)
 }
 
+// ToGoFunction returns the Go function
+// that was passed to [State.PushClosure]
+// to create the value at the given index.
+// If the value is not a closure created from Go,
+// ToGoFunction returns nil.
+func (l *State) ToGoFunction(idx int) Function {
+	f := l.state.ToGoFunction(idx)
+	if f == nil {
+		return nil
+	}
+	// This should be safe because State and lua54.State are identical in layout.
+	return *(*Function)(unsafe.Pointer(&f))
+}
+
 // Global pushes onto the stack the value of the global with the given name,
 // returning the type of that value.
 //
@@ -505,6 +914,14 @@ func (l *State) Field(idx int, k string, msgHandler int) (Type, error) {
 	return Type(tp), err
 }
 
+// Index pushes onto the stack the value t[n],
+// where t is the value at the given index.
+// See [State.Table] for further information.
+func (l *State) Index(idx int, n int64, msgHandler int) (Type, error) {
+	tp, err := l.state.Index(idx, n, msgHandler)
+	return Type(tp), err
+}
+
 // RawGet pushes onto the stack t[k],
 // where t is the value at the given index
 // and k is the value on the top of the stack.
@@ -534,6 +951,22 @@ func (l *State) RawField(idx int, k string) Type {
 	return Type(l.state.RawField(idx, k))
 }
 
+// RawGetP pushes onto the stack the value t[k],
+// where t is the table at the given index
+// and k is the pointer p represented as a light userdata.
+// The access is raw, that is, it does not use the __index metavalue.
+// Returns the type of the pushed value.
+//
+// RawGetP and [State.RawSetP] are useful for storing private data in the registry
+// without colliding with other packages' string keys.
+// A common choice for p is the address of a package-level variable:
+//
+//	var myKey byte
+//	l.RawGetP(lua.RegistryIndex, uintptr(unsafe.Pointer(&myKey)))
+func (l *State) RawGetP(idx int, p uintptr) Type {
+	return Type(l.state.RawGetP(idx, p))
+}
+
 // CreateTable creates a new empty table and pushes it onto the stack.
 // nArr is a hint for how many elements the table will have as a sequence;
 // nRec is a hint for how many other elements the table will have.
@@ -635,6 +1068,15 @@ func (l *State) SetField(idx int, k string, msgHandler int) error {
 	return l.state.SetField(idx, k, msgHandler)
 }
 
+// SetIndex does the equivalent to t[n] = v,
+// where t is the value at the given index
+// and v is the value on the top of the stack.
+// This function pops the value from the stack.
+// See [State.SetTable] for more information.
+func (l *State) SetIndex(idx int, n int64, msgHandler int) error {
+	return l.state.SetIndex(idx, n, msgHandler)
+}
+
 // RawSet does the equivalent to t[k] = v,
 // where t is the value at the given index,
 // v is the value on the top of the stack,
@@ -653,6 +1095,16 @@ func (l *State) RawSetIndex(idx int, n int64) {
 	l.state.RawSetIndex(idx, n)
 }
 
+// RawSetP does the equivalent of t[k] = v,
+// where t is the table at the given index,
+// k is the pointer p represented as a light userdata,
+// and v is the value on the top of the stack.
+// This function pops the value from the stack.
+// The assignment is raw, that is, it does not use the __newindex metavalue.
+func (l *State) RawSetP(idx int, p uintptr) {
+	l.state.RawSetP(idx, p)
+}
+
 // RawSetField does the equivalent to t[k] = v,
 // where t is the value at the given index
 // and v is the value on the top of the stack.
@@ -712,8 +1164,15 @@ func (l *State) SetUserValue(idx int, n int) bool {
 // such as a stack traceback.
 // Such information cannot be gathered after the return of Call,
 // since by then the stack has unwound.
+//
+// If the call fails after the state's instruction quota has run out
+// (see [State.SetQuota]), the returned error matches [ErrQuotaExceeded].
 func (l *State) Call(nArgs, nResults, msgHandler int) error {
-	return l.state.Call(nArgs, nResults, msgHandler)
+	err := l.state.Call(nArgs, nResults, msgHandler)
+	if err != nil && l.quotaExceeded() {
+		return &interruptError{msg: err.Error(), err: err, cause: ErrQuotaExceeded}
+	}
+	return err
 }
 
 // Load loads a Lua chunk without running it.
@@ -729,6 +1188,8 @@ func (l *State) Call(nArgs, nResults, msgHandler int) error {
 // It may be the string "b" (only binary chunks),
 // "t" (only text chunks),
 // or "bt" (both binary and text).
+// If binary chunks are disabled with [State.SetAllowBinaryChunks],
+// "bt" is treated as "t" and "b" is an error.
 //
 // [debug information]: https://www.lua.org/manual/5.4/manual.html#4.7
 func (l *State) Load(r io.Reader, chunkName string, mode string) error {
@@ -742,6 +1203,64 @@ func (l *State) LoadString(s string, chunkName string, mode string) error {
 	return l.state.LoadString(s, chunkName, mode)
 }
 
+// LoadWithEnv loads a Lua chunk without running it
+// and sets the chunk's first upvalue to the value at envIdx,
+// so that the chunk uses that value (usually a table) as its environment (_ENV)
+// instead of the global table.
+// It otherwise behaves the same as [State.Load].
+// If the chunk has no upvalues, the environment is ignored.
+func (l *State) LoadWithEnv(r io.Reader, chunkName string, mode string, envIdx int) error {
+	envIdx = l.AbsIndex(envIdx)
+	if err := l.Load(r, chunkName, mode); err != nil {
+		return err
+	}
+	if !l.CheckStack(1) {
+		panic("stack overflow")
+	}
+	l.PushValue(envIdx)
+	l.SetUpvalue(-2, 1)
+	return nil
+}
+
+// SetAllowBinaryChunks sets whether the state loads binary (precompiled) chunks.
+// Binary chunks are allowed by default,
+// but Lua does not verify them,
+// so a malicious binary chunk can crash the program.
+// When allow is false, every way of loading a chunk rejects binary chunks:
+// [State.Load], [State.LoadString], [State.LoadBytecode],
+// and functions built on them like [LoadFile] and the searchers used by require,
+// as well as the load, loadfile, and dofile functions of the basic library.
+// To do so, disallowing binary chunks replaces those functions
+// and the package library's file searcher
+// in the libraries that have been loaded
+// (and in the libraries loaded afterward)
+// with ones that check the setting.
+// The setting applies to the state and all of its threads.
+func (l *State) SetAllowBinaryChunks(allow bool) {
+	l.state.SetAllowBinaryChunks(allow)
+	if !allow {
+		if err := restrictLoadedLibraries(l); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// AllowBinaryChunks reports whether the state loads binary chunks.
+// See [State.SetAllowBinaryChunks].
+func (l *State) AllowBinaryChunks() bool {
+	return l.state.AllowBinaryChunks()
+}
+
+// LoadBytecode loads a precompiled chunk (as produced by [State.Dump])
+// from memory without running it.
+// Before loading, LoadBytecode checks that the chunk's header
+// matches the Lua version, number sizes, and byte order of this package's Lua,
+// so that incompatible chunks are rejected with a descriptive error.
+// Otherwise, LoadBytecode behaves like [State.Load] with a mode of "b".
+func (l *State) LoadBytecode(b []byte, chunkName string) error {
+	return l.state.LoadBytecode(b, chunkName)
+}
+
 // Dump dumps a function as a binary chunk to the given writer.
 // Receives a Lua function on the top of the stack and produces a binary chunk that,
 // if loaded again, results in a function equivalent to the one dumped.
@@ -780,6 +1299,15 @@ func (l *State) GCCount() int64 {
 	return l.state.GCCount()
 }
 
+// MemoryStats returns a snapshot of the state's memory allocator counters.
+// The counters cover the state and all of its threads.
+// Collections counts the garbage collection cycles
+// (including minor collections in generational mode)
+// that have completed since the state was created.
+func (l *State) MemoryStats() MemoryStats {
+	return l.state.MemoryStats()
+}
+
 // GCStep performs an incremental step of garbage collection,
 // corresponding to the allocation of stepSize kibibytes.
 //
@@ -814,6 +1342,29 @@ func (l *State) GCGenerational(minorMul, majorMul int) {
 	l.state.GCGenerational(minorMul, majorMul)
 }
 
+// SetWarnHandler sets the function that receives [warnings]
+// emitted by the Lua warn function or by [State.Warning].
+// A message with toBeContinued set to true
+// should be continued by the message in the next call.
+// Control messages (messages starting with '@', like "@on" and "@off")
+// are passed to the handler unaltered.
+// If f is nil, then warnings are discarded.
+// A new State discards warnings.
+//
+// The handler is shared by all threads in the state.
+//
+// [warnings]: https://www.lua.org/manual/5.4/manual.html#pdf-warn
+func (l *State) SetWarnHandler(f func(msg string, toBeContinued bool)) {
+	l.state.SetWarnHandler(f)
+}
+
+// Warning emits a warning with the given message.
+// A message in a call with toBeContinued set to true
+// should be continued in another call to this function.
+func (l *State) Warning(msg string, toBeContinued bool) {
+	l.state.Warning(msg, toBeContinued)
+}
+
 // Next pops a key from the stack,
 // and pushes a key–value pair from the table at the given index,
 // the "next" pair after the given key.
@@ -860,6 +1411,50 @@ func (l *State) Len(idx, msgHandler int) error {
 	return l.state.Len(idx, msgHandler)
 }
 
+// Upvalue pushes the value of the n-th upvalue (1-based)
+// of the closure at funcIndex onto the stack
+// and returns the upvalue's name.
+// For Lua functions, upvalues are the external local variables
+// that the function uses and that are consequently included in its closure.
+// Upvalues of Go functions have an empty name.
+// If there is no upvalue n, Upvalue returns ok=false and pushes nothing.
+//
+// Upvalue can be used alongside [State.SetUpvalue] to inspect or patch closures,
+// such as replacing the _ENV upvalue of a Lua function to sandbox it.
+func (l *State) Upvalue(funcIndex int, n int) (name string, ok bool) {
+	return l.state.Upvalue(funcIndex, n)
+}
+
+// SetUpvalue assigns the value on the top of the stack
+// to the n-th upvalue (1-based) of the closure at funcIndex
+// and returns the upvalue's name.
+// SetUpvalue pops the value from the stack,
+// even if there is no upvalue n (in which case ok is false).
+func (l *State) SetUpvalue(funcIndex int, n int) (name string, ok bool) {
+	return l.state.SetUpvalue(funcIndex, n)
+}
+
+// UpvalueID returns a unique identifier for the n-th upvalue (1-based)
+// of the closure at funcIndex.
+// These identifiers allow a program to check
+// whether different closures share upvalues.
+// Lua closures that share an upvalue
+// (that is, that access the same external local variable)
+// will return identical IDs for those upvalue indices.
+// If there is no upvalue n, UpvalueID returns zero.
+// UpvalueID panics if the value at funcIndex is not a function.
+func (l *State) UpvalueID(funcIndex int, n int) uintptr {
+	return l.state.UpvalueID(funcIndex, n)
+}
+
+// UpvalueJoin makes the n1-th upvalue of the Lua closure at funcIndex1
+// refer to the n2-th upvalue of the Lua closure at funcIndex2.
+// UpvalueJoin panics if either value is not a Lua function
+// or does not have the given upvalue.
+func (l *State) UpvalueJoin(funcIndex1, n1, funcIndex2, n2 int) {
+	l.state.UpvalueJoin(funcIndex1, n1, funcIndex2, n2)
+}
+
 // Stack returns an identifier of the activation record
 // of the function executing at the given level.
 // Level 0 is the current running function,
@@ -960,6 +1555,188 @@ func (ar *ActivationRecord) Info(what string) *Debug {
 	return (*Debug)(ar.ar.Info(what))
 }
 
+// Local pushes the value of the n-th local variable
+// of the function invocation onto the stack
+// and returns the variable's name.
+// Local variables are numbered starting at 1
+// in the order they are declared,
+// considering only the variables that are active at the current point of execution.
+// Negative values of n refer to the invocation's vararg arguments,
+// where -1 is the first vararg argument.
+// Names starting with '(' represent variables with no known names
+// (such as loop control variables or temporaries).
+// If there is no such variable or the ActivationRecord is no longer valid,
+// then Local returns false and pushes nothing.
+func (ar *ActivationRecord) Local(n int) (name string, ok bool) {
+	if ar == nil {
+		return "", false
+	}
+	return ar.ar.Local(n)
+}
+
+// SetLocal pops a value from the stack,
+// assigns it to the n-th local variable of the function invocation,
+// and returns the variable's name.
+// n is interpreted the same as in [ActivationRecord.Local].
+// If there is no such variable, then SetLocal returns false
+// (but still pops the value).
+func (ar *ActivationRecord) SetLocal(n int) (name string, ok bool) {
+	if ar == nil {
+		return "", false
+	}
+	return ar.ar.SetLocal(n)
+}
+
+// HookEvent is an enumeration of the events that trigger a [Hook].
+type HookEvent int
+
+// Hook events.
+const (
+	// HookEventCall is the event for when the interpreter calls a function.
+	// The hook is called just after Lua enters the new function.
+	HookEventCall HookEvent = HookEvent(lua54.HookCall)
+	// HookEventReturn is the event for when the interpreter returns from a function.
+	// The hook is called just before Lua leaves the function.
+	HookEventReturn HookEvent = HookEvent(lua54.HookReturn)
+	// HookEventLine is the event for when the interpreter
+	// is about to start the execution of a new line of code,
+	// or when it jumps back in the code (even to the same line).
+	// This event only happens while Lua is executing a Lua function.
+	HookEventLine HookEvent = HookEvent(lua54.HookLine)
+	// HookEventCount is the event for when the interpreter
+	// has executed the number of instructions given to [State.SetHook].
+	// This event only happens while Lua is executing a Lua function.
+	HookEventCount HookEvent = HookEvent(lua54.HookCount)
+	// HookEventTailCall is the event for when the interpreter calls a function
+	// as a tail call.
+	// In this case, there will be no corresponding [HookEventReturn] event.
+	HookEventTailCall HookEvent = HookEvent(lua54.HookTailCall)
+)
+
+// String returns the name of the event as reported by [debug.gethook].
+//
+// [debug.gethook]: https://www.lua.org/manual/5.4/manual.html#pdf-debug.gethook
+func (event HookEvent) String() string {
+	switch event {
+	case HookEventCall:
+		return "call"
+	case HookEventReturn:
+		return "return"
+	case HookEventLine:
+		return "line"
+	case HookEventCount:
+		return "count"
+	case HookEventTailCall:
+		return "tail call"
+	default:
+		return fmt.Sprintf("lua.HookEvent(%d)", int(event))
+	}
+}
+
+// HookMask is a bitmask of events that trigger a [Hook].
+type HookMask int
+
+// Hook masks.
+const (
+	MaskCall   HookMask = HookMask(lua54.MaskCall)
+	MaskReturn HookMask = HookMask(lua54.MaskReturn)
+	MaskLine   HookMask = HookMask(lua54.MaskLine)
+	MaskCount  HookMask = HookMask(lua54.MaskCount)
+)
+
+// A Hook is a Go function that is called by the interpreter
+// for the events set by [State.SetHook].
+// ar can be used to obtain information about the running function
+// with [ActivationRecord.Info]:
+// for a [HookEventLine] event, the CurrentLine field has the new line number.
+// ar is only valid for the duration of the call to the Hook.
+//
+// While Lua is running a hook, it disables other calls to hooks.
+// Therefore, if a hook calls back Lua to execute a function or a chunk,
+// this execution occurs without any calls to hooks.
+//
+// If the hook returns an error,
+// then the error is raised in the running function
+// as if the function had raised the error.
+// As with a [Function], the Go error can be recovered
+// from the error returned by [State.Call] with [errors.Is] or [errors.As].
+type Hook func(l *State, event HookEvent, ar *ActivationRecord) error
+
+// SetHook sets the debugging hook function.
+//
+// mask specifies on which events the hook will be called:
+// it is formed by a bitwise OR of the Mask constants.
+// The count argument is only meaningful when the mask includes [MaskCount]:
+// in that case, the hook is called after the interpreter executes every count instructions.
+// If f is nil or mask is zero, then the hook is turned off.
+//
+// Hooks are set per-thread.
+// Coroutines that have not had their own hook set
+// use the main thread's hook.
+// SetHook does not affect the hooks added with [State.AddHook],
+// which the package uses to implement features like [State.SetQuota].
+func (l *State) SetHook(f Hook, mask HookMask, count int) {
+	if f == nil || mask == 0 {
+		l.state.SetHook(nil, nil, 0, 0)
+		return
+	}
+	l.state.SetHook(wrapHook(f), f, int(mask), count)
+}
+
+// wrapHook converts a [Hook] to a [lua54.Hook].
+func wrapHook(f Hook) lua54.Hook {
+	return func(l *lua54.State, event int, ar *lua54.ActivationRecord) error {
+		// This should be safe because State and lua54.State are identical in layout.
+		return f((*State)(unsafe.Pointer(l)), HookEvent(event), &ActivationRecord{ar})
+	}
+}
+
+// Hook returns the current hook function, hook mask, and hook count
+// (as passed to [State.SetHook]).
+// If hooks are turned off, Hook returns a nil function and a zero mask.
+func (l *State) Hook() (f Hook, mask HookMask, count int) {
+	orig, m, count := l.state.Hook()
+	f, _ = orig.(Hook)
+	return f, HookMask(m), count
+}
+
+// HookID identifies a hook added with [State.AddHook].
+type HookID uint64
+
+// AddHook adds a hook function that is called for the events in mask,
+// in addition to the hook set by [State.SetHook]
+// and any other hooks added with AddHook.
+// mask and count have the same meaning as in SetHook,
+// and each added hook keeps its own count of instructions.
+// Hooks are called in the order they were added,
+// after the hook set by SetHook.
+// If a hook returns an error, the remaining hooks are not called for the event.
+//
+// Unlike the hook set by SetHook, added hooks apply to the whole state,
+// so AddHook lets independent components (like a debugger and a quota)
+// observe execution without replacing each other's hooks.
+// Every coroutine of the state receives the events of added hooks,
+// including coroutines created before the call to AddHook.
+//
+// AddHook returns an identifier for the hook
+// that can be passed to [State.UpdateHook] and [State.RemoveHook].
+func (l *State) AddHook(f Hook, mask HookMask, count int) HookID {
+	return HookID(l.state.AddHook(wrapHook(f), int(mask), count))
+}
+
+// UpdateHook changes the events that a hook added with [State.AddHook] is called for.
+// Changing the count restarts the hook's count of instructions.
+// UpdateHook does nothing if the hook has been removed.
+func (l *State) UpdateHook(id HookID, mask HookMask, count int) {
+	l.state.UpdateHook(uint64(id), int(mask), count)
+}
+
+// RemoveHook removes a hook added with [State.AddHook].
+// RemoveHook does nothing if the hook has already been removed.
+func (l *State) RemoveHook(id HookID) {
+	l.state.RemoveHook(uint64(id))
+}
+
 // Standard library names.
 const (
 	GName = lua54.GName
@@ -22,8 +22,12 @@
 package lua
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"math"
 	"strings"
 	"testing"
 	"testing/iotest"
@@ -103,6 +107,41 @@ func TestLoadString(t *testing.T) {
 	}
 }
 
+func TestLoadWithEnv(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	state.CreateTable(0, 1)
+	state.PushInteger(40)
+	state.RawSetField(-2, "x")
+	const source = "y = x + 2; return y"
+	if err := state.LoadWithEnv(strings.NewReader(source), source, "t", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	const want = int64(42)
+	if got, ok := state.ToInteger(-1); got != want || !ok {
+		t.Errorf("state.ToInteger(-1) = %d, %t; want %d, true", got, ok, want)
+	}
+	state.Pop(1)
+	state.RawField(-1, "y")
+	if got, ok := state.ToInteger(-1); got != want || !ok {
+		t.Errorf("env.y = %d, %t; want %d, true", got, ok, want)
+	}
+	state.Pop(1)
+	if tp, err := state.Global("y", 0); err != nil {
+		t.Error(err)
+	} else if tp != TypeNil {
+		t.Errorf("global y is %v; want nil", tp)
+	}
+}
+
 func TestDump(t *testing.T) {
 	state := new(State)
 	defer func() {
@@ -276,73 +315,1507 @@ func TestPushClosure(t *testing.T) {
 	})
 }
 
-// TestStateRepresentation ensures that State has the same memory representation
-// as lua54.State.
-// This is critical for the correct functioning of [State.PushClosure],
-// which avoids allocating a new closure by using a func(*State) (int, error)
-// as a func(*lua54.State) (int, error).
-func TestStateRepresentation(t *testing.T) {
-	if got, want := unsafe.Offsetof(State{}.state), uintptr(0); got != want {
-		t.Errorf("unsafe.Offsetof(State{}.state) = %d; want %d", got, want)
+func TestUpvalue(t *testing.T) {
+	t.Run("Lua", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		const source = "local x = 1\nreturn function() return x end"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		name, ok := state.Upvalue(1, 1)
+		if name != "x" || !ok {
+			t.Fatalf("state.Upvalue(1, 1) = %q, %t; want \"x\", true", name, ok)
+		}
+		if got, _ := state.ToInteger(-1); got != 1 {
+			t.Errorf("x = %d; want 1", got)
+		}
+		state.Pop(1)
+		if name, ok := state.Upvalue(1, 2); ok {
+			t.Errorf("state.Upvalue(1, 2) = %q, %t; want _, false", name, ok)
+		}
+		if got, want := state.Top(), 1; got != want {
+			t.Errorf("after missing upvalue, state.Top() = %d; want %d", got, want)
+		}
+
+		state.PushInteger(42)
+		if name, ok := state.SetUpvalue(1, 1); name != "x" || !ok {
+			t.Errorf("state.SetUpvalue(1, 1) = %q, %t; want \"x\", true", name, ok)
+		}
+		state.PushValue(1)
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := state.ToInteger(-1); got != 42 {
+			t.Errorf("function returned %d after SetUpvalue; want 42", got)
+		}
+	})
+
+	t.Run("Go", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		state.PushString("foo")
+		state.PushClosure(1, func(l *State) (int, error) {
+			l.PushValue(UpvalueIndex(1))
+			return 1, nil
+		})
+		name, ok := state.Upvalue(1, 1)
+		if name != "" || !ok {
+			t.Fatalf("state.Upvalue(1, 1) = %q, %t; want \"\", true", name, ok)
+		}
+		if got, _ := state.ToString(-1); got != "foo" {
+			t.Errorf("upvalue 1 = %q; want \"foo\"", got)
+		}
+		state.Pop(1)
+		if name, ok := state.Upvalue(1, 2); ok {
+			t.Errorf("state.Upvalue(1, 2) = %q, %t; want _, false", name, ok)
+		}
+	})
+}
+
+func TestUpvalueJoin(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "local x, y = 1, 2\n" +
+		"local function f() return x end\n" +
+		"local function g() return x end\n" +
+		"local function h() return y end\n" +
+		"return f, g, h"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
 	}
-	if got, want := unsafe.Sizeof(State{}), unsafe.Sizeof(lua54.State{}); got != want {
-		t.Errorf("unsafe.Sizeof(State{}) = %d; want %d", got, want)
+	if err := state.Call(0, 3, 0); err != nil {
+		t.Fatal(err)
 	}
-	if got, want := unsafe.Alignof(State{}), unsafe.Alignof(lua54.State{}); got%want != 0 {
-		t.Errorf("unsafe.Alignof(State{}) = %d; want %d", got, want)
+	if state.UpvalueID(1, 1) != state.UpvalueID(2, 1) {
+		t.Error("f and g do not share upvalue x")
+	}
+	if state.UpvalueID(1, 1) == state.UpvalueID(3, 1) {
+		t.Error("f and h share an upvalue before join")
+	}
+	if got := state.UpvalueID(1, 2); got != 0 {
+		t.Errorf("state.UpvalueID(1, 2) = %#x; want 0", got)
+	}
+
+	state.UpvalueJoin(1, 1, 3, 1)
+	if state.UpvalueID(1, 1) != state.UpvalueID(3, 1) {
+		t.Error("f and h do not share an upvalue after join")
+	}
+	state.PushValue(1)
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToInteger(-1); got != 2 {
+		t.Errorf("f() = %d after join; want 2", got)
 	}
 }
 
-func BenchmarkExec(b *testing.B) {
+func TestError(t *testing.T) {
 	state := new(State)
 	defer func() {
 		if err := state.Close(); err != nil {
-			b.Error("Close:", err)
+			t.Error("Close:", err)
 		}
 	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
 
-	const source = "return 2 + 2"
-	for i := 0; i < b.N; i++ {
-		if err := state.LoadString(source, source, "t"); err != nil {
-			b.Fatal(err)
+	const source = "local function inner() error({code = 42}) end\n" +
+		"inner()"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	err := state.Call(0, 0, 0)
+	var luaErr *Error
+	if !errors.As(err, &luaErr) {
+		t.Fatalf("Call(...) = %v; want *Error", err)
+	}
+	state.Pop(1)
+	if luaErr.Traceback != "" {
+		t.Errorf("Traceback = %q without CaptureTraceback; want empty", luaErr.Traceback)
+	}
+	if state.PushValueRef(luaErr.Value) {
+		t.Error("PushValueRef(luaErr.Value) succeeded without CaptureValue")
+	}
+
+	state.SetErrorCapture(CaptureTraceback | CaptureValue)
+	if got, want := state.ErrorCapture(), CaptureTraceback|CaptureValue; got != want {
+		t.Errorf("ErrorCapture() = %v; want %v", got, want)
+	}
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	err = state.Call(0, 0, 0)
+	if !errors.As(err, &luaErr) {
+		t.Fatalf("Call(...) = %v; want *Error", err)
+	}
+	state.Pop(1)
+	if luaErr.Code != StatusRuntimeError {
+		t.Errorf("Code = %v; want %v", luaErr.Code, StatusRuntimeError)
+	}
+	if !strings.Contains(luaErr.Traceback, "stack traceback:") || !strings.Contains(luaErr.Traceback, "inner") {
+		t.Errorf("Traceback = %q; want traceback mentioning inner", luaErr.Traceback)
+	}
+	if !state.PushValueRef(luaErr.Value) {
+		t.Fatal("PushValueRef(luaErr.Value) = false")
+	}
+	if got := state.RawField(-1, "code"); got != TypeNumber {
+		t.Fatalf("error object code field is a %v", got)
+	}
+	if got, _ := state.ToInteger(-1); got != 42 {
+		t.Errorf("error object code = %d; want 42", got)
+	}
+	state.SetTop(0)
+
+	// Rethrow the same value from a Go function.
+	ref := luaErr.Value
+	state.PushClosure(0, func(l *State) (int, error) {
+		if !l.PushValueRef(ref) {
+			return 0, errors.New("error value not available")
 		}
-		if err := state.Call(0, 1, 0); err != nil {
-			b.Fatal(err)
+		return 1, nil
+	})
+	if err := state.SetGlobal("lasterror", 0); err != nil {
+		t.Fatal(err)
+	}
+	const rethrow = "local ok, e = pcall(function() error(lasterror()) end)\n" +
+		"return e.code"
+	if err := state.LoadString(rethrow, "=(rethrow)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToInteger(-1); got != 42 {
+		t.Errorf("rethrown error object code = %d; want 42", got)
+	}
+	state.SetTop(0)
+
+	// Error values are held until they are released.
+	for i := 0; i < 100; i++ {
+		if err := state.LoadString("error('x')", "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		err := state.Call(0, 0, 0)
+		if !errors.As(err, &luaErr) {
+			t.Fatalf("Call(...) = %v; want *Error", err)
 		}
 		state.Pop(1)
+		state.ReleaseValueRef(luaErr.Value)
+	}
+	if !state.PushValueRef(ref) {
+		t.Fatal("PushValueRef failed for unreleased error")
+	}
+	state.Pop(1)
+	state.ReleaseValueRef(ref)
+	if state.PushValueRef(ref) {
+		t.Error("PushValueRef succeeded for released error")
+	}
+	state.ReleaseValueRef(ref)
+	if state.PushValueRef(ValueRef{}) {
+		t.Error("PushValueRef succeeded for zero ValueRef")
 	}
 }
 
-func BenchmarkPushClosure(b *testing.B) {
-	b.ReportAllocs()
+type testErrorType struct {
+	msg string
+}
+
+func (e *testErrorType) Error() string {
+	return e.msg
+}
 
+func TestGoErrorRoundTrip(t *testing.T) {
 	state := new(State)
 	defer func() {
 		if err := state.Close(); err != nil {
-			b.Error("Close:", err)
+			t.Error("Close:", err)
 		}
 	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
 
-	f := Function(func(l *State) (int, error) { return 0, nil })
-	for i := 0; i < b.N; i++ {
-		state.PushClosure(0, f)
-		state.Pop(1)
+	errSentinel := errors.New("sentinel")
+	state.PushClosure(0, func(l *State) (int, error) {
+		return 0, fmt.Errorf("wrapped: %w", errors.Join(errSentinel, &testErrorType{"custom"}))
+	})
+	if err := state.SetGlobal("fail", 0); err != nil {
+		t.Fatal(err)
+	}
+	// callFromGo calls its arguments from Go and returns its error unchanged.
+	state.PushClosure(0, func(l *State) (int, error) {
+		return 0, l.Call(l.Top()-1, 0, 0)
+	})
+	if err := state.SetGlobal("callFromGo", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		capture   ErrorCapture
+		source    string
+		wantGoErr bool
+	}{
+		{name: "Direct", source: "fail()", wantGoErr: true},
+		{name: "ThroughGo", source: "callFromGo(fail)", wantGoErr: true},
+		{name: "RethrowSameValue", source: "local ok, err = pcall(fail); error(err, 0)", wantGoErr: true},
+		{name: "RethrowWithPosition", source: "local ok, err = pcall(fail); error(err)", wantGoErr: false},
+		{name: "LuaError", source: "error('wrapped: sentinel')", wantGoErr: false},
+		{name: "Capture/Direct", capture: CaptureGoError, source: "fail()", wantGoErr: true},
+		{name: "Capture/Rethrow", capture: CaptureGoError, source: "local ok, err = pcall(fail); error(err)", wantGoErr: true},
+		{name: "Capture/RethrowTwice", capture: CaptureGoError, source: "local ok, err = pcall(function() local _, e = pcall(fail); error(e) end); error(err)", wantGoErr: true},
+		{name: "Capture/ThroughGo", capture: CaptureGoError, source: "callFromGo(function() error(select(2, pcall(fail))) end)", wantGoErr: true},
+		{name: "Capture/SameMessage", capture: CaptureGoError, source: "local ok, err = pcall(fail); error(tostring(err), 0)", wantGoErr: false},
+		{name: "Capture/LuaError", capture: CaptureGoError, source: "error('wrapped: sentinel')", wantGoErr: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state.SetErrorCapture(test.capture)
+			defer state.SetErrorCapture(0)
+			if err := state.LoadString(test.source, "=(load)", "t"); err != nil {
+				t.Fatal(err)
+			}
+			err := state.Call(0, 0, 0)
+			if err == nil {
+				t.Fatal("Call did not return an error")
+			}
+			state.Pop(1)
+			if got := errors.Is(err, errSentinel); got != test.wantGoErr {
+				t.Errorf("errors.Is(%v, errSentinel) = %t; want %t", err, got, test.wantGoErr)
+			}
+			var custom *testErrorType
+			if got := errors.As(err, &custom) && custom.msg == "custom"; got != test.wantGoErr {
+				t.Errorf("errors.As(%v, &custom) = %t; want %t", err, got, test.wantGoErr)
+			}
+		})
+	}
+
+	if err := Require(state, StringLibraryName, true, OpenString); err != nil {
+		t.Fatal(err)
 	}
+	state.Pop(1)
+
+	t.Run("String", func(t *testing.T) {
+		const source = "local ok, err = pcall(fail)\n" +
+			"assert(not ok)\n" +
+			"assert(type(err) == 'string')\n" +
+			"assert(err == 'wrapped: sentinel\\ncustom')\n" +
+			"local t = {[err] = true}\n" +
+			"assert(t['wrapped: sentinel\\ncustom'])\n"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 0, 0); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Capture/Userdata", func(t *testing.T) {
+		state.SetErrorCapture(CaptureGoError)
+		defer state.SetErrorCapture(0)
+		const source = "local ok, err = pcall(fail)\n" +
+			"assert(not ok)\n" +
+			"assert(type(err) == 'userdata')\n" +
+			"assert(tostring(err) == 'wrapped: sentinel\\ncustom')\n" +
+			"assert('<' .. err .. '>' == '<wrapped: sentinel\\ncustom>')\n" +
+			"assert(err:find('sentinel', 1, true) == 10)\n"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 0, 0); err != nil {
+			t.Error(err)
+		}
+	})
 }
 
-func BenchmarkOpenLibraries(b *testing.B) {
-	b.ReportAllocs()
+func TestPanicError(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	// Setting a NaN key outside of any protected call
+	// raises an error that Lua cannot catch.
+	state.CreateTable(0, 0)
+	state.PushNumber(math.NaN())
+	state.PushInteger(1)
+	var got any
+	func() {
+		defer func() {
+			got = recover()
+		}()
+		state.RawSet(-3)
+	}()
+
+	e, ok := got.(*PanicError)
+	if !ok {
+		t.Fatalf("recovered %#v; want *PanicError", got)
+	}
+	if want := "table index is NaN"; e.Message != want {
+		t.Errorf("e.Message = %q; want %q", e.Message, want)
+	}
+	if got, want := e.Error(), "lua: unprotected error: table index is NaN"; got != want {
+		t.Errorf("e.Error() = %q; want %q", got, want)
+	}
+	if len(e.Stack) == 0 {
+		t.Error("e.Stack is empty")
+	}
+}
 
+func TestToGoFunction(t *testing.T) {
 	state := new(State)
 	defer func() {
 		if err := state.Close(); err != nil {
-			b.Error("Close:", err)
+			t.Error("Close:", err)
 		}
 	}()
 
-	for i := 0; i < b.N; i++ {
-		if err := OpenLibraries(state); err != nil {
-			b.Fatal(err)
+	called := false
+	state.PushString("up")
+	state.PushClosure(1, func(l *State) (int, error) {
+		called = true
+		return 0, nil
+	})
+	if err := state.LoadString("return 1", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	state.PushString("function")
+
+	f := state.ToGoFunction(1)
+	if f == nil {
+		t.Fatal("state.ToGoFunction(1) = nil; want closure")
+	}
+	if _, err := f(state); err != nil {
+		t.Error(err)
+	}
+	if !called {
+		t.Error("Function returned by ToGoFunction did not call original")
+	}
+	if got := state.ToGoFunction(2); got != nil {
+		t.Error("state.ToGoFunction(2) (Lua function) != nil")
+	}
+	if got := state.ToGoFunction(3); got != nil {
+		t.Error("state.ToGoFunction(3) (string) != nil")
+	}
+	if got, want := state.Top(), 3; got != want {
+		t.Errorf("state.Top() = %d; want %d", got, want)
+	}
+}
+
+func TestLoadBytecode(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	if err := state.LoadString("return 42", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	chunk := new(bytes.Buffer)
+	if _, err := state.Dump(chunk, true); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+
+	t.Run("Valid", func(t *testing.T) {
+		defer state.SetTop(0)
+		if err := state.LoadBytecode(chunk.Bytes(), "=(bytecode)"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := state.ToInteger(-1); got != 42 {
+			t.Errorf("result = %d; want 42", got)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+		want   string
+	}{
+		{
+			name:   "Text",
+			modify: func(b []byte) []byte { return []byte("return 42") },
+			want:   "not a binary chunk",
+		},
+		{
+			name:   "Truncated",
+			modify: func(b []byte) []byte { return b[:10] },
+			want:   "truncated",
+		},
+		{
+			name: "Version",
+			modify: func(b []byte) []byte {
+				b[4] = 0x53
+				return b
+			},
+			want: "version mismatch",
+		},
+		{
+			name: "IntegerSize",
+			modify: func(b []byte) []byte {
+				b[13] = 4
+				return b
+			},
+			want: "lua_Integer size mismatch",
+		},
+		{
+			name: "Endianness",
+			modify: func(b []byte) []byte {
+				for i, j := 15, 22; i < j; i, j = i+1, j-1 {
+					b[i], b[j] = b[j], b[i]
+				}
+				return b
+			},
+			want: "endianness",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer state.SetTop(0)
+			b := test.modify(bytes.Clone(chunk.Bytes()))
+			err := state.LoadBytecode(b, "=(bytecode)")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("LoadBytecode(...) = %v; want error containing %q", err, test.want)
+			}
+			if got := state.Top(); got != 1 {
+				t.Errorf("state.Top() = %d; want 1", got)
+			}
+		})
+	}
+}
+
+func TestHandleCount(t *testing.T) {
+	t.Run("Released", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		if got := state.HandleCount(); got != 0 {
+			t.Errorf("new state HandleCount() = %d; want 0", got)
+		}
+		push := func() {
+			t.Helper()
+			state.PushClosure(0, func(l *State) (int, error) { return 0, nil })
+			if err := PushBlob(state, []byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+			if err := PushReader(state, io.NopCloser(strings.NewReader("xyz"))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The first push registers metatables, whose methods are Go closures.
+		push()
+		state.SetTop(0)
+		state.GC()
+		base := state.HandleCount()
+
+		push()
+		if got, want := state.HandleCount(), base+3; got != want {
+			t.Errorf("HandleCount() = %d; want %d", got, want)
 		}
+		state.SetTop(0)
+		state.GC()
+		if got := state.HandleCount(); got != base {
+			t.Errorf("after GC, HandleCount() = %d; want %d", got, base)
+		}
+	})
+
+	t.Run("Leak", func(t *testing.T) {
+		state := new(State)
+		state.state.NewHandle("leaked")
+		if err := state.Close(); err == nil {
+			t.Error("Close did not report leaked handle")
+		}
+	})
+}
+
+func TestToClose(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	var closed []string
+	pushClosable := func(l *State, name string, err error) {
+		l.CreateTable(0, 0)
+		l.CreateTable(0, 1)
+		l.PushClosure(0, func(l *State) (int, error) {
+			closed = append(closed, name)
+			return 0, err
+		})
+		l.RawSetField(-2, "__close")
+		l.SetMetatable(-2)
+	}
+
+	t.Run("CloseSlot", func(t *testing.T) {
+		closed = nil
+		pushClosable(state, "a", nil)
+		state.ToClose(-1)
+		pushClosable(state, "b", nil)
+		state.ToClose(-1)
+		if err := state.CloseSlot(2, 0); err != nil {
+			t.Error("CloseSlot(2):", err)
+		}
+		if !state.IsNil(2) {
+			t.Errorf("after CloseSlot(2), slot is %v; want nil", state.Type(2))
+		}
+		if err := state.CloseSlot(1, 0); err != nil {
+			t.Error("CloseSlot(1):", err)
+		}
+		if got, want := strings.Join(closed, ","), "b,a"; got != want {
+			t.Errorf("closed = %q; want %q", got, want)
+		}
+		state.SetTop(0)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		closed = nil
+		pushClosable(state, "c", errors.New("bork"))
+		state.ToClose(1)
+		err := state.CloseSlot(1, 0)
+		if err == nil || !strings.Contains(err.Error(), "bork") {
+			t.Errorf("CloseSlot(1) = %v; want error containing \"bork\"", err)
+		}
+		if got, want := state.Top(), 2; got != want {
+			t.Errorf("state.Top() = %d; want %d", got, want)
+		}
+		if !state.IsNil(1) {
+			t.Errorf("after CloseSlot(1), slot is %v; want nil", state.Type(1))
+		}
+		state.SetTop(0)
+		if got, want := strings.Join(closed, ","), "c"; got != want {
+			t.Errorf("closed = %q; want %q", got, want)
+		}
+	})
+
+	t.Run("PopPanics", func(t *testing.T) {
+		pushClosable(state, "d", nil)
+		state.ToClose(1)
+		defer func() {
+			if recover() == nil {
+				t.Error("Pop did not panic")
+			}
+			if err := state.CloseSlot(1, 0); err != nil {
+				t.Error("CloseSlot(1):", err)
+			}
+			state.SetTop(0)
+		}()
+		state.Pop(1)
+	})
+
+	t.Run("GoFunction", func(t *testing.T) {
+		closed = nil
+		state.PushClosure(0, func(l *State) (int, error) {
+			pushClosable(l, "e", nil)
+			l.ToClose(-1)
+			return 0, nil
+		})
+		if err := state.Call(0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Join(closed, ","), "e"; got != want {
+			t.Errorf("closed = %q; want %q", got, want)
+		}
+	})
+}
+
+func TestThread(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(io.Discard, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, CoroutineLibraryName, true, OpenCoroutine); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	const source = "local x = coroutine.yield(1)\n" +
+		"if x == 'fail' then error('bork') end\n" +
+		"return x * 2"
+	thread := state.NewThread()
+	if state.ToThread(-1) == nil {
+		t.Fatal("state.ToThread(-1) = <nil>")
+	}
+	if got := state.ToThread(-1).Status(); got != StatusOK {
+		t.Errorf("new thread status = %v; want %v", got, StatusOK)
+	}
+
+	run := func(t *testing.T, arg string) (int64, error) {
+		t.Helper()
+		if err := thread.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		nResults, yielded, err := thread.Resume(state, 0)
+		if err != nil || !yielded || nResults != 1 {
+			t.Fatalf("first Resume(...) = %d, %t, %v; want 1, true, <nil>", nResults, yielded, err)
+		}
+		if got := thread.Status(); got != StatusYield {
+			t.Errorf("after yield, thread.Status() = %v; want %v", got, StatusYield)
+		}
+		thread.Pop(nResults)
+		if arg == "fail" {
+			thread.PushString(arg)
+		} else {
+			thread.PushInteger(21)
+		}
+		nResults, yielded, err = thread.Resume(state, 1)
+		if err != nil {
+			return 0, err
+		}
+		if yielded || nResults != 1 {
+			t.Fatalf("second Resume(...) = %d, %t, <nil>; want 1, false, <nil>", nResults, yielded)
+		}
+		n, _ := thread.ToInteger(-1)
+		thread.Pop(1)
+		return n, nil
+	}
+
+	if _, err := run(t, "fail"); err == nil || !strings.Contains(err.Error(), "bork") {
+		t.Errorf("Resume error = %v; want error containing \"bork\"", err)
+	}
+	if got := thread.Status(); got != StatusRuntimeError {
+		t.Errorf("after error, thread.Status() = %v; want %v", got, StatusRuntimeError)
+	}
+	if err := thread.ResetThread(); err == nil {
+		t.Error("ResetThread() = <nil>; want error")
+	}
+	thread.SetTop(0)
+	if got := thread.Status(); got != StatusOK {
+		t.Errorf("after ResetThread, thread.Status() = %v; want %v", got, StatusOK)
+	}
+
+	got, err := run(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 42 {
+		t.Errorf("coroutine returned %d; want 42", got)
+	}
+}
+
+func TestThreadStatus(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	if got := state.Status(); got != StatusOK {
+		t.Errorf("state.Status() = %v; want %v", got, StatusOK)
+	}
+	if err := state.LoadString("error('bork')", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err == nil {
+		t.Error("Call did not return an error")
+	}
+	if got := state.Status(); got != StatusOK {
+		t.Errorf("after protected error, state.Status() = %v; want %v", got, StatusOK)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("state.ResetThread() on main thread did not panic")
+			}
+		}()
+		state.ResetThread()
+	}()
+}
+
+func TestThreadStatusString(t *testing.T) {
+	tests := []struct {
+		status ThreadStatus
+		want   string
+	}{
+		{StatusOK, "ok"},
+		{StatusYield, "yield"},
+		{StatusRuntimeError, "runtime error"},
+		{StatusHandlerError, "error in error handling"},
+		{ThreadStatus(100), "lua.ThreadStatus(100)"},
+	}
+	for _, test := range tests {
+		if got := test.status.String(); got != test.want {
+			t.Errorf("ThreadStatus(%d).String() = %q; want %q", int(test.status), got, test.want)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "local log = {}\n" +
+		"local t = setmetatable({}, {\n" +
+		"  __index = function(t, n) return n * 10 end,\n" +
+		"  __newindex = function(t, n, v) log[#log + 1] = n .. '=' .. v end,\n" +
+		"})\n" +
+		"return t, log, setmetatable({}, {__index = function() error('boom') end})"
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if tp, err := state.Index(1, 4, 0); err != nil {
+		t.Error("Index:", err)
+	} else if tp != TypeNumber {
+		t.Errorf("state.Index(1, 4, 0) = %v; want %v", tp, TypeNumber)
+	} else if got, _ := state.ToInteger(-1); got != 40 {
+		t.Errorf("t[4] = %d; want 40", got)
+	}
+	state.Pop(1)
+
+	state.PushString("x")
+	if err := state.SetIndex(1, 7, 0); err != nil {
+		t.Error("SetIndex:", err)
+	}
+	if got, want := state.Top(), 3; got != want {
+		t.Errorf("after SetIndex, state.Top() = %d; want %d", got, want)
+	}
+	state.RawIndex(2, 1)
+	if got, _ := state.ToString(-1); got != "7=x" {
+		t.Errorf("log[1] = %q; want \"7=x\"", got)
+	}
+	state.Pop(1)
+
+	if _, err := state.Index(3, 1, 0); err == nil {
+		t.Error("Index with erroring metamethod did not return an error")
+	}
+	if got, want := state.Top(), 4; got != want {
+		t.Errorf("after Index error, state.Top() = %d; want %d", got, want)
+	}
+}
+
+func TestCatchIndexErrors(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	state.PushInteger(1)
+	if err := state.CheckIndex(1); err != nil {
+		t.Errorf("state.CheckIndex(1) = %v; want <nil>", err)
+	}
+	if err := state.CheckIndex(100); err == nil {
+		t.Error("state.CheckIndex(100) = <nil>; want error")
+	}
+
+	err := CatchIndexErrors(func() error {
+		state.PushValue(-5)
+		return nil
+	})
+	var indexErr *IndexError
+	if !errors.As(err, &indexErr) || indexErr.Index != -5 {
+		t.Errorf("CatchIndexErrors(...) = %v; want *IndexError for -5", err)
+	}
+	if got, want := state.Top(), 1; got != want {
+		t.Errorf("after caught panic, state.Top() = %d; want %d", got, want)
+	}
+
+	wantErr := errors.New("bork")
+	if err := CatchIndexErrors(func() error { return wantErr }); err != wantErr {
+		t.Errorf("CatchIndexErrors(return bork) = %v; want %v", err, wantErr)
+	}
+
+	defer func() {
+		if v := recover(); v != "other" {
+			t.Errorf("recovered %v; want \"other\"", v)
+		}
+	}()
+	CatchIndexErrors(func() error { panic("other") })
+}
+
+func TestRawGetP(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	var key1, key2 byte
+	p1 := uintptr(unsafe.Pointer(&key1))
+	p2 := uintptr(unsafe.Pointer(&key2))
+	state.PushString("foo")
+	state.RawSetP(RegistryIndex, p1)
+	if got := state.Top(); got != 0 {
+		t.Errorf("after RawSetP, state.Top() = %d; want 0", got)
+	}
+	if got, want := state.RawGetP(RegistryIndex, p1), TypeString; got != want {
+		t.Errorf("state.RawGetP(RegistryIndex, &key1) = %v; want %v", got, want)
+	} else if s, _ := state.ToString(-1); s != "foo" {
+		t.Errorf("registry[&key1] = %q; want \"foo\"", s)
+	}
+	if got, want := state.RawGetP(RegistryIndex, p2), TypeNil; got != want {
+		t.Errorf("state.RawGetP(RegistryIndex, &key2) = %v; want %v", got, want)
+	}
+	state.PushLightUserdata(p1)
+	if got, want := state.RawGet(RegistryIndex), TypeString; got != want {
+		t.Errorf("registry[lightuserdata(&key1)] = %v; want %v", got, want)
+	}
+}
+
+func TestPushThread(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, CoroutineLibraryName, true, OpenCoroutine); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	if !state.PushThread() {
+		t.Error("state.PushThread() = false for main thread")
+	}
+	if !state.IsThread(-1) {
+		t.Errorf("pushed value is a %v; want thread", state.Type(-1))
+	}
+	state.Pop(1)
+
+	// Create a coroutine in Lua and resume it from Go.
+	const source = "return coroutine.create(function(a) local b = coroutine.yield(a + 1); return b * 2 end)"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	co := state.ToThread(-1)
+	if co == nil {
+		t.Fatalf("state.ToThread(-1) = <nil> for %v", state.Type(-1))
+	}
+	if co.PushThread() {
+		t.Error("co.PushThread() = true for coroutine")
+	}
+	co.Pop(1)
+	co.PushInteger(1)
+	if n, yielded, err := co.Resume(state, 1); err != nil || !yielded || n != 1 {
+		t.Fatalf("co.Resume(state, 1) = %d, %t, %v; want 1, true, <nil>", n, yielded, err)
+	}
+	if got, _ := co.ToInteger(-1); got != 2 {
+		t.Errorf("yielded %d; want 2", got)
+	}
+	co.Pop(1)
+	co.PushInteger(21)
+	if n, yielded, err := co.Resume(state, 1); err != nil || yielded || n != 1 {
+		t.Fatalf("co.Resume(state, 1) = %d, %t, %v; want 1, false, <nil>", n, yielded, err)
+	}
+	if got, _ := co.ToInteger(-1); got != 42 {
+		t.Errorf("returned %d; want 42", got)
+	}
+}
+
+func TestYield(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	// f yields its call count until it has been called three times.
+	calls := 0
+	f := func(l *State) (int, error) {
+		calls++
+		if !l.IsYieldable() {
+			return 0, errors.New("not yieldable")
+		}
+		if calls < 3 {
+			l.PushInteger(int64(calls))
+			return l.Yield(1)
+		}
+		return l.Top(), nil
+	}
+
+	thread := state.NewThread()
+	thread.PushClosure(0, f)
+	thread.PushString("arg")
+	for i := int64(1); i < 3; i++ {
+		nResults, yielded, err := thread.Resume(state, 1)
+		if err != nil || !yielded || nResults != 1 {
+			t.Fatalf("Resume #%d = %d, %t, %v; want 1, true, <nil>", i, nResults, yielded, err)
+		}
+		if got, _ := thread.ToInteger(-1); got != i {
+			t.Errorf("Resume #%d yielded %d; want %d", i, got, i)
+		}
+		thread.Pop(1)
+		thread.PushString("resume")
+	}
+	nResults, yielded, err := thread.Resume(state, 1)
+	if err != nil || yielded {
+		t.Fatalf("last Resume = %d, %t, %v; want _, false, <nil>", nResults, yielded, err)
+	}
+	// The stack has the original argument and the values from each resume.
+	if nResults != 3 {
+		t.Errorf("nResults = %d; want 3", nResults)
+	}
+	if got, _ := thread.ToString(-nResults); got != "arg" {
+		t.Errorf("first result = %q; want \"arg\"", got)
+	}
+	if calls != 3 {
+		t.Errorf("f called %d times; want 3", calls)
+	}
+
+	// Yielding from the main thread is an error.
+	state.SetTop(0)
+	if state.IsYieldable() {
+		t.Error("main thread is yieldable")
+	}
+	state.PushClosure(0, func(l *State) (int, error) {
+		return l.Yield(0)
+	})
+	if err := state.Call(0, 0, 0); err == nil {
+		t.Error("yielding from main thread did not return an error")
+	}
+}
+
+// TestStateRepresentation ensures that State has the same memory representation
+// as lua54.State.
+// This is critical for the correct functioning of [State.PushClosure],
+// which avoids allocating a new closure by using a func(*State) (int, error)
+// as a func(*lua54.State) (int, error).
+func TestStateRepresentation(t *testing.T) {
+	if got, want := unsafe.Offsetof(State{}.state), uintptr(0); got != want {
+		t.Errorf("unsafe.Offsetof(State{}.state) = %d; want %d", got, want)
+	}
+	if got, want := unsafe.Sizeof(State{}), unsafe.Sizeof(lua54.State{}); got != want {
+		t.Errorf("unsafe.Sizeof(State{}) = %d; want %d", got, want)
+	}
+	if got, want := unsafe.Alignof(State{}), unsafe.Alignof(lua54.State{}); got%want != 0 {
+		t.Errorf("unsafe.Alignof(State{}) = %d; want %d", got, want)
+	}
+}
+
+func BenchmarkExec(b *testing.B) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			b.Error("Close:", err)
+		}
+	}()
+
+	const source = "return 2 + 2"
+	for i := 0; i < b.N; i++ {
+		if err := state.LoadString(source, source, "t"); err != nil {
+			b.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			b.Fatal(err)
+		}
+		state.Pop(1)
+	}
+}
+
+func BenchmarkPushClosure(b *testing.B) {
+	b.ReportAllocs()
+
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			b.Error("Close:", err)
+		}
+	}()
+
+	f := Function(func(l *State) (int, error) { return 0, nil })
+	for i := 0; i < b.N; i++ {
+		state.PushClosure(0, f)
+		state.Pop(1)
+	}
+}
+
+func BenchmarkOpenLibraries(b *testing.B) {
+	b.ReportAllocs()
+
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			b.Error("Close:", err)
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		if err := OpenLibraries(state); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	if got, want := state.Version(), float64(VersionNum); got != want {
+		t.Errorf("state.Version() = %g; want %g", got, want)
+	}
+}
+
+func TestNumberKind(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	state.PushInteger(42)
+	state.PushNumber(42)
+	state.PushString("42")
+	state.PushNil()
+	want := []NumberKind{
+		NumberKindInteger,
+		NumberKindFloat,
+		NumberKindNone,
+		NumberKindNone,
+	}
+	for i, want := range want {
+		if got := state.NumberKind(i + 1); got != want {
+			t.Errorf("state.NumberKind(%d) = %v; want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestSetWarnHandler(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(io.Discard, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+
+	type warning struct {
+		msg           string
+		toBeContinued bool
+	}
+	var got []warning
+	state.SetWarnHandler(func(msg string, toBeContinued bool) {
+		got = append(got, warning{msg, toBeContinued})
+	})
+	if err := state.LoadString(`warn("Hello, ", "World")`, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	state.Warning("from Go", false)
+
+	want := []warning{
+		{"Hello, ", true},
+		{"World", false},
+		{"from Go", false},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("warnings = %+v; want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("warnings[%d] = %+v; want %+v", i, got[i], want[i])
+		}
+	}
+
+	state.SetWarnHandler(nil)
+	got = nil
+	state.Warning("ignored", false)
+	if len(got) > 0 {
+		t.Errorf("after SetWarnHandler(nil), warnings = %+v; want []", got)
+	}
+}
+
+func TestSetHook(t *testing.T) {
+	t.Run("Line", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		var lines []int
+		state.SetHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+			if event != HookEventLine {
+				t.Errorf("event = %v; want %v", event, HookEventLine)
+			}
+			lines = append(lines, ar.Info("l").CurrentLine)
+			return nil
+		}, MaskLine, 0)
+		if f, mask, _ := state.Hook(); f == nil || mask != MaskLine {
+			t.Errorf("state.Hook() = %p, %v, _; want <non-nil>, %v, _", f, mask, MaskLine)
+		}
+		const source = "local x = 1\nx = x + 1\nreturn x\n"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		want := []int{1, 2, 3}
+		if len(lines) != len(want) {
+			t.Fatalf("lines = %v; want %v", lines, want)
+		}
+		for i := range want {
+			if lines[i] != want[i] {
+				t.Errorf("lines = %v; want %v", lines, want)
+				break
+			}
+		}
+
+		state.SetHook(nil, 0, 0)
+		if f, mask, _ := state.Hook(); f != nil || mask != 0 {
+			t.Errorf("after clearing, state.Hook() = %p, %v, _; want <nil>, 0, _", f, mask)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		const message = "too many instructions"
+		state.SetHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+			return errors.New(message)
+		}, MaskCount, 1000)
+		if err := state.LoadString("while true do end", "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		err := state.Call(0, 0, 0)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("state.Call(...) = %v; want %q", err, message)
+		}
+	})
+}
+
+func TestAddHook(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	var setLines, addedLines, counts int
+	state.SetHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		setLines++
+		return nil
+	}, MaskLine, 0)
+	lineHook := state.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		if event != HookEventLine {
+			t.Errorf("line hook event = %v; want %v", event, HookEventLine)
+		}
+		addedLines++
+		return nil
+	}, MaskLine, 0)
+	countHook := state.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		if event != HookEventCount {
+			t.Errorf("count hook event = %v; want %v", event, HookEventCount)
+		}
+		counts++
+		return nil
+	}, MaskCount, 1)
+
+	const source = "local x = 1\nx = x + 1\nreturn x\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+	if setLines != 3 {
+		t.Errorf("SetHook hook saw %d lines; want 3", setLines)
+	}
+	if addedLines != 3 {
+		t.Errorf("added line hook saw %d lines; want 3", addedLines)
+	}
+	if counts == 0 {
+		t.Error("added count hook not called")
+	}
+
+	state.RemoveHook(lineHook)
+	state.RemoveHook(countHook)
+	state.SetHook(nil, 0, 0)
+	setLines, addedLines, counts = 0, 0, 0
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if setLines != 0 || addedLines != 0 || counts != 0 {
+		t.Errorf("after removing hooks, hooks saw %d, %d, and %d events; want 0", setLines, addedLines, counts)
+	}
+}
+
+func TestActivationRecordLocal(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	state.SetHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		if ar.Info("l").CurrentLine != 3 {
+			return nil
+		}
+		got := make(map[string]int64)
+		for n := 1; ; n++ {
+			name, ok := ar.Local(n)
+			if !ok {
+				break
+			}
+			if !strings.HasPrefix(name, "(") {
+				got[name], _ = l.ToInteger(-1)
+			}
+			l.Pop(1)
+		}
+		if want := map[string]int64{"x": 1, "y": 2}; !maps.Equal(got, want) {
+			t.Errorf("locals = %v; want %v", got, want)
+		}
+		l.PushInteger(40)
+		if name, ok := ar.SetLocal(2); name != "y" || !ok {
+			t.Errorf("ar.SetLocal(2) = %q, %t; want \"y\", true", name, ok)
+		}
+		if _, ok := ar.Local(100); ok {
+			l.Pop(1)
+			t.Error("ar.Local(100) found a variable")
+		}
+		return nil
+	}, MaskLine, 0)
+	const source = "local x = 1\nlocal y = 2\nreturn x + y\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToInteger(-1); got != 41 {
+		t.Errorf("result = %d; want 41", got)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := SelfTest(state); err != nil {
+		t.Error(err)
+	}
+	if got := state.Top(); got != 0 {
+		t.Errorf("after SelfTest, state.Top() = %d; want 0", got)
+	}
+	if tp, err := state.Global("test", 0); err != nil || tp != TypeNil {
+		t.Errorf("global test = %v, %v; want nil, <nil>", tp, err)
+	}
+}
+
+func TestStringToNumber(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	tests := []struct {
+		s         string
+		want      string
+		isInteger bool
+		ok        bool
+	}{
+		{s: "42", want: "42", isInteger: true, ok: true},
+		{s: " 0x10 ", want: "16", isInteger: true, ok: true},
+		{s: "1.5", want: "1.5", ok: true},
+		{s: "1e2", want: "100.0", ok: true},
+		{s: "1e", ok: false},
+		{s: "abc", ok: false},
+		{s: "1\x002", ok: false},
+	}
+	for _, test := range tests {
+		top := state.Top()
+		ok := state.StringToNumber(test.s)
+		if ok != test.ok {
+			t.Errorf("state.StringToNumber(%q) = %t; want %t", test.s, ok, test.ok)
+			state.SetTop(top)
+			continue
+		}
+		if !ok {
+			if got := state.Top(); got != top {
+				t.Errorf("after failed state.StringToNumber(%q), state.Top() = %d; want %d", test.s, got, top)
+			}
+			continue
+		}
+		if got := state.IsInteger(-1); got != test.isInteger {
+			t.Errorf("state.StringToNumber(%q) pushed integer = %t; want %t", test.s, got, test.isInteger)
+		}
+		if got, _ := state.ToString(-1); got != test.want {
+			t.Errorf("state.StringToNumber(%q) pushed %s; want %s", test.s, got, test.want)
+		}
+		state.SetTop(top)
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if got := state.MemoryStats(); got != (MemoryStats{}) {
+		t.Errorf("new(State).MemoryStats() = %+v; want zero", got)
+	}
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	before := state.MemoryStats()
+	if before.InUse == 0 || before.Peak < before.InUse || before.Allocs == 0 {
+		t.Errorf("after OpenLibraries, MemoryStats() = %+v", before)
+	}
+	if got, want := before.InUse, uint64(state.GCCount()); got != want {
+		t.Errorf("MemoryStats().InUse = %d; want GCCount() = %d", got, want)
+	}
+
+	if err := state.LoadString(`local t = {}; for i = 1, 1000 do t[i] = "x" .. i end`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	state.GC()
+	state.GC()
+	after := state.MemoryStats()
+	if after.Peak <= before.Peak {
+		t.Errorf("Peak = %d after filling table; want > %d", after.Peak, before.Peak)
+	}
+	if after.InUse >= after.Peak {
+		t.Errorf("after GC, InUse = %d; want < Peak (%d)", after.InUse, after.Peak)
+	}
+	if after.TotalAlloc-before.TotalAlloc < after.Peak-before.Peak {
+		t.Errorf("TotalAlloc increased by %d; want >= %d (increase in Peak)", after.TotalAlloc-before.TotalAlloc, after.Peak-before.Peak)
+	}
+	if after.Allocs-before.Allocs < 1000 {
+		t.Errorf("Allocs increased by %d; want >= 1000", after.Allocs-before.Allocs)
+	}
+	if after.Frees <= before.Frees {
+		t.Errorf("Frees = %d after GC; want > %d", after.Frees, before.Frees)
+	}
+	if after.Collections < before.Collections+2 {
+		t.Errorf("Collections = %d after 2 GC calls; want >= %d", after.Collections, before.Collections+2)
+	}
+}
+
+func TestNewStateWithLimit(t *testing.T) {
+	const limit = 1 << 20
+	state := NewStateWithLimit(limit)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, StringLibraryName, true, OpenString); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	if err := state.LoadString(`return #string.rep("x", 1000)`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	if err := state.LoadString(`local t = {}; for i = 1, 1e9 do t[i] = string.rep("x", 100) .. i end`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	err := state.Call(0, 0, 0)
+	if !IsOutOfMemory(err) {
+		t.Errorf("filling table: %v; want out of memory error", err)
+	}
+	state.SetTop(0)
+	state.GC()
+	if got := state.GCCount(); got > limit {
+		t.Errorf("state.GCCount() = %d; want <= %d", got, limit)
+	}
+
+	// The state is still usable after running out of memory.
+	if err := state.LoadString(`return 1 + 1`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
 	}
 }
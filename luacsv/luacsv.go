@@ -0,0 +1,223 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package luacsv provides a Lua module for encoding CSV records.
+//
+// A record is a sequence of fields: the elements 1 through #record
+// of a table, read without invoking metamethods.
+// Each field must be a string or a number.
+// Numbers are formatted in the same way as tostring.
+// Records are encoded as described in [encoding/csv],
+// with fields separated by commas and records terminated by a newline.
+//
+// # Lua API
+//
+// [Open] loads a module with the following members:
+//
+//   - csv.encode(records) returns the CSV encoding
+//     of the sequence of records as a string.
+//   - csv.write(file, records) writes the CSV encoding
+//     of the sequence of records to file
+//     (any value with a write method, like the files of the io library)
+//     in pieces, without building the whole string in memory.
+//     It returns file.
+//   - csv.writerows(file, f [, s [, ctrl]]) writes the records
+//     produced by the iterator f, s, ctrl to file
+//     as in a generic for loop.
+//     Each record is the last value returned by a call to the iterator,
+//     so both ipairs(t) and functions that return one value at a time work.
+//     Records are written as they are produced,
+//     and writerows stops at the first failed write.
+//     It returns file.
+//
+// All of the functions raise an error if a record cannot be encoded
+// or a write fails.
+package luacsv
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/lua"
+)
+
+// ModuleName is the conventional name of the module loaded by [Open].
+const ModuleName = "csv"
+
+// Open is a [lua.Function] that pushes a new table with the csv module's functions
+// as described in the package documentation.
+// It is intended to be used with [lua.Require]:
+//
+//	err := lua.Require(l, luacsv.ModuleName, true, luacsv.Open)
+func Open(l *lua.State) (int, error) {
+	err := lua.NewLib(l, map[string]lua.Function{
+		"encode":    encode,
+		"write":     write,
+		"writerows": writeRows,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func encode(l *lua.State) (int, error) {
+	if l.Type(1) != lua.TypeTable {
+		return 0, lua.NewTypeError(l, 1, lua.TypeTable.String())
+	}
+	sb := new(strings.Builder)
+	w := csv.NewWriter(sb)
+	if err := writeRecords(w, l, 1); err != nil {
+		return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+	}
+	w.Flush()
+	l.PushString(sb.String())
+	return 1, nil
+}
+
+func write(l *lua.State) (int, error) {
+	if l.IsNone(1) {
+		return 0, lua.NewArgError(l, 1, "value expected")
+	}
+	if l.Type(2) != lua.TypeTable {
+		return 0, lua.NewTypeError(l, 2, lua.TypeTable.String())
+	}
+	l.SetTop(2)
+	w := csv.NewWriter(&fileWriter{l: l, idx: 1})
+	err := writeRecords(w, l, 2)
+	if err == nil {
+		w.Flush()
+		err = w.Error()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+	}
+	l.SetTop(1)
+	return 1, nil
+}
+
+func writeRows(l *lua.State) (int, error) {
+	if l.IsNone(1) {
+		return 0, lua.NewArgError(l, 1, "value expected")
+	}
+	if l.IsNone(2) {
+		return 0, lua.NewArgError(l, 2, "value expected")
+	}
+	l.SetTop(4)
+	w := csv.NewWriter(&fileWriter{l: l, idx: 1})
+	for i := int64(1); ; i++ {
+		if !l.CheckStack(3) {
+			return 0, errors.New("stack overflow")
+		}
+		l.PushValue(2)
+		l.PushValue(3)
+		l.PushValue(4)
+		if err := l.Call(2, lua.MultipleReturns, 0); err != nil {
+			return 0, err
+		}
+		if l.Top() == 4 || l.IsNil(5) {
+			break
+		}
+		if err := writeRecord(w, l, l.Top(), i); err != nil {
+			return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+		}
+		// Flush after every record so that records are written
+		// as they are produced and a failed write stops the iteration.
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+		}
+		l.Copy(5, 4)
+		l.SetTop(4)
+	}
+	l.SetTop(1)
+	return 1, nil
+}
+
+// writeRecords writes the elements 1 through #t
+// of the table at the absolute index idx to w as records.
+func writeRecords(w *csv.Writer, l *lua.State, idx int) error {
+	n := int64(l.RawLen(idx))
+	for i := int64(1); i <= n; i++ {
+		if !l.CheckStack(1) {
+			return errors.New("stack overflow")
+		}
+		l.RawIndex(idx, i)
+		err := writeRecord(w, l, l.Top(), i)
+		l.Pop(1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecord writes the record at the absolute index idx to w.
+// i is the position of the record, used in error messages.
+func writeRecord(w *csv.Writer, l *lua.State, idx int, i int64) error {
+	if tp := l.Type(idx); tp != lua.TypeTable {
+		return fmt.Errorf("[%d]: record is a %v", i, tp)
+	}
+	if !l.CheckStack(1) {
+		return errors.New("stack overflow")
+	}
+	fields := make([]string, l.RawLen(idx))
+	for j := range fields {
+		tp := l.RawIndex(idx, int64(j)+1)
+		if tp != lua.TypeString && tp != lua.TypeNumber {
+			l.Pop(1)
+			return fmt.Errorf("[%d][%d]: cannot encode %v", i, j+1, tp)
+		}
+		fields[j], _ = l.ToString(-1)
+		l.Pop(1)
+	}
+	return w.Write(fields)
+}
+
+// fileWriter is an [io.Writer] that calls the write method
+// of the value at idx.
+type fileWriter struct {
+	l   *lua.State
+	idx int
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	l := fw.l
+	if !l.CheckStack(3) {
+		return 0, errors.New("stack overflow")
+	}
+	if _, err := l.Field(fw.idx, "write", 0); err != nil {
+		return 0, err
+	}
+	l.PushValue(fw.idx)
+	l.PushString(string(p))
+	if err := l.Call(2, 2, 0); err != nil {
+		return 0, err
+	}
+	defer l.Pop(2)
+	if l.IsNil(-2) {
+		msg, _ := l.ToString(-1)
+		return 0, errors.New(msg)
+	}
+	return len(p), nil
+}
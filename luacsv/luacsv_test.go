@@ -0,0 +1,172 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package luacsv
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/lua"
+)
+
+func newTestState(t *testing.T) *lua.State {
+	t.Helper()
+	state := new(lua.State)
+	t.Cleanup(func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	})
+	if err := lua.Require(state, lua.GName, true, lua.NewOpenBase(io.Discard, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.Require(state, ModuleName, true, Open); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+	return state
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{`{}`, ``},
+		{`{{"a", "b"}, {"c", "d"}}`, "a,b\nc,d\n"},
+		{`{{1, 2.5, "x"}}`, "1,2.5,x\n"},
+		{`{{"a,b", 'say "hi"', "two\nlines"}}`, "\"a,b\",\"say \"\"hi\"\"\",\"two\nlines\"\n"},
+	}
+	state := newTestState(t)
+	for _, test := range tests {
+		if err := state.LoadString("return csv.encode("+test.expr+")", "=(test)", "t"); err != nil {
+			t.Errorf("csv.encode(%s): %v", test.expr, err)
+			continue
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Errorf("csv.encode(%s): %v", test.expr, err)
+			state.SetTop(0)
+			continue
+		}
+		if got, _ := state.ToString(-1); got != test.want {
+			t.Errorf("csv.encode(%s) = %q; want %q", test.expr, got, test.want)
+		}
+		state.SetTop(0)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	const prelude = "local out = {}\n" +
+		"function out:write(s) self[#self + 1] = s; return self end\n" +
+		"local function gen(n) local i = 0; return function() i = i + 1; if i <= n then return {i, i * i} end end end\n" +
+		"local big = {}; for i = 1, 2000 do big[i] = {i, 'some text'} end\n"
+	tests := []struct {
+		stmt       string
+		want       string
+		manyWrites bool
+	}{
+		{`csv.write(out, {{"a", 1}, {"b", 2}})`, "a,1\nb,2\n", false},
+		{`csv.write(out, {})`, "", false},
+		{`csv.writerows(out, ipairs({{"x"}, {"y", "z"}}))`, "x\ny,z\n", false},
+		{`csv.writerows(out, gen(3))`, "1,1\n2,4\n3,9\n", false},
+		{`csv.writerows(out, gen(0))`, "", false},
+		{`csv.writerows(out, gen(3))`, "", true},
+		{`csv.write(out, big)`, "", true},
+	}
+	state := newTestState(t)
+	for _, test := range tests {
+		source := prelude +
+			"assert(" + test.stmt + " == out)\n" +
+			"local s = ''; for _, chunk in ipairs(out) do s = s .. chunk end\n" +
+			"return s, #out"
+		if err := state.LoadString(source, "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.stmt, err)
+			continue
+		}
+		if err := state.Call(0, 2, 0); err != nil {
+			t.Errorf("%s: %v", test.stmt, err)
+			continue
+		}
+		got, _ := state.ToString(1)
+		nWrites, _ := state.ToInteger(2)
+		if !test.manyWrites && got != test.want {
+			t.Errorf("%s wrote %q; want %q", test.stmt, got, test.want)
+		}
+		if test.manyWrites && nWrites < 2 {
+			t.Errorf("%s called write %d times; want several", test.stmt, nWrites)
+		}
+		state.SetTop(0)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{`csv.write({write = function() return nil, "disk full" end}, {{"a"}})`, "disk full"},
+		{`csv.writerows({write = function() return nil, "disk full" end}, ipairs({{"a"}}))`, "disk full"},
+		{`csv.write({}, {{"a"}})`, "attempt to call a nil value"},
+		{`csv.write({write = function(self) return self end}, {{"a"}, "b"})`, "[2]: record is a string"},
+		{`csv.writerows({write = function(self) return self end}, ipairs({{"a", print}}))`, "[1][2]: cannot encode function"},
+		{`csv.encode({{"a", nil, "c"}})`, "[1][2]: cannot encode nil"},
+		{`csv.encode("a")`, "table expected"},
+	}
+	state := newTestState(t)
+	for _, test := range tests {
+		if err := state.LoadString(test.stmt, "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.stmt, err)
+			continue
+		}
+		if err := state.Call(0, 0, 0); err == nil {
+			t.Errorf("%s did not raise an error", test.stmt)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s error = %v; want %q", test.stmt, err, test.want)
+		}
+		state.SetTop(0)
+	}
+}
+
+func TestWriteRowsStopsAtFirstFailure(t *testing.T) {
+	const source = `
+		local calls = 0
+		local function gen()
+			calls = calls + 1
+			if calls <= 10 then return {calls} end
+		end
+		local out = {write = function() return nil, "disk full" end}
+		local ok = pcall(csv.writerows, out, gen)
+		assert(not ok)
+		return calls
+	`
+	state := newTestState(t)
+	if err := state.LoadString(source, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if calls, _ := state.ToInteger(-1); calls != 1 {
+		t.Errorf("iterator called %d times; want 1", calls)
+	}
+}
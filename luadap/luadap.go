@@ -0,0 +1,745 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package luadap serves the [Debug Adapter Protocol] (DAP) for a [lua.State]
+// so that editors like VS Code can debug Lua code embedded in a Go program.
+//
+// The Go program owns the state and decides which code runs:
+// the "launch" and "attach" requests only configure the debugging session.
+// A typical program accepts a connection from the editor,
+// calls [Attach], waits for the editor's breakpoints with [Debugger.WaitConfigured],
+// runs its Lua code, and then calls [Debugger.Exited] and [Debugger.Close].
+//
+// Breakpoints are matched against chunk names (see [lua.State.SetBreakpoint]),
+// so chunks should be loaded with a name of "@" followed by
+// the path that the editor uses for the file.
+//
+// [Debug Adapter Protocol]: https://microsoft.github.io/debug-adapter-protocol/
+package luadap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/lua"
+)
+
+// threadID is the identifier of the single thread reported to clients.
+const threadID = 1
+
+// pollInterval is the number of instructions between checks for requests
+// while Lua code is running.
+const pollInterval = 1000
+
+// valuesKey is the registry key of the table
+// that holds values referenced by variable references.
+const valuesKey = "zombiezen.com/go/lua/luadap.values"
+
+var errNotStopped = errors.New("not stopped")
+
+// A Debugger connects a [lua.State] to a DAP client.
+// Methods on Debugger must be called from the goroutine
+// that uses the state.
+type Debugger struct {
+	l    *lua.State
+	conn io.ReadWriteCloser
+
+	// requests receives requests that need access to the state.
+	requests chan *request
+	// closing is closed when Close is called.
+	closing chan struct{}
+	// done is closed once the connection's reader stops.
+	done chan struct{}
+
+	wmu sync.Mutex
+	seq int
+
+	// Remaining fields are only used on the state's goroutine.
+
+	// hookID is the debugger's count hook.
+	hookID lua.HookID
+
+	// breakpoints maps source paths to the lines with breakpoints.
+	breakpoints map[string][]int
+	configured  bool
+	detached    bool
+	// stopReason is the reason reported for the next stop
+	// if it is not at a breakpoint.
+	stopReason string
+	// refs are the variable references handed out since the last stop.
+	// A reference's ID is its index plus one.
+	refs []varRef
+}
+
+type refKind int
+
+const (
+	refValue refKind = iota
+	refLocals
+	refUpvalues
+)
+
+// varRef is the target of a variable reference.
+// Values are stored in the registry table at valuesKey
+// under the reference's ID.
+type varRef struct {
+	kind  refKind
+	level int
+}
+
+// Attach starts a debugging session for l with a client on conn.
+// Attach adds a count hook to l (see [lua.State.AddHook])
+// and sets l's breakpoint handler.
+// Execution stops when it reaches a breakpoint or completes a step,
+// and while stopped, the Debugger serves the client's requests
+// on the goroutine that is running the Lua code.
+func Attach(l *lua.State, conn io.ReadWriteCloser) *Debugger {
+	d := &Debugger{
+		l:           l,
+		conn:        conn,
+		requests:    make(chan *request, 16),
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+		breakpoints: make(map[string][]int),
+	}
+	d.hookID = l.AddHook(d.hook, lua.MaskCount, pollInterval)
+	l.SetBreakpointHandler(d.stop)
+	go d.read()
+	return d
+}
+
+// WaitConfigured serves requests from the client
+// until the client sends a "configurationDone" request,
+// so that the client's breakpoints are in place before any Lua code runs.
+func (d *Debugger) WaitConfigured(ctx context.Context) error {
+	for !d.configured {
+		select {
+		case req := <-d.requests:
+			d.handle(d.l, req, false)
+		case <-d.done:
+			d.detach(d.l)
+			return errors.New("luadap: connection closed before configuration done")
+		case <-ctx.Done():
+			return fmt.Errorf("luadap: wait for configuration: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Exited informs the client that the program has finished
+// with the given exit code.
+func (d *Debugger) Exited(exitCode int) {
+	d.sendEvent("exited", map[string]any{"exitCode": exitCode})
+	d.sendEvent("terminated", nil)
+}
+
+// Close ends the debugging session,
+// clears the session's breakpoints,
+// removes the debugger's hook,
+// and closes the connection.
+func (d *Debugger) Close() error {
+	d.detach(d.l)
+	d.l.SetBreakpointHandler(nil)
+	d.l.RemoveHook(d.hookID)
+	close(d.closing)
+	err := d.conn.Close()
+	<-d.done
+	return err
+}
+
+// read reads requests from the connection.
+// Requests that don't need the state are handled directly
+// and the rest are sent to d.requests.
+func (d *Debugger) read() {
+	defer close(d.done)
+	r := bufio.NewReader(d.conn)
+	for {
+		req := new(request)
+		if err := readMessage(r, req); err != nil {
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+		switch req.Command {
+		case "initialize":
+			d.respond(req, map[string]any{
+				"supportsConfigurationDoneRequest": true,
+			}, nil)
+			d.sendEvent("initialized", nil)
+		case "threads":
+			d.respond(req, map[string]any{
+				"threads": []map[string]any{{"id": threadID, "name": "main"}},
+			}, nil)
+		case "disconnect":
+			d.respond(req, nil, nil)
+			return
+		default:
+			select {
+			case d.requests <- req:
+			case <-d.closing:
+				return
+			}
+		}
+	}
+}
+
+// hook periodically serves requests while Lua code is running.
+func (d *Debugger) hook(l *lua.State, event lua.HookEvent, ar *lua.ActivationRecord) error {
+	for {
+		select {
+		case req := <-d.requests:
+			d.handle(l, req, false)
+		case <-d.done:
+			d.detach(l)
+			return nil
+		default:
+			return nil
+		}
+	}
+}
+
+// stop is the state's breakpoint handler.
+// It serves requests until the client resumes execution.
+func (d *Debugger) stop(l *lua.State, ar *lua.ActivationRecord) error {
+	if d.detached {
+		return nil
+	}
+	reason := d.stopReason
+	d.stopReason = ""
+	if d.atBreakpoint(ar) {
+		reason = "breakpoint"
+	} else if reason == "" {
+		reason = "step"
+	}
+	d.sendEvent("stopped", map[string]any{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	})
+	defer d.clearRefs(l)
+	for {
+		select {
+		case req := <-d.requests:
+			if d.handle(l, req, true) {
+				return nil
+			}
+		case <-d.done:
+			d.detach(l)
+			return nil
+		}
+	}
+}
+
+// detach removes the session's breakpoints
+// after the client has disconnected.
+func (d *Debugger) detach(l *lua.State) {
+	if d.detached {
+		return
+	}
+	d.detached = true
+	for p, lines := range d.breakpoints {
+		for _, line := range lines {
+			l.ClearBreakpoint(p, line)
+		}
+	}
+	d.breakpoints = nil
+	l.Step(lua.StepContinue)
+}
+
+func (d *Debugger) atBreakpoint(ar *lua.ActivationRecord) bool {
+	info := ar.Info("Sl")
+	p, ok := strings.CutPrefix(info.Source, "@")
+	return ok && slices.Contains(d.breakpoints[p], info.CurrentLine)
+}
+
+// handle serves a request that needs the state.
+// stopped reports whether execution is stopped.
+// handle reports whether execution should resume.
+func (d *Debugger) handle(l *lua.State, req *request, stopped bool) (resume bool) {
+	switch req.Command {
+	case "next", "stepIn", "stepOut", "stackTrace", "scopes", "variables", "evaluate":
+		if !stopped {
+			d.respond(req, nil, errNotStopped)
+			return false
+		}
+	}
+
+	var body any
+	var err error
+	switch req.Command {
+	case "launch", "attach":
+		err = d.launch(l, req.Arguments)
+	case "configurationDone":
+		d.configured = true
+	case "setBreakpoints":
+		body, err = d.setBreakpoints(l, req.Arguments)
+	case "continue":
+		l.Step(lua.StepContinue)
+		body = map[string]any{"allThreadsContinued": true}
+		resume = stopped
+	case "next":
+		l.Step(lua.StepOver)
+		d.stopReason = "step"
+		resume = true
+	case "stepIn":
+		l.Step(lua.StepIn)
+		d.stopReason = "step"
+		resume = true
+	case "stepOut":
+		l.Step(lua.StepOut)
+		d.stopReason = "step"
+		resume = true
+	case "pause":
+		if !stopped {
+			l.Step(lua.StepIn)
+			d.stopReason = "pause"
+		}
+	case "stackTrace":
+		body, err = d.stackTrace(l, req.Arguments)
+	case "scopes":
+		body, err = d.scopes(l, req.Arguments)
+	case "variables":
+		body, err = d.variables(l, req.Arguments)
+	case "evaluate":
+		body, err = d.evaluate(l, req.Arguments)
+	default:
+		err = fmt.Errorf("unsupported command %q", req.Command)
+	}
+	d.respond(req, body, err)
+	return resume && err == nil
+}
+
+func (d *Debugger) launch(l *lua.State, data json.RawMessage) error {
+	var args struct {
+		StopOnEntry bool `json:"stopOnEntry"`
+	}
+	if err := parseArguments(data, &args); err != nil {
+		return err
+	}
+	if args.StopOnEntry {
+		l.Step(lua.StepIn)
+		d.stopReason = "entry"
+	}
+	return nil
+}
+
+func (d *Debugger) setBreakpoints(l *lua.State, data json.RawMessage) (any, error) {
+	var args struct {
+		Source      source             `json:"source"`
+		Breakpoints []sourceBreakpoint `json:"breakpoints"`
+		Lines       []int              `json:"lines"`
+	}
+	if err := parseArguments(data, &args); err != nil {
+		return nil, err
+	}
+	if args.Source.Path == "" {
+		return nil, errors.New("source has no path")
+	}
+	for _, line := range d.breakpoints[args.Source.Path] {
+		l.ClearBreakpoint(args.Source.Path, line)
+	}
+	lines := args.Lines
+	if args.Breakpoints != nil {
+		lines = lines[:0]
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+		}
+	}
+	result := make([]breakpoint, 0, len(lines))
+	for _, line := range lines {
+		l.SetBreakpoint(args.Source.Path, line)
+		result = append(result, breakpoint{Verified: true, Line: line})
+	}
+	if len(lines) == 0 {
+		delete(d.breakpoints, args.Source.Path)
+	} else {
+		d.breakpoints[args.Source.Path] = lines
+	}
+	return map[string]any{"breakpoints": result}, nil
+}
+
+func (d *Debugger) stackTrace(l *lua.State, data json.RawMessage) (any, error) {
+	var args struct {
+		StartFrame int `json:"startFrame"`
+		Levels     int `json:"levels"`
+	}
+	if err := parseArguments(data, &args); err != nil {
+		return nil, err
+	}
+	var frames []stackFrame
+	for level := 0; ; level++ {
+		ar := l.Stack(level)
+		if ar == nil {
+			break
+		}
+		frames = append(frames, newStackFrame(level, ar.Info("nSl")))
+	}
+	total := len(frames)
+	frames = frames[min(args.StartFrame, len(frames)):]
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+	return map[string]any{
+		"stackFrames": frames,
+		"totalFrames": total,
+	}, nil
+}
+
+func newStackFrame(level int, info *lua.Debug) stackFrame {
+	f := stackFrame{
+		ID:   level + 1,
+		Name: info.Name,
+	}
+	switch {
+	case info.What == "main":
+		f.Name = "main chunk"
+	case f.Name == "" && info.What == "Lua":
+		f.Name = fmt.Sprintf("function <%s:%d>", info.ShortSource, info.LineDefined)
+	case f.Name == "":
+		f.Name = "?"
+	}
+	if p, ok := strings.CutPrefix(info.Source, "@"); ok {
+		f.Source = &source{Name: path.Base(p), Path: p}
+	} else if name, ok := strings.CutPrefix(info.Source, "="); ok {
+		f.Source = &source{Name: name}
+	}
+	if info.CurrentLine > 0 {
+		f.Line = info.CurrentLine
+		f.Column = 1
+	}
+	return f
+}
+
+func (d *Debugger) scopes(l *lua.State, data json.RawMessage) (any, error) {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	if err := parseArguments(data, &args); err != nil {
+		return nil, err
+	}
+	level := args.FrameID - 1
+	if level < 0 || l.Stack(level) == nil {
+		return nil, fmt.Errorf("unknown frame %d", args.FrameID)
+	}
+	if !l.CheckStack(1) {
+		return nil, errors.New("stack overflow")
+	}
+	l.RawIndex(lua.RegistryIndex, lua.RegistryIndexGlobals)
+	globals := d.newValueRef(l, -1)
+	l.Pop(1)
+	return map[string]any{
+		"scopes": []scope{
+			{Name: "Locals", VariablesReference: d.newRef(varRef{kind: refLocals, level: level})},
+			{Name: "Upvalues", VariablesReference: d.newRef(varRef{kind: refUpvalues, level: level})},
+			{Name: "Globals", VariablesReference: globals, Expensive: true},
+		},
+	}, nil
+}
+
+func (d *Debugger) variables(l *lua.State, data json.RawMessage) (any, error) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := parseArguments(data, &args); err != nil {
+		return nil, err
+	}
+	id := args.VariablesReference
+	if id < 1 || id > len(d.refs) {
+		return nil, fmt.Errorf("unknown variables reference %d", id)
+	}
+	if !l.CheckStack(4) {
+		return nil, errors.New("stack overflow")
+	}
+	vars := []variable{}
+	switch ref := d.refs[id-1]; ref.kind {
+	case refLocals:
+		ar := l.Stack(ref.level)
+		for n := 1; ; n++ {
+			name, ok := ar.Local(n)
+			if !ok {
+				break
+			}
+			if !strings.HasPrefix(name, "(") {
+				vars = append(vars, d.newVariable(l, name, -1))
+			}
+			l.Pop(1)
+		}
+	case refUpvalues:
+		ar := l.Stack(ref.level)
+		ar.Info("f")
+		for n := 1; ; n++ {
+			name, ok := l.Upvalue(-1, n)
+			if !ok {
+				break
+			}
+			if name == "" {
+				name = "?"
+			}
+			vars = append(vars, d.newVariable(l, name, -1))
+			l.Pop(1)
+		}
+		l.Pop(1)
+	case refValue:
+		d.pushValue(l, id)
+		if l.Type(-1) == lua.TypeTable {
+			l.PushNil()
+			for l.Next(-2) {
+				vars = append(vars, d.newVariable(l, keyName(l, -2), -1))
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+		sort.Slice(vars, func(i, j int) bool {
+			return vars[i].Name < vars[j].Name
+		})
+	}
+	return map[string]any{"variables": vars}, nil
+}
+
+func (d *Debugger) evaluate(l *lua.State, data json.RawMessage) (any, error) {
+	var args struct {
+		Expression string `json:"expression"`
+		FrameID    int    `json:"frameId"`
+	}
+	if err := parseArguments(data, &args); err != nil {
+		return nil, err
+	}
+	if !l.CheckStack(4) {
+		return nil, errors.New("stack overflow")
+	}
+	base := l.Top()
+	defer l.SetTop(base)
+	if err := d.pushEnv(l, args.FrameID); err != nil {
+		return nil, err
+	}
+	env := l.Top()
+	err := l.LoadWithEnv(strings.NewReader("return "+args.Expression), "=(eval)", "t", env)
+	if err != nil {
+		if err := l.LoadWithEnv(strings.NewReader(args.Expression), "=(eval)", "t", env); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.Call(0, lua.MultipleReturns, 0); err != nil {
+		return nil, err
+	}
+	result := variable{}
+	var values []string
+	for i := env + 1; i <= l.Top(); i++ {
+		v := d.newVariable(l, "", i)
+		values = append(values, v.Value)
+		if l.Top() == env+1 {
+			result = v
+		}
+	}
+	return map[string]any{
+		"result":             strings.Join(values, ", "),
+		"type":               result.Type,
+		"variablesReference": result.VariablesReference,
+	}, nil
+}
+
+// pushEnv pushes a table to use as the environment of evaluated code.
+// The table holds the upvalues and local variables of the given frame
+// and falls back to the frame's _ENV (or the global environment).
+func (d *Debugger) pushEnv(l *lua.State, frameID int) error {
+	l.CreateTable(0, 0)
+	env := l.Top()
+	l.CreateTable(0, 1)
+	l.RawIndex(lua.RegistryIndex, lua.RegistryIndexGlobals)
+	l.RawSetField(-2, "__index")
+	if frameID > 0 {
+		ar := l.Stack(frameID - 1)
+		if ar == nil {
+			l.Pop(2)
+			return fmt.Errorf("unknown frame %d", frameID)
+		}
+		ar.Info("f")
+		for n := 1; ; n++ {
+			name, ok := l.Upvalue(-1, n)
+			if !ok {
+				break
+			}
+			if name == "_ENV" {
+				l.RawSetField(-3, "__index")
+			} else if name != "" {
+				l.RawSetField(env, name)
+			} else {
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+		for n := 1; ; n++ {
+			name, ok := ar.Local(n)
+			if !ok {
+				break
+			}
+			if strings.HasPrefix(name, "(") {
+				l.Pop(1)
+			} else {
+				l.RawSetField(env, name)
+			}
+		}
+	}
+	l.SetMetatable(env)
+	return nil
+}
+
+// newVariable describes the value at idx.
+// Tables are given a variable reference so that clients can expand them.
+func (d *Debugger) newVariable(l *lua.State, name string, idx int) variable {
+	tp := l.Type(idx)
+	v := variable{
+		Name: name,
+		Type: tp.String(),
+	}
+	if tp == lua.TypeString {
+		s, _ := l.ToString(idx)
+		v.Value = strconv.Quote(s)
+	} else if s, err := lua.ToString(l, idx); err == nil {
+		v.Value = s
+	} else {
+		v.Value = fmt.Sprintf("%v: %#x", tp, l.ToPointer(idx))
+	}
+	if tp == lua.TypeTable {
+		v.VariablesReference = d.newValueRef(l, idx)
+	}
+	return v
+}
+
+// keyName formats the table key at idx as a variable name.
+func keyName(l *lua.State, idx int) string {
+	if l.Type(idx) == lua.TypeString {
+		s, _ := l.ToString(idx)
+		if isIdentifier(s) {
+			return s
+		}
+		return "[" + strconv.Quote(s) + "]"
+	}
+	s, err := lua.ToString(l, idx)
+	if err != nil {
+		s = fmt.Sprintf("%v: %#x", l.Type(idx), l.ToPointer(idx))
+	}
+	return "[" + s + "]"
+}
+
+func isIdentifier(s string) bool {
+	if s == "" || ('0' <= s[0] && s[0] <= '9') {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Debugger) newRef(ref varRef) int {
+	d.refs = append(d.refs, ref)
+	return len(d.refs)
+}
+
+// newValueRef returns a new variable reference to the value at idx.
+func (d *Debugger) newValueRef(l *lua.State, idx int) int {
+	idx = l.AbsIndex(idx)
+	id := d.newRef(varRef{kind: refValue})
+	if l.RawField(lua.RegistryIndex, valuesKey) != lua.TypeTable {
+		l.Pop(1)
+		l.CreateTable(0, 0)
+		l.PushValue(-1)
+		l.RawSetField(lua.RegistryIndex, valuesKey)
+	}
+	l.PushValue(idx)
+	l.RawSetIndex(-2, int64(id))
+	l.Pop(1)
+	return id
+}
+
+// pushValue pushes the value referenced by the given variable reference.
+func (d *Debugger) pushValue(l *lua.State, id int) {
+	if l.RawField(lua.RegistryIndex, valuesKey) != lua.TypeTable {
+		l.Pop(1)
+		l.PushNil()
+		return
+	}
+	l.RawIndex(-1, int64(id))
+	l.Remove(-2)
+}
+
+// clearRefs invalidates all variable references,
+// since they are only valid while execution is stopped.
+func (d *Debugger) clearRefs(l *lua.State) {
+	d.refs = nil
+	l.PushNil()
+	l.RawSetField(lua.RegistryIndex, valuesKey)
+}
+
+func (d *Debugger) respond(req *request, body any, err error) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	d.seq++
+	resp := &response{
+		Seq:        d.seq,
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	// Write errors are noticed by the reader.
+	writeMessage(d.conn, resp)
+}
+
+func (d *Debugger) sendEvent(name string, body any) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	d.seq++
+	writeMessage(d.conn, &event{
+		Seq:   d.seq,
+		Type:  "event",
+		Event: name,
+		Body:  body,
+	})
+}
+
+func parseArguments(data json.RawMessage, v any) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse arguments: %v", err)
+	}
+	return nil
+}
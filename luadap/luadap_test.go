@@ -0,0 +1,220 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package luadap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"maps"
+	"net"
+	"testing"
+
+	"zombiezen.com/go/lua"
+)
+
+func TestDebugger(t *testing.T) {
+	state := new(lua.State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "local t = {n = 10}\n" +
+		"local function f(a)\n" +
+		"  local b = a * t.n\n" +
+		"  return b + 1\n" +
+		"end\n" +
+		"local x = f(1)\n" +
+		"return x\n"
+	serverConn, clientConn := net.Pipe()
+	luaDone := make(chan struct{})
+	defer func() { <-luaDone }()
+	defer clientConn.Close()
+	go func() {
+		defer close(luaDone)
+		d := Attach(state, serverConn)
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error("Debugger.Close:", err)
+			}
+			if hook, _, _ := state.Hook(); hook != nil {
+				t.Error("hook still installed after Close")
+			}
+		}()
+		if err := d.WaitConfigured(context.Background()); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := state.LoadString(source, "@test.lua", "t"); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Error(err)
+			return
+		}
+		if got, _ := state.ToInteger(-1); got != 11 {
+			t.Errorf("result = %d; want 11", got)
+		}
+		d.Exited(0)
+	}()
+
+	c := &testClient{t: t, conn: clientConn, r: bufio.NewReader(clientConn)}
+	c.request("initialize", map[string]any{"adapterID": "lua"})
+	c.expectEvent("initialized")
+	c.request("launch", nil)
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": "test.lua"},
+		"breakpoints": []map[string]any{{"line": 4}},
+	}, &bps)
+	if len(bps.Breakpoints) != 1 || !bps.Breakpoints[0].Verified {
+		t.Errorf("setBreakpoints = %+v; want 1 verified breakpoint", bps.Breakpoints)
+	}
+	c.request("configurationDone", nil)
+
+	var stopped struct {
+		Reason string `json:"reason"`
+	}
+	c.expectEvent("stopped", &stopped)
+	if stopped.Reason != "breakpoint" {
+		t.Errorf("stopped reason = %q; want \"breakpoint\"", stopped.Reason)
+	}
+	var trace struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	c.request("stackTrace", map[string]any{"threadId": threadID}, &trace)
+	if len(trace.StackFrames) < 2 {
+		t.Fatalf("stackTrace = %+v; want at least 2 frames", trace.StackFrames)
+	}
+	if got := trace.StackFrames[0]; got.Name != "f" || got.Line != 4 || got.Source == nil || got.Source.Path != "test.lua" {
+		t.Errorf("top frame = %+v; want f at test.lua:4", got)
+	}
+	var scopes struct {
+		Scopes []scope `json:"scopes"`
+	}
+	c.request("scopes", map[string]any{"frameId": trace.StackFrames[0].ID}, &scopes)
+	if len(scopes.Scopes) == 0 || scopes.Scopes[0].Name != "Locals" {
+		t.Fatalf("scopes = %+v; want Locals first", scopes.Scopes)
+	}
+	var vars struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", map[string]any{"variablesReference": scopes.Scopes[0].VariablesReference}, &vars)
+	got := make(map[string]string)
+	for _, v := range vars.Variables {
+		got[v.Name] = v.Value
+	}
+	if want := map[string]string{"a": "1", "b": "10"}; !maps.Equal(got, want) {
+		t.Errorf("locals = %v; want %v", got, want)
+	}
+	var eval struct {
+		Result string `json:"result"`
+	}
+	c.request("evaluate", map[string]any{"expression": "a + b + t.n", "frameId": trace.StackFrames[0].ID}, &eval)
+	if eval.Result != "21" {
+		t.Errorf("evaluate result = %q; want \"21\"", eval.Result)
+	}
+
+	c.request("next", map[string]any{"threadId": threadID})
+	c.expectEvent("stopped", &stopped)
+	if stopped.Reason != "step" {
+		t.Errorf("stopped reason = %q; want \"step\"", stopped.Reason)
+	}
+	c.request("stackTrace", map[string]any{"threadId": threadID}, &trace)
+	if len(trace.StackFrames) == 0 || trace.StackFrames[0].Line != 7 {
+		t.Errorf("after next, stack = %+v; want line 7 on top", trace.StackFrames)
+	}
+	c.request("continue", map[string]any{"threadId": threadID})
+	c.expectEvent("exited")
+	c.expectEvent("terminated")
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+type testMessage struct {
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// request sends a request and waits for its response,
+// unmarshaling the response body into body if given.
+func (c *testClient) request(command string, args any, body ...any) {
+	c.t.Helper()
+	c.seq++
+	req := map[string]any{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := writeMessage(c.conn, req); err != nil {
+		c.t.Fatalf("send %s: %v", command, err)
+	}
+	msg := c.read()
+	if msg.Type != "response" || msg.Command != command || msg.RequestSeq != c.seq {
+		c.t.Fatalf("got %+v; want response to %s", msg, command)
+	}
+	if !msg.Success {
+		c.t.Fatalf("%s failed: %s", command, msg.Message)
+	}
+	c.unmarshal(msg, body)
+}
+
+func (c *testClient) expectEvent(name string, body ...any) {
+	c.t.Helper()
+	msg := c.read()
+	if msg.Type != "event" || msg.Event != name {
+		c.t.Fatalf("got %+v; want %s event", msg, name)
+	}
+	c.unmarshal(msg, body)
+}
+
+func (c *testClient) read() *testMessage {
+	c.t.Helper()
+	msg := new(testMessage)
+	if err := readMessage(c.r, msg); err != nil {
+		c.t.Fatal("read:", err)
+	}
+	return msg
+}
+
+func (c *testClient) unmarshal(msg *testMessage, body []any) {
+	c.t.Helper()
+	for _, b := range body {
+		if err := json.Unmarshal(msg.Body, b); err != nil {
+			c.t.Fatalf("%s%s body: %v", msg.Command, msg.Event, err)
+		}
+	}
+}
@@ -0,0 +1,667 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package luajson provides a Lua module for encoding and decoding JSON
+// along with Go functions that convert between Lua values and JSON directly.
+//
+// Lua values are encoded as follows:
+//
+//   - nil and json.null become null.
+//   - Booleans become true or false.
+//   - Integers become JSON numbers without a fraction or exponent.
+//     Floats always have a fraction or exponent (like 1.0),
+//     so that they decode as floats again.
+//     NaN and infinities cannot be encoded.
+//   - Strings become JSON strings.
+//     Invalid UTF-8 sequences are replaced with U+FFFD.
+//   - Tables whose keys are exactly the integers 1 through n (for n > 0)
+//     become arrays.
+//     Other tables, including empty tables, become objects,
+//     with keys sorted and numeric keys formatted as decimal strings.
+//     Tables with keys of other types cannot be encoded.
+//   - Tables marked by json.array or json.object
+//     become an array or object regardless of their contents.
+//     A marked array contains the elements 1 through #t.
+//
+// Tables are read without invoking metamethods.
+// Other types of values and tables that contain themselves cannot be encoded.
+//
+// JSON values are decoded as follows:
+//
+//   - null becomes json.null.
+//   - Numbers without a fraction or exponent become integers
+//     if they are in range.
+//     Other numbers become floats.
+//   - Arrays become sequences marked with json.array,
+//     so that empty arrays encode as arrays again.
+//   - Objects become tables with string keys.
+//
+// # Lua API
+//
+// [Open] loads a module with the following members:
+//
+//   - json.encode(value) returns the JSON encoding of value as a string.
+//   - json.decode(s) returns the value encoded by the JSON string s.
+//   - json.write(file, value) writes the JSON encoding of value
+//     to file (any value with a write method, like the files of the io library)
+//     in pieces, without building the whole string in memory.
+//     It returns file.
+//   - json.writearray(file, f [, s [, ctrl]]) writes a JSON array to file
+//     whose elements are produced by the iterator f, s, ctrl
+//     as in a generic for loop.
+//     Each element is the last value returned by a call to the iterator,
+//     so both ipairs(t) and functions that return one value at a time work.
+//     Elements are written as they are produced,
+//     and writearray stops at the first failed write.
+//     It returns file.
+//   - json.null is a light userdata that represents JSON null
+//     in places where nil would be lost, like arrays.
+//   - json.array([t]) marks t as an array and returns it.
+//     If t is omitted, a new table is created.
+//   - json.object([t]) marks t as an object and returns it.
+//     If t is omitted, a new table is created.
+//
+// Marking a table sets its metatable.
+// encode and decode raise an error if the value cannot be converted.
+package luajson
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"zombiezen.com/go/lua"
+)
+
+// ModuleName is the conventional name of the module loaded by [Open].
+const ModuleName = "json"
+
+// Names of the metatables used to mark tables as arrays or objects.
+const (
+	arrayMetatableName  = "zombiezen.com/go/lua/luajson.array"
+	objectMetatableName = "zombiezen.com/go/lua/luajson.object"
+)
+
+// maxDepth is the maximum nesting of arrays and objects
+// that will be encoded or decoded.
+const maxDepth = 200
+
+// Open is a [lua.Function] that pushes a new table with the json module's functions
+// as described in the package documentation.
+// It is intended to be used with [lua.Require]:
+//
+//	err := lua.Require(l, luajson.ModuleName, true, luajson.Open)
+func Open(l *lua.State) (int, error) {
+	err := lua.NewLib(l, map[string]lua.Function{
+		"encode":     encode,
+		"decode":     decode,
+		"write":      write,
+		"writearray": writeArray,
+		"array":      markArray,
+		"object":     markObject,
+	})
+	if err != nil {
+		return 0, err
+	}
+	pushNull(l)
+	l.RawSetField(-2, "null")
+	return 1, nil
+}
+
+// pushNull pushes the value that represents JSON null onto the stack.
+func pushNull(l *lua.State) {
+	l.PushLightUserdata(0)
+}
+
+// isNull reports whether the value at the given index represents JSON null.
+func isNull(l *lua.State, idx int) bool {
+	return l.Type(idx) == lua.TypeLightUserdata && l.ToPointer(idx) == 0
+}
+
+func encode(l *lua.State) (int, error) {
+	if err := lua.CheckAny(l, 1); err != nil {
+		return 0, err
+	}
+	buf := new(bytes.Buffer)
+	if err := encodeTo(buf, l, 1); err != nil {
+		return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+	}
+	l.PushString(buf.String())
+	return 1, nil
+}
+
+func write(l *lua.State) (int, error) {
+	if err := lua.CheckAny(l, 1); err != nil {
+		return 0, err
+	}
+	if err := lua.CheckAny(l, 2); err != nil {
+		return 0, err
+	}
+	l.SetTop(2)
+	if err := encodeTo(&fileWriter{l: l, idx: 1}, l, 2); err != nil {
+		return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+	}
+	l.SetTop(1)
+	return 1, nil
+}
+
+func writeArray(l *lua.State) (int, error) {
+	if err := lua.CheckAny(l, 1); err != nil {
+		return 0, err
+	}
+	if err := lua.CheckAny(l, 2); err != nil {
+		return 0, err
+	}
+	l.SetTop(4)
+	e := newEncoder(&fileWriter{l: l, idx: 1}, l)
+	e.w.WriteByte('[')
+	for i := 1; ; i++ {
+		if !l.CheckStack(3) {
+			return 0, errors.New("stack overflow")
+		}
+		l.PushValue(2)
+		l.PushValue(3)
+		l.PushValue(4)
+		if err := l.Call(2, lua.MultipleReturns, 0); err != nil {
+			return 0, err
+		}
+		if l.Top() == 4 || l.IsNil(5) {
+			break
+		}
+		if i > 1 {
+			e.w.WriteByte(',')
+		}
+		if err := e.value(l.Top(), 1); err != nil {
+			return 0, fmt.Errorf("%s[%d]: %v", lua.Where(l, 1), i, err)
+		}
+		// Flush after every element so that elements are written
+		// as they are produced and a failed write stops the iteration.
+		if err := e.w.Flush(); err != nil {
+			return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+		}
+		l.Copy(5, 4)
+		l.SetTop(4)
+	}
+	e.w.WriteByte(']')
+	if err := e.w.Flush(); err != nil {
+		return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+	}
+	l.SetTop(1)
+	return 1, nil
+}
+
+// fileWriter is an [io.Writer] that calls the write method
+// of the value at idx.
+type fileWriter struct {
+	l   *lua.State
+	idx int
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	l := fw.l
+	if !l.CheckStack(3) {
+		return 0, errors.New("stack overflow")
+	}
+	if _, err := l.Field(fw.idx, "write", 0); err != nil {
+		return 0, err
+	}
+	l.PushValue(fw.idx)
+	l.PushString(string(p))
+	if err := l.Call(2, 2, 0); err != nil {
+		return 0, err
+	}
+	defer l.Pop(2)
+	if l.IsNil(-2) {
+		msg, _ := l.ToString(-1)
+		return 0, errors.New(msg)
+	}
+	return len(p), nil
+}
+
+func decode(l *lua.State) (int, error) {
+	s, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if err := decodeFrom(l, strings.NewReader(s)); err != nil {
+		return 0, fmt.Errorf("%s%v", lua.Where(l, 1), err)
+	}
+	return 1, nil
+}
+
+func markArray(l *lua.State) (int, error) {
+	return mark(l, arrayMetatableName)
+}
+
+func markObject(l *lua.State) (int, error) {
+	return mark(l, objectMetatableName)
+}
+
+func mark(l *lua.State, tname string) (int, error) {
+	if l.IsNone(1) {
+		l.CreateTable(0, 0)
+	} else if err := lua.CheckType(l, 1, lua.TypeTable); err != nil {
+		return 0, err
+	}
+	l.SetTop(1)
+	setMarker(l, tname)
+	return 1, nil
+}
+
+// setMarker sets the metatable of the table on the top of the stack
+// to the marker metatable with the given name,
+// creating the metatable if necessary.
+func setMarker(l *lua.State, tname string) {
+	lua.NewMetatable(l, tname)
+	l.SetMetatable(-2)
+}
+
+// Encode writes the JSON encoding of the Lua value at the given index to w,
+// as described in the package documentation.
+// If Encode returns an error, then part of the value may have been written to w.
+func Encode(w io.Writer, l *lua.State, idx int) error {
+	if err := encodeTo(w, l, idx); err != nil {
+		return fmt.Errorf("luajson: encode: %w", err)
+	}
+	return nil
+}
+
+func encodeTo(w io.Writer, l *lua.State, idx int) error {
+	e := newEncoder(w, l)
+	if err := e.value(l.AbsIndex(idx), 0); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func newEncoder(w io.Writer, l *lua.State) *encoder {
+	return &encoder{
+		l:        l,
+		w:        bufio.NewWriter(w),
+		visiting: make(map[uintptr]struct{}),
+	}
+}
+
+// encoder holds the state of a call to [Encode].
+type encoder struct {
+	l *lua.State
+	w *bufio.Writer
+	// visiting holds the addresses of the tables being encoded.
+	visiting map[uintptr]struct{}
+	scratch  []byte
+}
+
+// value encodes the value at the absolute index idx.
+func (e *encoder) value(idx int, depth int) error {
+	l := e.l
+	switch tp := l.Type(idx); tp {
+	case lua.TypeNil, lua.TypeNone:
+		e.w.WriteString("null")
+	case lua.TypeBoolean:
+		if l.ToBoolean(idx) {
+			e.w.WriteString("true")
+		} else {
+			e.w.WriteString("false")
+		}
+	case lua.TypeNumber:
+		if i, ok := l.ToInteger(idx); ok && l.IsInteger(idx) {
+			e.scratch = strconv.AppendInt(e.scratch[:0], i, 10)
+		} else {
+			f, _ := l.ToNumber(idx)
+			if math.IsInf(f, 0) || math.IsNaN(f) {
+				return fmt.Errorf("cannot encode %v", f)
+			}
+			e.scratch = appendFloat(e.scratch[:0], f)
+		}
+		e.w.Write(e.scratch)
+	case lua.TypeString:
+		s, _ := l.ToString(idx)
+		e.scratch = appendString(e.scratch[:0], s)
+		e.w.Write(e.scratch)
+	case lua.TypeLightUserdata:
+		if !isNull(l, idx) {
+			return fmt.Errorf("cannot encode %v", tp)
+		}
+		e.w.WriteString("null")
+	case lua.TypeTable:
+		return e.table(idx, depth)
+	default:
+		return fmt.Errorf("cannot encode %v", tp)
+	}
+	return nil
+}
+
+// table encodes the table at the absolute index idx.
+func (e *encoder) table(idx int, depth int) error {
+	l := e.l
+	if depth >= maxDepth {
+		return errors.New("value nested too deeply")
+	}
+	ptr := l.ToPointer(idx)
+	if _, cyclic := e.visiting[ptr]; cyclic {
+		return errors.New("table contains itself")
+	}
+	e.visiting[ptr] = struct{}{}
+	defer delete(e.visiting, ptr)
+	if !l.CheckStack(3) {
+		return errors.New("stack overflow")
+	}
+
+	isArray := false
+	switch tableKind(l, idx) {
+	case arrayMetatableName:
+		isArray = true
+	case objectMetatableName:
+	default:
+		n := l.RawLen(idx)
+		count := uint64(0)
+		isArray = n > 0
+		l.PushNil()
+		for l.Next(idx) {
+			count++
+			if k, ok := l.ToInteger(-2); !ok || !l.IsInteger(-2) || k < 1 || uint64(k) > n {
+				isArray = false
+			}
+			l.Pop(1)
+		}
+		isArray = isArray && count == n
+	}
+	if isArray {
+		return e.array(idx, depth)
+	}
+	return e.object(idx, depth)
+}
+
+// tableKind returns the name of the metatable that marks the table
+// at the given index as an array or object
+// or the empty string if it is not marked.
+func tableKind(l *lua.State, idx int) string {
+	if !l.Metatable(idx) {
+		return ""
+	}
+	defer l.Pop(1)
+	for _, tname := range []string{arrayMetatableName, objectMetatableName} {
+		lua.Metatable(l, tname)
+		marked := l.RawEqual(-1, -2)
+		l.Pop(1)
+		if marked {
+			return tname
+		}
+	}
+	return ""
+}
+
+func (e *encoder) array(idx int, depth int) error {
+	l := e.l
+	e.w.WriteByte('[')
+	n := int64(l.RawLen(idx))
+	for i := int64(1); i <= n; i++ {
+		if i > 1 {
+			e.w.WriteByte(',')
+		}
+		l.RawIndex(idx, i)
+		err := e.value(l.AbsIndex(-1), depth+1)
+		l.Pop(1)
+		if err != nil {
+			return fmt.Errorf("[%d]: %w", i, err)
+		}
+	}
+	e.w.WriteByte(']')
+	return nil
+}
+
+// objectKey is a key of a table being encoded as an object.
+type objectKey struct {
+	// name is the key's JSON object member name.
+	name string
+	// i or f hold the key's value if it is an integer or float.
+	i       int64
+	f       float64
+	isInt   bool
+	isFloat bool
+}
+
+func (e *encoder) object(idx int, depth int) error {
+	l := e.l
+	var keys []objectKey
+	l.PushNil()
+	for l.Next(idx) {
+		l.Pop(1)
+		switch tp := l.Type(-1); tp {
+		case lua.TypeString:
+			s, _ := l.ToString(-1)
+			keys = append(keys, objectKey{name: s})
+		case lua.TypeNumber:
+			if i, ok := l.ToInteger(-1); ok && l.IsInteger(-1) {
+				keys = append(keys, objectKey{
+					name:  strconv.FormatInt(i, 10),
+					i:     i,
+					isInt: true,
+				})
+			} else {
+				f, _ := l.ToNumber(-1)
+				keys = append(keys, objectKey{
+					name:    strconv.FormatFloat(f, 'g', -1, 64),
+					f:       f,
+					isFloat: true,
+				})
+			}
+		default:
+			l.Pop(1)
+			return fmt.Errorf("cannot encode %v key", tp)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name
+	})
+
+	e.w.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			e.w.WriteByte(',')
+		}
+		e.scratch = appendString(e.scratch[:0], k.name)
+		e.scratch = append(e.scratch, ':')
+		e.w.Write(e.scratch)
+		switch {
+		case k.isInt:
+			l.RawIndex(idx, k.i)
+		case k.isFloat:
+			l.PushNumber(k.f)
+			l.RawGet(idx)
+		default:
+			l.RawField(idx, k.name)
+		}
+		err := e.value(l.AbsIndex(-1), depth+1)
+		l.Pop(1)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strconv.Quote(k.name), err)
+		}
+	}
+	e.w.WriteByte('}')
+	return nil
+}
+
+// appendFloat appends the JSON encoding of a finite float to dst,
+// ensuring that it has a fraction or exponent.
+func appendFloat(dst []byte, f float64) []byte {
+	start := len(dst)
+	dst = strconv.AppendFloat(dst, f, 'g', -1, 64)
+	if bytes.IndexAny(dst[start:], ".e") == -1 {
+		dst = append(dst, ".0"...)
+	}
+	return dst
+}
+
+// appendString appends s as a JSON string to dst.
+func appendString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, `\n`...)
+			case c == '\r':
+				dst = append(dst, `\r`...)
+			case c == '\t':
+				dst = append(dst, `\t`...)
+			case c < 0x20 || c == 0x7f:
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				dst = append(dst, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			dst = append(dst, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			// Valid JSON, but not valid JavaScript.
+			dst = append(dst, `\u202`...)
+			dst = append(dst, hex[r&0xf])
+		default:
+			dst = append(dst, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(dst, '"')
+}
+
+// Decode reads a single JSON value from r
+// and pushes its Lua equivalent onto the stack,
+// as described in the package documentation.
+// It is an error for r to contain anything but whitespace after the value.
+// If Decode returns an error, then nothing is pushed onto the stack.
+func Decode(l *lua.State, r io.Reader) error {
+	if err := decodeFrom(l, r); err != nil {
+		return fmt.Errorf("luajson: decode: %w", err)
+	}
+	return nil
+}
+
+func decodeFrom(l *lua.State, r io.Reader) error {
+	top := l.Top()
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := decodeValue(l, dec, 0); err != nil {
+		l.SetTop(top)
+		return decodeError(dec, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		l.SetTop(top)
+		if err == nil {
+			return fmt.Errorf("offset %d: unexpected data after top-level value", dec.InputOffset())
+		}
+		return decodeError(dec, err)
+	}
+	return nil
+}
+
+// decodeError adds the offset at which an error occurred to its message.
+func decodeError(dec *json.Decoder, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) {
+		return fmt.Errorf("offset %d: %w", syntaxError.Offset, err)
+	}
+	return fmt.Errorf("offset %d: %w", dec.InputOffset(), err)
+}
+
+// decodeValue reads the next JSON value from dec and pushes it onto the stack.
+// On error, decodeValue may leave values on the stack.
+func decodeValue(l *lua.State, dec *json.Decoder, depth int) error {
+	if !l.CheckStack(3) {
+		return errors.New("stack overflow")
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok := tok.(type) {
+	case nil:
+		pushNull(l)
+	case bool:
+		l.PushBoolean(tok)
+	case string:
+		l.PushString(tok)
+	case json.Number:
+		s := string(tok)
+		if !strings.ContainsAny(s, ".eE") {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				l.PushInteger(i)
+				return nil
+			}
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return err
+		}
+		l.PushNumber(f)
+	case json.Delim:
+		if depth >= maxDepth {
+			return errors.New("value nested too deeply")
+		}
+		switch tok {
+		case '[':
+			l.CreateTable(0, 0)
+			for i := int64(1); dec.More(); i++ {
+				if err := decodeValue(l, dec, depth+1); err != nil {
+					return err
+				}
+				l.RawSetIndex(-2, i)
+			}
+			setMarker(l, arrayMetatableName)
+		case '{':
+			l.CreateTable(0, 0)
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if err := decodeValue(l, dec, depth+1); err != nil {
+					return err
+				}
+				l.RawSetField(-2, key.(string))
+			}
+		}
+		// Consume the closing delimiter.
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
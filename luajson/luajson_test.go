@@ -0,0 +1,306 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package luajson
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/lua"
+)
+
+func newTestState(t *testing.T) *lua.State {
+	t.Helper()
+	state := new(lua.State)
+	t.Cleanup(func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	})
+	if err := lua.Require(state, lua.GName, true, lua.NewOpenBase(io.Discard, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.Require(state, ModuleName, true, Open); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+	return state
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{`nil`, `null`},
+		{`json.null`, `null`},
+		{`true`, `true`},
+		{`false`, `false`},
+		{`42`, `42`},
+		{`-7`, `-7`},
+		{`1.0`, `1.0`},
+		{`0.5`, `0.5`},
+		{`1e100`, `1e+100`},
+		{`"hi"`, `"hi"`},
+		{`"a\"b\\c\n\0"`, `"a\"b\\c\n\u0000"`},
+		{`"\xff"`, `"\ufffd"`},
+		{`"h\u{e9}llo"`, `"héllo"`},
+		{`"\u{2028}"`, `"\u2028"`},
+		{`{}`, `{}`},
+		{`{1, 2, 3}`, `[1,2,3]`},
+		{`{1, nil, 3}`, `{"1":1,"3":3}`},
+		{`{b = 1, a = {true, json.null}}`, `{"a":[true,null],"b":1}`},
+		{`{[1] = "x", y = "z"}`, `{"1":"x","y":"z"}`},
+		{`{[1.5] = true}`, `{"1.5":true}`},
+		{`json.array()`, `[]`},
+		{`json.array({1, 2, x = 3})`, `[1,2]`},
+		{`json.object({1, 2})`, `{"1":1,"2":2}`},
+		{`json.decode("[]")`, `[]`},
+	}
+	state := newTestState(t)
+	for _, test := range tests {
+		if err := state.LoadString("return json.encode("+test.expr+")", "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Errorf("json.encode(%s): %v", test.expr, err)
+			continue
+		}
+		if got, _ := state.ToString(-1); got != test.want {
+			t.Errorf("json.encode(%s) = %s; want %s", test.expr, got, test.want)
+		}
+		state.SetTop(0)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{`print`, "cannot encode function"},
+		{`0/0`, "cannot encode NaN"},
+		{`math and 1 or 1/0`, "cannot encode +Inf"},
+		{`{[true] = 1}`, "cannot encode boolean key"},
+		{`{x = {print}}`, `"x": [1]: cannot encode function`},
+		{`(function() local t = {}; t.self = t; return t end)()`, "table contains itself"},
+	}
+	state := newTestState(t)
+	for _, test := range tests {
+		if err := state.LoadString("return json.encode("+test.expr+")", "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		err := state.Call(0, 1, 0)
+		if err == nil {
+			got, _ := state.ToString(-1)
+			t.Errorf("json.encode(%s) = %s; want error", test.expr, got)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("json.encode(%s) error = %v; want %q", test.expr, err, test.want)
+		}
+		state.SetTop(0)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	const prelude = "local out = {}\n" +
+		"function out:write(s) self[#self + 1] = s; return self end\n" +
+		"local function gen(n) local i = 0; return function() i = i + 1; if i <= n then return i end end end\n" +
+		"local big = {}; for i = 1, 2000 do big[i] = i end\n"
+	tests := []struct {
+		stmt       string
+		want       string
+		manyWrites bool
+	}{
+		{`json.write(out, {b = 1, a = {true}})`, `{"a":[true],"b":1}`, false},
+		{`json.write(out, "x")`, `"x"`, false},
+		{`json.writearray(out, ipairs({1, "a", {}}))`, `[1,"a",{}]`, false},
+		{`json.writearray(out, gen(3))`, `[1,2,3]`, false},
+		{`json.writearray(out, gen(0))`, `[]`, false},
+		{`json.writearray(out, ipairs(big))`, "", true},
+		{`json.write(out, big)`, "", true},
+	}
+	state := newTestState(t)
+	for _, test := range tests {
+		source := prelude +
+			"assert(" + test.stmt + " == out)\n" +
+			"local s = ''; for _, chunk in ipairs(out) do s = s .. chunk end\n" +
+			"return s, #out"
+		if err := state.LoadString(source, "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.stmt, err)
+			continue
+		}
+		if err := state.Call(0, 2, 0); err != nil {
+			t.Errorf("%s: %v", test.stmt, err)
+			continue
+		}
+		got, _ := state.ToString(1)
+		nWrites, _ := state.ToInteger(2)
+		if test.want != "" && got != test.want {
+			t.Errorf("%s wrote %s; want %s", test.stmt, got, test.want)
+		}
+		if test.manyWrites && nWrites < 2 {
+			t.Errorf("%s called write %d times; want several", test.stmt, nWrites)
+		}
+		state.SetTop(0)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{`json.write({write = function() return nil, "disk full" end}, 1)`, "disk full"},
+		{`json.write({}, 1)`, "attempt to call a nil value"},
+		{`json.writearray({write = function(self) return self end}, ipairs({1, print}))`, "[2]: cannot encode function"},
+	}
+	state := newTestState(t)
+	for _, test := range tests {
+		if err := state.LoadString(test.stmt, "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.stmt, err)
+			continue
+		}
+		if err := state.Call(0, 0, 0); err == nil {
+			t.Errorf("%s did not raise an error", test.stmt)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s error = %v; want %q", test.stmt, err, test.want)
+		}
+		state.SetTop(0)
+	}
+}
+
+func TestWriteArrayStopsAtFirstFailure(t *testing.T) {
+	const source = `
+		local calls = 0
+		local function gen()
+			calls = calls + 1
+			if calls <= 10 then return calls end
+		end
+		local out = {write = function() return nil, "disk full" end}
+		local ok = pcall(json.writearray, out, gen)
+		assert(not ok)
+		return calls
+	`
+	state := newTestState(t)
+	if err := state.LoadString(source, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if calls, _ := state.ToInteger(-1); calls != 1 {
+		t.Errorf("iterator called %d times; want 1", calls)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	const source = `
+		local t = json.decode('{"a": [1, 2.5, "x", null, true], "b": {}, "c": -9223372036854775808, "d": 1e400}')
+		assert(math.type(t.a[1]) == "integer")
+		assert(math.type(t.a[2]) == "float" and t.a[2] == 2.5)
+		assert(t.a[3] == "x")
+		assert(t.a[4] == json.null)
+		assert(t.a[5] == true)
+		assert(#t.a == 5)
+		assert(next(t.b) == nil)
+		assert(t.c == math.mininteger)
+		assert(t.d == math.huge)
+		assert(json.decode("12345678901234567890") == 12345678901234567890.0)
+		assert(json.decode(" null ") == json.null)
+		assert(json.decode('"\\u00e9"') == "\u{e9}")
+		assert(json.encode(json.decode('{"x":[]}')) == '{"x":[]}')
+		assert(not pcall(json.decode, "[1,]"))
+		assert(not pcall(json.decode, "1 2"))
+		assert(not pcall(json.decode, "[1"))
+		assert(not pcall(json.decode, ""))
+		assert(not pcall(json.decode, string.rep("[", 201) .. string.rep("]", 201)))
+		assert(pcall(json.decode, string.rep("[", 200) .. string.rep("]", 200)))
+	`
+	state := newTestState(t)
+	if err := lua.Require(state, lua.MathLibraryName, true, lua.NewOpenMath(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.Require(state, lua.StringLibraryName, true, lua.OpenString); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+	if err := state.LoadString(source, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoAPI(t *testing.T) {
+	state := newTestState(t)
+
+	const input = `{"name": "svc", "ports": [80, 443], "debug": false}`
+	if err := Decode(state, strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Top(); got != 1 {
+		t.Fatalf("after Decode, state.Top() = %d; want 1", got)
+	}
+	sb := new(strings.Builder)
+	if err := Encode(sb, state, -1); err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"debug":false,"name":"svc","ports":[80,443]}`
+	if got := sb.String(); got != want {
+		t.Errorf("Encode(Decode(%s)) = %s; want %s", input, got, want)
+	}
+	if got := state.Top(); got != 1 {
+		t.Errorf("after Encode, state.Top() = %d; want 1", got)
+	}
+	state.SetTop(0)
+
+	if err := Decode(state, strings.NewReader(`{"x": [1, }`)); err == nil {
+		t.Error("Decode of invalid JSON did not return an error")
+	} else if !strings.Contains(err.Error(), "offset") {
+		t.Errorf("Decode error = %v; want offset", err)
+	}
+	if got := state.Top(); got != 0 {
+		t.Errorf("after failed Decode, state.Top() = %d; want 0", got)
+	}
+
+	state.PushClosure(0, Open)
+	if err := Encode(io.Discard, state, -1); err == nil {
+		t.Error("Encode(function) did not return an error")
+	}
+	state.CreateTable(0, 0)
+	if err := Encode(errWriter{}, state, -1); !errors.Is(err, errWrite) {
+		t.Errorf("Encode to failing writer = %v; want %v", err, errWrite)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
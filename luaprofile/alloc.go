@@ -0,0 +1,172 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package luaprofile
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+
+	"zombiezen.com/go/lua"
+)
+
+// An AllocProfile records the memory that Lua code allocates,
+// attributed to the function that was running when the memory was allocated.
+// Allocations made by Go functions are attributed to the Go function.
+//
+// An AllocProfile must only be used on the goroutine that uses its state.
+type AllocProfile struct {
+	h hook
+	b builder
+
+	lastBytes  uint64
+	lastAllocs uint64
+}
+
+// StartAlloc starts recording the allocations made by l.
+// Allocations are attributed with call, return, and count hooks
+// (see [lua.State.AddHook]) that compare the state's [lua.MemoryStats]
+// with the previous event's,
+// so allocations are attributed at least every opts.Period instructions
+// and whenever a function is called or returns.
+// As with [Start], coroutines are only profiled
+// if they are created after the call to StartAlloc,
+// and there is no overhead when the profiler is not running.
+func StartAlloc(l *lua.State, opts *Options) *AllocProfile {
+	p := &AllocProfile{b: newBuilder()}
+	stats := l.MemoryStats()
+	p.lastBytes = stats.TotalAlloc
+	p.lastAllocs = stats.Allocs
+	p.h.start(l, lua.MaskCall|lua.MaskReturn, opts.period(), p.sample)
+	return p
+}
+
+func (p *AllocProfile) sample(l *lua.State, event lua.HookEvent) {
+	stats := l.MemoryStats()
+	bytes := stats.TotalAlloc - p.lastBytes
+	allocs := stats.Allocs - p.lastAllocs
+	p.lastBytes = stats.TotalAlloc
+	p.lastAllocs = stats.Allocs
+	if bytes == 0 && allocs == 0 {
+		return
+	}
+	level := 0
+	if event == lua.HookEventCall || event == lua.HookEventTailCall {
+		// The memory was allocated by the caller.
+		level = 1
+	}
+	p.b.record(l, level, [2]int64{int64(allocs), int64(bytes)})
+	// Recording the stack can allocate (for example, function names).
+	stats = l.MemoryStats()
+	p.lastBytes = stats.TotalAlloc
+	p.lastAllocs = stats.Allocs
+}
+
+// Stop stops recording and removes the profiler's hooks.
+// Calling Stop more than once has no effect.
+func (p *AllocProfile) Stop() {
+	p.h.stop()
+}
+
+// Write writes the allocations recorded so far to w
+// as a gzipped pprof protocol buffer.
+// Each sample has two values:
+// the number of memory blocks allocated and the number of bytes allocated.
+func (p *AllocProfile) Write(w io.Writer) error {
+	return p.b.write(w, profileHeader{
+		sampleTypes: [2]valueType{{"alloc_objects", "count"}, {"alloc_space", "bytes"}},
+		periodType:  valueType{"space", "bytes"},
+		period:      1,
+		start:       p.h.startTime,
+		end:         p.h.endTime(),
+	})
+}
+
+// Allocator is an entry in an [AllocProfile]'s report.
+type Allocator struct {
+	// Function is the name of the function.
+	Function string
+	// Source is the short source of the chunk that defined the function
+	// (or "[C]" for Go functions).
+	Source string
+	// Line is the line where the function was defined.
+	Line int
+	// Allocs is the number of memory blocks the function allocated.
+	Allocs int64
+	// Bytes is the number of bytes the function allocated.
+	Bytes int64
+}
+
+// Top returns the n functions that allocated the most bytes
+// in descending order.
+// Only the memory allocated directly by each function is counted,
+// not the memory allocated by the functions it called.
+// If n is negative, Top returns all functions that allocated memory.
+func (p *AllocProfile) Top(n int) []Allocator {
+	byFunc := make(map[uint64]int)
+	var result []Allocator
+	for _, s := range p.b.order {
+		funcID := p.b.locations[s.locIDs[0]-1].funcID
+		i, ok := byFunc[funcID]
+		if !ok {
+			f := p.b.functions[funcID-1]
+			i = len(result)
+			result = append(result, Allocator{
+				Function: f.name,
+				Source:   f.filename,
+				Line:     int(f.line),
+			})
+			byFunc[funcID] = i
+		}
+		result[i].Allocs += s.values[0]
+		result[i].Bytes += s.values[1]
+	}
+	slices.SortStableFunc(result, func(a, b Allocator) int {
+		switch {
+		case a.Bytes > b.Bytes:
+			return -1
+		case a.Bytes < b.Bytes:
+			return 1
+		default:
+			return 0
+		}
+	})
+	if n >= 0 && n < len(result) {
+		result = result[:n]
+	}
+	return result
+}
+
+// WriteReport writes a table of the n functions that allocated the most bytes
+// (as returned by [AllocProfile.Top]) to w.
+func (p *AllocProfile) WriteReport(w io.Writer, n int) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "BYTES\tALLOCS\tFUNCTION\n")
+	for _, a := range p.Top(n) {
+		fmt.Fprintf(tw, "%d\t%d\t%s (%s:%d)\n", a.Bytes, a.Allocs, a.Function, a.Source, a.Line)
+	}
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("luaprofile: write report: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package luaprofile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"zombiezen.com/go/lua"
+)
+
+// A builder accumulates stack samples for a pprof profile.
+type builder struct {
+	strings   []string
+	stringIDs map[string]int64
+	functions []function
+	funcIDs   map[function]uint64
+	locations []location
+	locIDs    map[location]uint64
+	samples   map[string]*sample
+	order     []*sample
+}
+
+type function struct {
+	name     string
+	filename string
+	line     int64
+}
+
+type location struct {
+	funcID uint64
+	line   int64
+}
+
+type sample struct {
+	locIDs []uint64
+	values [2]int64
+}
+
+func newBuilder() builder {
+	return builder{
+		strings:   []string{""},
+		stringIDs: map[string]int64{"": 0},
+		funcIDs:   make(map[function]uint64),
+		locIDs:    make(map[location]uint64),
+		samples:   make(map[string]*sample),
+	}
+}
+
+// record adds values to the sample for l's current call stack,
+// starting at the given stack level.
+func (b *builder) record(l *lua.State, level int, values [2]int64) {
+	var locIDs []uint64
+	for ; ; level++ {
+		ar := l.Stack(level)
+		if ar == nil {
+			break
+		}
+		info := ar.Info("Sln")
+		if info == nil {
+			break
+		}
+		f := function{
+			name:     info.Name,
+			filename: info.ShortSource,
+			line:     int64(info.LineDefined),
+		}
+		switch {
+		case info.What == "main":
+			f.name = "main chunk"
+		case info.What == "C":
+			if f.name == "" {
+				f.name = "?"
+			}
+			f.filename = "[C]"
+		case f.name == "":
+			f.name = fmt.Sprintf("function <%s:%d>", info.ShortSource, info.LineDefined)
+		}
+		locIDs = append(locIDs, b.location(location{
+			funcID: b.function(f),
+			line:   int64(max(info.CurrentLine, 0)),
+		}))
+	}
+	if len(locIDs) == 0 {
+		return
+	}
+	key := fmt.Sprint(locIDs)
+	s := b.samples[key]
+	if s == nil {
+		s = &sample{locIDs: locIDs}
+		b.samples[key] = s
+		b.order = append(b.order, s)
+	}
+	s.values[0] += values[0]
+	s.values[1] += values[1]
+}
+
+func (b *builder) string(s string) int64 {
+	id, ok := b.stringIDs[s]
+	if !ok {
+		id = int64(len(b.strings))
+		b.strings = append(b.strings, s)
+		b.stringIDs[s] = id
+	}
+	return id
+}
+
+func (b *builder) function(f function) uint64 {
+	id, ok := b.funcIDs[f]
+	if !ok {
+		b.functions = append(b.functions, f)
+		id = uint64(len(b.functions))
+		b.funcIDs[f] = id
+	}
+	return id
+}
+
+func (b *builder) location(loc location) uint64 {
+	id, ok := b.locIDs[loc]
+	if !ok {
+		b.locations = append(b.locations, loc)
+		id = uint64(len(b.locations))
+		b.locIDs[loc] = id
+	}
+	return id
+}
+
+type valueType struct {
+	typ  string
+	unit string
+}
+
+// profileHeader is the profile-wide information written by [builder.write].
+type profileHeader struct {
+	sampleTypes [2]valueType
+	periodType  valueType
+	period      int64
+	start       time.Time
+	end         time.Time
+}
+
+// write writes the samples to w as a gzipped pprof protocol buffer.
+func (b *builder) write(w io.Writer, hdr profileHeader) error {
+	var buf protoBuffer
+	encodeValueType := func(vt valueType) []byte {
+		var vb protoBuffer
+		vb.int(1, b.string(vt.typ))
+		vb.int(2, b.string(vt.unit))
+		return vb
+	}
+	for _, vt := range hdr.sampleTypes {
+		buf.bytes(1, encodeValueType(vt))
+	}
+	for _, s := range b.order {
+		var sb, ids, values protoBuffer
+		for _, id := range s.locIDs {
+			ids.varint(id)
+		}
+		for _, v := range s.values {
+			values.varint(uint64(v))
+		}
+		sb.bytes(1, ids)
+		sb.bytes(2, values)
+		buf.bytes(2, sb)
+	}
+	for i, loc := range b.locations {
+		var lb, line protoBuffer
+		lb.int(1, int64(i+1))
+		line.int(1, int64(loc.funcID))
+		line.int(2, loc.line)
+		lb.bytes(4, line)
+		buf.bytes(4, lb)
+	}
+	for i, f := range b.functions {
+		var fb protoBuffer
+		fb.int(1, int64(i+1))
+		fb.int(2, b.string(f.name))
+		fb.int(3, b.string(f.name))
+		fb.int(4, b.string(f.filename))
+		fb.int(5, f.line)
+		buf.bytes(5, fb)
+	}
+	// Intern all strings before writing the string table.
+	periodType := encodeValueType(hdr.periodType)
+	for _, s := range b.strings {
+		buf.bytes(6, []byte(s))
+	}
+	buf.int(9, hdr.start.UnixNano())
+	buf.int(10, int64(hdr.end.Sub(hdr.start)))
+	buf.bytes(11, periodType)
+	buf.int(12, hdr.period)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(buf); err != nil {
+		return fmt.Errorf("luaprofile: write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("luaprofile: write: %v", err)
+	}
+	return nil
+}
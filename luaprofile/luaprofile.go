@@ -0,0 +1,137 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package luaprofile provides sampling profilers for Lua code
+// that write profiles in the format used by the [pprof] tool.
+//
+// [pprof]: https://github.com/google/pprof
+package luaprofile
+
+import (
+	"io"
+	"time"
+
+	"zombiezen.com/go/lua"
+)
+
+// DefaultPeriod is the default number of Lua instructions between samples.
+const DefaultPeriod = 1000
+
+// Options is the set of optional parameters to [Start] and [StartAlloc].
+type Options struct {
+	// Period is the number of Lua instructions between samples.
+	// If Period is zero, then DefaultPeriod is used.
+	Period int
+}
+
+func (opts *Options) period() int {
+	if opts == nil || opts.Period <= 0 {
+		return DefaultPeriod
+	}
+	return opts.Period
+}
+
+// A Profile samples the call stack of a [lua.State]
+// every few Lua instructions.
+// Each sample attributes the instructions run since the previous sample
+// to the functions on the stack,
+// along with their sources and current lines.
+// Go functions do not execute Lua instructions,
+// so time spent in them is not sampled.
+//
+// A Profile must only be used on the goroutine that uses its state.
+type Profile struct {
+	h hook
+	b builder
+}
+
+// Start starts profiling l.
+// The profile is collected with a count hook (see [lua.State.AddHook]).
+// Instructions in coroutines are only sampled
+// if the coroutine was created after the call to Start.
+// No hook is added until Start is called
+// and the hook is removed by [Profile.Stop],
+// so there is no overhead when the profiler is not running.
+func Start(l *lua.State, opts *Options) *Profile {
+	p := &Profile{b: newBuilder()}
+	p.h.start(l, 0, opts.period(), func(l *lua.State, event lua.HookEvent) {
+		p.b.record(l, 0, [2]int64{1, int64(p.h.period)})
+	})
+	return p
+}
+
+// Stop stops profiling and removes the profiler's hook.
+// Calling Stop more than once has no effect.
+func (p *Profile) Stop() {
+	p.h.stop()
+}
+
+// Write writes the samples collected so far to w
+// as a gzipped pprof protocol buffer.
+// Each sample has two values:
+// the number of samples and the approximate number of instructions.
+func (p *Profile) Write(w io.Writer) error {
+	return p.b.write(w, profileHeader{
+		sampleTypes: [2]valueType{{"samples", "count"}, {"instructions", "count"}},
+		periodType:  valueType{"instructions", "count"},
+		period:      int64(p.h.period),
+		start:       p.h.startTime,
+		end:         p.h.endTime(),
+	})
+}
+
+// hook is a hook added by a profiler.
+type hook struct {
+	l         *lua.State
+	id        lua.HookID
+	period    int
+	startTime time.Time
+	stopTime  time.Time
+}
+
+// start adds a hook to l for the given events in addition to count events.
+// sample is called for every event.
+func (h *hook) start(l *lua.State, mask lua.HookMask, period int, sample func(l *lua.State, event lua.HookEvent)) {
+	h.l = l
+	h.period = period
+	h.startTime = time.Now()
+	h.id = l.AddHook(func(l *lua.State, event lua.HookEvent, ar *lua.ActivationRecord) error {
+		sample(l, event)
+		return nil
+	}, mask|lua.MaskCount, h.period)
+}
+
+func (h *hook) stop() {
+	if !h.stopTime.IsZero() {
+		return
+	}
+	h.stopTime = time.Now()
+	h.l.RemoveHook(h.id)
+}
+
+// endTime returns the time the profile stopped
+// or the current time if it is still running.
+func (h *hook) endTime() time.Time {
+	if h.stopTime.IsZero() {
+		return time.Now()
+	}
+	return h.stopTime
+}
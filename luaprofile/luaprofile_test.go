@@ -0,0 +1,167 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package luaprofile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"zombiezen.com/go/lua"
+)
+
+func TestProfile(t *testing.T) {
+	state := new(lua.State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	p := Start(state, &Options{Period: 100})
+	const source = "local function busy(n)\n" +
+		"  local x = 0\n" +
+		"  for i = 1, n do x = x + i end\n" +
+		"  return x\n" +
+		"end\n" +
+		"local result = busy(10000)\n" +
+		"return result\n"
+	if err := state.LoadString(source, "@busy.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if hook, _, _ := state.Hook(); hook != nil {
+		t.Error("hook still installed after Stop")
+	}
+	if len(p.b.samples) == 0 {
+		t.Fatal("no samples collected")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := p.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"busy", "busy.lua", "main chunk", "instructions"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("profile does not contain %q", want)
+		}
+	}
+}
+
+func TestProfilePreviousHook(t *testing.T) {
+	state := new(lua.State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	lines := 0
+	state.SetHook(func(l *lua.State, event lua.HookEvent, ar *lua.ActivationRecord) error {
+		lines++
+		return nil
+	}, lua.MaskLine, 0)
+	p := Start(state, nil)
+	if err := state.LoadString("local x = 1\nx = x + 1\nreturn x\n", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if lines != 3 {
+		t.Errorf("previous hook saw %d lines; want 3", lines)
+	}
+	if _, mask, _ := state.Hook(); mask != lua.MaskLine {
+		t.Errorf("after Stop, hook mask = %v; want %v", mask, lua.MaskLine)
+	}
+}
+
+func TestAllocProfile(t *testing.T) {
+	state := new(lua.State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "local function churn(n)\n" +
+		"  local t\n" +
+		"  for i = 1, n do t = {i, i, i, i} end\n" +
+		"  return t\n" +
+		"end\n" +
+		"local function quiet(n)\n" +
+		"  local x = 0\n" +
+		"  for i = 1, n do x = x + i end\n" +
+		"  return x\n" +
+		"end\n" +
+		"local a = churn(1000)\n" +
+		"local b = quiet(1000)\n" +
+		"return a, b\n"
+	if err := state.LoadString(source, "@churn.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+	p := StartAlloc(state, nil)
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	if hook, _, _ := state.Hook(); hook != nil {
+		t.Error("hook still installed after Stop")
+	}
+
+	top := p.Top(1)
+	if len(top) != 1 {
+		t.Fatalf("p.Top(1) = %+v; want 1 entry", top)
+	}
+	if got := top[0]; got.Function != "churn" || got.Source != "churn.lua" || got.Line != 1 || got.Allocs < 1000 || got.Bytes < 1000*64 {
+		t.Errorf("p.Top(1)[0] = %+v; want churn (churn.lua:1) with >= 1000 allocs and >= 64000 bytes", got)
+	}
+	for _, a := range p.Top(-1) {
+		if a.Function == "quiet" && a.Bytes > top[0].Bytes/10 {
+			t.Errorf("quiet allocated %d bytes; want much less than churn (%d)", a.Bytes, top[0].Bytes)
+		}
+	}
+
+	report := new(bytes.Buffer)
+	if err := p.WriteReport(report, 5); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(report.Bytes(), []byte("churn (churn.lua:1)")) {
+		t.Errorf("report does not mention churn:\n%s", report)
+	}
+	if err := p.Write(io.Discard); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package luaremote provides an HTTP interface to a live Lua state
+// for running diagnostics scripts.
+//
+// A [Handler] serves the following endpoints,
+// all of which exchange JSON:
+//
+//   - POST /eval with a body of {"code": "..."} runs a chunk
+//     and returns {"results": [...]}.
+//   - POST /call with a body of {"function": "name", "args": [...]}
+//     calls a global function and returns {"results": [...]}.
+//   - GET /global?name=... returns {"value": ...}
+//     with the value of a global variable.
+//
+// Failures are reported as {"error": "..."} with a non-2xx status code.
+// The handler can be served over any [net.Listener],
+// including Unix domain sockets.
+package luaremote
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"zombiezen.com/go/lua"
+)
+
+// maxRequestSize is the maximum size of a request body in bytes.
+const maxRequestSize = 1 << 20
+
+// maxDepth is the maximum nesting depth of converted values.
+const maxDepth = 100
+
+// Handler is an [http.Handler] that exposes a Lua state.
+type Handler struct {
+	// Do is called to run f with exclusive access to the state.
+	// Since a [lua.State] cannot be used from multiple goroutines concurrently,
+	// Do typically acquires a lock or runs f on the state's own goroutine.
+	// Do must return f's error.
+	Do func(f func(l *lua.State) error) error
+
+	// Token is the shared secret that clients must present
+	// in an "Authorization: Bearer <token>" header.
+	// If Token is empty, all requests are rejected.
+	Token string
+}
+
+// ServeHTTP handles an eval, call, or global request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	switch r.URL.Path {
+	case "/eval":
+		h.eval(w, r)
+	case "/call":
+		h.call(w, r)
+	case "/global":
+		h.global(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.Token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) == 1
+}
+
+func (h *Handler) eval(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if !readRequest(w, r, &req) {
+		return
+	}
+	var results []any
+	err := h.Do(func(l *lua.State) error {
+		base := l.Top()
+		defer l.SetTop(base)
+		if err := l.LoadString(req.Code, "=(remote)", "t"); err != nil {
+			return err
+		}
+		var err error
+		results, err = callResults(l, base, 0)
+		return err
+	})
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+func (h *Handler) call(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Function string            `json:"function"`
+		Args     []json.RawMessage `json:"args"`
+	}
+	if !readRequest(w, r, &req) {
+		return
+	}
+	var results []any
+	err := h.Do(func(l *lua.State) error {
+		base := l.Top()
+		defer l.SetTop(base)
+		if !l.CheckStack(len(req.Args) + 1) {
+			return errors.New("too many arguments")
+		}
+		tp, err := l.Global(req.Function, 0)
+		if err != nil {
+			return err
+		}
+		if tp != lua.TypeFunction {
+			return fmt.Errorf("%s is a %v, not a function", req.Function, tp)
+		}
+		for i, arg := range req.Args {
+			if err := pushJSON(l, arg); err != nil {
+				return fmt.Errorf("argument #%d: %v", i+1, err)
+			}
+		}
+		results, err = callResults(l, base, len(req.Args))
+		return err
+	})
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+func (h *Handler) global(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	name := r.FormValue("name")
+	var value any
+	err := h.Do(func(l *lua.State) error {
+		base := l.Top()
+		defer l.SetTop(base)
+		if _, err := l.Global(name, 0); err != nil {
+			return err
+		}
+		var err error
+		value, err = toJSON(l, -1, 0)
+		return err
+	})
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"value": value})
+}
+
+// callResults calls the function on the stack above base with nArgs arguments
+// and converts its results.
+func callResults(l *lua.State, base int, nArgs int) ([]any, error) {
+	if err := l.Call(nArgs, lua.MultipleReturns, 0); err != nil {
+		return nil, err
+	}
+	results := make([]any, 0, l.Top()-base)
+	for i := base + 1; i <= l.Top(); i++ {
+		v, err := toJSON(l, i, 0)
+		if err != nil {
+			return nil, fmt.Errorf("result #%d: %v", i-base, err)
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
+
+// toJSON converts the Lua value at idx to a value that can be marshaled as JSON.
+// Sequences become arrays and other tables become objects.
+// Values with no JSON equivalent (like functions) are converted to strings.
+func toJSON(l *lua.State, idx int, depth int) (any, error) {
+	if depth >= maxDepth {
+		return nil, errors.New("value nested too deeply (cycle?)")
+	}
+	idx = l.AbsIndex(idx)
+	switch tp := l.Type(idx); tp {
+	case lua.TypeNil, lua.TypeNone:
+		return nil, nil
+	case lua.TypeBoolean:
+		return l.ToBoolean(idx), nil
+	case lua.TypeNumber:
+		if l.IsInteger(idx) {
+			n, _ := l.ToInteger(idx)
+			return n, nil
+		}
+		n, _ := l.ToNumber(idx)
+		if math.IsInf(n, 0) || math.IsNaN(n) {
+			return strconv.FormatFloat(n, 'g', -1, 64), nil
+		}
+		return n, nil
+	case lua.TypeString:
+		s, _ := l.ToString(idx)
+		return s, nil
+	case lua.TypeTable:
+		return tableToJSON(l, idx, depth)
+	default:
+		return fmt.Sprintf("%v: %#x", tp, l.ToPointer(idx)), nil
+	}
+}
+
+func tableToJSON(l *lua.State, idx int, depth int) (any, error) {
+	if !l.CheckStack(3) {
+		return nil, errors.New("stack overflow")
+	}
+	n := l.RawLen(idx)
+	isArray := true
+	count := uint64(0)
+	l.PushNil()
+	for l.Next(idx) {
+		count++
+		if k, ok := l.ToInteger(-2); !ok || !l.IsInteger(-2) || k < 1 || uint64(k) > n {
+			isArray = false
+		}
+		l.Pop(1)
+	}
+	if isArray && count == n && n > 0 {
+		arr := make([]any, 0, n)
+		for i := int64(1); i <= int64(n); i++ {
+			l.RawIndex(idx, i)
+			v, err := toJSON(l, -1, depth+1)
+			l.Pop(1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+
+	obj := make(map[string]any)
+	l.PushNil()
+	for l.Next(idx) {
+		var key string
+		if l.Type(-2) == lua.TypeString {
+			key, _ = l.ToString(-2)
+		} else {
+			k, err := toJSON(l, -2, depth+1)
+			if err != nil {
+				l.Pop(2)
+				return nil, err
+			}
+			key = fmt.Sprint(k)
+		}
+		v, err := toJSON(l, -1, depth+1)
+		l.Pop(1)
+		if err != nil {
+			l.Pop(1)
+			return nil, err
+		}
+		obj[key] = v
+	}
+	return obj, nil
+}
+
+// pushJSON pushes the Lua equivalent of a JSON value.
+// Arrays and objects become tables and null becomes nil.
+func pushJSON(l *lua.State, data json.RawMessage) error {
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	return pushValue(l, v, 0)
+}
+
+func pushValue(l *lua.State, v any, depth int) error {
+	if depth >= maxDepth {
+		return errors.New("value nested too deeply")
+	}
+	if !l.CheckStack(3) {
+		return errors.New("stack overflow")
+	}
+	switch v := v.(type) {
+	case nil:
+		l.PushNil()
+	case bool:
+		l.PushBoolean(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			l.PushInteger(n)
+		} else if f, err := v.Float64(); err == nil {
+			l.PushNumber(f)
+		} else {
+			return err
+		}
+	case string:
+		l.PushString(v)
+	case []any:
+		l.CreateTable(len(v), 0)
+		for i, elem := range v {
+			if err := pushValue(l, elem, depth+1); err != nil {
+				l.Pop(1)
+				return err
+			}
+			l.RawSetIndex(-2, int64(i+1))
+		}
+	case map[string]any:
+		l.CreateTable(0, len(v))
+		for k, elem := range v {
+			if err := pushValue(l, elem, depth+1); err != nil {
+				l.Pop(1)
+				return err
+			}
+			l.RawSetField(-2, k)
+		}
+	default:
+		return fmt.Errorf("unsupported JSON value %T", v)
+	}
+	return nil
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("parse request: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]any{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		code = http.StatusInternalServerError
+		data, _ = json.Marshal(map[string]any{"error": err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(code)
+	w.Write(data)
+}
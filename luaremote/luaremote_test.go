@@ -0,0 +1,153 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package luaremote
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"zombiezen.com/go/lua"
+)
+
+func TestHandler(t *testing.T) {
+	state := new(lua.State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := lua.Require(state, lua.GName, true, lua.NewOpenBase(io.Discard, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+	const setup = `counter = 3` + "\n" +
+		`function add(a, b) return a + b end` + "\n" +
+		`config = {name = "svc", ports = {80, 443}}`
+	if err := state.LoadString(setup, "=(setup)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const token = "xyzzy"
+	var mu sync.Mutex
+	srv := httptest.NewServer(&Handler{
+		Token: token,
+		Do: func(f func(l *lua.State) error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return f(state)
+		},
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		token    string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "Eval",
+			method:   http.MethodPost,
+			path:     "/eval",
+			body:     `{"code": "return counter * 2, 'hi', nil"}`,
+			token:    token,
+			wantCode: http.StatusOK,
+			want:     `{"results":[6,"hi",null]}`,
+		},
+		{
+			name:     "EvalError",
+			method:   http.MethodPost,
+			path:     "/eval",
+			body:     `{"code": "error('bork')"}`,
+			token:    token,
+			wantCode: http.StatusUnprocessableEntity,
+			want:     `{"error":"(remote):1: bork"}`,
+		},
+		{
+			name:     "Call",
+			method:   http.MethodPost,
+			path:     "/call",
+			body:     `{"function": "add", "args": [40, 2]}`,
+			token:    token,
+			wantCode: http.StatusOK,
+			want:     `{"results":[42]}`,
+		},
+		{
+			name:     "Global",
+			method:   http.MethodGet,
+			path:     "/global?name=config",
+			token:    token,
+			wantCode: http.StatusOK,
+			want:     `{"value":{"name":"svc","ports":[80,443]}}`,
+		},
+		{
+			name:     "Unauthorized",
+			method:   http.MethodPost,
+			path:     "/eval",
+			body:     `{"code": "counter = 0"}`,
+			token:    "wrong",
+			wantCode: http.StatusUnauthorized,
+			want:     `{"error":"unauthorized"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.wantCode {
+				t.Errorf("status = %d; want %d", resp.StatusCode, test.wantCode)
+			}
+			if string(got) != test.want {
+				t.Errorf("body = %s; want %s", got, test.want)
+			}
+		})
+	}
+
+	if got, err := state.Global("counter", 0); err != nil || got != lua.TypeNumber {
+		t.Fatalf("counter is %v (err = %v)", got, err)
+	}
+	if n, _ := state.ToInteger(-1); n != 3 {
+		t.Errorf("counter = %d after unauthorized request; want 3", n)
+	}
+}
@@ -0,0 +1,552 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime/cgo"
+	"strconv"
+	"strings"
+)
+
+// IntegerMode determines how [MarshalOptions] represents numbers in Go.
+type IntegerMode int
+
+const (
+	// IntegerInt64 converts Lua integers to int64
+	// and Lua floats to float64.
+	IntegerInt64 IntegerMode = iota
+	// IntegerInt converts Lua integers to int
+	// and Lua floats to float64.
+	// Integers that do not fit in an int are an error.
+	IntegerInt
+	// IntegerFloat64 converts all Lua numbers to float64,
+	// as encoding/json does.
+	// When pushing, float64 values that are exact integers
+	// become Lua integers.
+	IntegerFloat64
+)
+
+// MarshalOptions is the set of parameters for converting
+// between Lua values and trees of dynamically typed Go values
+// (like those used by encoding/json).
+// To convert to or from values of static Go types,
+// use [PushAny] and [Unmarshal] instead;
+// [MarshalOptions.Push] uses PushAny for types it does not handle itself.
+// A nil *MarshalOptions is treated the same as the zero value.
+type MarshalOptions struct {
+	// Integers determines how numbers are converted.
+	Integers IntegerMode
+}
+
+// Marshal converts the Lua value at the given index to a Go value
+// using the default [MarshalOptions].
+func Marshal(l *State, idx int) (any, error) {
+	return (*MarshalOptions)(nil).Marshal(l, idx)
+}
+
+// Push converts a Go value to a Lua value and pushes it onto the stack
+// using the default [MarshalOptions].
+func Push(l *State, v any) error {
+	return (*MarshalOptions)(nil).Push(l, v)
+}
+
+// CallByName calls the function named by path,
+// a global variable name optionally followed by dot-separated field names
+// (like "hooks.on_request"),
+// with args converted by [Push]
+// and returns its results converted by [Marshal].
+// Fields are looked up as in Lua, so metamethods may be invoked.
+// If the function raises an error,
+// CallByName returns an error that wraps an [*Error]
+// whose Traceback field has the Lua stack traceback.
+// CallByName leaves the stack as it found it.
+func CallByName(l *State, path string, args ...any) ([]any, error) {
+	base := l.Top()
+	defer l.SetTop(base)
+	if !l.CheckStack(2 + len(args)) {
+		return nil, fmt.Errorf("lua: call %s: stack overflow", path)
+	}
+
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	for i := 0; ; {
+		n := strings.IndexByte(path[i:], '.')
+		if n < 0 {
+			n = len(path) - i
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("lua: call %s: invalid name", path)
+		}
+		if i > 0 {
+			if tp := l.Type(-1); tp != TypeTable && tp != TypeUserdata {
+				return nil, fmt.Errorf("lua: call %s: %s is a %v value", path, path[:i-1], tp)
+			}
+		}
+		if _, err := l.Field(-1, path[i:i+n], 0); err != nil {
+			return nil, fmt.Errorf("lua: call %s: %w", path, err)
+		}
+		l.Remove(-2)
+		i += n + 1
+		if i > len(path) {
+			break
+		}
+	}
+	if l.IsNil(-1) {
+		return nil, fmt.Errorf("lua: call %s: function not found", path)
+	}
+
+	p := &pusher{l: l, visiting: make(map[uintptr]struct{})}
+	for i, arg := range args {
+		if err := p.value(arg, 0); err != nil {
+			return nil, fmt.Errorf("lua: call %s: argument #%d: %w", path, i+1, err)
+		}
+	}
+	capture := l.ErrorCapture()
+	l.SetErrorCapture(capture | CaptureTraceback)
+	err := l.Call(len(args), MultipleReturns, 0)
+	l.SetErrorCapture(capture)
+	if err != nil {
+		return nil, fmt.Errorf("lua: call %s: %w", path, err)
+	}
+	var results []any
+	m := &marshaler{l: l, visiting: make(map[uintptr]struct{})}
+	for idx := base + 1; idx <= l.Top(); idx++ {
+		v, err := m.value(idx, 0)
+		if err != nil {
+			return nil, fmt.Errorf("lua: call %s: result #%d: %w", path, idx-base, err)
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
+
+// Marshal converts the Lua value at the given index to a Go value.
+// Values are converted as follows:
+//
+//   - nil becomes nil.
+//   - Booleans become bool.
+//   - Numbers are converted according to opts.Integers.
+//   - Strings become string.
+//   - Tables whose keys are exactly the integers 1 through n (for n > 0)
+//     become []any.
+//   - Other tables, including empty tables, become map[string]any.
+//     Numeric keys are formatted in decimal
+//     and keys of other types are an error.
+//     A table that has both a number key and the equivalent string key
+//     (like [1] and ["1"]) is an error.
+//   - Userdata created by [NewUserdata] become the pointer to their Go value,
+//     and userdata created by [PushStruct] become their bound pointer.
+//
+// Tables are read without invoking metamethods.
+// Other values, and tables that contain themselves
+// (which report [ErrCycle]), are an error.
+// If a value cannot be converted, Marshal returns a [*ConversionError].
+func (opts *MarshalOptions) Marshal(l *State, idx int) (any, error) {
+	m := &marshaler{l: l, visiting: make(map[uintptr]struct{})}
+	if opts != nil {
+		m.opts = *opts
+	}
+	v, err := m.value(l.AbsIndex(idx), 0)
+	if err != nil {
+		return nil, fmt.Errorf("lua: marshal: %w", err)
+	}
+	return v, nil
+}
+
+// marshaler holds the state of a call to [MarshalOptions.Marshal].
+type marshaler struct {
+	l    *State
+	opts MarshalOptions
+	// visiting holds the addresses of the tables being converted.
+	visiting map[uintptr]struct{}
+}
+
+// value converts the value at the absolute index idx.
+func (m *marshaler) value(idx int, depth int) (any, error) {
+	l := m.l
+	switch tp := l.Type(idx); tp {
+	case TypeNil, TypeNone:
+		return nil, nil
+	case TypeBoolean:
+		return l.ToBoolean(idx), nil
+	case TypeNumber:
+		return m.number(idx)
+	case TypeString:
+		s, _ := l.ToString(idx)
+		return s, nil
+	case TypeTable:
+		return m.table(idx, depth)
+	case TypeUserdata:
+		if x, ok := goValue(l, idx); ok {
+			if rv, ok := x.(*reflect.Value); ok && rv.Kind() == reflect.Pointer {
+				// Bound with PushStruct.
+				return rv.Interface(), nil
+			}
+			return x, nil
+		}
+		fallthrough
+	default:
+		return nil, &ConversionError{
+			LuaType: tp,
+			Kind:    ErrUnsupportedType,
+			msg:     fmt.Sprintf("cannot marshal %v", tp),
+		}
+	}
+}
+
+func (m *marshaler) number(idx int) (any, error) {
+	l := m.l
+	if !l.IsInteger(idx) || m.opts.Integers == IntegerFloat64 {
+		f, _ := l.ToNumber(idx)
+		return f, nil
+	}
+	i, _ := l.ToInteger(idx)
+	if m.opts.Integers != IntegerInt {
+		return i, nil
+	}
+	if int64(int(i)) != i {
+		return nil, &ConversionError{
+			GoType:  reflect.TypeOf(0),
+			LuaType: TypeNumber,
+			Kind:    ErrOverflow,
+			msg:     fmt.Sprintf("%d overflows int", i),
+		}
+	}
+	return int(i), nil
+}
+
+func (m *marshaler) table(idx int, depth int) (any, error) {
+	l := m.l
+	if depth >= maxConvertDepth {
+		return nil, tooDeepError(nil, TypeTable)
+	}
+	ptr := l.ToPointer(idx)
+	if _, cyclic := m.visiting[ptr]; cyclic {
+		return nil, &ConversionError{
+			LuaType: TypeTable,
+			Kind:    ErrCycle,
+			msg:     "table contains itself",
+		}
+	}
+	m.visiting[ptr] = struct{}{}
+	defer delete(m.visiting, ptr)
+	if !l.CheckStack(3) {
+		return nil, errors.New("stack overflow")
+	}
+
+	if n := l.RawLen(idx); n > 0 && isSequence(l, idx, n) {
+		s := make([]any, n)
+		for i := range s {
+			l.RawIndex(idx, int64(i)+1)
+			v, err := m.value(l.AbsIndex(-1), depth+1)
+			l.Pop(1)
+			if err != nil {
+				return nil, prependPath(err, indexSegment(int64(i)+1))
+			}
+			s[i] = v
+		}
+		return s, nil
+	}
+
+	obj := make(map[string]any)
+	l.PushNil()
+	for l.Next(idx) {
+		seg := luaKeySegment(l, -2)
+		key, err := stringMapKey(l, -2, obj)
+		if err != nil {
+			l.Pop(2)
+			return nil, prependPath(err, seg)
+		}
+		v, err := m.value(l.AbsIndex(-1), depth+1)
+		if err != nil {
+			l.Pop(2)
+			return nil, prependPath(err, seg)
+		}
+		obj[key] = v
+		l.Pop(1)
+	}
+	return obj, nil
+}
+
+// stringMapKey converts the table key at the given index
+// to a key for the map[string]any m
+// as described in [MarshalOptions.Marshal] and [ToMap].
+// Numbers are formatted in decimal.
+// stringMapKey returns an error if the converted key is already in m
+// (as when a table has both [1] and ["1"]).
+func stringMapKey(l *State, idx int, m map[string]any) (string, error) {
+	var key string
+	switch tp := l.Type(idx); tp {
+	case TypeString:
+		key, _ = l.ToString(idx)
+	case TypeNumber:
+		if i, ok := l.ToInteger(idx); ok {
+			key = strconv.FormatInt(i, 10)
+		} else {
+			f, _ := l.ToNumber(idx)
+			key = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	default:
+		return "", &ConversionError{
+			GoType:  stringMapType,
+			LuaType: tp,
+			Kind:    ErrUnsupportedType,
+			msg:     fmt.Sprintf("cannot use %v as map key", tp),
+		}
+	}
+	if _, dup := m[key]; dup {
+		return "", &ConversionError{
+			GoType:  stringMapType,
+			LuaType: l.Type(idx),
+			Kind:    ErrUnsupportedType,
+			msg:     fmt.Sprintf("table has both string and number keys for %q", key),
+		}
+	}
+	return key, nil
+}
+
+// isSequence reports whether the keys of the table at the given index
+// are exactly the integers 1 through n.
+func isSequence(l *State, idx int, n uint64) bool {
+	count := uint64(0)
+	l.PushNil()
+	for l.Next(idx) {
+		count++
+		if k, ok := l.ToInteger(-2); !ok || !l.IsInteger(-2) || k < 1 || uint64(k) > n {
+			l.Pop(2)
+			return false
+		}
+		l.Pop(1)
+	}
+	return count == n
+}
+
+// goValue returns the Go value held by the userdata at the given index
+// if it was created by [NewUserdata].
+func goValue(l *State, idx int) (any, bool) {
+	if l.UserValue(idx, 1) != TypeUserdata {
+		l.Pop(1)
+		return nil, false
+	}
+	handle := cgo.Handle(unmarshalUintptr(TestUserdata(l, -1, goValueMetatableName)))
+	l.Pop(1)
+	if handle == 0 {
+		return nil, false
+	}
+	return handle.Value(), true
+}
+
+// Push converts a Go value to a Lua value and pushes it onto the stack.
+// Push accepts the values produced by [MarshalOptions.Marshal]
+// and converts them as follows:
+//
+//   - nil becomes nil.
+//   - bool becomes a boolean.
+//   - float32 and float64 become floats,
+//     unless opts.Integers is [IntegerFloat64]
+//     and the value is an exact integer.
+//   - string and []byte become strings.
+//   - []any becomes a sequence.
+//   - map[string]any and map[any]any become tables.
+//     Keys of a map[any]any that convert to nil or NaN are an error.
+//   - [Function] becomes a Go closure with no upvalues.
+//   - Pointers to structs are bound with [PushStruct].
+//   - Values that implement [Marshaler] are pushed
+//     by calling their PushLua method.
+//
+// Other values are converted as by [PushAny].
+// A []any, map[string]any, or map[any]any that contains itself
+// is an error that matches [ErrCycle].
+// If a value cannot be converted, Push returns a [*ConversionError].
+// If Push returns an error, then nothing is pushed onto the stack.
+func (opts *MarshalOptions) Push(l *State, v any) error {
+	p := &pusher{l: l, visiting: make(map[uintptr]struct{})}
+	if opts != nil {
+		p.opts = *opts
+	}
+	if err := p.value(v, 0); err != nil {
+		return fmt.Errorf("lua: push: %w", err)
+	}
+	return nil
+}
+
+// pusher holds the state of a call to [MarshalOptions.Push].
+type pusher struct {
+	l    *State
+	opts MarshalOptions
+	// visiting holds the addresses of the slices and maps being converted.
+	visiting map[uintptr]struct{}
+}
+
+func (p *pusher) value(v any, depth int) error {
+	l := p.l
+	if !l.CheckStack(3) {
+		return errors.New("stack overflow")
+	}
+	if m, ok := v.(Marshaler); ok {
+		if rv := reflect.ValueOf(v); rv.Kind() != reflect.Pointer || !rv.IsNil() {
+			return pushMarshaler(l, m)
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		l.PushNil()
+	case bool:
+		l.PushBoolean(v)
+	case string:
+		l.PushString(v)
+	case []byte:
+		l.PushString(string(v))
+	case float64:
+		p.float(v)
+	case float32:
+		p.float(float64(v))
+	case Function:
+		if v == nil {
+			l.PushNil()
+		} else {
+			l.PushClosure(0, v)
+		}
+	case []any:
+		if v == nil {
+			l.PushNil()
+			return nil
+		}
+		if err := p.enter(reflect.ValueOf(v), depth); err != nil {
+			return err
+		}
+		defer p.leave(reflect.ValueOf(v))
+		l.CreateTable(len(v), 0)
+		for i, elem := range v {
+			if err := p.value(elem, depth+1); err != nil {
+				l.Pop(1)
+				return prependPath(err, indexSegment(int64(i)+1))
+			}
+			l.RawSetIndex(-2, int64(i)+1)
+		}
+	case map[string]any:
+		if v == nil {
+			l.PushNil()
+			return nil
+		}
+		if err := p.enter(reflect.ValueOf(v), depth); err != nil {
+			return err
+		}
+		defer p.leave(reflect.ValueOf(v))
+		l.CreateTable(0, len(v))
+		for k, elem := range v {
+			if err := p.value(elem, depth+1); err != nil {
+				l.Pop(1)
+				return prependPath(err, fieldSegment(k))
+			}
+			l.RawSetField(-2, k)
+		}
+	case map[any]any:
+		if v == nil {
+			l.PushNil()
+			return nil
+		}
+		if err := p.enter(reflect.ValueOf(v), depth); err != nil {
+			return err
+		}
+		defer p.leave(reflect.ValueOf(v))
+		l.CreateTable(0, len(v))
+		for k, elem := range v {
+			seg := goKeySegment(reflect.ValueOf(k))
+			if err := p.value(k, depth+1); err != nil {
+				l.Pop(1)
+				return prependPath(err, seg)
+			}
+			if bad := badTableKey(l, -1); bad != "" {
+				l.Pop(2)
+				return &ConversionError{
+					GoType:  reflect.TypeOf(v),
+					LuaType: TypeNone,
+					Kind:    ErrUnsupportedType,
+					msg:     "map has " + bad + " key",
+				}
+			}
+			if err := p.value(elem, depth+1); err != nil {
+				l.Pop(2)
+				return prependPath(err, seg)
+			}
+			l.RawSet(-3)
+		}
+	default:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Pointer && rv.Type().Elem().Kind() == reflect.Struct {
+			if rv.IsNil() {
+				l.PushNil()
+				return nil
+			}
+			return pushBoundStruct(l, rv)
+		}
+		return pushValue(l, rv, depth)
+	}
+	return nil
+}
+
+func (p *pusher) float(f float64) {
+	if p.opts.Integers == IntegerFloat64 {
+		if i, ok := floatToInteger(f); ok {
+			p.l.PushInteger(i)
+			return
+		}
+	}
+	p.l.PushNumber(f)
+}
+
+// floatToInteger returns the integer equal to f, if one exists.
+func floatToInteger(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= -math.MinInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// enter marks the slice or map v as being converted,
+// returning an error if it is already being converted
+// or if depth exceeds the maximum nesting.
+func (p *pusher) enter(v reflect.Value, depth int) error {
+	if depth >= maxConvertDepth {
+		return tooDeepError(v.Type(), TypeNone)
+	}
+	ptr := uintptr(v.UnsafePointer())
+	if _, cyclic := p.visiting[ptr]; cyclic && ptr != 0 {
+		return &ConversionError{
+			GoType:  v.Type(),
+			LuaType: TypeNone,
+			Kind:    ErrCycle,
+			msg:     fmt.Sprintf("%v contains itself", v.Type()),
+		}
+	}
+	p.visiting[ptr] = struct{}{}
+	return nil
+}
+
+// leave undoes a successful call to enter.
+func (p *pusher) leave(v reflect.Value) {
+	delete(p.visiting, uintptr(v.UnsafePointer()))
+}
@@ -0,0 +1,293 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalPush(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = `return {
+		name = "svc",
+		ports = {80, 443},
+		ratio = 0.5,
+		whole = 2.0,
+		enabled = true,
+		empty = {},
+		sparse = {[1] = "a", [3] = "c"},
+	}`
+	if err := state.LoadString(source, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Marshal(state, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"name":    "svc",
+		"ports":   []any{int64(80), int64(443)},
+		"ratio":   0.5,
+		"whole":   2.0,
+		"enabled": true,
+		"empty":   map[string]any{},
+		"sparse":  map[string]any{"1": "a", "3": "c"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Marshal(...) = %#v; want %#v", got, want)
+	}
+
+	gotInt, err := (&MarshalOptions{Integers: IntegerInt}).Marshal(state, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports := gotInt.(map[string]any)["ports"]; !reflect.DeepEqual(ports, []any{80, 443}) {
+		t.Errorf("Marshal(..., IntegerInt).ports = %#v; want []any{80, 443}", ports)
+	}
+	gotFloat, err := (&MarshalOptions{Integers: IntegerFloat64}).Marshal(state, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports := gotFloat.(map[string]any)["ports"]; !reflect.DeepEqual(ports, []any{80.0, 443.0}) {
+		t.Errorf("Marshal(..., IntegerFloat64).ports = %#v; want []any{80.0, 443.0}", ports)
+	}
+	state.Pop(1)
+
+	// Round trip through Push.
+	if err := Push(state, want); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := Marshal(state, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTrip, want) {
+		t.Errorf("Marshal(Push(%#v)) = %#v", want, roundTrip)
+	}
+	state.Pop(1)
+
+	// Other Go types are converted as by PushAny.
+	if err := Push(state, map[float64]int{1.5: 1}); err != nil {
+		t.Error("Push(map[float64]int{1.5: 1}):", err)
+	} else {
+		state.PushNumber(1.5)
+		if got := state.RawGet(-2); got != TypeNumber {
+			t.Errorf("Push(map[float64]int{1.5: 1})[1.5] is a %v; want number", got)
+		}
+		state.Pop(2)
+	}
+
+	// A table with both [1] and ["1"] cannot be represented.
+	if err := state.LoadString(`return {[1] = "num", ["1"] = "str"}`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Marshal(state, -1); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Marshal({[1] = \"num\", [\"1\"] = \"str\"}) = %#v, %v; want error %v", got, err, ErrUnsupportedType)
+	}
+	state.Pop(1)
+
+	// IntegerFloat64 pushes whole floats as integers.
+	opts := &MarshalOptions{Integers: IntegerFloat64}
+	if err := opts.Push(state, []any{1.0, 1.5, math.Inf(1)}); err != nil {
+		t.Fatal(err)
+	}
+	for i, wantInteger := range []bool{true, false, false} {
+		state.RawIndex(-1, int64(i)+1)
+		if got := state.IsInteger(-1); got != wantInteger {
+			t.Errorf("element %d is integer = %t; want %t", i+1, got, wantInteger)
+		}
+		state.Pop(1)
+	}
+	state.Pop(1)
+}
+
+func TestMarshalUserdata(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	type point struct{ X, Y int }
+	p := &point{X: 1, Y: 2}
+	if err := PushStruct(state, p); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewUserdata(state, "hello", "test.string"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Marshal(state, -2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != p {
+		t.Errorf("Marshal(PushStruct(p)) = %#v; want %p", got, p)
+	}
+	got, err = Marshal(state, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := got.(*string); !ok || *s != "hello" {
+		t.Errorf("Marshal(NewUserdata(\"hello\")) = %#v; want *string", got)
+	}
+	state.SetTop(0)
+
+	if err := Push(state, map[string]any{"p": p}); err != nil {
+		t.Fatal(err)
+	}
+	state.RawField(-1, "p")
+	if got := TestStruct[point](state, -1); got != p {
+		t.Errorf("Push bound %p; want %p", got, p)
+	}
+	state.SetTop(0)
+
+	state.NewUserdataUV(4, 0)
+	if _, err := Marshal(state, -1); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Marshal(plain userdata) error = %v; want %v", err, ErrUnsupportedType)
+	}
+	state.SetTop(0)
+}
+
+func TestMarshalCycles(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	if err := state.LoadString(`local t = {x = {}}; t.x[1] = t; return t`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Marshal(state, -1)
+	if !errors.Is(err, ErrCycle) {
+		t.Errorf("Marshal(cyclic table) error = %v; want %v", err, ErrCycle)
+	} else if e := new(ConversionError); !errors.As(err, &e) || e.Path != "x[1]" {
+		t.Errorf("Marshal(cyclic table) error = %v; want path x[1]", err)
+	}
+	state.SetTop(0)
+
+	m := map[string]any{}
+	m["self"] = []any{m}
+	if err := Push(state, m); !errors.Is(err, ErrCycle) {
+		t.Errorf("Push(cyclic map) error = %v; want %v", err, ErrCycle)
+	}
+	if got := state.Top(); got != 0 {
+		t.Errorf("after failed Push, state.Top() = %d; want 0", got)
+	}
+
+	shared := []any{"x"}
+	if err := Push(state, []any{shared, shared}); err != nil {
+		t.Error("Push with shared slice:", err)
+	}
+	state.SetTop(0)
+
+	if err := Push(state, []any{uint64(math.MaxUint64)}); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Push(MaxUint64) error = %v; want %v", err, ErrOverflow)
+	}
+	if err := Push(state, make(chan int)); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Push(make(chan int)) error = %v; want %v", err, ErrUnsupportedType)
+	}
+	if err := Push(state, map[any]any{math.NaN(): 1}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Push(map[any]any{NaN: 1}) error = %v; want %v", err, ErrUnsupportedType)
+	}
+	if got := state.Top(); got != 0 {
+		t.Errorf("after failed Push, state.Top() = %d; want 0", got)
+	}
+}
+
+func TestCallByName(t *testing.T) {
+	l := new(State)
+	defer func() {
+		if err := l.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(l); err != nil {
+		t.Fatal(err)
+	}
+	const source = `hooks = {request = {}}` + "\n" +
+		`function hooks.request.handle(name, opts)` + "\n" +
+		`  if name == "boom" then error("exploded") end` + "\n" +
+		`  return "hello, " .. name, opts.count * 2` + "\n" +
+		`end` + "\n" +
+		`function greet() return end`
+	if err := l.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := CallByName(l, "hooks.request.handle", "world", map[string]any{"count": 21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{"hello, world", int64(42)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CallByName(...) = %#v; want %#v", got, want)
+	}
+	if top := l.Top(); top != 0 {
+		t.Errorf("after CallByName, l.Top() = %d; want 0", top)
+	}
+
+	if got, err := CallByName(l, "greet"); err != nil || len(got) != 0 {
+		t.Errorf("CallByName(l, \"greet\") = %v, %v; want [], <nil>", got, err)
+	}
+
+	_, err = CallByName(l, "hooks.request.handle", "boom", map[string]any{})
+	var luaErr *Error
+	if !errors.As(err, &luaErr) {
+		t.Errorf("CallByName(...) error = %v; want *Error", err)
+	} else if !strings.Contains(luaErr.Traceback, "stack traceback:") {
+		t.Errorf("Traceback = %q; want traceback", luaErr.Traceback)
+	}
+
+	for _, path := range []string{"missing", "hooks.missing", "hooks.missing.handle", "hooks..request", ""} {
+		if _, err := CallByName(l, path); err == nil {
+			t.Errorf("CallByName(l, %q) did not return an error", path)
+		}
+	}
+	if top := l.Top(); top != 0 {
+		t.Errorf("after failed CallByName, l.Top() = %d; want 0", top)
+	}
+}
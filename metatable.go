@@ -0,0 +1,187 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// MetatableBuilder declares the methods and metamethods
+// of userdata that hold Go values of type T.
+// The metatable is created in a state's registry
+// the first time it is needed
+// and reused afterward.
+//
+// A MetatableBuilder should not be modified once it has been used,
+// but it may then be shared among states and goroutines.
+type MetatableBuilder[T any] struct {
+	name        string
+	methods     map[string]func(*State, *T) (int, error)
+	metamethods map[string]Function
+}
+
+// NewMetatableFor returns a new [MetatableBuilder] for the type T
+// with the given registry name (see [NewMetatable]).
+// If name is empty, T's Go type name is used.
+func NewMetatableFor[T any](name string) *MetatableBuilder[T] {
+	if name == "" {
+		name = reflect.TypeOf((*T)(nil)).Elem().String()
+	}
+	return &MetatableBuilder[T]{
+		name:        name,
+		methods:     make(map[string]func(*State, *T) (int, error)),
+		metamethods: make(map[string]Function),
+	}
+}
+
+// Name returns the metatable's registry name.
+func (b *MetatableBuilder[T]) Name() string {
+	return b.name
+}
+
+// Method adds a method to the metatable's __index table
+// and returns b.
+// When called from Lua (like obj:name(...)),
+// f receives a pointer to the userdata's Go value
+// and the arguments start at index 2.
+// If the first argument is not a userdata of this type,
+// the method raises an error.
+func (b *MetatableBuilder[T]) Method(name string, f func(l *State, v *T) (int, error)) *MetatableBuilder[T] {
+	b.methods[name] = f
+	return b
+}
+
+// Metamethod sets a field of the metatable (like "__tostring" or "__add")
+// and returns b.
+// Unlike methods, metamethods receive their arguments unchanged,
+// since the userdata is not always the first operand.
+// If the metatable has methods and an "__index" metamethod,
+// the __index function is only called for keys that are not methods.
+// "__name" and "__metatable" are set by the builder and cannot be overridden.
+func (b *MetatableBuilder[T]) Metamethod(name string, f Function) *MetatableBuilder[T] {
+	b.metamethods[name] = f
+	return b
+}
+
+// Push pushes the metatable onto the stack,
+// creating it in the registry if it does not already exist.
+// The metatable's __name field is set to the registry name
+// and its __metatable field is set to false
+// so that Lua code cannot access or change it.
+func (b *MetatableBuilder[T]) Push(l *State) error {
+	if !NewMetatable(l, b.name) {
+		return nil
+	}
+	if err := b.init(l); err != nil {
+		l.Pop(1)
+		l.PushNil()
+		l.RawSetField(RegistryIndex, b.name)
+		return fmt.Errorf("lua: metatable %s: %v", b.name, err)
+	}
+	return nil
+}
+
+// init fills in the new metatable on the top of the stack.
+func (b *MetatableBuilder[T]) init(l *State) error {
+	if !l.CheckStack(3) {
+		return errors.New("stack overflow")
+	}
+	if _, ok := b.metamethods["__tostring"]; !ok {
+		l.PushClosure(0, goValueToString)
+		l.RawSetField(-2, "__tostring")
+	}
+	for name, f := range b.metamethods {
+		if name == "__name" || name == "__metatable" || name == "__index" && len(b.methods) > 0 {
+			continue
+		}
+		if f == nil {
+			l.PushBoolean(false)
+		} else {
+			l.PushClosure(0, f)
+		}
+		l.RawSetField(-2, name)
+	}
+	if len(b.methods) > 0 {
+		l.CreateTable(0, len(b.methods))
+		for name, f := range b.methods {
+			l.PushClosure(0, b.method(f))
+			l.RawSetField(-2, name)
+		}
+		if index := b.metamethods["__index"]; index != nil {
+			l.PushClosure(1, methodsThenIndex(index))
+		}
+		l.RawSetField(-2, "__index")
+	}
+	l.PushBoolean(false)
+	l.RawSetField(-2, "__metatable")
+	return nil
+}
+
+// method wraps a method function
+// so that it receives the userdata's Go value.
+func (b *MetatableBuilder[T]) method(f func(*State, *T) (int, error)) Function {
+	return func(l *State) (int, error) {
+		v, err := CheckTypedUserdata[T](l, 1, b.name)
+		if err != nil {
+			return 0, err
+		}
+		return f(l, v)
+	}
+}
+
+// methodsThenIndex returns an __index function
+// that looks up keys in the table in its first upvalue
+// before calling index.
+func methodsThenIndex(index Function) Function {
+	return func(l *State) (int, error) {
+		l.PushValue(2)
+		if l.RawGet(UpvalueIndex(1)) != TypeNil {
+			return 1, nil
+		}
+		l.Pop(1)
+		return index(l)
+	}
+}
+
+// New pushes a new userdata holding a copy of v
+// with the builder's metatable, as if by [NewUserdata].
+func (b *MetatableBuilder[T]) New(l *State, v T) error {
+	if err := b.Push(l); err != nil {
+		return err
+	}
+	l.Pop(1)
+	return NewUserdata(l, v, b.name)
+}
+
+// Test returns a pointer to the Go value held by the userdata at the given index
+// or nil if the value is not a userdata created by [MetatableBuilder.New].
+func (b *MetatableBuilder[T]) Test(l *State, idx int) *T {
+	return TestTypedUserdata[T](l, idx, b.name)
+}
+
+// Check returns a pointer to the Go value held by the given userdata argument
+// or an error if the argument is not a userdata created by [MetatableBuilder.New].
+func (b *MetatableBuilder[T]) Check(l *State, arg int) (*T, error) {
+	return CheckTypedUserdata[T](l, arg, b.name)
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testCounter struct {
+	n int64
+}
+
+var testCounterMetatable = NewMetatableFor[testCounter]("test.counter").
+	Method("incr", func(l *State, c *testCounter) (int, error) {
+		delta, err := OptInteger(l, 2, 1)
+		if err != nil {
+			return 0, err
+		}
+		c.n += delta
+		l.PushInteger(c.n)
+		return 1, nil
+	}).
+	Method("get", func(l *State, c *testCounter) (int, error) {
+		l.PushInteger(c.n)
+		return 1, nil
+	}).
+	Metamethod("__tostring", func(l *State) (int, error) {
+		c, err := CheckTypedUserdata[testCounter](l, 1, "test.counter")
+		if err != nil {
+			return 0, err
+		}
+		l.PushString(fmt.Sprintf("counter(%d)", c.n))
+		return 1, nil
+	}).
+	Metamethod("__index", func(l *State) (int, error) {
+		key, _ := l.ToString(2)
+		l.PushString("fallback:" + key)
+		return 1, nil
+	})
+
+func TestMetatableBuilder(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+
+	state.PushClosure(0, func(l *State) (int, error) {
+		start, err := OptInteger(l, 1, 0)
+		if err != nil {
+			return 0, err
+		}
+		if err := testCounterMetatable.New(l, testCounter{n: start}); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+	if err := state.SetGlobal("newCounter", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = `
+		local c = newCounter(5)
+		assert(c:incr() == 6)
+		assert(c:incr(10) == 16)
+		assert(c:get() == 16)
+		assert(tostring(c) == "counter(16)")
+		assert(c.other == "fallback:other")
+		assert(getmetatable(c) == false)
+		assert(not pcall(setmetatable, c, {}))
+		local d = newCounter()
+		assert(d:get() == 0)
+		assert(c:get() == 16)
+		return c
+	`
+	if err := state.LoadString(source, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if c := testCounterMetatable.Test(state, -1); c == nil || c.n != 16 {
+		t.Errorf("Test(...) = %v; want &{16}", c)
+	}
+	state.SetTop(0)
+
+	if err := state.LoadString(`local c = newCounter(); return c.incr({})`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	err := state.Call(0, 0, 0)
+	if err == nil || !strings.Contains(err.Error(), "test.counter expected") {
+		t.Errorf("calling method with wrong self = %v; want type error", err)
+	}
+
+	// The metatable is created once per state.
+	if err := testCounterMetatable.Push(state); err != nil {
+		t.Fatal(err)
+	}
+	Metatable(state, testCounterMetatable.Name())
+	if !state.RawEqual(-1, -2) {
+		t.Error("Push did not push the registry metatable")
+	}
+	state.RawField(-1, "__name")
+	if got, _ := state.ToString(-1); got != "test.counter" {
+		t.Errorf("__name = %q; want %q", got, "test.counter")
+	}
+}
+
+func TestNewMetatableForDefaultName(t *testing.T) {
+	if got, want := NewMetatableFor[testCounter]("").Name(), "lua.testCounter"; got != want {
+		t.Errorf("Name() = %q; want %q", got, want)
+	}
+}
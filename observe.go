@@ -0,0 +1,207 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// TableObserver is a set of callbacks
+// for the metamethod-driven events of a table.
+// See [ObserveTable].
+type TableObserver struct {
+	// Index is called when Lua code reads a key that is absent from the table.
+	// It is called after the table's original __index metamethod (if any),
+	// and found reports whether the read produced a non-nil value.
+	// Index may be nil.
+	Index func(l *State, key string, found bool)
+	// NewIndex is called when Lua code assigns to a key that is absent from the table,
+	// before the table's original __newindex metamethod (if any) is called.
+	// NewIndex may be nil.
+	NewIndex func(l *State, key string)
+}
+
+// observedKey is the address used as the key (via [State.RawSetP])
+// to store the original metatable in an observed table's metatable.
+var observedKey byte
+
+func observedKeyPointer() uintptr {
+	return uintptr(unsafe.Pointer(&observedKey))
+}
+
+// ObserveTable installs obs on the table at the given index.
+// Because Lua only consults metamethods for absent keys,
+// reads and writes of keys present in the table do not call obs
+// and have no additional overhead.
+// Non-string keys are passed to obs formatted as by [ToString].
+// The callbacks may use [Where] to report the location of the access.
+//
+// ObserveTable gives the table a new metatable
+// with the same fields as its original metatable (if any),
+// so the original metatable is left untouched.
+// If the table is already observed, then obs replaces the previous observer.
+// [UnobserveTable] restores the original metatable.
+func ObserveTable(l *State, idx int, obs TableObserver) error {
+	idx = l.AbsIndex(idx)
+	if l.Type(idx) != TypeTable {
+		return errors.New("lua: observe table: not a table")
+	}
+	if !l.CheckStack(5) {
+		return errors.New("lua: observe table: stack overflow")
+	}
+	if err := UnobserveTable(l, idx); err != nil {
+		return err
+	}
+
+	// Copy the original metatable (or an empty table) into the new metatable.
+	if !l.Metatable(idx) {
+		l.CreateTable(0, 0)
+		l.PushBoolean(false)
+	} else {
+		l.PushValue(-1)
+	}
+	// Stack: orig, marker
+	l.CreateTable(0, 3)
+	l.Rotate(-2, 1)
+	l.RawSetP(-2, observedKeyPointer())
+	// Stack: orig, meta
+	l.PushNil()
+	for l.Next(-3) {
+		l.PushValue(-2)
+		l.Rotate(-2, 1)
+		l.RawSet(-4)
+	}
+
+	l.PushValue(-2)
+	l.PushClosure(1, observedIndex(obs.Index))
+	l.RawSetField(-2, "__index")
+	l.PushValue(-2)
+	l.PushClosure(1, observedNewIndex(obs.NewIndex))
+	l.RawSetField(-2, "__newindex")
+
+	l.SetMetatable(idx)
+	l.Pop(1)
+	return nil
+}
+
+// UnobserveTable removes an observer installed by [ObserveTable]
+// from the table at the given index,
+// restoring its original metatable.
+// If the table is not observed, UnobserveTable does nothing.
+func UnobserveTable(l *State, idx int) error {
+	idx = l.AbsIndex(idx)
+	if l.Type(idx) != TypeTable {
+		return errors.New("lua: unobserve table: not a table")
+	}
+	if !l.CheckStack(2) {
+		return errors.New("lua: unobserve table: stack overflow")
+	}
+	if !l.Metatable(idx) {
+		return nil
+	}
+	switch l.RawGetP(-1, observedKeyPointer()) {
+	case TypeTable:
+		l.SetMetatable(idx)
+	case TypeBoolean:
+		l.Pop(1)
+		l.PushNil()
+		l.SetMetatable(idx)
+	default:
+		// Not observed.
+		l.Pop(1)
+	}
+	l.Pop(1)
+	return nil
+}
+
+// observedIndex returns the __index metamethod for an observed table.
+// The closure's first upvalue is the table's original metatable.
+func observedIndex(f func(l *State, key string, found bool)) Function {
+	return func(l *State) (int, error) {
+		// Stack: t, k
+		switch l.RawField(UpvalueIndex(1), "__index") {
+		case TypeNil:
+			l.PushNil()
+		case TypeFunction:
+			l.PushValue(1)
+			l.PushValue(2)
+			if err := l.Call(2, 1, 0); err != nil {
+				return 0, err
+			}
+		default:
+			l.PushValue(2)
+			if _, err := l.Table(-2, 0); err != nil {
+				return 0, err
+			}
+		}
+		if f != nil {
+			f(l, observedKeyString(l, 2), !l.IsNil(-1))
+		}
+		return 1, nil
+	}
+}
+
+// observedNewIndex returns the __newindex metamethod for an observed table.
+// The closure's first upvalue is the table's original metatable.
+func observedNewIndex(f func(l *State, key string)) Function {
+	return func(l *State) (int, error) {
+		// Stack: t, k, v
+		if f != nil {
+			f(l, observedKeyString(l, 2))
+		}
+		switch l.RawField(UpvalueIndex(1), "__newindex") {
+		case TypeNil:
+			// RawSet's errors would unwind past this Go function.
+			if bad := badTableKey(l, 2); bad != "" {
+				return 0, errors.New("index is " + bad)
+			}
+			l.Pop(1)
+			l.SetTop(3)
+			l.RawSet(1)
+		case TypeFunction:
+			l.PushValue(1)
+			l.PushValue(2)
+			l.PushValue(3)
+			if err := l.Call(3, 0, 0); err != nil {
+				return 0, err
+			}
+		default:
+			l.PushValue(2)
+			l.PushValue(3)
+			if err := l.SetTable(-3, 0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	}
+}
+
+func observedKeyString(l *State, idx int) string {
+	top := l.Top()
+	s, err := ToString(l, idx)
+	l.SetTop(top)
+	if err != nil {
+		return l.Type(idx).String()
+	}
+	return s
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestObserveTable(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	type indexEvent struct {
+		key   string
+		found bool
+	}
+	var reads []indexEvent
+	var writes []string
+	state.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	err := ObserveTable(state, -1, TableObserver{
+		Index: func(l *State, key string, found bool) {
+			reads = append(reads, indexEvent{key, found})
+		},
+		NewIndex: func(l *State, key string) {
+			writes = append(writes, key)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const source = "x = 1\n" +
+		"local a = x\n" +
+		"local b = undefined\n" +
+		"x = 2\n" +
+		"return x"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToInteger(-1); got != 2 {
+		t.Errorf("x = %d; want 2", got)
+	}
+	state.Pop(1)
+	if want := []indexEvent{{"undefined", false}}; !reflect.DeepEqual(reads, want) {
+		t.Errorf("reads = %v; want %v", reads, want)
+	}
+	if want := []string{"x"}; !reflect.DeepEqual(writes, want) {
+		t.Errorf("writes = %q; want %q", writes, want)
+	}
+
+	if err := UnobserveTable(state, -1); err != nil {
+		t.Fatal(err)
+	}
+	if state.Metatable(-1) {
+		t.Error("globals still have a metatable after UnobserveTable")
+	}
+}
+
+func TestObserveTableFallback(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	const source = "local t = setmetatable({}, {__index = {default = 42}})\n" +
+		"return t, getmetatable(t)"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	var found []bool
+	err := ObserveTable(state, 1, TableObserver{
+		Index: func(l *State, key string, ok bool) {
+			found = append(found, ok)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state.PushString("default")
+	if _, err := state.Table(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToInteger(-1); got != 42 {
+		t.Errorf("t.default = %d; want 42", got)
+	}
+	state.Pop(1)
+	if want := []bool{true}; !reflect.DeepEqual(found, want) {
+		t.Errorf("found = %v; want %v", found, want)
+	}
+
+	if err := UnobserveTable(state, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Metatable(1) || !state.RawEqual(-1, 2) {
+		t.Error("original metatable not restored")
+	}
+}
+
+func TestObserveTableBadKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		wantErr string
+	}{
+		{"NaN", "t[0/0] = 1", "index is NaN"},
+		{"Nil", "t[nil] = 1", "index is nil"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := new(State)
+			defer func() {
+				if err := state.Close(); err != nil {
+					t.Error("Close:", err)
+				}
+			}()
+
+			state.CreateTable(0, 0)
+			var keys []string
+			err := ObserveTable(state, -1, TableObserver{
+				NewIndex: func(l *State, key string) {
+					keys = append(keys, key)
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := state.SetGlobal("t", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := state.LoadString(test.source, "=(load)", "t"); err != nil {
+				t.Fatal(err)
+			}
+			err = state.Call(0, 0, 0)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: %v; want error containing %q", test.source, err, test.wantErr)
+			}
+			if len(keys) != 1 {
+				t.Errorf("NewIndex called %d times; want 1", len(keys))
+			}
+		})
+	}
+}
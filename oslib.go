@@ -23,7 +23,6 @@ package lua
 
 import (
 	"errors"
-	"fmt"
 	"math"
 	"os"
 	"strconv"
@@ -40,6 +39,17 @@ type OSLibrary struct {
 	// Location returns the local timezone.
 	// If nil, uses time.Local.
 	Location func() *time.Location
+	// Monotonic returns a reading of a monotonic clock
+	// as the time elapsed since an arbitrary fixed point.
+	// os.hrtime (and os.clock if CPUTime is nil) report elapsed time
+	// using Monotonic.
+	// If nil, elapsed time is measured with Now
+	// or with time.Now's monotonic clock if Now is also nil.
+	Monotonic func() time.Duration
+	// CPUTime returns the amount of processor time used by the program.
+	// If nil, os.clock reports the wall clock time
+	// elapsed since the library was opened.
+	CPUTime func() (time.Duration, error)
 	// LookupEnv returns the value of the given process environment variable.
 	// If nil, os.getenv will always return nil.
 	LookupEnv func(string) (string, bool)
@@ -52,6 +62,9 @@ type OSLibrary struct {
 	// Execute runs a subprocess in the operating system shell.
 	// If nil, os.execute with an argument will always return nil.
 	Execute func(command string) (ok bool, result string, status int)
+	// Commands starts subprocesses for os.execute.
+	// If Commands is not nil, it is used instead of Execute.
+	Commands CommandRunner
 	// HasShell reports whether a shell is available.
 	// If nil, os.execute without an argument will always return false.
 	HasShell func() bool
@@ -63,6 +76,7 @@ type OSLibrary struct {
 // NewOSLibrary returns an OSLibrary that uses the native operating system.
 func NewOSLibrary() *OSLibrary {
 	return &OSLibrary{
+		CPUTime:   processCPUTime,
 		LookupEnv: os.LookupEnv,
 		Remove:    os.Remove,
 		Rename:    os.Rename,
@@ -73,15 +87,7 @@ func NewOSLibrary() *OSLibrary {
 }
 
 func osExecute(command string) (ok bool, result string, status int) {
-	c := osCommand(command)
-	c.Stdin = os.Stdin
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	if err := c.Run(); err != nil {
-		result, status = execError(err)
-		return false, result, status
-	}
-	return true, "exit", 0
+	return executeCommand(ExecCommandRunner{}, command)
 }
 
 func osTempName() (string, error) {
@@ -97,13 +103,14 @@ func osTempName() (string, error) {
 // OpenLibrary loads the standard os library.
 // This method is intended to be used as an argument to [Require].
 func (lib *OSLibrary) OpenLibrary(l *State) (int, error) {
-	clock := lib.newClock()
+	clock, hrtime := lib.newClock()
 	err := NewLib(l, map[string]Function{
 		"clock":     clock,
 		"date":      lib.date,
 		"difftime":  lib.difftime,
 		"execute":   lib.execute,
 		"getenv":    lib.getenv,
+		"hrtime":    hrtime,
 		"remove":    lib.remove,
 		"rename":    lib.rename,
 		"setlocale": lib.setlocale,
@@ -116,33 +123,54 @@ func (lib *OSLibrary) OpenLibrary(l *State) (int, error) {
 	return 1, nil
 }
 
-// newClock returns a [Function] that reports the wall clock time
-// since newClock was called.
+// newClock returns the implementations of os.clock and os.hrtime.
 //
 // The original Lua os.clock function uses the C clock function,
 // which reports the CPU time in seconds.
-// I am unclear the intent of the os.clock function,
-// but at least [on Windows], C clock returns wall clock time.
-// Therefore, using wall clock (possibly monotonic) time seems reasonable to me.
+// If lib.CPUTime is set, then os.clock uses it to do the same.
+// Otherwise, os.clock falls back to reporting the wall clock (possibly monotonic) time
+// since newClock was called.
+// This is still a reasonable approximation:
+// [on Windows], C clock returns wall clock time.
+//
+// os.hrtime is an extension that returns the number of nanoseconds
+// elapsed since newClock was called as an integer.
+// It is intended for benchmarking.
 //
 // [on Windows]: https://learn.microsoft.com/en-us/cpp/c-runtime-library/reference/clock?view=msvc-170
-func (lib *OSLibrary) newClock() Function {
-	var openTime time.Time
-	if lib.Now == nil {
-		openTime = time.Now()
-	} else {
-		openTime = lib.Now()
+func (lib *OSLibrary) newClock() (clock, hrtime Function) {
+	var elapsed func() time.Duration
+	switch {
+	case lib.Monotonic != nil:
+		start := lib.Monotonic()
+		elapsed = func() time.Duration { return lib.Monotonic() - start }
+	case lib.Now != nil:
+		openTime := lib.Now()
+		elapsed = func() time.Duration { return lib.Now().Sub(openTime) }
+	default:
+		openTime := time.Now()
+		elapsed = func() time.Duration { return time.Since(openTime) }
 	}
-	return func(l *State) (int, error) {
+
+	clock = func(l *State) (int, error) {
 		var d time.Duration
-		if lib.Now == nil {
-			d = time.Since(openTime)
+		if lib.CPUTime == nil {
+			d = elapsed()
 		} else {
-			d = lib.Now().Sub(openTime)
+			var err error
+			d, err = lib.CPUTime()
+			if err != nil {
+				return 0, luaErrorf("%s%v", Where(l, 1), err)
+			}
 		}
 		l.PushNumber(d.Seconds())
 		return 1, nil
 	}
+	hrtime = func(l *State) (int, error) {
+		l.PushInteger(int64(elapsed()))
+		return 1, nil
+	}
+	return clock, hrtime
 }
 
 func (lib *OSLibrary) date(l *State) (int, error) {
@@ -268,10 +296,17 @@ func (lib *OSLibrary) execute(l *State) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	if lib.Execute == nil {
+	var ok bool
+	var result string
+	var status int
+	switch {
+	case lib.Commands != nil:
+		ok, result, status = executeCommand(lib.Commands, command)
+	case lib.Execute != nil:
+		ok, result, status = lib.Execute(command)
+	default:
 		return pushFileResult(l, errors.ErrUnsupported), nil
 	}
-	ok, result, status := lib.Execute(command)
 	if ok {
 		l.PushBoolean(true)
 	} else {
@@ -359,16 +394,16 @@ func timeField(l *State, key string, d int) (int, error) {
 	if !ok {
 		// TODO(soon): Add where information to errors.
 		if tp != TypeNil {
-			return 0, fmt.Errorf("%sfield '%s' is not an integer", Where(l, 1), key)
+			return 0, luaErrorf("%sfield '%s' is not an integer", Where(l, 1), key)
 		}
 		if d < 0 {
-			return 0, fmt.Errorf("%sfield '%s' missing in date table", Where(l, 1), key)
+			return 0, luaErrorf("%sfield '%s' missing in date table", Where(l, 1), key)
 		}
 		return d, nil
 	}
 
 	if !(math.MinInt <= res && res <= math.MaxInt) {
-		return 0, fmt.Errorf("%sfield '%s' is out-of-bound", Where(l, 1), key)
+		return 0, luaErrorf("%sfield '%s' is out-of-bound", Where(l, 1), key)
 	}
 	return int(res), nil
 }
@@ -424,7 +459,7 @@ func strftime(t time.Time, format string) (string, error) {
 		}
 		i++
 		if i >= len(format) {
-			return string(buf), fmt.Errorf("invalid conversion specifier '%%'")
+			return string(buf), luaErrorf("invalid conversion specifier '%%'")
 		}
 		switch format[i] {
 		case 'a':
@@ -511,7 +546,7 @@ func strftime(t time.Time, format string) (string, error) {
 		case '%':
 			buf = append(buf, '%')
 		default:
-			return string(buf), fmt.Errorf("invalid conversion specifier '%%%c'", format[i])
+			return string(buf), luaErrorf("invalid conversion specifier '%%%c'", format[i])
 		}
 	}
 	return string(buf), nil
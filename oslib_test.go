@@ -99,6 +99,39 @@ func TestOSLibrary(t *testing.T) {
 	}
 }
 
+func TestOSLibraryMonotonic(t *testing.T) {
+	var now time.Duration
+	lib := &OSLibrary{
+		Now: func() time.Time {
+			return time.Date(2023, time.September, 24, 13, 58, 7, 0, time.UTC)
+		},
+		Monotonic: func() time.Duration { return now },
+	}
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, OSLibraryName, true, lib.OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	now = 1500 * time.Millisecond
+
+	if err := state.LoadString("return os.clock(), os.hrtime()", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToNumber(-2); got != 1.5 {
+		t.Errorf("os.clock() = %g; want 1.5", got)
+	}
+	if got, _ := state.ToInteger(-1); got != int64(now) {
+		t.Errorf("os.hrtime() = %d; want %d", got, int64(now))
+	}
+}
+
 func TestStrftime(t *testing.T) {
 	refTime1 := time.Date(2006, time.January, 2, 15, 4, 5, 999999999, time.FixedZone("MST", -7*60*60))
 	refTime2 := time.Date(2023, time.September, 24, 13, 58, 7, 999999999, time.FixedZone("PDT", -7*60*60))
@@ -154,3 +187,13 @@ func TestStrftime(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessCPUTime(t *testing.T) {
+	d, err := processCPUTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d < 0 {
+		t.Errorf("processCPUTime() = %v; want >=0", d)
+	}
+}
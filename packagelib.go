@@ -0,0 +1,380 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"zombiezen.com/go/lua/internal/lua54"
+)
+
+// DefaultPath is the value of package.path
+// when no path environment variable is set.
+const DefaultPath = lua54.PathDefault
+
+// PackageLibrary is an implementation of the standard Lua "package" library
+// whose searchers (the functions in package.searchers) are written in Go.
+// The zero value of PackageLibrary searches package.preload
+// and then the operating system's file system using package.path.
+// Unlike [OpenPackage], PackageLibrary does not load C modules.
+type PackageLibrary struct {
+	// FS is the file system that Lua modules are loaded from.
+	// If nil, modules are loaded from the operating system's file system.
+	FS fs.FS
+	// Path is the initial value of package.path.
+	// If empty and FS is nil, package.path is set from the environment
+	// like the standard library
+	// (from LUA_PATH_5_4 or LUA_PATH, falling back to [DefaultPath]).
+	// If empty and FS is not nil, [DefaultFSPath] is used.
+	// As in the environment variables,
+	// a ";;" in Path is replaced with the default path
+	// ([DefaultPath] if FS is nil or [DefaultFSPath] otherwise).
+	Path string
+	// Searchers is a list of additional searchers
+	// tried after package.preload and package.path.
+	// Each searcher is called with the module name as its argument.
+	// A searcher that finds the module returns a loader function
+	// and optionally an extra value to pass to the loader.
+	// Otherwise, a searcher returns a string explaining why it did not find the module
+	// (or nil if it has nothing to say).
+	// See [package.searchers] for details.
+	//
+	// [package.searchers]: https://www.lua.org/manual/5.4/manual.html#pdf-package.searchers
+	Searchers []Function
+}
+
+// OpenLibrary loads the standard package library.
+// This method is intended to be used as an argument to [Require].
+func (lib *PackageLibrary) OpenLibrary(l *State) (int, error) {
+	if _, err := OpenPackage(l); err != nil {
+		return 0, err
+	}
+	pkg := l.AbsIndex(-1)
+	switch {
+	case lib.Path != "":
+		dft := DefaultPath
+		if lib.FS != nil {
+			dft = DefaultFSPath
+		}
+		l.PushString(expandDefaultPath(lib.Path, dft))
+		l.RawSetField(pkg, "path")
+	case lib.FS != nil:
+		l.PushString(DefaultFSPath)
+		l.RawSetField(pkg, "path")
+	}
+
+	l.CreateTable(2+len(lib.Searchers), 0)
+	l.PushValue(pkg)
+	l.PushClosure(1, searchPreload)
+	l.RawSetIndex(-2, 1)
+	l.PushValue(pkg)
+	l.PushClosure(1, lib.searchPath)
+	l.RawSetIndex(-2, 2)
+	for i, f := range lib.Searchers {
+		l.PushClosure(0, f)
+		l.RawSetIndex(-2, int64(i)+3)
+	}
+	l.RawSetField(pkg, "searchers")
+	// The searchers above already respect State.SetAllowBinaryChunks.
+	markRestricted(l, pkg)
+	return 1, nil
+}
+
+// expandDefaultPath replaces the first ";;" in path with dft,
+// the same way the standard library treats LUA_PATH.
+func expandDefaultPath(path, dft string) string {
+	prefix, suffix, ok := strings.Cut(path, ";;")
+	if !ok {
+		return path
+	}
+	sb := new(strings.Builder)
+	if prefix != "" {
+		sb.WriteString(prefix)
+		sb.WriteString(";")
+	}
+	sb.WriteString(dft)
+	if suffix != "" {
+		sb.WriteString(";")
+		sb.WriteString(suffix)
+	}
+	return sb.String()
+}
+
+// AddSearcher appends a searcher to package.searchers
+// in a state that has the package library loaded.
+// See [PackageLibrary.Searchers] for how searchers are called.
+func AddSearcher(l *State, f Function) error {
+	if l.RawField(RegistryIndex, LoadedTable) != TypeTable {
+		l.Pop(1)
+		return errors.New("lua: add searcher: package library not loaded")
+	}
+	tp := l.RawField(-1, PackageLibraryName)
+	l.Remove(-2)
+	if tp != TypeTable {
+		l.Pop(1)
+		return errors.New("lua: add searcher: package library not loaded")
+	}
+	tp = l.RawField(-1, "searchers")
+	l.Remove(-2)
+	if tp != TypeTable {
+		l.Pop(1)
+		return errors.New("lua: add searcher: package.searchers is not a table")
+	}
+	if rf := requireFilterOf(l); rf != nil {
+		f = rf.wrapSearcher(f)
+	}
+	l.PushClosure(0, f)
+	l.RawSetIndex(-2, int64(l.RawLen(-2))+1)
+	l.Pop(1)
+	return nil
+}
+
+const (
+	// requireFilterKey is the registry key of the userdata
+	// that holds a state's *requireFilter.
+	requireFilterKey = "zombiezen.com/go/lua.requireFilter"
+	// requireFilterMetatableName is the registry name
+	// of the require filter userdata's metatable.
+	requireFilterMetatableName = "*zombiezen.com/go/lua.requireFilter"
+)
+
+// requireFilter is the policy set by [SetRequireFilter].
+type requireFilter struct {
+	f func(modname string) error
+}
+
+// check returns an error if the filter does not allow loading modname.
+func (rf *requireFilter) check(l *State, modname string) error {
+	if rf.f == nil {
+		return nil
+	}
+	if err := rf.f(modname); err != nil {
+		return luaErrorf("%smodule '%s' not allowed: %w", Where(l, 1), modname, err)
+	}
+	return nil
+}
+
+// callFiltered is a Go function that checks its first argument
+// against rf before calling the function in its first upvalue
+// with the same arguments.
+func (rf *requireFilter) callFiltered(l *State) (int, error) {
+	name, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if err := rf.check(l, name); err != nil {
+		return 0, err
+	}
+	n := l.Top()
+	l.PushValue(UpvalueIndex(1))
+	l.Rotate(1, 1)
+	if err := l.Call(n, MultipleReturns, 0); err != nil {
+		return 0, err
+	}
+	return l.Top(), nil
+}
+
+// wrapSearcher returns a searcher that calls f
+// for the modules that rf allows.
+func (rf *requireFilter) wrapSearcher(f Function) Function {
+	return func(l *State) (int, error) {
+		name, err := CheckString(l, 1)
+		if err != nil {
+			return 0, err
+		}
+		if err := rf.check(l, name); err != nil {
+			return 0, err
+		}
+		return f(l)
+	}
+}
+
+// SetRequireFilter installs a policy on require
+// in a state that has the package library loaded.
+// filter is called with the module name on every call to require,
+// before package.loaded or any searcher is consulted.
+// If filter returns an error, require raises an error that wraps it
+// and the module is not loaded.
+// Otherwise, require proceeds as usual.
+// Calling SetRequireFilter again replaces the previous filter,
+// and a nil filter removes it.
+//
+// SetRequireFilter replaces the global require function
+// and the functions in package.searchers (as well as searchers added later with [AddSearcher])
+// with ones that consult filter,
+// so references to require saved before the first call
+// cannot be used to load modules that are not allowed.
+// They can still return modules that are already in package.loaded,
+// and searchers that Lua code adds to package.searchers itself are not filtered.
+func SetRequireFilter(l *State, filter func(modname string) error) error {
+	if !l.CheckStack(4) {
+		return errors.New("lua: set require filter: stack overflow")
+	}
+	if rf := requireFilterOf(l); rf != nil {
+		rf.f = filter
+		return nil
+	}
+
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	tp := l.RawField(-1, "require")
+	l.Remove(-2)
+	if tp != TypeFunction {
+		l.Pop(1)
+		return errors.New("lua: set require filter: package library not loaded")
+	}
+	if l.RawField(RegistryIndex, LoadedTable) != TypeTable {
+		l.Pop(2)
+		return errors.New("lua: set require filter: package library not loaded")
+	}
+	tp = l.RawField(-1, PackageLibraryName)
+	l.Remove(-2)
+	if tp != TypeTable {
+		l.Pop(2)
+		return errors.New("lua: set require filter: package library not loaded")
+	}
+	tp = l.RawField(-1, "searchers")
+	l.Remove(-2)
+	if tp != TypeTable {
+		l.Pop(2)
+		return errors.New("lua: set require filter: package.searchers is not a table")
+	}
+
+	rf := &requireFilter{f: filter}
+	NewUserdata(l, rf, requireFilterMetatableName)
+	l.RawSetField(RegistryIndex, requireFilterKey)
+	for i, n := int64(1), int64(l.RawLen(-1)); i <= n; i++ {
+		l.RawIndex(-1, i)
+		l.PushClosure(1, rf.callFiltered)
+		l.RawSetIndex(-2, i)
+	}
+	l.Pop(1)
+
+	l.PushClosure(1, rf.callFiltered)
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	l.Rotate(-2, 1)
+	l.RawSetField(-2, "require")
+	l.Pop(1)
+	return nil
+}
+
+// requireFilterOf returns the filter installed by [SetRequireFilter]
+// or nil if there is none.
+func requireFilterOf(l *State) *requireFilter {
+	if !l.CheckStack(1) {
+		return nil
+	}
+	l.RawField(RegistryIndex, requireFilterKey)
+	rf := TestTypedUserdata[*requireFilter](l, -1, requireFilterMetatableName)
+	l.Pop(1)
+	if rf == nil {
+		return nil
+	}
+	return *rf
+}
+
+// searchPreload is the searcher for package.preload.
+func searchPreload(l *State) (int, error) {
+	name, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if l.RawField(RegistryIndex, PreloadTable) != TypeTable {
+		l.PushString("no field package.preload['" + name + "']")
+		return 1, nil
+	}
+	if l.RawField(-1, name) == TypeNil {
+		l.PushString("no field package.preload['" + name + "']")
+		return 1, nil
+	}
+	l.PushString(":preload:")
+	return 2, nil
+}
+
+// searchPath is the searcher for Lua files found with package.path.
+func (lib *PackageLibrary) searchPath(l *State) (int, error) {
+	name, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if l.RawField(UpvalueIndex(1), "path") != TypeString {
+		return 0, errors.New("'package.path' must be a string")
+	}
+	templates, _ := l.ToString(-1)
+	l.Pop(1)
+
+	sep := string(filepath.Separator)
+	if lib.FS != nil {
+		sep = "/"
+	}
+	fileName := strings.ReplaceAll(name, ".", sep)
+	msg := new(strings.Builder)
+	for _, template := range strings.Split(templates, ";") {
+		if template == "" {
+			continue
+		}
+		file := strings.ReplaceAll(template, "?", fileName)
+		if !lib.isFile(file) {
+			if msg.Len() > 0 {
+				msg.WriteString("\n\t")
+			}
+			fmt.Fprintf(msg, "no file '%s'", file)
+			continue
+		}
+		var err error
+		if lib.FS != nil {
+			err = LoadFS(l, lib.FS, path.Clean(file), "bt")
+		} else {
+			err = LoadFile(l, file, "bt")
+		}
+		if err != nil {
+			errMsg, _ := l.ToString(-1)
+			return 0, fmt.Errorf("error loading module '%s' from file '%s':\n\t%s", name, file, errMsg)
+		}
+		l.PushString(file)
+		return 2, nil
+	}
+	l.PushString(msg.String())
+	return 1, nil
+}
+
+// isFile reports whether file names a regular file
+// in the library's file system.
+func (lib *PackageLibrary) isFile(file string) bool {
+	var info fs.FileInfo
+	var err error
+	if lib.FS != nil {
+		file = path.Clean(file)
+		if !fs.ValidPath(file) {
+			return false
+		}
+		info, err = fs.Stat(lib.FS, file)
+	} else {
+		info, err = os.Stat(file)
+	}
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPackageLibrary(t *testing.T) {
+	lib := &PackageLibrary{
+		FS: fstest.MapFS{
+			"foo/bar.lua":   {Data: []byte("return {name = ..., file = select(2, ...)}\n")},
+			"baz/init.lua":  {Data: []byte("return 'baz'\n")},
+			"broken.lua":    {Data: []byte("return +\n")},
+			"outside/x.lua": {Data: []byte("return 'x'\n")},
+		},
+		Searchers: []Function{
+			func(l *State) (int, error) {
+				name, _ := l.ToString(1)
+				if name != "custom" {
+					l.PushString("not custom")
+					return 1, nil
+				}
+				l.PushClosure(0, func(l *State) (int, error) {
+					l.PushString("from custom searcher")
+					return 1, nil
+				})
+				return 1, nil
+			},
+		},
+	}
+
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, PackageLibraryName, true, lib.OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+	if err := AddSearcher(state, func(l *State) (int, error) {
+		name, _ := l.ToString(1)
+		if name != "added" {
+			return 0, nil
+		}
+		l.PushClosure(0, func(l *State) (int, error) {
+			l.PushString("from added searcher")
+			return 1, nil
+		})
+		return 1, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"local m = require 'foo.bar'; return m.name .. ' ' .. m.file", "foo.bar foo/bar.lua"},
+		{"return require 'baz'", "baz"},
+		{"return require 'custom'", "from custom searcher"},
+		{"return require 'added'", "from added searcher"},
+		{"package.preload.pre = function() return 'preloaded' end; return require 'pre'", "preloaded"},
+		{"package.path = 'outside/?.lua'; return require 'x'", "x"},
+	}
+	for _, test := range tests {
+		if err := state.LoadString(test.source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			state.SetTop(0)
+			continue
+		}
+		if got, _ := state.ToString(-1); got != test.want {
+			t.Errorf("%s = %q; want %q", test.source, got, test.want)
+		}
+		state.SetTop(0)
+	}
+
+	errorTests := []struct {
+		source string
+		want   []string
+	}{
+		{"return require 'missing'", []string{"no field package.preload['missing']", "no file 'outside/missing.lua'", "not custom"}},
+		{"package.path = '?.lua'; return require 'broken'", []string{"error loading module 'broken' from file 'broken.lua'"}},
+	}
+	for _, test := range errorTests {
+		if err := state.LoadString(test.source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		err := state.Call(0, 1, 0)
+		state.SetTop(0)
+		if err == nil {
+			t.Errorf("%s did not raise an error", test.source)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s error = %q; want to contain %q", test.source, err, want)
+			}
+		}
+	}
+}
+
+func TestSetRequireFilter(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.LoadString(`savedRequire = require`, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	errDenied := errors.New("denied")
+	err := SetRequireFilter(state, func(modname string) error {
+		if modname != "string" {
+			return errDenied
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := state.LoadString(`return require("string").upper("x")`, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Error("require(\"string\"):", err)
+	} else if got, _ := state.ToString(-1); got != "X" {
+		t.Errorf("require(\"string\").upper(\"x\") = %q; want \"X\"", got)
+	}
+	state.SetTop(0)
+
+	if err := state.LoadString(`return require("io")`, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err == nil {
+		t.Error("require(\"io\") did not raise an error")
+	} else if !errors.Is(err, errDenied) {
+		t.Errorf("require(\"io\") = %v; want to wrap %v", err, errDenied)
+	}
+	state.SetTop(0)
+
+	// A require saved before the filter was installed
+	// cannot load modules that are not allowed.
+	if err := AddSearcher(state, func(l *State) (int, error) {
+		l.PushClosure(0, func(l *State) (int, error) {
+			l.PushString("custom")
+			return 1, nil
+		})
+		return 1, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.LoadString(`return savedRequire("custom")`, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err == nil {
+		t.Error("savedRequire(\"custom\") did not raise an error")
+	} else if !errors.Is(err, errDenied) {
+		t.Errorf("savedRequire(\"custom\") = %v; want to wrap %v", err, errDenied)
+	}
+	state.SetTop(0)
+
+	if err := SetRequireFilter(state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.LoadString(`return require("io")`, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Error("after removing filter, require(\"io\"):", err)
+	}
+}
+
+func TestPackageLibraryDefaultPathMarker(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"lib/?.lua", "lib/?.lua"},
+		{"lib/?.lua;;", "lib/?.lua;" + DefaultFSPath},
+		{";;lib/?.lua", DefaultFSPath + ";lib/?.lua"},
+		{"a/?.lua;;b/?.lua", "a/?.lua;" + DefaultFSPath + ";b/?.lua"},
+		{";;", DefaultFSPath},
+	}
+	for _, test := range tests {
+		lib := &PackageLibrary{FS: fstest.MapFS{}, Path: test.path}
+		state := new(State)
+		if err := Require(state, PackageLibraryName, true, lib.OpenLibrary); err != nil {
+			t.Fatal(err)
+		}
+		state.RawField(-1, "path")
+		if got, _ := state.ToString(-1); got != test.want {
+			t.Errorf("Path = %q: package.path = %q; want %q", test.path, got, test.want)
+		}
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}
+}
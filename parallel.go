@@ -0,0 +1,218 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// ParallelMapOptions is the set of optional parameters for [ParallelMap].
+type ParallelMapOptions struct {
+	// Workers is the maximum number of worker states to run concurrently.
+	// If Workers is zero or negative, then runtime.GOMAXPROCS(0) is used.
+	Workers int
+	// NewState returns a state to run the function in.
+	// Each worker calls NewState once.
+	// If NewState is nil, then each worker uses a new State
+	// with the standard libraries opened.
+	NewState func() (*State, error)
+	// ReleaseState is called with each state returned by NewState
+	// once the worker has finished.
+	// If ReleaseState is nil, then the state is closed.
+	ReleaseState func(*State)
+}
+
+// ParallelMap calls the Lua function at index fn
+// on each element of the sequence at index idx,
+// distributing the elements among multiple worker states
+// that run in separate goroutines.
+// The table is accessed without metamethods.
+// The function is called with each element and its index
+// and its first result is stored in a new sequence at the same index,
+// which ParallelMap pushes onto the stack.
+//
+// The function at index fn must be a Lua function
+// that does not depend on any upvalues other than its environment:
+// it is transferred to the worker states using [State.Dump],
+// which resets any upvalues to nil
+// (except the first upvalue, which is set to the worker's global environment).
+// Elements and results are deep copied between states,
+// so they may only consist of nil, booleans, numbers, strings, and tables.
+//
+// If the function raises an error on any element,
+// ParallelMap returns the error for the element with the lowest index
+// and pushes nothing onto the stack.
+func ParallelMap(l *State, idx, fn int, opts *ParallelMapOptions) error {
+	idx = l.AbsIndex(idx)
+	fn = l.AbsIndex(fn)
+	if !l.IsTable(idx) {
+		return errors.New("lua: parallel map: not a table")
+	}
+	if l.Type(fn) != TypeFunction || l.IsNativeFunction(fn) {
+		return errors.New("lua: parallel map: not a Lua function")
+	}
+	n := int64(l.RawLen(idx))
+	if opts == nil {
+		opts = new(ParallelMapOptions)
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if int64(workers) > n {
+		workers = int(n)
+	}
+
+	// Dump the function once so it can be loaded into each worker.
+	l.PushValue(fn)
+	chunk := new(bytes.Buffer)
+	_, err := l.Dump(chunk, false)
+	l.Pop(1)
+	if err != nil {
+		return fmt.Errorf("lua: parallel map: %w", err)
+	}
+
+	// Set up each worker's inputs serially,
+	// since l cannot be used concurrently.
+	tasks := make([]*parallelMapTask, workers)
+	defer func() {
+		for _, task := range tasks {
+			if task != nil && task.state != nil {
+				if opts.ReleaseState == nil {
+					task.state.Close()
+				} else {
+					opts.ReleaseState(task.state)
+				}
+			}
+		}
+	}()
+	for i := range tasks {
+		task := &parallelMapTask{
+			start: 1 + int64(i)*n/int64(workers),
+			end:   1 + int64(i+1)*n/int64(workers),
+		}
+		tasks[i] = task
+		if opts.NewState == nil {
+			task.state = new(State)
+			err = OpenLibraries(task.state)
+		} else {
+			task.state, err = opts.NewState()
+		}
+		if err != nil {
+			return fmt.Errorf("lua: parallel map: %w", err)
+		}
+		if task.state == nil {
+			return fmt.Errorf("lua: parallel map: NewState returned nil")
+		}
+		task.base = task.state.Top()
+		if err := task.state.Load(bytes.NewReader(chunk.Bytes()), "=(parallel map)", "b"); err != nil {
+			task.state.SetTop(task.base)
+			return fmt.Errorf("lua: parallel map: %w", err)
+		}
+		task.state.CreateTable(int(task.end-task.start), 0)
+		for j := task.start; j < task.end; j++ {
+			l.RawIndex(idx, j)
+			err := (*CopyOptions)(nil).Copy(task.state, l, -1)
+			l.Pop(1)
+			if err != nil {
+				task.state.SetTop(task.base)
+				return fmt.Errorf("lua: parallel map: element %d: %w", j, err)
+			}
+			task.state.RawSetIndex(-2, j-task.start+1)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task *parallelMapTask) {
+			defer wg.Done()
+			task.run()
+		}(task)
+	}
+	wg.Wait()
+
+	for _, task := range tasks {
+		if task.err != nil {
+			for _, task := range tasks {
+				task.state.SetTop(task.base)
+			}
+			return fmt.Errorf("lua: parallel map: %w", task.err)
+		}
+	}
+
+	// Copy results back serially.
+	l.CreateTable(int(n), 0)
+	for _, task := range tasks {
+		for j := task.start; j < task.end; j++ {
+			task.state.RawIndex(-1, j-task.start+1)
+			err := (*CopyOptions)(nil).Copy(l, task.state, -1)
+			task.state.Pop(1)
+			if err != nil {
+				l.Pop(1)
+				for _, task := range tasks {
+					task.state.SetTop(task.base)
+				}
+				return fmt.Errorf("lua: parallel map: result %d: %w", j, err)
+			}
+			l.RawSetIndex(-2, j)
+		}
+		task.state.SetTop(task.base)
+	}
+	return nil
+}
+
+// parallelMapTask is the work assigned to a single worker of [ParallelMap].
+type parallelMapTask struct {
+	state *State
+	// base is the stack top of state before ParallelMap pushed anything.
+	base int
+	// start and end are the half-open range of indices in the sequence.
+	start, end int64
+	err        error
+}
+
+// run calls the function for each element in the task's range.
+// When run is called, the function and a sequence of inputs
+// are on the top of the stack.
+// When run returns without an error,
+// the inputs have been replaced by the results.
+func (task *parallelMapTask) run() {
+	l := task.state
+	fn := task.base + 1
+	args := task.base + 2
+	for j := task.start; j < task.end; j++ {
+		l.PushValue(fn)
+		l.RawIndex(args, j-task.start+1)
+		l.PushInteger(j)
+		if err := l.Call(2, 1, 0); err != nil {
+			l.Pop(1)
+			task.err = fmt.Errorf("element %d: %w", j, err)
+			return
+		}
+		l.RawSetIndex(args, j-task.start+1)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParallelMap(t *testing.T) {
+	t.Run("Squares", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		const n = 100
+		state.CreateTable(n, 0)
+		for i := int64(1); i <= n; i++ {
+			state.PushInteger(i)
+			state.RawSetIndex(-2, i)
+		}
+		const source = "return function(x, i) return {value = x * x, index = i} end"
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ParallelMap(state, 1, 2, &ParallelMapOptions{Workers: 4}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := state.Top(), 3; got != want {
+			t.Fatalf("state.Top() = %d; want %d", got, want)
+		}
+		if got := state.RawLen(-1); got != n {
+			t.Errorf("#result = %d; want %d", got, n)
+		}
+		for i := int64(1); i <= n; i++ {
+			state.RawIndex(-1, i)
+			state.RawField(-1, "value")
+			if got, ok := state.ToInteger(-1); got != i*i || !ok {
+				t.Errorf("result[%d].value = %v; want %d", i, state.Type(-1), i*i)
+			}
+			state.RawField(-2, "index")
+			if got, ok := state.ToInteger(-1); got != i || !ok {
+				t.Errorf("result[%d].index = %v; want %d", i, state.Type(-1), i)
+			}
+			state.Pop(3)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		state.CreateTable(3, 0)
+		for i := int64(1); i <= 3; i++ {
+			state.PushInteger(i)
+			state.RawSetIndex(-2, i)
+		}
+		const source = `return function(x) if x == 2 then error("bad element") end return x end`
+		if err := state.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		err := ParallelMap(state, 1, 2, nil)
+		if err == nil || !strings.Contains(err.Error(), "bad element") {
+			t.Errorf("ParallelMap(...) = %v; want error containing %q", err, "bad element")
+		}
+		if got, want := state.Top(), 2; got != want {
+			t.Errorf("state.Top() = %d; want %d", got, want)
+		}
+	})
+}
@@ -0,0 +1,504 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+)
+
+// This file is a port of the pattern matching functions in lstrlib.c.
+
+const (
+	// maxCaptures is the maximum number of captures in a pattern.
+	maxCaptures = 32
+	// defaultMatchDepth is the default maximum recursion depth for matching.
+	defaultMatchDepth = 200
+
+	capUnfinished = -1
+	capPosition   = -2
+
+	patternSpecials = "^$*+?.([%-"
+)
+
+// errPatternTooComplex is raised when a match exceeds its depth or step limit.
+var errPatternTooComplex = luaErrorf("pattern too complex")
+
+// patternError is panicked by the matcher
+// and recovered by [catchPatternError].
+type patternError struct {
+	err error
+}
+
+func raisePattern(format string, args ...any) {
+	panic(patternError{luaErrorf(format, args...)})
+}
+
+// catchPatternError recovers a [patternError] into *err.
+// It must be called directly by defer.
+func catchPatternError(err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	e, ok := v.(patternError)
+	if !ok {
+		panic(v)
+	}
+	*err = e.err
+}
+
+type matchCapture struct {
+	init int
+	len  int
+}
+
+// matchState is the state of a single pattern match.
+// Positions are byte offsets into src and pat.
+type matchState struct {
+	src string
+	pat string
+	// depth is the remaining recursion depth.
+	depth int
+	// steps is the remaining number of matching steps
+	// or a negative number for no limit.
+	steps   int
+	level   int
+	capture [maxCaptures]matchCapture
+}
+
+func newMatchState(src, pat string, depth, steps int) *matchState {
+	if depth <= 0 {
+		depth = defaultMatchDepth
+	}
+	if steps <= 0 {
+		steps = -1
+	}
+	return &matchState{src: src, pat: pat, depth: depth, steps: steps}
+}
+
+// p returns the pattern byte at i
+// or zero if i is past the end of the pattern
+// (mirroring the terminating NUL byte that C Lua relies on).
+func (ms *matchState) p(i int) byte {
+	if i >= len(ms.pat) {
+		return 0
+	}
+	return ms.pat[i]
+}
+
+// s returns the subject byte at i or zero if i is past the end of the subject.
+func (ms *matchState) s(i int) byte {
+	if i >= len(ms.src) {
+		return 0
+	}
+	return ms.src[i]
+}
+
+func (ms *matchState) step() {
+	if ms.steps < 0 {
+		return
+	}
+	if ms.steps == 0 {
+		panic(patternError{errPatternTooComplex})
+	}
+	ms.steps--
+}
+
+func (ms *matchState) checkCapture(l byte) int {
+	i := int(l) - '1'
+	if i < 0 || i >= ms.level || ms.capture[i].len == capUnfinished {
+		raisePattern("invalid capture index %%%d", i+1)
+	}
+	return i
+}
+
+func (ms *matchState) captureToClose() int {
+	for level := ms.level - 1; level >= 0; level-- {
+		if ms.capture[level].len == capUnfinished {
+			return level
+		}
+	}
+	raisePattern("invalid pattern capture")
+	return 0
+}
+
+func (ms *matchState) classEnd(p int) int {
+	c := ms.p(p)
+	p++
+	switch c {
+	case '%':
+		if p >= len(ms.pat) {
+			raisePattern("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	case '[':
+		if ms.p(p) == '^' {
+			p++
+		}
+		for {
+			// Look for a ']'.
+			if p >= len(ms.pat) {
+				raisePattern("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' && p < len(ms.pat) {
+				// Skip escapes (e.g. '%]').
+				p++
+			}
+			if ms.p(p) == ']' {
+				return p + 1
+			}
+		}
+	default:
+		return p
+	}
+}
+
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch toLowerASCII(cl) {
+	case 'a':
+		res = isAlphaASCII(c)
+	case 'c':
+		res = c < 0x20 || c == 0x7f
+	case 'd':
+		res = '0' <= c && c <= '9'
+	case 'g':
+		res = 0x21 <= c && c <= 0x7e
+	case 'l':
+		res = 'a' <= c && c <= 'z'
+	case 'p':
+		res = 0x21 <= c && c <= 0x7e && !isAlphaASCII(c) && !('0' <= c && c <= '9')
+	case 's':
+		res = c == ' ' || '\t' <= c && c <= '\r'
+	case 'u':
+		res = 'A' <= c && c <= 'Z'
+	case 'w':
+		res = isAlphaASCII(c) || '0' <= c && c <= '9'
+	case 'x':
+		res = '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+	case 'z':
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if 'a' <= cl && cl <= 'z' {
+		return res
+	}
+	return !res
+}
+
+func isAlphaASCII(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func toLowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// matchBracketClass reports whether c matches the bracket class
+// that starts at p (the '[') and ends at ec (the ']').
+func (ms *matchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	if ms.p(p+1) == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		switch {
+		case ms.pat[p] == '%':
+			p++
+			if matchClass(c, ms.p(p)) {
+				return sig
+			}
+		case ms.p(p+1) == '-' && p+2 < ec:
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *matchState) singleMatch(s, p, ep int) bool {
+	ms.step()
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, ms.p(p+1))
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	default:
+		return ms.pat[p] == c
+	}
+}
+
+func (ms *matchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		raisePattern("malformed pattern (missing arguments to '%%b')")
+	}
+	if ms.s(s) != ms.pat[p] || s >= len(ms.src) {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for s++; s < len(ms.src); s++ {
+		ms.step()
+		switch ms.src[s] {
+		case e:
+			cont--
+			if cont == 0 {
+				return s + 1
+			}
+		case b:
+			cont++
+		}
+	}
+	// String ends out of balance.
+	return -1
+}
+
+func (ms *matchState) maxExpand(s, p, ep int) int {
+	// Count maximum expand for item.
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	// Keep trying to match with the maximum repetitions.
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res >= 0 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res >= 0 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		// Try with one more repetition.
+		s++
+	}
+}
+
+func (ms *matchState) startCapture(s, p, what int) int {
+	level := ms.level
+	if level >= maxCaptures {
+		raisePattern("too many captures")
+	}
+	ms.capture[level] = matchCapture{init: s, len: what}
+	ms.level = level + 1
+	res := ms.match(s, p)
+	if res < 0 {
+		// Undo capture.
+		ms.level--
+	}
+	return res
+}
+
+func (ms *matchState) endCapture(s, p int) int {
+	l := ms.captureToClose()
+	ms.capture[l].len = s - ms.capture[l].init
+	res := ms.match(s, p)
+	if res < 0 {
+		// Undo capture.
+		ms.capture[l].len = capUnfinished
+	}
+	return res
+}
+
+func (ms *matchState) matchCapture(s int, l byte) int {
+	i := ms.checkCapture(l)
+	c := ms.capture[i]
+	if len(ms.src)-s >= c.len && ms.src[c.init:c.init+c.len] == ms.src[s:s+c.len] {
+		return s + c.len
+	}
+	return -1
+}
+
+// match returns the end of the match of the pattern starting at p
+// against the subject starting at s, or -1 if there is no match.
+func (ms *matchState) match(s, p int) int {
+	if ms.depth == 0 {
+		panic(patternError{errPatternTooComplex})
+	}
+	ms.depth--
+	defer func() { ms.depth++ }()
+	ms.step()
+
+	for p < len(ms.pat) {
+		switch ms.pat[p] {
+		case '(':
+			if ms.p(p+1) == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s != len(ms.src) {
+					return -1
+				}
+				return s
+			}
+		case '%':
+			switch ms.p(p + 1) {
+			case 'b':
+				s = ms.matchBalance(s, p+2)
+				if s < 0 {
+					return -1
+				}
+				p += 4
+				continue
+			case 'f':
+				p += 2
+				if ms.p(p) != '[' {
+					raisePattern("missing '[' after '%%f' in pattern")
+				}
+				ep := ms.classEnd(p)
+				var previous byte
+				if s > 0 {
+					previous = ms.src[s-1]
+				}
+				if !ms.matchBracketClass(previous, p, ep-1) &&
+					ms.matchBracketClass(ms.s(s), p, ep-1) {
+					p = ep
+					continue
+				}
+				return -1
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				s = ms.matchCapture(s, ms.pat[p+1])
+				if s < 0 {
+					return -1
+				}
+				p += 2
+				continue
+			}
+		}
+
+		// Pattern class plus optional suffix.
+		ep := ms.classEnd(p)
+		if !ms.singleMatch(s, p, ep) {
+			if c := ms.p(ep); c == '*' || c == '?' || c == '-' {
+				// Accept empty.
+				p = ep + 1
+				continue
+			}
+			// '+' or no suffix.
+			return -1
+		}
+		// Matched once.
+		switch ms.p(ep) {
+		case '?':
+			if res := ms.match(s+1, ep+1); res >= 0 {
+				return res
+			}
+			p = ep + 1
+		case '+':
+			return ms.maxExpand(s+1, p, ep)
+		case '*':
+			return ms.maxExpand(s, p, ep)
+		case '-':
+			return ms.minExpand(s, p, ep)
+		default:
+			s++
+			p = ep
+		}
+	}
+	return s
+}
+
+// reset prepares ms for a new match attempt.
+func (ms *matchState) reset() {
+	ms.level = 0
+}
+
+// captureValue returns the i'th capture.
+// If there are no captures and i is 0,
+// it returns the whole match src[s:e].
+// Position captures are returned as integers (1-based).
+func (ms *matchState) captureValue(i, s, e int) (str string, pos int64, isPos bool) {
+	if i >= ms.level {
+		if i != 0 {
+			raisePattern("invalid capture index %%%d", i+1)
+		}
+		return ms.src[s:e], 0, false
+	}
+	c := ms.capture[i]
+	switch c.len {
+	case capUnfinished:
+		raisePattern("unfinished capture")
+	case capPosition:
+		return "", int64(c.init) + 1, true
+	}
+	return ms.src[c.init : c.init+c.len], 0, false
+}
+
+// pushCapture pushes the i'th capture onto the stack.
+func (ms *matchState) pushCapture(l *State, i, s, e int) {
+	str, pos, isPos := ms.captureValue(i, s, e)
+	if isPos {
+		l.PushInteger(pos)
+	} else {
+		l.PushString(str)
+	}
+}
+
+// pushCaptures pushes all the captures onto the stack
+// (or the whole match if there are none and wholeIfNone is true)
+// and returns the number of values pushed.
+func (ms *matchState) pushCaptures(l *State, s, e int, wholeIfNone bool) int {
+	n := ms.level
+	if n == 0 && wholeIfNone {
+		n = 1
+	}
+	if !l.CheckStack(n) {
+		raisePattern("too many captures")
+	}
+	for i := 0; i < n; i++ {
+		ms.pushCapture(l, i, s, e)
+	}
+	return n
+}
+
+// hasPatternSpecials reports whether p has any special pattern characters.
+func hasPatternSpecials(p string) bool {
+	return strings.ContainsAny(p, patternSpecials)
+}
@@ -0,0 +1,452 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrPoolClosed is returned by [Pool.Get] after [Pool.Shutdown] has been called.
+var ErrPoolClosed = errors.New("lua: pool closed")
+
+// errInterrupted is the error raised in Lua code
+// running in a pool state that is interrupted by [Pool.Shutdown].
+var errInterrupted = errors.New("interrupted by pool shutdown")
+
+// poolGlobalsKey is the registry key of the snapshot of a pool State's globals
+// used by [Pool.RestoreGlobals].
+const poolGlobalsKey = "zombiezen.com/go/lua.poolGlobals"
+
+// poolInterruptCount is the number of instructions
+// between checks for interruption.
+const poolInterruptCount = 1000
+
+// Pool is a set of States that can be reused across calls.
+// A Pool is safe to use from multiple goroutines,
+// but each State it returns must only be used by one goroutine at a time.
+// The zero value is an empty pool
+// that creates States with the standard libraries opened.
+//
+// Pool adds a count hook to the States it creates
+// (see [State.AddHook]) so that [Pool.Shutdown] can interrupt long-running calls.
+//
+// A Pool can be used with [ParallelMap]
+// by setting [ParallelMapOptions] NewState to p.Get
+// and ReleaseState to p.Put.
+type Pool struct {
+	// New returns a new State for the pool.
+	// If New is nil, the pool uses a new State
+	// with the standard libraries opened.
+	New func() (*State, error)
+	// GC is the garbage collection policy for the pool's States.
+	// If GC is nil, the pool leaves garbage collection to Lua's collector.
+	GC *GCPolicy
+	// RestoreGlobals causes [Pool.Put] to restore a State's global variables
+	// to the values they had when New returned the State,
+	// so that one use of a State cannot affect the next through globals.
+	// The fields of tables stored in global variables
+	// (like the standard library tables) and the metatable of the globals table
+	// are restored too, but more deeply nested values are not.
+	RestoreGlobals bool
+
+	interrupted atomic.Bool
+	// interruptCh is closed once interrupted is set.
+	interruptCh chan struct{}
+
+	mu      sync.Mutex
+	idle    []*State
+	active  int
+	closing bool
+	drained chan struct{} // closed when active drops to zero after closing
+	states  map[*State]*poolState
+}
+
+// poolState is the pool's bookkeeping for one of its States.
+type poolState struct {
+	// ctx is the context the state's calls are bound to
+	// (see [Pool.bindContext]).
+	ctx atomic.Pointer[context.Context]
+	// uses is the number of times the state has been returned with Put.
+	// It is only accessed by the goroutine that owns the state.
+	uses int
+}
+
+// GCPolicy describes when a [Pool] collects garbage in its States.
+// Collections run in a background goroutine
+// after a State is returned with [Pool.Put]
+// and before the State is handed out again,
+// so that garbage collection happens between requests
+// instead of during them.
+type GCPolicy struct {
+	// Every is the number of uses of a State between collections.
+	// If Every is zero or negative, then the State is collected after every use.
+	Every int
+	// StepSize is the size in kibibytes of the incremental step
+	// to perform for each collection (see [State.GCStep]).
+	// If StepSize is zero or negative, then each collection is a full cycle.
+	StepSize int
+	// StopAutomatic stops Lua's automatic collector in the pool's States,
+	// so that garbage is only collected by the policy.
+	// Programs that set StopAutomatic should ensure that the policy
+	// collects often enough to bound memory usage.
+	StopAutomatic bool
+}
+
+// GCAfterNCalls returns a policy that performs a full garbage collection cycle
+// after every n uses of a State.
+func GCAfterNCalls(n int) *GCPolicy {
+	return &GCPolicy{Every: n}
+}
+
+// GCWhenIdle returns a policy that only collects garbage between uses of a State,
+// performing an incremental step of stepSize kibibytes after each use.
+func GCWhenIdle(stepSize int) *GCPolicy {
+	return &GCPolicy{StepSize: stepSize, StopAutomatic: true}
+}
+
+// collect performs a collection on l if the policy calls for one
+// after the given number of uses.
+func (policy *GCPolicy) collect(l *State, uses int) {
+	if policy.Every > 1 && uses%policy.Every != 0 {
+		return
+	}
+	if policy.StepSize > 0 {
+		l.GCStep(policy.StepSize)
+	} else {
+		l.GC()
+	}
+}
+
+// Get returns an idle State from the pool or creates a new one.
+// The caller must return the State with [Pool.Put] when finished with it.
+func (p *Pool) Get() (*State, error) {
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	p.active++
+	if n := len(p.idle); n > 0 {
+		l := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return l, nil
+	}
+	p.mu.Unlock()
+
+	l, err := p.newState()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	if p.RestoreGlobals {
+		if err := snapshotGlobals(l); err != nil {
+			l.Close()
+			p.release()
+			return nil, err
+		}
+	}
+	ps := new(poolState)
+	p.mu.Lock()
+	if p.states == nil {
+		p.states = make(map[*State]*poolState)
+	}
+	p.states[l] = ps
+	p.mu.Unlock()
+	l.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		return p.checkInterrupt(ps)
+	}, MaskCount, poolInterruptCount)
+	l.addInterrupt(p.interruptChan(), func(l *State) error {
+		return p.checkInterrupt(ps)
+	})
+	if p.GC != nil && p.GC.StopAutomatic {
+		l.GCStop()
+	}
+	return l, nil
+}
+
+func (p *Pool) newState() (*State, error) {
+	if p.New != nil {
+		return p.New()
+	}
+	l := new(State)
+	if err := OpenLibraries(l); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (p *Pool) checkInterrupt(ps *poolState) error {
+	if p.interrupted.Load() {
+		return errInterrupted
+	}
+	if ctx := ps.ctx.Load(); ctx != nil {
+		return (*ctx).Err()
+	}
+	return nil
+}
+
+// bindContext arranges for Lua code running in l,
+// a State obtained from p.Get,
+// to be interrupted with an error once ctx is done.
+// The returned function removes the binding.
+func (p *Pool) bindContext(l *State, ctx context.Context) (unbind func()) {
+	p.mu.Lock()
+	ps := p.states[l]
+	p.mu.Unlock()
+	if ps == nil {
+		return func() {}
+	}
+	ps.ctx.Store(&ctx)
+	removeInterrupt := l.addInterrupt(ctx.Done(), func(l *State) error {
+		return p.checkInterrupt(ps)
+	})
+	return func() {
+		removeInterrupt()
+		ps.ctx.Store(nil)
+	}
+}
+
+// interruptChan returns a channel that is closed
+// once [Pool.Shutdown] interrupts the pool's States.
+func (p *Pool) interruptChan() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interruptCh == nil {
+		p.interruptCh = make(chan struct{})
+	}
+	return p.interruptCh
+}
+
+// Put returns a State obtained from [Pool.Get] to the pool.
+// The State's stack is cleared.
+// If the pool has a [GCPolicy], the State is made available again
+// after its collection finishes in the background.
+// If the pool is shutting down, the State is closed instead.
+func (p *Pool) Put(l *State) {
+	l.SetTop(0)
+	if p.RestoreGlobals {
+		restoreGlobals(l)
+	}
+	p.mu.Lock()
+	ps := p.states[l]
+	closing := p.closing
+	p.mu.Unlock()
+	if p.GC != nil && ps != nil && !closing {
+		ps.uses++
+		uses := ps.uses
+		go func() {
+			p.GC.collect(l, uses)
+			p.putIdle(l)
+		}()
+		return
+	}
+	p.putIdle(l)
+}
+
+// snapshotGlobals stores shallow copies of l's globals table
+// and the tables in its global variables in the registry
+// for use by [restoreGlobals].
+func snapshotGlobals(l *State) error {
+	if !l.CheckStack(7) {
+		return errors.New("lua: pool: snapshot globals: stack overflow")
+	}
+	l.CreateTable(0, 2) // snapshot
+	snapshot := l.Top()
+	l.CreateTable(0, 0) // tables
+	tables := l.Top()
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	globals := l.Top()
+	l.PushValue(globals)
+	pushShallowCopy(l, globals)
+	l.RawSet(tables)
+	l.PushNil()
+	for l.Next(globals) {
+		if l.IsTable(-1) {
+			l.PushValue(-1)
+			if l.RawGet(tables) == TypeNil {
+				l.Pop(1)
+				l.PushValue(-1)
+				pushShallowCopy(l, l.AbsIndex(-2))
+				l.RawSet(tables)
+			} else {
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+	}
+	if l.Metatable(globals) {
+		l.RawSetField(snapshot, "metatable")
+	}
+	l.Pop(1) // globals
+	l.RawSetField(snapshot, "tables")
+	l.RawSetField(RegistryIndex, poolGlobalsKey)
+	return nil
+}
+
+// pushShallowCopy pushes a new table
+// with the same keys and values as the table at the absolute index idx.
+func pushShallowCopy(l *State, idx int) {
+	l.CreateTable(0, 0)
+	l.PushNil()
+	for l.Next(idx) {
+		l.PushValue(-2)
+		l.Insert(-2)
+		l.RawSet(-4)
+	}
+}
+
+// restoreGlobals restores the tables saved by [snapshotGlobals].
+func restoreGlobals(l *State) {
+	if !l.CheckStack(6) {
+		return
+	}
+	defer l.SetTop(0)
+	if l.RawField(RegistryIndex, poolGlobalsKey) != TypeTable {
+		return
+	}
+	snapshot := l.Top()
+	l.RawField(snapshot, "tables")
+	tables := l.Top()
+	l.PushNil()
+	for l.Next(tables) {
+		restoreTable(l, l.AbsIndex(-2), l.AbsIndex(-1))
+		l.Pop(1)
+	}
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	l.RawField(snapshot, "metatable")
+	l.SetMetatable(-2)
+}
+
+// restoreTable sets the fields of the table at the absolute index t
+// to the fields of the table at the absolute index saved,
+// removing any fields that saved does not have.
+func restoreTable(l *State, t, saved int) {
+	l.PushNil()
+	for l.Next(t) {
+		l.Pop(1)
+		l.PushValue(-1)
+		if l.RawGet(saved) == TypeNil {
+			// Clearing fields during traversal is permitted.
+			l.PushValue(-2)
+			l.PushNil()
+			l.RawSet(t)
+		}
+		l.Pop(1)
+	}
+	l.PushNil()
+	for l.Next(saved) {
+		l.PushValue(-2)
+		l.Insert(-2)
+		l.RawSet(t)
+	}
+}
+
+// putIdle adds l to the idle list
+// or closes it if the pool is shutting down.
+func (p *Pool) putIdle(l *State) {
+	p.mu.Lock()
+	closing := p.closing
+	if !closing {
+		p.idle = append(p.idle, l)
+	}
+	p.mu.Unlock()
+	if closing {
+		p.forget(l)
+		closePoolState(l)
+	}
+	p.release()
+}
+
+// release marks a State as no longer active.
+func (p *Pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	if p.closing && p.active == 0 {
+		close(p.drained)
+	}
+}
+
+// Shutdown stops the pool from handing out States,
+// closes its idle States,
+// and waits for all States in use to be returned with [Pool.Put],
+// closing them as they are returned.
+// If ctx is done before all States are returned,
+// then Shutdown interrupts any Lua code still running in the pool's States
+// (the calls fail with an error)
+// and returns ctx.Err().
+// States returned after Shutdown returns are still closed by Put.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closing {
+		p.closing = true
+		p.drained = make(chan struct{})
+		if p.active == 0 {
+			close(p.drained)
+		}
+	}
+	idle := p.idle
+	p.idle = nil
+	drained := p.drained
+	p.mu.Unlock()
+
+	for _, l := range idle {
+		p.forget(l)
+		closePoolState(l)
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		if !p.interrupted.Load() {
+			p.interrupted.Store(true)
+			if p.interruptCh == nil {
+				p.interruptCh = make(chan struct{})
+			}
+			close(p.interruptCh)
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// forget removes the bookkeeping for a State that is about to be closed.
+func (p *Pool) forget(l *State) {
+	p.mu.Lock()
+	delete(p.states, l)
+	p.mu.Unlock()
+}
+
+// closePoolState runs a final garbage collection cycle
+// (so that finalizers run while the state is intact)
+// and then closes l.
+func closePoolState(l *State) {
+	l.GC()
+	l.Close()
+}
@@ -0,0 +1,227 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	t.Run("Reuse", func(t *testing.T) {
+		p := new(Pool)
+		l1, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l1.PushInteger(42)
+		p.Put(l1)
+		l2, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l2 != l1 {
+			t.Error("Get did not reuse idle state")
+		}
+		if got := l2.Top(); got != 0 {
+			t.Errorf("reused state has Top() = %d; want 0", got)
+		}
+		p.Put(l2)
+
+		if err := p.Shutdown(context.Background()); err != nil {
+			t.Error("Shutdown:", err)
+		}
+		if _, err := p.Get(); !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("Get after Shutdown = _, %v; want %v", err, ErrPoolClosed)
+		}
+	})
+
+	t.Run("Interrupt", func(t *testing.T) {
+		p := new(Pool)
+		l, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.LoadString("while true do end", "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		callDone := make(chan error)
+		go func() {
+			err := l.Call(0, 0, 0)
+			p.Put(l)
+			callDone <- err
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown(...) = %v; want %v", err, context.DeadlineExceeded)
+		}
+		select {
+		case err := <-callDone:
+			if err == nil || !strings.Contains(err.Error(), errInterrupted.Error()) {
+				t.Errorf("Call(...) = %v; want interrupted error", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("call not interrupted")
+		}
+		if err := p.Shutdown(context.Background()); err != nil {
+			t.Error("second Shutdown:", err)
+		}
+	})
+
+	t.Run("InterruptBlocked", func(t *testing.T) {
+		p := new(Pool)
+		l, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.LoadString("local ch = ...; ch:receive()", "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := PushChannel(l, make(chan any)); err != nil {
+			t.Fatal(err)
+		}
+		callDone := make(chan error)
+		go func() {
+			err := l.Call(1, 0, 0)
+			p.Put(l)
+			callDone <- err
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown(...) = %v; want %v", err, context.DeadlineExceeded)
+		}
+		select {
+		case err := <-callDone:
+			if err == nil || !strings.Contains(err.Error(), errInterrupted.Error()) {
+				t.Errorf("Call(...) = %v; want interrupted error", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("blocked receive not interrupted")
+		}
+	})
+
+	t.Run("RestoreGlobals", func(t *testing.T) {
+		p := &Pool{RestoreGlobals: true}
+		defer p.Shutdown(context.Background())
+		l, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		const source = "x = 42\n" +
+			"print = nil\n" +
+			"string.foo = 'bar'\n" +
+			"setmetatable(_G, {__index = function() return 'oops' end})\n"
+		if err := l.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Call(0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		p.Put(l)
+
+		l2, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Put(l2)
+		if l2 != l {
+			t.Fatal("Get did not reuse idle state")
+		}
+		const check = "return rawget(_G, 'x'), type(print), string.foo, getmetatable(_G), type(string.format)"
+		if err := l2.LoadString(check, "=(check)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l2.Call(0, 5, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !l2.IsNil(1) {
+			t.Errorf("x is a %v; want nil", l2.Type(1))
+		}
+		if got, _ := l2.ToString(2); got != "function" {
+			t.Errorf("type(print) = %q; want \"function\"", got)
+		}
+		if !l2.IsNil(3) {
+			t.Errorf("string.foo is a %v; want nil", l2.Type(3))
+		}
+		if !l2.IsNil(4) {
+			t.Error("globals metatable not removed")
+		}
+		if got, _ := l2.ToString(5); got != "function" {
+			t.Errorf("type(string.format) = %q; want \"function\"", got)
+		}
+	})
+
+	t.Run("GCWhenIdle", func(t *testing.T) {
+		p := &Pool{GC: GCWhenIdle(1 << 20)}
+		defer p.Shutdown(context.Background())
+		l, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.state.IsGCRunning() {
+			t.Error("automatic collector running in pool state")
+		}
+		const source = "local t = {}\n" +
+			"for i = 1, 10000 do t[i] = {i} end\n"
+		if err := l.LoadString(source, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Call(0, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		before := l.GCCount()
+		p.Put(l)
+
+		// Wait for the background collection to return the state.
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			p.mu.Lock()
+			n := len(p.idle)
+			p.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("state not returned to pool after collection")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		l2, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Put(l2)
+		if l2 != l {
+			t.Fatal("Get did not reuse idle state")
+		}
+		if after := l2.GCCount(); after >= before {
+			t.Errorf("GCCount() = %d after Put; want < %d", after, before)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+)
+
+// ErrQuotaExceeded matches errors returned by [State.Call]
+// (and the functions that use it)
+// when the instruction quota set by [State.SetQuota] has run out.
+var ErrQuotaExceeded = errors.New("lua: instruction quota exceeded")
+
+const (
+	// quotaRegistryKey is the registry key of the userdata
+	// that holds a state's *quota.
+	quotaRegistryKey = "zombiezen.com/go/lua.quota"
+	// quotaMetatableName is the registry name of the quota userdata's metatable.
+	quotaMetatableName = "*zombiezen.com/go/lua.quota"
+	// maxQuotaStep is the maximum number of instructions
+	// between checks of the quota.
+	maxQuotaStep = 1000
+)
+
+// quota is the instruction budget set by [State.SetQuota].
+type quota struct {
+	remaining int64
+	// id is the quota's hook, added with [State.AddHook].
+	id HookID
+	// step is the number of instructions between calls to the hook.
+	step int
+}
+
+// SetQuota limits the number of Lua VM instructions that the state may execute.
+// Once roughly n more instructions have run,
+// the running function raises an error,
+// and [State.Call] returns an error that matches [ErrQuotaExceeded].
+// The error is raised again after every instruction
+// if Lua code catches it with pcall.
+// Calling SetQuota again replaces the remaining budget,
+// and a negative n removes the quota.
+//
+// The quota is enforced with a count hook (see [State.AddHook])
+// that is checked every min(n, 1000) instructions,
+// so instructions in every coroutine of the state are counted.
+// Go functions are not counted.
+func (l *State) SetQuota(n int64) {
+	q := l.quota()
+	if n < 0 {
+		if q != nil {
+			l.PushNil()
+			l.RawSetField(RegistryIndex, quotaRegistryKey)
+			l.RemoveHook(q.id)
+		}
+		return
+	}
+	if q == nil {
+		q = new(quota)
+		q.id = l.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+			q.remaining -= int64(q.step)
+			if q.remaining > 0 {
+				return nil
+			}
+			q.remaining = 0
+			if q.step != 1 {
+				// Raise the error after every instruction from now on
+				// so that pcall cannot be used to keep running.
+				q.step = 1
+				l.UpdateHook(q.id, MaskCount, q.step)
+			}
+			return ErrQuotaExceeded
+		}, 0, 0)
+		NewUserdata(l, q, quotaMetatableName)
+		l.RawSetField(RegistryIndex, quotaRegistryKey)
+	}
+	q.remaining = n
+	q.step = int(min(max(n, 1), maxQuotaStep))
+	l.UpdateHook(q.id, MaskCount, q.step)
+}
+
+// Quota returns the approximate number of instructions
+// that remain in the quota set by [State.SetQuota].
+// ok is false if the state does not have a quota.
+func (l *State) Quota() (remaining int64, ok bool) {
+	q := l.quota()
+	if q == nil {
+		return 0, false
+	}
+	return q.remaining, true
+}
+
+// quota returns the state's quota or nil if it does not have one.
+func (l *State) quota() *quota {
+	if !l.CheckStack(1) {
+		return nil
+	}
+	l.RawField(RegistryIndex, quotaRegistryKey)
+	q := TestTypedUserdata[*quota](l, -1, quotaMetatableName)
+	l.Pop(1)
+	if q == nil {
+		return nil
+	}
+	return *q
+}
+
+// quotaExceeded reports whether the state's quota has run out.
+func (l *State) quotaExceeded() bool {
+	q := l.quota()
+	return q != nil && q.remaining <= 0
+}
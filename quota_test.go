@@ -0,0 +1,197 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	if _, ok := state.Quota(); ok {
+		t.Error("new state has a quota")
+	}
+
+	state.SetQuota(100_000)
+	if got, ok := state.Quota(); !ok || got != 100_000 {
+		t.Errorf("state.Quota() = %d, %t; want 100000, true", got, ok)
+	}
+	if err := state.LoadString(`local n = 0; for i = 1, 10000 do n = n + i end; return n`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+	remaining, _ := state.Quota()
+	if remaining >= 100_000 || remaining < 50_000 {
+		t.Errorf("after short loop, state.Quota() = %d; want in [50000, 100000)", remaining)
+	}
+
+	for _, source := range []string{
+		`while true do end`,
+		`while true do pcall(function() while true do end end) end`,
+	} {
+		state.SetQuota(5000)
+		if err := state.LoadString(source, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		err := state.Call(0, 0, 0)
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("%s: state.Call(...) = %v; want %v", source, err, ErrQuotaExceeded)
+		}
+		if got, _ := state.Quota(); got != 0 {
+			t.Errorf("%s: after exceeding quota, state.Quota() = %d; want 0", source, got)
+		}
+		state.SetTop(0)
+	}
+
+	// Other errors are not reported as quota errors.
+	state.SetQuota(5000)
+	if err := state.LoadString(`error("boom")`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err == nil || errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("state.Call(error) = %v; want non-quota error", err)
+	}
+	state.SetTop(0)
+
+	state.SetQuota(-1)
+	if _, ok := state.Quota(); ok {
+		t.Error("state has a quota after SetQuota(-1)")
+	}
+	if f, mask, _ := state.Hook(); f != nil || mask != 0 {
+		t.Errorf("hook not removed after SetQuota(-1) (mask = %v)", mask)
+	}
+}
+
+func TestQuotaExistingCoroutine(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, CoroutineLibraryName, true, OpenCoroutine); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	// Create the coroutine before the quota's hook is added.
+	if err := state.LoadString(`co = coroutine.create(function() while true do end end)`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	state.SetQuota(5000)
+	defer state.SetQuota(-1)
+	if err := state.LoadString(`return coroutine.resume(co)`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if state.ToBoolean(1) {
+		t.Fatal("coroutine.resume(co) succeeded")
+	}
+	if msg, _ := state.ToString(2); !strings.Contains(msg, ErrQuotaExceeded.Error()) {
+		t.Errorf("coroutine.resume(co) error = %q; want %q", msg, ErrQuotaExceeded)
+	}
+}
+
+func TestQuotaPreviousHook(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	calls := 0
+	state.SetHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		if event == HookEventCall && ar.Info("S").What != "C" {
+			calls++
+		}
+		return nil
+	}, MaskCall, 0)
+	state.SetQuota(1000)
+	if err := state.LoadString(`local function f() end; f(); f()`, "=(test)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("previous hook saw %d calls; want 3", calls)
+	}
+	state.SetQuota(-1)
+	if _, mask, _ := state.Hook(); mask != MaskCall {
+		t.Errorf("after SetQuota(-1), hook mask = %v; want %v", mask, MaskCall)
+	}
+}
+
+func TestQuotaBreakpoint(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	var stops []int
+	state.SetBreakpointHandler(func(l *State, ar *ActivationRecord) error {
+		stops = append(stops, ar.Info("l").CurrentLine)
+		return nil
+	})
+	state.SetQuota(1000)
+	state.SetBreakpoint("test", 2)
+	state.SetQuota(-1)
+	if err := state.LoadString("local x = 1\nx = x + 1\nreturn x\n", "=test", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(stops) != 1 || stops[0] != 2 {
+		t.Errorf("stopped at lines %v; want [2]", stops)
+	}
+	if _, ok := state.Quota(); ok {
+		t.Error("state.Quota() reports a quota after SetQuota(-1)")
+	}
+}
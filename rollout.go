@@ -0,0 +1,334 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rollout routes calls to the global functions of a script
+// loaded in a [Pool] of States (the primary version),
+// while optionally shadowing a fraction of the calls
+// to a candidate version of the script loaded in another Pool.
+// Shadowed calls run in the background after the primary call returns,
+// their results are compared to the primary results,
+// and differences are reported to OnMismatch.
+// Callers always receive the primary version's results.
+// Once satisfied, a program can [Rollout.Promote] the candidate to primary
+// or [Rollout.Rollback] to discard it.
+//
+// A Rollout must be created with [NewRollout].
+// Its methods are safe to call from multiple goroutines.
+type Rollout struct {
+	// OnMismatch is called when a shadowed call's results
+	// differ from the primary call's results.
+	// It is called from a background goroutine.
+	// If OnMismatch is nil, mismatches are ignored.
+	OnMismatch func(*ShadowMismatch)
+	// ShadowTimeout is the maximum duration of a shadowed call.
+	// If ShadowTimeout is zero, shadowed calls are only interrupted
+	// when their candidate is rolled back or replaced.
+	ShadowTimeout time.Duration
+
+	mu        sync.Mutex
+	primary   *rolloutVersion
+	candidate *rolloutVersion
+	fraction  float64
+	shadows   sync.WaitGroup
+}
+
+// rolloutVersion is a version of the script used by a [Rollout].
+type rolloutVersion struct {
+	pool *Pool
+	// calls counts the calls in progress on pool.
+	// The pool is not shut down until they finish.
+	calls sync.WaitGroup
+	// ctx is done once the version is retired.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newRolloutVersion(pool *Pool) *rolloutVersion {
+	v := &rolloutVersion{pool: pool}
+	v.ctx, v.cancel = context.WithCancel(context.Background())
+	return v
+}
+
+// retire waits for the calls in progress on v to finish
+// and then shuts down v's pool.
+// If interrupt is true, shadowed calls are interrupted first.
+func (v *rolloutVersion) retire(ctx context.Context, interrupt bool) error {
+	if interrupt {
+		v.cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		v.calls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	v.cancel()
+	return v.pool.Shutdown(ctx)
+}
+
+// ShadowMismatch describes a difference between the results
+// of a primary call and its shadowed call.
+type ShadowMismatch struct {
+	// Name is the name of the global function that was called.
+	Name string
+	// Args are the arguments passed to the function.
+	Args []any
+	// Primary and Candidate are the results of each version,
+	// converted as with [Unmarshal] into an empty interface.
+	Primary   []any
+	Candidate []any
+	// PrimaryErr and CandidateErr are the errors returned by each version.
+	PrimaryErr   error
+	CandidateErr error
+	// Diff is a short description of the first difference found.
+	Diff string
+}
+
+// NewRollout returns a new Rollout that sends calls to primary.
+func NewRollout(primary *Pool) *Rollout {
+	return &Rollout{primary: newRolloutVersion(primary)}
+}
+
+// Stage sets the candidate version of the script
+// and the fraction (between 0 and 1) of calls that are shadowed to it.
+// Any previously staged candidate is shut down
+// after its shadowed calls are interrupted.
+func (r *Rollout) Stage(ctx context.Context, candidate *Pool, fraction float64) error {
+	if fraction < 0 || fraction > 1 {
+		return fmt.Errorf("lua: stage: shadow fraction %g out of range [0, 1]", fraction)
+	}
+	r.mu.Lock()
+	prev := r.candidate
+	if prev == nil || prev.pool != candidate {
+		r.candidate = newRolloutVersion(candidate)
+	} else {
+		prev = nil
+	}
+	r.fraction = fraction
+	r.mu.Unlock()
+	if prev != nil {
+		return prev.retire(ctx, true)
+	}
+	return nil
+}
+
+// Promote makes the staged candidate the primary version
+// and shuts down the previous primary version
+// once the calls already in progress on it finish.
+func (r *Rollout) Promote(ctx context.Context) error {
+	r.mu.Lock()
+	if r.candidate == nil {
+		r.mu.Unlock()
+		return errors.New("lua: promote: no candidate staged")
+	}
+	prev := r.primary
+	r.primary = r.candidate
+	r.candidate = nil
+	r.mu.Unlock()
+	return prev.retire(ctx, false)
+}
+
+// Rollback discards the staged candidate (if any),
+// interrupting its shadowed calls and shutting it down.
+func (r *Rollout) Rollback(ctx context.Context) error {
+	r.mu.Lock()
+	prev := r.candidate
+	r.candidate = nil
+	r.mu.Unlock()
+	if prev == nil {
+		return nil
+	}
+	return prev.retire(ctx, true)
+}
+
+// Wait waits for all shadowed calls that have started to finish.
+func (r *Rollout) Wait() {
+	r.shadows.Wait()
+}
+
+// Call calls the global function with the given name
+// in the primary version with args converted by [PushAny].
+// The function's results are converted as with [Unmarshal] into an empty interface.
+// Lua code running for the call is interrupted once ctx is done.
+func (r *Rollout) Call(ctx context.Context, name string, args ...any) ([]any, error) {
+	r.mu.Lock()
+	primary := r.primary
+	candidate := r.candidate
+	shadow := candidate != nil && rand.Float64() < r.fraction
+	primary.calls.Add(1)
+	if shadow {
+		r.shadows.Add(1)
+		candidate.calls.Add(1)
+	}
+	r.mu.Unlock()
+
+	results, err := callPooled(ctx, primary.pool, name, args)
+	primary.calls.Done()
+	if shadow {
+		go func() {
+			defer r.shadows.Done()
+			defer candidate.calls.Done()
+			r.shadowCall(candidate, name, args, results, err)
+		}()
+	}
+	return results, err
+}
+
+func (r *Rollout) shadowCall(candidate *rolloutVersion, name string, args []any, primary []any, primaryErr error) {
+	ctx := candidate.ctx
+	if r.ShadowTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.ShadowTimeout)
+		defer cancel()
+	}
+	results, err := callPooled(ctx, candidate.pool, name, args)
+	if errors.Is(err, ErrPoolClosed) || candidate.ctx.Err() != nil {
+		// Candidate was rolled back or replaced during the call.
+		return
+	}
+	var diff string
+	switch {
+	case (primaryErr == nil) != (err == nil):
+		diff = fmt.Sprintf("error: primary %v, candidate %v", primaryErr, err)
+	case err != nil:
+		if primaryErr.Error() != err.Error() {
+			diff = fmt.Sprintf("error: primary %q, candidate %q", primaryErr, err)
+		}
+	default:
+		diff = diffValues("results", primary, results)
+	}
+	if diff != "" && r.OnMismatch != nil {
+		r.OnMismatch(&ShadowMismatch{
+			Name:         name,
+			Args:         args,
+			Primary:      primary,
+			Candidate:    results,
+			PrimaryErr:   primaryErr,
+			CandidateErr: err,
+			Diff:         diff,
+		})
+	}
+}
+
+// callPooled calls the named global function in a State from pool.
+func callPooled(ctx context.Context, pool *Pool, name string, args []any) ([]any, error) {
+	l, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Put(l)
+	unbind := pool.bindContext(l, ctx)
+	defer unbind()
+
+	if _, err := l.Global(name, 0); err != nil {
+		return nil, fmt.Errorf("lua: call %s: %w", name, err)
+	}
+	if !l.IsFunction(-1) {
+		return nil, fmt.Errorf("lua: call %s: not a function", name)
+	}
+	for i, arg := range args {
+		if err := pushValue(l, reflect.ValueOf(arg), 0); err != nil {
+			return nil, fmt.Errorf("lua: call %s: argument #%d: %w", name, i+1, err)
+		}
+	}
+	if err := l.Call(len(args), MultipleReturns, 0); err != nil {
+		return nil, fmt.Errorf("lua: call %s: %w", name, err)
+	}
+	results := make([]any, 0, l.Top())
+	for i := 1; i <= l.Top(); i++ {
+		v, err := toAny(l, i, 0)
+		if err != nil {
+			return nil, fmt.Errorf("lua: call %s: result #%d: %w", name, i, err)
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
+
+// diffValues returns a description of the first difference
+// between two values produced by [toAny] (or slices of them),
+// or the empty string if they are equal.
+func diffValues(path string, a, b any) string {
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		if !ok {
+			return fmt.Sprintf("%s: %#v != %#v", path, a, b)
+		}
+		if len(a) != len(b) {
+			return fmt.Sprintf("%s: length %d != %d", path, len(a), len(b))
+		}
+		for i := range a {
+			if d := diffValues(fmt.Sprintf("%s[%d]", path, i+1), a[i], b[i]); d != "" {
+				return d
+			}
+		}
+		return ""
+	case map[any]any:
+		b, ok := b.(map[any]any)
+		if !ok {
+			return fmt.Sprintf("%s: %#v != %#v", path, a, b)
+		}
+		keys := make([]any, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, k := range keys {
+			if d := diffValues(fmt.Sprintf("%s[%#v]", path, k), a[k], b[k]); d != "" {
+				return d
+			}
+		}
+		return ""
+	default:
+		if fmt.Sprintf("%T", a) != fmt.Sprintf("%T", b) {
+			return fmt.Sprintf("%s: %T %#v != %T %#v", path, a, a, b, b)
+		}
+		if a != b {
+			return fmt.Sprintf("%s: %#v != %#v", path, a, b)
+		}
+		return ""
+	}
+}
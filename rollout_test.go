@@ -0,0 +1,239 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRollout(t *testing.T) {
+	ctx := context.Background()
+	scriptPool := func(source string) *Pool {
+		return &Pool{New: func() (*State, error) {
+			l := new(State)
+			if err := OpenLibraries(l); err != nil {
+				l.Close()
+				return nil, err
+			}
+			if err := l.LoadString(source, "=(script)", "t"); err != nil {
+				l.Close()
+				return nil, err
+			}
+			if err := l.Call(0, 0, 0); err != nil {
+				l.Close()
+				return nil, err
+			}
+			return l, nil
+		}}
+	}
+
+	r := NewRollout(scriptPool("function greet(name) return 'hello ' .. name end"))
+	var mu sync.Mutex
+	var mismatches []*ShadowMismatch
+	r.OnMismatch = func(m *ShadowMismatch) {
+		mu.Lock()
+		mismatches = append(mismatches, m)
+		mu.Unlock()
+	}
+
+	got, err := r.Call(ctx, "greet", "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "hello world" {
+		t.Errorf("greet(\"world\") = %#v; want []any{\"hello world\"}", got)
+	}
+
+	candidate := scriptPool("function greet(name) return 'hi ' .. name end")
+	if err := r.Stage(ctx, candidate, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.Call(ctx, "greet", "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "hello world" {
+		t.Errorf("with candidate staged, greet(\"world\") = %#v; want []any{\"hello world\"}", got)
+	}
+	r.Wait()
+	mu.Lock()
+	if len(mismatches) != 1 {
+		t.Errorf("got %d mismatches; want 1", len(mismatches))
+	} else if m := mismatches[0]; m.Name != "greet" || !strings.Contains(m.Diff, "hi world") {
+		t.Errorf("mismatch = %+v; want greet mismatch mentioning \"hi world\"", m)
+	}
+	mu.Unlock()
+
+	if err := r.Promote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.Call(ctx, "greet", "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "hi world" {
+		t.Errorf("after promote, greet(\"world\") = %#v; want []any{\"hi world\"}", got)
+	}
+	if err := r.Rollback(ctx); err != nil {
+		t.Error("Rollback with no candidate:", err)
+	}
+	if err := r.Promote(ctx); err == nil {
+		t.Error("Promote with no candidate did not return an error")
+	}
+}
+
+func TestRolloutRetire(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	scriptPool := func(source string, wait func()) *Pool {
+		return &Pool{New: func() (*State, error) {
+			l := new(State)
+			if err := OpenLibraries(l); err != nil {
+				l.Close()
+				return nil, err
+			}
+			l.PushClosure(0, func(l *State) (int, error) {
+				wait()
+				return 0, nil
+			})
+			if err := l.SetGlobal("wait", 0); err != nil {
+				l.Close()
+				return nil, err
+			}
+			if err := l.LoadString(source, "=(script)", "t"); err != nil {
+				l.Close()
+				return nil, err
+			}
+			if err := l.Call(0, 0, 0); err != nil {
+				l.Close()
+				return nil, err
+			}
+			return l, nil
+		}}
+	}
+
+	t.Run("PromoteDuringCall", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		r := NewRollout(scriptPool("function f() wait(); return 1 end", func() {
+			close(started)
+			<-release
+		}))
+		callDone := make(chan error, 1)
+		go func() {
+			_, err := r.Call(ctx, "f")
+			callDone <- err
+		}()
+		<-started
+
+		if err := r.Stage(ctx, scriptPool("function f() return 1 end", func() {}), 0); err != nil {
+			t.Fatal(err)
+		}
+		promoteDone := make(chan error, 1)
+		go func() {
+			promoteDone <- r.Promote(ctx)
+		}()
+		select {
+		case err := <-promoteDone:
+			t.Fatalf("Promote returned %v before the primary call finished", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		if err := <-callDone; err != nil {
+			t.Error("Call:", err)
+		}
+		if err := <-promoteDone; err != nil {
+			t.Error("Promote:", err)
+		}
+	})
+
+	t.Run("RollbackInterruptsShadow", func(t *testing.T) {
+		started := make(chan struct{})
+		r := NewRollout(scriptPool("function f() return 1 end", func() {}))
+		var mismatched bool
+		r.OnMismatch = func(*ShadowMismatch) { mismatched = true }
+		candidate := scriptPool("function f() wait(); while true do end end", func() {
+			close(started)
+		})
+		if err := r.Stage(ctx, candidate, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Call(ctx, "f"); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+		if err := r.Rollback(ctx); err != nil {
+			t.Error("Rollback:", err)
+		}
+		r.Wait()
+		if mismatched {
+			t.Error("OnMismatch called for an interrupted shadow call")
+		}
+	})
+
+	t.Run("ShadowTimeout", func(t *testing.T) {
+		r := NewRollout(scriptPool("function f() return 1 end", func() {}))
+		r.ShadowTimeout = 10 * time.Millisecond
+		mismatches := make(chan *ShadowMismatch, 1)
+		r.OnMismatch = func(m *ShadowMismatch) { mismatches <- m }
+		if err := r.Stage(ctx, scriptPool("function f() while true do end end", func() {}), 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Call(ctx, "f"); err != nil {
+			t.Fatal(err)
+		}
+		r.Wait()
+		select {
+		case m := <-mismatches:
+			if m.CandidateErr == nil {
+				t.Errorf("CandidateErr = <nil>; want timeout error")
+			}
+		default:
+			t.Error("OnMismatch not called for a timed out shadow call")
+		}
+	})
+}
+
+func TestDiffValues(t *testing.T) {
+	tests := []struct {
+		a, b any
+		want string
+	}{
+		{int64(1), int64(1), ""},
+		{int64(1), 1.0, "x: int64 1 != float64 1"},
+		{
+			map[any]any{"a": map[any]any{int64(1): "x"}},
+			map[any]any{"a": map[any]any{int64(1): "y"}},
+			`x["a"][1]: "x" != "y"`,
+		},
+		{[]any{"a"}, []any{"a", "b"}, "x: length 1 != 2"},
+	}
+	for _, test := range tests {
+		if got := diffValues("x", test.a, test.b); got != test.want {
+			t.Errorf("diffValues(%#v, %#v) = %q; want %q", test.a, test.b, got, test.want)
+		}
+	}
+}
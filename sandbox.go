@@ -0,0 +1,231 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+// SandboxOptions is the set of parameters for [OpenSandbox].
+// A nil *SandboxOptions is treated the same as the zero value.
+type SandboxOptions struct {
+	// Output is the writer that print writes to.
+	// If nil, print discards its output.
+	Output io.Writer
+	// Rand is the source of math.random's numbers.
+	// If nil, Lua's built-in random number generator is used.
+	Rand rand.Source
+}
+
+// sandboxBase lists the functions of the basic library that [OpenSandbox] keeps.
+var sandboxBase = []string{
+	"_G",
+	"_VERSION",
+	"assert",
+	"error",
+	"getmetatable",
+	"ipairs",
+	"load",
+	"next",
+	"pairs",
+	"pcall",
+	"print",
+	"rawequal",
+	"rawget",
+	"rawlen",
+	"rawset",
+	"select",
+	"setmetatable",
+	"tonumber",
+	"tostring",
+	"type",
+	"xpcall",
+}
+
+// sandboxLibraries lists the libraries that [OpenSandbox] opens
+// and the functions it keeps from each.
+// A nil list keeps every function.
+var sandboxLibraries = []struct {
+	name   string
+	fields []string
+}{
+	{CoroutineLibraryName, nil},
+	{TableLibraryName, nil},
+	{StringLibraryName, []string{
+		"byte",
+		"char",
+		"find",
+		"format",
+		"gmatch",
+		"gsub",
+		"len",
+		"lower",
+		"match",
+		"pack",
+		"packsize",
+		"rep",
+		"reverse",
+		"sub",
+		"unpack",
+		"upper",
+	}},
+	{UTF8LibraryName, nil},
+	{MathLibraryName, nil},
+}
+
+// OpenSandbox opens the subset of the standard Lua libraries
+// that is safe to expose to untrusted code into the given state.
+// The sandbox follows this policy:
+//
+//   - The basic library omits collectgarbage, dofile, loadfile, and warn.
+//     load only accepts text chunks.
+//     print writes to opts.Output.
+//   - The coroutine, table, utf8, and math libraries are opened in full.
+//   - The string library omits string.dump.
+//     The string metatable's __index refers to the reduced library.
+//   - The io, os, debug, and package libraries (including require)
+//     are not opened.
+//
+// The sandbox does not limit memory or CPU use;
+// see [NewStateWithLimit], [State.SetQuota], and [State.CallTimeout] for that.
+// OpenSandbox should be called on a fresh state:
+// it does not remove functions that are already present.
+func OpenSandbox(l *State, opts *SandboxOptions) error {
+	if opts == nil {
+		opts = new(SandboxOptions)
+	}
+	if !l.CheckStack(4) {
+		return fmt.Errorf("lua: open sandbox: stack overflow")
+	}
+	out := opts.Output
+	if out == nil {
+		out = io.Discard
+	}
+
+	// The basic library writes its functions directly into the globals table,
+	// so copy the allowed functions back over after opening it.
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	l.CreateTable(0, len(sandboxBase))
+	l.PushClosure(0, NewOpenBase(out, nil))
+	l.PushString(GName)
+	if err := l.Call(1, 1, 0); err != nil {
+		l.Pop(2)
+		return fmt.Errorf("lua: open sandbox: %w", err)
+	}
+	for _, name := range sandboxBase {
+		l.RawField(-1, name)
+		l.RawSetField(-3, name)
+	}
+	l.RawField(-1, "load")
+	l.PushClosure(1, sandboxLoad)
+	l.RawSetField(-3, "load")
+	for _, name := range []string{"collectgarbage", "dofile", "loadfile", "warn"} {
+		l.PushNil()
+		l.RawSetField(-2, name)
+	}
+	l.Pop(1)
+	l.PushNil()
+	for l.Next(-2) {
+		l.PushValue(-2)
+		l.Rotate(-2, 1)
+		l.RawSet(-5)
+	}
+	l.Pop(1)
+
+	for _, lib := range sandboxLibraries {
+		var openf Function
+		switch lib.name {
+		case CoroutineLibraryName:
+			openf = OpenCoroutine
+		case TableLibraryName:
+			openf = OpenTable
+		case StringLibraryName:
+			openf = OpenString
+		case UTF8LibraryName:
+			openf = OpenUTF8
+		case MathLibraryName:
+			openf = NewOpenMath(opts.Rand)
+		}
+		l.PushClosure(0, openf)
+		l.PushString(lib.name)
+		if err := l.Call(1, 1, 0); err != nil {
+			l.Pop(1)
+			return fmt.Errorf("lua: open sandbox: %s: %w", lib.name, err)
+		}
+		if lib.fields != nil {
+			l.CreateTable(0, len(lib.fields))
+			for _, name := range lib.fields {
+				l.RawField(-2, name)
+				l.RawSetField(-2, name)
+			}
+			l.Remove(-2)
+		}
+		if lib.name == StringLibraryName {
+			l.PushString("")
+			if l.Metatable(-1) {
+				l.PushValue(-3)
+				l.RawSetField(-2, "__index")
+				l.Pop(1)
+			}
+			l.Pop(1)
+		}
+		l.RawSetField(-2, lib.name)
+	}
+	l.Pop(1)
+	l.PushBoolean(true)
+	l.RawSetField(RegistryIndex, sandboxRegistryKey)
+	return nil
+}
+
+// sandboxRegistryKey is the registry key that [OpenSandbox] sets to true
+// so that [State.Capabilities] can report the sandbox.
+const sandboxRegistryKey = "zombiezen.com/go/lua.sandbox"
+
+// sandboxLoad is the load function installed by [OpenSandbox].
+// It calls the standard load function (its first upvalue)
+// with the mode forced to "t".
+func sandboxLoad(l *State) (int, error) {
+	if !l.IsNoneOrNil(3) {
+		mode, err := CheckString(l, 3)
+		if err != nil {
+			return 0, err
+		}
+		if !strings.Contains(mode, "t") {
+			l.PushNil()
+			l.PushString(fmt.Sprintf("attempt to load a text chunk (mode is '%s')", mode))
+			return 2, nil
+		}
+	}
+	n := max(l.Top(), 3)
+	l.SetTop(n)
+	l.PushString("t")
+	l.Replace(3)
+	l.PushValue(UpvalueIndex(1))
+	l.Rotate(1, 1)
+	if err := l.Call(n, MultipleReturns, 0); err != nil {
+		return 0, err
+	}
+	return l.Top(), nil
+}
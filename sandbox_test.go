@@ -0,0 +1,88 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpenSandbox(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	out := new(strings.Builder)
+	if err := OpenSandbox(state, &SandboxOptions{Output: out}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"type(print)", "function"},
+		{"type(pcall)", "function"},
+		{"type(dofile)", "nil"},
+		{"type(loadfile)", "nil"},
+		{"type(collectgarbage)", "nil"},
+		{"type(require)", "nil"},
+		{"type(io)", "nil"},
+		{"type(os)", "nil"},
+		{"type(debug)", "nil"},
+		{"type(string.dump)", "nil"},
+		{"type(('x').dump)", "nil"},
+		{"('abc'):upper()", "ABC"},
+		{"table.concat({1, 2}, ',')", "1,2"},
+		{"tostring(math.max(1, 2))", "2"},
+		{"tostring(coroutine.wrap(function() coroutine.yield(42) end)())", "42"},
+		{"load('return 1 + 1')()", "2"},
+		{"select(2, load('return 1', 'x', 'b'))", "attempt to load a text chunk (mode is 'b')"},
+		{"select(2, load(string.char(27) .. 'Lua'))", "attempt to load a binary chunk (mode is 't')"},
+	}
+	for _, test := range tests {
+		if err := state.LoadString("return "+test.expr, "=(load)", "t"); err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got, _ := state.ToString(-1); got != test.want {
+			t.Errorf("%s = %q; want %q", test.expr, got, test.want)
+		}
+		state.Pop(1)
+	}
+
+	if err := state.LoadString("print('hello', 42)", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "hello\t42\n"; got != want {
+		t.Errorf("print output = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+)
+
+//go:embed selftest.lua
+var selfTestSource string
+
+// SelfTest runs a set of tests adapted from a subset of the official Lua test suite
+// to verify that the Lua core (see [Release] for its version)
+// and the standard libraries behave correctly in l.
+// This is intended for programs that build with a patched copy of this package.
+// The standard libraries must have been opened in l (see [OpenLibraries]).
+//
+// The tests run in an environment that inherits from (but does not modify)
+// the global environment.
+// However, they do run full garbage collection cycles.
+// SelfTest returns an error describing every failed test.
+func SelfTest(l *State) error {
+	if !l.CheckStack(6) {
+		return errors.New("lua: self test: stack overflow")
+	}
+	base := l.Top()
+	defer l.SetTop(base)
+
+	if err := l.LoadString(selfTestSource, "=selftest", "t"); err != nil {
+		return fmt.Errorf("lua: self test: %w", err)
+	}
+	// Set _ENV to a new table that inherits from the globals.
+	l.CreateTable(0, 0)
+	l.CreateTable(0, 1)
+	l.RawIndex(RegistryIndex, RegistryIndexGlobals)
+	l.RawSetField(-2, "__index")
+	l.SetMetatable(-2)
+	if _, ok := l.SetUpvalue(-2, 1); !ok {
+		return errors.New("lua: self test: could not set environment")
+	}
+	if err := l.Call(0, 1, 0); err != nil {
+		return fmt.Errorf("lua: self test: %w", err)
+	}
+
+	tests := l.Top()
+	var errs []error
+	for i, n := int64(1), int64(l.RawLen(tests)); i <= n; i++ {
+		l.RawIndex(tests, i)
+		l.RawIndex(-1, 1)
+		name, _ := l.ToString(-1)
+		l.RawIndex(-2, 2)
+		if err := l.Call(0, 0, 0); err != nil {
+			errs = append(errs, fmt.Errorf("lua: self test: %s: %w", name, err))
+		}
+		l.SetTop(tests)
+	}
+	return errors.Join(errs...)
+}
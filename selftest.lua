@@ -0,0 +1,281 @@
+-- Copyright 2023 Ross Light
+--
+-- Permission is hereby granted, free of charge, to any person obtaining a copy of
+-- this software and associated documentation files (the “Software”), to deal in
+-- the Software without restriction, including without limitation the rights to
+-- use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+-- the Software, and to permit persons to whom the Software is furnished to do so,
+-- subject to the following conditions:
+--
+-- The above copyright notice and this permission notice shall be included in all
+-- copies or substantial portions of the Software.
+--
+-- THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+-- IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+-- FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+-- COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+-- IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+-- CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+--
+-- SPDX-License-Identifier: MIT
+
+
+-- Self tests for the Lua core and standard libraries.
+-- These are adapted from a subset of the official Lua 5.4 test suite
+-- and are run by lua.SelfTest.
+-- The chunk returns a sequence of {name, function} pairs.
+
+local tests = {}
+
+local function test(name, f)
+  tests[#tests + 1] = {name, f}
+end
+
+test("arithmetic", function()
+  assert(7 // 2 == 3 and math.type(7 // 2) == "integer")
+  assert(7 / 2 == 3.5)
+  assert(-7 // 2 == -4)
+  assert(-7 % 3 == 2)
+  assert(7.0 // 2 == 3.0 and math.type(7.0 // 2) == "float")
+  assert(math.maxinteger + 1 == math.mininteger)
+  assert(2^53 == 9007199254740992.0)
+  assert(1 // 0.0 == math.huge)
+  assert(not pcall(function() return 1 // 0 end))
+  assert(3 & 5 == 1 and 3 | 5 == 7 and 3 ~ 5 == 6 and ~0 == -1)
+  assert(1 << 63 == math.mininteger and 1 << 64 == 0)
+  assert(math.tointeger(3.0) == 3 and math.tointeger(3.5) == nil)
+  assert(tostring(1e15) == "1e+15" and tostring(10 // 1) == "10")
+  assert(tonumber("0x10") == 16 and tonumber("  10  ") == 10)
+  assert(tonumber("z", 36) == 35 and tonumber("10", 2) == 2)
+  assert(tonumber("1e") == nil)
+end)
+
+test("strings", function()
+  assert(#"\0\1\2" == 3)
+  assert(("abc"):upper() == "ABC")
+  assert(string.rep("ab", 3, ",") == "ab,ab,ab")
+  assert(string.sub("hello", 2, -2) == "ell")
+  assert(string.sub("hello", -100, 100) == "hello")
+  assert(string.byte("A") == 65 and string.char(72, 105) == "Hi")
+  assert(string.format("%5.2f|%d|%s|%q", 3.14159, 42, "x", "a\nb") == ' 3.14|42|x|"a\\\nb"')
+  assert(string.format("%x", 255) == "ff")
+  assert(("x"):rep(0) == "")
+  assert("a" < "b" and "a" < "ab" and "" < "a")
+  assert("10" + 1 == 11 and 10 .. "" == "10")
+end)
+
+test("patterns", function()
+  assert(string.find("hello world", "o w") == 5)
+  assert(string.find("a.b", ".", 1, true) == 2)
+  assert(string.match("key = value", "(%w+)%s*=%s*(%w+)") == "key")
+  assert(select(2, string.match("key = value", "(%w+)%s*=%s*(%w+)")) == "value")
+  assert(string.gsub("hello world", "o", "0") == "hell0 w0rld")
+  assert(string.gsub("abc", "%w", "%0%0") == "aabbcc")
+  assert(string.gsub("abc", "", "-") == "-a-b-c-")
+  assert(string.gsub("hello", "l+", function(s) return #s end) == "he2o")
+  local t = {}
+  for w in string.gmatch("one two three", "%a+") do t[#t + 1] = w end
+  assert(#t == 3 and t[3] == "three")
+  assert(string.match("  trim  ", "^%s*(.-)%s*$") == "trim")
+  assert(string.find("THE (quick) fox", "%((%a+)%)") == 5)
+  assert(string.match("[[x]]", "%b[]") == "[[x]]")
+  assert(string.match("THE (quick) fox", "%f[%a]%a+", 5) == "quick")
+end)
+
+test("pack", function()
+  local s = string.pack("<i4", 100)
+  assert(#s == 4 and string.unpack("<i4", s) == 100)
+  assert(string.unpack(">I2", "\1\2") == 258)
+  assert(string.packsize("i4i8") == 12 and string.packsize("!8i4i8") == 16)
+  local a, b = string.unpack("z s1", string.pack("z s1", "hi", "yo"))
+  assert(a == "hi" and b == "yo")
+end)
+
+test("utf8", function()
+  assert(utf8.char(72, 228, 8364) == "H\u{E4}\u{20AC}")
+  assert(utf8.len("H\u{E4}\u{20AC}") == 3)
+  assert(utf8.codepoint("\u{20AC}") == 8364)
+  assert(utf8.len("\xff") == nil)
+  local n = 0
+  for _, c in utf8.codes("ab\u{E4}") do n = n + c end
+  assert(n == 97 + 98 + 228)
+end)
+
+test("tables", function()
+  local t = {10, 20, 30, nil}
+  assert(#t == 3)
+  table.insert(t, 40)
+  table.insert(t, 1, 0)
+  assert(table.concat(t, ",") == "0,10,20,30,40")
+  assert(table.remove(t) == 40 and table.remove(t, 1) == 0)
+  assert(select("#", table.unpack({1, 2, nil, 4}, 1, 4)) == 4)
+  local p = table.pack(1, nil, 3)
+  assert(p.n == 3)
+  local s = {5, 2, 8, 1}
+  table.sort(s)
+  assert(table.concat(s, " ") == "1 2 5 8")
+  table.sort(s, function(a, b) return a > b end)
+  assert(s[1] == 8)
+  local m = table.move({1, 2, 3}, 1, 3, 2)
+  assert(m[1] == 1 and m[2] == 1 and m[4] == 3)
+  local n = 0
+  for k, v in pairs({a = 1, b = 2, 3}) do n = n + v end
+  assert(n == 6)
+end)
+
+test("closures", function()
+  local function counter()
+    local i = 0
+    return function() i = i + 1; return i end
+  end
+  local c1, c2 = counter(), counter()
+  assert(c1() == 1 and c1() == 2 and c2() == 1)
+  local fs = {}
+  for i = 1, 3 do fs[i] = function() return i end end
+  assert(fs[1]() == 1 and fs[3]() == 3)
+  local function sum(...)
+    local s = 0
+    for _, v in ipairs({...}) do s = s + v end
+    return s, select("#", ...)
+  end
+  local s, n = sum(1, 2, 3)
+  assert(s == 6 and n == 3)
+  local function deep(n) if n == 0 then return 0 end return deep(n - 1) end
+  assert(deep(100000) == 0) -- proper tail calls
+end)
+
+test("control", function()
+  local n = 0
+  for i = 10, 1, -3 do n = n + i end
+  assert(n == 10 + 7 + 4 + 1)
+  for i = math.maxinteger - 1, math.maxinteger do n = i end
+  assert(n == math.maxinteger)
+  local i = 0
+  repeat local j = i; i = i + 1 until j >= 3
+  assert(i == 4)
+  do
+    local k = 0
+    ::top::
+    k = k + 1
+    if k < 5 then goto top end
+    assert(k == 5)
+  end
+  local x <const> = 10
+  assert(x == 10)
+end)
+
+test("metatables", function()
+  local V = {}
+  V.__index = V
+  V.__add = function(a, b) return setmetatable({x = a.x + b.x}, V) end
+  V.__eq = function(a, b) return a.x == b.x end
+  V.__lt = function(a, b) return a.x < b.x end
+  V.__le = function(a, b) return a.x <= b.x end
+  V.__len = function(a) return a.x end
+  V.__call = function(self, y) return self.x + y end
+  V.__tostring = function(a) return "V(" .. a.x .. ")" end
+  V.__concat = function(a, b) return tostring(a) .. tostring(b) end
+  function V.get(self) return self.x end
+  local a = setmetatable({x = 1}, V)
+  local b = setmetatable({x = 2}, V)
+  assert((a + b).x == 3 and a + b == setmetatable({x = 3}, V))
+  assert(a < b and a <= b and not (b < a))
+  assert(#b == 2 and b(3) == 5 and a:get() == 1)
+  assert(tostring(a) == "V(1)" and a .. b == "V(1)V(2)")
+  local log = {}
+  local p = setmetatable({}, {__newindex = function(t, k, v) log[#log + 1] = k; rawset(t, k, v) end})
+  p.a = 1; p.a = 2
+  assert(#log == 1 and p.a == 2)
+  assert(getmetatable(setmetatable({}, {__metatable = "locked"})) == "locked")
+  assert(rawequal(a, a) and not rawequal(a, setmetatable({x = 1}, V)))
+  assert(rawlen({1, 2}) == 2 and rawget(a, "get") == nil)
+end)
+
+test("errors", function()
+  local ok, err = pcall(error, "msg", 0)
+  assert(not ok and err == "msg")
+  ok, err = pcall(error, {code = 42})
+  assert(not ok and err.code == 42)
+  ok, err = pcall(function() local x = nil; return x.y end)
+  assert(not ok and string.find(err, "attempt to index"))
+  local handled
+  ok = xpcall(function() error("boom") end, function(m) handled = m; return m end)
+  assert(not ok and string.find(handled, "boom"))
+  ok, err = pcall(function() return {} + 1 end)
+  assert(not ok and string.find(err, "arithmetic"))
+  do
+    local closed = false
+    do
+      local c <close> = setmetatable({}, {__close = function() closed = true end})
+    end
+    assert(closed)
+  end
+end)
+
+test("coroutines", function()
+  local co = coroutine.create(function(a, b)
+    local c = coroutine.yield(a + b)
+    local d, e = coroutine.yield(c * 2)
+    return d + e
+  end)
+  local ok, v = coroutine.resume(co, 1, 2)
+  assert(ok and v == 3)
+  ok, v = coroutine.resume(co, 10)
+  assert(ok and v == 20)
+  ok, v = coroutine.resume(co, 4, 5)
+  assert(ok and v == 9 and coroutine.status(co) == "dead")
+  assert(not coroutine.resume(co))
+  local gen = coroutine.wrap(function() for i = 1, 3 do coroutine.yield(i) end end)
+  assert(gen() == 1 and gen() == 2 and gen() == 3)
+  local _, main = coroutine.running()
+  assert(main)
+  co = coroutine.create(function() error("oops") end)
+  ok, v = coroutine.resume(co)
+  assert(not ok and string.find(v, "oops"))
+end)
+
+test("gc", function()
+  local weak = setmetatable({}, {__mode = "k"})
+  weak[{}] = true
+  collectgarbage()
+  assert(next(weak) == nil)
+  local finalized = false
+  setmetatable({}, {__gc = function() finalized = true end})
+  collectgarbage()
+  assert(finalized)
+  assert(collectgarbage("count") > 0)
+end)
+
+test("load", function()
+  local f = load("return 1 + ...")
+  assert(f(2) == 3)
+  local env = {y = 5}
+  f = load("return y", "=chunk", "t", env)
+  assert(f() == 5)
+  local pieces = {"return ", "4", "2"}
+  local i = 0
+  f = load(function() i = i + 1; return pieces[i] end)
+  assert(f() == 42)
+  local ok, err = load("return +")
+  assert(ok == nil and type(err) == "string")
+  f = load(string.dump(function(x) return x * 2 end), "dumped", "b")
+  assert(f(21) == 42)
+  assert(load("return 1", "text", "b") == nil)
+end)
+
+test("math", function()
+  assert(math.floor(3.7) == 3 and math.ceil(3.2) == 4)
+  assert(math.type(math.floor(3.7)) == "integer")
+  assert(math.abs(math.mininteger) == math.mininteger)
+  assert(math.max(1, 5, 3) == 5 and math.min(4, 2) == 2)
+  assert(math.fmod(7, 3) == 1 and math.fmod(-7, 3) == -1)
+  assert(math.ult(1, -1))
+  assert(math.huge > math.maxinteger and -math.huge < math.mininteger)
+  assert(math.abs(math.sin(math.pi)) < 1e-15)
+  local nan = 0 / 0
+  assert(nan ~= nan)
+  local r = math.random(1, 10)
+  assert(r >= 1 and r <= 10)
+end)
+
+return tests
@@ -24,10 +24,12 @@ package lua
 import (
 	cryptorand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
+	"strings"
 
 	"zombiezen.com/go/lua/internal/lua54"
 )
@@ -80,53 +82,226 @@ func NewOpenBase(out io.Writer, loadfile Function) Function {
 		}
 
 		// Override print function.
-		l.PushClosure(0, func(l *State) (int, error) {
-			n := l.Top()
-			for i := 1; i <= n; i++ {
-				s, err := ToString(l, i)
-				if err != nil {
-					return 0, err
-				}
-				if i > 1 {
-					io.WriteString(out, "\t")
-				}
-				io.WriteString(out, s)
-			}
-			io.WriteString(out, "\n")
-			return 0, nil
-		})
+		l.PushClosure(0, newPrint(out))
 		l.RawSetField(-2, "print")
 
 		// Override loadfile and dofile if requested.
 		if loadfile != nil {
 			l.PushClosure(0, loadfile)
-			l.PushValue(-1) // extra copy for dofile upvalue
+			l.PushValue(-1)
 			l.RawSetField(-3, "loadfile")
+			if err := pushDofile(l); err != nil {
+				return 0, err
+			}
+			l.RawSetField(-2, "dofile")
+		}
 
-			l.PushClosure(1, func(l *State) (int, error) {
-				if tp := l.Type(1); tp != TypeNone && tp != TypeNil && tp != TypeString {
-					return 0, NewTypeError(l, 1, TypeString.String())
-				}
-				l.SetTop(1)
+		if !l.AllowBinaryChunks() {
+			if err := restrictBaseLibrary(l, -1); err != nil {
+				return 0, err
+			}
+		}
+		return 1, nil
+	}
+}
 
-				// loadfile(filename)
-				l.PushValue(UpvalueIndex(1))
-				l.Rotate(1, 1)
-				if err := l.Call(1, 1, 0); err != nil {
-					return 0, err
-				}
+// newPrint returns a print function that writes to out.
+func newPrint(out io.Writer) Function {
+	return func(l *State) (int, error) {
+		n := l.Top()
+		for i := 1; i <= n; i++ {
+			s, err := ToString(l, i)
+			if err != nil {
+				return 0, err
+			}
+			if i > 1 {
+				io.WriteString(out, "\t")
+			}
+			io.WriteString(out, s)
+		}
+		io.WriteString(out, "\n")
+		return 0, nil
+	}
+}
+
+// restrictedLibrariesKey is the registry key of a table
+// whose keys are the library tables
+// that have been changed to respect [State.SetAllowBinaryChunks].
+const restrictedLibrariesKey = "zombiezen.com/go/lua.restrictedLibraries"
+
+// restrictLoadedLibraries changes the basic and package libraries
+// in the loaded table to respect [State.SetAllowBinaryChunks].
+// The libraries only need to be changed once binary chunks are disallowed:
+// until then, their stock functions load binary chunks as usual.
+func restrictLoadedLibraries(l *State) error {
+	if !l.CheckStack(2) {
+		return errors.New("stack overflow")
+	}
+	if l.RawField(RegistryIndex, LoadedTable) != TypeTable {
+		l.Pop(1)
+		return nil
+	}
+	if l.RawField(-1, GName) == TypeTable {
+		if err := restrictBaseLibrary(l, -1); err != nil {
+			l.Pop(2)
+			return err
+		}
+	}
+	l.Pop(1)
+	if l.RawField(-1, PackageLibraryName) == TypeTable {
+		restrictPackageLibrary(l, -1)
+	}
+	l.Pop(2)
+	return nil
+}
 
-				// Call the loaded function.
-				if err := l.Call(0, MultipleReturns, 0); err != nil {
+// markRestricted records that the library table at idx
+// respects [State.SetAllowBinaryChunks].
+// It reports false if the table was already marked.
+func markRestricted(l *State, idx int) bool {
+	idx = l.AbsIndex(idx)
+	if !l.CheckStack(3) {
+		panic("stack overflow")
+	}
+	if l.RawField(RegistryIndex, restrictedLibrariesKey) != TypeTable {
+		l.Pop(1)
+		l.CreateTable(0, 2)
+		l.CreateTable(0, 1)
+		l.PushString("k")
+		l.RawSetField(-2, "__mode")
+		l.SetMetatable(-2)
+		l.PushValue(-1)
+		l.RawSetField(RegistryIndex, restrictedLibrariesKey)
+	}
+	l.PushValue(idx)
+	if l.RawGet(-2) != TypeNil {
+		l.Pop(2)
+		return false
+	}
+	l.Pop(1)
+	l.PushValue(idx)
+	l.PushBoolean(true)
+	l.RawSet(-3)
+	l.Pop(1)
+	return true
+}
+
+// restrictBaseLibrary replaces the load, loadfile, and dofile functions
+// in the basic library table at idx
+// with functions that respect [State.SetAllowBinaryChunks].
+func restrictBaseLibrary(l *State, idx int) error {
+	idx = l.AbsIndex(idx)
+	if !markRestricted(l, idx) {
+		return nil
+	}
+	if !l.CheckStack(2) {
+		return errors.New("stack overflow")
+	}
+	if l.RawField(idx, "load") == TypeFunction {
+		l.PushClosure(1, restrictLoadMode(3))
+		l.RawSetField(idx, "load")
+	} else {
+		l.Pop(1)
+	}
+
+	if l.RawField(idx, "loadfile") != TypeFunction {
+		// Without loadfile, dofile cannot be replaced,
+		// so remove it rather than leave the stock one.
+		l.Pop(1)
+		if l.RawField(idx, "dofile") != TypeNil {
+			l.PushNil()
+			l.RawSetField(idx, "dofile")
+		}
+		l.Pop(1)
+		return nil
+	}
+	l.PushClosure(1, restrictLoadMode(2))
+	l.PushValue(-1)
+	l.RawSetField(idx, "loadfile")
+	if err := pushDofile(l); err != nil {
+		return err
+	}
+	l.RawSetField(idx, "dofile")
+	return nil
+}
+
+// restrictPackageLibrary replaces the Lua searcher
+// in the package library table at idx
+// with one that respects [State.SetAllowBinaryChunks].
+// The stock searcher loads files with luaL_loadfilex,
+// which does not consult the state's setting.
+func restrictPackageLibrary(l *State, idx int) {
+	idx = l.AbsIndex(idx)
+	if !markRestricted(l, idx) {
+		return
+	}
+	if !l.CheckStack(2) {
+		panic("stack overflow")
+	}
+	if l.RawField(idx, "searchers") != TypeTable {
+		l.Pop(1)
+		return
+	}
+	l.PushValue(idx)
+	l.PushClosure(1, new(PackageLibrary).searchPath)
+	l.RawSetIndex(-2, 2)
+	l.Pop(1)
+}
+
+// restrictLoadMode returns a [Function] that calls its first upvalue,
+// a load function that takes a mode as its modeArg'th argument,
+// with "b" removed from the mode
+// if the state does not allow binary chunks.
+func restrictLoadMode(modeArg int) Function {
+	return func(l *State) (int, error) {
+		if !l.AllowBinaryChunks() {
+			mode := "bt"
+			if !l.IsNoneOrNil(modeArg) {
+				var err error
+				mode, err = CheckString(l, modeArg)
+				if err != nil {
 					return 0, err
 				}
-				return l.Top(), nil
-			})
-			l.RawSetField(-2, "dofile")
+			}
+			if l.Top() < modeArg {
+				l.SetTop(modeArg)
+			}
+			l.PushString(strings.ReplaceAll(mode, "b", ""))
+			l.Replace(modeArg)
 		}
+		n := l.Top()
+		l.PushValue(UpvalueIndex(1))
+		l.Rotate(1, 1)
+		if err := l.Call(n, MultipleReturns, 0); err != nil {
+			return 0, err
+		}
+		return l.Top(), nil
+	}
+}
 
-		return 1, nil
+// dofileSource is the implementation of dofile
+// used with a replaced loadfile.
+// It is written in Lua so that the loaded chunk can yield,
+// like the stock dofile.
+const dofileSource = `local loadfile = ...
+return function(filename)
+  local f, err = loadfile(filename)
+  if not f then error(err, 0) end
+  return f()
+end
+`
+
+// pushDofile replaces the loadfile function on the top of the stack
+// with a dofile function that loads files with it.
+func pushDofile(l *State) error {
+	if !l.CheckStack(2) {
+		return errors.New("stack overflow")
 	}
+	if err := l.LoadString(dofileSource, "=dofile", "t"); err != nil {
+		return err
+	}
+	l.Rotate(-2, 1)
+	return l.Call(1, 1, 0)
 }
 
 // OpenCoroutine loads the standard coroutine library.
@@ -294,6 +469,9 @@ func OpenPackage(l *State) (int, error) {
 	if err := l.Call(nArgs, MultipleReturns, 0); err != nil {
 		return 0, err
 	}
+	if !l.AllowBinaryChunks() && l.Type(1) == TypeTable {
+		restrictPackageLibrary(l, 1)
+	}
 	return l.Top(), nil
 }
 
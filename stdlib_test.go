@@ -25,6 +25,8 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -141,3 +143,111 @@ func TestMathLibrary(t *testing.T) {
 		}
 	})
 }
+
+func TestAllowBinaryChunks(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := state.LoadString("return 42", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	chunk := new(bytes.Buffer)
+	if _, err := state.Dump(chunk, false); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+	path := filepath.Join(t.TempDir(), "chunk.luac")
+	if err := os.WriteFile(path, chunk.Bytes(), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	state.PushString(chunk.String())
+	if err := state.SetGlobal("chunk", 0); err != nil {
+		t.Fatal(err)
+	}
+	state.PushString(path)
+	if err := state.SetGlobal("path", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "chunkmod.lua"), chunk.Bytes(), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	yieldPath := filepath.Join(filepath.Dir(path), "yield.lua")
+	if err := os.WriteFile(yieldPath, []byte("coroutine.yield(1)\nreturn 2\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	state.PushString(yieldPath)
+	if err := state.SetGlobal("yieldPath", 0); err != nil {
+		t.Fatal(err)
+	}
+	state.PushString(filepath.Join(filepath.Dir(path), "?.lua"))
+	if err := state.SetGlobal("modPath", 0); err != nil {
+		t.Fatal(err)
+	}
+	const yieldScript = `local co = coroutine.wrap(function() return dofile(yieldPath) end)
+return co() * 10 + co()`
+	checkYield := func(when string) {
+		t.Helper()
+		if err := state.LoadString(yieldScript, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Errorf("%s, dofile in coroutine: %v", when, err)
+		} else if got, _ := state.ToInteger(-1); got != 12 {
+			t.Errorf("%s, dofile in coroutine = %d; want 12", when, got)
+		}
+		state.SetTop(0)
+	}
+	checkYield("before SetAllowBinaryChunks(false)")
+
+	scripts := []string{
+		"return load(chunk)()",
+		"return loadfile(path)()",
+		"return dofile(path)",
+		"package.path = modPath; package.loaded.chunkmod = nil; return require('chunkmod')",
+	}
+	for _, script := range scripts {
+		if err := state.LoadString(script, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Errorf("before SetAllowBinaryChunks(false), %s: %v", script, err)
+		} else if got, _ := state.ToInteger(-1); got != 42 {
+			t.Errorf("before SetAllowBinaryChunks(false), %s = %d; want 42", script, got)
+		}
+		state.SetTop(0)
+	}
+
+	state.SetAllowBinaryChunks(false)
+	if state.AllowBinaryChunks() {
+		t.Error("AllowBinaryChunks() = true after SetAllowBinaryChunks(false)")
+	}
+	if err := state.LoadString(chunk.String(), "=(chunk)", "bt"); err == nil {
+		t.Error("LoadString(chunk, \"bt\") did not return an error")
+	}
+	state.SetTop(0)
+	if err := state.LoadBytecode(chunk.Bytes(), "=(chunk)"); err == nil {
+		t.Error("LoadBytecode(chunk) did not return an error")
+	}
+	state.SetTop(0)
+	if err := state.LoadString("return 42", "=(load)", "bt"); err != nil {
+		t.Error("LoadString(text, \"bt\"):", err)
+	}
+	state.SetTop(0)
+	for _, script := range scripts {
+		if err := state.LoadString(script, "=(load)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err == nil {
+			t.Errorf("after SetAllowBinaryChunks(false), %s did not raise an error", script)
+		}
+		state.SetTop(0)
+	}
+	checkYield("after SetAllowBinaryChunks(false)")
+}
@@ -23,6 +23,7 @@ package lua
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -80,10 +81,107 @@ func PushFile(l *State, f ReadWriteSeekCloser) error {
 	return nil
 }
 
+// SetStreamMethods adds the given functions as methods
+// of the Lua file objects created by this package,
+// including the files of the io library
+// and those pushed by [PushReader], [PushWriter], [PushPipe], and [PushFile].
+// A function with the same name as an existing method replaces that method.
+// Methods can use [StreamReader] and [StreamWriter]
+// to access the file passed as their first argument.
+func SetStreamMethods(l *State, methods map[string]Function) error {
+	if err := createStreamMetatable(l); err != nil {
+		return fmt.Errorf("lua: set stream methods: %v", err)
+	}
+	Metatable(l, streamMetatableName)
+	l.RawField(-1, "__index")
+	err := SetFuncs(l, 0, methods)
+	l.Pop(2)
+	if err != nil {
+		return fmt.Errorf("lua: set stream methods: %v", err)
+	}
+	return nil
+}
+
+// StreamReader returns a reader for the Lua file object at the given index.
+// Reads are served from the file's buffer,
+// so they are consistent with the file's read method.
+// StreamReader returns an error if the value is not a file
+// or the file cannot be read from.
+// Reading from the returned reader after the file has been closed
+// returns an error.
+func StreamReader(l *State, idx int) (io.Reader, error) {
+	s := testStream(l, idx)
+	if s == nil {
+		return nil, fmt.Errorf("lua: stream reader: %v is not a file", l.Type(idx))
+	}
+	if s.isClosed() {
+		return nil, errors.New("lua: stream reader: file is already closed")
+	}
+	if s.r == nil {
+		return nil, fmt.Errorf("lua: stream reader: %w", errors.ErrUnsupported)
+	}
+	return streamReader{s}, nil
+}
+
+// StreamWriter returns a writer for the Lua file object at the given index.
+// Writes go through the file's buffer (if any),
+// so they are consistent with the file's write method.
+// StreamWriter returns an error if the value is not a file
+// or the file cannot be written to.
+// Writing to the returned writer after the file has been closed
+// returns an error.
+func StreamWriter(l *State, idx int) (io.Writer, error) {
+	s := testStream(l, idx)
+	if s == nil {
+		return nil, fmt.Errorf("lua: stream writer: %v is not a file", l.Type(idx))
+	}
+	if s.isClosed() {
+		return nil, errors.New("lua: stream writer: file is already closed")
+	}
+	if s.w == nil {
+		return nil, fmt.Errorf("lua: stream writer: %w", errors.ErrUnsupported)
+	}
+	return streamWriter{s}, nil
+}
+
+// streamReader is the [io.Reader] returned by [StreamReader].
+type streamReader struct {
+	s *stream
+}
+
+func (sr streamReader) Read(p []byte) (int, error) {
+	if sr.s.isClosed() {
+		return 0, errors.New("file is already closed")
+	}
+	if err := sr.s.flush(); err != nil {
+		return 0, err
+	}
+	return sr.s.r.Read(p)
+}
+
+// streamWriter is the [io.Writer] returned by [StreamWriter].
+type streamWriter struct {
+	s *stream
+}
+
+func (sw streamWriter) Write(p []byte) (int, error) {
+	if sw.s.isClosed() {
+		return 0, errors.New("file is already closed")
+	}
+	n, err := sw.s.writer().Write(p)
+	if err != nil {
+		return n, err
+	}
+	if sw.s.lineBuffered && bytes.IndexByte(p[:n], '\n') >= 0 {
+		err = sw.s.flush()
+	}
+	return n, err
+}
+
 func pushStream(l *State, s *stream) {
 	l.NewUserdataUV(int(unsafe.Sizeof(uintptr(0))), 1)
 	SetMetatable(l, streamMetatableName)
-	setUintptr(l, -1, uintptr(cgo.NewHandle(s)))
+	setUintptr(l, -1, uintptr(l.state.NewHandle(s)))
 }
 
 func createStreamMetatable(l *State) error {
@@ -94,7 +192,7 @@ func createStreamMetatable(l *State) error {
 	err := SetFuncs(l, 0, map[string]Function{
 		"__index":     nil,
 		"__gc":        fgc,
-		"__close":     nil,
+		"__close":     fcloseMeta,
 		"__tostring":  ftostring,
 		"__metatable": nil, // prevent access to metatable
 	})
@@ -103,10 +201,6 @@ func createStreamMetatable(l *State) error {
 		return err
 	}
 
-	// Use same __gc function for __close.
-	l.RawField(-1, "__gc")
-	l.RawSetField(-2, "__close")
-
 	err = NewLib(l, map[string]Function{
 		"close":   fclose,
 		"flush":   fflush,
@@ -145,17 +239,28 @@ func ftostring(l *State) (int, error) {
 }
 
 func fgc(l *State) (int, error) {
-	s, err := toStream(l)
-	if err != nil {
-		return 0, err
+	if s := testStream(l, 1); s != nil {
+		s.Close()
+	}
+	if handle := cgo.Handle(unmarshalUintptr(TestUserdata(l, 1, streamMetatableName))); handle != 0 {
+		l.state.DeleteHandle(handle)
+		setUintptr(l, 1, 0)
+	}
+	return 0, nil
+}
+
+// fcloseMeta is the __close metamethod for streams.
+// Unlike __gc, it keeps the stream's handle
+// so that the closed file can still be inspected afterward.
+func fcloseMeta(l *State) (int, error) {
+	if s := testStream(l, 1); s != nil {
+		s.Close()
 	}
-	s.Close()
-	setUintptr(l, 1, 0)
 	return 0, nil
 }
 
 func fclose(l *State) (int, error) {
-	s, err := toStream(l)
+	s, err := toOpenStream(l)
 	if err != nil {
 		return 0, err
 	}
@@ -164,7 +269,7 @@ func fclose(l *State) (int, error) {
 }
 
 func fread(l *State) (int, error) {
-	s, err := toStream(l)
+	s, err := toOpenStream(l)
 	if err != nil {
 		return 0, err
 	}
@@ -172,7 +277,7 @@ func fread(l *State) (int, error) {
 }
 
 func fwrite(l *State) (int, error) {
-	s, err := toStream(l)
+	s, err := toOpenStream(l)
 	if err != nil {
 		return 0, err
 	}
@@ -181,7 +286,7 @@ func fwrite(l *State) (int, error) {
 }
 
 func fseek(l *State) (int, error) {
-	s, err := toStream(l)
+	s, err := toOpenStream(l)
 	if err != nil {
 		return 0, err
 	}
@@ -218,6 +323,9 @@ func fseek(l *State) (int, error) {
 	if s.seek == nil {
 		return pushFileResult(l, fmt.Errorf("seek: %w", errors.ErrUnsupported)), nil
 	}
+	if err := s.flush(); err != nil {
+		return pushFileResult(l, err), nil
+	}
 	pos, err := s.seek.Seek(offset, whence)
 	if err != nil {
 		return pushFileResult(l, err), nil
@@ -227,7 +335,7 @@ func fseek(l *State) (int, error) {
 }
 
 func flines(l *State) (int, error) {
-	if _, err := toStream(l); err != nil {
+	if _, err := toOpenStream(l); err != nil {
 		return 0, err
 	}
 	if err := pushLinesFunction(l, false); err != nil {
@@ -237,13 +345,31 @@ func flines(l *State) (int, error) {
 }
 
 func fflush(l *State) (int, error) {
-	l.PushBoolean(true)
-	return 1, nil
+	s, err := toOpenStream(l)
+	if err != nil {
+		return 0, err
+	}
+	return pushFileResult(l, s.flush()), nil
 }
 
 func fsetvbuf(l *State) (int, error) {
-	pushFail(l)
-	return 1, nil
+	s, err := toOpenStream(l)
+	if err != nil {
+		return 0, err
+	}
+	const modeArg = 2
+	mode, err := CheckString(l, modeArg)
+	if err != nil {
+		return 0, err
+	}
+	if mode != "no" && mode != "full" && mode != "line" {
+		return 0, NewArgError(l, modeArg, fmt.Sprintf("invalid option '%s'", mode))
+	}
+	size, err := OptInteger(l, 3, 0)
+	if err != nil {
+		return 0, err
+	}
+	return pushFileResult(l, s.setBuffering(mode, int(min(size, math.MaxInt32)))), nil
 }
 
 // registryStream gets the stream stored in the registry at the given key
@@ -271,6 +397,19 @@ func toStream(l *State) (*stream, error) {
 	return s, nil
 }
 
+// toOpenStream is like toStream,
+// but returns an error if the stream has been closed.
+func toOpenStream(l *State) (*stream, error) {
+	s, err := toStream(l)
+	if err != nil {
+		return nil, err
+	}
+	if s.isClosed() {
+		return nil, fmt.Errorf("%sattempt to use a closed file", Where(l, 1))
+	}
+	return s, nil
+}
+
 func testStream(l *State, idx int) *stream {
 	handle := cgo.Handle(unmarshalUintptr(TestUserdata(l, idx, streamMetatableName)))
 	if handle == 0 {
@@ -290,6 +429,13 @@ type stream struct {
 	w    io.Writer
 	seek io.Seeker
 	c    io.Closer
+
+	// wbuf buffers writes to w after a call to file:setvbuf.
+	// If wbuf is nil, writes go directly to w.
+	wbuf *bufio.Writer
+	// lineBuffered is true if wbuf is flushed after every write
+	// that contains a newline.
+	lineBuffered bool
 }
 
 func newStream(f io.Closer, read, write, seek bool) *stream {
@@ -356,6 +502,9 @@ func (s *stream) read(l *State, first int) (int, error) {
 	if s.r == nil {
 		return pushFileResult(l, fmt.Errorf("read: %w", errors.ErrUnsupported)), nil
 	}
+	if err := s.flush(); err != nil {
+		return pushFileResult(l, err), nil
+	}
 
 	nArgs := l.Top() - 1
 	if nArgs <= 0 {
@@ -374,8 +523,8 @@ func (s *stream) read(l *State, first int) (int, error) {
 	if !l.CheckStack(nArgs + 20) {
 		return 0, fmt.Errorf("%sstack overflow (too many arguments)", Where(l, 1))
 	}
-	var n int
-	for n = first; nArgs > 0; n, nArgs = n+1, nArgs-1 {
+	n := first
+	for ; nArgs > 0; n, nArgs = n+1, nArgs-1 {
 		if l.Type(n) == TypeNumber {
 			size, err := CheckInteger(l, n)
 			if err != nil {
@@ -386,8 +535,9 @@ func (s *stream) read(l *State, first int) (int, error) {
 			}
 			buf, err := s.readSlice(int(size))
 			if err == io.EOF {
+				// Stop at the first failed format.
 				pushFail(l)
-				break
+				return n + 1 - first, nil
 			}
 			if err != nil {
 				return pushFileResult(l, err), nil
@@ -406,13 +556,20 @@ func (s *stream) read(l *State, first int) (int, error) {
 		case "l", "L":
 			line, err := s.readLine(format == "l")
 			if err == io.EOF {
+				// Stop at the first failed format.
 				pushFail(l)
-				break
+				return n + 1 - first, nil
 			}
 			if err != nil {
 				return pushFileResult(l, err), nil
 			}
 			l.PushString(line)
+		case "n":
+			if !s.readNumber(l) {
+				// Stop at the first failed format.
+				pushFail(l)
+				return n + 1 - first, nil
+			}
 		case "a":
 			l.PushString(s.readAll())
 		default:
@@ -424,8 +581,18 @@ func (s *stream) read(l *State, first int) (int, error) {
 
 func (s *stream) readSlice(n int) ([]byte, error) {
 	if n == 0 {
-		_, err := s.r.Read(nil)
-		return nil, err
+		// Test for end of file.
+		if _, ok := s.r.(io.ByteScanner); !ok {
+			_, err := s.r.Read(nil)
+			return nil, err
+		}
+		if _, err := s.r.ReadByte(); err != nil {
+			return nil, err
+		}
+		if !s.unreadByte() {
+			return nil, errUnreadUnsupported
+		}
+		return nil, nil
 	}
 	buf := make([]byte, n)
 	n, err := s.r.Read(buf)
@@ -438,6 +605,112 @@ func (s *stream) readSlice(n int) ([]byte, error) {
 	return buf[:n], nil
 }
 
+// unreadByte attempts to unread the last byte read from s.r,
+// reporting whether it succeeded.
+func (s *stream) unreadByte() bool {
+	u, ok := s.r.(io.ByteScanner)
+	return ok && u.UnreadByte() == nil
+}
+
+// maxNumeralLength is the maximum length of a numeral read by the "n" format.
+const maxNumeralLength = 200
+
+// readNumber reads a numeral from s using the same rules as the Lua lexer
+// and pushes its value onto the stack.
+// If the input is not a valid numeral, then readNumber returns false
+// without pushing anything.
+// readNumber reads at most one byte past the numeral,
+// which it unreads if the stream's reader supports it.
+func (s *stream) readNumber(l *State) bool {
+	rn := &numeralReader{r: s.r}
+	rn.c = rn.getc()
+	for isSpaceASCII(rn.c) {
+		rn.c = rn.getc()
+	}
+	rn.test2("-+") // optional sign
+	count := 0
+	hex := false
+	if rn.test2("00") {
+		if rn.test2("xX") {
+			hex = true
+		} else {
+			// Count initial '0' as a valid digit.
+			count = 1
+		}
+	}
+	count += rn.readDigits(hex) // integral part
+	if rn.test2("..") {
+		count += rn.readDigits(hex) // fractional part
+	}
+	expMark := "eE"
+	if hex {
+		expMark = "pP"
+	}
+	if count > 0 && rn.test2(expMark) {
+		rn.test2("-+") // exponent sign
+		rn.readDigits(false)
+	}
+	if rn.c >= 0 {
+		s.unreadByte()
+	}
+	if rn.tooLong {
+		return false
+	}
+	return l.StringToNumber(rn.buf.String())
+}
+
+// numeralReader holds the state of [*stream.readNumber].
+type numeralReader struct {
+	r       io.ByteReader
+	c       int // look-ahead character or -1 at end of file
+	buf     strings.Builder
+	tooLong bool
+}
+
+func (rn *numeralReader) getc() int {
+	c, err := rn.r.ReadByte()
+	if err != nil {
+		return -1
+	}
+	return int(c)
+}
+
+// next adds the current character to the buffer and reads the next one.
+func (rn *numeralReader) next() bool {
+	if rn.buf.Len() >= maxNumeralLength {
+		rn.tooLong = true
+		return false
+	}
+	rn.buf.WriteByte(byte(rn.c))
+	rn.c = rn.getc()
+	return true
+}
+
+// test2 accepts the current character if it is one of the two bytes in set.
+func (rn *numeralReader) test2(set string) bool {
+	if rn.c == int(set[0]) || rn.c == int(set[1]) {
+		return rn.next()
+	}
+	return false
+}
+
+// readDigits reads a sequence of (hexadecimal) digits.
+func (rn *numeralReader) readDigits(hex bool) int {
+	count := 0
+	for rn.c >= 0 && (isDigitASCII(byte(rn.c)) || hex && isHexDigitASCII(byte(rn.c))) && rn.next() {
+		count++
+	}
+	return count
+}
+
+func isSpaceASCII(c int) bool {
+	return c == ' ' || '\t' <= c && c <= '\r'
+}
+
+func isHexDigitASCII(c byte) bool {
+	return isDigitASCII(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
 func (s *stream) readAll() string {
 	// TODO(someday): Add limits.
 	sb := new(strings.Builder)
@@ -473,16 +746,17 @@ func (s *stream) write(l *State, arg int) (int, error) {
 		return pushFileResult(l, fmt.Errorf("write: %w", errors.ErrUnsupported)), nil
 	}
 
+	w := s.writer()
 	nArgs := l.Top() - arg
 	for ; nArgs > 0; arg, nArgs = arg+1, nArgs-1 {
 		var werr error
 		if l.Type(arg) == TypeNumber {
 			if l.IsInteger(arg) {
 				n, _ := l.ToInteger(arg)
-				_, werr = fmt.Fprintf(s.w, "%d", n)
+				_, werr = fmt.Fprintf(w, "%d", n)
 			} else {
 				n, _ := l.ToNumber(arg)
-				_, werr = fmt.Fprintf(s.w, "%.14g", n)
+				_, werr = fmt.Fprintf(w, "%.14g", n)
 			}
 		} else {
 			var argString string
@@ -490,7 +764,10 @@ func (s *stream) write(l *State, arg int) (int, error) {
 			if err != nil {
 				return 0, err
 			}
-			_, werr = io.WriteString(s.w, argString)
+			_, werr = io.WriteString(w, argString)
+			if werr == nil && s.lineBuffered && strings.Contains(argString, "\n") {
+				werr = s.flush()
+			}
 		}
 		if werr != nil {
 			return pushFileResult(l, werr), nil
@@ -510,7 +787,10 @@ func pushLinesFunction(l *State, toClose bool) error {
 	if nArgs >= maxArgs {
 		return NewArgError(l, maxArgs+2, "too many arguments")
 	}
+	// Copy the stream handle below the arguments
+	// so that it becomes the first upvalue.
 	l.PushValue(1)
+	l.Insert(2)
 	l.PushClosure(nArgs+1, func(l *State) (int, error) {
 		s := testStream(l, UpvalueIndex(1))
 		if s == nil {
@@ -555,11 +835,48 @@ func (s *stream) isClosed() bool {
 	return s.c == nil
 }
 
+// writer returns the writer that writes to the stream should use.
+func (s *stream) writer() io.Writer {
+	if s.wbuf != nil {
+		return s.wbuf
+	}
+	return s.w
+}
+
+// flush writes any buffered data to the stream's underlying writer.
+func (s *stream) flush() error {
+	if s.wbuf == nil {
+		return nil
+	}
+	return s.wbuf.Flush()
+}
+
+// setBuffering changes the buffering mode for writes to the stream
+// as described for file:setvbuf.
+// Any buffered data is flushed first.
+// If size is not positive, a default buffer size is used.
+func (s *stream) setBuffering(mode string, size int) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if mode == "no" || s.w == nil {
+		s.wbuf = nil
+		s.lineBuffered = false
+		return nil
+	}
+	s.wbuf = bufio.NewWriterSize(s.w, size)
+	s.lineBuffered = mode == "line"
+	return nil
+}
+
 func (s *stream) Close() error {
 	if s.isClosed() {
 		return nil
 	}
-	err := s.c.Close()
+	err := s.flush()
+	if cerr := s.c.Close(); err == nil {
+		err = cerr
+	}
 	*s = stream{}
 	return err
 }
@@ -585,3 +902,14 @@ func (pr polyfillReader) Read(p []byte) (int, error) {
 func (pr polyfillReader) ReadByte() (byte, error) {
 	return pr.r.ReadByte()
 }
+
+func (pr polyfillReader) UnreadByte() error {
+	if s, ok := pr.r.(io.ByteScanner); ok {
+		return s.UnreadByte()
+	}
+	return errUnreadUnsupported
+}
+
+// errUnreadUnsupported is returned by UnreadByte methods
+// whose underlying reader does not support unreading.
+var errUnreadUnsupported = errors.New("unread byte not supported")
@@ -0,0 +1,238 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSetStreamMethods(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	err := SetStreamMethods(state, map[string]Function{
+		"readupper": func(l *State) (int, error) {
+			r, err := StreamReader(l, 1)
+			if err != nil {
+				return 0, err
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return 0, err
+			}
+			l.PushString(strings.ToUpper(string(b)))
+			return 1, nil
+		},
+		"writetwice": func(l *State) (int, error) {
+			w, err := StreamWriter(l, 1)
+			if err != nil {
+				return 0, err
+			}
+			s, err := CheckString(l, 2)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := io.WriteString(w, s+s); err != nil {
+				return 0, err
+			}
+			return 0, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PushReader(state, io.NopCloser(strings.NewReader("hello\nworld\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetGlobal("r", 0); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := PushWriter(state, nopWriteCloser{out}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetGlobal("w", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = "local first = r:read('l')\n" +
+		"w:writetwice('ab')\n" +
+		"return first, r:readupper()"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToString(1); got != "hello" {
+		t.Errorf("first = %q; want \"hello\"", got)
+	}
+	if got, _ := state.ToString(2); got != "WORLD\n" {
+		t.Errorf("r:readupper() = %q; want \"WORLD\\n\"", got)
+	}
+	if got := out.String(); got != "abab" {
+		t.Errorf("written = %q; want \"abab\"", got)
+	}
+
+	state.PushInteger(42)
+	if _, err := StreamReader(state, -1); err == nil {
+		t.Error("StreamReader(number) did not return an error")
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestStreamSeek(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+
+	if err := PushReader(state, nopReadSeekCloser{strings.NewReader("hello world")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetGlobal("f", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushReader(state, io.NopCloser(strings.NewReader("hello world"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetGlobal("pipe", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = "assert(f:seek() == 0)\n" +
+		"assert(f:read(5) == 'hello')\n" +
+		"assert(f:seek() == 5)\n" +
+		"assert(f:seek('cur', 1) == 6)\n" +
+		"assert(f:read('a') == 'world')\n" +
+		"assert(f:seek('set', 4) == 4)\n" +
+		"assert(f:read(1) == 'o')\n" +
+		"assert(f:seek('end') == 11)\n" +
+		"assert(f:seek('end', -5) == 6)\n" +
+		"assert(f:read(1) == 'w')\n" +
+		"assert(f:seek('set') == 0)\n" +
+		"assert(not pcall(f.seek, f, 'bad'))\n" +
+		"assert(not pcall(f.seek, f, 'set', 'x'))\n" +
+		"local pos, msg = pipe:seek('set', 0)\n" +
+		"assert(pos == nil, 'seek on pipe succeeded')\n" +
+		"assert(type(msg) == 'string', 'seek on pipe did not return message')\n" +
+		"assert(pipe:read('a') == 'hello world')\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type nopReadSeekCloser struct {
+	*strings.Reader
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+func TestStreamSetvbuf(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.Pop(1)
+
+	out := new(bytes.Buffer)
+	if err := PushWriter(state, nopWriteCloser{out}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetGlobal("f", 0); err != nil {
+		t.Fatal(err)
+	}
+	state.PushClosure(0, func(l *State) (int, error) {
+		want, err := CheckString(l, 1)
+		if err != nil {
+			return 0, err
+		}
+		l.PushBoolean(out.String() == want)
+		l.PushString(out.String())
+		return 2, nil
+	})
+	if err := state.SetGlobal("written", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = "local function check(want)\n" +
+		"  local ok, got = written(want)\n" +
+		"  if not ok then error('written = ' .. got .. '; want ' .. want, 2) end\n" +
+		"end\n" +
+		"assert(f:write('a'))\n" +
+		"check('a')\n" +
+		"assert(f:setvbuf('full'))\n" +
+		"assert(f:write('b\\n'))\n" +
+		"check('a')\n" +
+		"assert(f:flush())\n" +
+		"check('ab\\n')\n" +
+		"assert(f:setvbuf('line', 1024))\n" +
+		"assert(f:write('c'))\n" +
+		"check('ab\\n')\n" +
+		"assert(f:write('d\\ne'))\n" +
+		"check('ab\\ncd\\ne')\n" +
+		"assert(f:write('f'))\n" +
+		"check('ab\\ncd\\ne')\n" +
+		"assert(f:setvbuf('no'))\n" +
+		"check('ab\\ncd\\nef')\n" +
+		"assert(f:write('g'))\n" +
+		"check('ab\\ncd\\nefg')\n" +
+		"assert(f:setvbuf('full', 16))\n" +
+		"assert(f:write('h'))\n" +
+		"assert(not pcall(f.setvbuf, f, 'bad'))\n" +
+		"check('ab\\ncd\\nefg')\n" +
+		"assert(f:close())\n" +
+		"check('ab\\ncd\\nefgh')\n"
+	if err := state.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
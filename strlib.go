@@ -0,0 +1,750 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// StringLibrary is an implementation of the standard Lua "string" library
+// whose pattern matching, formatting, and packing functions
+// (string.find, string.match, string.gmatch, string.gsub,
+// string.format, string.pack, string.packsize, and string.unpack)
+// are written in Go.
+// The remaining functions are the same as [OpenString].
+// The zero value of StringLibrary behaves like the standard library.
+type StringLibrary struct {
+	// MaxMatchSteps limits the amount of work
+	// that a single pattern match can perform
+	// (roughly the number of characters compared).
+	// A match that exceeds the limit raises a "pattern too complex" error.
+	// If MaxMatchSteps is zero or negative, matches are not limited.
+	MaxMatchSteps int
+	// MaxMatchDepth limits the recursion depth of a pattern match.
+	// If MaxMatchDepth is zero or negative, the limit is 200,
+	// the same as the standard library.
+	MaxMatchDepth int
+	// DisableQuotedFormat makes string.format raise an error
+	// for the %q specifier.
+	DisableQuotedFormat bool
+	// DisablePack removes string.pack, string.packsize, and string.unpack
+	// from the library.
+	DisablePack bool
+}
+
+// OpenLibrary loads the standard string library.
+// This method is intended to be used as an argument to [Require].
+func (lib *StringLibrary) OpenLibrary(l *State) (int, error) {
+	if _, err := OpenString(l); err != nil {
+		return 0, err
+	}
+	funcs := map[string]Function{
+		"find":   lib.find,
+		"format": lib.format,
+		"gmatch": lib.gmatch,
+		"gsub":   lib.gsub,
+		"match":  lib.match,
+	}
+	if lib.DisablePack {
+		funcs["pack"] = nil
+		funcs["packsize"] = nil
+		funcs["unpack"] = nil
+	} else {
+		funcs["pack"] = strPack
+		funcs["packsize"] = strPackSize
+		funcs["unpack"] = strUnpack
+	}
+	for name, f := range funcs {
+		if f == nil {
+			l.PushNil()
+		} else {
+			l.PushClosure(0, f)
+		}
+		l.RawSetField(-2, name)
+	}
+	return 1, nil
+}
+
+func (lib *StringLibrary) newMatchState(src, pat string) *matchState {
+	return newMatchState(src, pat, lib.MaxMatchDepth, lib.MaxMatchSteps)
+}
+
+// posRelative translates a relative initial string position
+// (negative means back from end) to an absolute position
+// clipped to [1, inf).
+func posRelative(pos int64, n int) int64 {
+	switch {
+	case pos > 0:
+		return pos
+	case pos == 0:
+		return 1
+	case pos < -int64(n):
+		return 1
+	default:
+		return int64(n) + pos + 1
+	}
+}
+
+func (lib *StringLibrary) find(l *State) (int, error) {
+	return lib.findAux(l, true)
+}
+
+func (lib *StringLibrary) match(l *State) (int, error) {
+	return lib.findAux(l, false)
+}
+
+func (lib *StringLibrary) findAux(l *State, find bool) (nResults int, err error) {
+	s, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	p, err := CheckString(l, 2)
+	if err != nil {
+		return 0, err
+	}
+	initPos, err := OptInteger(l, 3, 1)
+	if err != nil {
+		return 0, err
+	}
+	init := posRelative(initPos, len(s)) - 1
+	if init > int64(len(s)) {
+		// Start after string's end: cannot find anything.
+		pushFail(l)
+		return 1, nil
+	}
+
+	if find && (l.ToBoolean(4) || !hasPatternSpecials(p)) {
+		// Do a plain search.
+		if i := strings.Index(s[init:], p); i >= 0 {
+			l.PushInteger(init + int64(i) + 1)
+			l.PushInteger(init + int64(i) + int64(len(p)))
+			return 2, nil
+		}
+		pushFail(l)
+		return 1, nil
+	}
+
+	defer catchPatternError(&err)
+	anchor := strings.HasPrefix(p, "^")
+	if anchor {
+		p = p[1:]
+	}
+	ms := lib.newMatchState(s, p)
+	for s1 := int(init); ; s1++ {
+		ms.reset()
+		if e := ms.match(s1, 0); e >= 0 {
+			if find {
+				l.PushInteger(int64(s1) + 1)
+				l.PushInteger(int64(e))
+				return ms.pushCaptures(l, -1, -1, false) + 2, nil
+			}
+			return ms.pushCaptures(l, s1, e, true), nil
+		}
+		if s1 >= len(s) || anchor {
+			break
+		}
+	}
+	pushFail(l)
+	return 1, nil
+}
+
+func (lib *StringLibrary) gmatch(l *State) (int, error) {
+	s, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	p, err := CheckString(l, 2)
+	if err != nil {
+		return 0, err
+	}
+	initPos, err := OptInteger(l, 3, 1)
+	if err != nil {
+		return 0, err
+	}
+	init := posRelative(initPos, len(s)) - 1
+	if init > int64(len(s)) {
+		// Start after string's end.
+		init = int64(len(s)) + 1
+	}
+
+	src := int(init)
+	lastMatch := -1
+	l.PushClosure(0, func(l *State) (nResults int, err error) {
+		defer catchPatternError(&err)
+		ms := lib.newMatchState(s, p)
+		for ; src <= len(s); src++ {
+			ms.reset()
+			if e := ms.match(src, 0); e >= 0 && e != lastMatch {
+				start := src
+				src, lastMatch = e, e
+				return ms.pushCaptures(l, start, e, true), nil
+			}
+		}
+		return 0, nil
+	})
+	return 1, nil
+}
+
+func (lib *StringLibrary) gsub(l *State) (nResults int, err error) {
+	src, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	p, err := CheckString(l, 2)
+	if err != nil {
+		return 0, err
+	}
+	tr := l.Type(3)
+	maxN, err := OptInteger(l, 4, int64(len(src))+1)
+	if err != nil {
+		return 0, err
+	}
+	if tr != TypeNumber && tr != TypeString && tr != TypeFunction && tr != TypeTable {
+		return 0, NewTypeError(l, 3, "string/function/table")
+	}
+
+	defer catchPatternError(&err)
+	anchor := strings.HasPrefix(p, "^")
+	if anchor {
+		p = p[1:]
+	}
+	ms := lib.newMatchState(src, p)
+	b := new(strings.Builder)
+	changed := false
+	n := int64(0)
+	pos := 0
+	lastMatch := -1
+	for n < maxN {
+		ms.reset()
+		if e := ms.match(pos, 0); e >= 0 && e != lastMatch {
+			n++
+			c, err := lib.addValue(l, ms, b, pos, e, tr)
+			if err != nil {
+				return 0, err
+			}
+			changed = changed || c
+			pos, lastMatch = e, e
+		} else if pos < len(src) {
+			// Otherwise, skip one character.
+			b.WriteByte(src[pos])
+			pos++
+		} else {
+			// End of subject.
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	if !changed {
+		l.PushValue(1)
+	} else {
+		b.WriteString(src[pos:])
+		l.PushString(b.String())
+	}
+	l.PushInteger(n)
+	return 2, nil
+}
+
+// addValue adds the replacement value for the match src[s:e] to b.
+// It reports whether the original string was changed.
+// (Function calls and table indexing resulting in nil or false
+// do not change the subject.)
+func (lib *StringLibrary) addValue(l *State, ms *matchState, b *strings.Builder, s, e int, tr Type) (bool, error) {
+	switch tr {
+	case TypeFunction:
+		l.PushValue(3)
+		n := ms.pushCaptures(l, s, e, true)
+		if err := l.Call(n, 1, 0); err != nil {
+			return false, err
+		}
+	case TypeTable:
+		ms.pushCapture(l, 0, s, e)
+		if _, err := l.Table(3, 0); err != nil {
+			return false, err
+		}
+	default:
+		addReplacement(l, ms, b, s, e)
+		return true, nil
+	}
+	if !l.ToBoolean(-1) {
+		l.Pop(1)
+		b.WriteString(ms.src[s:e])
+		return false, nil
+	}
+	if !l.IsString(-1) {
+		tp := l.Type(-1)
+		l.Pop(1)
+		return false, luaErrorf("invalid replacement value (a %v)", tp)
+	}
+	repl, _ := l.ToString(-1)
+	l.Pop(1)
+	b.WriteString(repl)
+	return true, nil
+}
+
+// addReplacement adds the string replacement (argument 3 of gsub)
+// for the match src[s:e] to b, expanding capture references.
+func addReplacement(l *State, ms *matchState, b *strings.Builder, s, e int) {
+	news, _ := l.ToString(3)
+	for {
+		i := strings.IndexByte(news, '%')
+		if i < 0 {
+			break
+		}
+		b.WriteString(news[:i])
+		var c byte
+		if i+1 < len(news) {
+			c = news[i+1]
+		}
+		switch {
+		case c == '%':
+			b.WriteByte('%')
+		case c == '0':
+			b.WriteString(ms.src[s:e])
+		case '1' <= c && c <= '9':
+			str, pos, isPos := ms.captureValue(int(c-'1'), s, e)
+			if isPos {
+				b.WriteString(strconv.FormatInt(pos, 10))
+			} else {
+				b.WriteString(str)
+			}
+		default:
+			raisePattern("invalid use of '%%' in replacement string")
+		}
+		news = news[min(i+2, len(news)):]
+	}
+	b.WriteString(news)
+}
+
+// Valid flags in a format specification.
+const (
+	formatFlagsFloat    = "-+#0 "
+	formatFlagsHex      = "-#0"
+	formatFlagsInt      = "-+0 "
+	formatFlagsUnsigned = "-0"
+	formatFlagsChar     = "-"
+)
+
+// maxFormat is the maximum size of each format specification (such as "%-099.99d").
+const maxFormat = 32
+
+func (lib *StringLibrary) format(l *State) (int, error) {
+	top := l.Top()
+	arg := 1
+	strfrmt, err := CheckString(l, arg)
+	if err != nil {
+		return 0, err
+	}
+	b := new(strings.Builder)
+	for i := 0; i < len(strfrmt); {
+		if strfrmt[i] != '%' {
+			b.WriteByte(strfrmt[i])
+			i++
+			continue
+		}
+		i++
+		if i < len(strfrmt) && strfrmt[i] == '%' {
+			b.WriteByte('%')
+			i++
+			continue
+		}
+
+		// Format item.
+		arg++
+		if arg > top {
+			return 0, NewArgError(l, arg, "no value")
+		}
+		n := 0
+		for i+n < len(strfrmt) && strings.IndexByte(formatFlagsFloat+"123456789.", strfrmt[i+n]) >= 0 {
+			n++
+		}
+		n++ // Add following character (should be the specifier).
+		if n >= maxFormat-10 {
+			return 0, luaErrorf("invalid format (too long)")
+		}
+		form := "%" + strfrmt[i:min(i+n, len(strfrmt))]
+		i += n
+		var conv byte
+		if len(form) > 1 {
+			conv = form[len(form)-1]
+		}
+
+		switch conv {
+		case 'c':
+			if err := checkFormat(form, formatFlagsChar, false); err != nil {
+				return 0, err
+			}
+			c, err := CheckInteger(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			spec := parseFormatSpec(form)
+			b.WriteString(spec.pad(string([]byte{byte(c)})))
+		case 'd', 'i', 'u', 'o', 'x', 'X':
+			c, err := CheckInteger(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			flags := formatFlagsInt
+			switch conv {
+			case 'u':
+				flags = formatFlagsUnsigned
+			case 'o', 'x', 'X':
+				flags = formatFlagsHex
+			}
+			if err := checkFormat(form, flags, true); err != nil {
+				return 0, err
+			}
+			b.WriteString(formatInteger(form, c))
+		case 'a', 'A':
+			if err := checkFormat(form, formatFlagsFloat, true); err != nil {
+				return 0, err
+			}
+			f, err := CheckNumber(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			b.WriteString(formatHexFloat(parseFormatSpec(form), f))
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			f, err := CheckNumber(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			if err := checkFormat(form, formatFlagsFloat, true); err != nil {
+				return 0, err
+			}
+			b.WriteString(formatFloat(parseFormatSpec(form), f))
+		case 'p':
+			if err := checkFormat(form, formatFlagsChar, false); err != nil {
+				return 0, err
+			}
+			spec := parseFormatSpec(form)
+			if p := l.ToPointer(arg); p == 0 {
+				b.WriteString(spec.pad("(null)"))
+			} else {
+				b.WriteString(spec.pad(fmt.Sprintf("%#x", p)))
+			}
+		case 'q':
+			if lib.DisableQuotedFormat {
+				return 0, luaErrorf("format '%%q' is disabled")
+			}
+			if len(form) > 2 {
+				return 0, luaErrorf("specifier '%%q' cannot have modifiers")
+			}
+			if err := addLiteral(l, b, arg); err != nil {
+				return 0, err
+			}
+		case 's':
+			s, err := ToString(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			if len(form) == 2 {
+				// No modifiers: keep entire string.
+				b.WriteString(s)
+				break
+			}
+			if strings.IndexByte(s, 0) >= 0 {
+				return 0, NewArgError(l, arg, "string contains zeros")
+			}
+			if err := checkFormat(form, formatFlagsChar, true); err != nil {
+				return 0, err
+			}
+			spec := parseFormatSpec(form)
+			if !spec.hasPrecision && len(s) >= 100 {
+				// No precision and string is too long to be formatted.
+				b.WriteString(s)
+				break
+			}
+			if spec.hasPrecision && spec.precision < len(s) {
+				s = s[:spec.precision]
+			}
+			b.WriteString(spec.pad(s))
+		default:
+			return 0, luaErrorf("invalid conversion '%s' to 'format'", form)
+		}
+	}
+	l.PushString(b.String())
+	return 1, nil
+}
+
+// checkFormat checks whether a conversion specification is valid.
+// form must start with '%' and end with a conversion specifier.
+// flags are the accepted flags;
+// precision signals whether to accept a precision.
+func checkFormat(form string, flags string, precision bool) error {
+	spec := form[1:]
+	for len(spec) > 0 && strings.IndexByte(flags, spec[0]) >= 0 {
+		spec = spec[1:]
+	}
+	if !strings.HasPrefix(spec, "0") {
+		// A width cannot start with '0'.
+		spec = skip2Digits(spec)
+		if strings.HasPrefix(spec, ".") && precision {
+			spec = skip2Digits(spec[1:])
+		}
+	}
+	if len(spec) == 0 || !isAlphaASCII(spec[0]) {
+		return luaErrorf("invalid conversion specification: '%s'", form)
+	}
+	return nil
+}
+
+func skip2Digits(s string) string {
+	for i := 0; i < 2 && len(s) > 0 && '0' <= s[0] && s[0] <= '9'; i++ {
+		s = s[1:]
+	}
+	return s
+}
+
+// formatSpec is a parsed conversion specification
+// that has been validated by [checkFormat].
+type formatSpec struct {
+	flags        string
+	width        int
+	hasPrecision bool
+	precision    int
+	conv         byte
+}
+
+func parseFormatSpec(form string) formatSpec {
+	spec := formatSpec{conv: form[len(form)-1]}
+	s := form[1 : len(form)-1]
+	i := 0
+	for i < len(s) && strings.IndexByte(formatFlagsFloat, s[i]) >= 0 {
+		i++
+	}
+	spec.flags, s = s[:i], s[i:]
+	for len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+		spec.width = spec.width*10 + int(s[0]-'0')
+		s = s[1:]
+	}
+	if strings.HasPrefix(s, ".") {
+		spec.hasPrecision = true
+		for s = s[1:]; len(s) > 0 && '0' <= s[0] && s[0] <= '9'; s = s[1:] {
+			spec.precision = spec.precision*10 + int(s[0]-'0')
+		}
+	}
+	return spec
+}
+
+func (spec formatSpec) has(flag byte) bool {
+	return strings.IndexByte(spec.flags, flag) >= 0
+}
+
+// pad pads s with spaces to the spec's width.
+func (spec formatSpec) pad(s string) string {
+	if len(s) >= spec.width {
+		return s
+	}
+	padding := strings.Repeat(" ", spec.width-len(s))
+	if spec.has('-') {
+		return s + padding
+	}
+	return padding + s
+}
+
+// padNumber pads a formatted number to the spec's width,
+// inserting zeros after the sign and prefix if the '0' flag is given.
+func (spec formatSpec) padNumber(sign, prefix, digits string) string {
+	n := len(sign) + len(prefix) + len(digits)
+	if n >= spec.width {
+		return sign + prefix + digits
+	}
+	if spec.has('0') && !spec.has('-') {
+		return sign + prefix + strings.Repeat("0", spec.width-n) + digits
+	}
+	return spec.pad(sign + prefix + digits)
+}
+
+func formatInteger(form string, n int64) string {
+	spec := parseFormatSpec(form)
+	switch spec.conv {
+	case 'd', 'i':
+		return fmt.Sprintf(strings.TrimSuffix(form, string(spec.conv))+"d", n)
+	case 'u':
+		return fmt.Sprintf(strings.TrimSuffix(form, "u")+"d", uint64(n))
+	default:
+		if n == 0 && spec.has('#') {
+			// C does not add a prefix to zero.
+			form = strings.Replace(form, "#", "", 1)
+		}
+		return fmt.Sprintf(form, uint64(n))
+	}
+}
+
+func formatFloat(spec formatSpec, f float64) string {
+	upper := spec.conv == 'E' || spec.conv == 'F' || spec.conv == 'G'
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return spec.pad(formatNonFinite(spec, f, upper))
+	}
+	prec := 6
+	if spec.hasPrecision {
+		prec = spec.precision
+	}
+	verb := spec.conv
+	if verb == 'F' {
+		verb = 'f'
+	}
+	goFormat := "%" + spec.flags
+	if spec.width > 0 {
+		goFormat += strconv.Itoa(spec.width)
+	}
+	goFormat += "." + strconv.Itoa(prec) + string(verb)
+	return fmt.Sprintf(goFormat, f)
+}
+
+// formatNonFinite formats an infinity or NaN like C printf.
+func formatNonFinite(spec formatSpec, f float64, upper bool) string {
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = "inf"
+	}
+	if upper {
+		s = strings.ToUpper(s)
+	}
+	switch {
+	case math.Signbit(f):
+		s = "-" + s
+	case spec.has('+'):
+		s = "+" + s
+	case spec.has(' '):
+		s = " " + s
+	}
+	return s
+}
+
+// formatHexFloat formats f like C printf's %a conversion.
+func formatHexFloat(spec formatSpec, f float64) string {
+	upper := spec.conv == 'A'
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return spec.pad(formatNonFinite(spec, f, upper))
+	}
+	prec := -1
+	if spec.hasPrecision {
+		prec = spec.precision
+	}
+	var sign string
+	switch {
+	case math.Signbit(f):
+		sign = "-"
+		f = -f
+	case spec.has('+'):
+		sign = "+"
+	case spec.has(' '):
+		sign = " "
+	}
+	s := hexFloat(f, prec)
+	if spec.has('#') && !strings.Contains(s, ".") {
+		s = strings.Replace(s, "p", ".p", 1)
+	}
+	s = strings.TrimPrefix(s, "0x")
+	prefix := "0x"
+	if upper {
+		prefix = "0X"
+		s = strings.ToUpper(s)
+	}
+	return spec.padNumber(sign, prefix, s)
+}
+
+// hexFloat formats a non-negative finite f in hexadecimal
+// with a single-digit exponent where possible (like C) instead of Go's two digits.
+func hexFloat(f float64, prec int) string {
+	s := strconv.FormatFloat(f, 'x', prec, 64)
+	mant, exp, _ := strings.Cut(s, "p")
+	expSign, expDigits := exp[:1], strings.TrimLeft(exp[1:], "0")
+	if expDigits == "" {
+		expDigits = "0"
+	}
+	return mant + "p" + expSign + expDigits
+}
+
+// addLiteral adds the value at arg to b in a form
+// that can be read back by Lua (string.format's %q).
+func addLiteral(l *State, b *strings.Builder, arg int) error {
+	switch l.Type(arg) {
+	case TypeString:
+		s, _ := l.ToString(arg)
+		addQuoted(b, s)
+	case TypeNumber:
+		if !l.IsInteger(arg) {
+			f, _ := l.ToNumber(arg)
+			switch {
+			case math.IsInf(f, 1):
+				b.WriteString("1e9999")
+			case math.IsInf(f, -1):
+				b.WriteString("-1e9999")
+			case math.IsNaN(f):
+				b.WriteString("(0/0)")
+			case math.Signbit(f):
+				b.WriteString("-" + hexFloat(-f, -1))
+			default:
+				b.WriteString(hexFloat(f, -1))
+			}
+			break
+		}
+		n, _ := l.ToInteger(arg)
+		if n == math.MinInt64 {
+			// Corner case: use hex.
+			b.WriteString("0x8000000000000000")
+		} else {
+			b.WriteString(strconv.FormatInt(n, 10))
+		}
+	case TypeNil, TypeBoolean:
+		s, err := ToString(l, arg)
+		if err != nil {
+			return err
+		}
+		b.WriteString(s)
+	default:
+		return NewArgError(l, arg, "value has no literal form")
+	}
+	return nil
+}
+
+func addQuoted(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\' || c == '\n':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			if i+1 < len(s) && '0' <= s[i+1] && s[i+1] <= '9' {
+				fmt.Fprintf(b, "\\%03d", c)
+			} else {
+				fmt.Fprintf(b, "\\%d", c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+}
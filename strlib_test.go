@@ -0,0 +1,327 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+// stringLibraryTests are Lua expressions whose results
+// must be the same between the C and Go string libraries.
+var stringLibraryTests = []string{
+	`string.find("hello world", "wor")`,
+	`string.find("hello world", "o", 6)`,
+	`string.find("hello world", "o", -3)`,
+	`string.find("hello world", "l+")`,
+	`string.find("hello world", "(h)(e)")`,
+	`string.find("hello world", "()ll()")`,
+	`string.find("a.b", ".", 1, true)`,
+	`string.find("abc", "", 10)`,
+	`string.find("abc", "", 4)`,
+	`string.find("abc", "^b")`,
+	`string.find("abc", "[")`,
+	`string.find("abc", "%")`,
+	`string.find("abc", "(()")`,
+	`string.match("key = value", "(%w+)%s*=%s*(%w+)")`,
+	`string.match("  trim  ", "^%s*(.-)%s*$")`,
+	`string.match("THE (quick) fox", "%((%a+)%)")`,
+	`string.match("f(a(b)c)d", "%b()")`,
+	`string.match("THE (quick) fox", "%f[%a]%a+", 5)`,
+	`string.match("hello", "(h)(.)%2")`,
+	`string.match("helle", "(h)(e)ll%2")`,
+	`string.match("[[x]]", "[%[%]]+")`,
+	`string.match("abc123", "[^%d]+")`,
+	`string.match("abc123", "[a-b]*")`,
+	`string.match("x = 10", "()=()")`,
+	`string.match("aaa", "a-b")`,
+	`string.match("aaab", "a-b")`,
+	`string.match("aaa", "a?a?a?a")`,
+	`string.match("hello", "%1")`,
+	`string.match("hello", "(%1)")`,
+	`string.match("hello", "%bx")`,
+	`string.match("hello", "%f")`,
+	`string.match("hello", "[a")`,
+	`string.match("hello", "[a-")`,
+	`string.match("hello", "%z")`,
+	`string.match("h\0llo", "%z")`,
+	`string.match("hello", ")")`,
+	`(function() local t = {} for k, v in string.gmatch("a=1, b=2", "(%w+)=(%w+)") do t[#t+1] = k .. v end return table.concat(t, ",") end)()`,
+	`(function() local t = {} for w in string.gmatch("one two  three", "%a+") do t[#t+1] = w end return table.concat(t, ",") end)()`,
+	`(function() local t = {} for w in string.gmatch("abc", "") do t[#t+1] = "[" .. w .. "]" end return table.concat(t) end)()`,
+	`(function() local t = {} for w in string.gmatch("abcabc", "b", 3) do t[#t+1] = w end return #t end)()`,
+	`(function() local t = {} for w in string.gmatch("abc", "()") do t[#t+1] = w end return table.concat(t, ",") end)()`,
+	`string.gsub("hello world", "o", "0")`,
+	`string.gsub("hello world", "o", "0", 1)`,
+	`string.gsub("hello world", "(%w+)", "<%1>")`,
+	`string.gsub("hello world", "%w+", "%0 %0")`,
+	`string.gsub("hello", "", "-")`,
+	`string.gsub("abc", "%w", "%%")`,
+	`string.gsub("abc", "%w", "%2")`,
+	`string.gsub("abc", "%w", "%x")`,
+	`string.gsub("abc", "^a", "x")`,
+	`string.gsub("abc", "b*", "-")`,
+	`string.gsub("$name is $age", "%$(%w+)", {name = "Bob", age = 42})`,
+	`string.gsub("$name is $x", "%$(%w+)", {name = "Bob"})`,
+	`string.gsub("hello world", "%w+", function(w) return w:upper() end)`,
+	`string.gsub("hello world", "%w+", function(w) return nil end)`,
+	`string.gsub("hello world", "%w+", function(w) return {} end)`,
+	`string.gsub("hello", "l", true)`,
+	`string.gsub("abc", "()", "%1")`,
+	`string.format("%d %5d %-5d| %05d %+d % d %.3d", 42, 42, 42, 42, 42, 42, 42)`,
+	`string.format("%i %u %o %#o %x %X %#x %#X %#x", -7, 3, 8, 8, 255, 255, 255, 255, 0)`,
+	`string.format("%5.2f %e %E %g %G %.3g %10.4f|%-10.2e|", 3.14159, 12345.678, 0.00012, 100000, 1e20, 2/3, -1.5, 1.5)`,
+	`string.format("%g %g %g %f %e", 1/0, -1/0, 0/0 ~= 0/0 and 1 or 0, 1/0, -1/0)`,
+	`string.format("%a %A %a %a %.3a", 1.0, 255.5, 0.0, -0.1, 1/3)`,
+	`string.format("%c%c%c", 76, 117, 97)`,
+	`string.format("%5c|%-5c|", 65, 66)`,
+	`string.format("%s %10s %-10s| %.2s %5.1s", "x", "right", "left", "truncate", "abc")`,
+	`string.format("%s %s %s", 1, 1.5, true)`,
+	`string.format("%s", setmetatable({}, {__tostring = function() return "custom" end}))`,
+	`string.format("%q", 'a "quoted"\n\\ string\0with\1control\0012')`,
+	`string.format("%q", 42)`,
+	`string.format("%q", math.mininteger)`,
+	`string.format("%q", 1.5)`,
+	`string.format("%q", 1/0)`,
+	`string.format("%q", -1/0)`,
+	`string.format("%q", 0/0)`,
+	`string.format("%q %q %q", nil, true, false)`,
+	`string.format("%q", {})`,
+	`string.format("%10q", "x")`,
+	`string.format("%%")`,
+	`string.format("%d")`,
+	`string.format("%d", 1.5)`,
+	`string.format("%d", "x")`,
+	`string.format("%y", 1)`,
+	`string.format("%010s", "x")`,
+	`string.format("%123d", 1)`,
+	`string.format("%.123d", 1)`,
+	`string.format("%#d", 1)`,
+	`string.format("%0000000000000000000000000000000d", 1)`,
+	`string.format("%10s", "a\0b")`,
+	`string.format("%s", "a\0b")`,
+	`string.format("%s", string.rep("x", 120))`,
+	`string.format("%.3s", string.rep("x", 120))`,
+	`string.format("%", 1)`,
+	`string.pack("i4", 100)`,
+	`string.pack(">i4", -2)`,
+	`string.pack("<I2 >I2 =I2", 1, 2, 3)`,
+	`string.pack("bBhHlLjJT", -1, 255, -300, 60000, -5, 5, -6, 6, 7)`,
+	`string.pack("i16", -3)`,
+	`string.pack("I16", 3)`,
+	`string.pack("i17", 0)`,
+	`string.pack("i0", 0)`,
+	`string.pack("b", 200)`,
+	`string.pack("B", -1)`,
+	`string.pack("f d n", 1.5, -2.25, 1/3)`,
+	`string.pack(">f >d", 1.5, -2.25)`,
+	`string.pack("c5", "abc")`,
+	`string.pack("c2", "abc")`,
+	`string.pack("c", "abc")`,
+	`string.pack("s1 s2 s", "a", "bc", "def")`,
+	`string.pack("s1", string.rep("x", 256))`,
+	`string.pack("z z", "hello", "")`,
+	`string.pack("z", "a\0b")`,
+	`string.pack("!4 b i4 b !8 d x", 1, 2, 3, 4.5)`,
+	`string.pack("b Xi4 i4", 1, 2)`,
+	`string.pack("b X", 1)`,
+	`string.pack("b Xc1", 1)`,
+	`string.pack("!3 i4", 1)`,
+	`string.pack("!17 i4", 1)`,
+	`string.pack("i3 w", 1)`,
+	`string.pack("i", "x")`,
+	`string.packsize("i4 i8 !8 b d")`,
+	`string.packsize("!4 b i4 b Xd")`,
+	`string.packsize("s")`,
+	`string.packsize("z")`,
+	`string.packsize("c2147483647 c2")`,
+	`string.packsize("c2147483648")`,
+	`string.unpack("i4", string.pack("i4", 100))`,
+	`string.unpack(">i4 <i4", string.pack(">i4 <i4", -2, 3))`,
+	`string.unpack("bBhHlLjJT", string.pack("bBhHlLjJT", -1, 255, -300, 60000, -5, 5, -6, 6, 7))`,
+	`string.unpack("i16 I16", string.pack("i16 I16", -3, 3))`,
+	`string.unpack("i9", string.rep("\255", 8) .. "\1")`,
+	`string.unpack("I9", string.rep("\0", 8) .. "\1")`,
+	`string.unpack("f d n", string.pack("f d n", 1.5, -2.25, 1/3))`,
+	`string.unpack("c3 s1 z", string.pack("c3 s1 z", "abc", "de", "fgh"))`,
+	`string.unpack("z", "abc")`,
+	`string.unpack("s1", "\5ab")`,
+	`string.unpack("i4", "ab")`,
+	`string.unpack("b", "abc", 2)`,
+	`string.unpack("b", "abc", -1)`,
+	`string.unpack("b", "abc", 5)`,
+	`string.unpack("b", "abc", 4)`,
+	`string.unpack("!4 b i4", string.pack("!4 b i4", 1, 2))`,
+	`string.unpack(" x b", "ab")`,
+}
+
+func TestStringLibrary(t *testing.T) {
+	newState := func(t *testing.T, openString Function) *State {
+		t.Helper()
+		state := new(State)
+		t.Cleanup(func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		})
+		if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if err := Require(state, TableLibraryName, true, OpenTable); err != nil {
+			t.Fatal(err)
+		}
+		if err := Require(state, MathLibraryName, true, NewOpenMath(nil)); err != nil {
+			t.Fatal(err)
+		}
+		if err := Require(state, StringLibraryName, true, openString); err != nil {
+			t.Fatal(err)
+		}
+		state.SetTop(0)
+		return state
+	}
+	cState := newState(t, OpenString)
+	goState := newState(t, new(StringLibrary).OpenLibrary)
+
+	for _, expr := range stringLibraryTests {
+		want, err := evalStringTest(cState, expr)
+		if err != nil {
+			t.Errorf("%s (C): %v", expr, err)
+			continue
+		}
+		got, err := evalStringTest(goState, expr)
+		if err != nil {
+			t.Errorf("%s (Go): %v", expr, err)
+			continue
+		}
+		// Not all errors raised from Go functions include a position.
+		got = strings.ReplaceAll(got, `"(test):10: `, `"`)
+		want = strings.ReplaceAll(want, `"(test):10: `, `"`)
+		if got != want {
+			t.Errorf("%s = %s; want %s", expr, got, want)
+		}
+	}
+}
+
+// evalStringTest evaluates the Lua expression expr
+// and returns a description of its results.
+func evalStringTest(l *State, expr string) (string, error) {
+	const prelude = "local function describe(ok, ...)\n" +
+		"  local t = {tostring(ok)}\n" +
+		"  for i = 1, select('#', ...) do\n" +
+		"    local v = select(i, ...)\n" +
+		"    t[#t+1] = type(v) == 'string' and string.format('%q', v) or math.type(v) or tostring(v)\n" +
+		"    if math.type(v) then t[#t] = t[#t] .. ' ' .. tostring(v) end\n" +
+		"  end\n" +
+		"  return table.concat(t, ', ')\n" +
+		"end\n" +
+		"return describe(pcall(function() return "
+	if err := l.Load(strings.NewReader(prelude+expr+" end))"), "=(test)", "t"); err != nil {
+		return "", err
+	}
+	defer l.SetTop(0)
+	if err := l.Call(0, 1, 0); err != nil {
+		return "", err
+	}
+	s, _ := l.ToString(-1)
+	return s, nil
+}
+
+func TestStringLibraryLimits(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	lib := &StringLibrary{
+		MaxMatchSteps:       1000,
+		DisableQuotedFormat: true,
+		DisablePack:         true,
+	}
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, StringLibraryName, true, lib.OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	tests := []struct {
+		source  string
+		wantErr string
+	}{
+		{
+			source: `assert(string.find(string.rep("a", 10), "a-b") == nil)`,
+		},
+		{
+			source:  `string.find(string.rep("a", 100), ".-.-.-b")`,
+			wantErr: "pattern too complex",
+		},
+		{
+			source:  `string.format("%q", "x")`,
+			wantErr: "'%q' is disabled",
+		},
+		{
+			source: `assert(string.format("%s", "x") == "x")`,
+		},
+		{
+			source: `assert(string.pack == nil and string.packsize == nil and string.unpack == nil)`,
+		},
+		{
+			source: `assert(string.rep("x", 3) == "xxx")`,
+		},
+	}
+	for _, test := range tests {
+		if err := state.Load(strings.NewReader(test.source), "=(test)", "t"); err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		err := state.Call(0, 0, 0)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", test.source, err)
+		case test.wantErr != "" && err == nil:
+			t.Errorf("%s did not raise an error", test.source)
+		case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+			t.Errorf("%s: %v; want error containing %q", test.source, err, test.wantErr)
+		}
+	}
+}
+
+func TestStringLibrarySelfTest(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := Require(state, StringLibraryName, true, new(StringLibrary).OpenLibrary); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+	if err := SelfTest(state); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,501 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"encoding/binary"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// packOption is the kind of a string.pack format option.
+type packOption int
+
+const (
+	packInt       packOption = iota // signed integers
+	packUint                        // unsigned integers
+	packFloat                       // single-precision floating-point numbers
+	packNumber                      // Lua "native" floating-point numbers
+	packDouble                      // double-precision floating-point numbers
+	packChar                        // fixed-length strings
+	packString                      // strings with prefixed length
+	packZString                     // zero-terminated strings
+	packPadding                     // padding
+	packPaddAlign                   // padding for alignment
+	packNop                         // no-op (configuration or spaces)
+)
+
+// Sizes of the C types used by string.pack.
+const (
+	sizeofInt     = 4
+	sizeofSizeT   = int(unsafe.Sizeof(uintptr(0)))
+	sizeofInteger = 8
+	// packMaxAlign is the default maximum alignment for the '!' option.
+	packMaxAlign = 8
+	// maxIntSize is the maximum size for the binary representation of an integer.
+	maxIntSize = 16
+	// maxPackSize is the maximum size of a packed string.
+	maxPackSize = math.MaxInt32
+)
+
+// sizeofLong is the size of a C long.
+var sizeofLong = func() int {
+	if strconv.IntSize == 32 || runtime.GOOS == "windows" {
+		return 4
+	}
+	return 8
+}()
+
+var nativeLittleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// packHeader holds the state of a string.pack format string.
+type packHeader struct {
+	l        *State
+	fmt      string
+	little   bool
+	maxAlign int
+}
+
+func newPackHeader(l *State, fmt string) *packHeader {
+	return &packHeader{
+		l:        l,
+		fmt:      fmt,
+		little:   nativeLittleEndian,
+		maxAlign: 1,
+	}
+}
+
+// getNum reads an integer numeral from the format string
+// or returns def if there is no numeral.
+func (h *packHeader) getNum(def int) int {
+	if len(h.fmt) == 0 || !isDigitASCII(h.fmt[0]) {
+		return def
+	}
+	a := 0
+	for {
+		a = a*10 + int(h.fmt[0]-'0')
+		h.fmt = h.fmt[1:]
+		if len(h.fmt) == 0 || !isDigitASCII(h.fmt[0]) || a > (maxPackSize-9)/10 {
+			return a
+		}
+	}
+}
+
+// getNumLimit reads an integer numeral and returns an error
+// if it is larger than the maximum size for integers.
+func (h *packHeader) getNumLimit(def int) (int, error) {
+	sz := h.getNum(def)
+	if sz > maxIntSize || sz <= 0 {
+		return 0, luaErrorf("integral size (%d) out of limits [1,%d]", sz, maxIntSize)
+	}
+	return sz, nil
+}
+
+// option reads and classifies the next option.
+func (h *packHeader) option() (opt packOption, size int, err error) {
+	c := h.fmt[0]
+	h.fmt = h.fmt[1:]
+	switch c {
+	case 'b':
+		return packInt, 1, nil
+	case 'B':
+		return packUint, 1, nil
+	case 'h':
+		return packInt, 2, nil
+	case 'H':
+		return packUint, 2, nil
+	case 'l':
+		return packInt, sizeofLong, nil
+	case 'L':
+		return packUint, sizeofLong, nil
+	case 'j':
+		return packInt, sizeofInteger, nil
+	case 'J':
+		return packUint, sizeofInteger, nil
+	case 'T':
+		return packUint, sizeofSizeT, nil
+	case 'f':
+		return packFloat, 4, nil
+	case 'n':
+		return packNumber, 8, nil
+	case 'd':
+		return packDouble, 8, nil
+	case 'i', 'I':
+		size, err := h.getNumLimit(sizeofInt)
+		if err != nil {
+			return 0, 0, err
+		}
+		if c == 'i' {
+			return packInt, size, nil
+		}
+		return packUint, size, nil
+	case 's':
+		size, err := h.getNumLimit(sizeofSizeT)
+		if err != nil {
+			return 0, 0, err
+		}
+		return packString, size, nil
+	case 'c':
+		size := h.getNum(-1)
+		if size == -1 {
+			return 0, 0, luaErrorf("missing size for format option 'c'")
+		}
+		return packChar, size, nil
+	case 'z':
+		return packZString, 0, nil
+	case 'x':
+		return packPadding, 1, nil
+	case 'X':
+		return packPaddAlign, 0, nil
+	case ' ':
+	case '<':
+		h.little = true
+	case '>':
+		h.little = false
+	case '=':
+		h.little = nativeLittleEndian
+	case '!':
+		var err error
+		h.maxAlign, err = h.getNumLimit(packMaxAlign)
+		if err != nil {
+			return 0, 0, err
+		}
+	default:
+		return 0, 0, luaErrorf("invalid format option '%c'", c)
+	}
+	return packNop, 0, nil
+}
+
+// details reads, classifies, and fills other details about the next option.
+// ntoalign is the number of padding bytes needed
+// to align an item at totalSize.
+func (h *packHeader) details(totalSize int) (opt packOption, size, ntoalign int, err error) {
+	opt, size, err = h.option()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	align := size // usually, alignment follows size
+	if opt == packPaddAlign {
+		// 'X' gets alignment from following option.
+		if len(h.fmt) == 0 {
+			return 0, 0, 0, NewArgError(h.l, 1, "invalid next option for option 'X'")
+		}
+		var nextOpt packOption
+		nextOpt, align, err = h.option()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if nextOpt == packChar || align == 0 {
+			return 0, 0, 0, NewArgError(h.l, 1, "invalid next option for option 'X'")
+		}
+	}
+	if align <= 1 || opt == packChar {
+		return opt, size, 0, nil
+	}
+	align = min(align, h.maxAlign)
+	if align&(align-1) != 0 {
+		return 0, 0, 0, NewArgError(h.l, 1, "format asks for alignment not power of 2")
+	}
+	ntoalign = (align - totalSize&(align-1)) & (align - 1)
+	return opt, size, ntoalign, nil
+}
+
+// packInteger appends n with size bytes and the given endianness to b.
+// Bytes beyond the size of a Lua integer are filled with the sign.
+func packInteger(b []byte, n uint64, little bool, size int, neg bool) []byte {
+	start := len(b)
+	b = append(b, make([]byte, size)...)
+	buf := b[start:]
+	for i := 0; i < size; i++ {
+		c := byte(n)
+		if i >= sizeofInteger {
+			c = 0
+			if neg {
+				c = 0xff
+			}
+		}
+		if little {
+			buf[i] = c
+		} else {
+			buf[size-1-i] = c
+		}
+		n >>= 8
+	}
+	return b
+}
+
+// appendWithEndian appends the native-endian bytes in src to b,
+// correcting the endianness if needed.
+func appendWithEndian(b []byte, src []byte, little bool) []byte {
+	if little == nativeLittleEndian {
+		return append(b, src...)
+	}
+	for i := len(src) - 1; i >= 0; i-- {
+		b = append(b, src[i])
+	}
+	return b
+}
+
+func strPack(l *State) (int, error) {
+	format, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	h := newPackHeader(l, format)
+	var b []byte
+	arg := 1
+	totalSize := 0
+	for len(h.fmt) > 0 {
+		opt, size, ntoalign, err := h.details(totalSize)
+		if err != nil {
+			return 0, err
+		}
+		totalSize += ntoalign + size
+		for ; ntoalign > 0; ntoalign-- {
+			b = append(b, 0)
+		}
+		arg++
+		switch opt {
+		case packInt:
+			n, err := CheckInteger(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			if size < sizeofInteger {
+				lim := int64(1) << (size*8 - 1)
+				if !(-lim <= n && n < lim) {
+					return 0, NewArgError(l, arg, "integer overflow")
+				}
+			}
+			b = packInteger(b, uint64(n), h.little, size, n < 0)
+		case packUint:
+			n, err := CheckInteger(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			if size < sizeofInteger && uint64(n) >= uint64(1)<<(size*8) {
+				return 0, NewArgError(l, arg, "unsigned overflow")
+			}
+			b = packInteger(b, uint64(n), h.little, size, false)
+		case packFloat:
+			f, err := CheckNumber(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			b = appendWithEndian(b, binary.NativeEndian.AppendUint32(nil, math.Float32bits(float32(f))), h.little)
+		case packNumber, packDouble:
+			f, err := CheckNumber(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			b = appendWithEndian(b, binary.NativeEndian.AppendUint64(nil, math.Float64bits(f)), h.little)
+		case packChar:
+			s, err := CheckString(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			if len(s) > size {
+				return 0, NewArgError(l, arg, "string longer than given size")
+			}
+			b = append(b, s...)
+			for i := len(s); i < size; i++ {
+				b = append(b, 0)
+			}
+		case packString:
+			s, err := CheckString(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			if size < sizeofSizeT && uint64(len(s)) >= uint64(1)<<(size*8) {
+				return 0, NewArgError(l, arg, "string length does not fit in given size")
+			}
+			b = packInteger(b, uint64(len(s)), h.little, size, false)
+			b = append(b, s...)
+			totalSize += len(s)
+		case packZString:
+			s, err := CheckString(l, arg)
+			if err != nil {
+				return 0, err
+			}
+			if strings.IndexByte(s, 0) >= 0 {
+				return 0, NewArgError(l, arg, "string contains zeros")
+			}
+			b = append(b, s...)
+			b = append(b, 0)
+			totalSize += len(s) + 1
+		case packPadding:
+			b = append(b, 0)
+			arg--
+		case packPaddAlign, packNop:
+			arg--
+		}
+	}
+	l.PushString(string(b))
+	return 1, nil
+}
+
+func strPackSize(l *State) (int, error) {
+	format, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	h := newPackHeader(l, format)
+	totalSize := 0
+	for len(h.fmt) > 0 {
+		opt, size, ntoalign, err := h.details(totalSize)
+		if err != nil {
+			return 0, err
+		}
+		if opt == packString || opt == packZString {
+			return 0, NewArgError(l, 1, "variable-length format")
+		}
+		size += ntoalign
+		if totalSize > maxPackSize-size {
+			return 0, NewArgError(l, 1, "format result too large")
+		}
+		totalSize += size
+	}
+	l.PushInteger(int64(totalSize))
+	return 1, nil
+}
+
+// unpackInteger decodes an integer with size bytes and the given endianness.
+func unpackInteger(b []byte, little bool, size int, signed bool) (int64, error) {
+	byteAt := func(i int) byte {
+		if little {
+			return b[i]
+		}
+		return b[size-1-i]
+	}
+	var res uint64
+	limit := min(size, sizeofInteger)
+	for i := limit - 1; i >= 0; i-- {
+		res = res<<8 | uint64(byteAt(i))
+	}
+	if size < sizeofInteger {
+		if signed {
+			// Sign extend.
+			mask := uint64(1) << (size*8 - 1)
+			res = (res ^ mask) - mask
+		}
+	} else if size > sizeofInteger {
+		// Check that the unread bytes do not cause an overflow.
+		var mask byte
+		if signed && int64(res) < 0 {
+			mask = 0xff
+		}
+		for i := limit; i < size; i++ {
+			if byteAt(i) != mask {
+				return 0, luaErrorf("%d-byte integer does not fit into Lua Integer", size)
+			}
+		}
+	}
+	return int64(res), nil
+}
+
+// nativeBytes returns b in native byte order,
+// given that it is encoded with the given endianness.
+func nativeBytes(b []byte, little bool) []byte {
+	return appendWithEndian(nil, b, little)
+}
+
+func strUnpack(l *State) (int, error) {
+	format, err := CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	data, err := CheckString(l, 2)
+	if err != nil {
+		return 0, err
+	}
+	initPos, err := OptInteger(l, 3, 1)
+	if err != nil {
+		return 0, err
+	}
+	pos64 := posRelative(initPos, len(data)) - 1
+	if pos64 > int64(len(data)) {
+		return 0, NewArgError(l, 3, "initial position out of string")
+	}
+	pos := int(pos64)
+	h := newPackHeader(l, format)
+	n := 0
+	for len(h.fmt) > 0 {
+		opt, size, ntoalign, err := h.details(pos)
+		if err != nil {
+			return 0, err
+		}
+		if ntoalign+size > len(data)-pos {
+			return 0, NewArgError(l, 2, "data string too short")
+		}
+		pos += ntoalign
+		// Stack space for item + next position.
+		if !l.CheckStack(2) {
+			return 0, luaErrorf("stack overflow (too many results)")
+		}
+		n++
+		switch opt {
+		case packInt, packUint:
+			res, err := unpackInteger([]byte(data[pos:pos+size]), h.little, size, opt == packInt)
+			if err != nil {
+				return 0, err
+			}
+			l.PushInteger(res)
+		case packFloat:
+			bits := binary.NativeEndian.Uint32(nativeBytes([]byte(data[pos:pos+size]), h.little))
+			l.PushNumber(float64(math.Float32frombits(bits)))
+		case packNumber, packDouble:
+			bits := binary.NativeEndian.Uint64(nativeBytes([]byte(data[pos:pos+size]), h.little))
+			l.PushNumber(math.Float64frombits(bits))
+		case packChar:
+			l.PushString(data[pos : pos+size])
+		case packString:
+			length, err := unpackInteger([]byte(data[pos:pos+size]), h.little, size, false)
+			if err != nil {
+				return 0, err
+			}
+			if uint64(length) > uint64(len(data)-pos-size) {
+				return 0, NewArgError(l, 2, "data string too short")
+			}
+			l.PushString(data[pos+size : pos+size+int(length)])
+			pos += int(length)
+		case packZString:
+			length := strings.IndexByte(data[pos:], 0)
+			if length < 0 {
+				return 0, NewArgError(l, 2, "unfinished string for format 'z'")
+			}
+			l.PushString(data[pos : pos+length])
+			pos += length + 1
+		case packPaddAlign, packPadding, packNop:
+			n--
+		}
+		pos += size
+	}
+	l.PushInteger(int64(pos) + 1)
+	return n + 1, nil
+}
+
+func isDigitASCII(c byte) bool {
+	return '0' <= c && c <= '9'
+}
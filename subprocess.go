@@ -0,0 +1,247 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// SubprocessFlag is the command-line flag
+// that starts the zombiezen-lua interpreter in subprocess mode.
+// In subprocess mode, the interpreter reads a chunk from standard input,
+// runs it with the libraries opened by [OpenSandbox],
+// and writes its results to standard output for [Subprocess.Run].
+// Passing -subprocess-unsafe in [Subprocess.Args]
+// opens the full standard library (including io and os) instead.
+const SubprocessFlag = "-subprocess"
+
+// subprocessMagic is the first bytes of every subprocess response.
+const subprocessMagic = "zombiezen-lua\x00"
+
+// Response status codes.
+const (
+	subprocessOK    byte = 0
+	subprocessError byte = 1
+)
+
+// Subprocess runs Lua chunks in a separate operating system process.
+// Hosts that cannot risk a crash in C code (or a misbehaving script)
+// taking down their own process can use Subprocess to isolate untrusted chunks.
+// Only nil, booleans, numbers, strings, and tables of those
+// can be returned from a chunk.
+type Subprocess struct {
+	// Path is the path to an executable that serves subprocess requests,
+	// typically the zombiezen-lua interpreter.
+	// If empty, "zombiezen-lua" is looked up in the PATH.
+	Path string
+	// Args holds additional command-line arguments
+	// passed before [SubprocessFlag].
+	Args []string
+	// Env specifies the environment of the process.
+	// If nil, the process uses the current process's environment.
+	Env []string
+	// Stderr receives the process's standard error,
+	// which includes any output written by the chunk.
+	// If nil, the output is discarded.
+	Stderr io.Writer
+	// Setup is called with the command before it is started.
+	// Setup can modify the command to apply resource limits or sandboxing
+	// (e.g. by setting SysProcAttr or wrapping the command with prlimit).
+	// Setup must not set the command's Stdout.
+	Setup func(cmd *exec.Cmd) error
+	// MaxResponseSize is the maximum number of bytes
+	// that Run reads from the process's standard output.
+	// If the response is larger, the process is killed
+	// and Run returns an error.
+	// If MaxResponseSize is zero, DefaultMaxSubprocessResponseSize is used.
+	MaxResponseSize int64
+}
+
+// DefaultMaxSubprocessResponseSize is the maximum size of a response
+// read by [Subprocess.Run] if [Subprocess.MaxResponseSize] is zero.
+const DefaultMaxSubprocessResponseSize = 64 << 20
+
+// Run runs the chunk read from r in a new process
+// and pushes its results onto l's stack.
+// chunkName is used in error messages and debug information,
+// as in [State.Load].
+// Run returns the number of results pushed.
+// If the chunk raises an error or the process fails,
+// then Run returns an error and pushes nothing.
+func (sp *Subprocess) Run(ctx context.Context, l *State, r io.Reader, chunkName string) (int, error) {
+	path := sp.Path
+	if path == "" {
+		path = "zombiezen-lua"
+	}
+	args := append(append([]string(nil), sp.Args...), SubprocessFlag)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = sp.Env
+	cmd.Stderr = sp.Stderr
+	request := new(bytes.Buffer)
+	request.Write(binary.AppendUvarint(nil, uint64(len(chunkName))))
+	request.WriteString(chunkName)
+	cmd.Stdin = io.MultiReader(request, r)
+	if sp.Setup != nil {
+		if err := sp.Setup(cmd); err != nil {
+			return 0, fmt.Errorf("lua: run subprocess: %w", err)
+		}
+	}
+	maxSize := sp.MaxResponseSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSubprocessResponseSize
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("lua: run subprocess: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("lua: run subprocess: %w", err)
+	}
+	// Read one byte past the limit to detect oversized responses.
+	response, readErr := io.ReadAll(io.LimitReader(stdout, maxSize+1))
+	if int64(len(response)) > maxSize {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("lua: run subprocess: response larger than %d bytes", maxSize)
+	}
+	runErr := cmd.Wait()
+	if runErr == nil {
+		runErr = readErr
+	}
+	n, err := readSubprocessResponse(l, bufio.NewReader(bytes.NewReader(response)))
+	if err != nil {
+		if runErr != nil {
+			return 0, fmt.Errorf("lua: run subprocess: %w", runErr)
+		}
+		return 0, fmt.Errorf("lua: run subprocess: %w", err)
+	}
+	return n, nil
+}
+
+func readSubprocessResponse(l *State, r *bufio.Reader) (int, error) {
+	magic := make([]byte, len(subprocessMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != subprocessMagic {
+		return 0, errors.New("invalid response")
+	}
+	status, err := r.ReadByte()
+	if err != nil {
+		return 0, errors.New("invalid response")
+	}
+	switch status {
+	case subprocessOK:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, fmt.Errorf("invalid response: %w", err)
+		}
+		if n > uint64(maxStack) || !l.CheckStack(int(n)) {
+			return 0, fmt.Errorf("too many results (%d)", n)
+		}
+		for i := 0; i < int(n); i++ {
+			if err := decodeValue(l, r); err != nil {
+				l.Pop(i)
+				return 0, fmt.Errorf("result #%d: %w", i+1, err)
+			}
+		}
+		return int(n), nil
+	case subprocessError:
+		msg, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		return 0, errors.New(string(msg))
+	default:
+		return 0, fmt.Errorf("invalid response status %d", status)
+	}
+}
+
+// maxStack is an upper bound on the number of results
+// that a subprocess response can contain.
+const maxStack = 1_000_000
+
+// ServeSubprocess handles a single [Subprocess.Run] request.
+// It reads a chunk from r, runs it in l,
+// and writes the response to w with a single call to Write.
+// ServeSubprocess returns an error only if it could not write the response;
+// errors from the chunk are reported to the caller of [Subprocess.Run].
+//
+// The caller is responsible for opening any libraries in l
+// and should ensure that the chunk's output (e.g. from print)
+// is not written to w.
+func ServeSubprocess(l *State, r io.Reader, w io.Writer) error {
+	// Build the whole response in memory
+	// so that a failure partway through encoding the results
+	// can be replaced by an error response.
+	response := new(bytes.Buffer)
+	bw := bufio.NewWriter(response)
+	bw.WriteString(subprocessMagic)
+	n, err := runSubprocessChunk(l, bufio.NewReader(r))
+	if err == nil {
+		bw.WriteByte(subprocessOK)
+		bw.Write(binary.AppendUvarint(nil, uint64(n)))
+		base := l.Top() - n
+		for i := 1; i <= n; i++ {
+			if err = encodeValue(bw, l, base+i); err != nil {
+				err = fmt.Errorf("result #%d: %v", i, err)
+				break
+			}
+		}
+		l.Pop(n)
+	}
+	bw.Flush()
+	if err != nil {
+		// Discard any partially written results.
+		response.Reset()
+		response.WriteString(subprocessMagic)
+		response.WriteByte(subprocessError)
+		response.WriteString(err.Error())
+	}
+	_, err = w.Write(response.Bytes())
+	return err
+}
+
+func runSubprocessChunk(l *State, r *bufio.Reader) (int, error) {
+	nameLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("read request: %v", err)
+	}
+	chunkName := make([]byte, min(nameLen, 4096))
+	if _, err := io.ReadFull(r, chunkName); err != nil || uint64(len(chunkName)) != nameLen {
+		return 0, fmt.Errorf("read request: invalid chunk name")
+	}
+	base := l.Top()
+	if err := l.Load(r, string(chunkName), "t"); err != nil {
+		l.Pop(1)
+		return 0, err
+	}
+	if err := l.Call(0, MultipleReturns, 0); err != nil {
+		l.Pop(1)
+		return 0, err
+	}
+	return l.Top() - base, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+const subprocessHelperEnv = "ZOMBIEZEN_LUA_TEST_SUBPROCESS"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(subprocessHelperEnv) == "1" {
+		os.Exit(serveTestSubprocess())
+	}
+	os.Exit(m.Run())
+}
+
+// serveTestSubprocess allows the test binary to act as a [Subprocess] helper.
+func serveTestSubprocess() int {
+	l := new(State)
+	defer l.Close()
+	if err := Require(l, GName, true, NewOpenBase(os.Stderr, nil)); err != nil {
+		return 1
+	}
+	l.Pop(1)
+	if err := ServeSubprocess(l, os.Stdin, os.Stdout); err != nil {
+		return 1
+	}
+	return 0
+}
+
+func TestSubprocess(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip("Cannot find test executable:", err)
+	}
+	sp := &Subprocess{
+		Path: exe,
+		Env:  append(os.Environ(), subprocessHelperEnv+"=1"),
+	}
+
+	t.Run("Results", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		const source = `local t = {1, 2.5, "x", nested = {ok = true}}` + "\n" +
+			`t.self = t` + "\n" +
+			`print("this goes to stderr")` + "\n" +
+			`return 42, t, nil`
+		n, err := sp.Run(context.Background(), state, strings.NewReader(source), "=(subprocess)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 || state.Top() != 3 {
+			t.Fatalf("Run(...) = %d (top = %d); want 3", n, state.Top())
+		}
+		if got, ok := state.ToInteger(1); got != 42 || !ok {
+			t.Errorf("result #1 = %v; want 42", state.Type(1))
+		}
+		if got, want := state.RawIndex(2, 2), TypeNumber; got != want || state.IsInteger(-1) {
+			t.Errorf("t[2] is %v (integer = %t); want float", got, state.IsInteger(-1))
+		}
+		state.Pop(1)
+		state.RawField(2, "nested")
+		if got := state.RawField(-1, "ok"); got != TypeBoolean || !state.ToBoolean(-1) {
+			t.Errorf("t.nested.ok = %v; want true", got)
+		}
+		state.Pop(2)
+		state.RawField(2, "self")
+		if !state.RawEqual(2, -1) {
+			t.Error("t.self ~= t")
+		}
+		state.Pop(1)
+		if !state.IsNil(3) {
+			t.Errorf("result #3 = %v; want nil", state.Type(3))
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		_, err := sp.Run(context.Background(), state, strings.NewReader(`error("bork")`), "=(subprocess)")
+		if err == nil || !strings.Contains(err.Error(), "bork") {
+			t.Errorf("Run(...) = _, %v; want error containing \"bork\"", err)
+		}
+		if got := state.Top(); got != 0 {
+			t.Errorf("state.Top() = %d; want 0", got)
+		}
+	})
+
+	t.Run("UnencodableResult", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		_, err := sp.Run(context.Background(), state, strings.NewReader(`return 1, print`), "=(subprocess)")
+		if err == nil || !strings.Contains(err.Error(), "result #2") {
+			t.Errorf("Run(...) = _, %v; want error about result #2", err)
+		}
+		if got := state.Top(); got != 0 {
+			t.Errorf("state.Top() = %d; want 0", got)
+		}
+	})
+
+	t.Run("ResponseTooLarge", func(t *testing.T) {
+		state := new(State)
+		defer func() {
+			if err := state.Close(); err != nil {
+				t.Error("Close:", err)
+			}
+		}()
+
+		sp := *sp
+		sp.MaxResponseSize = 1024
+		const source = `local s = "x"; for i = 1, 12 do s = s .. s end; return s`
+		_, err := sp.Run(context.Background(), state, strings.NewReader(source), "=(subprocess)")
+		if err == nil || !strings.Contains(err.Error(), "larger than 1024 bytes") {
+			t.Errorf("Run(...) = _, %v; want error about response size", err)
+		}
+		if got := state.Top(); got != 0 {
+			t.Errorf("state.Top() = %d; want 0", got)
+		}
+	})
+}
+
+// recordWriter records each call to Write.
+type recordWriter struct {
+	writes [][]byte
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+func TestServeSubprocessPartialResults(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenSandbox(state, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first result is larger than the encoder's buffer,
+	// so it would be flushed before the second result fails to encode.
+	const chunkName = "=(subprocess)"
+	request := binary.AppendUvarint(nil, uint64(len(chunkName)))
+	request = append(request, chunkName...)
+	request = append(request, `return string.rep("x", 100000), print`...)
+	w := new(recordWriter)
+	if err := ServeSubprocess(state, bytes.NewReader(request), w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.writes) != 1 {
+		t.Fatalf("ServeSubprocess called Write %d times; want 1", len(w.writes))
+	}
+	_, err := readSubprocessResponse(state, bufio.NewReader(bytes.NewReader(w.writes[0])))
+	if err == nil || !strings.Contains(err.Error(), "result #2") {
+		t.Errorf("response error = %v; want error about result #2", err)
+	}
+}
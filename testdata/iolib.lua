@@ -43,6 +43,34 @@ do
   assert(f:close())
 end
 
+-- Read formats
+do
+  local f = assert(io.open("numbers.txt", "w"))
+  assert(f:write("  12 0x1F -3.5e2 .5\n0x.8p1 1e next line\nlast"))
+  assert(f:close())
+
+  f = assert(io.open("numbers.txt"))
+  assert(f:read(0) == "")
+  local a, b, c, d, e = f:read("n", "n", "n", "n", "n")
+  assert(a == 12 and math.type(a) == "integer", tostring(a))
+  assert(b == 31 and math.type(b) == "integer", tostring(b))
+  assert(c == -350 and math.type(c) == "float", tostring(c))
+  assert(d == 0.5, tostring(d))
+  assert(e == 1.0 and math.type(e) == "float", tostring(e))
+  -- "1e" is not a valid numeral, so reading stops at the first failure.
+  local x, y = f:read("n", "l")
+  assert(x == nil and y == nil)
+  assert(f:read("L") == " next line\n")
+  assert(f:read(2) == "la")
+  assert(f:read("a") == "st")
+  assert(f:read("a") == "")
+  assert(f:read(0) == nil)
+  assert(f:read("l") == nil)
+  assert(f:read(1) == nil)
+  assert(not pcall(f.read, f, "x"))
+  assert(f:close())
+end
+
 -- Lines
 do
   local i = 1
@@ -51,6 +79,63 @@ do
     assert(lines[i] == line, "line "..i..": "..line)
     i = i + 1
   end
+  assert(i == #lines + 1, "Too few lines")
+end
+
+-- Lines with formats
+do
+  local got = {}
+  for c, rest in io.lines("foo.txt", 1, "L") do
+    got[#got + 1] = c.."|"..rest
+  end
+  assert(#got == 2)
+  assert(got[1] == "H|ello, 42!\n", got[1])
+  assert(got[2] == "s|econd line\n", got[2])
+
+  local f = assert(io.open("foo.txt"))
+  local i = 1
+  for line in f:lines("l") do
+    assert(lines[i] == line, "line "..i..": "..line)
+    i = i + 1
+  end
+  assert(i == #lines + 1, "Too few lines")
+  assert(io.type(f) == "file", "file:lines closed file")
+  assert(f:close())
+end
+
+-- io.lines closes file at end of loop
+do
+  local next = io.lines("foo.txt")
+  assert(next() == lines[1])
+  assert(next() == lines[2])
+  assert(next() == nil)
+  assert(not pcall(next))
+end
+
+-- To-be-closed variables
+do
+  local escaped
+  do
+    local f <close> = assert(io.open("foo.txt"))
+    escaped = f
+    assert(f:read("l") == lines[1])
+  end
+  assert(io.type(escaped) == "closed file", io.type(escaped))
+  assert(tostring(escaped) == "file (closed)")
+  assert(not pcall(escaped.read, escaped))
+  assert(not pcall(escaped.close, escaped))
+
+  -- Closing explicitly before the variable goes out of scope is safe.
+  do
+    local f <close> = assert(io.open("foo.txt"))
+    assert(f:close())
+  end
+
+  -- io.lines returns the file as a to-be-closed value,
+  -- so breaking out of the loop closes it.
+  for line in io.lines("foo.txt") do
+    break
+  end
 end
 
 -- Seeking
@@ -70,3 +70,10 @@ local dt = os.difftime(t1, t2)
 assert(dt == 3427)
 
 assert(os.date(nil, t2) == "Sun Sep 24 13:01:00 2023")
+
+-- os.clock and os.hrtime
+assert(type(os.clock()) == "number")
+assert(os.clock() >= 0)
+local ns = os.hrtime()
+assert(type(ns) == "number")
+assert(ns >= 0 and ns // 1 == ns)
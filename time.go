@@ -0,0 +1,318 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	timeMetatableName     = "*zombiezen.com/go/lua.time"
+	durationMetatableName = "*zombiezen.com/go/lua.duration"
+)
+
+var (
+	timeMetatable     = NewMetatableFor[time.Time](timeMetatableName)
+	durationMetatable = NewMetatableFor[time.Duration](durationMetatableName)
+)
+
+func init() {
+	// The methods refer to the builders,
+	// so they are added here to avoid an initialization cycle.
+	timeMetatable.
+		Method("unix", func(l *State, t *time.Time) (int, error) {
+			l.PushInteger(t.Unix())
+			return 1, nil
+		}).
+		Method("unixnano", func(l *State, t *time.Time) (int, error) {
+			l.PushInteger(t.UnixNano())
+			return 1, nil
+		}).
+		Method("utc", func(l *State, t *time.Time) (int, error) {
+			return 1, PushTime(l, t.UTC())
+		}).
+		Method("format", func(l *State, t *time.Time) (int, error) {
+			layout, err := OptString(l, 2, time.RFC3339Nano)
+			if err != nil {
+				return 0, err
+			}
+			l.PushString(t.Format(layout))
+			return 1, nil
+		}).
+		Metamethod("__tostring", func(l *State) (int, error) {
+			t, err := CheckTypedUserdata[time.Time](l, 1, timeMetatableName)
+			if err != nil {
+				return 0, err
+			}
+			l.PushString(t.Format(time.RFC3339Nano))
+			return 1, nil
+		}).
+		Metamethod("__eq", timeCompare("eq")).
+		Metamethod("__lt", timeCompare("lt")).
+		Metamethod("__le", timeCompare("le")).
+		Metamethod("__add", timeArith("add")).
+		Metamethod("__sub", timeArith("sub")).
+		Metamethod("__mul", timeArith("mul")).
+		Metamethod("__div", timeArith("div")).
+		Metamethod("__unm", timeArith("unm"))
+	durationMetatable.
+		Method("seconds", func(l *State, d *time.Duration) (int, error) {
+			l.PushNumber(d.Seconds())
+			return 1, nil
+		}).
+		Method("milliseconds", func(l *State, d *time.Duration) (int, error) {
+			l.PushInteger(d.Milliseconds())
+			return 1, nil
+		}).
+		Metamethod("__tostring", func(l *State) (int, error) {
+			d, err := CheckTypedUserdata[time.Duration](l, 1, durationMetatableName)
+			if err != nil {
+				return 0, err
+			}
+			l.PushString(d.String())
+			return 1, nil
+		}).
+		Metamethod("__eq", timeCompare("eq")).
+		Metamethod("__lt", timeCompare("lt")).
+		Metamethod("__le", timeCompare("le")).
+		Metamethod("__add", timeArith("add")).
+		Metamethod("__sub", timeArith("sub")).
+		Metamethod("__mul", timeArith("mul")).
+		Metamethod("__div", timeArith("div")).
+		Metamethod("__unm", timeArith("unm"))
+}
+
+// PushTime pushes a Lua time object onto the stack that holds t.
+// Time objects can be compared with each other using ==, <, and <=.
+// Subtracting two times results in a duration object (see [PushDuration]),
+// and adding or subtracting a duration (or a number of seconds)
+// to or from a time results in a new time.
+// Time objects have the following methods:
+//
+//   - t:unix() returns the number of seconds since the Unix epoch.
+//   - t:unixnano() returns the number of nanoseconds since the Unix epoch.
+//   - t:utc() returns t with the location set to UTC.
+//   - t:format([layout]) formats t as in [time.Time.Format].
+//     The default layout is [time.RFC3339Nano],
+//     which is also used by tostring.
+func PushTime(l *State, t time.Time) error {
+	if err := timeMetatable.New(l, t); err != nil {
+		return fmt.Errorf("lua: push time: %v", err)
+	}
+	return nil
+}
+
+// ToTime returns the time held by the Lua time object at the given index.
+// If the value is not a time object, ToTime returns false.
+func ToTime(l *State, idx int) (time.Time, bool) {
+	t := timeMetatable.Test(l, idx)
+	if t == nil {
+		return time.Time{}, false
+	}
+	return *t, true
+}
+
+// PushDuration pushes a Lua duration object onto the stack that holds d.
+// Durations are always pushed as duration objects
+// so that scripts do not need to guess their unit,
+// but anywhere a duration is accepted, a number of seconds is accepted too.
+// Duration objects can be compared with each other using ==, <, and <=,
+// can be added to or subtracted from each other,
+// and can be multiplied or divided by numbers.
+// Dividing a duration by another duration results in a number.
+// Duration objects have the following methods:
+//
+//   - d:seconds() returns the duration as a floating-point number of seconds.
+//   - d:milliseconds() returns the duration as an integer number of milliseconds.
+func PushDuration(l *State, d time.Duration) error {
+	if err := durationMetatable.New(l, d); err != nil {
+		return fmt.Errorf("lua: push duration: %v", err)
+	}
+	return nil
+}
+
+// ToDuration returns the duration held by the Lua duration object
+// at the given index.
+// If the value is a number, it is interpreted as a number of seconds.
+// If the value is neither a duration object nor a number
+// (or the number is out of range),
+// ToDuration returns false.
+func ToDuration(l *State, idx int) (time.Duration, bool) {
+	if d := durationMetatable.Test(l, idx); d != nil {
+		return *d, true
+	}
+	if l.Type(idx) != TypeNumber {
+		return 0, false
+	}
+	if l.IsInteger(idx) {
+		n, _ := l.ToInteger(idx)
+		if n > math.MaxInt64/int64(time.Second) || n < math.MinInt64/int64(time.Second) {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	secs, _ := l.ToNumber(idx)
+	return floatToDuration(secs * float64(time.Second))
+}
+
+// floatToDuration converts a number of nanoseconds to a [time.Duration],
+// reporting false if it is out of range.
+func floatToDuration(ns float64) (time.Duration, bool) {
+	if math.IsNaN(ns) || ns >= math.MaxInt64 || ns < math.MinInt64 {
+		return 0, false
+	}
+	return time.Duration(ns), true
+}
+
+// timeCompare returns the comparison metamethod for the given event
+// for time and duration objects.
+func timeCompare(event string) Function {
+	return func(l *State) (int, error) {
+		var cmp int
+		if t1, ok := ToTime(l, 1); ok {
+			t2, ok := ToTime(l, 2)
+			if !ok {
+				return timeCompareError(l, event)
+			}
+			cmp = t1.Compare(t2)
+		} else if d1 := durationMetatable.Test(l, 1); d1 != nil {
+			d2 := durationMetatable.Test(l, 2)
+			if d2 == nil {
+				return timeCompareError(l, event)
+			}
+			cmp = compareDurations(*d1, *d2)
+		} else {
+			return timeCompareError(l, event)
+		}
+		switch event {
+		case "lt":
+			l.PushBoolean(cmp < 0)
+		case "le":
+			l.PushBoolean(cmp <= 0)
+		default:
+			l.PushBoolean(cmp == 0)
+		}
+		return 1, nil
+	}
+}
+
+func timeCompareError(l *State, event string) (int, error) {
+	if event == "eq" {
+		l.PushBoolean(false)
+		return 1, nil
+	}
+	return 0, fmt.Errorf("%sattempt to compare %s with %s", Where(l, 1), TypeName(l, 1), TypeName(l, 2))
+}
+
+func compareDurations(d1, d2 time.Duration) int {
+	switch {
+	case d1 < d2:
+		return -1
+	case d1 > d2:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// timeArith returns the arithmetic metamethod for the given event
+// for time and duration objects.
+func timeArith(event string) Function {
+	return func(l *State) (int, error) {
+		t1, isTime1 := ToTime(l, 1)
+		t2, isTime2 := ToTime(l, 2)
+		d1 := durationMetatable.Test(l, 1)
+		d2 := durationMetatable.Test(l, 2)
+		switch event {
+		case "add":
+			switch {
+			case isTime1:
+				if d, ok := ToDuration(l, 2); ok {
+					return 1, PushTime(l, t1.Add(d))
+				}
+			case isTime2:
+				if d, ok := ToDuration(l, 1); ok {
+					return 1, PushTime(l, t2.Add(d))
+				}
+			default:
+				a, ok1 := ToDuration(l, 1)
+				b, ok2 := ToDuration(l, 2)
+				if ok1 && ok2 {
+					return 1, PushDuration(l, a+b)
+				}
+			}
+		case "sub":
+			switch {
+			case isTime1 && isTime2:
+				return 1, PushDuration(l, t1.Sub(t2))
+			case isTime1:
+				if d, ok := ToDuration(l, 2); ok {
+					return 1, PushTime(l, t1.Add(-d))
+				}
+			case !isTime2:
+				a, ok1 := ToDuration(l, 1)
+				b, ok2 := ToDuration(l, 2)
+				if ok1 && ok2 {
+					return 1, PushDuration(l, a-b)
+				}
+			}
+		case "unm":
+			if d1 != nil {
+				return 1, PushDuration(l, -*d1)
+			}
+		case "mul":
+			d, n := d1, 2
+			if d == nil {
+				d, n = d2, 1
+			}
+			if d != nil && l.Type(n) == TypeNumber {
+				x, _ := l.ToNumber(n)
+				if result, ok := floatToDuration(float64(*d) * x); ok {
+					return 1, PushDuration(l, result)
+				}
+				return 0, fmt.Errorf("%sduration out of range", Where(l, 1))
+			}
+		case "div":
+			if d1 == nil {
+				break
+			}
+			if d2 != nil {
+				l.PushNumber(float64(*d1) / float64(*d2))
+				return 1, nil
+			}
+			if l.Type(2) == TypeNumber {
+				x, _ := l.ToNumber(2)
+				if result, ok := floatToDuration(float64(*d1) / x); ok {
+					return 1, PushDuration(l, result)
+				}
+				return 0, fmt.Errorf("%sduration out of range", Where(l, 1))
+			}
+		}
+		bad := 2
+		if !isTime1 && d1 == nil && l.Type(1) != TypeNumber {
+			bad = 1
+		}
+		return 0, fmt.Errorf("%sattempt to perform arithmetic on a %s value", Where(l, 1), TypeName(l, bad))
+	}
+}
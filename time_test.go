@@ -0,0 +1,90 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTime(t *testing.T) {
+	l := new(State)
+	defer func() {
+		if err := l.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(l); err != nil {
+		t.Fatal(err)
+	}
+
+	t1 := time.Date(2023, time.March, 4, 12, 30, 0, 0, time.UTC)
+	if err := PushTime(l, t1); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := ToTime(l, -1); !ok || !got.Equal(t1) {
+		t.Errorf("ToTime(l, -1) = %v, %t; want %v, true", got, ok, t1)
+	}
+	if err := l.SetGlobal("t1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushDuration(l, 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetGlobal("d", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const source = `local t2 = t1 + d` + "\n" +
+		`assert(t1 < t2 and t1 <= t1 and t1 == t1 + 0 and t1 ~= t2)` + "\n" +
+		`assert(t2 - t1 == d)` + "\n" +
+		`assert(t2 - d == t1 and t1 + 90 == t2 and 90.0 + t1 == t2)` + "\n" +
+		`assert(d * 2 == d + d and 2 * d == d + 90 and d / 2 == d - 45)` + "\n" +
+		`assert(d / d == 1.0 and -d < d)` + "\n" +
+		`assert(d:seconds() == 90.0 and d:milliseconds() == 90000)` + "\n" +
+		`assert(t1:unix() == 1677933000)` + "\n" +
+		`assert(tostring(t1) == "2023-03-04T12:30:00Z")` + "\n" +
+		`assert(tostring(d) == "1m30s")` + "\n" +
+		`assert(t1:format("2006-01-02") == "2023-03-04")` + "\n" +
+		`assert(not pcall(function() return t1 < d end))` + "\n" +
+		`assert(not pcall(function() return t1 + t1 end))` + "\n" +
+		`assert(t1 ~= d)` + "\n" +
+		`return t2, t2 - t1, 2.5`
+	if err := l.LoadString(source, "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Call(0, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := ToTime(l, -3); !ok || !got.Equal(t1.Add(90*time.Second)) {
+		t.Errorf("t2 = %v, %t; want %v, true", got, ok, t1.Add(90*time.Second))
+	}
+	if got, ok := ToDuration(l, -2); !ok || got != 90*time.Second {
+		t.Errorf("ToDuration(t2 - t1) = %v, %t; want 1m30s, true", got, ok)
+	}
+	if got, ok := ToDuration(l, -1); !ok || got != 2500*time.Millisecond {
+		t.Errorf("ToDuration(2.5) = %v, %t; want 2.5s, true", got, ok)
+	}
+	if _, ok := ToDuration(l, -3); ok {
+		t.Error("ToDuration(time) = _, true; want false")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTimeout matches errors returned by [State.CallTimeout]
+// when the function runs past its deadline.
+// Such errors are of type [*TimeoutError].
+var ErrTimeout = errors.New("lua: call timed out")
+
+// TimeoutError is the error returned by [State.CallTimeout]
+// when the function runs past its deadline.
+// TimeoutError values match [ErrTimeout] with [errors.Is].
+type TimeoutError struct {
+	// Timeout is the duration passed to CallTimeout.
+	Timeout time.Duration
+	// Traceback is the Lua stack traceback
+	// of the function at the time it was last interrupted.
+	// It is empty if the deadline passed before the function started.
+	Traceback string
+
+	// err is the error returned by [State.Call], if any.
+	err error
+}
+
+// Error returns the error message raised in the interrupted function.
+func (e *TimeoutError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("timed out after %v", e.Timeout)
+	}
+	return e.err.Error()
+}
+
+// Unwrap returns the error returned by [State.Call].
+func (e *TimeoutError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is [ErrTimeout].
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// CallTimeout calls a function like [State.Call],
+// but interrupts the function with an error
+// once it has run for longer than d of wall-clock time.
+// The deadline is checked with a hook
+// and has the same limitations as [State.CallContext].
+//
+// If the function is interrupted,
+// CallTimeout returns a [*TimeoutError] with the function's traceback.
+// If d is zero or negative, the function is not called
+// and the error is returned immediately.
+func (l *State) CallTimeout(d time.Duration, nArgs, nResults, msgHandler int) error {
+	msg := fmt.Sprintf("timed out after %v", d)
+	if d <= 0 {
+		l.Pop(nArgs + 1)
+		l.PushString(msg)
+		return &TimeoutError{Timeout: d}
+	}
+	deadline := time.Now().Add(d)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	var traceback string
+	cause, err := l.callInterruptible(nArgs, nResults, msgHandler, ctx.Done(), func(l *State) error {
+		if time.Now().Before(deadline) {
+			return nil
+		}
+		if l.CheckStack(1) {
+			Traceback(l, l, "", 0)
+			traceback, _ = l.ToString(-1)
+			l.Pop(1)
+		}
+		return errors.New(msg)
+	})
+	if cause != nil {
+		return &TimeoutError{Timeout: d, Traceback: traceback, err: err}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallTimeout(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := Require(state, GName, true, NewOpenBase(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.SetTop(0)
+
+	tests := []struct {
+		name          string
+		source        string
+		wantTraceback string
+	}{
+		{
+			name:          "Loop",
+			source:        "local function spin()\n  while true do end\nend\nspin()",
+			wantTraceback: "spin",
+		},
+		{
+			name:          "Caught",
+			source:        "local function spin()\n  while true do end\nend\npcall(spin)\nwhile true do end",
+			wantTraceback: "(test):5: in main chunk",
+		},
+		{
+			name:          "CaughtInLoop",
+			source:        "local function spin()\n  while true do end\nend\nwhile true do pcall(spin) end",
+			wantTraceback: "in main chunk",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer state.SetTop(0)
+			if err := state.LoadString(test.source, "=(test)", "t"); err != nil {
+				t.Fatal(err)
+			}
+			err := state.CallTimeout(10*time.Millisecond, 0, 0, 0)
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatalf("CallTimeout(...) = %v; want %v", err, ErrTimeout)
+			}
+			var timeoutError *TimeoutError
+			if !errors.As(err, &timeoutError) {
+				t.Fatalf("CallTimeout(...) = %#v; want *TimeoutError", err)
+			}
+			if timeoutError.Timeout != 10*time.Millisecond {
+				t.Errorf("Timeout = %v; want 10ms", timeoutError.Timeout)
+			}
+			if !strings.Contains(timeoutError.Traceback, test.wantTraceback) {
+				t.Errorf("Traceback = %q; want to contain %q", timeoutError.Traceback, test.wantTraceback)
+			}
+			if !strings.Contains(err.Error(), "timed out after 10ms") {
+				t.Errorf("Error() = %q; want to contain %q", err.Error(), "timed out after 10ms")
+			}
+			if f, mask, _ := state.Hook(); f != nil || mask != 0 {
+				t.Errorf("hook not removed after CallTimeout (mask = %v)", mask)
+			}
+		})
+	}
+
+	t.Run("Finishes", func(t *testing.T) {
+		defer state.SetTop(0)
+		if err := state.LoadString(`return 1 + 1`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.CallTimeout(time.Minute, 0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := state.ToInteger(-1); got != 2 {
+			t.Errorf("result = %d; want 2", got)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		defer state.SetTop(0)
+		if err := state.LoadString(`error("should not run")`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		err := state.CallTimeout(0, 0, 0, 0)
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("CallTimeout(0, ...) = %v; want %v", err, ErrTimeout)
+		}
+		if got := state.Top(); got != 1 {
+			t.Errorf("state.Top() = %d; want 1", got)
+		}
+	})
+
+	t.Run("OtherError", func(t *testing.T) {
+		defer state.SetTop(0)
+		if err := state.LoadString(`error("boom")`, "=(test)", "t"); err != nil {
+			t.Fatal(err)
+		}
+		err := state.CallTimeout(time.Minute, 0, 0, 0)
+		if err == nil || errors.Is(err, ErrTimeout) {
+			t.Errorf("CallTimeout(...) = %v; want non-timeout error", err)
+		}
+	})
+}
@@ -0,0 +1,262 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// traceRegistryKey is the registry key of the userdata
+	// that holds a state's *tracer.
+	traceRegistryKey = "zombiezen.com/go/lua.trace"
+	// traceMetatableName is the registry name
+	// of the trace userdata's metatable.
+	traceMetatableName = "*zombiezen.com/go/lua.tracer"
+)
+
+// TraceOptions is the set of parameters to [State.SetTrace].
+// At least one of Writer or Logger should be set.
+type TraceOptions struct {
+	// Writer receives a line of text for each traced call and return.
+	Writer io.Writer
+	// Logger receives a record for each traced call and return
+	// at the level given by Level.
+	// Call records have the message "lua call"
+	// and the attributes "direction", "function", "args", and "source".
+	// Return records have the message "lua return"
+	// and the attributes "direction", "function", and "duration".
+	Logger *slog.Logger
+	Level  slog.Level
+}
+
+// tracer holds the state of a trace hook.
+type tracer struct {
+	opts TraceOptions
+	id   HookID
+	// frames is the stack of active calls for each thread,
+	// keyed by the thread's pointer.
+	frames map[uintptr][]traceFrame
+}
+
+// traceFrame is a call that has not yet returned.
+type traceFrame struct {
+	// depth is the stack depth of the called function.
+	depth int
+	// direction is the empty string if the call did not cross
+	// between Lua and Go.
+	direction string
+	name      string
+	start     time.Time
+}
+
+// SetTrace starts tracing every call that crosses between Lua and Go:
+// Lua code calling a Go function and Go code calling a Lua function.
+// Each call is reported with the function's name,
+// the types of its arguments, and where it was called,
+// and each return is reported with the call's duration.
+// If opts is nil, SetTrace stops tracing.
+// Calling SetTrace again replaces the previous options,
+// so tracing can be turned on and off as the program runs.
+//
+// Tracing uses call and return hooks (see [State.AddHook])
+// that slow down every function call.
+// Calls in coroutines are only traced
+// if the coroutine was created after SetTrace was called.
+func (l *State) SetTrace(opts *TraceOptions) {
+	if !l.CheckStack(1) {
+		panic("stack overflow")
+	}
+	l.RawField(RegistryIndex, traceRegistryKey)
+	p := TestTypedUserdata[*tracer](l, -1, traceMetatableName)
+	l.Pop(1)
+	if p != nil {
+		t := *p
+		if opts != nil {
+			t.opts = *opts
+			return
+		}
+		l.RemoveHook(t.id)
+		l.PushNil()
+		l.RawSetField(RegistryIndex, traceRegistryKey)
+		return
+	}
+	if opts == nil {
+		return
+	}
+
+	t := &tracer{
+		opts:   *opts,
+		frames: make(map[uintptr][]traceFrame),
+	}
+	t.id = l.AddHook(func(l *State, event HookEvent, ar *ActivationRecord) error {
+		switch event {
+		case HookEventCall:
+			t.call(l, ar)
+		case HookEventReturn:
+			t.ret(l)
+		}
+		return nil
+	}, MaskCall|MaskReturn, 0)
+	NewUserdata(l, t, traceMetatableName)
+	l.RawSetField(RegistryIndex, traceRegistryKey)
+}
+
+func (t *tracer) call(l *State, ar *ActivationRecord) {
+	callee := ar.Info("nSu")
+	var caller *Debug
+	if car := l.Stack(1); car != nil {
+		caller = car.Info("Sl")
+	}
+	calleeIsGo := callee.What == "C"
+	callerIsGo := caller == nil || caller.What == "C"
+	f := traceFrame{
+		depth: stackDepth(l),
+		name:  traceFunctionName(callee),
+		start: time.Now(),
+	}
+	switch {
+	case calleeIsGo && !callerIsGo:
+		f.direction = "lua->go"
+	case !calleeIsGo && callerIsGo:
+		f.direction = "go->lua"
+	}
+	thread := threadPointer(l)
+	t.frames[thread] = append(t.frames[thread], f)
+	if f.direction == "" {
+		return
+	}
+
+	args := traceArgs(l, ar, callee)
+	var source string
+	if calleeIsGo {
+		source = fmt.Sprintf("%s:%d", caller.ShortSource, caller.CurrentLine)
+	} else {
+		source = fmt.Sprintf("%s:%d", callee.ShortSource, callee.LineDefined)
+	}
+	if t.opts.Writer != nil {
+		fmt.Fprintf(t.opts.Writer, "lua trace: call %s %s(%s) at %s\n", f.direction, f.name, args, source)
+	}
+	if t.opts.Logger != nil {
+		t.opts.Logger.LogAttrs(context.Background(), t.opts.Level, "lua call",
+			slog.String("direction", f.direction),
+			slog.String("function", f.name),
+			slog.String("args", args),
+			slog.String("source", source),
+		)
+	}
+}
+
+func (t *tracer) ret(l *State) {
+	thread := threadPointer(l)
+	frames := t.frames[thread]
+	depth := stackDepth(l)
+	// Calls that were unwound by an error never return.
+	for len(frames) > 0 && frames[len(frames)-1].depth > depth {
+		frames = frames[:len(frames)-1]
+	}
+	if len(frames) == 0 || frames[len(frames)-1].depth != depth {
+		t.frames[thread] = frames
+		return
+	}
+	f := frames[len(frames)-1]
+	frames = frames[:len(frames)-1]
+	if len(frames) == 0 {
+		delete(t.frames, thread)
+	} else {
+		t.frames[thread] = frames
+	}
+	if f.direction == "" {
+		return
+	}
+
+	d := time.Since(f.start)
+	if t.opts.Writer != nil {
+		fmt.Fprintf(t.opts.Writer, "lua trace: return %s %s (%v)\n", f.direction, f.name, d)
+	}
+	if t.opts.Logger != nil {
+		t.opts.Logger.LogAttrs(context.Background(), t.opts.Level, "lua return",
+			slog.String("direction", f.direction),
+			slog.String("function", f.name),
+			slog.Duration("duration", d),
+		)
+	}
+}
+
+// traceFunctionName returns a name for the function described by info.
+func traceFunctionName(info *Debug) string {
+	switch {
+	case info.Name != "":
+		return info.Name
+	case info.What == "main":
+		return "main chunk"
+	case info.What == "C":
+		return "?"
+	default:
+		return fmt.Sprintf("function <%s:%d>", info.ShortSource, info.LineDefined)
+	}
+}
+
+// traceArgs returns a comma-separated list of the types
+// of the arguments of the function that was just called.
+func traceArgs(l *State, ar *ActivationRecord, info *Debug) string {
+	if !l.CheckStack(1) {
+		return "?"
+	}
+	var types []string
+	addLocal := func(n int) bool {
+		if _, ok := ar.Local(n); !ok {
+			return false
+		}
+		types = append(types, l.Type(-1).String())
+		l.Pop(1)
+		return true
+	}
+	if info.What == "C" {
+		// A Go function's locals are its stack slots,
+		// which are its arguments when it is called.
+		for n := 1; addLocal(n); n++ {
+		}
+	} else {
+		for n := 1; n <= int(info.NumParams) && addLocal(n); n++ {
+		}
+		for n := -1; addLocal(n); n-- {
+		}
+	}
+	return strings.Join(types, ", ")
+}
+
+// threadPointer returns a pointer that identifies l's thread.
+func threadPointer(l *State) uintptr {
+	if !l.CheckStack(1) {
+		return 0
+	}
+	l.PushThread()
+	p := l.ToPointer(-1)
+	l.Pop(1)
+	return p
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetTrace(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+
+	state.PushClosure(0, func(l *State) (int, error) {
+		// Call back into Lua.
+		l.PushValue(1)
+		l.PushValue(2)
+		if err := l.Call(1, 1, 0); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+	if err := state.SetGlobal("apply", 0); err != nil {
+		t.Fatal(err)
+	}
+	const source = "local function double(x)\n" +
+		"  return x * 2\n" +
+		"end\n" +
+		"local function helper(y)\n" +
+		"  return y\n" +
+		"end\n" +
+		"return helper(apply(double, 21))\n"
+	run := func() {
+		t.Helper()
+		if err := state.LoadString(source, "=trace.lua", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Call(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := state.ToInteger(-1); got != 42 {
+			t.Errorf("result = %d; want 42", got)
+		}
+		state.Pop(1)
+	}
+
+	text := new(bytes.Buffer)
+	logs := new(bytes.Buffer)
+	state.SetTrace(&TraceOptions{
+		Writer: text,
+		Logger: slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Level:  slog.LevelDebug,
+	})
+	run()
+	for _, want := range []string{
+		"lua trace: call go->lua main chunk() at trace.lua:0\n",
+		"lua trace: call lua->go apply(function, number) at trace.lua:7\n",
+		"lua trace: call go->lua function <trace.lua:1>(number) at trace.lua:1\n",
+		"lua trace: return go->lua function <trace.lua:1> (",
+		"lua trace: return lua->go apply (",
+		"lua trace: return go->lua main chunk (",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("trace does not contain %q. Trace:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text.String(), "helper") {
+		t.Errorf("trace includes Lua-to-Lua call. Trace:\n%s", text)
+	}
+	for _, want := range []string{
+		`level=DEBUG msg="lua call" direction=lua->go function=apply args="function, number" source=trace.lua:7`,
+		`level=DEBUG msg="lua return" direction=lua->go function=apply duration=`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs do not contain %q. Logs:\n%s", want, logs)
+		}
+	}
+
+	state.SetTrace(nil)
+	if hook, _, _ := state.Hook(); hook != nil {
+		t.Error("hook still installed after SetTrace(nil)")
+	}
+	text.Reset()
+	run()
+	if text.Len() > 0 {
+		t.Errorf("after SetTrace(nil), trace = %q; want empty", text)
+	}
+}
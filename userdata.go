@@ -0,0 +1,144 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// goValueMetatableName is the registry name of the metatable
+// for the hidden userdata that owns a Go value pushed by [NewUserdata].
+const goValueMetatableName = "*zombiezen.com/go/lua.goValue"
+
+// NewUserdata pushes a new full userdata onto the stack
+// that holds a copy of v.
+// The userdata's metatable is set to the metatable associated with tname
+// in the registry, which is created with [NewMetatable] if it does not exist.
+// A metatable created by NewUserdata has a __tostring metamethod
+// that formats the Go value using its String or Error method if it has one
+// or with the %v verb of the fmt package otherwise.
+// A pointer to the copy can be retrieved with [CheckTypedUserdata]
+// or [TestTypedUserdata].
+//
+// The copy of v is released after the userdata is garbage collected.
+// Finalizers (__gc metamethods) in tname's metatable
+// may still access the value.
+func NewUserdata[T any](l *State, v T, tname string) error {
+	if err := createGoValueMetatable(l); err != nil {
+		return fmt.Errorf("lua: new userdata: %v", err)
+	}
+	p := new(T)
+	*p = v
+
+	// The owner is created (and marked for finalization) before the userdata
+	// so that Lua runs the userdata's finalizer first.
+	l.NewUserdataUV(int(unsafe.Sizeof(uintptr(0))), 0)
+	SetMetatable(l, goValueMetatableName)
+	setUintptr(l, -1, uintptr(l.state.NewHandle(p)))
+	l.NewUserdataUV(0, 1)
+	l.Rotate(-2, 1)
+	l.SetUserValue(-2, 1)
+	if NewMetatable(l, tname) {
+		l.PushClosure(0, goValueToString)
+		l.RawSetField(-2, "__tostring")
+	}
+	l.SetMetatable(-2)
+	return nil
+}
+
+// TestTypedUserdata returns a pointer to the Go value
+// held by the userdata at the given index.
+// TestTypedUserdata returns nil unless the value at the given index
+// was created by [NewUserdata] with a value of type T
+// and has the type tname (see [NewMetatable]).
+func TestTypedUserdata[T any](l *State, idx int, tname string) *T {
+	if TestUserdata(l, idx, tname) == nil {
+		return nil
+	}
+	l.UserValue(idx, 1)
+	handle := cgo.Handle(unmarshalUintptr(TestUserdata(l, -1, goValueMetatableName)))
+	l.Pop(1)
+	if handle == 0 {
+		return nil
+	}
+	p, _ := handle.Value().(*T)
+	return p
+}
+
+// CheckTypedUserdata returns a pointer to the Go value
+// held by the given userdata argument.
+// CheckTypedUserdata returns an error if the function argument arg
+// was not created by [NewUserdata] with a value of type T
+// or is not a userdata of the type tname (see [NewMetatable]).
+func CheckTypedUserdata[T any](l *State, arg int, tname string) (*T, error) {
+	p := TestTypedUserdata[T](l, arg, tname)
+	if p == nil {
+		return nil, NewTypeError(l, arg, tname)
+	}
+	return p, nil
+}
+
+func createGoValueMetatable(l *State) error {
+	if !NewMetatable(l, goValueMetatableName) {
+		l.Pop(1)
+		return nil
+	}
+	err := SetFuncs(l, 0, map[string]Function{
+		"__gc":        goValueGC,
+		"__metatable": nil, // prevent access to metatable
+	})
+	l.Pop(1)
+	return err
+}
+
+// goValueToString is the default __tostring metamethod
+// for userdata created by [NewUserdata].
+func goValueToString(l *State) (int, error) {
+	v, ok := goValue(l, 1)
+	if !ok {
+		l.PushString(fmt.Sprintf("%s: %#x", TypeName(l, 1), l.ToPointer(1)))
+		return 1, nil
+	}
+	switch v := v.(type) {
+	case fmt.Stringer:
+		l.PushString(v.String())
+	case error:
+		l.PushString(v.Error())
+	default:
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && !rv.IsNil() {
+			v = rv.Elem().Interface()
+		}
+		l.PushString(fmt.Sprintf("%v", v))
+	}
+	return 1, nil
+}
+
+func goValueGC(l *State) (int, error) {
+	if handle := cgo.Handle(unmarshalUintptr(TestUserdata(l, 1, goValueMetatableName))); handle != 0 {
+		l.state.DeleteHandle(handle)
+		setUintptr(l, 1, 0)
+	}
+	return 0, nil
+}
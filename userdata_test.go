@@ -0,0 +1,159 @@
+// Copyright 2023 Ross Light
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the “Software”), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNewUserdata(t *testing.T) {
+	type counter struct {
+		n int
+	}
+	const tname = "counter"
+
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewUserdata(state, counter{n: 40}, tname); err != nil {
+		t.Fatal(err)
+	}
+	c := TestTypedUserdata[counter](state, -1, tname)
+	if c == nil {
+		t.Fatal("TestTypedUserdata[counter](...) = <nil>")
+	}
+	if got := TestTypedUserdata[int](state, -1, tname); got != nil {
+		t.Errorf("TestTypedUserdata[int](...) = %p; want <nil>", got)
+	}
+	if got := TestTypedUserdata[counter](state, -1, "other"); got != nil {
+		t.Errorf("TestTypedUserdata[counter](..., \"other\") = %p; want <nil>", got)
+	}
+	state.SetGlobal("c", 0)
+
+	// Add a method that uses the value.
+	NewMetatable(state, tname)
+	state.PushClosure(0, func(l *State) (int, error) {
+		c, err := CheckTypedUserdata[counter](l, 1, tname)
+		if err != nil {
+			return 0, err
+		}
+		c.n++
+		l.PushInteger(int64(c.n))
+		return 1, nil
+	})
+	state.RawSetField(-2, "__call")
+	state.Pop(1)
+
+	if err := state.LoadString("return c() + c()", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := state.ToInteger(-1); got != 41+42 {
+		t.Errorf("c() + c() = %d; want %d", got, 41+42)
+	}
+	if c.n != 42 {
+		t.Errorf("after calls, c.n = %d; want 42", c.n)
+	}
+	state.SetTop(0)
+
+	// Type mismatches are argument errors.
+	if err := NewUserdata(state, "not a counter", tname); err != nil {
+		t.Fatal(err)
+	}
+	state.SetGlobal("s", 0)
+	if err := state.LoadString("return s()", "=(load)", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 1, 0); err == nil {
+		t.Error("s() did not return an error")
+	} else if got, want := err.Error(), "counter expected"; !strings.Contains(got, want) {
+		t.Errorf("s() error = %q; want to contain %q", got, want)
+	}
+	state.SetTop(0)
+
+	// Collecting the userdata releases the Go value.
+	state.GC()
+	base := state.HandleCount()
+	state.PushNil()
+	state.SetGlobal("c", 0)
+	state.PushNil()
+	state.SetGlobal("s", 0)
+	state.GC()
+	if got, want := state.HandleCount(), base-2; got != want {
+		t.Errorf("after GC, HandleCount() = %d; want %d", got, want)
+	}
+}
+
+type testStringer struct{ name string }
+
+func (s testStringer) String() string { return "stringer " + s.name }
+
+func TestNewUserdataToString(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	if err := OpenLibraries(state); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"Stringer", testStringer{"foo"}, "stringer foo"},
+		{"Error", errors.New("bork"), "bork"},
+		{"Default", struct{ X, Y int }{1, 2}, "{1 2}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer state.SetTop(0)
+			if err := NewUserdata(state, test.value, "test."+test.name); err != nil {
+				t.Fatal(err)
+			}
+			if err := state.LoadString("return tostring(...)", "=(load)", "t"); err != nil {
+				t.Fatal(err)
+			}
+			state.Rotate(-2, 1)
+			if err := state.Call(1, 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := state.ToString(-1); got != test.want {
+				t.Errorf("tostring(v) = %q; want %q", got, test.want)
+			}
+		})
+	}
+}